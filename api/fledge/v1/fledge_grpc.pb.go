@@ -0,0 +1,610 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/fledge/v1/fledge.proto
+
+// The gRPC API of fledge serve, an alternative to its HTTP endpoints for
+// the Volant control plane and other services. Regenerate the Go code with
+// `make proto` after editing this file.
+
+package fledgev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	BuildService_StartBuild_FullMethodName = "/fledge.v1.BuildService/StartBuild"
+	BuildService_Build_FullMethodName      = "/fledge.v1.BuildService/Build"
+	BuildService_GetJob_FullMethodName     = "/fledge.v1.BuildService/GetJob"
+	BuildService_ListJobs_FullMethodName   = "/fledge.v1.BuildService/ListJobs"
+	BuildService_CancelJob_FullMethodName  = "/fledge.v1.BuildService/CancelJob"
+	BuildService_WatchJob_FullMethodName   = "/fledge.v1.BuildService/WatchJob"
+)
+
+// BuildServiceClient is the client API for BuildService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BuildServiceClient interface {
+	// StartBuild queues a build and returns its job at once. It fails with
+	// RESOURCE_EXHAUSTED when the build queue is full.
+	StartBuild(ctx context.Context, in *StartBuildRequest, opts ...grpc.CallOption) (*Job, error)
+	// Build starts a build like StartBuild and streams its events until the
+	// job finishes; the last event carries the finished job.
+	Build(ctx context.Context, in *StartBuildRequest, opts ...grpc.CallOption) (BuildService_BuildClient, error)
+	// GetJob returns the current state of a job.
+	GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// ListJobs returns the jobs the daemon remembers, newest first.
+	ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error)
+	// CancelJob stops a queued or running job.
+	CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// WatchJob streams the log of a job from its start, then follows it
+	// until the job finishes.
+	WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (BuildService_WatchJobClient, error)
+}
+
+type buildServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBuildServiceClient(cc grpc.ClientConnInterface) BuildServiceClient {
+	return &buildServiceClient{cc}
+}
+
+func (c *buildServiceClient) StartBuild(ctx context.Context, in *StartBuildRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, BuildService_StartBuild_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *buildServiceClient) Build(ctx context.Context, in *StartBuildRequest, opts ...grpc.CallOption) (BuildService_BuildClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BuildService_ServiceDesc.Streams[0], BuildService_Build_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &buildServiceBuildClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type BuildService_BuildClient interface {
+	Recv() (*JobEvent, error)
+	grpc.ClientStream
+}
+
+type buildServiceBuildClient struct {
+	grpc.ClientStream
+}
+
+func (x *buildServiceBuildClient) Recv() (*JobEvent, error) {
+	m := new(JobEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *buildServiceClient) GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, BuildService_GetJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *buildServiceClient) ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error) {
+	out := new(ListJobsResponse)
+	err := c.cc.Invoke(ctx, BuildService_ListJobs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *buildServiceClient) CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, BuildService_CancelJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *buildServiceClient) WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (BuildService_WatchJobClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BuildService_ServiceDesc.Streams[1], BuildService_WatchJob_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &buildServiceWatchJobClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type BuildService_WatchJobClient interface {
+	Recv() (*JobEvent, error)
+	grpc.ClientStream
+}
+
+type buildServiceWatchJobClient struct {
+	grpc.ClientStream
+}
+
+func (x *buildServiceWatchJobClient) Recv() (*JobEvent, error) {
+	m := new(JobEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// BuildServiceServer is the server API for BuildService service.
+// All implementations must embed UnimplementedBuildServiceServer
+// for forward compatibility
+type BuildServiceServer interface {
+	// StartBuild queues a build and returns its job at once. It fails with
+	// RESOURCE_EXHAUSTED when the build queue is full.
+	StartBuild(context.Context, *StartBuildRequest) (*Job, error)
+	// Build starts a build like StartBuild and streams its events until the
+	// job finishes; the last event carries the finished job.
+	Build(*StartBuildRequest, BuildService_BuildServer) error
+	// GetJob returns the current state of a job.
+	GetJob(context.Context, *GetJobRequest) (*Job, error)
+	// ListJobs returns the jobs the daemon remembers, newest first.
+	ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error)
+	// CancelJob stops a queued or running job.
+	CancelJob(context.Context, *CancelJobRequest) (*Job, error)
+	// WatchJob streams the log of a job from its start, then follows it
+	// until the job finishes.
+	WatchJob(*WatchJobRequest, BuildService_WatchJobServer) error
+	mustEmbedUnimplementedBuildServiceServer()
+}
+
+// UnimplementedBuildServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedBuildServiceServer struct {
+}
+
+func (UnimplementedBuildServiceServer) StartBuild(context.Context, *StartBuildRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartBuild not implemented")
+}
+func (UnimplementedBuildServiceServer) Build(*StartBuildRequest, BuildService_BuildServer) error {
+	return status.Errorf(codes.Unimplemented, "method Build not implemented")
+}
+func (UnimplementedBuildServiceServer) GetJob(context.Context, *GetJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJob not implemented")
+}
+func (UnimplementedBuildServiceServer) ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListJobs not implemented")
+}
+func (UnimplementedBuildServiceServer) CancelJob(context.Context, *CancelJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+func (UnimplementedBuildServiceServer) WatchJob(*WatchJobRequest, BuildService_WatchJobServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJob not implemented")
+}
+func (UnimplementedBuildServiceServer) mustEmbedUnimplementedBuildServiceServer() {}
+
+// UnsafeBuildServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BuildServiceServer will
+// result in compilation errors.
+type UnsafeBuildServiceServer interface {
+	mustEmbedUnimplementedBuildServiceServer()
+}
+
+func RegisterBuildServiceServer(s grpc.ServiceRegistrar, srv BuildServiceServer) {
+	s.RegisterService(&BuildService_ServiceDesc, srv)
+}
+
+func _BuildService_StartBuild_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartBuildRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BuildServiceServer).StartBuild(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BuildService_StartBuild_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BuildServiceServer).StartBuild(ctx, req.(*StartBuildRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BuildService_Build_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StartBuildRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BuildServiceServer).Build(m, &buildServiceBuildServer{stream})
+}
+
+type BuildService_BuildServer interface {
+	Send(*JobEvent) error
+	grpc.ServerStream
+}
+
+type buildServiceBuildServer struct {
+	grpc.ServerStream
+}
+
+func (x *buildServiceBuildServer) Send(m *JobEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _BuildService_GetJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BuildServiceServer).GetJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BuildService_GetJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BuildServiceServer).GetJob(ctx, req.(*GetJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BuildService_ListJobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListJobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BuildServiceServer).ListJobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BuildService_ListJobs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BuildServiceServer).ListJobs(ctx, req.(*ListJobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BuildService_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BuildServiceServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BuildService_CancelJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BuildServiceServer).CancelJob(ctx, req.(*CancelJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BuildService_WatchJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchJobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BuildServiceServer).WatchJob(m, &buildServiceWatchJobServer{stream})
+}
+
+type BuildService_WatchJobServer interface {
+	Send(*JobEvent) error
+	grpc.ServerStream
+}
+
+type buildServiceWatchJobServer struct {
+	grpc.ServerStream
+}
+
+func (x *buildServiceWatchJobServer) Send(m *JobEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// BuildService_ServiceDesc is the grpc.ServiceDesc for BuildService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BuildService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fledge.v1.BuildService",
+	HandlerType: (*BuildServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StartBuild",
+			Handler:    _BuildService_StartBuild_Handler,
+		},
+		{
+			MethodName: "GetJob",
+			Handler:    _BuildService_GetJob_Handler,
+		},
+		{
+			MethodName: "ListJobs",
+			Handler:    _BuildService_ListJobs_Handler,
+		},
+		{
+			MethodName: "CancelJob",
+			Handler:    _BuildService_CancelJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Build",
+			Handler:       _BuildService_Build_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchJob",
+			Handler:       _BuildService_WatchJob_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/fledge/v1/fledge.proto",
+}
+
+const (
+	ArtifactService_ListArtifacts_FullMethodName    = "/fledge.v1.ArtifactService/ListArtifacts"
+	ArtifactService_GetArtifact_FullMethodName      = "/fledge.v1.ArtifactService/GetArtifact"
+	ArtifactService_DownloadArtifact_FullMethodName = "/fledge.v1.ArtifactService/DownloadArtifact"
+	ArtifactService_PublishArtifact_FullMethodName  = "/fledge.v1.ArtifactService/PublishArtifact"
+)
+
+// ArtifactServiceClient is the client API for ArtifactService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ArtifactServiceClient interface {
+	// ListArtifacts returns the stored artifacts, newest first.
+	ListArtifacts(ctx context.Context, in *ListArtifactsRequest, opts ...grpc.CallOption) (*ListArtifactsResponse, error)
+	// GetArtifact returns the metadata of an artifact.
+	GetArtifact(ctx context.Context, in *GetArtifactRequest, opts ...grpc.CallOption) (*Artifact, error)
+	// DownloadArtifact streams the artifact file, or its manifest.json.
+	DownloadArtifact(ctx context.Context, in *DownloadArtifactRequest, opts ...grpc.CallOption) (ArtifactService_DownloadArtifactClient, error)
+	// PublishArtifact registers the artifact and its manifest with the
+	// Volant API fledge serve was started with.
+	PublishArtifact(ctx context.Context, in *PublishArtifactRequest, opts ...grpc.CallOption) (*PublishArtifactResponse, error)
+}
+
+type artifactServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewArtifactServiceClient(cc grpc.ClientConnInterface) ArtifactServiceClient {
+	return &artifactServiceClient{cc}
+}
+
+func (c *artifactServiceClient) ListArtifacts(ctx context.Context, in *ListArtifactsRequest, opts ...grpc.CallOption) (*ListArtifactsResponse, error) {
+	out := new(ListArtifactsResponse)
+	err := c.cc.Invoke(ctx, ArtifactService_ListArtifacts_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *artifactServiceClient) GetArtifact(ctx context.Context, in *GetArtifactRequest, opts ...grpc.CallOption) (*Artifact, error) {
+	out := new(Artifact)
+	err := c.cc.Invoke(ctx, ArtifactService_GetArtifact_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *artifactServiceClient) DownloadArtifact(ctx context.Context, in *DownloadArtifactRequest, opts ...grpc.CallOption) (ArtifactService_DownloadArtifactClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ArtifactService_ServiceDesc.Streams[0], ArtifactService_DownloadArtifact_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &artifactServiceDownloadArtifactClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ArtifactService_DownloadArtifactClient interface {
+	Recv() (*DownloadArtifactResponse, error)
+	grpc.ClientStream
+}
+
+type artifactServiceDownloadArtifactClient struct {
+	grpc.ClientStream
+}
+
+func (x *artifactServiceDownloadArtifactClient) Recv() (*DownloadArtifactResponse, error) {
+	m := new(DownloadArtifactResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *artifactServiceClient) PublishArtifact(ctx context.Context, in *PublishArtifactRequest, opts ...grpc.CallOption) (*PublishArtifactResponse, error) {
+	out := new(PublishArtifactResponse)
+	err := c.cc.Invoke(ctx, ArtifactService_PublishArtifact_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ArtifactServiceServer is the server API for ArtifactService service.
+// All implementations must embed UnimplementedArtifactServiceServer
+// for forward compatibility
+type ArtifactServiceServer interface {
+	// ListArtifacts returns the stored artifacts, newest first.
+	ListArtifacts(context.Context, *ListArtifactsRequest) (*ListArtifactsResponse, error)
+	// GetArtifact returns the metadata of an artifact.
+	GetArtifact(context.Context, *GetArtifactRequest) (*Artifact, error)
+	// DownloadArtifact streams the artifact file, or its manifest.json.
+	DownloadArtifact(*DownloadArtifactRequest, ArtifactService_DownloadArtifactServer) error
+	// PublishArtifact registers the artifact and its manifest with the
+	// Volant API fledge serve was started with.
+	PublishArtifact(context.Context, *PublishArtifactRequest) (*PublishArtifactResponse, error)
+	mustEmbedUnimplementedArtifactServiceServer()
+}
+
+// UnimplementedArtifactServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedArtifactServiceServer struct {
+}
+
+func (UnimplementedArtifactServiceServer) ListArtifacts(context.Context, *ListArtifactsRequest) (*ListArtifactsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListArtifacts not implemented")
+}
+func (UnimplementedArtifactServiceServer) GetArtifact(context.Context, *GetArtifactRequest) (*Artifact, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetArtifact not implemented")
+}
+func (UnimplementedArtifactServiceServer) DownloadArtifact(*DownloadArtifactRequest, ArtifactService_DownloadArtifactServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadArtifact not implemented")
+}
+func (UnimplementedArtifactServiceServer) PublishArtifact(context.Context, *PublishArtifactRequest) (*PublishArtifactResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PublishArtifact not implemented")
+}
+func (UnimplementedArtifactServiceServer) mustEmbedUnimplementedArtifactServiceServer() {}
+
+// UnsafeArtifactServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ArtifactServiceServer will
+// result in compilation errors.
+type UnsafeArtifactServiceServer interface {
+	mustEmbedUnimplementedArtifactServiceServer()
+}
+
+func RegisterArtifactServiceServer(s grpc.ServiceRegistrar, srv ArtifactServiceServer) {
+	s.RegisterService(&ArtifactService_ServiceDesc, srv)
+}
+
+func _ArtifactService_ListArtifacts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListArtifactsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArtifactServiceServer).ListArtifacts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ArtifactService_ListArtifacts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArtifactServiceServer).ListArtifacts(ctx, req.(*ListArtifactsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ArtifactService_GetArtifact_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetArtifactRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArtifactServiceServer).GetArtifact(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ArtifactService_GetArtifact_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArtifactServiceServer).GetArtifact(ctx, req.(*GetArtifactRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ArtifactService_DownloadArtifact_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadArtifactRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ArtifactServiceServer).DownloadArtifact(m, &artifactServiceDownloadArtifactServer{stream})
+}
+
+type ArtifactService_DownloadArtifactServer interface {
+	Send(*DownloadArtifactResponse) error
+	grpc.ServerStream
+}
+
+type artifactServiceDownloadArtifactServer struct {
+	grpc.ServerStream
+}
+
+func (x *artifactServiceDownloadArtifactServer) Send(m *DownloadArtifactResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ArtifactService_PublishArtifact_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishArtifactRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArtifactServiceServer).PublishArtifact(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ArtifactService_PublishArtifact_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArtifactServiceServer).PublishArtifact(ctx, req.(*PublishArtifactRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ArtifactService_ServiceDesc is the grpc.ServiceDesc for ArtifactService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ArtifactService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fledge.v1.ArtifactService",
+	HandlerType: (*ArtifactServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListArtifacts",
+			Handler:    _ArtifactService_ListArtifacts_Handler,
+		},
+		{
+			MethodName: "GetArtifact",
+			Handler:    _ArtifactService_GetArtifact_Handler,
+		},
+		{
+			MethodName: "PublishArtifact",
+			Handler:    _ArtifactService_PublishArtifact_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "DownloadArtifact",
+			Handler:       _ArtifactService_DownloadArtifact_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/fledge/v1/fledge.proto",
+}
@@ -0,0 +1,18 @@
+// Fledge - Volant Plugin Builder
+// Copyright (c) 2025 HYPR. PTE. LTD.
+// Licensed under the Business Source License 1.1
+
+// Command fledge-agent runs inside build microVMs. It executes the step
+// command and streams its output and exit code to the fledge executor over
+// vsock. Build it statically (CGO_ENABLED=0) so it runs in any rootfs.
+package main
+
+import (
+	"os"
+
+	"github.com/volantvm/fledge/internal/vsock"
+)
+
+func main() {
+	os.Exit(vsock.RunGuest(os.Args[1:]))
+}
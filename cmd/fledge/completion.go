@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+	"github.com/volantvm/fledge/internal/config"
+)
+
+func newManCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "man [DIR]",
+		Short: "Generate man pages for fledge and its commands",
+		Long: `Write a man page for fledge and each of its commands to DIR (default man),
+e.g. fledge.1 and fledge-build.1. Set SOURCE_DATE_EPOCH for reproducible dates.`,
+		Example: `  # Install the man pages system-wide
+  fledge man /usr/local/share/man/man1`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := "man"
+			if len(args) == 1 {
+				dir = args[0]
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", dir, err)
+			}
+			root := cmd.Root()
+			root.DisableAutoGenTag = true
+			header := &doc.GenManHeader{
+				Title:   "FLEDGE",
+				Section: "1",
+				Source:  "fledge " + version,
+				Manual:  "Fledge Manual",
+			}
+			if err := doc.GenManTree(root, header, dir); err != nil {
+				return fmt.Errorf("failed to generate man pages: %w", err)
+			}
+			fmt.Printf("Wrote man pages to %s\n", dir)
+			return nil
+		},
+	}
+}
+
+// completeValues completes a flag from a fixed list of values.
+func completeValues(values ...string) completionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeTOML completes a flag naming a .toml file.
+func completeTOML(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{"toml"}, cobra.ShellCompDirectiveFilterFileExt
+}
+
+// completeDirs completes a flag naming a directory.
+func completeDirs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return nil, cobra.ShellCompDirectiveFilterDirs
+}
+
+// completeSet completes --set with fledge.toml keys, and then with the
+// values of keys that take one of a fixed set, such as strategy and
+// filesystem.type.
+func completeSet(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	key, _, hasValue := strings.Cut(toComplete, "=")
+	var completions []string
+	if !hasValue {
+		for _, k := range config.OverrideKeys() {
+			if strings.HasPrefix(k, key) {
+				completions = append(completions, k+"=")
+			}
+		}
+		return completions, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+	}
+	for _, value := range config.OverrideValues(key) {
+		if candidate := key + "=" + value; strings.HasPrefix(candidate, toComplete) {
+			completions = append(completions, candidate)
+		}
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+type completionFunc = func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective)
+
+// registerCompletions sets the completion functions of cmd's flags that
+// complete something other than file names.
+func registerCompletions(cmd *cobra.Command, fns map[string]completionFunc) {
+	for name, fn := range fns {
+		if err := cmd.RegisterFlagCompletionFunc(name, fn); err != nil {
+			panic(err) // unknown flag: a programming error
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/volantvm/fledge/internal/builder"
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/hostcaps"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+func newConvertCommand() *cobra.Command {
+	var (
+		to               string
+		outputPath       string
+		populate         string
+		compressionLevel int
+		sizeBufferMB     int
+		skipVerify       bool
+		sha512           bool
+		noReport         bool
+		tempDir          string
+	)
+	cmd := &cobra.Command{
+		Use:   "convert <artifact>",
+		Short: "Repack a rootfs image as another filesystem type",
+		Long: `Repack a built rootfs image as another filesystem type (squashfs, ext4, xfs
+or btrfs) without rebuilding it from its sources: a squashfs image is
+unpacked and a block image is mounted read-only, and its contents are packed
+as a build of the new type would pack them. The artifact's manifest.json, if
+any, is carried over with the new image's format and checksum.
+
+An initramfs cannot be converted: it boots through its own /init rather than
+as a root filesystem.`,
+		Example: `  # Repack an ext4 image as squashfs, writing plugin.squashfs
+  sudo fledge convert plugin.img --to squashfs
+
+  # Repack a squashfs image as ext4 at a chosen path
+  sudo fledge convert plugin.squashfs --to ext4 -o plugin-rw.img`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireLinux("convert"); err != nil {
+				return err
+			}
+			ctx := cmd.Context()
+			input, err := filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+			from, err := builder.DetectImageFormat(input)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case populate != "" && populate != config.PopulateMkfs && populate != config.PopulateMount:
+				return fmt.Errorf("invalid --populate %q, must be mkfs or mount", populate)
+			case populate == config.PopulateMkfs && to == "xfs":
+				return fmt.Errorf("--populate mkfs is not supported for xfs, whose mkfs cannot copy a directory in")
+			case compressionLevel < 0 || compressionLevel > 22:
+				return fmt.Errorf("--compression-level must be between 0-22, got %d", compressionLevel)
+			case sizeBufferMB < 0:
+				return fmt.Errorf("--size-buffer-mb must be non-negative, got %d", sizeBufferMB)
+			}
+			fs := convertFilesystem(to, populate, compressionLevel, sizeBufferMB)
+			output := outputPath
+			if output == "" {
+				output = builder.ConvertedOutputPath(input, to)
+			}
+			if output, err = filepath.Abs(output); err != nil {
+				return err
+			}
+			if output == input {
+				return fmt.Errorf("output %s would overwrite the input", output)
+			}
+
+			if err := applyTempDir(tempDir, nil, ""); err != nil {
+				return err
+			}
+			if err := hostcaps.Check(builder.ConvertNeeds(from, fs)...); err != nil {
+				return err
+			}
+			checksums := []string{builder.ChecksumSHA256}
+			if sha512 {
+				checksums = append(checksums, builder.ChecksumSHA512)
+			}
+			return runReported(ctx, config.StrategyOCIRootfs, output, noReport, func(rep *report.Report) error {
+				c := &builder.ImageConverter{
+					InputPath:  input,
+					OutputPath: output,
+					Filesystem: fs,
+					SkipVerify: skipVerify,
+					Checksums:  checksums,
+					Report:     rep,
+				}
+				return c.Convert(ctx)
+			})
+		},
+	}
+	cmd.Flags().StringVar(&to, "to", "", "filesystem type to convert to: "+strings.Join(config.FilesystemTypes, ", "))
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "", "output file path (default: the artifact's name with the new type's extension)")
+	cmd.Flags().StringVar(&populate, "populate", "", "how an ext4, xfs or btrfs image is filled: mkfs or mount (default as for filesystem.populate)")
+	cmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "squashfs compression level, 1-22 (default as for filesystem.compression_level)")
+	cmd.Flags().IntVar(&sizeBufferMB, "size-buffer-mb", 0, "free space left in an ext4, xfs or btrfs image, in MB")
+	cmd.Flags().BoolVar(&skipVerify, "skip-verify", false, "do not check the new image with e2fsck, xfs_repair, btrfs check or unsquashfs")
+	cmd.Flags().BoolVar(&sha512, "sha512", false, "also write <output>.sha512 next to <output>.sha256")
+	cmd.Flags().BoolVar(&noReport, "no-report", false, "do not write <output>.report.json with step timings and sizes")
+	cmd.Flags().StringVar(&tempDir, "workdir", "", "scratch directory for the unpacked image (or FLEDGE_WORKDIR; default TMPDIR)")
+	cmd.MarkFlagRequired("to")
+	registerCompletions(cmd, map[string]completionFunc{
+		"to":       completeValues(config.FilesystemTypes...),
+		"populate": completeValues(config.PopulateMkfs, config.PopulateMount),
+		"workdir":  completeDirs,
+	})
+	return cmd
+}
+
+// convertFilesystem returns the [filesystem] settings of converting to
+// fsType, defaulted as a fledge.toml build of that type would be.
+func convertFilesystem(fsType, populate string, compressionLevel, sizeBufferMB int) *config.FilesystemConfig {
+	defaults := config.DefaultFilesystemConfig()
+	fs := &config.FilesystemConfig{
+		Type:         fsType,
+		SizeBufferMB: sizeBufferMB,
+	}
+	if fsType == "squashfs" {
+		fs.CompressionLevel = compressionLevel
+		if fs.CompressionLevel == 0 {
+			fs.CompressionLevel = defaults.CompressionLevel
+		}
+		fs.OverlaySize = defaults.OverlaySize
+		return fs
+	}
+	fs.Populate = populate
+	if fs.Populate == "" {
+		fs.Populate = config.DefaultPopulate(fsType)
+	}
+	return fs
+}
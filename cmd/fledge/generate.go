@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/volantvm/fledge/internal/cigen"
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+)
+
+func newGenerateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate files for working with fledge builds",
+	}
+	cmd.AddCommand(newGenerateCICommand())
+	return cmd
+}
+
+func newGenerateCICommand() *cobra.Command {
+	var (
+		github     bool
+		gitlab     bool
+		configPath string
+		outputPath string
+		force      bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "ci",
+		Short: "Generate a CI pipeline that builds, verifies and publishes the plugin",
+		Long: `Generate a GitHub Actions workflow or GitLab CI pipeline for the plugin of
+fledge.toml. It installs the host tools the build needs and fledge itself,
+caches downloads, builds with --locked when fledge.lock exists, checks the
+artifact's checksum, uploads dist/ and publishes tagged releases with
+fledge publish. Run it from the repository root.`,
+		Example: `  # Write .github/workflows/fledge.yml
+  fledge generate ci --github
+
+  # Write .gitlab-ci.yml for a plugin in a subdirectory
+  fledge generate ci --gitlab -c plugins/nginx/fledge.toml
+
+  # Print the workflow instead of writing it
+  fledge generate ci --github -o -`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var provider string
+			switch {
+			case github && gitlab:
+				return fmt.Errorf("--github and --gitlab cannot be combined")
+			case github:
+				provider = cigen.ProviderGitHub
+			case gitlab:
+				provider = cigen.ProviderGitLab
+			default:
+				return fmt.Errorf("one of --github or --gitlab is required")
+			}
+
+			// Loaded without loadConfig's logging, which would end up in
+			// the pipeline with -o -
+			cfg, err := config.LoadWithOverrides(configPath, nil)
+			if err != nil {
+				return fmt.Errorf("failed to parse config: %w", err)
+			}
+			rel, err := repoRelative(configPath)
+			if err != nil {
+				return err
+			}
+			_, lockErr := os.Stat(filepath.Join(filepath.Dir(configPath), lock.FileName))
+			pipeline, err := cigen.Generate(provider, cigen.Options{
+				Config:     cfg,
+				ConfigPath: rel,
+				Artifact:   filepath.Base(determineOutputPath(cfg, "")),
+				Locked:     lockErr == nil,
+				Version:    version,
+			})
+			if err != nil {
+				return err
+			}
+
+			if outputPath == "-" {
+				_, err := os.Stdout.Write(pipeline)
+				return err
+			}
+			if outputPath == "" {
+				outputPath = cigen.DefaultPath(provider)
+			}
+			if _, err := os.Stat(outputPath); err == nil && !force {
+				return fmt.Errorf("%s already exists (use --force to overwrite)", outputPath)
+			}
+			if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", filepath.Dir(outputPath), err)
+			}
+			if err := os.WriteFile(outputPath, pipeline, 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", outputPath, err)
+			}
+			fmt.Printf("Wrote %s\n", outputPath)
+			if lockErr != nil {
+				fmt.Printf("Commit %s and regenerate to build with --locked\n", filepath.Join(filepath.Dir(configPath), lock.FileName))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&github, "github", false, "generate a GitHub Actions workflow")
+	cmd.Flags().BoolVar(&gitlab, "gitlab", false, "generate a GitLab CI pipeline")
+	cmd.Flags().StringVarP(&configPath, "config", "c", "fledge.toml", "path to fledge.toml (build configuration)")
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "", "file to write, or - for stdout (default .github/workflows/fledge.yml or .gitlab-ci.yml)")
+	cmd.Flags().BoolVar(&force, "force", false, "overwrite an existing pipeline")
+	registerCompletions(cmd, map[string]completionFunc{"config": completeTOML})
+
+	return cmd
+}
+
+// repoRelative returns path relative to the current directory, which is
+// taken to be the repository root, with forward slashes.
+func repoRelative(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || filepath.IsAbs(rel) || len(rel) > 2 && rel[:3] == ".."+string(filepath.Separator) {
+		return "", fmt.Errorf("%s is outside the current directory; run fledge generate ci from the repository root", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
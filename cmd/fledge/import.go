@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/volantvm/fledge/internal/compose"
+	"github.com/volantvm/fledge/internal/scaffold"
+)
+
+func newImportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Create a plugin from an existing container setup",
+	}
+	cmd.AddCommand(newImportComposeCommand())
+	return cmd
+}
+
+func newImportComposeCommand() *cobra.Command {
+	var (
+		service string
+		name    string
+		dir     string
+		force   bool
+	)
+	cmd := &cobra.Command{
+		Use:   "compose [docker-compose.yml]",
+		Short: "Generate fledge.toml and manifest.toml from a docker-compose service",
+		Long: `Generate fledge.toml and manifest.toml for a docker-compose service: its image
+or build, command, environment (env_file included), ports, resource limits,
+sysctls and bind mounts, which are copied into the artifact. Variables are
+interpolated from the environment and .env as docker compose does.
+
+What a plugin cannot express, such as named volumes, depends_on or
+healthcheck, is listed as notes, printed and written at the top of
+fledge.toml. Existing files are left alone unless --force is given.`,
+		Example: `  # Import the only service of ./docker-compose.yml
+  fledge import compose
+
+  # Import the web service into plugins/web
+  fledge import compose deploy/compose.yml --service web -o plugins/web`,
+		Args: cobra.MaximumNArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return []string{"yml", "yaml"}, cobra.ShellCompDirectiveFilterFileExt
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := "docker-compose.yml"
+			if len(args) == 1 {
+				path = args[0]
+			} else if _, err := os.Stat(path); err != nil {
+				if _, err := os.Stat("compose.yaml"); err == nil {
+					path = "compose.yaml"
+				}
+			}
+			f, err := compose.Load(path)
+			if err != nil {
+				return err
+			}
+			composeDir, err := filepath.Abs(filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			outDir, err := filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+			if service == "" && len(f.Services) == 1 {
+				service = f.ServiceNames()[0]
+			}
+			if name == "" {
+				name = service
+			}
+			pluginName := scaffold.PluginName(name)
+			if pluginName == "" && name != "" {
+				return fmt.Errorf("plugin name %q has no letters or digits", name)
+			}
+			plugin, err := f.Import(service, compose.Options{
+				ComposeDir: composeDir,
+				OutDir:     outDir,
+				Name:       pluginName,
+				Source:     filepath.Base(path),
+			})
+			if err != nil {
+				return err
+			}
+
+			files := []struct {
+				name string
+				data []byte
+			}{
+				{"fledge.toml", plugin.FledgeTOML},
+				{"manifest.toml", plugin.ManifestTOML},
+			}
+			if !force {
+				for _, file := range files {
+					if _, err := os.Lstat(filepath.Join(dir, file.name)); err == nil {
+						return fmt.Errorf("%s already exists (use --force to overwrite)", filepath.Join(dir, file.name))
+					}
+				}
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", dir, err)
+			}
+			for _, file := range files {
+				target := filepath.Join(dir, file.name)
+				if err := os.WriteFile(target, file.data, 0644); err != nil {
+					return fmt.Errorf("failed to write %s: %w", target, err)
+				}
+				fmt.Printf("Wrote %s\n", target)
+			}
+			for _, note := range plugin.Notes {
+				fmt.Printf("Note: %s\n", note)
+			}
+			if dir == "." {
+				fmt.Println("Build it with: sudo fledge build")
+			} else {
+				fmt.Printf("Build it with: cd %s && sudo fledge build\n", dir)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&service, "service", "", "service to import (default: the only one)")
+	cmd.Flags().StringVar(&name, "name", "", "plugin name (default: the service's name)")
+	cmd.Flags().StringVarP(&dir, "output", "o", ".", "directory to write fledge.toml and manifest.toml to")
+	cmd.Flags().BoolVar(&force, "force", false, "overwrite existing files")
+	registerCompletions(cmd, map[string]completionFunc{"output": completeDirs})
+	return cmd
+}
@@ -5,19 +5,37 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/volantvm/fledge/internal/builder"
+	"github.com/volantvm/fledge/internal/buildinfo"
 	_ "github.com/volantvm/fledge/internal/buildkit"
 	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/hostcaps"
+	"github.com/volantvm/fledge/internal/ledger"
+	"github.com/volantvm/fledge/internal/lock"
 	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/privsep"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/publish"
+	"github.com/volantvm/fledge/internal/report"
 	"github.com/volantvm/fledge/internal/server"
+	"github.com/volantvm/fledge/internal/store"
+	"github.com/volantvm/fledge/internal/telemetry"
+	"github.com/volantvm/fledge/internal/utils"
 )
 
 var (
@@ -29,11 +47,46 @@ var (
 	// Global flags
 	verbose bool
 	quiet   bool
+	logFile   string
+	logFormat string
 )
 
 func main() {
-	if err := newRootCommand().Execute(); err != nil {
+	// The privileged helper of a build that dropped root is this binary
+	if len(os.Args) > 2 && os.Args[1] == privsep.HelperArg {
+		if err := privsep.Serve(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "fledge: privileged helper: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Tracing is only enabled when OTEL_EXPORTER_OTLP_* is configured
+	shutdownTracing, err := telemetry.Setup(context.Background(), version)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: tracing disabled: %v\n", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	err = newRootCommand().Execute()
+	if err != nil {
+		// Keep the failure in the log file too
+		logging.Debug("Command failed", "error", err)
+	}
+	logging.CloseFile()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if shutdownErr := shutdownTracing(flushCtx); shutdownErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to flush traces: %v\n", shutdownErr)
+	}
+	cancel()
+
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		var coded interface{ ExitCode() int }
+		if errors.As(err, &coded) {
+			os.Exit(coded.ExitCode())
+		}
 		os.Exit(1)
 	}
 }
@@ -52,45 +105,101 @@ The tool reads declarative fledge.toml configuration files and produces
 ready-to-deploy artifacts following the Filesystem Hierarchy Standard (FHS).`,
 		SilenceUsage:  true,
 		SilenceErrors: true,
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			logging.InitLogger(verbose, quiet)
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := logging.InitLoggerFormat(verbose, quiet, logFormat); err != nil {
+				return err
+			}
+			if logFile != "" {
+				return logging.SetFile(logging.FileOptions{Path: logFile, Format: logFormat})
+			}
+			return nil
 		},
 	}
 
 	// Global flags
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose output with debug details")
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "quiet mode (minimal output, errors only)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", os.Getenv("FLEDGE_LOG_FORMAT"), "log format: text or json, with build_id, step and strategy fields (or FLEDGE_LOG_FORMAT; default text)")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", os.Getenv("FLEDGE_LOG_FILE"), "also write all logs, debug included, to this file, rotated at 100M (or FLEDGE_LOG_FILE; [logging] file)")
+	registerCompletions(rootCmd, map[string]completionFunc{
+		"log-format": completeValues("text", "json"),
+	})
 
 	// Add subcommands
 	rootCmd.AddCommand(newVersionCommand())
 	rootCmd.AddCommand(newBuildCommand())
 	rootCmd.AddCommand(newServeCommand())
+	rootCmd.AddCommand(newPublishCommand())
+	rootCmd.AddCommand(newCleanupCommand())
+	rootCmd.AddCommand(newGenerateCommand())
+	rootCmd.AddCommand(newStoreCommand())
+	rootCmd.AddCommand(newConvertCommand())
+	rootCmd.AddCommand(newNewCommand())
+	rootCmd.AddCommand(newImportCommand())
+	rootCmd.AddCommand(newManCommand())
 
 	return rootCmd
 }
 
 func newVersionCommand() *cobra.Command {
-	return &cobra.Command{
+	var asJSON bool
+	cmd := &cobra.Command{
 		Use:   "version",
 		Short: "Print version information",
-		Run: func(cmd *cobra.Command, args []string) {
+		Long: `Print version information. With --json, also print the platform, the
+features compiled in (embedded BuildKit, step VM hypervisors, privilege
+dropping, strategies, filesystem types and userlands) and the versions of
+the main libraries, for tooling to gate its behavior on.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(buildinfo.Get(version, buildDate, gitCommit))
+			}
 			fmt.Printf("fledge version %s\n", version)
 			fmt.Printf("  build date: %s\n", buildDate)
 			fmt.Printf("  git commit: %s\n", gitCommit)
+			return nil
 		},
 	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the version, platform, features and library versions as JSON")
+	return cmd
 }
 
 func newBuildCommand() *cobra.Command {
 	var (
-		configPath      string
+		configPaths     []string
+		parallel        int
 		manifestPath    string
 		outputPath      string
 		dockerfilePath  string
 		contextDir      string
 		targetStage     string
 		buildArgValues  []string
+		setValues       []string
+		frontendImage   string
+		exportImage     string
+		pushImage       string
 		outputInitramfs bool
+		locked          bool
+		noReport        bool
+		force           bool
+		sizeReport      bool
+		copyDeps        bool
+		skipVerify      bool
+		dropPrivileges  bool
+		sha512          bool
+		sbom            bool
+		outputDir       string
+		storeDir        string
+		tempDir         string
+		timeout         time.Duration
+		progressMode    string
+		tuiMode         bool
+		strict          bool
+		remoteURL       string
+		apiKey          string
+		priority        string
 	)
 
 	buildCmd := &cobra.Command{
@@ -103,6 +212,7 @@ or directly from a Dockerfile using the embedded BuildKit solver.
 The build process produces:
   1. An artifact (rootfs.img or initramfs.cpio.gz)
   2. A manifest.json (merged from manifest.toml + build metadata)
+  3. A <artifact>.sha256 checksum file
 
 Examples:
   # Build using defaults (fledge.toml + manifest.toml in current directory)
@@ -111,58 +221,208 @@ Examples:
   # Build from specific config files with custom output
   sudo fledge build -c build/fledge.toml -m build/manifest.toml -o dist/myapp.img
 
+  # Override a source.build_args entry from CI
+  sudo fledge build -c fledge.toml --build-arg VERSION=1.2.3
+
+  # Try a different filesystem and agent without editing fledge.toml
+  sudo fledge build --set filesystem.type=ext4 --set agent.version=v0.9.0
+
+  # Keep temporary files on a large scratch disk instead of /tmp
+  sudo fledge build --workdir /mnt/scratch
+
+  # Fail a hung CI build after 45 minutes, with line-by-line progress for CI logs
+  sudo fledge build --timeout 45m --progress plain
+
+  # Collect artifact, manifest, checksums and SBOM in dist/ for publishing
+  sudo fledge build --output-dir dist --sha512
+
+  # Build every plugin of a monorepo, four at a time
+  sudo fledge build -c 'plugins/*' --parallel 4 --output-dir dist
+
+  # Run as the invoking user, with root only for ownership, mounts and packaging
+  sudo fledge build --drop-privileges
+
+  # Rebuild even if no input changed since the last build
+  sudo fledge build --force
+
+  # Build on a shared Linux builder and download the artifact, e.g. from macOS
+  fledge build --remote https://builder:7070 --api-key $KEY --priority high
+
   # Build directly from a Dockerfile (generates minimal manifest)
   sudo fledge build ./Dockerfile
 
+  # Also get the container image from the same build
+  sudo fledge build ./Dockerfile --also-export-image app.tar --also-push-image registry.example.com/app:1.2.3
+
   # Build an initramfs from a Dockerfile with custom context and build args
   sudo fledge build --dockerfile docker/app.Dockerfile --context ./app --build-arg VERSION=1.2.3 --output-initramfs`,
 		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyProgressMode(progressMode); err != nil {
+				return err
+			}
 			if len(args) == 1 {
 				if dockerfilePath != "" && dockerfilePath != args[0] {
 					return fmt.Errorf("dockerfile specified multiple times with differing values")
 				}
 				dockerfilePath = args[0]
 			}
+			if remoteURL == "" {
+				remoteURL = os.Getenv("FLEDGE_REMOTE")
+			}
+			if apiKey == "" {
+				apiKey = os.Getenv("FLEDGE_API_KEY")
+			}
 
 			return runBuild(buildCLIOptions{
-				ConfigPath:      configPath,
+				ConfigPaths:     configPaths,
+				Parallel:        parallel,
 				ManifestPath:    manifestPath,
 				OutputPath:      outputPath,
 				DockerfilePath:  dockerfilePath,
 				ContextDir:      contextDir,
 				Target:          targetStage,
 				BuildArgs:       buildArgValues,
+				Set:             setValues,
+				FrontendImage:   frontendImage,
+				ExportImage:     exportImage,
+				PushImage:       pushImage,
 				OutputInitramfs: outputInitramfs,
+				Locked:          locked,
+				NoReport:        noReport,
+				Force:           force,
+				SizeReport:      sizeReport,
+				CopyDeps:        copyDeps,
+				SkipVerify:      skipVerify,
+				DropPrivileges:  dropPrivileges,
+				SHA512:          sha512,
+				SBOM:            sbom,
+				OutputDir:       outputDir,
+				Store:           storeDir,
+				TempDir:         tempDir,
+				Timeout:         timeout,
+				TUI:             tuiMode,
+				Strict:          strict,
 				ConfigExplicit:  cmd.Flags().Changed("config"),
 				ManifestExplicit: cmd.Flags().Changed("manifest"),
+				Remote:          remoteURL,
+				APIKey:          apiKey,
+				Priority:        priority,
 			})
 		},
 	}
 
-	buildCmd.Flags().StringVarP(&configPath, "config", "c", "fledge.toml", "path to fledge.toml (build configuration)")
+	buildCmd.Flags().StringArrayVarP(&configPaths, "config", "c", []string{"fledge.toml"}, "path to fledge.toml (build configuration); repeat it or pass a directory or glob to build several plugins")
+	buildCmd.Flags().IntVar(&parallel, "parallel", 1, "number of plugins built at once when several --config files are given")
 	buildCmd.Flags().StringVarP(&manifestPath, "manifest", "m", "manifest.toml", "path to manifest.toml (runtime defaults)")
 	buildCmd.Flags().StringVarP(&outputPath, "output", "o", "", "output file path (default: auto-generated)")
 	buildCmd.Flags().StringVar(&dockerfilePath, "dockerfile", "", "path to Dockerfile for direct-build mode (alternative to positional argument)")
 	buildCmd.Flags().StringVar(&contextDir, "context", "", "build context directory (default: directory containing the Dockerfile)")
 	buildCmd.Flags().StringVar(&targetStage, "target", "", "build target stage (for multi-stage Dockerfiles)")
 	buildCmd.Flags().StringArrayVar(&buildArgValues, "build-arg", nil, "build argument in KEY=VALUE form (can be repeated)")
+	buildCmd.Flags().StringArrayVar(&setValues, "set", nil, "override a fledge.toml value in key=value form, e.g. filesystem.type=ext4 (can be repeated)")
+	buildCmd.Flags().StringVar(&frontendImage, "frontend-image", "", "Dockerfile frontend image to use instead of the built-in one (e.g. docker/dockerfile:1.7-labs)")
+	buildCmd.Flags().StringVar(&exportImage, "also-export-image", "", "also write the Dockerfile build's container image to this OCI image tarball (source.export_image)")
+	buildCmd.Flags().StringVar(&pushImage, "also-push-image", "", "also push the Dockerfile build's container image to this registry reference with skopeo (source.push_image)")
 	buildCmd.Flags().BoolVar(&outputInitramfs, "output-initramfs", false, "produce an initramfs (.cpio.gz) instead of a rootfs image when building from a Dockerfile")
+	buildCmd.Flags().BoolVar(&locked, "locked", false, "fail if remote inputs resolve differently than recorded in fledge.lock")
+	buildCmd.Flags().BoolVar(&noReport, "no-report", false, "do not write <output>.report.json with step timings, downloads and sizes")
+	buildCmd.Flags().BoolVar(&sizeReport, "size-report", false, "print the rootfs size by top-level directory and by source (image, Dockerfile, mappings, agent, ...) and store it in the build report")
+	buildCmd.Flags().BoolVar(&copyDeps, "copy-deps", false, "copy shared libraries that mapped executables need but the artifact lacks from the host, instead of warning")
+	buildCmd.Flags().BoolVar(&skipVerify, "skip-verify", false, "do not check the finished artifact with e2fsck, xfs_repair, btrfs check or unsquashfs (or the cpio/gzip stream of an initramfs)")
+	buildCmd.Flags().BoolVar(&dropPrivileges, "drop-privileges", false, "run the build as the user who invoked sudo, keeping root only to apply file ownership, mount the image and package it (fledge.toml oci_rootfs builds)")
+	buildCmd.Flags().BoolVar(&sha512, "sha512", false, "also write <output>.sha512 next to <output>.sha256")
+	buildCmd.Flags().BoolVar(&sbom, "sbom", false, "write an SPDX document of the artifact and its resolved inputs to <output>.spdx.json")
+	buildCmd.Flags().StringVar(&outputDir, "output-dir", "", "write the artifact, manifest, checksums and SBOM to this directory, e.g. dist (implies --sbom)")
+	buildCmd.Flags().StringVar(&storeDir, "store", os.Getenv(store.Env), "keep the artifact in this store directory by digest, hardlinking identical rebuilds to the stored copy (or FLEDGE_STORE)")
+	buildCmd.Flags().BoolVar(&force, "force", false, "rebuild even if no input changed since the artifact was last built")
+	buildCmd.Flags().StringVar(&tempDir, "workdir", "", "scratch directory for temporary build files (or FLEDGE_WORKDIR or [build] temp_dir; default TMPDIR)")
+	buildCmd.Flags().StringVar(&progressMode, "progress", os.Getenv(progress.Env), "progress output: auto, tty, plain or quiet (or FLEDGE_PROGRESS; default auto)")
+	buildCmd.Flags().BoolVar(&strict, "strict", false, "fail the build, with exit status 3, if it logged warnings of the classes in [build] strict_warnings (default all but \"other\")")
+	buildCmd.Flags().BoolVar(&tuiMode, "tui", false, "monitor the build full screen: steps with their durations, step VMs and the latest logs (needs a terminal; replaces --progress)")
+	buildCmd.Flags().DurationVar(&timeout, "timeout", 0, "fail the build if it runs longer than this, e.g. 45m (overrides [build] timeout)")
+	buildCmd.Flags().StringVar(&remoteURL, "remote", "", "build on the fledge serve build service at this URL, e.g. https://builder:7070, uploading the directory of fledge.toml and downloading the artifact (or FLEDGE_REMOTE)")
+	buildCmd.Flags().StringVar(&apiKey, "api-key", "", "API key with build and read scopes for the --remote build service (or FLEDGE_API_KEY)")
+	buildCmd.Flags().StringVar(&priority, "priority", "", "queue priority of a --remote build: low, normal or high")
+	registerCompletions(buildCmd, map[string]completionFunc{
+		"config":     completeTOML,
+		"manifest":   completeTOML,
+		"context":    completeDirs,
+		"output-dir": completeDirs,
+		"store":      completeDirs,
+		"workdir":    completeDirs,
+		"set":        completeSet,
+		"progress":   completeValues("auto", "tty", "plain", "quiet"),
+		"priority":   completeValues(remotePriorities...),
+	})
 
 	return buildCmd
 }
 
 func newServeCommand() *cobra.Command {
 	var (
-		addr   string
-		apiKey string
-		cors   string
+		addr        string
+		apiKey      string
+		cors        string
+		artifactDir string
+		tenantsDir  string
+		tenantDisk  string
+		tenantMax   int
+		maxBuilds   int
+		maxQueued   int
+		install     bool
+		systemdDir  string
+		tlsOpts     server.TLSOptions
+		volantAPI   string
+		volantToken string
+		tempDir     string
+		timeout     time.Duration
+		grpcAddr    string
+		artifactTTL time.Duration
+		maxArtifact string
+		auditLog    string
+		apiKeysFile string
+		oidcOpts    server.OIDCOptions
+		oidcClaims  []string
+		rateLimit   float64
+		rateBurst   int
+		maxRequest  string
+		maxUpload   string
+		clientTime  time.Duration
+		allowRoots  []string
 	)
 
 	cmd := &cobra.Command{
 		Use:   "serve",
 		Short: "Run fledge in HTTP daemon mode",
+		Example: `  # Listen on TCP (default 127.0.0.1:7070)
+  sudo fledge serve --api-key secret
+
+  # Listen on a Unix socket instead of a TCP port
+  sudo fledge serve --addr unix:///run/fledge.sock
+
+  # Only build configs under /srv/fledge, writing artifacts there too
+  sudo fledge serve --allow-root /srv/fledge
+
+  # Serve HTTPS and require client certificates signed by ca.pem
+  sudo fledge serve --addr 0.0.0.0:7443 --tls-cert server.pem --tls-key server-key.pem --tls-client-ca ca.pem
+
+  # Accept tokens from an SSO provider instead of shared API keys
+  sudo fledge serve --oidc-issuer https://sso.example.com --oidc-audience fledge --oidc-require-claim groups=builders
+
+  # Also serve the gRPC API on a Unix socket
+  sudo fledge serve --grpc-addr unix:///run/fledge-grpc.sock
+
+  # Install socket-activated systemd units
+  sudo fledge serve --install-systemd`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireLinux("serve"); err != nil {
+				return err
+			}
+			if install {
+				return installSystemdUnits(addr, systemdDir)
+			}
+
 			ctx, cancel := setupSignalHandling()
 			defer cancel()
 
@@ -176,6 +436,25 @@ func newServeCommand() *cobra.Command {
 			if apiKey == "" {
 				apiKey = os.Getenv("FLEDGE_API_KEY")
 			}
+			if apiKeysFile == "" {
+				apiKeysFile = os.Getenv("FLEDGE_API_KEYS_FILE")
+			}
+			if oidcOpts.Issuer == "" {
+				oidcOpts.Issuer = os.Getenv("FLEDGE_OIDC_ISSUER")
+			}
+			if oidcOpts.Audience == "" {
+				oidcOpts.Audience = os.Getenv("FLEDGE_OIDC_AUDIENCE")
+			}
+			for _, c := range oidcClaims {
+				name, value, ok := strings.Cut(c, "=")
+				if !ok || name == "" {
+					return fmt.Errorf("invalid --oidc-require-claim %q: expected name=value", c)
+				}
+				if oidcOpts.RequiredClaims == nil {
+					oidcOpts.RequiredClaims = map[string]string{}
+				}
+				oidcOpts.RequiredClaims[name] = value
+			}
 			origins := []string{}
 			if cors == "" {
 				cors = os.Getenv("FLEDGE_CORS_ORIGINS")
@@ -189,73 +468,642 @@ func newServeCommand() *cobra.Command {
 				}
 			}
 
-			opts := server.Options{Addr: addr, APIKey: apiKey, CORSOrigins: origins}
+			if artifactDir == "" {
+				artifactDir = os.Getenv("FLEDGE_ARTIFACT_DIR")
+			}
+			if tenantsDir == "" {
+				tenantsDir = os.Getenv("FLEDGE_TENANTS_DIR")
+			}
+			if len(allowRoots) == 0 {
+				allowRoots = filepath.SplitList(os.Getenv("FLEDGE_ALLOWED_ROOTS"))
+			}
+			if grpcAddr == "" {
+				grpcAddr = os.Getenv("FLEDGE_GRPC_ADDR")
+			}
+			if auditLog == "" {
+				auditLog = os.Getenv("FLEDGE_AUDIT_LOG")
+			}
+			if tlsOpts.CertFile == "" {
+				tlsOpts.CertFile = os.Getenv("FLEDGE_TLS_CERT")
+			}
+			if tlsOpts.KeyFile == "" {
+				tlsOpts.KeyFile = os.Getenv("FLEDGE_TLS_KEY")
+			}
+			if tlsOpts.ClientCA == "" {
+				tlsOpts.ClientCA = os.Getenv("FLEDGE_TLS_CLIENT_CA")
+			}
+			if err := applyTempDir(tempDir, nil, ""); err != nil {
+				return err
+			}
+			// Concurrent builds cannot share an interactive display
+			progress.SetMode(progress.ModePlain)
+			if hostcaps.Check(reclaimNeeds()...) == nil {
+				ledger.ReclaimOrphans(ctx)
+			}
+
+			opts := server.Options{
+				Addr:                addr,
+				APIKey:              apiKey,
+				APIKeysFile:         apiKeysFile,
+				OIDC:                oidcOpts,
+				CORSOrigins:         origins,
+				ArtifactDir:         artifactDir,
+				TenantsDir:          tenantsDir,
+				TenantQuota:         server.TenantQuota{MaxBuilds: tenantMax},
+				MaxConcurrentBuilds: maxBuilds,
+				MaxQueuedBuilds:     maxQueued,
+				BuildTimeout:        timeout,
+				TLS:                 tlsOpts,
+				GRPCAddr:            grpcAddr,
+				ArtifactTTL:         artifactTTL,
+				AuditLog:            auditLog,
+				RateLimit:           rateLimit,
+				RateBurst:           rateBurst,
+				ClientTimeout:       clientTime,
+				AllowedRoots:        allowRoots,
+				Version:             version,
+			}
+			if maxRequest != "" {
+				n, err := config.ParseByteSize(maxRequest)
+				if err != nil {
+					return fmt.Errorf("invalid --max-request-size: %w", err)
+				}
+				opts.MaxRequestBytes = n
+			}
+			if maxUpload != "" {
+				n, err := config.ParseByteSize(maxUpload)
+				if err != nil {
+					return fmt.Errorf("invalid --max-upload-size: %w", err)
+				}
+				opts.MaxUploadBytes = n
+			}
+			if tenantDisk != "" {
+				n, err := config.ParseByteSize(tenantDisk)
+				if err != nil {
+					return fmt.Errorf("invalid --tenant-max-disk: %w", err)
+				}
+				opts.TenantQuota.MaxDiskBytes = n
+			}
+			if maxArtifact != "" {
+				n, err := config.ParseByteSize(maxArtifact)
+				if err != nil {
+					return fmt.Errorf("invalid --artifact-max-size: %w", err)
+				}
+				opts.MaxArtifactBytes = n
+			}
+			if volantAPI == "" {
+				volantAPI = os.Getenv("FLEDGE_VOLANT_API")
+			}
+			if volantAPI != "" {
+				publisher, err := publish.NewClient(volantAPI, volantTokenOrEnv(volantToken))
+				if err != nil {
+					return err
+				}
+				opts.Publisher = publisher
+			}
 			logging.Info("Starting fledge serve", "addr", opts.Addr)
 
-			// wrap build functions matching server signature
-			// Note: Server mode uses default manifest template for now
-			buildFn := func(ctx context.Context, cfg *config.Config, workDir, output string) error {
-				manifestTpl := config.DefaultManifestTemplate()
-				return buildOCIRootfs(ctx, cfg, manifestTpl, workDir, output)
+			// wrap build functions matching server signature; requests
+			// without an inline manifest use the default template
+			buildFn := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+				warnServedSettings(cfg)
+				if err := hostcaps.Check(builder.HostNeeds(cfg)...); err != nil {
+					return err
+				}
+				if manifestTpl == nil {
+					manifestTpl = config.DefaultManifestTemplate()
+				}
+				return buildOCIRootfs(ctx, cfg, manifestTpl, workDir, output, nil, nil, builderFlags{})
 			}
-			initramfsFn := func(ctx context.Context, cfg *config.Config, workDir, output string) error {
-				manifestTpl := config.DefaultManifestTemplate()
-				return buildInitramfs(ctx, cfg, manifestTpl, workDir, output)
+			initramfsFn := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+				warnServedSettings(cfg)
+				if err := hostcaps.Check(builder.HostNeeds(cfg)...); err != nil {
+					return err
+				}
+				if manifestTpl == nil {
+					manifestTpl = config.DefaultManifestTemplate()
+				}
+				return buildInitramfs(ctx, cfg, manifestTpl, workDir, output, nil, nil, builderFlags{})
 			}
 
 			return server.Start(ctx, opts, buildFn, initramfsFn)
 		},
 	}
 
-	cmd.Flags().StringVar(&addr, "addr", "", "address to bind (default 127.0.0.1:7070 or FLEDGE_ADDR)")
-	cmd.Flags().StringVar(&apiKey, "api-key", "", "API key required for requests (or FLEDGE_API_KEY)")
+	cmd.Flags().StringVar(&addr, "addr", "", "address to bind, host:port or unix:///path (default 127.0.0.1:7070 or FLEDGE_ADDR)")
+	cmd.Flags().StringVar(&apiKey, "api-key", "", "API key with full access required for requests (or FLEDGE_API_KEY)")
+	cmd.Flags().StringVar(&apiKeysFile, "api-keys-file", "", "TOML file of named API keys with build, read or admin scopes, reloaded on change (or FLEDGE_API_KEYS_FILE)")
+	cmd.Flags().StringVar(&oidcOpts.Issuer, "oidc-issuer", "", "also accept Bearer JWTs from this OpenID Connect issuer (or FLEDGE_OIDC_ISSUER)")
+	cmd.Flags().StringVar(&oidcOpts.Audience, "oidc-audience", "", "audience OIDC tokens must be issued for (or FLEDGE_OIDC_AUDIENCE)")
+	cmd.Flags().StringVar(&oidcOpts.JWKSURL, "oidc-jwks-url", "", "JWKS URL of the OIDC issuer's signing keys (default: from its discovery document)")
+	cmd.Flags().StringVar(&oidcOpts.ScopesClaim, "oidc-scopes-claim", "scope", "OIDC token claim listing the build, read or admin scopes it grants")
+	cmd.Flags().StringVar(&oidcOpts.TenantClaim, "oidc-tenant-claim", "", "OIDC token claim naming the tenant workspace of its builds; tokens without one are rejected (default: the default workspace)")
+	cmd.Flags().StringArrayVar(&oidcClaims, "oidc-require-claim", nil, "claim=value an OIDC token must carry, e.g. groups=builders (repeatable)")
 	cmd.Flags().StringVar(&cors, "cors-origins", "", "comma-separated allowed CORS origins (or FLEDGE_CORS_ORIGINS)")
+	cmd.Flags().IntVar(&maxBuilds, "max-concurrent-builds", server.DefaultMaxConcurrentBuilds, "maximum number of builds running at once")
+	cmd.Flags().IntVar(&maxQueued, "max-queued-builds", server.DefaultMaxQueuedBuilds, "maximum number of builds waiting for a slot before requests are rejected with 429")
+	cmd.Flags().DurationVar(&timeout, "build-timeout", server.DefaultBuildTimeout, "maximum duration of a build, including time queued; a build's [build] timeout may only lower it")
+	cmd.Flags().Float64Var(&rateLimit, "rate-limit", server.DefaultRateLimit, "requests per second allowed per client address; negative disables rate limiting")
+	cmd.Flags().IntVar(&rateBurst, "rate-burst", server.DefaultRateBurst, "requests a client may make at once before --rate-limit applies")
+	cmd.Flags().StringVar(&maxRequest, "max-request-size", "", "maximum size of a JSON request body, e.g. 1M (default 8M)")
+	cmd.Flags().StringVar(&maxUpload, "max-upload-size", "", "maximum size of an upload build request, e.g. 10G (default 4G)")
+	cmd.Flags().DurationVar(&clientTime, "client-timeout", server.DefaultClientTimeout, "disconnect clients that send none of their request or accept none of the response for this long; negative disables")
+	cmd.Flags().StringArrayVar(&allowRoots, "allow-root", nil, "directory tree that config_path, work_dir, output_path and the files configs read must lie in (repeatable, or FLEDGE_ALLOWED_ROOTS separated by colons; default: any path)")
+	cmd.Flags().StringVar(&artifactDir, "artifact-dir", "", "directory keeping finished artifacts for download (or FLEDGE_ARTIFACT_DIR; default ~/.cache/fledge/artifacts)")
+	cmd.Flags().StringVar(&tenantsDir, "tenants-dir", "", "directory holding the artifact store, download cache and build workspaces of each tenant named by API keys (or FLEDGE_TENANTS_DIR; default ~/.cache/fledge/tenants)")
+	cmd.Flags().StringVar(&tenantDisk, "tenant-max-disk", "", "disk each tenant's artifacts, caches and workspaces may use, e.g. 20G, beyond which its builds get 507 (default: unlimited)")
+	cmd.Flags().IntVar(&tenantMax, "tenant-max-builds", 0, "builds each tenant may have running or queued, beyond which it gets 429 (default: unlimited)")
+	cmd.Flags().DurationVar(&artifactTTL, "artifact-ttl", 0, "remove stored artifacts after this long unless their build request sets a ttl (default: keep)")
+	cmd.Flags().StringVar(&maxArtifact, "artifact-max-size", "", "total size of stored artifacts, e.g. 50G, beyond which the oldest are removed (default: unlimited)")
+	cmd.Flags().StringVar(&tlsOpts.CertFile, "tls-cert", "", "PEM certificate to serve HTTPS with (or FLEDGE_TLS_CERT)")
+	cmd.Flags().StringVar(&tlsOpts.KeyFile, "tls-key", "", "PEM private key for --tls-cert (or FLEDGE_TLS_KEY)")
+	cmd.Flags().StringVar(&tlsOpts.ClientCA, "tls-client-ca", "", "PEM CA bundle; clients must present a certificate signed by it (or FLEDGE_TLS_CLIENT_CA)")
+	cmd.Flags().StringVar(&volantAPI, "volant-api", "", "Volant API URL that POST /v1/artifacts/{id}/publish registers plugins with (or FLEDGE_VOLANT_API)")
+	cmd.Flags().StringVar(&volantToken, "volant-token", "", "bearer token for the Volant API (or FLEDGE_VOLANT_TOKEN)")
+	cmd.Flags().BoolVar(&install, "install-systemd", false, "write fledge.socket and fledge.service units for socket activation and exit")
+	cmd.Flags().StringVar(&tempDir, "workdir", "", "scratch directory for build workspaces and temporary files (or FLEDGE_WORKDIR; default TMPDIR)")
+	cmd.Flags().StringVar(&auditLog, "audit-log", "", "append a JSON record of every API request to this file, - for stdout or syslog (or FLEDGE_AUDIT_LOG)")
+	cmd.Flags().StringVar(&grpcAddr, "grpc-addr", "", "also serve the gRPC API on host:port or unix:///path (or FLEDGE_GRPC_ADDR; disabled by default)")
+	cmd.Flags().StringVar(&systemdDir, "systemd-dir", "/etc/systemd/system", "directory --install-systemd writes the units to")
 
 	return cmd
 }
 
+// applyProgressMode sets the progress display from --progress. With --quiet
+// and no explicit mode, progress is hidden too.
+func applyProgressMode(value string) error {
+	mode, err := progress.ParseMode(value)
+	if err != nil {
+		return err
+	}
+	if mode == progress.ModeAuto && quiet {
+		mode = progress.ModeQuiet
+	}
+	progress.SetMode(mode)
+	return nil
+}
+
+// warnServedSettings notes the host settings that do not apply to builds
+// submitted to the daemon: the scratch directory is set by serve --workdir and
+// the log file by serve --log-file.
+func warnServedSettings(cfg *config.Config) {
+	if cfg.Build != nil && cfg.Build.TempDir != "" {
+		logging.Warn("Ignoring [build] temp_dir for served build; use fledge serve --workdir", "temp_dir", cfg.Build.TempDir)
+	}
+	if cfg.Logging != nil && cfg.Logging.File != "" {
+		logging.Warn("Ignoring [logging] file for served build; use fledge serve --log-file", "file", cfg.Logging.File)
+	}
+}
+
+func newCleanupCommand() *cobra.Command {
+	var (
+		force bool
+		list  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Reclaim loop devices, mounts, taps, IPs and VMs left by crashed builds",
+		Long: `Fledge records the host resources it creates in a ledger
+(~/.cache/fledge/state/ledger.json). Resources whose fledge process is no
+longer running are reclaimed: stray cloud-hypervisor processes are stopped,
+mounts unmounted, loop devices detached, tap interfaces removed and leased
+IPs released. Builds and fledge serve do the same automatically on startup.`,
+		Example: `  # Reclaim resources left by dead fledge processes
+  sudo fledge cleanup
+
+  # Show what is recorded without touching anything
+  sudo fledge cleanup --list
+
+  # Also reclaim resources of fledge processes that are still running
+  sudo fledge cleanup --force`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireLinux("cleanup"); err != nil {
+				return err
+			}
+			ctx, cancel := setupSignalHandling()
+			defer cancel()
+
+			l := ledger.Default()
+			if l == nil {
+				return fmt.Errorf("resource ledger is not available")
+			}
+			if list {
+				entries, err := l.Entries()
+				if err != nil {
+					return err
+				}
+				for _, e := range entries {
+					fmt.Printf("%-6s %-28s pid=%d created=%s\n", e.Kind, e.ID, e.Owner, e.Created.Format(time.RFC3339))
+				}
+				return nil
+			}
+
+			if err := hostcaps.Check(reclaimNeeds()...); err != nil {
+				return err
+			}
+			outcomes, err := l.Reclaim(ctx, force)
+			if err != nil {
+				return err
+			}
+			failed := 0
+			for _, o := range outcomes {
+				if o.Err != nil {
+					failed++
+					fmt.Printf("failed    %s: %v\n", o.Entry, o.Err)
+					continue
+				}
+				fmt.Printf("reclaimed %s\n", o.Entry)
+			}
+			if len(outcomes) == 0 {
+				fmt.Println("Nothing to clean up")
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d resource(s) could not be reclaimed", failed)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&force, "force", false, "also reclaim resources owned by fledge processes that are still running")
+	cmd.Flags().BoolVar(&list, "list", false, "list recorded resources instead of reclaiming them")
+
+	return cmd
+}
+
+func newPublishCommand() *cobra.Command {
+	var (
+		volantAPI    string
+		volantToken  string
+		manifestPath string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "publish <artifact>",
+		Short: "Upload a built plugin to a Volant control plane",
+		Long: `Upload a built artifact to a Volant orchestrator and register its
+manifest.json as a plugin. The manifest's artifact URL is rewritten to the
+location Volant stores the artifact at; an existing plugin of the same name
+is replaced.`,
+		Example: `  # Publish a build (reads plugin.img.manifest.json)
+  fledge publish plugin.img --volant-api https://volant.example:7777
+
+  # Publish with an explicit manifest and token
+  FLEDGE_VOLANT_TOKEN=secret fledge publish plugin.img -m manifest.json --volant-api https://volant.example:7777`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := setupSignalHandling()
+			defer cancel()
+
+			if volantAPI == "" {
+				volantAPI = os.Getenv("FLEDGE_VOLANT_API")
+			}
+			if volantAPI == "" {
+				return fmt.Errorf("--volant-api (or FLEDGE_VOLANT_API) is required")
+			}
+			client, err := publish.NewClient(volantAPI, volantTokenOrEnv(volantToken))
+			if err != nil {
+				return err
+			}
+
+			artifact := args[0]
+			if manifestPath == "" {
+				manifestPath = artifact + ".manifest.json"
+			}
+			logging.Info("Publishing plugin", "artifact", artifact, "manifest", manifestPath, "volant", volantAPI)
+			res, err := client.Publish(ctx, artifact, manifestPath)
+			if err != nil {
+				return err
+			}
+
+			action := "Registered"
+			if res.Updated {
+				action = "Updated"
+			}
+			fmt.Printf("%s plugin %s (artifact %s)\n", action, res.Plugin, res.ArtifactURL)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&volantAPI, "volant-api", "", "Volant API URL (or FLEDGE_VOLANT_API)")
+	cmd.Flags().StringVar(&volantToken, "volant-token", "", "bearer token for the Volant API (or FLEDGE_VOLANT_TOKEN)")
+	cmd.Flags().StringVarP(&manifestPath, "manifest", "m", "", "manifest.json to register (default <artifact>.manifest.json)")
+
+	return cmd
+}
+
+// volantTokenOrEnv returns token, falling back to FLEDGE_VOLANT_TOKEN.
+func volantTokenOrEnv(token string) string {
+	if token == "" {
+		return os.Getenv("FLEDGE_VOLANT_TOKEN")
+	}
+	return token
+}
+
+// installSystemdUnits writes socket-activated systemd units for this binary.
+// The socket path comes from a unix:// --addr, defaulting to /run/fledge.sock.
+func installSystemdUnits(addr, dir string) error {
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate fledge executable: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(execPath); err == nil {
+		execPath = resolved
+	}
+
+	socketPath := server.DefaultSocketPath
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok && path != "" {
+		socketPath = path
+	} else if addr != "" {
+		return fmt.Errorf("--install-systemd only supports unix:// addresses, got %q", addr)
+	}
+
+	paths, err := server.InstallSystemd(dir, execPath, socketPath)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fmt.Printf("Wrote %s\n", p)
+	}
+	fmt.Println("Configure the daemon in /etc/fledge/fledge.env (e.g. FLEDGE_API_KEY), then run:")
+	fmt.Println("  systemctl daemon-reload && systemctl enable --now fledge.socket")
+	return nil
+}
+
 type buildCLIOptions struct {
 	ConfigPath       string
+	ConfigPaths      []string
+	Parallel         int
 	ManifestPath     string
 	OutputPath       string
 	DockerfilePath   string
 	ContextDir       string
 	Target           string
 	BuildArgs        []string
+	Set              []string
+	FrontendImage    string
+	ExportImage      string
+	PushImage        string
 	OutputInitramfs  bool
+	Locked           bool
+	NoReport         bool
+	Force            bool
+	SizeReport       bool
+	CopyDeps         bool
+	SkipVerify       bool
+	DropPrivileges   bool
+	SHA512           bool
+	SBOM             bool
+	OutputDir        string
+	// Store is the artifact store directory outputs are deduplicated in.
+	Store            string
+	TempDir          string
+	Timeout          time.Duration
+	// TUI monitors the build full screen.
+	TUI              bool
+	// Strict fails builds that logged warnings of the classes in [build]
+	// strict_warnings.
+	Strict           bool
 	ConfigExplicit   bool
 	ManifestExplicit bool
+	// Plugin names the plugin of one build of a multi-config build.
+	Plugin string
+	// OutputBase is the directory a default output path is relative to.
+	OutputBase string
+	// Remote is the URL of a fledge build service to build on instead of
+	// this host, authenticating with APIKey.
+	Remote   string
+	APIKey   string
+	Priority string
+
+	// onStep is passed the build's steps as they start and finish.
+	onStep func(builder.StepEvent)
+	// warnings collects the build's warnings.
+	warnings *buildWarnings
+}
+
+// builderFlags are the command line settings passed to the builders.
+type builderFlags struct {
+	SizeReport bool
+	CopyDeps   bool
+	SkipVerify bool
+	Checksums  []string
+	SBOM       bool
+	// Privileged is the root helper of a build that dropped privileges.
+	Privileged *privsep.Helper
+	// OnStep is passed the build's steps as they start and finish.
+	OnStep func(builder.StepEvent)
+}
+
+func (o buildCLIOptions) builderFlags() builderFlags {
+	return builderFlags{
+		SizeReport: o.SizeReport,
+		CopyDeps:   o.CopyDeps,
+		SkipVerify: o.SkipVerify,
+		Checksums:  o.checksums(),
+		SBOM:       o.wantsSBOM(),
+		OnStep:     o.onStep,
+	}
+}
+
+// checksums returns the algorithms checksum files are written for.
+func (o buildCLIOptions) checksums() []string {
+	if o.SHA512 {
+		return []string{builder.ChecksumSHA256, builder.ChecksumSHA512}
+	}
+	return []string{builder.ChecksumSHA256}
+}
+
+// wantsSBOM reports whether the build writes <output>.spdx.json.
+func (o buildCLIOptions) wantsSBOM() bool {
+	return o.SBOM || o.OutputDir != ""
+}
+
+// distFiles returns the files written next to output besides its manifest,
+// which an up-to-date build must already have.
+func (o buildCLIOptions) distFiles(output string) []string {
+	var files []string
+	for _, algorithm := range o.checksums() {
+		files = append(files, output+"."+algorithm)
+	}
+	if o.wantsSBOM() {
+		files = append(files, output+builder.SBOMSuffix)
+	}
+	return files
+}
+
+// resolveOutput places output in --output-dir, if set, or a relative
+// output in OutputBase.
+func (o buildCLIOptions) resolveOutput(output string) string {
+	switch {
+	case o.OutputDir != "":
+		return filepath.Join(o.OutputDir, filepath.Base(output))
+	case o.OutputBase != "" && !filepath.IsAbs(output):
+		return filepath.Join(o.OutputBase, output)
+	}
+	return output
 }
 
 func runBuild(opts buildCLIOptions) error {
 	ctx, cancel := setupSignalHandling()
 	defer cancel()
 
-	if os.Geteuid() != 0 {
-		logging.Error("Fledge requires root privileges for building artifacts")
-		return fmt.Errorf("must run as root (use sudo)")
+	if opts.Remote != "" {
+		return runRemoteBuild(ctx, opts)
+	}
+	if opts.Priority != "" {
+		return fmt.Errorf("--priority requires --remote")
+	}
+	if err := requireLinux("build"); err != nil {
+		return err
+	}
+
+	// Privileges are checked per build, once its strategy is known
+	if hostcaps.Check(reclaimNeeds()...) == nil {
+		ledger.ReclaimOrphans(ctx)
+	}
+
+	configPaths, err := expandConfigPaths(opts.ConfigPaths)
+	if err != nil {
+		return err
+	}
+	if len(configPaths) > 1 {
+		if opts.TUI {
+			return fmt.Errorf("--tui is not supported in multi-config builds")
+		}
+		return runMultiBuild(ctx, opts, configPaths)
+	}
+	if len(configPaths) == 1 {
+		opts.ConfigPath = configPaths[0]
+	}
+	ctx = logging.NewContext(ctx, logging.KeyBuildID, newBuildID())
+	warnings, stopWarnings := collectWarnings(ctx)
+	opts.warnings = warnings
+	defer func() {
+		stopWarnings()
+		if !quiet {
+			warnings.printSummary(os.Stderr)
+		}
+	}()
+	if opts.TUI {
+		stop, err := startMonitor(&opts)
+		if err != nil {
+			return err
+		}
+		defer stop()
 	}
 
 	if opts.DockerfilePath != "" {
+		if opts.Locked {
+			return fmt.Errorf("--locked is only supported when building from fledge.toml")
+		}
+		if len(opts.Set) > 0 {
+			return fmt.Errorf("--set is only supported when building from fledge.toml")
+		}
+		if opts.DropPrivileges {
+			return fmt.Errorf("--drop-privileges is only supported when building from fledge.toml")
+		}
 		return runDockerfileBuild(ctx, opts)
 	}
 
-	if opts.OutputInitramfs || opts.ContextDir != "" || opts.Target != "" || len(opts.BuildArgs) > 0 {
-		return fmt.Errorf("--dockerfile is required when using --output-initramfs, --context, --target, or --build-arg")
+	if opts.OutputInitramfs || opts.ContextDir != "" || opts.Target != "" {
+		return fmt.Errorf("--dockerfile is required when using --output-initramfs, --context, or --target")
 	}
 
 	return runConfigBuild(ctx, opts)
 }
 
+// applyImageExport sets source.export_image and source.push_image from
+// --also-export-image and --also-push-image.
+func applyImageExport(cfg *config.Config, opts buildCLIOptions) error {
+	if opts.ExportImage == "" && opts.PushImage == "" {
+		return nil
+	}
+	if cfg.Source.Dockerfile == "" {
+		return fmt.Errorf("--also-export-image and --also-push-image require a Dockerfile build (source.dockerfile)")
+	}
+	if opts.ExportImage != "" {
+		abs, err := filepath.Abs(opts.ExportImage)
+		if err != nil {
+			return fmt.Errorf("failed to resolve --also-export-image: %w", err)
+		}
+		cfg.Source.ExportImage = abs
+	}
+	if opts.PushImage != "" {
+		cfg.Source.PushImage = opts.PushImage
+	}
+	return nil
+}
+
+// newBuildID returns a random ID tagging the log records of one build.
+func newBuildID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 func runConfigBuild(ctx context.Context, opts buildCLIOptions) error {
-	logging.Info("Starting Fledge build", "config", opts.ConfigPath, "manifest", opts.ManifestPath)
+	logging.InfoContext(ctx, "Starting Fledge build", "config", opts.ConfigPath, "manifest", opts.ManifestPath)
 
 	// Load build config (fledge.toml)
-	cfg, err := loadConfig(opts.ConfigPath)
+	cfg, err := loadConfig(opts.ConfigPath, opts.Set)
 	if err != nil {
 		return err
 	}
 
+	if opts.Plugin != "" {
+		// TMPDIR and the log file are per process, so configs built
+		// together cannot each choose their own
+		if cfg.Build != nil && cfg.Build.TempDir != "" {
+			logging.WarnContext(ctx, "Ignoring [build] temp_dir in a multi-config build; use --workdir", "config", opts.ConfigPath)
+		}
+		if cfg.Logging != nil && cfg.Logging.File != "" {
+			logging.WarnContext(ctx, "Ignoring [logging] file in a multi-config build; use --log-file", "config", opts.ConfigPath)
+		}
+	} else {
+		if err := applyTempDir(opts.TempDir, cfg, opts.ConfigPath); err != nil {
+			return err
+		}
+		if err := applyLogFile(cfg, opts.ConfigPath); err != nil {
+			return err
+		}
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = cfg.BuildTimeout()
+	}
+	ctx, cancel := withBuildTimeout(ctx, timeout)
+	defer cancel()
+
+	if opts.FrontendImage != "" {
+		if cfg.Source.Dockerfile == "" {
+			return fmt.Errorf("--frontend-image requires a Dockerfile build (source.dockerfile)")
+		}
+		cfg.Source.FrontendImage = opts.FrontendImage
+	}
+	if err := applyImageExport(cfg, opts); err != nil {
+		return err
+	}
+
+	// --build-arg adds to or overrides source.build_args
+	if len(opts.BuildArgs) > 0 {
+		if cfg.Source.Dockerfile == "" {
+			return fmt.Errorf("--build-arg requires a Dockerfile build (source.dockerfile)")
+		}
+		overrides, err := parseBuildArgs(opts.BuildArgs)
+		if err != nil {
+			return err
+		}
+		if cfg.Source.BuildArgs == nil {
+			cfg.Source.BuildArgs = make(map[string]string, len(overrides))
+		}
+		for k, v := range overrides {
+			cfg.Source.BuildArgs[k] = v
+		}
+	}
+
 	// Load manifest template (manifest.toml)
 	// This defines runtime defaults that will be merged with build metadata
 	manifestTpl, err := loadManifestTemplate(opts.ManifestPath, opts.ManifestExplicit)
@@ -263,22 +1111,165 @@ func runConfigBuild(ctx context.Context, opts buildCLIOptions) error {
 		return err
 	}
 
-	output := determineOutputPath(cfg, opts.OutputPath)
-	logging.Info("Output artifact", "path", output)
+	output := opts.resolveOutput(determineOutputPath(cfg, opts.OutputPath))
+	logging.InfoContext(ctx, "Output artifact", "path", output)
 
 	workDir, err := getWorkingDirectory(opts.ConfigPath)
 	if err != nil {
 		return err
 	}
 
+	// fledge.lock lives next to fledge.toml
+	lockPath := filepath.Join(filepath.Dir(opts.ConfigPath), lock.FileName)
+	tracker, err := lock.Open(lockPath, opts.Locked)
+	if err != nil {
+		return err
+	}
+
 	switch cfg.Strategy {
-	case config.StrategyOCIRootfs:
-		return buildOCIRootfs(ctx, cfg, manifestTpl, workDir, output)
-	case config.StrategyInitramfs:
-		return buildInitramfs(ctx, cfg, manifestTpl, workDir, output)
+	case config.StrategyOCIRootfs, config.StrategyInitramfs:
 	default:
 		return fmt.Errorf("unknown build strategy: %s", cfg.Strategy)
 	}
+	inputs, skip := checkInputs(ctx, cfg, manifestTpl, workDir, output, opts.distFiles(output), opts.Force)
+	if skip {
+		return nil
+	}
+	if err := hostcaps.Check(builder.HostNeeds(cfg)...); err != nil {
+		return err
+	}
+	flags := opts.builderFlags()
+	if opts.DropPrivileges {
+		helper, err := dropPrivileges(ctx, cfg, opts)
+		if err != nil {
+			return err
+		}
+		defer helper.Close()
+		flags.Privileged = helper
+	}
+	err = runReported(ctx, cfg.Strategy, output, opts.NoReport, func(rep *report.Report) error {
+		build := buildInitramfs
+		if cfg.Strategy == config.StrategyOCIRootfs {
+			build = buildOCIRootfs
+		}
+		if err := build(ctx, cfg, manifestTpl, workDir, output, tracker, rep, flags); err != nil {
+			return err
+		}
+		return opts.checkWarnings(cfg)
+	})
+	if err != nil {
+		return timeoutError(ctx, timeout, err)
+	}
+	recordInputs(ctx, output, inputs)
+	storeArtifact(ctx, opts.Store, output)
+
+	if err := tracker.Save(); err != nil {
+		logging.WarnContext(ctx, "Failed to update lock file", "path", lockPath, "error", err)
+	}
+	return nil
+}
+
+// dropPrivileges starts the privileged helper and drops the process to the
+// user who invoked sudo. Only the OCI rootfs pipeline routes the steps that
+// need root through the helper.
+func dropPrivileges(ctx context.Context, cfg *config.Config, opts buildCLIOptions) (*privsep.Helper, error) {
+	switch {
+	case opts.Plugin != "":
+		return nil, fmt.Errorf("--drop-privileges is not supported in multi-config builds")
+	case cfg.Strategy != config.StrategyOCIRootfs:
+		return nil, fmt.Errorf("--drop-privileges only supports the oci_rootfs strategy")
+	case cfg.Source.Dockerfile != "":
+		return nil, fmt.Errorf("--drop-privileges does not support source.dockerfile: the embedded BuildKit needs root")
+	case cfg.SELinux != nil:
+		return nil, fmt.Errorf("--drop-privileges does not support [selinux]: setting labels needs root")
+	}
+	helper, err := privsep.Start()
+	if err != nil {
+		return nil, err
+	}
+	logging.InfoContext(ctx, "Dropped root privileges; ownership, mounts and packaging run in a privileged helper", "uid", os.Getuid())
+	return helper, nil
+}
+
+// reclaimNeeds are what reclaiming the loop devices, mounts, taps and
+// microVM processes recorded in the ledger needs from the host.
+func reclaimNeeds() []hostcaps.Need {
+	return []hostcaps.Need{
+		hostcaps.Cap(hostcaps.CapSysAdmin, "to unmount images and detach loop devices"),
+		hostcaps.Cap(hostcaps.CapNetAdmin, "to delete tap devices"),
+		hostcaps.Cap(hostcaps.CapKill, "to stop microVM processes"),
+	}
+}
+
+// withBuildTimeout bounds ctx by timeout; a zero timeout leaves it unbounded.
+func withBuildTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError replaces the error of a build that ran out of time with one
+// naming the limit, since the step that was interrupted rarely explains it.
+func timeoutError(ctx context.Context, timeout time.Duration, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("build exceeded timeout of %s (raise --timeout or [build] timeout): %w", timeout, err)
+}
+
+// applyLogFile applies [logging] from cfg. Its file is used unless
+// --log-file or FLEDGE_LOG_FILE chose one, and is resolved against the
+// directory holding configPath; format and max_size apply to either.
+func applyLogFile(cfg *config.Config, configPath string) error {
+	l := cfg.Logging
+	if l == nil || (l.File == "" && logFile == "") {
+		return nil
+	}
+	path := logFile
+	if path == "" {
+		path = l.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(configPath), path)
+		}
+	}
+	opts := logging.FileOptions{Path: path, Format: l.Format}
+	if opts.Format == "" {
+		opts.Format = logFormat
+	}
+	if l.MaxSize != "" {
+		size, err := config.ParseByteSize(l.MaxSize)
+		if err != nil {
+			return err
+		}
+		opts.MaxSize = size
+	}
+	if err := logging.SetFile(opts); err != nil {
+		return err
+	}
+	logging.Debug("Writing log file", "path", path, "format", opts.Format)
+	return nil
+}
+
+// applyTempDir selects the scratch directory for the build from --workdir,
+// FLEDGE_WORKDIR or [build] temp_dir in cfg, in that order. A relative
+// temp_dir is resolved against the directory holding configPath.
+func applyTempDir(flagValue string, cfg *config.Config, configPath string) error {
+	dir := flagValue
+	if dir == "" {
+		dir = os.Getenv(utils.WorkDirEnv)
+	}
+	if dir == "" && cfg != nil && cfg.Build != nil && cfg.Build.TempDir != "" {
+		dir = cfg.Build.TempDir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(configPath), dir)
+		}
+	}
+	if dir == "" {
+		return nil
+	}
+	_, err := utils.UseTempDir(dir)
+	return err
 }
 
 func runDockerfileBuild(ctx context.Context, opts buildCLIOptions) error {
@@ -304,6 +1295,10 @@ func runDockerfileBuild(ctx context.Context, opts buildCLIOptions) error {
 		return fmt.Errorf("dockerfile path %s is a directory", dfAbs)
 	}
 
+	if err := applyTempDir(opts.TempDir, nil, ""); err != nil {
+		return err
+	}
+
 	contextDir := opts.ContextDir
 	if contextDir == "" {
 		contextDir = filepath.Dir(dfAbs)
@@ -350,6 +1345,7 @@ func runDockerfileBuild(ctx context.Context, opts buildCLIOptions) error {
 	if outputPath == "" {
 		outputPath = defaultDockerfileOutput(contextAbs, opts.OutputInitramfs)
 	}
+	outputPath = opts.resolveOutput(outputPath)
 
 	strategy := config.StrategyOCIRootfs
 	if opts.OutputInitramfs {
@@ -360,12 +1356,16 @@ func runDockerfileBuild(ctx context.Context, opts buildCLIOptions) error {
 		Version:  "1",
 		Strategy: strategy,
 		Source: config.SourceConfig{
-			Dockerfile: dfForConfig,
-			Context:    ctxForConfig,
-			Target:     opts.Target,
-			BuildArgs:  buildArgs,
+			Dockerfile:    dfForConfig,
+			Context:       ctxForConfig,
+			Target:        opts.Target,
+			BuildArgs:     buildArgs,
+			FrontendImage: opts.FrontendImage,
 		},
 	}
+	if err := applyImageExport(cfg, opts); err != nil {
+		return err
+	}
 
 	cfg.Agent = config.DefaultAgentConfig()
 	if strategy == config.StrategyOCIRootfs {
@@ -392,16 +1392,117 @@ func runDockerfileBuild(ctx context.Context, opts buildCLIOptions) error {
 		},
 	}
 
-	logging.Info("Starting Dockerfile build",
+	logging.InfoContext(ctx, "Starting Dockerfile build",
 		"dockerfile", dfAbs,
 		"context", contextAbs,
 		"output", outputPath,
 		"format", strategy)
 
-	if strategy == config.StrategyOCIRootfs {
-		return buildOCIRootfs(ctx, cfg, manifestTpl, workDir, outputPath)
+	ctx, cancel := withBuildTimeout(ctx, opts.Timeout)
+	defer cancel()
+	inputs, skip := checkInputs(ctx, cfg, manifestTpl, workDir, outputPath, opts.distFiles(outputPath), opts.Force)
+	if skip {
+		return nil
+	}
+	if err := hostcaps.Check(builder.HostNeeds(cfg)...); err != nil {
+		return err
+	}
+	err = runReported(ctx, strategy, outputPath, opts.NoReport, func(rep *report.Report) error {
+		build := buildInitramfs
+		if strategy == config.StrategyOCIRootfs {
+			build = buildOCIRootfs
+		}
+		if err := build(ctx, cfg, manifestTpl, workDir, outputPath, nil, rep, opts.builderFlags()); err != nil {
+			return err
+		}
+		return opts.checkWarnings(cfg)
+	})
+	if err != nil {
+		return timeoutError(ctx, opts.Timeout, err)
+	}
+	recordInputs(ctx, outputPath, inputs)
+	storeArtifact(ctx, opts.Store, outputPath)
+	return nil
+}
+
+// checkInputs digests the inputs of the build and reports whether it can be
+// skipped because output was already built from them. The record of the
+// previous build is removed otherwise, as the build may overwrite output.
+// distFiles, such as checksum files, must exist too. An empty digest means
+// the inputs could not be determined.
+func checkInputs(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string, distFiles []string, force bool) (string, bool) {
+	inputs, err := builder.InputsDigest(ctx, cfg, manifestTpl, workDir, output, version)
+	if err != nil {
+		logging.InfoContext(ctx, "Cannot tell whether build inputs changed; rebuilding", "reason", err)
+		inputs = ""
+	} else if !force && builder.UpToDate(cfg, workDir, output, inputs) && filesExist(distFiles) {
+		logging.InfoContext(ctx, "Build inputs unchanged; skipping build (use --force to rebuild)", "output", output, "inputs", inputs)
+		return inputs, true
+	}
+	if err := os.Remove(output + builder.InputsSuffix); err != nil && !os.IsNotExist(err) {
+		logging.WarnContext(ctx, "Failed to remove build inputs record", "error", err)
+	}
+	return inputs, false
+}
+
+// filesExist reports whether all paths exist.
+func filesExist(paths []string) bool {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
 	}
-	return buildInitramfs(ctx, cfg, manifestTpl, workDir, outputPath)
+	return true
+}
+
+// recordInputs records the inputs digest of a successful build next to its
+// output.
+func recordInputs(ctx context.Context, output, inputs string) {
+	if inputs == "" {
+		return
+	}
+	if err := builder.RecordInputs(output, inputs); err != nil {
+		logging.WarnContext(ctx, "Failed to record build inputs", "error", err)
+	}
+}
+
+// storeArtifact keeps output in the artifact store at dir, if set. A
+// failure to store leaves the artifact as built and only warns.
+func storeArtifact(ctx context.Context, dir, output string) {
+	if dir == "" {
+		return
+	}
+	s, err := store.Open(dir)
+	if err == nil {
+		var entry store.Entry
+		var deduplicated bool
+		if entry, deduplicated, err = s.Put(output); err == nil {
+			logging.InfoContext(ctx, "Artifact stored", "store", s.Dir(), "digest", entry.Digest, "deduplicated", deduplicated)
+			return
+		}
+	}
+	logging.WarnContext(ctx, "Failed to keep artifact in the store", "store", dir, "error", err)
+}
+
+// runReported runs build and writes its report to <output>.report.json, even
+// when the build fails. With disabled set, build runs without a report.
+func runReported(ctx context.Context, strategy, output string, disabled bool, build func(rep *report.Report) error) error {
+	if disabled {
+		return build(nil)
+	}
+
+	rep := report.New(version, strategy, output)
+	stopWarnings := logging.OnBuildWarn(ctx, rep.Warn)
+	err := build(rep)
+	stopWarnings()
+
+	rep.Finish(err)
+	if werr := rep.Write(); werr != nil {
+		logging.WarnContext(ctx, "Failed to write build report", "error", werr)
+	} else {
+		logging.InfoContext(ctx, "Build report written", "path", rep.Path())
+	}
+	return err
 }
 
 func parseBuildArgs(args []string) (map[string]string, error) {
@@ -461,7 +1562,7 @@ func setupSignalHandling() (context.Context, context.CancelFunc) {
 }
 
 // loadConfig loads and validates the configuration file.
-func loadConfig(configPath string) (*config.Config, error) {
+func loadConfig(configPath string, overrides []string) (*config.Config, error) {
 	logging.Debug("Loading configuration", "path", configPath)
 
 	// Check if config file exists
@@ -470,7 +1571,7 @@ func loadConfig(configPath string) (*config.Config, error) {
 	}
 
 	// Parse configuration
-	cfg, err := config.Load(configPath)
+	cfg, err := config.LoadWithOverrides(configPath, overrides)
 	if err != nil {
 		logging.Error("Failed to load configuration", "error", err)
 		return nil, fmt.Errorf("failed to parse config: %w", err)
@@ -604,40 +1705,84 @@ func sanitizeFilename(name string) string {
 }
 
 // buildOCIRootfs builds an OCI rootfs filesystem image.
-func buildOCIRootfs(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, outputPath string) error {
-	logging.Info("Building OCI rootfs artifact")
+func buildOCIRootfs(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, outputPath string, tracker *lock.Tracker, rep *report.Report, flags builderFlags) error {
+	logging.InfoContext(ctx, "Building OCI rootfs artifact")
 
 	// Validate OCI-specific requirements
-	if cfg.Source.Image == "" && cfg.Source.Dockerfile == "" {
-		return fmt.Errorf("either source.image or source.dockerfile is required for oci_rootfs strategy")
+	if cfg.Source.Image == "" && cfg.Source.Dockerfile == "" && cfg.Source.Artifact == "" && cfg.Binary == nil {
+		return fmt.Errorf("one of source.image, source.dockerfile or source.artifact is required for oci_rootfs strategy")
 	}
 
 	// Create builder with manifest template
 	builder := builder.NewOCIRootfsBuilder(cfg, manifestTpl, workDir, outputPath)
+	builder.Lock = tracker
+	builder.Report = rep
+	builder.TrackSizes = flags.SizeReport
+	builder.CopyDeps = flags.CopyDeps
+	builder.SkipVerify = flags.SkipVerify
+	builder.Checksums = flags.Checksums
+	builder.SBOM = flags.SBOM
+	builder.Privileged = flags.Privileged
+	builder.OnStep = flags.OnStep
 
 	// Run build
-	if err := builder.Build(); err != nil {
-		logging.Error("OCI rootfs build failed", "error", err)
+	if err := builder.BuildContext(ctx); err != nil {
+		logging.ErrorContext(ctx, "OCI rootfs build failed", "error", err)
 		return err
 	}
 
-	logging.Info("✓ OCI rootfs build complete", "output", outputPath)
+	logging.InfoContext(ctx, "✓ OCI rootfs build complete", "output", outputPath)
+	printSizeBreakdown(os.Stdout, builder.SizeBreakdown)
 	return nil
 }
 
 // buildInitramfs builds an initramfs CPIO archive.
-func buildInitramfs(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, outputPath string) error {
-	logging.Info("Building initramfs artifact")
+func buildInitramfs(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, outputPath string, tracker *lock.Tracker, rep *report.Report, flags builderFlags) error {
+	logging.InfoContext(ctx, "Building initramfs artifact")
 
 	// Create builder with manifest template
 	builder := builder.NewInitramfsBuilder(cfg, manifestTpl, workDir, outputPath)
+	builder.Lock = tracker
+	builder.Report = rep
+	builder.TrackSizes = flags.SizeReport
+	builder.CopyDeps = flags.CopyDeps
+	builder.SkipVerify = flags.SkipVerify
+	builder.Checksums = flags.Checksums
+	builder.SBOM = flags.SBOM
+	builder.OnStep = flags.OnStep
 
 	// Run build
-	if err := builder.Build(); err != nil {
-		logging.Error("Initramfs build failed", "error", err)
+	if err := builder.BuildContext(ctx); err != nil {
+		logging.ErrorContext(ctx, "Initramfs build failed", "error", err)
 		return err
 	}
 
-	logging.Info("✓ Initramfs build complete", "output", outputPath)
+	logging.InfoContext(ctx, "✓ Initramfs build complete", "output", outputPath)
+	printSizeBreakdown(os.Stdout, builder.SizeBreakdown)
 	return nil
 }
+
+// printSizeBreakdown prints the rootfs size ranked by top-level directory
+// and by source. A nil breakdown prints nothing.
+func printSizeBreakdown(w io.Writer, b *report.SizeBreakdown) {
+	if b == nil {
+		return
+	}
+	fmt.Fprintf(w, "\nRootfs size: %s in %d files\n", utils.FormatBytes(b.Bytes), b.Files)
+	for _, group := range []struct {
+		title  string
+		shares []report.SizeShare
+	}{{"DIRECTORY", b.ByDirectory}, {"SOURCE", b.BySource}} {
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "%s\tSIZE\tSHARE\tFILES\n", group.title)
+		for _, s := range group.shares {
+			share := 0.0
+			if b.Bytes > 0 {
+				share = float64(s.Bytes) * 100 / float64(b.Bytes)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%.1f%%\t%d\n", s.Name, utils.FormatBytes(s.Bytes), share, s.Files)
+		}
+		tw.Flush()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/progress"
+)
+
+// expandConfigPaths resolves the --config values to config files. A
+// directory stands for the fledge.toml in it, and a glob for the .toml
+// files and the directories containing a fledge.toml that it matches.
+func expandConfigPaths(values []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			path = filepath.Join(path, "fledge.toml")
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	for _, value := range values {
+		if !strings.ContainsAny(value, "*?[") {
+			add(value)
+			continue
+		}
+		matches, err := filepath.Glob(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --config pattern %q: %w", value, err)
+		}
+		found := false
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil {
+				continue
+			} else if info.IsDir() {
+				if _, err := os.Stat(filepath.Join(match, "fledge.toml")); err != nil {
+					continue
+				}
+			} else if filepath.Ext(match) != ".toml" {
+				continue
+			}
+			add(match)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("--config pattern %q matches no fledge.toml", value)
+		}
+	}
+	return paths, nil
+}
+
+// runMultiBuild builds the plugins of several configs, opts.Parallel at a
+// time. Every build has its own build ID, workspace, lock file and report,
+// and its log records carry the plugin name. A failed build does not stop
+// the others.
+func runMultiBuild(ctx context.Context, opts buildCLIOptions, paths []string) error {
+	switch {
+	case opts.DockerfilePath != "":
+		return fmt.Errorf("a Dockerfile cannot be built together with several --config files")
+	case opts.OutputPath != "":
+		return fmt.Errorf("--output cannot be used with several --config files; use --output-dir")
+	case opts.ManifestExplicit:
+		return fmt.Errorf("--manifest cannot be used with several --config files; each uses the manifest.toml next to it")
+	case opts.Parallel < 1:
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+	dirs := make(map[string]string, len(paths))
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve config path: %w", err)
+		}
+		if other, ok := dirs[filepath.Dir(abs)]; ok {
+			return fmt.Errorf("%s and %s are in the same directory and would share fledge.lock, manifest.toml and outputs", other, path)
+		}
+		dirs[filepath.Dir(abs)] = path
+	}
+
+	if err := applyTempDir(opts.TempDir, nil, ""); err != nil {
+		return err
+	}
+	if opts.Parallel > 1 && progress.Current() == progress.ModeTTY {
+		// Redrawn progress displays of concurrent builds would overwrite
+		// each other
+		progress.SetMode(progress.ModePlain)
+	}
+
+	plugins := pluginNames(paths)
+	logging.InfoContext(ctx, "Building plugins", "count", len(paths), "parallel", opts.Parallel)
+	errs := make([]error, len(paths))
+	warnings := make([]*buildWarnings, len(paths))
+	sem := make(chan struct{}, opts.Parallel)
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+
+			sub := opts
+			sub.ConfigPath = path
+			sub.ManifestPath = filepath.Join(filepath.Dir(path), "manifest.toml")
+			sub.Plugin = plugins[i]
+			if opts.OutputDir != "" {
+				sub.OutputDir = filepath.Join(opts.OutputDir, plugins[i])
+			} else {
+				sub.OutputBase = filepath.Dir(path)
+			}
+			buildCtx := logging.NewContext(ctx, logging.KeyPlugin, plugins[i], logging.KeyBuildID, newBuildID())
+			var stopWarnings func()
+			sub.warnings, stopWarnings = collectWarnings(buildCtx)
+			warnings[i] = sub.warnings
+			errs[i] = runConfigBuild(buildCtx, sub)
+			stopWarnings()
+			if errs[i] != nil {
+				logging.ErrorContext(buildCtx, "Plugin build failed", "error", errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nPLUGIN\tCONFIG\tWARNINGS\tRESULT")
+	for i, path := range paths {
+		result := "ok"
+		if errs[i] != nil {
+			failed++
+			result = "failed: " + errs[i].Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", plugins[i], path, warnings[i].count(), result)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d plugin builds failed", failed, len(paths))
+	}
+	return nil
+}
+
+// pluginNames names the plugin of each config after its directory, or
+// after the directory's path when two directories have the same name.
+func pluginNames(paths []string) []string {
+	names := make([]string, len(paths))
+	count := make(map[string]int, len(paths))
+	for i, path := range paths {
+		dir, _ := filepath.Abs(filepath.Dir(path))
+		names[i] = filepath.Base(dir)
+		count[names[i]]++
+	}
+	for i, path := range paths {
+		if count[names[i]] > 1 {
+			names[i] = filepath.ToSlash(filepath.Clean(filepath.Dir(path)))
+		}
+	}
+	return names
+}
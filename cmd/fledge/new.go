@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/volantvm/fledge/internal/scaffold"
+)
+
+func newNewCommand() *cobra.Command {
+	var (
+		name  string
+		force bool
+		list  bool
+	)
+	cmd := &cobra.Command{
+		Use:   "new <template> [directory]",
+		Short: "Create a plugin directory from a template",
+		Long: `Create a plugin directory from a template for a common plugin archetype: a
+Dockerfile or payload, fledge.toml and manifest.toml that build as they are.
+The directory defaults to the current one and is created if needed; the
+plugin is named after it unless --name is given. Existing files are left
+alone unless --force is given.`,
+		Example: `  # List the templates
+  fledge new --list
+
+  # Start a Go service in ./hello and build it
+  fledge new go-service hello
+  cd hello && sudo fledge build`,
+		Args: cobra.RangeArgs(0, 2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) > 0 {
+				return nil, cobra.ShellCompDirectiveFilterDirs
+			}
+			var names []string
+			for _, t := range scaffold.Templates() {
+				names = append(names, t.Name+"\t"+t.Description)
+			}
+			return names, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if list || len(args) == 0 {
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				for _, t := range scaffold.Templates() {
+					fmt.Fprintf(w, "%s\t%s\n", t.Name, t.Description)
+				}
+				return w.Flush()
+			}
+			dir := "."
+			if len(args) == 2 {
+				dir = args[1]
+			}
+			paths, err := scaffold.Write(args[0], dir, scaffold.Options{Name: name, Force: force})
+			if err != nil {
+				return err
+			}
+			for _, p := range paths {
+				fmt.Printf("Wrote %s\n", filepath.Join(dir, p))
+			}
+			if dir == "." {
+				fmt.Println("Build it with: sudo fledge build")
+			} else {
+				fmt.Printf("Build it with: cd %s && sudo fledge build\n", dir)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "plugin name (default: the directory's name)")
+	cmd.Flags().BoolVar(&force, "force", false, "overwrite existing files")
+	cmd.Flags().BoolVar(&list, "list", false, "list the templates")
+	return cmd
+}
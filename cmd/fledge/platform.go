@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// requireLinux fails commands that need a Linux host (loop devices, mounts,
+// mkfs tools and KVM step VMs) on other platforms, where fledge only
+// scaffolds, imports, generates, publishes and builds with --remote.
+func requireLinux(command string) error {
+	if runtime.GOOS == "linux" {
+		return nil
+	}
+	return fmt.Errorf("fledge %s needs a Linux host, not %s; build on a Linux machine running fledge serve with fledge build --remote URL", command, runtime.GOOS)
+}
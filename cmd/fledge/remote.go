@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/remote"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// remotePriorities are the --priority values, as fledge serve accepts them.
+var remotePriorities = []string{"low", "normal", "high"}
+
+// runRemoteBuild builds the fledge.toml of opts on the build service at
+// opts.Remote, printing its log as it runs, and downloads the artifact, its
+// manifest.json and checksum to where a local build would write them.
+func runRemoteBuild(ctx context.Context, opts buildCLIOptions) error {
+	if err := checkRemoteOptions(opts); err != nil {
+		return err
+	}
+	configPaths, err := expandConfigPaths(opts.ConfigPaths)
+	if err != nil {
+		return err
+	}
+	if len(configPaths) != 1 {
+		return fmt.Errorf("--remote builds one config at a time, got %d", len(configPaths))
+	}
+	opts.ConfigPath = configPaths[0]
+	client, err := remote.NewClient(opts.Remote, opts.APIKey)
+	if err != nil {
+		return err
+	}
+
+	ctx = logging.NewContext(ctx, logging.KeyBuildID, newBuildID())
+	warnings, stopWarnings := collectWarnings(ctx)
+	opts.warnings = warnings
+	defer func() {
+		stopWarnings()
+		if !quiet {
+			warnings.printSummary(os.Stderr)
+		}
+	}()
+
+	cfg, err := loadConfig(opts.ConfigPath, nil)
+	if err != nil {
+		return err
+	}
+	// The service builds with its default manifest unless one is sent
+	manifestPath := opts.ManifestPath
+	if _, err := os.Stat(manifestPath); err != nil {
+		if opts.ManifestExplicit {
+			return fmt.Errorf("manifest file not found: %s", manifestPath)
+		}
+		manifestPath = ""
+	}
+	output := opts.resolveOutput(determineOutputPath(cfg, opts.OutputPath))
+
+	ctx, cancel := withBuildTimeout(ctx, opts.Timeout)
+	defer cancel()
+	logging.InfoContext(ctx, "Starting remote build", "remote", opts.Remote, "config", opts.ConfigPath, "output", output)
+	a, err := client.Build(ctx, remote.Request{
+		ConfigPath:   opts.ConfigPath,
+		ManifestPath: manifestPath,
+		Exclude:      outputExcludes(opts.ConfigPath, output),
+		Keep:         localSources(cfg),
+		Priority:     opts.Priority,
+		OnLog:        func(l remote.Log) { logRemote(ctx, l) },
+	}, output)
+	if err != nil {
+		return timeoutError(ctx, opts.Timeout, err)
+	}
+	logging.InfoContext(ctx, "Remote build complete", "artifact", output, "size", utils.FormatBytes(a.Size), "sha256", a.SHA256)
+	storeArtifact(ctx, opts.Store, output)
+	return opts.checkWarnings(cfg)
+}
+
+// checkRemoteOptions rejects the build options a remote build cannot honor:
+// those of Dockerfile builds and of steps that only run locally.
+func checkRemoteOptions(opts buildCLIOptions) error {
+	unsupported := []struct {
+		flag string
+		set  bool
+	}{
+		{"--dockerfile", opts.DockerfilePath != ""},
+		{"--set", len(opts.Set) > 0},
+		{"--build-arg", len(opts.BuildArgs) > 0},
+		{"--frontend-image", opts.FrontendImage != ""},
+		{"--also-export-image", opts.ExportImage != ""},
+		{"--also-push-image", opts.PushImage != ""},
+		{"--locked", opts.Locked},
+		{"--drop-privileges", opts.DropPrivileges},
+		{"--size-report", opts.SizeReport},
+		{"--copy-deps", opts.CopyDeps},
+		{"--skip-verify", opts.SkipVerify},
+		{"--sha512", opts.SHA512},
+		{"--sbom", opts.SBOM},
+		{"--tui", opts.TUI},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return fmt.Errorf("%s is not supported with --remote", u.flag)
+		}
+	}
+	if opts.Priority != "" && !slices.Contains(remotePriorities, opts.Priority) {
+		return fmt.Errorf("invalid --priority %q: must be one of %s", opts.Priority, strings.Join(remotePriorities, ", "))
+	}
+	return nil
+}
+
+// outputExcludes returns the patterns, relative to the directory of
+// configPath, that keep output and the files written next to it out of the
+// upload when they are inside that directory.
+func outputExcludes(configPath, output string) []string {
+	dir, err := filepath.Abs(filepath.Dir(configPath))
+	if err != nil {
+		return nil
+	}
+	abs, err := filepath.Abs(output)
+	if err != nil {
+		return nil
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	return []string{rel, rel + ".*"}
+}
+
+// localSources returns the relative paths of the local files cfg reads,
+// which are uploaded even if an ignore file matches them.
+func localSources(cfg *config.Config) []string {
+	var paths []string
+	add := func(path string) {
+		if path != "" && !filepath.IsAbs(path) {
+			paths = append(paths, path)
+		}
+	}
+	add(cfg.Source.Dockerfile)
+	if cfg.Agent != nil && cfg.Agent.SourceStrategy == config.AgentSourceLocal {
+		add(cfg.Agent.Path)
+	}
+	for src := range cfg.Mappings {
+		if _, isRemote, _ := config.ParseRemoteSource(src); !isRemote {
+			add(src)
+		}
+	}
+	return paths
+}
+
+// logRemote logs a record of a remote build as if the local build had, so
+// progress output, the log file and warning checks see it.
+func logRemote(ctx context.Context, l remote.Log) {
+	var args []any
+	if l.Step != "" {
+		args = append(args, logging.KeyStep, l.Step)
+	}
+	keys := make([]string, 0, len(l.Attrs))
+	for k := range l.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, k, l.Attrs[k])
+	}
+
+	switch level := l.SlogLevel(); {
+	case level >= slog.LevelError:
+		logging.ErrorContext(ctx, l.Message, args...)
+	case level >= slog.LevelWarn:
+		logging.WarnContext(ctx, l.Message, args...)
+	case level >= slog.LevelInfo:
+		logging.InfoContext(ctx, l.Message, args...)
+	default:
+		logging.DebugContext(ctx, l.Message, args...)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/volantvm/fledge/internal/store"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+func newStoreCommand() *cobra.Command {
+	var dir string
+	cmd := &cobra.Command{
+		Use:   "store",
+		Short: "List and prune the artifact store",
+		Long: `fledge build --store DIR (or FLEDGE_STORE) keeps each artifact in DIR by
+the SHA256 of its content. An artifact identical to one already stored is
+hardlinked to the stored copy rather than kept twice, which saves space when
+building many similar plugin versions. The store must be on the filesystem
+of the outputs.`,
+	}
+	cmd.PersistentFlags().StringVar(&dir, "store", os.Getenv(store.Env), "artifact store directory (or FLEDGE_STORE)")
+	registerCompletions(cmd, map[string]completionFunc{"store": completeDirs})
+	cmd.AddCommand(newStoreListCommand(&dir), newStorePruneCommand(&dir))
+	return cmd
+}
+
+func newStoreListCommand(dir *string) *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List the stored artifacts and the outputs linked to them",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := store.Open(*dir)
+			if err != nil {
+				return err
+			}
+			entries, err := s.List()
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				if entries == nil {
+					entries = []store.Entry{}
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(entries)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "DIGEST\tSIZE\tADDED\tOUTPUTS")
+			var total, saved int64
+			for _, e := range entries {
+				outputs := strings.Join(e.Paths, ", ")
+				if outputs == "" {
+					outputs = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", shortDigest(e.Digest), utils.FormatBytes(e.Size),
+					e.Added.Local().Format(time.DateTime), outputs)
+				total += e.Size
+				if len(e.Paths) > 1 {
+					saved += e.Size * int64(len(e.Paths)-1)
+				}
+			}
+			w.Flush()
+			fmt.Printf("%d artifacts, %s stored, %s saved by hardlinks\n", len(entries), utils.FormatBytes(total), utils.FormatBytes(saved))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the artifacts as JSON")
+	return cmd
+}
+
+func newStorePruneCommand(dir *string) *cobra.Command {
+	var (
+		olderThan time.Duration
+		dryRun    bool
+	)
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove stored artifacts no output is linked to any more",
+		Long: `Remove the stored artifacts that no output is hardlinked to any more, because
+every output built with that content was deleted or rebuilt differently.
+Those only take up space in the store.`,
+		Example: `  # Remove unreferenced artifacts added over a month ago
+  fledge store prune --older-than 720h`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := store.Open(*dir)
+			if err != nil {
+				return err
+			}
+			var cutoff time.Time
+			if olderThan > 0 {
+				cutoff = time.Now().Add(-olderThan)
+			}
+			pruned, err := s.Prune(cutoff, dryRun)
+			var freed int64
+			for _, e := range pruned {
+				freed += e.Size
+				fmt.Println(e.Digest)
+			}
+			if err != nil {
+				return err
+			}
+			verb := "Removed"
+			if dryRun {
+				verb = "Would remove"
+			}
+			fmt.Printf("%s %d artifacts, %s\n", verb, len(pruned), utils.FormatBytes(freed))
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&olderThan, "older-than", 0, "only remove artifacts added longer ago than this, e.g. 720h")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "list what would be removed without removing it")
+	return cmd
+}
+
+// shortDigest abbreviates a sha256 digest like docker image ls does.
+func shortDigest(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
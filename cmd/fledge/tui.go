@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/volantvm/fledge/internal/builder"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/microvmworker"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/tui"
+)
+
+// startMonitor takes over the terminal with the --tui build monitor: the
+// console log goes to its log pane instead, progress bars are turned off, and
+// the build's steps and step VMs are passed to it. The returned function
+// restores the terminal and the console log.
+func startMonitor(opts *buildCLIOptions) (stop func(), err error) {
+	title := opts.ConfigPath
+	if opts.DockerfilePath != "" {
+		title = opts.DockerfilePath
+	}
+	if title == "" {
+		title = "fledge.toml"
+	}
+	mon, err := tui.Start(os.Stderr, filepath.Base(filepath.Dir(absOrSelf(title)))+"/"+filepath.Base(title))
+	if err != nil {
+		return nil, err
+	}
+
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	logging.SetHandler(mon.Handler(level))
+	progress.SetMode(progress.ModeQuiet)
+	unregister := microvmworker.OnVM(func(ev microvmworker.VMEvent) {
+		mon.VM(ev.Name, ev.PID, ev.Exited, ev.Err)
+	})
+	opts.onStep = func(ev builder.StepEvent) {
+		mon.Step(ev.Name, ev.Done, ev.Duration, ev.Err)
+	}
+	return func() {
+		unregister()
+		mon.Stop()
+		_ = logging.InitLoggerFormat(verbose, quiet, logFormat)
+	}, nil
+}
+
+// absOrSelf returns the absolute form of path, or path if it has none.
+func absOrSelf(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// exitDegraded is the exit status of a build that --strict failed for its
+// warnings, so that CI can tell a degraded artifact from a failed build.
+const exitDegraded = 3
+
+// buildWarnings collects the warnings of a build by class, for the summary
+// printed when it ends and for --strict.
+type buildWarnings struct {
+	mu      sync.Mutex
+	byClass map[string][]string
+}
+
+// collectWarnings collects the warnings of the build of ctx until the
+// returned function is called.
+func collectWarnings(ctx context.Context) (*buildWarnings, func()) {
+	w := &buildWarnings{byClass: map[string][]string{}}
+	stop := logging.OnBuildWarn(ctx, func(msg string, args []any) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		class := logging.WarningClass(args)
+		w.byClass[class] = append(w.byClass[class], report.FormatWarning(msg, args))
+	})
+	return w, stop
+}
+
+// count returns the number of warnings collected.
+func (w *buildWarnings) count() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, list := range w.byClass {
+		n += len(list)
+	}
+	return n
+}
+
+// printSummary lists the warnings by class, if there were any.
+func (w *buildWarnings) printSummary(out io.Writer) {
+	n := w.count()
+	if n == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(out, "\nBuild finished with %d %s:\n", n, plural(n, "warning"))
+	for _, class := range logging.WarningClasses {
+		for _, warning := range w.byClass[class] {
+			fmt.Fprintf(out, "  [%s] %s\n", class, warning)
+		}
+	}
+}
+
+// check fails with a degradedError if any warnings of classes were
+// collected.
+func (w *buildWarnings) check(classes []string) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var found []string
+	for _, class := range logging.WarningClasses {
+		if n := len(w.byClass[class]); n > 0 && slices.Contains(classes, class) {
+			found = append(found, fmt.Sprintf("%d %s", n, class))
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return &degradedError{found: found}
+}
+
+// degradedError fails a build that logged warnings of the classes --strict
+// turns into errors.
+type degradedError struct {
+	// found are the classes' warning counts, such as "2 kernel-modules".
+	found []string
+}
+
+func (e *degradedError) Error() string {
+	return fmt.Sprintf("--strict: the build logged %s warnings (see [build] strict_warnings)", strings.Join(e.found, ", "))
+}
+
+// ExitCode is the exit status fledge exits with for e.
+func (e *degradedError) ExitCode() int {
+	return exitDegraded
+}
+
+// checkWarnings fails a build run with --strict that logged warnings of the
+// classes cfg selects.
+func (o buildCLIOptions) checkWarnings(cfg *config.Config) error {
+	if !o.Strict {
+		return nil
+	}
+	return o.warnings.check(cfg.StrictWarnings())
+}
+
+// plural returns word for n of one, and word with an s otherwise.
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
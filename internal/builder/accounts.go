@@ -0,0 +1,266 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/privsep"
+)
+
+// accountFile is a colon-separated account database such as /etc/passwd.
+// Lines are kept as split fields so entries fledge does not touch are
+// written back unchanged.
+type accountFile struct {
+	path  string
+	mode  os.FileMode
+	lines [][]string
+}
+
+// loadAccountFile reads name (e.g. "/etc/passwd") from the rootfs. A missing
+// file starts out with seed, the entry for root.
+func loadAccountFile(rootfsDir, name string, mode os.FileMode, seed string) (*accountFile, error) {
+	f := &accountFile{path: filepath.Join(rootfsDir, name), mode: mode}
+	hostPath, err := resolveInRoot(rootfsDir, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		f.lines = [][]string{strings.Split(seed, ":")}
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+	data, err := os.ReadFile(hostPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if info, err := os.Stat(hostPath); err == nil {
+		f.mode = info.Mode().Perm()
+	}
+	f.path = hostPath
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line != "" {
+			f.lines = append(f.lines, strings.Split(line, ":"))
+		}
+	}
+	return f, nil
+}
+
+// find returns the entry whose field i equals value.
+func (f *accountFile) find(i int, value string) []string {
+	for _, fields := range f.lines {
+		if len(fields) > i && fields[i] == value {
+			return fields
+		}
+	}
+	return nil
+}
+
+// put replaces the entry named fields[0], or appends it.
+func (f *accountFile) put(fields []string) {
+	for i, existing := range f.lines {
+		if existing[0] == fields[0] {
+			f.lines[i] = fields
+			return
+		}
+	}
+	f.lines = append(f.lines, fields)
+}
+
+func (f *accountFile) save() error {
+	var b strings.Builder
+	for _, fields := range f.lines {
+		b.WriteString(strings.Join(fields, ":"))
+		b.WriteByte('\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(f.path, []byte(b.String()), f.mode); err != nil {
+		return err
+	}
+	return os.Chmod(f.path, f.mode)
+}
+
+// accountDB holds the rootfs /etc/passwd, /etc/group and /etc/shadow.
+type accountDB struct {
+	passwd, group, shadow *accountFile
+}
+
+func loadAccounts(rootfsDir string) (*accountDB, error) {
+	passwd, err := loadAccountFile(rootfsDir, "/etc/passwd", 0644, "root:x:0:0:root:/root:/bin/sh")
+	if err != nil {
+		return nil, err
+	}
+	group, err := loadAccountFile(rootfsDir, "/etc/group", 0644, "root:x:0:")
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := loadAccountFile(rootfsDir, "/etc/shadow", 0640, "root:*::0:99999:7:::")
+	if err != nil {
+		return nil, err
+	}
+	return &accountDB{passwd: passwd, group: group, shadow: shadow}, nil
+}
+
+func (db *accountDB) save() error {
+	for _, f := range []*accountFile{db.passwd, db.group, db.shadow} {
+		if err := f.save(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// addGroup adds a group, or adds members to an existing group of the same
+// name and gid.
+func (db *accountDB) addGroup(name string, gid int, members []string) error {
+	id := strconv.Itoa(gid)
+	fields := db.group.find(0, name)
+	if fields == nil {
+		if other := db.group.find(2, id); other != nil {
+			return fmt.Errorf("gid %d of group %s is already used by group %s", gid, name, other[0])
+		}
+		fields = []string{name, "x", id, ""}
+	} else if len(fields) < 4 || fields[2] != id {
+		return fmt.Errorf("group %s already exists with a different gid", name)
+	}
+	for _, m := range members {
+		addGroupMember(fields, m)
+	}
+	db.group.put(fields)
+	return nil
+}
+
+// addGroupMember adds user to the member list of a group entry.
+func addGroupMember(fields []string, user string) {
+	var members []string
+	if fields[3] != "" {
+		members = strings.Split(fields[3], ",")
+	}
+	for _, m := range members {
+		if m == user {
+			return
+		}
+	}
+	fields[3] = strings.Join(append(members, user), ",")
+}
+
+// primaryGID resolves u's primary group, creating the user's own group when
+// neither gid nor group is set.
+func (db *accountDB) primaryGID(u config.UserConfig) (int, error) {
+	switch {
+	case u.Group != "":
+		fields := db.group.find(0, u.Group)
+		if fields == nil {
+			return 0, fmt.Errorf("group %s of user %s does not exist", u.Group, u.Name)
+		}
+		return strconv.Atoi(fields[2])
+	case u.GID != nil:
+		return *u.GID, nil
+	}
+	if fields := db.group.find(0, u.Name); fields != nil {
+		return strconv.Atoi(fields[2])
+	}
+	if err := db.addGroup(u.Name, *u.UID, nil); err != nil {
+		return 0, fmt.Errorf("failed to create group for user %s (set 'gid' or 'group'): %w", u.Name, err)
+	}
+	return *u.UID, nil
+}
+
+// addUser adds u, or updates an existing user with the same uid.
+func (db *accountDB) addUser(u config.UserConfig) (gid int, err error) {
+	uid := strconv.Itoa(*u.UID)
+	if fields := db.passwd.find(0, u.Name); fields != nil && (len(fields) < 3 || fields[2] != uid) {
+		return 0, fmt.Errorf("user %s already exists with a different uid", u.Name)
+	}
+	if other := db.passwd.find(2, uid); other != nil && other[0] != u.Name {
+		return 0, fmt.Errorf("uid %s of user %s is already used by user %s", uid, u.Name, other[0])
+	}
+	if gid, err = db.primaryGID(u); err != nil {
+		return 0, err
+	}
+	for _, g := range u.Groups {
+		fields := db.group.find(0, g)
+		if fields == nil || len(fields) < 4 {
+			return 0, fmt.Errorf("supplementary group %s of user %s does not exist", g, u.Name)
+		}
+		addGroupMember(fields, u.Name)
+	}
+
+	db.passwd.put([]string{u.Name, "x", uid, strconv.Itoa(gid), u.Comment, u.HomeDir(), u.LoginShell()})
+	if db.shadow.find(0, u.Name) == nil {
+		db.shadow.put([]string{u.Name, "!", "", "0", "99999", "7", "", "", ""})
+	}
+	return gid, nil
+}
+
+// applyAccounts adds the [[groups]] and [[users]] of cfg to the rootfs
+// account databases and creates the users' home directories.
+func applyAccounts(ctx context.Context, cfg *config.Config, rootfsDir string) error {
+	if len(cfg.Users) == 0 && len(cfg.Groups) == 0 {
+		return nil
+	}
+	logging.InfoContext(ctx, "Creating users and groups", "users", len(cfg.Users), "groups", len(cfg.Groups))
+
+	db, err := loadAccounts(rootfsDir)
+	if err != nil {
+		return err
+	}
+	for _, g := range cfg.Groups {
+		if err := db.addGroup(g.Name, *g.GID, g.Members); err != nil {
+			return err
+		}
+	}
+	gids := make([]int, len(cfg.Users))
+	for i, u := range cfg.Users {
+		if gids[i], err = db.addUser(u); err != nil {
+			return err
+		}
+	}
+	if err := db.save(); err != nil {
+		return err
+	}
+
+	for i, u := range cfg.Users {
+		if err := createHome(rootfsDir, u.HomeDir(), *u.UID, gids[i]); err != nil {
+			return fmt.Errorf("failed to create home of user %s: %w", u.Name, err)
+		}
+		if _, err := resolveInRoot(rootfsDir, u.LoginShell()); err != nil {
+			logging.WarnContext(ctx, "Login shell is missing from the artifact", "user", u.Name, "shell", u.LoginShell())
+		}
+		logging.DebugContext(ctx, "Created user", "user", u.Name, "uid", *u.UID, "gid", gids[i])
+	}
+	return nil
+}
+
+// createHome creates a home directory owned by uid:gid unless it already
+// exists or is a placeholder such as /nonexistent.
+func createHome(rootfsDir, home string, uid, gid int) error {
+	if home == "/" || home == "/nonexistent" {
+		return nil
+	}
+	dir := filepath.Join(rootfsDir, filepath.Clean(home))
+	if _, err := os.Lstat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if privsep.Journaling() {
+		privsep.RecordOwner(dir, uid, gid)
+		return nil
+	}
+	if uid != os.Geteuid() || gid != os.Getegid() {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s to %d:%d: %w", home, uid, gid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestApplyAccounts tests adding users and groups to an image's account
+// databases and to a rootfs without any.
+func TestApplyAccounts(t *testing.T) {
+	intp := func(v int) *int { return &v }
+	read := func(root, name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	ctx := context.Background()
+
+	// An image with existing accounts
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/ash\nnobody:x:65534:65534:nobody:/:/sbin/nologin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/group"), []byte("root:x:0:\nwheel:x:10:root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Groups: []config.GroupConfig{{Name: "svc", GID: intp(4242)}},
+		Users: []config.UserConfig{
+			{Name: "app", UID: intp(1000), Group: "svc", Groups: []string{"wheel"}, Home: "/nonexistent", Shell: "/sbin/nologin"},
+		},
+	}
+	if err := applyAccounts(ctx, cfg, root); err != nil {
+		t.Fatalf("applyAccounts failed: %v", err)
+	}
+	if passwd := read(root, "etc/passwd"); !strings.Contains(passwd, "nobody:x:65534:") || !strings.HasSuffix(passwd, "app:x:1000:4242::/nonexistent:/sbin/nologin\n") {
+		t.Errorf("Unexpected /etc/passwd:\n%s", passwd)
+	}
+	if group := read(root, "etc/group"); !strings.Contains(group, "wheel:x:10:root,app\n") || !strings.Contains(group, "svc:x:4242:\n") {
+		t.Errorf("Unexpected /etc/group:\n%s", group)
+	}
+	if shadow := read(root, "etc/shadow"); !strings.Contains(shadow, "app:!:") {
+		t.Errorf("Unexpected /etc/shadow:\n%s", shadow)
+	}
+
+	// Conflicts with the image fail the build
+	for _, bad := range []*config.Config{
+		{Users: []config.UserConfig{{Name: "nobody", UID: intp(1000)}}},
+		{Users: []config.UserConfig{{Name: "other", UID: intp(65534)}}},
+		{Groups: []config.GroupConfig{{Name: "other", GID: intp(10)}}},
+		{Users: []config.UserConfig{{Name: "other", UID: intp(2000), Group: "missing"}}},
+	} {
+		if err := applyAccounts(ctx, bad, root); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+
+	// A rootfs without accounts gets root and the user's own group
+	root = t.TempDir()
+	cfg = &config.Config{Users: []config.UserConfig{{Name: "svc", UID: intp(100), Home: "/nonexistent"}}}
+	if err := applyAccounts(ctx, cfg, root); err != nil {
+		t.Fatalf("applyAccounts on an empty rootfs failed: %v", err)
+	}
+	if passwd, group := read(root, "etc/passwd"), read(root, "etc/group"); !strings.HasPrefix(passwd, "root:x:0:0:") || group != "root:x:0:\nsvc:x:100:\n" {
+		t.Errorf("Unexpected accounts:\n%s\n%s", passwd, group)
+	}
+}
+
+// TestCreateHome tests creating a home directory owned by the build user.
+func TestCreateHome(t *testing.T) {
+	root := t.TempDir()
+	if err := createHome(root, "/home/app", os.Geteuid(), os.Getegid()); err != nil {
+		t.Fatalf("createHome failed: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "home/app")); err != nil || !info.IsDir() {
+		t.Errorf("Expected a home directory, got %v", err)
+	}
+	if err := createHome(root, "/nonexistent", 1, 1); err != nil {
+		t.Errorf("Expected placeholder homes to be skipped, got %v", err)
+	}
+}
@@ -2,15 +2,17 @@
 package builder
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
 	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/oci"
 	"github.com/volantvm/fledge/internal/utils"
 )
 
@@ -30,55 +32,129 @@ type GitHubRelease struct {
 	} `json:"assets"`
 }
 
+// ResolvedAgent describes a sourced kestrel agent binary.
+type ResolvedAgent struct {
+	// Path is the temporary copy of the binary; remove it with CleanupAgent.
+	Path           string
+	SourceStrategy string
+	// Version is the resolved release tag (release strategy only).
+	Version string
+	// URL is where the binary was downloaded from, if it was downloaded.
+	URL string
+	// Image is the OCI reference the binary was pulled from (oci strategy only).
+	Image string
+	// Digest is the "sha256:<hex>" digest of the binary.
+	Digest string
+}
+
+// LockEntry returns the fledge.lock entry for the agent.
+func (a *ResolvedAgent) LockEntry() lock.Agent {
+	return lock.Agent{
+		SourceStrategy: a.SourceStrategy,
+		Version:        a.Version,
+		URL:            a.URL,
+		Image:          a.Image,
+		Digest:         a.Digest,
+	}
+}
+
+// agentManifest returns the manifest.json "agent" section for a.
+func agentManifest(a *ResolvedAgent) map[string]interface{} {
+	agent := map[string]interface{}{
+		"source_strategy": a.SourceStrategy,
+		"digest":          a.Digest,
+	}
+	if a.Version != "" {
+		agent["version"] = a.Version
+	}
+	return agent
+}
+
+// recordAgentDownload records a downloaded or pulled agent in the build report.
+func recordAgentDownload(ctx context.Context, a *ResolvedAgent) {
+	source := a.URL
+	if source == "" {
+		source = a.Image
+	}
+	if source == "" {
+		return
+	}
+	recordFileDownload(ctx, "agent", source, a.Path, false)
+}
+
 // SourceAgent sources the kestrel agent binary based on the configuration.
 // Returns the path to the agent binary.
-func SourceAgent(agentCfg *config.AgentConfig, showProgress bool) (string, error) {
+func SourceAgent(ctx context.Context, agentCfg *config.AgentConfig, showProgress bool) (string, error) {
+	agent, err := ResolveAgent(ctx, agentCfg, showProgress)
+	if err != nil {
+		return "", err
+	}
+	return agent.Path, nil
+}
+
+// ResolveAgent sources the kestrel agent binary based on the configuration
+// and reports the version and digest it resolved to. When agent.checksum is
+// set the binary is verified against it for every strategy.
+func ResolveAgent(ctx context.Context, agentCfg *config.AgentConfig, showProgress bool) (*ResolvedAgent, error) {
 	if agentCfg == nil {
-		return "", fmt.Errorf("agent configuration is nil")
+		return nil, fmt.Errorf("agent configuration is nil")
 	}
 
-	logging.Info("Sourcing agent", "strategy", agentCfg.SourceStrategy)
+	logging.InfoContext(ctx, "Sourcing agent", "strategy", agentCfg.SourceStrategy)
 
+	agent := &ResolvedAgent{SourceStrategy: agentCfg.SourceStrategy}
+	var err error
 	switch agentCfg.SourceStrategy {
 	case config.AgentSourceRelease:
-		return sourceAgentFromRelease(agentCfg.Version, showProgress)
+		if vendored := vendoredAgent(agentCfg.Version); vendored != nil {
+			agent.Path, agent.Version, agent.URL, err = sourceAgentFromVendored(ctx, vendored)
+			break
+		}
+		agent.Path, agent.Version, agent.URL, err = sourceAgentFromRelease(ctx, agentCfg.Version, showProgress)
 	case config.AgentSourceLocal:
-		return sourceAgentFromLocal(agentCfg.Path)
+		agent.Path, err = sourceAgentFromLocal(agentCfg.Path)
 	case config.AgentSourceHTTP:
-		return sourceAgentFromHTTP(agentCfg.URL, agentCfg.Checksum, showProgress)
+		agent.URL = agentCfg.URL
+		agent.Path, err = sourceAgentFromHTTP(ctx, agentCfg.URL, agentCfg.Checksum, showProgress)
+	case config.AgentSourceOCI:
+		agent.Image = agentCfg.Image
+		agent.Path, err = sourceAgentFromOCI(ctx, agentCfg.Image)
 	default:
-		return "", fmt.Errorf("unknown agent source strategy: %s", agentCfg.SourceStrategy)
+		return nil, fmt.Errorf("unknown agent source strategy: %s", agentCfg.SourceStrategy)
 	}
-}
-
-// sourceAgentFromRelease fetches the kestrel binary from GitHub releases.
-func sourceAgentFromRelease(version string, showProgress bool) (string, error) {
-	logging.Info("Fetching agent from GitHub releases", "version", version)
-
-	// Fetch release information from GitHub API
-	var releaseURL string
-	if version == "latest" {
-		releaseURL = fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", DefaultGitHubRepo)
-	} else {
-		releaseURL = fmt.Sprintf("https://api.github.com/repos/%s/releases/tags/%s", DefaultGitHubRepo, version)
+	if err != nil {
+		return nil, err
 	}
 
-	logging.Debug("Fetching release info", "url", releaseURL)
+	// The HTTP strategy has already verified its checksum
+	if agentCfg.Checksum != "" && agentCfg.SourceStrategy != config.AgentSourceHTTP {
+		logging.InfoContext(ctx, "Verifying agent checksum")
+		if err := utils.VerifyChecksum(agent.Path, agentCfg.Checksum); err != nil {
+			CleanupAgent(agent.Path)
+			return nil, fmt.Errorf("agent checksum verification failed: %w", err)
+		}
+	}
 
-	resp, err := http.Get(releaseURL)
+	hash, err := utils.CalculateSHA256(agent.Path)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch release info: %w", err)
+		CleanupAgent(agent.Path)
+		return nil, fmt.Errorf("failed to hash agent: %w", err)
 	}
-	defer resp.Body.Close()
+	agent.Digest = "sha256:" + hash
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("GitHub API returned status %d: %s", resp.StatusCode, string(body))
-	}
+	logging.InfoContext(ctx, "Agent resolved", "version", agent.Version, "digest", agent.Digest)
+	return agent, nil
+}
+
+// sourceAgentFromRelease fetches the kestrel binary from GitHub releases and
+// returns its path along with the resolved release tag and download URL.
+func sourceAgentFromRelease(ctx context.Context, version string, showProgress bool) (string, string, string, error) {
+	logging.InfoContext(ctx, "Fetching agent from GitHub releases", "version", version)
 
-	var release GitHubRelease
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		return "", fmt.Errorf("failed to parse release JSON: %w", err)
+	// Fetch release information from GitHub API (cached, with rate-limit retries)
+	release, err := fetchRelease(ctx, DefaultGitHubRepo, version)
+	if err != nil {
+		return "", "", "", err
 	}
 
 	// Find the kestrel asset
@@ -91,25 +167,25 @@ func sourceAgentFromRelease(version string, showProgress bool) (string, error) {
 	}
 
 	if downloadURL == "" {
-		return "", fmt.Errorf("kestrel binary not found in release %s", release.TagName)
+		return "", "", "", fmt.Errorf("kestrel binary not found in release %s", release.TagName)
 	}
 
-	logging.Info("Downloading kestrel", "version", release.TagName, "url", downloadURL)
+	logging.InfoContext(ctx, "Downloading kestrel", "version", release.TagName, "url", downloadURL)
 
 	// Download to temp file
-	tmpPath, err := utils.DownloadToTempFile(downloadURL, showProgress)
+	tmpPath, err := utils.DownloadToTempFile(ctx, downloadURL, showProgress)
 	if err != nil {
-		return "", fmt.Errorf("failed to download kestrel: %w", err)
+		return "", "", "", fmt.Errorf("failed to download kestrel: %w", err)
 	}
 
 	// Make executable
 	if err := os.Chmod(tmpPath, 0755); err != nil {
 		os.Remove(tmpPath)
-		return "", fmt.Errorf("failed to make kestrel executable: %w", err)
+		return "", "", "", fmt.Errorf("failed to make kestrel executable: %w", err)
 	}
 
-	logging.Info("Agent sourced successfully", "path", tmpPath, "version", release.TagName)
-	return tmpPath, nil
+	logging.InfoContext(ctx, "Agent sourced successfully", "path", tmpPath, "version", release.TagName)
+	return tmpPath, release.TagName, downloadURL, nil
 }
 
 // sourceAgentFromLocal copies the kestrel binary from a local path.
@@ -170,18 +246,18 @@ func sourceAgentFromLocal(localPath string) (string, error) {
 }
 
 // sourceAgentFromHTTP downloads the kestrel binary from a custom HTTP URL.
-func sourceAgentFromHTTP(url, checksum string, showProgress bool) (string, error) {
-	logging.Info("Downloading agent from HTTP", "url", url)
+func sourceAgentFromHTTP(ctx context.Context, url, checksum string, showProgress bool) (string, error) {
+	logging.InfoContext(ctx, "Downloading agent from HTTP", "url", url)
 
 	// Download to temp file
-	tmpPath, err := utils.DownloadToTempFile(url, showProgress)
+	tmpPath, err := utils.DownloadToTempFile(ctx, url, showProgress)
 	if err != nil {
 		return "", fmt.Errorf("failed to download agent: %w", err)
 	}
 
 	// Verify checksum if provided
 	if checksum != "" {
-		logging.Info("Verifying agent checksum")
+		logging.InfoContext(ctx, "Verifying agent checksum")
 		if err := utils.VerifyChecksum(tmpPath, checksum); err != nil {
 			os.Remove(tmpPath)
 			return "", fmt.Errorf("agent checksum verification failed: %w", err)
@@ -194,10 +270,92 @@ func sourceAgentFromHTTP(url, checksum string, showProgress bool) (string, error
 		return "", fmt.Errorf("failed to make agent executable: %w", err)
 	}
 
-	logging.Info("Agent sourced successfully from HTTP", "path", tmpPath)
+	logging.InfoContext(ctx, "Agent sourced successfully from HTTP", "path", tmpPath)
+	return tmpPath, nil
+}
+
+// agentImagePaths are searched, in order, when the agent reference is a regular
+// filesystem image rather than a single-blob artifact.
+var agentImagePaths = []string{
+	DefaultAgentBinaryName,
+	"bin/" + DefaultAgentBinaryName,
+	"usr/local/bin/" + DefaultAgentBinaryName,
+	"usr/bin/" + DefaultAgentBinaryName,
+}
+
+// sourceAgentFromOCI pulls the kestrel binary from an OCI registry.
+func sourceAgentFromOCI(ctx context.Context, imageRef string) (string, error) {
+	logging.InfoContext(ctx, "Pulling agent from OCI registry", "image", imageRef)
+
+	tmpDir, err := os.MkdirTemp("", "fledge-agent-oci-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	layoutDir := filepath.Join(tmpDir, "oci-layout")
+	if err := os.MkdirAll(layoutDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create oci layout dir: %w", err)
+	}
+	if err := copyImageToLayout(ctx, imageRef, layoutDir); err != nil {
+		return "", fmt.Errorf("failed to pull agent image: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp("", "fledge-agent-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	err = extractAgentFromLayout(ctx, layoutDir, tmpDir, tmpFile)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0755)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to extract agent from %s: %w", imageRef, err)
+	}
+
+	logging.InfoContext(ctx, "Agent sourced successfully from OCI registry", "path", tmpPath)
 	return tmpPath, nil
 }
 
+// extractAgentFromLayout writes the agent binary from the image in layoutDir
+// to w. Artifacts with a single non-tar layer are treated as the raw binary;
+// anything else is unpacked under scratchDir and searched for kestrel.
+func extractAgentFromLayout(ctx context.Context, layoutDir, scratchDir string, w io.Writer) error {
+	manifest, err := oci.ResolveManifest(layoutDir, "latest")
+	if err != nil {
+		return err
+	}
+	if len(manifest.Layers) == 1 && !strings.Contains(manifest.Layers[0].MediaType, "tar") {
+		return oci.CopyBlob(layoutDir, manifest.Layers[0], w)
+	}
+
+	rootDir := filepath.Join(scratchDir, "rootfs")
+	if err := oci.ApplyLayout(ctx, layoutDir, "latest", rootDir); err != nil {
+		return err
+	}
+	for _, rel := range agentImagePaths {
+		path := filepath.Join(rootDir, rel)
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	return fmt.Errorf("no %s binary found in image (looked in /%s)", DefaultAgentBinaryName, strings.Join(agentImagePaths, ", /"))
+}
+
 // CleanupAgent removes a temporary agent file.
 func CleanupAgent(agentPath string) {
 	if agentPath != "" {
@@ -216,7 +374,7 @@ func CleanupAgent(agentPath string) {
 
 		if isTempFile {
 			if err := os.Remove(agentPath); err != nil {
-				logging.Warn("Failed to cleanup agent file", "path", agentPath, "error", err)
+				logging.Warn("Failed to cleanup agent file", "path", agentPath, "error", err, logging.KeyWarning, logging.WarnCleanup)
 			} else {
 				logging.Debug("Cleaned up agent file", "path", agentPath)
 			}
@@ -1,8 +1,14 @@
 package builder
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/volantvm/fledge/internal/config"
@@ -26,7 +32,7 @@ func TestSourceAgent_LocalStrategy(t *testing.T) {
 		Path:           agentPath,
 	}
 
-	resultPath, err := SourceAgent(agentCfg, false)
+	resultPath, err := SourceAgent(context.Background(), agentCfg, false)
 	if err != nil {
 		t.Fatalf("SourceAgent failed: %v", err)
 	}
@@ -63,7 +69,7 @@ func TestSourceAgent_LocalStrategy_NonExistent(t *testing.T) {
 		Path:           "/nonexistent/path/to/agent",
 	}
 
-	_, err := SourceAgent(agentCfg, false)
+	_, err := SourceAgent(context.Background(), agentCfg, false)
 	if err == nil {
 		t.Fatal("Expected error for non-existent path, got nil")
 	}
@@ -78,7 +84,7 @@ func TestSourceAgent_LocalStrategy_Directory(t *testing.T) {
 		Path:           tmpDir,
 	}
 
-	_, err := SourceAgent(agentCfg, false)
+	_, err := SourceAgent(context.Background(), agentCfg, false)
 	if err == nil {
 		t.Fatal("Expected error for directory path, got nil")
 	}
@@ -86,7 +92,7 @@ func TestSourceAgent_LocalStrategy_Directory(t *testing.T) {
 
 // TestSourceAgent_NilConfig tests error handling for nil configuration.
 func TestSourceAgent_NilConfig(t *testing.T) {
-	_, err := SourceAgent(nil, false)
+	_, err := SourceAgent(context.Background(), nil, false)
 	if err == nil {
 		t.Fatal("Expected error for nil config, got nil")
 	}
@@ -98,12 +104,89 @@ func TestSourceAgent_UnknownStrategy(t *testing.T) {
 		SourceStrategy: "invalid_strategy",
 	}
 
-	_, err := SourceAgent(agentCfg, false)
+	_, err := SourceAgent(context.Background(), agentCfg, false)
 	if err == nil {
 		t.Fatal("Expected error for unknown strategy, got nil")
 	}
 }
 
+// TestResolveAgent_Checksum tests digest reporting and checksum verification.
+func TestResolveAgent_Checksum(t *testing.T) {
+	agentPath := filepath.Join(t.TempDir(), "kestrel")
+	if err := os.WriteFile(agentPath, []byte("test"), 0755); err != nil {
+		t.Fatalf("Failed to create test agent: %v", err)
+	}
+	const digest = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	agent, err := ResolveAgent(context.Background(), &config.AgentConfig{
+		SourceStrategy: config.AgentSourceLocal,
+		Path:           agentPath,
+		Checksum:       digest,
+	}, false)
+	if err != nil {
+		t.Fatalf("ResolveAgent failed: %v", err)
+	}
+	defer CleanupAgent(agent.Path)
+	if agent.Digest != digest {
+		t.Errorf("Expected digest %s, got %s", digest, agent.Digest)
+	}
+	if entry := agent.LockEntry(); entry.SourceStrategy != config.AgentSourceLocal || entry.Digest != digest {
+		t.Errorf("Unexpected lock entry: %+v", entry)
+	}
+
+	_, err = ResolveAgent(context.Background(), &config.AgentConfig{
+		SourceStrategy: config.AgentSourceLocal,
+		Path:           agentPath,
+		Checksum:       "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}, false)
+	if err == nil {
+		t.Fatal("Expected checksum mismatch error")
+	}
+}
+
+// writeArtifactLayout writes an OCI layout tagged "latest" whose single layer
+// is the raw blob data.
+func writeArtifactLayout(t *testing.T, layoutDir string, data []byte) {
+	t.Helper()
+	writeBlob := func(mediaType string, content []byte) string {
+		sum := sha256.Sum256(content)
+		hexSum := hex.EncodeToString(sum[:])
+		dir := filepath.Join(layoutDir, "blobs", "sha256")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create blob dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, hexSum), content, 0644); err != nil {
+			t.Fatalf("Failed to write blob: %v", err)
+		}
+		return fmt.Sprintf(`{"mediaType":%q,"digest":"sha256:%s","size":%d}`, mediaType, hexSum, len(content))
+	}
+
+	layer := writeBlob("application/vnd.volant.kestrel.binary", data)
+	cfg := writeBlob("application/vnd.oci.empty.v1+json", []byte("{}"))
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":%s,"layers":[%s]}`, cfg, layer))
+	desc := strings.TrimSuffix(writeBlob("application/vnd.oci.image.manifest.v1+json", manifest), "}") +
+		`,"annotations":{"org.opencontainers.image.ref.name":"latest"}}`
+	index := fmt.Sprintf(`{"schemaVersion":2,"manifests":[%s]}`, desc)
+	if err := os.WriteFile(filepath.Join(layoutDir, "index.json"), []byte(index), 0644); err != nil {
+		t.Fatalf("Failed to write index.json: %v", err)
+	}
+}
+
+// TestExtractAgentFromLayout_Artifact tests extracting a single-blob agent artifact.
+func TestExtractAgentFromLayout_Artifact(t *testing.T) {
+	layoutDir := t.TempDir()
+	content := []byte("\x7fELF kestrel")
+	writeArtifactLayout(t, layoutDir, content)
+
+	var buf bytes.Buffer
+	if err := extractAgentFromLayout(context.Background(), layoutDir, t.TempDir(), &buf); err != nil {
+		t.Fatalf("extractAgentFromLayout failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Expected agent content %q, got %q", content, buf.Bytes())
+	}
+}
+
 // TestCleanupAgent tests cleanup of temporary agent files.
 func TestCleanupAgent(t *testing.T) {
 	// Create a temp file
@@ -0,0 +1,129 @@
+package builder
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/volantvm/fledge/internal/ledger"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/loopdev"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// extractArtifact unpacks the fledge artifact at path onto dir, which may
+// already hold files: a squashfs image with unsquashfs, an ext4, xfs or
+// btrfs image by copying it out of a read-only mount, and an initramfs with
+// cpio. It returns the image config an OCI rootfs build saved in the
+// artifact's /etc/fsify-entrypoint, or nil if it has none, as an initramfs
+// does not.
+func extractArtifact(ctx context.Context, path, dir, tempRoot string) (*ocispec.Image, error) {
+	format, err := DetectImageFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	logging.InfoContext(ctx, "Extracting artifact", "artifact", path, "format", format)
+	switch format {
+	case "squashfs":
+		err = unsquashImage(ctx, path, dir)
+	case formatInitramfs:
+		err = extractInitramfs(ctx, path, dir)
+	default:
+		err = copyOutImage(ctx, path, format, dir, tempRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadImageConfig(filepath.Join(dir, "etc", "fsify-entrypoint"))
+}
+
+// unsquashImage unpacks the squashfs image at path onto dir.
+func unsquashImage(ctx context.Context, path, dir string) error {
+	report.FromContext(ctx).UseTool("unsquashfs")
+	cmd := exec.CommandContext(ctx, "unsquashfs", "-no-progress", "-f", "-d", dir, path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("unsquashfs failed: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// extractInitramfs unpacks the gzip-compressed cpio archive at path onto
+// dir.
+func extractInitramfs(ctx context.Context, path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read initramfs %s: %w", path, err)
+	}
+	defer zr.Close()
+
+	report.FromContext(ctx).UseTool("cpio")
+	cmd := exec.CommandContext(ctx, "cpio", "-idmu", "--quiet", "--no-absolute-filenames")
+	cmd.Dir = dir
+	cmd.Stdin = zr
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cpio command failed: %w\nStderr: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// copyOutImage copies the contents of the fsType image at path onto dir
+// through a read-only mount.
+func copyOutImage(ctx context.Context, path, fsType, dir, tempRoot string) error {
+	mountPoint, err := os.MkdirTemp(tempRoot, "fledge-artifact-mnt-*")
+	if err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	defer os.Remove(mountPoint)
+	unmount, err := mountImageReadOnly(ctx, path, fsType, mountPoint)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	if err := overlayCopyPreserve(ctx, mountPoint, dir); err != nil {
+		return fmt.Errorf("failed to copy out %s: %w", path, err)
+	}
+	return nil
+}
+
+// mountImageReadOnly attaches the fsType image at path to a loop device and
+// mounts it read-only at mountPoint. The returned function unmounts it and
+// detaches the device, warning if either fails.
+func mountImageReadOnly(ctx context.Context, path, fsType, mountPoint string) (unmount func(), err error) {
+	device, err := loopdev.Attach(path, true)
+	if err != nil {
+		return nil, err
+	}
+	ledger.Record(ledger.KindLoop, device, path)
+	detach := func() {
+		if err := loopdev.Detach(device); err != nil {
+			logging.WarnClassContext(ctx, logging.WarnCleanup, "Failed to detach loop device", "device", device, "error", err)
+			return
+		}
+		ledger.Release(ledger.KindLoop, device)
+	}
+	if err := loopdev.Mount(device, mountPoint, fsType, true); err != nil {
+		detach()
+		return nil, err
+	}
+	ledger.Record(ledger.KindMount, mountPoint, device)
+	return func() {
+		if err := loopdev.Unmount(mountPoint); err != nil {
+			logging.WarnClassContext(ctx, logging.WarnCleanup, "Failed to unmount", "mount_point", mountPoint, "error", err)
+		} else {
+			ledger.Release(ledger.KindMount, mountPoint)
+		}
+		detach()
+	}, nil
+}
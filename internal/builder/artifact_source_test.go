@@ -0,0 +1,47 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestExtractArtifact tests unpacking an ext4 artifact, with the image
+// config an OCI rootfs build saved in it, onto an existing rootfs.
+func TestExtractArtifact(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not installed")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounting the artifact requires root")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "etc"), 0755)
+	os.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("base\n"), 0644)
+	os.WriteFile(filepath.Join(src, "etc", "fsify-entrypoint"), []byte(`{"config":{"Entrypoint":["/bin/app"]}}`), 0644)
+	artifact := filepath.Join(dir, "base.img")
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-d", src, artifact, "8M").CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, out)
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+	os.WriteFile(filepath.Join(rootfs, "etc", "motd"), []byte("kept\n"), 0644)
+	img, err := extractArtifact(context.Background(), artifact, rootfs, dir)
+	if err != nil {
+		t.Skipf("artifact not mountable here: %v", err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(rootfs, "etc", "hostname")); string(data) != "base\n" {
+		t.Errorf("Expected the artifact's files to be extracted, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc", "motd")); err != nil {
+		t.Errorf("Expected existing files to be kept: %v", err)
+	}
+	if img == nil || len(img.Config.Entrypoint) != 1 || img.Config.Entrypoint[0] != "/bin/app" {
+		t.Errorf("Expected the artifact's image config, got %+v", img)
+	}
+}
@@ -0,0 +1,205 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/oci"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// applyAssets fetches each [[assets]] source in order and copies the selected
+// path into targetDir. Local git repositories are relative to workDir.
+func applyAssets(ctx context.Context, assets []config.Asset, workDir, targetDir string, tracker *lock.Tracker) error {
+	for i, asset := range assets {
+		if err := applyAsset(ctx, i, asset, workDir, targetDir, tracker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyAsset fetches a single asset into a scratch directory and maps it.
+func applyAsset(ctx context.Context, index int, asset config.Asset, workDir, targetDir string, tracker *lock.Tracker) error {
+	scratchDir, err := os.MkdirTemp("", "fledge-asset-*")
+	if err != nil {
+		return fmt.Errorf("failed to create asset dir: %w", err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	logging.InfoContext(ctx, "Fetching asset", "index", index, "source", asset.Source, "ref", asset.Ref, "path", asset.Path)
+
+	var rootDir string
+	if strings.HasPrefix(asset.Source, config.AssetSchemeOCI) {
+		rootDir, err = fetchOCIAsset(ctx, strings.TrimPrefix(asset.Source, config.AssetSchemeOCI), scratchDir, tracker)
+	} else {
+		rootDir, err = fetchGitAsset(ctx, asset.Source, asset.Ref, workDir, scratchDir, tracker)
+	}
+	if err != nil {
+		return fmt.Errorf("asset %s: %w", asset.Source, err)
+	}
+
+	srcPath := filepath.Join(rootDir, filepath.Clean("/"+asset.Path))
+	prepared, err := PrepareFileMappings(map[string]string{srcPath: asset.Dest}, rootDir)
+	if err != nil {
+		return fmt.Errorf("asset %s path %s: %w", asset.Source, asset.Path, err)
+	}
+	if err := ApplyFileMappings(ctx, prepared, targetDir); err != nil {
+		return fmt.Errorf("failed to map asset %s: %w", asset.Source, err)
+	}
+	return nil
+}
+
+// fetchOCIAsset pulls imageRef and returns a directory holding its content.
+// Artifacts whose layers are all non-tar blobs (e.g. pushed with oras) are
+// written as individual files named by their title annotation; regular images
+// are unpacked as a filesystem.
+func fetchOCIAsset(ctx context.Context, imageRef, scratchDir string, tracker *lock.Tracker) (string, error) {
+	layoutDir := filepath.Join(scratchDir, "oci-layout")
+	if err := os.MkdirAll(layoutDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create oci layout dir: %w", err)
+	}
+	if err := pullImage(ctx, tracker, lock.RoleAsset, imageRef, layoutDir); err != nil {
+		return "", fmt.Errorf("failed to pull image: %w", err)
+	}
+
+	rootDir := filepath.Join(scratchDir, "rootfs")
+	manifest, err := oci.ResolveManifest(layoutDir, "latest")
+	if err != nil {
+		return "", err
+	}
+	if !isArtifact(manifest) {
+		if err := oci.ApplyLayout(ctx, layoutDir, "latest", rootDir); err != nil {
+			return "", err
+		}
+		return rootDir, nil
+	}
+
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create asset dir: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		if err := writeArtifactBlob(layoutDir, layer, rootDir); err != nil {
+			return "", err
+		}
+	}
+	return rootDir, nil
+}
+
+// isArtifact reports whether every layer of manifest is a plain blob rather
+// than a filesystem tarball.
+func isArtifact(manifest ocispec.Manifest) bool {
+	if len(manifest.Layers) == 0 {
+		return false
+	}
+	for _, layer := range manifest.Layers {
+		if strings.Contains(layer.MediaType, "tar") {
+			return false
+		}
+	}
+	return true
+}
+
+// writeArtifactBlob writes an artifact layer to rootDir under its title
+// annotation, falling back to the digest hex when no title is set.
+func writeArtifactBlob(layoutDir string, layer ocispec.Descriptor, rootDir string) error {
+	name := layer.Annotations[ocispec.AnnotationTitle]
+	if name == "" {
+		name = layer.Digest.Encoded()
+	}
+	path := filepath.Join(rootDir, filepath.Clean("/"+name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", name, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	err = oci.CopyBlob(layoutDir, layer, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write artifact blob %s: %w", name, err)
+	}
+	return nil
+}
+
+// fetchGitAsset checks out ref of the repository at source into scratchDir
+// and returns the checkout, without its .git directory. Only the requested
+// commit is fetched.
+func fetchGitAsset(ctx context.Context, source, ref, workDir, scratchDir string, tracker *lock.Tracker) (string, error) {
+	url := gitCloneURL(source, workDir)
+	report.FromContext(ctx).UseTool("git")
+	checkoutDir := filepath.Join(scratchDir, "checkout")
+	if err := os.MkdirAll(checkoutDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create checkout dir: %w", err)
+	}
+
+	steps := [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", url},
+		// The ref comes from the config: it must not be read as an option
+		{"fetch", "--quiet", "--depth", "1", "--end-of-options", "origin", ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	}
+	for _, args := range steps {
+		if _, err := runGit(ctx, checkoutDir, args...); err != nil {
+			return "", err
+		}
+	}
+
+	commit, err := runGit(ctx, checkoutDir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	logging.DebugContext(ctx, "Resolved git asset", "url", url, "ref", ref, "commit", commit)
+	if err := tracker.RecordRepository(lock.Repository{URL: source, Ref: ref, Commit: commit}); err != nil {
+		return "", err
+	}
+
+	if err := os.RemoveAll(filepath.Join(checkoutDir, ".git")); err != nil {
+		return "", fmt.Errorf("failed to remove .git: %w", err)
+	}
+	return checkoutDir, nil
+}
+
+// gitCloneURL strips the "git+" prefix fledge uses to mark git sources with a
+// transport scheme, such as git+https://. A relative local repository is
+// resolved against workDir, as git would otherwise look for it in the
+// directory it runs in.
+func gitCloneURL(source, workDir string) string {
+	if path, ok := config.LocalGitPath(source); ok {
+		return "file://" + absPath(resolveWorkPath(path, workDir))
+	}
+	if rest, ok := strings.CutPrefix(source, "git+"); ok {
+		return rest
+	}
+	return source
+}
+
+// runGit runs git in dir and returns its trimmed stdout.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.Output()
+	if err != nil {
+		stderr := ""
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = string(exitErr.Stderr)
+		}
+		return "", fmt.Errorf("git %s failed: %w\nOutput: %s", args[0], err, strings.TrimSpace(stderr))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,94 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+)
+
+// TestApplyAssets_Git tests mapping a subpath of a git repository at a tag.
+func TestApplyAssets_Git(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repoDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repoDir, "payload"), 0755); err != nil {
+		t.Fatalf("Failed to create payload dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, "payload", "plugin.conf"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("Failed to write payload: %v", err)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=fledge", "-c", "user.email=fledge@example.com", "commit", "--quiet", "-m", "payload"},
+		{"tag", "v1.0.0"},
+	} {
+		if _, err := runGit(context.Background(), repoDir, args...); err != nil {
+			t.Fatalf("Failed to prepare repository: %v", err)
+		}
+	}
+	commit, err := runGit(context.Background(), repoDir, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatalf("Failed to read commit: %v", err)
+	}
+
+	lockPath := filepath.Join(t.TempDir(), lock.FileName)
+	tracker, err := lock.Open(lockPath, false)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// Relative to the directory of fledge.toml, not to where git runs
+	source := "git+file://" + filepath.Base(repoDir)
+	targetDir := t.TempDir()
+	assets := []config.Asset{{Source: source, Ref: "v1.0.0", Path: "payload", Dest: "/opt/plugin"}}
+	if err := applyAssets(context.Background(), assets, filepath.Dir(repoDir), targetDir, tracker); err != nil {
+		t.Fatalf("applyAssets failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(targetDir, "opt", "plugin", "plugin.conf"))
+	if err != nil || string(data) != "v1" {
+		t.Errorf("Expected mapped plugin.conf with 'v1', got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "opt", "plugin", ".git")); !os.IsNotExist(err) {
+		t.Errorf("Expected no .git directory in the mapped asset")
+	}
+
+	if err := tracker.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	f, err := lock.Load(lockPath)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	want := lock.Repository{URL: source, Ref: "v1.0.0", Commit: commit}
+	if len(f.Repositories) != 1 || f.Repositories[0] != want {
+		t.Errorf("Expected repositories %+v, got %+v", want, f.Repositories)
+	}
+}
+
+// TestFetchGitAsset_OptionRef tests that a ref is never read as a git
+// option, such as --upload-pack running a command.
+func TestFetchGitAsset_OptionRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repoDir := t.TempDir()
+	if _, err := runGit(context.Background(), repoDir, "init", "--quiet"); err != nil {
+		t.Fatalf("Failed to prepare repository: %v", err)
+	}
+	marker := filepath.Join(t.TempDir(), "pwned")
+	ref := "--upload-pack=touch " + marker + ";git-upload-pack"
+	if _, err := fetchGitAsset(context.Background(), "git+file://"+repoDir, ref, "", t.TempDir(), nil); err == nil {
+		t.Error("Expected fetching an option-like ref to fail")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Expected the ref not to run a command")
+	}
+}
@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// hostCABundles are the CA bundle locations of common distributions, in
+// lookup order.
+var hostCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine, Arch
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL
+	"/etc/ssl/ca-bundle.pem",             // openSUSE
+	"/etc/ssl/cert.pem",                  // Alpine, BSDs
+}
+
+// binaryCABundle is where the host's CA bundle is placed in the artifact.
+const binaryCABundle = "/etc/ssl/certs/ca-certificates.crt"
+
+// defaultPathEnv is the PATH of binary strategy workloads.
+const defaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// prepareBinaryRootfs lays out the base of a binary strategy rootfs: the
+// standard directories and the host's CA certificates. The executables
+// themselves are added as mappings, and their libraries by the shared
+// library check. It returns the image config the workload defaults come
+// from.
+func prepareBinaryRootfs(ctx context.Context, bin *config.BinaryConfig, rootfsDir string) (*ocispec.Image, error) {
+	for _, dir := range baseRootfsDirs {
+		if err := os.MkdirAll(filepath.Join(rootfsDir, dir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(rootfsDir, "tmp"), 0777|os.ModeSticky); err != nil {
+		return nil, fmt.Errorf("failed to set /tmp permissions: %w", err)
+	}
+
+	if bin.WantsCertificates() {
+		if err := installHostCertificates(ctx, rootfsDir); err != nil {
+			return nil, err
+		}
+	}
+
+	img := &ocispec.Image{}
+	img.Config.Entrypoint = []string{config.BinaryDest(bin.Executables[0])}
+	img.Config.Env = []string{defaultPathEnv}
+	logging.InfoContext(ctx, "Assembling rootfs from host executables",
+		"executables", len(bin.Executables), "entrypoint", img.Config.Entrypoint[0])
+	return img, nil
+}
+
+// installHostCertificates copies the first CA bundle found on the host into
+// the rootfs. A host without one only gets a warning.
+func installHostCertificates(ctx context.Context, rootfsDir string) error {
+	for _, bundle := range hostCABundles {
+		src, err := filepath.EvalSymlinks(bundle)
+		if err != nil {
+			continue
+		}
+		dest := filepath.Join(rootfsDir, binaryCABundle)
+		if err := CopyFile(src, dest, 0644); err != nil {
+			return fmt.Errorf("failed to copy CA certificates: %w", err)
+		}
+		// OpenSSL and Go also look for the bundle here
+		link := filepath.Join(rootfsDir, "etc/ssl/cert.pem")
+		if err := os.Symlink("certs/ca-certificates.crt", link); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to link CA certificates: %w", err)
+		}
+		logging.DebugContext(ctx, "Installed host CA certificates", "source", bundle)
+		return nil
+	}
+	logging.WarnContext(ctx, "No CA certificates found on the host; TLS clients in the artifact will fail to verify peers",
+		"searched", hostCABundles)
+	return nil
+}
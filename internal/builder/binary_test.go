@@ -0,0 +1,33 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestPrepareBinaryRootfs tests the base layout and workload defaults of a
+// binary strategy rootfs.
+func TestPrepareBinaryRootfs(t *testing.T) {
+	root := t.TempDir()
+	noCerts := false
+	bin := &config.BinaryConfig{Executables: []string{"target/app", "/usr/bin/tool"}, Certificates: &noCerts}
+
+	img, err := prepareBinaryRootfs(context.Background(), bin, root)
+	if err != nil {
+		t.Fatalf("prepareBinaryRootfs failed: %v", err)
+	}
+	if ep := img.Config.Entrypoint; len(ep) != 1 || ep[0] != "/usr/local/bin/app" {
+		t.Errorf("Unexpected entrypoint %v", ep)
+	}
+	info, err := os.Stat(filepath.Join(root, "tmp"))
+	if err != nil || info.Mode().Perm() != 0o777 || info.Mode()&os.ModeSticky == 0 {
+		t.Errorf("Expected a sticky world-writable /tmp, got %v (err %v)", info, err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, binaryCABundle)); !os.IsNotExist(err) {
+		t.Errorf("Expected no CA bundle with certificates disabled, got %v", err)
+	}
+}
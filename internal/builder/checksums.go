@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// Checksum algorithms <output>.<algorithm> files can be written for.
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+)
+
+// writeChecksumFiles writes <output>.<algorithm> for each of algorithms in
+// the format of sha256sum, so `sha256sum -c` verifies the artifact from its
+// directory. sha256 is the artifact's already computed SHA256.
+func writeChecksumFiles(ctx context.Context, output, sha256 string, algorithms []string) error {
+	for _, algorithm := range algorithms {
+		var sum string
+		switch algorithm {
+		case ChecksumSHA256:
+			sum = sha256
+		case ChecksumSHA512:
+			var err error
+			if sum, err = computeSHA512(output); err != nil {
+				return fmt.Errorf("failed to compute artifact checksum: %w", err)
+			}
+		default:
+			return fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+		}
+
+		path := output + "." + algorithm
+		line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(output))
+		if err := os.WriteFile(path, []byte(line), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		logging.InfoContext(ctx, "Checksum file written", "path", path)
+	}
+	return nil
+}
+
+// computeSHA512 computes the SHA512 checksum of a file.
+func computeSHA512(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
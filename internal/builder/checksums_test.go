@@ -0,0 +1,38 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteChecksumFiles tests that checksum files use the sha256sum format
+// with the artifact's base name.
+func TestWriteChecksumFiles(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "plugin.img")
+	if err := os.WriteFile(output, []byte("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const sha256 = "c7c5c1d70c5dec4416ab6158afd0b223ef40c29b1dc1f97ed9428b94d4cadb1c"
+	if err := writeChecksumFiles(context.Background(), output, sha256, []string{ChecksumSHA256, ChecksumSHA512}); err != nil {
+		t.Fatalf("writeChecksumFiles failed: %v", err)
+	}
+
+	for algorithm, want := range map[string]string{
+		ChecksumSHA256: sha256,
+		ChecksumSHA512: "14697440701c3885f7c8d5faa59f336b471ca86332034eff0d3fddc02dc9b18b8356e840db54823c8fd2f2cbd0906969cf132cf8bb9c73dc769b4ffd817bd23d",
+	} {
+		data, err := os.ReadFile(output + "." + algorithm)
+		if err != nil {
+			t.Fatalf("Expected %s file: %v", algorithm, err)
+		}
+		if got := string(data); got != want+"  plugin.img\n" {
+			t.Errorf("%s file = %q", algorithm, got)
+		}
+	}
+
+	if err := writeChecksumFiles(context.Background(), output, sha256, []string{"md5"}); err == nil {
+		t.Error("Expected an unsupported algorithm to fail")
+	}
+}
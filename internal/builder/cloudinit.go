@@ -0,0 +1,168 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// cloudInitSeedLabel is the volume label the NoCloud datasource looks for.
+const cloudInitSeedLabel = "cidata"
+
+// isoTools are the ISO 9660 authoring tools tried in order, with the
+// arguments that make them behave like mkisofs.
+var isoTools = [][]string{
+	{"xorriso", "-as", "mkisofs"},
+	{"genisoimage"},
+	{"mkisofs"},
+}
+
+// writeCloudInitSeed writes the NoCloud seed image of the manifest's
+// [cloud_init] next to the artifact and returns its manifest.json entry,
+// or nil when no seed is wanted.
+func writeCloudInitSeed(ctx context.Context, tpl *config.ManifestTemplate, artifactPath string) (map[string]interface{}, error) {
+	if tpl == nil || !tpl.CloudInit.WantsSeed() {
+		return nil, nil
+	}
+	ci := tpl.CloudInit
+
+	dir, err := os.MkdirTemp("", "fledge-cidata-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create seed dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	userData, err := cloudInitUserData(ci.UserData, tpl.Dir)
+	if err != nil {
+		return nil, err
+	}
+	metaData, err := cloudInitMetaData(ci.MetaData, tpl.Name)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{filepath.Join(dir, "user-data"), filepath.Join(dir, "meta-data")}
+	if err := os.WriteFile(files[0], userData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write user-data: %w", err)
+	}
+	if err := os.WriteFile(files[1], metaData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write meta-data: %w", err)
+	}
+
+	var seedPath, format string
+	switch ci.Seed {
+	case config.CloudInitSeedVFAT:
+		seedPath, format = artifactPath+".seed.img", "vfat"
+		err = writeVFATSeed(ctx, seedPath, files)
+	default:
+		seedPath, format = artifactPath+".seed.iso", "iso9660"
+		err = writeISOSeed(ctx, seedPath, files)
+	}
+	if err != nil {
+		os.Remove(seedPath)
+		return nil, err
+	}
+
+	checksum, err := computeSHA256(seedPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute seed checksum: %w", err)
+	}
+	logging.InfoContext(ctx, "Cloud-init seed generated", "path", seedPath, "format", format)
+	return map[string]interface{}{
+		"url":      "file://" + seedPath,
+		"format":   format,
+		"checksum": "sha256:" + checksum,
+	}, nil
+}
+
+// cloudInitUserData returns the user-data of the seed: the inline content,
+// the file it names relative to manifestDir, or an empty cloud-config.
+func cloudInitUserData(ud *config.CloudInitUserData, manifestDir string) ([]byte, error) {
+	switch {
+	case ud == nil:
+		return []byte("#cloud-config\n{}\n"), nil
+	case ud.Inline:
+		return []byte(ud.Content), nil
+	}
+	path := ud.Content
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(manifestDir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cloud-init user-data: %w", err)
+	}
+	return data, nil
+}
+
+// cloudInitMetaData returns the meta-data of the seed as JSON, which
+// cloud-init parses as YAML. instance-id and local-hostname default to the
+// plugin name.
+func cloudInitMetaData(meta map[string]interface{}, name string) ([]byte, error) {
+	out := make(map[string]interface{}, len(meta)+2)
+	for k, v := range meta {
+		out[k] = v
+	}
+	if name == "" {
+		name = "fledge"
+	}
+	if _, ok := out["instance-id"]; !ok {
+		out["instance-id"] = name
+	}
+	if _, ok := out["local-hostname"]; !ok {
+		out["local-hostname"] = name
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cloud-init meta-data: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// writeISOSeed writes files to an ISO 9660 image labelled cidata. Joliet
+// and Rock Ridge keep the lower-case, dashed file names.
+func writeISOSeed(ctx context.Context, path string, files []string) error {
+	for _, tool := range isoTools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		args := append(append([]string{}, tool[1:]...), "-output", path, "-volid", cloudInitSeedLabel, "-joliet", "-rock", "-quiet")
+		args = append(args, files...)
+		if out, err := exec.CommandContext(ctx, tool[0], args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create seed ISO with %s: %w\nOutput: %s", tool[0], err, out)
+		}
+		return nil
+	}
+	return fmt.Errorf("no ISO authoring tool found (install xorriso or genisoimage), or set cloud_init.seed = \"vfat\"")
+}
+
+// writeVFATSeed writes files to a FAT image labelled cidata using
+// mkfs.vfat and mtools.
+func writeVFATSeed(ctx context.Context, path string, files []string) error {
+	var size int64
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+	}
+	// mkfs.vfat counts 1 KiB blocks; leave room for the FAT and directory
+	blocks := max(size/1024+256, 1024)
+
+	os.Remove(path)
+	if out, err := exec.CommandContext(ctx, "mkfs.vfat", "-n", "CIDATA", "-C", path, strconv.FormatInt(blocks, 10)).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create seed FAT image: %w\nOutput: %s", err, out)
+	}
+	args := append([]string{"-i", path}, files...)
+	if out, err := exec.CommandContext(ctx, "mcopy", append(args, "::")...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy seed files (mcopy from mtools is required): %w\nOutput: %s", err, out)
+	}
+	return nil
+}
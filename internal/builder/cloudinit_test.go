@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestCloudInitSeedFiles tests the user-data and meta-data written to a
+// NoCloud seed.
+func TestCloudInitSeedFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "user-data.yaml"), []byte("#cloud-config\npackages: [nginx]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := cloudInitUserData(&config.CloudInitUserData{Content: "user-data.yaml"}, dir)
+	if err != nil || string(data) != "#cloud-config\npackages: [nginx]\n" {
+		t.Errorf("cloudInitUserData() = %q, %v", data, err)
+	}
+	data, err = cloudInitUserData(&config.CloudInitUserData{Inline: true, Content: "#!/bin/sh\necho hi\n"}, dir)
+	if err != nil || string(data) != "#!/bin/sh\necho hi\n" {
+		t.Errorf("cloudInitUserData() = %q, %v", data, err)
+	}
+	if _, err := cloudInitUserData(&config.CloudInitUserData{Content: "missing.yaml"}, dir); err == nil {
+		t.Error("Expected a missing user-data file to fail")
+	}
+
+	data, err = cloudInitMetaData(map[string]interface{}{"local-hostname": "web-1"}, "web")
+	if err != nil {
+		t.Fatalf("cloudInitMetaData failed: %v", err)
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta["instance-id"] != "web" || meta["local-hostname"] != "web-1" {
+		t.Errorf("unexpected meta-data: %v", meta)
+	}
+}
+
+// TestWriteCloudInitSeedDisabled tests that no seed is written without a
+// nocloud [cloud_init].
+func TestWriteCloudInitSeedDisabled(t *testing.T) {
+	artifact := filepath.Join(t.TempDir(), "web.img")
+	tpl := &config.ManifestTemplate{Name: "web", CloudInit: &config.CloudInitConfig{Seed: config.CloudInitSeedNone}}
+	seed, err := writeCloudInitSeed(context.Background(), tpl, artifact)
+	if err != nil || seed != nil {
+		t.Errorf("writeCloudInitSeed() = %v, %v; want no seed", seed, err)
+	}
+	if _, err := os.Stat(artifact + ".seed.iso"); !os.IsNotExist(err) {
+		t.Errorf("Expected no seed image, got %v", err)
+	}
+}
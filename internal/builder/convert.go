@@ -0,0 +1,242 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// formatInitramfs is what DetectImageFormat reports for a gzip-compressed
+// initramfs.
+const formatInitramfs = "initramfs"
+
+// imageMagics identify filesystem images by the bytes at an offset.
+var imageMagics = []struct {
+	format string
+	offset int64
+	magic  []byte
+}{
+	{"squashfs", 0, []byte("hsqs")},
+	{"xfs", 0, []byte("XFSB")},
+	{formatInitramfs, 0, []byte{0x1f, 0x8b}},
+	{"ext4", 1080, []byte{0x53, 0xef}},
+	{"btrfs", 65600, []byte("_BHRfS_M")},
+}
+
+// DetectImageFormat returns the filesystem type of the artifact at path:
+// squashfs, ext4, xfs or btrfs, or "initramfs" for a gzip-compressed
+// initramfs.
+func DetectImageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, m := range imageMagics {
+		buf := make([]byte, len(m.magic))
+		if _, err := f.ReadAt(buf, m.offset); err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if bytes.Equal(buf, m.magic) {
+			return m.format, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a squashfs, ext4, xfs or btrfs image", path)
+}
+
+// ConvertedOutputPath returns the default output of converting input to
+// fsType: input with the extension of fsType's artifacts, .squashfs or
+// .img, or with the type added when that would be input itself.
+func ConvertedOutputPath(input, fsType string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(input, ".img"), ".squashfs")
+	ext := ".img"
+	if fsType == "squashfs" {
+		ext = ".squashfs"
+	}
+	if base+ext == input {
+		return base + "." + fsType + ext
+	}
+	return base + ext
+}
+
+// ImageConverter repacks an existing rootfs image artifact as another
+// filesystem type from the image's contents, without rebuilding it from
+// its sources. The artifact's manifest.json, when present, is carried over
+// with the new image's format and checksum.
+type ImageConverter struct {
+	InputPath  string
+	OutputPath string
+	// Filesystem configures the new image, as [filesystem] does for a
+	// build.
+	Filesystem *config.FilesystemConfig
+	// TempRoot is where the temporary directory is created; empty uses
+	// TMPDIR.
+	TempRoot   string
+	SkipVerify bool
+	Checksums  []string
+	// Report collects step timings and statistics; nil disables reporting.
+	Report *report.Report
+
+	// from is the filesystem type of the input.
+	from string
+	// unmount releases the mount of a block image input, if it is mounted.
+	unmount func()
+}
+
+// Convert converts the input image.
+func (c *ImageConverter) Convert(ctx context.Context) error {
+	from, err := DetectImageFormat(c.InputPath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case from == formatInitramfs:
+		return fmt.Errorf("%s is an initramfs, which boots through its own /init rather than as a root filesystem; only rootfs images can be converted", c.InputPath)
+	case !slices.Contains(config.FilesystemTypes, c.Filesystem.Type):
+		return fmt.Errorf("cannot convert to %q, must be one of: %s", c.Filesystem.Type, strings.Join(config.FilesystemTypes, ", "))
+	case from == c.Filesystem.Type:
+		return fmt.Errorf("%s is already a %s image", c.InputPath, from)
+	}
+	c.from = from
+	ctx = report.NewContext(ctx, c.Report)
+	logging.InfoContext(ctx, "Converting image", "input", c.InputPath, "from", from, "to", c.Filesystem.Type, "output", c.OutputPath)
+
+	tmpDir, err := os.MkdirTemp(c.TempRoot, "fledge-convert-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The new image is packed by the build's own pipelines, from the
+	// input's contents in place of an assembled rootfs
+	ext := ".img"
+	if c.Filesystem.Type == "squashfs" {
+		ext = ".squashfs"
+	}
+	b := &OCIRootfsBuilder{
+		Config:       &config.Config{Strategy: config.StrategyOCIRootfs, Filesystem: c.Filesystem},
+		OutputPath:   c.OutputPath,
+		TempDir:      tmpDir,
+		UnpackedPath: filepath.Join(tmpDir, "unpacked-rootfs"),
+		ImagePath:    filepath.Join(tmpDir, "fs-image"+ext),
+		Report:       c.Report,
+		SkipVerify:   c.SkipVerify,
+		Checksums:    c.Checksums,
+		ctx:          ctx,
+	}
+	if err := os.MkdirAll(b.UnpackedPath, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", b.UnpackedPath, err)
+	}
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+	defer c.release()
+
+	pipeline := newImagePipeline(b)
+	defer pipeline.release()
+	steps := append([]buildStep{{"Extract " + from + " image", func() error {
+		return c.extract(b.stepContext(), rootfsPath)
+	}}}, pipeline.steps()...)
+	steps = append(steps,
+		buildStep{"Release input image", c.release},
+		buildStep{"Verify image", b.verifyImage},
+		buildStep{"Move to final location", b.moveToFinal},
+		buildStep{"Write manifest", func() error { return c.writeManifest(b) }},
+		buildStep{"Write checksums", func() error {
+			return writeChecksumFiles(b.stepContext(), b.OutputPath, b.checksum, b.Checksums)
+		}},
+	)
+	for _, step := range steps {
+		logging.InfoContext(ctx, step.name)
+		if err := b.runStep(ctx, step.name, step.fn); err != nil {
+			return fmt.Errorf("%s failed: %w", step.name, err)
+		}
+	}
+	b.Report.RecordArtifact(b.OutputPath)
+	logging.InfoContext(ctx, "Conversion complete", "output", b.OutputPath)
+	return nil
+}
+
+// extract makes the contents of the input available at rootfsPath: a
+// squashfs image is unpacked, a block image is mounted read-only.
+func (c *ImageConverter) extract(ctx context.Context, rootfsPath string) error {
+	if c.from == "squashfs" {
+		return unsquashImage(ctx, c.InputPath, rootfsPath)
+	}
+	if err := os.MkdirAll(rootfsPath, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", rootfsPath, err)
+	}
+	unmount, err := mountImageReadOnly(ctx, c.InputPath, c.from, rootfsPath)
+	if err != nil {
+		return err
+	}
+	c.unmount = unmount
+	return nil
+}
+
+// release unmounts the input image, if it is mounted.
+func (c *ImageConverter) release() error {
+	if c.unmount != nil {
+		c.unmount()
+		c.unmount = nil
+	}
+	return nil
+}
+
+// writeManifest writes the input's manifest.json for the new image, with
+// its URL, format and checksum. A squashfs root is always read-only with
+// an overlay, so the settings of a read-only ext4/xfs/btrfs root are
+// dropped for it.
+func (c *ImageConverter) writeManifest(b *OCIRootfsBuilder) error {
+	if b.checksum == "" {
+		checksum, err := computeSHA256(b.OutputPath)
+		if err != nil {
+			return fmt.Errorf("failed to compute artifact checksum: %w", err)
+		}
+		b.checksum = checksum
+	}
+
+	data, err := os.ReadFile(c.InputPath + ".manifest.json")
+	if errors.Is(err, os.ErrNotExist) {
+		logging.WarnContext(b.stepContext(), "Input has no manifest.json; none written", "input", c.InputPath)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest map[string]any
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest of %s: %w", c.InputPath, err)
+	}
+	rootfs, _ := manifest["rootfs"].(map[string]any)
+	if rootfs == nil {
+		return fmt.Errorf("manifest of %s has no rootfs section", c.InputPath)
+	}
+	rootfs["url"] = "file://" + b.OutputPath
+	rootfs["format"] = c.Filesystem.Type
+	rootfs["checksum"] = "sha256:" + b.checksum
+	if c.Filesystem.Type == "squashfs" {
+		for _, key := range []string{"read_only", "tmpfs", "overlay_size", "kernel_args"} {
+			delete(rootfs, key)
+		}
+	}
+
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	path := b.OutputPath + ".manifest.json"
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	logging.InfoContext(b.stepContext(), "Manifest written", "path", path)
+	return nil
+}
@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestDetectImageFormat tests recognising artifacts by their magic bytes.
+func TestDetectImageFormat(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name   string
+		offset int64
+		magic  []byte
+		want   string
+	}{
+		{"rootfs.squashfs", 0, []byte("hsqs"), "squashfs"},
+		{"ext4.img", 1080, []byte{0x53, 0xef}, "ext4"},
+		{"xfs.img", 0, []byte("XFSB"), "xfs"},
+		{"btrfs.img", 65600, []byte("_BHRfS_M"), "btrfs"},
+		{"plugin.cpio.gz", 0, []byte{0x1f, 0x8b, 0x08}, formatInitramfs},
+	} {
+		path := filepath.Join(dir, tc.name)
+		data := make([]byte, tc.offset+4096)
+		copy(data[tc.offset:], tc.magic)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := DetectImageFormat(path)
+		if err != nil {
+			t.Errorf("DetectImageFormat(%s): %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("Expected %s to be %s, got %s", tc.name, tc.want, got)
+		}
+	}
+
+	// Shorter than the deepest magic, and none matching
+	path := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(path, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DetectImageFormat(path); err == nil {
+		t.Error("Expected an error for a file that is no image")
+	}
+}
+
+// TestConvertedOutputPath tests the default output names of conversions.
+func TestConvertedOutputPath(t *testing.T) {
+	for _, tc := range []struct{ input, fsType, want string }{
+		{"/out/plugin.img", "squashfs", "/out/plugin.squashfs"},
+		{"/out/plugin.squashfs", "ext4", "/out/plugin.img"},
+		{"/out/plugin.img", "btrfs", "/out/plugin.btrfs.img"},
+		{"/out/plugin", "xfs", "/out/plugin.img"},
+	} {
+		if got := ConvertedOutputPath(tc.input, tc.fsType); got != tc.want {
+			t.Errorf("ConvertedOutputPath(%s, %s) = %s, want %s", tc.input, tc.fsType, got, tc.want)
+		}
+	}
+}
+
+// TestConvertWriteManifest tests carrying the input's manifest over to a
+// squashfs conversion of a read-only ext4 root.
+func TestConvertWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "plugin.img")
+	output := filepath.Join(dir, "plugin.squashfs")
+	if err := os.WriteFile(output, []byte("squashfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{
+  "name": "demo",
+  "rootfs": {
+    "url": "file://` + input + `",
+    "format": "ext4",
+    "checksum": "sha256:0000",
+    "read_only": true,
+    "tmpfs": ["/tmp"],
+    "overlay_size": "1G",
+    "kernel_args": "ro"
+  }
+}`
+	if err := os.WriteFile(input+".manifest.json", []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ImageConverter{InputPath: input, Filesystem: &config.FilesystemConfig{Type: "squashfs"}}
+	b := &OCIRootfsBuilder{OutputPath: output}
+	if err := c.writeManifest(b); err != nil {
+		t.Fatalf("writeManifest: %v", err)
+	}
+
+	data, err := os.ReadFile(output + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Name   string         `json:"name"`
+		Rootfs map[string]any `json:"rootfs"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "demo" {
+		t.Errorf("Expected the name to be kept, got %q", got.Name)
+	}
+	want, _ := computeSHA256(output)
+	if got.Rootfs["url"] != "file://"+output || got.Rootfs["format"] != "squashfs" || got.Rootfs["checksum"] != "sha256:"+want {
+		t.Errorf("Expected the rootfs to describe the new image, got %v", got.Rootfs)
+	}
+	for _, key := range []string{"read_only", "tmpfs", "overlay_size", "kernel_args"} {
+		if _, ok := got.Rootfs[key]; ok {
+			t.Errorf("Expected %s to be dropped for squashfs, got %v", key, got.Rootfs[key])
+		}
+	}
+}
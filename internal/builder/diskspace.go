@@ -0,0 +1,137 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// Space estimates used by the preflight checks. They are deliberately rough:
+// the goal is to fail before a long build runs out of space halfway, not to
+// predict usage exactly.
+const (
+	// minTempSpace is required in the temp directory when nothing better
+	// can be estimated.
+	minTempSpace = 512 << 20
+	// minBuildKitSpace is required in BuildKit's state directory for
+	// Dockerfile builds.
+	minBuildKitSpace = 2 << 30
+	// unpackRatio is the assumed ratio of unpacked to compressed layer size.
+	unpackRatio = 3
+	// squashfsRatio is the assumed ratio of rootfs to squashfs image size.
+	squashfsRatio = 2
+)
+
+// skipSpaceCheckEnv disables the preflight checks when set.
+const skipSpaceCheckEnv = "FLEDGE_SKIP_SPACE_CHECK"
+
+// spaceNeed is an amount of space a build step needs in dir.
+type spaceNeed struct {
+	what  string
+	dir   string
+	bytes int64
+}
+
+// checkSpace verifies that the filesystems holding each need have room for
+// them. Needs on the same filesystem are added up; filesystems whose free
+// space cannot be determined are skipped.
+func checkSpace(needs ...spaceNeed) error {
+	if os.Getenv(skipSpaceCheckEnv) != "" {
+		return nil
+	}
+
+	type filesystem struct {
+		free  int64
+		total int64
+		needs []spaceNeed
+	}
+	var order []uint64
+	byFS := make(map[uint64]*filesystem)
+	for _, n := range needs {
+		if n.bytes <= 0 {
+			continue
+		}
+		free, id, err := utils.FreeSpace(n.dir)
+		if err != nil {
+			logging.Debug("Skipping disk space check", "path", n.dir, "error", err)
+			continue
+		}
+		fs, ok := byFS[id]
+		if !ok {
+			fs = &filesystem{free: free}
+			byFS[id] = fs
+			order = append(order, id)
+		}
+		fs.total += n.bytes
+		fs.needs = append(fs.needs, n)
+	}
+
+	for _, id := range order {
+		fs := byFS[id]
+		logging.Debug("Disk space check", "path", fs.needs[0].dir, "need", utils.FormatBytes(fs.total), "free", utils.FormatBytes(fs.free))
+		if fs.total <= fs.free {
+			continue
+		}
+		parts := make([]string, len(fs.needs))
+		for i, n := range fs.needs {
+			parts[i] = fmt.Sprintf("%s in %s (%s)", n.what, n.dir, utils.FormatBytes(n.bytes))
+		}
+		return fmt.Errorf("not enough disk space: need about %s for %s, but only %s is free; "+
+			"free up space, move temporary files to a larger disk with --workdir or [build] temp_dir, or set %s=1 to skip this check",
+			utils.FormatBytes(fs.total), strings.Join(parts, ", "), utils.FormatBytes(fs.free), skipSpaceCheckEnv)
+	}
+	return nil
+}
+
+// sameFilesystem reports whether a and b are known to be on one filesystem.
+func sameFilesystem(a, b string) bool {
+	_, idA, errA := utils.FreeSpace(a)
+	_, idB, errB := utils.FreeSpace(b)
+	return errA == nil && errB == nil && idA == idB
+}
+
+// explainNoSpace adds guidance to errors caused by a full filesystem.
+func explainNoSpace(err error) error {
+	if !utils.IsNoSpace(err) {
+		return err
+	}
+	return fmt.Errorf("%w\nran out of disk space: free up space in the temp and output directories, or move temporary files to a larger disk with --workdir or [build] temp_dir", err)
+}
+
+// estimateImageSize returns the compressed size of imageRef's layers, or 0
+// when it cannot be determined. The local Docker daemon is tried first, like
+// copyImageToLayout does.
+func estimateImageSize(ctx context.Context, imageRef string) int64 {
+	if imageRef == "" {
+		return 0
+	}
+	for _, transport := range []string{"docker-daemon:", "docker://"} {
+		layers, err := inspectImageLayers(ctx, transport, imageRef)
+		if err != nil {
+			continue
+		}
+		var total int64
+		for _, layer := range layers {
+			total += layer.Size
+		}
+		if total > 0 {
+			return total
+		}
+	}
+	logging.DebugContext(ctx, "Could not estimate image size", "image", imageRef)
+	return 0
+}
+
+// buildKitNeed returns the space needed in BuildKit's state directory, if
+// the registered Dockerfile builder keeps one.
+func buildKitNeed() []spaceNeed {
+	dir := dockerfileStateDir()
+	if dir == "" {
+		return nil
+	}
+	return []spaceNeed{{"BuildKit state", dir, minBuildKitSpace}}
+}
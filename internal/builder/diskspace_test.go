@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestCheckSpace tests that needs on one filesystem are added up and
+// compared against its free space.
+func TestCheckSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := checkSpace(spaceNeed{"small", dir, 1}); err != nil {
+		t.Errorf("Expected 1 byte to fit, got %v", err)
+	}
+
+	huge := int64(1) << 62
+	err := checkSpace(
+		spaceNeed{"pulled image", dir, huge},
+		spaceNeed{"filesystem image", dir, 1},
+	)
+	if err == nil {
+		t.Fatal("Expected an error for an impossible need")
+	}
+	for _, want := range []string{"not enough disk space", "pulled image", "filesystem image", skipSpaceCheckEnv} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %q, got %v", want, err)
+		}
+	}
+
+	t.Setenv(skipSpaceCheckEnv, "1")
+	if err := checkSpace(spaceNeed{"pulled image", dir, huge}); err != nil {
+		t.Errorf("Expected check to be skipped, got %v", err)
+	}
+}
+
+// TestCheckSpace_MissingDir tests that needs are checked against the nearest
+// existing parent of directories that do not exist yet.
+func TestCheckSpace_MissingDir(t *testing.T) {
+	dir := t.TempDir() + "/not/created/yet"
+	if err := checkSpace(spaceNeed{"output", dir, int64(1) << 62}); err == nil {
+		t.Error("Expected an error for a directory that does not exist yet")
+	}
+}
+
+// TestExplainNoSpace tests that only ENOSPC failures get extra guidance.
+func TestExplainNoSpace(t *testing.T) {
+	plain := errors.New("boom")
+	if got := explainNoSpace(plain); got != plain {
+		t.Errorf("Expected unrelated error unchanged, got %v", got)
+	}
+	if explainNoSpace(nil) != nil {
+		t.Error("Expected nil to stay nil")
+	}
+
+	wrapped := fmt.Errorf("write failed: %w", syscall.ENOSPC)
+	got := explainNoSpace(wrapped)
+	if !errors.Is(got, syscall.ENOSPC) || !strings.Contains(got.Error(), "ran out of disk space") {
+		t.Errorf("Expected guidance wrapping ENOSPC, got %v", got)
+	}
+
+	tool := errors.New("mksquashfs failed: exit status 1\nOutput: Write failed because No space left on device")
+	if got := explainNoSpace(tool); !strings.Contains(got.Error(), "ran out of disk space") {
+		t.Errorf("Expected guidance for tool output, got %v", got)
+	}
+}
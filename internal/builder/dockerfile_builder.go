@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"sync"
+
+	"github.com/volantvm/fledge/internal/telemetry"
+	"github.com/volantvm/fledge/internal/vmnet"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type DockerfileBuildInput struct {
@@ -12,6 +16,18 @@ type DockerfileBuildInput struct {
 	Target     string
 	BuildArgs  map[string]string
 	DestDir    string
+	// ImageConfigPath, when set, receives the OCI image config JSON of the
+	// built image so callers can translate ENTRYPOINT/CMD/ENV and friends.
+	ImageConfigPath string
+	// FrontendImage optionally overrides the built-in Dockerfile frontend with
+	// an image resolved through the BuildKit gateway.
+	FrontendImage string
+	// ExportPaths optionally limits the export to these absolute paths of the
+	// target stage, each written at the same location under DestDir.
+	ExportPaths []string
+	// ImageTarPath, when set, also receives the built image as an OCI image
+	// tarball from the same solve.
+	ImageTarPath string
 }
 
 type DockerfileBuildFunc func(ctx context.Context, input DockerfileBuildInput) error
@@ -19,6 +35,7 @@ type DockerfileBuildFunc func(ctx context.Context, input DockerfileBuildInput) e
 var (
 	dockerfileBuilderMu sync.RWMutex
 	dockerfileBuilder   DockerfileBuildFunc
+	dockerfileStateFn   func() string
 )
 
 func RegisterDockerfileBuilder(fn DockerfileBuildFunc) {
@@ -27,6 +44,26 @@ func RegisterDockerfileBuilder(fn DockerfileBuildFunc) {
 	dockerfileBuilder = fn
 }
 
+// RegisterDockerfileStateDir registers a function returning the directory
+// the Dockerfile builder keeps its state and cache in, or "" if none, so
+// builds can check its free space up front.
+func RegisterDockerfileStateDir(fn func() string) {
+	dockerfileBuilderMu.Lock()
+	defer dockerfileBuilderMu.Unlock()
+	dockerfileStateFn = fn
+}
+
+// dockerfileStateDir returns the registered Dockerfile builder state dir.
+func dockerfileStateDir() string {
+	dockerfileBuilderMu.RLock()
+	fn := dockerfileStateFn
+	dockerfileBuilderMu.RUnlock()
+	if fn == nil {
+		return ""
+	}
+	return fn()
+}
+
 func invokeDockerfileBuilder(ctx context.Context, input DockerfileBuildInput) error {
 	dockerfileBuilderMu.RLock()
 	fn := dockerfileBuilder
@@ -36,5 +73,13 @@ func invokeDockerfileBuilder(ctx context.Context, input DockerfileBuildInput) er
 		return errors.New("initramfs builder: Dockerfile builds require embedded BuildKit support")
 	}
 
-	return fn(ctx, input)
+	input.BuildArgs = withProxyBuildArgs(input.BuildArgs, vmnet.FromContext(ctx).Proxy)
+
+	ctx, span := telemetry.Start(ctx, "buildkit.solve",
+		attribute.String("fledge.dockerfile", input.Dockerfile),
+		attribute.String("fledge.target", input.Target),
+		attribute.Int("fledge.export_paths", len(input.ExportPaths)))
+	err := fn(ctx, input)
+	telemetry.End(span, err)
+	return err
 }
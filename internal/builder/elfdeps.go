@@ -0,0 +1,384 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// maxSymlinkHops bounds symlink resolution inside a rootfs, as ELOOP does.
+const maxSymlinkHops = 40
+
+// defaultLibraryDirs are searched after DT_RPATH/DT_RUNPATH and ld.so.conf,
+// covering both glibc's and musl's built-in paths.
+var defaultLibraryDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib"}
+
+// multiarchTriplets maps ELF machines to their Debian multiarch library
+// subdirectory, e.g. /usr/lib/x86_64-linux-gnu.
+var multiarchTriplets = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64-linux-gnu",
+	elf.EM_AARCH64: "aarch64-linux-gnu",
+	elf.EM_386:     "i386-linux-gnu",
+	elf.EM_ARM:     "arm-linux-gnueabihf",
+	elf.EM_RISCV:   "riscv64-linux-gnu",
+	elf.EM_PPC64:   "powerpc64le-linux-gnu",
+	elf.EM_S390:    "s390x-linux-gnu",
+}
+
+// missingLib is a shared library or interpreter an ELF file in the rootfs
+// needs but the rootfs lacks.
+type missingLib struct {
+	binary string
+	name   string
+}
+
+// elfDeps is what the dynamic loader needs to run an ELF file.
+type elfDeps struct {
+	class   elf.Class
+	machine elf.Machine
+	interp  string
+	needed  []string
+	// runpath holds the DT_RPATH and DT_RUNPATH directories, with $ORIGIN
+	// expanded to the file's directory in the rootfs.
+	runpath []string
+}
+
+// checkMappedLibraries resolves the shared libraries of every ELF file copied
+// by [mappings] and [[stage_mappings]] against rootfsDir. Missing libraries
+// are copied from the host when copyDeps is set, and otherwise logged as
+// warnings, as they would only surface when the VM boots.
+func checkMappedLibraries(ctx context.Context, cfg *config.Config, rootfsDir string, copyDeps bool) error {
+	var targets []string
+	for _, dest := range cfg.Mappings {
+		targets = append(targets, dest)
+	}
+	for _, m := range cfg.StageMappings {
+		targets = append(targets, m.Dest)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	sort.Strings(targets)
+
+	c := newDepChecker(rootfsDir, copyDeps)
+	for _, target := range targets {
+		if err := c.checkTree(ctx, target); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range c.missing {
+		logging.WarnClassContext(ctx, logging.WarnLibraries, "Shared library missing from the artifact", "binary", m.binary, "library", m.name)
+	}
+	if len(c.missing) > 0 && !copyDeps {
+		logging.WarnClassContext(ctx, logging.WarnLibraries, "Mapped executables will fail to start; add the libraries to the mappings or build with --copy-deps", "missing", len(c.missing))
+	}
+	return nil
+}
+
+// depChecker resolves ELF dependencies inside a rootfs.
+type depChecker struct {
+	root     string
+	copyDeps bool
+	ldConf   []string
+	hostConf []string
+	checked  map[string]bool
+	missing  []missingLib
+}
+
+func newDepChecker(root string, copyDeps bool) *depChecker {
+	c := &depChecker{
+		root:     root,
+		copyDeps: copyDeps,
+		ldConf:   loaderConfDirs(root),
+		checked:  make(map[string]bool),
+	}
+	if copyDeps {
+		c.hostConf = loaderConfDirs("/")
+	}
+	return c
+}
+
+// checkTree checks every regular file at or below path in the rootfs.
+func (c *depChecker) checkTree(ctx context.Context, path string) error {
+	hostPath, err := resolveInRoot(c.root, path)
+	if err != nil {
+		logging.DebugContext(ctx, "Skipping dependency check of missing mapping", "path", path, "error", err)
+		return nil
+	}
+	return filepath.WalkDir(hostPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.root, p)
+		if err != nil {
+			return err
+		}
+		return c.check(ctx, "/"+filepath.ToSlash(rel))
+	})
+}
+
+// check resolves the dependencies of the file at path in the rootfs, and of
+// the libraries it loads.
+func (c *depChecker) check(ctx context.Context, path string) error {
+	hostPath, err := resolveInRoot(c.root, path)
+	if err != nil || c.checked[hostPath] {
+		return nil
+	}
+	c.checked[hostPath] = true
+
+	deps, err := readELFDeps(hostPath, path)
+	if err != nil || deps == nil {
+		return nil
+	}
+	if deps.interp != "" {
+		if _, err := resolveInRoot(c.root, deps.interp); err != nil {
+			if err := c.handleMissing(ctx, path, deps.interp, deps.interp, deps); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range deps.needed {
+		if strings.Contains(name, "/") {
+			if _, err := resolveInRoot(c.root, name); err != nil {
+				if err := c.handleMissing(ctx, path, name, name, deps); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		found := findLibrary(c.root, name, deps, c.ldConf)
+		if found == "" {
+			if err := c.handleMissing(ctx, path, name, "", deps); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.check(ctx, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleMissing records name as missing for binary, or copies it from the
+// host when enabled. dest is where the copy goes in the rootfs; empty uses
+// the library's directory on the host.
+func (c *depChecker) handleMissing(ctx context.Context, binary, name, dest string, deps *elfDeps) error {
+	if !c.copyDeps {
+		c.missing = append(c.missing, missingLib{binary: binary, name: name})
+		return nil
+	}
+	src := dest
+	if src == "" {
+		src = findLibrary("/", name, deps, c.hostConf)
+	} else if !compatibleELF(src, deps) {
+		src = ""
+	}
+	if src == "" {
+		c.missing = append(c.missing, missingLib{binary: binary, name: name})
+		return nil
+	}
+	if dest == "" {
+		dest = filepath.Join(filepath.Dir(src), name)
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat host library %s: %w", src, err)
+	}
+	target := filepath.Join(c.root, dest)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create library directory: %w", err)
+	}
+	// A dangling symlink at dest would otherwise be followed.
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to replace %s: %w", dest, err)
+	}
+	if err := CopyFile(src, target, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to copy %s for %s: %w", src, binary, err)
+	}
+	logging.InfoContext(ctx, "Copied shared library from host", "binary", binary, "library", name, "dest", dest)
+	return c.check(ctx, dest)
+}
+
+// findLibrary returns the path in root of the shared library name as the
+// loader of deps would find it, or "" if there is none.
+func findLibrary(root, name string, deps *elfDeps, confDirs []string) string {
+	dirs := append([]string{}, deps.runpath...)
+	dirs = append(dirs, confDirs...)
+	if triplet, ok := multiarchTriplets[deps.machine]; ok {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+	dirs = append(dirs, defaultLibraryDirs...)
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, name)
+		hostPath, err := resolveInRoot(root, candidate)
+		if err != nil || !compatibleELF(hostPath, deps) {
+			continue
+		}
+		return candidate
+	}
+	return ""
+}
+
+// compatibleELF reports whether the ELF file at path can be loaded by deps'
+// loader: glibc skips libraries of another class or machine.
+func compatibleELF(path string, deps *elfDeps) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Class == deps.class && f.Machine == deps.machine
+}
+
+// readELFDeps returns the dependencies of the ELF file at hostPath, found at
+// path in the rootfs. It returns nil for files that are not dynamically
+// linked executables or libraries.
+func readELFDeps(hostPath, path string) (*elfDeps, error) {
+	f, err := elf.Open(hostPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return nil, nil
+	}
+
+	deps := &elfDeps{class: f.Class, machine: f.Machine}
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return nil, err
+		}
+		deps.interp = strings.TrimRight(string(data), "\x00")
+	}
+	if deps.needed, err = f.ImportedLibraries(); err != nil {
+		return nil, err
+	}
+	if deps.interp == "" && len(deps.needed) == 0 {
+		return nil, nil
+	}
+	origin := filepath.Dir(path)
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		values, _ := f.DynString(tag)
+		for _, v := range values {
+			for _, dir := range strings.Split(v, ":") {
+				dir = strings.ReplaceAll(strings.ReplaceAll(dir, "${ORIGIN}", origin), "$ORIGIN", origin)
+				if dir != "" {
+					deps.runpath = append(deps.runpath, dir)
+				}
+			}
+		}
+	}
+	return deps, nil
+}
+
+// loaderConfDirs returns the library directories configured in root's
+// /etc/ld.so.conf (with its includes) and musl's /etc/ld-musl-*.path files.
+func loaderConfDirs(root string) []string {
+	dirs := readLdSoConf(root, "/etc/ld.so.conf", 0)
+	paths, _ := filepath.Glob(filepath.Join(root, "etc", "ld-musl-*.path"))
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, strings.FieldsFunc(string(data), func(r rune) bool {
+			return r == ':' || r == '\n'
+		})...)
+	}
+	return dirs
+}
+
+// readLdSoConf parses the ld.so.conf file at path in root.
+func readLdSoConf(root, path string, depth int) []string {
+	f, err := os.Open(filepath.Join(root, path))
+	if err != nil || depth > 8 {
+		return nil
+	}
+	defer f.Close()
+
+	var dirs []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "include" {
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+				matches, _ := filepath.Glob(filepath.Join(root, pattern))
+				sort.Strings(matches)
+				for _, m := range matches {
+					if rel, err := filepath.Rel(root, m); err == nil {
+						dirs = append(dirs, readLdSoConf(root, "/"+rel, depth+1)...)
+					}
+				}
+			}
+			continue
+		}
+		if line != "" {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs
+}
+
+// resolveInRoot returns the host path of path inside root, following
+// symlinks as if root were "/". It fails if the path does not exist.
+func resolveInRoot(root, path string) (string, error) {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	resolved := "/"
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many symlinks resolving %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(filepath.ToSlash(target), "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
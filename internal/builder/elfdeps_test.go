@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestResolveInRoot tests that symlinks resolve inside the rootfs.
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/lib/x86_64-linux-gnu"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "usr/lib/x86_64-linux-gnu/libc.so.6"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"lib":                   "usr/lib",
+		"lib64":                 "/lib/x86_64-linux-gnu",
+		"usr/lib/libc-abs.so.6": "/usr/lib/x86_64-linux-gnu/libc.so.6",
+		"usr/lib/escape.so":     "../../../../../usr/lib/x86_64-linux-gnu/libc.so.6",
+		"usr/lib/dangling.so":   "/nowhere",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := filepath.Join(root, "usr/lib/x86_64-linux-gnu/libc.so.6")
+	for _, p := range []string{"/lib64/libc.so.6", "/lib/libc-abs.so.6", "/usr/lib/escape.so", "lib/x86_64-linux-gnu/../x86_64-linux-gnu/libc.so.6"} {
+		got, err := resolveInRoot(root, p)
+		if err != nil || got != want {
+			t.Errorf("resolveInRoot(%q) = %q, %v; want %q", p, got, err, want)
+		}
+	}
+	if _, err := resolveInRoot(root, "/usr/lib/dangling.so"); err == nil {
+		t.Error("Expected a dangling symlink to fail")
+	}
+}
+
+// TestDepChecker tests finding and copying the libraries of a dynamically
+// linked host binary mapped into an empty rootfs.
+func TestDepChecker(t *testing.T) {
+	const binary = "/bin/ls"
+	hostPath, err := filepath.EvalSymlinks(binary)
+	if err != nil {
+		t.Skipf("%s not available: %v", binary, err)
+	}
+	if deps, err := readELFDeps(hostPath, binary); err != nil || deps == nil {
+		t.Skipf("%s is not dynamically linked", binary)
+	}
+
+	setup := func() string {
+		t.Helper()
+		root := t.TempDir()
+		if err := CopyFile(hostPath, filepath.Join(root, "usr/bin/app"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+	ctx := context.Background()
+
+	root := setup()
+	c := newDepChecker(root, false)
+	if err := c.checkTree(ctx, "/usr/bin"); err != nil {
+		t.Fatalf("checkTree failed: %v", err)
+	}
+	if len(c.missing) == 0 {
+		t.Fatal("Expected missing libraries in an empty rootfs")
+	}
+	for _, m := range c.missing {
+		if m.binary != "/usr/bin/app" {
+			t.Errorf("Unexpected binary %q in %+v", m.binary, m)
+		}
+	}
+
+	root = setup()
+	c = newDepChecker(root, true)
+	if err := c.checkTree(ctx, "/usr/bin/app"); err != nil {
+		t.Fatalf("checkTree with copying failed: %v", err)
+	}
+	if len(c.missing) != 0 {
+		t.Errorf("Expected all libraries to be copied, still missing %+v", c.missing)
+	}
+	c = newDepChecker(root, false)
+	if err := c.checkTree(ctx, "/usr/bin/app"); err != nil || len(c.missing) != 0 {
+		t.Errorf("Expected copied libraries to resolve, missing %+v (err %v)", c.missing, err)
+	}
+}
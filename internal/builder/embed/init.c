@@ -236,6 +236,97 @@ static void read_root_params(char *root_dev, size_t root_dev_len, char *root_fs,
     }
 }
 
+// Look up key (e.g. "overlay_size=") on the kernel command line and copy its
+// value to out. Returns 1 if found.
+static int read_cmdline_value(const char *key, char *out, size_t out_len) {
+    FILE *f = fopen("/proc/cmdline", "r");
+    if (!f)
+        return 0;
+
+    char line[4096];
+    int found = 0;
+    if (fgets(line, sizeof(line), f)) {
+        size_t key_len = strlen(key);
+        char *saveptr = NULL;
+        for (char *token = strtok_r(line, " \n", &saveptr); token; token = strtok_r(NULL, " \n", &saveptr)) {
+            if (strncmp(token, key, key_len) == 0) {
+                strncpy(out, token + key_len, out_len - 1);
+                out[out_len - 1] = '\0';
+                found = 1;
+            }
+        }
+    }
+    fclose(f);
+    return found;
+}
+
+// Report whether a bare flag such as "ro" is on the kernel command line.
+static int cmdline_has_flag(const char *flag) {
+    FILE *f = fopen("/proc/cmdline", "r");
+    if (!f)
+        return 0;
+
+    char line[4096];
+    int found = 0;
+    if (fgets(line, sizeof(line), f)) {
+        char *saveptr = NULL;
+        for (char *token = strtok_r(line, " \n", &saveptr); token; token = strtok_r(NULL, " \n", &saveptr)) {
+            if (strcmp(token, flag) == 0)
+                found = 1;
+        }
+    }
+    fclose(f);
+    return found;
+}
+
+// Overlay tmpfs-backed upper layers on the writable paths of a read-only
+// root mounted at /newroot. The paths come from fledge.tmpfs= (default
+// /tmp,/run,/var) and share one tmpfs sized by overlay_size= (default 1G).
+static void mount_tmpfs_overlays(void) {
+    char paths[1024] = "/tmp,/run,/var";
+    char size[64] = "1G";
+    read_cmdline_value("fledge.tmpfs=", paths, sizeof(paths));
+    read_cmdline_value("overlay_size=", size, sizeof(size));
+
+    load_filesystem_modules();
+
+    char size_opts[96];
+    snprintf(size_opts, sizeof(size_opts), "size=%s", size);
+    mkdir("/overlays", 0755);
+    if (mount("tmpfs", "/overlays", "tmpfs", 0, size_opts)) {
+        fprintf(stderr, "C INIT: Failed to mount tmpfs for overlays: %s\n", strerror(errno));
+        return;
+    }
+
+    int n = 0;
+    char *saveptr = NULL;
+    for (char *path = strtok_r(paths, ",", &saveptr); path; path = strtok_r(NULL, ",", &saveptr), n++) {
+        char target[1100], dir[64], upper[80], work[80], opts[1400];
+        struct stat st;
+
+        snprintf(target, sizeof(target), "/newroot%s", path);
+        if (stat(target, &st) || !S_ISDIR(st.st_mode)) {
+            fprintf(stderr, "C INIT: %s is not a directory in the root filesystem; not overlaid\n", path);
+            continue;
+        }
+        snprintf(dir, sizeof(dir), "/overlays/%d", n);
+        snprintf(upper, sizeof(upper), "%s/upper", dir);
+        snprintf(work, sizeof(work), "%s/work", dir);
+        mkdir(dir, 0755);
+        mkdir(upper, st.st_mode & 07777);
+        mkdir(work, 0755);
+        if (chown(upper, st.st_uid, st.st_gid))
+            fprintf(stderr, "C INIT: Failed to chown overlay of %s: %s\n", path, strerror(errno));
+
+        snprintf(opts, sizeof(opts), "lowerdir=%s,upperdir=%s,workdir=%s", target, upper, work);
+        if (mount("overlay", target, "overlay", 0, opts)) {
+            fprintf(stderr, "C INIT: Failed to overlay %s: %s\n", path, strerror(errno));
+            continue;
+        }
+        printf("C INIT: %s is writable (tmpfs overlay)\n", path);
+    }
+}
+
 static int try_run_buildkit(void) {
     char root_dev[256];
     char root_fs[64];
@@ -317,13 +408,16 @@ static int try_run_buildkit(void) {
         
         printf("C INIT: overlayfs mounted (squashfs lower + tmpfs upper with %s)\n", overlay_opts);
     } else {
-        // Legacy ext4/xfs/btrfs direct mount
-        if (mount(root_dev, "/newroot", root_fs, 0, NULL)) {
+        // Legacy ext4/xfs/btrfs direct mount, read-only when booted with "ro"
+        unsigned long root_flags = cmdline_has_flag("ro") ? MS_RDONLY : 0;
+        if (mount(root_dev, "/newroot", root_fs, root_flags, NULL)) {
             fprintf(stderr, "C INIT: Failed to mount root device %s (%s): %s\n", root_dev, root_fs, strerror(errno));
             rmdir("/newroot");
             return 0;
         }
-        printf("C INIT: mounted root filesystem from %s (%s)\n", root_dev, root_fs);
+        printf("C INIT: mounted root filesystem from %s (%s%s)\n", root_dev, root_fs, root_flags ? ", read-only" : "");
+        if (root_flags)
+            mount_tmpfs_overlays();
     }
 
     char init_path[4096] = {0};
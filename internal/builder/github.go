@@ -0,0 +1,221 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/retry"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+const (
+	// githubMaxRetryDelay caps a single backoff, even when the rate limit
+	// resets later than that.
+	githubMaxRetryDelay = time.Minute
+	// githubLatestCacheTTL is how long a cached "latest" release is trusted.
+	// Releases looked up by tag are cached indefinitely.
+	githubLatestCacheTTL = 10 * time.Minute
+)
+
+var (
+	// githubAPIBase is the GitHub REST API endpoint.
+	githubAPIBase = "https://api.github.com"
+	// githubRetryBaseDelay is the first backoff delay; it doubles per attempt.
+	githubRetryBaseDelay = 2 * time.Second
+	// githubTokenEnv lists the environment variables holding a GitHub token, in
+	// order of preference.
+	githubTokenEnv = []string{"FLEDGE_GITHUB_TOKEN", "GITHUB_TOKEN"}
+)
+
+// fetchRelease returns release metadata for version ("latest" or a tag) of
+// repo. Responses are cached locally; if GitHub cannot be reached or keeps
+// rate limiting, a stale cached copy is used instead of failing.
+func fetchRelease(ctx context.Context, repo, version string) (*GitHubRelease, error) {
+	cachePath, cacheErr := releaseCachePath(ctx, repo, version)
+	if cacheErr != nil {
+		logging.DebugContext(ctx, "Release metadata cache unavailable", "error", cacheErr)
+	}
+
+	ttl := time.Duration(0)
+	if version == "latest" {
+		ttl = githubLatestCacheTTL
+	}
+	if cachePath != "" {
+		if release, fresh := readCachedRelease(cachePath, ttl); release != nil && fresh {
+			logging.DebugContext(ctx, "Using cached release metadata", "repo", repo, "version", version, "tag", release.TagName)
+			return release, nil
+		}
+	}
+
+	var releaseURL string
+	if version == "latest" {
+		releaseURL = fmt.Sprintf("%s/repos/%s/releases/latest", githubAPIBase, repo)
+	} else {
+		releaseURL = fmt.Sprintf("%s/repos/%s/releases/tags/%s", githubAPIBase, repo, version)
+	}
+
+	release, err := getRelease(ctx, releaseURL)
+	if err != nil {
+		if cachePath != "" {
+			if stale, _ := readCachedRelease(cachePath, ttl); stale != nil {
+				logging.WarnContext(ctx, "GitHub release lookup failed, using cached metadata", "tag", stale.TagName, "error", err)
+				return stale, nil
+			}
+		}
+		return nil, err
+	}
+
+	if cachePath != "" {
+		if data, err := json.Marshal(release); err == nil {
+			if err := os.WriteFile(cachePath, data, 0644); err != nil {
+				logging.DebugContext(ctx, "Failed to cache release metadata", "path", cachePath, "error", err)
+			}
+		}
+	}
+	return release, nil
+}
+
+// getRelease requests releaseURL, retrying with backoff when the request
+// fails in transit or GitHub answers 403 or 429 (rate limiting) or a 5xx
+// error, as often as the network retry policy in ctx allows.
+func getRelease(ctx context.Context, releaseURL string) (*GitHubRelease, error) {
+	token := githubToken()
+	attempts := max(retry.FromContext(ctx).Network.Attempts, 1)
+	var lastErr error
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, releaseURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		logging.DebugContext(ctx, "Fetching release info", "url", releaseURL, "attempt", attempt+1, "authenticated", token != "")
+		resp, err := http.DefaultClient.Do(req)
+		var header http.Header
+		if err != nil {
+			// Transport errors, such as a reset connection, are retried
+			lastErr = fmt.Errorf("failed to fetch release info: %w", err)
+			if ctx.Err() != nil || attempt == attempts-1 {
+				return nil, lastErr
+			}
+		} else {
+			if resp.StatusCode == http.StatusOK {
+				var release GitHubRelease
+				err := json.NewDecoder(resp.Body).Decode(&release)
+				resp.Body.Close()
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse release JSON: %w", err)
+				}
+				return &release, nil
+			}
+
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("GitHub API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+
+			retryable := githubRateLimited(resp) ||
+				resp.StatusCode == http.StatusTooManyRequests ||
+				resp.StatusCode >= 500
+			if !retryable {
+				break
+			}
+			header = resp.Header
+		}
+		if attempt == attempts-1 {
+			break
+		}
+
+		delay := githubRetryDelay(header, attempt, time.Now())
+		logging.WarnContext(ctx, "GitHub API request failed, retrying", "error", lastErr, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("%w (set GITHUB_TOKEN or FLEDGE_GITHUB_TOKEN to raise the rate limit)", lastErr)
+	}
+	return nil, lastErr
+}
+
+// githubRateLimited reports whether a 403 response is GitHub's rate limit,
+// rather than a denied request that retrying cannot fix.
+func githubRateLimited(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusForbidden &&
+		(resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != "")
+}
+
+// githubRetryDelay honours Retry-After and X-RateLimit-Reset, falling back to
+// exponential backoff. The result never exceeds githubMaxRetryDelay.
+func githubRetryDelay(h http.Header, attempt int, now time.Time) time.Duration {
+	delay := githubRetryBaseDelay << attempt
+
+	if secs, err := strconv.Atoi(h.Get("Retry-After")); err == nil && secs >= 0 {
+		delay = time.Duration(secs) * time.Second
+	} else if h.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if until := time.Unix(reset, 0).Sub(now); until > 0 {
+				delay = until
+			}
+		}
+	}
+
+	if delay > githubMaxRetryDelay {
+		delay = githubMaxRetryDelay
+	}
+	return delay
+}
+
+// githubToken returns the first GitHub token set in the environment.
+func githubToken() string {
+	for _, name := range githubTokenEnv {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// releaseCachePath returns the cache file for a repo release lookup.
+func releaseCachePath(ctx context.Context, repo, version string) (string, error) {
+	dir, err := utils.CacheDirContext(ctx, "github-releases")
+	if err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(repo + "@" + version)
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// readCachedRelease loads cached release metadata and reports whether it is
+// younger than ttl. A zero ttl means the entry never expires.
+func readCachedRelease(path string, ttl time.Duration) (*GitHubRelease, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var release GitHubRelease
+	if err := json.Unmarshal(data, &release); err != nil || release.TagName == "" {
+		return nil, false
+	}
+	fresh := ttl == 0 || time.Since(info.ModTime()) < ttl
+	return &release, fresh
+}
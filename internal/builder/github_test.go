@@ -0,0 +1,195 @@
+package builder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/volantvm/fledge/internal/retry"
+)
+
+// useGitHubServer points release lookups at a test server with an isolated cache.
+func useGitHubServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	prevBase, prevDelay := githubAPIBase, githubRetryBaseDelay
+	githubAPIBase, githubRetryBaseDelay = srv.URL, time.Millisecond
+	t.Cleanup(func() { githubAPIBase, githubRetryBaseDelay = prevBase, prevDelay })
+
+	t.Setenv("FLEDGE_CACHE_DIR", t.TempDir())
+	t.Setenv("FLEDGE_GITHUB_TOKEN", "")
+	t.Setenv("GITHUB_TOKEN", "")
+}
+
+// TestFetchRelease_RetriesRateLimit tests retrying 429 responses with the token set.
+func TestFetchRelease_RetriesRateLimit(t *testing.T) {
+	var calls int32
+	useGitHubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer s3cret" {
+			t.Errorf("Expected bearer token, got %q", got)
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"tag_name":"v0.4.2","assets":[{"name":"kestrel","browser_download_url":"https://example.com/kestrel"}]}`))
+	})
+	t.Setenv("GITHUB_TOKEN", "s3cret")
+
+	release, err := fetchRelease(context.Background(), "volantvm/volant", "v0.4.2")
+	if err != nil {
+		t.Fatalf("fetchRelease failed: %v", err)
+	}
+	if release.TagName != "v0.4.2" || calls != 3 {
+		t.Errorf("Expected v0.4.2 after 3 calls, got %s after %d", release.TagName, calls)
+	}
+
+	// Tagged releases are served from the cache afterwards
+	if _, err := fetchRelease(context.Background(), "volantvm/volant", "v0.4.2"); err != nil {
+		t.Fatalf("Cached fetchRelease failed: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected cached lookup to skip the API, got %d calls", calls)
+	}
+}
+
+// TestFetchRelease_Forbidden tests that a 403 is only retried when it is
+// the rate limit.
+func TestFetchRelease_Forbidden(t *testing.T) {
+	var calls, limited int32
+	useGitHubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&limited) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if n < 3 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", "0")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"tag_name":"v0.4.2","assets":[]}`))
+	})
+
+	if _, err := fetchRelease(context.Background(), "volantvm/volant", "v0.4.1"); err == nil {
+		t.Fatal("Expected a denied request to fail")
+	}
+	if calls != 1 {
+		t.Errorf("Expected a denied request not to be retried, got %d calls", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&limited, 1)
+	if _, err := fetchRelease(context.Background(), "volantvm/volant", "v0.4.2"); err != nil {
+		t.Fatalf("fetchRelease failed: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected the rate limit to be retried, got %d calls", calls)
+	}
+}
+
+// TestFetchRelease_RetriesTransportErrors tests that dropped connections
+// are retried, as often as the network retry policy allows.
+func TestFetchRelease_RetriesTransportErrors(t *testing.T) {
+	var calls int32
+	useGitHubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 4 {
+			// Close the connection without an answer
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte(`{"tag_name":"v0.4.2","assets":[]}`))
+	})
+
+	ctx := retry.NewContext(context.Background(), retry.Policies{Network: retry.Policy{Attempts: 3}})
+	if _, err := fetchRelease(ctx, "volantvm/volant", "v0.4.1"); err == nil || !strings.Contains(err.Error(), "failed to fetch release info") {
+		t.Fatalf("Expected a transport error after the configured attempts, got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("Expected 3 attempts, got %d calls", n)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	ctx = retry.NewContext(context.Background(), retry.Policies{Network: retry.Policy{Attempts: 4}})
+	release, err := fetchRelease(ctx, "volantvm/volant", "v0.4.2")
+	if err != nil {
+		t.Fatalf("fetchRelease failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); release.TagName != "v0.4.2" || n != 4 {
+		t.Errorf("Expected v0.4.2 after 4 calls, got %s after %d", release.TagName, n)
+	}
+}
+
+// TestFetchRelease_StaleCache tests falling back to expired cache entries.
+func TestFetchRelease_StaleCache(t *testing.T) {
+	var failing int32
+	useGitHubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"tag_name":"v0.5.0"}`))
+	})
+
+	if _, err := fetchRelease(context.Background(), "volantvm/volant", "latest"); err != nil {
+		t.Fatalf("fetchRelease failed: %v", err)
+	}
+	path, err := releaseCachePath(context.Background(), "volantvm/volant", "latest")
+	if err != nil {
+		t.Fatalf("releaseCachePath failed: %v", err)
+	}
+	old := time.Now().Add(-2 * githubLatestCacheTTL)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	release, err := fetchRelease(context.Background(), "volantvm/volant", "latest")
+	if err != nil {
+		t.Fatalf("Expected stale cache fallback, got %v", err)
+	}
+	if release.TagName != "v0.5.0" {
+		t.Errorf("Expected cached v0.5.0, got %s", release.TagName)
+	}
+}
+
+// TestGitHubRetryDelay tests Retry-After, rate limit reset and backoff handling.
+func TestGitHubRetryDelay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	h := http.Header{}
+	h.Set("Retry-After", "7")
+	if got := githubRetryDelay(h, 0, now); got != 7*time.Second {
+		t.Errorf("Expected Retry-After delay of 7s, got %v", got)
+	}
+
+	h = http.Header{}
+	h.Set("X-RateLimit-Remaining", "0")
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(20*time.Second).Unix(), 10))
+	if got := githubRetryDelay(h, 0, now); got != 20*time.Second {
+		t.Errorf("Expected reset delay of 20s, got %v", got)
+	}
+
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(time.Hour).Unix(), 10))
+	if got := githubRetryDelay(h, 0, now); got != githubMaxRetryDelay {
+		t.Errorf("Expected delay capped at %v, got %v", githubMaxRetryDelay, got)
+	}
+
+	if got := githubRetryDelay(http.Header{}, 2, now); got != githubRetryBaseDelay<<2 {
+		t.Errorf("Expected exponential backoff, got %v", got)
+	}
+}
@@ -0,0 +1,348 @@
+package builder
+
+import (
+	"context"
+	"debug/elf"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// Files and directories the GPU driver is installed to.
+const (
+	gpuLdConfPath      = "/etc/ld.so.conf.d/fledge-gpu.conf"
+	gpuModulesLoadPath = "/etc/modules-load.d/fledge-gpu.conf"
+	gpuModuleSubdir    = "kernel/drivers/video"
+)
+
+var (
+	// gpuLibraryRe matches the driver's userspace libraries.
+	gpuLibraryRe = regexp.MustCompile(`^lib(cuda|nvcuvid|nvoptix|nvidia-|EGL_nvidia|GLX_nvidia|GLESv[12].*_nvidia)[^/]*\.so(\.[0-9.]+)?$`)
+	// gpuVersionRe extracts the driver version from a library name.
+	gpuVersionRe = regexp.MustCompile(`^libnvidia-ml\.so\.([0-9]+\.[0-9.]+)$`)
+)
+
+// gpuTools are the driver's command line tools installed to /usr/bin.
+var gpuTools = []string{
+	"nvidia-smi",
+	"nvidia-debugdump",
+	"nvidia-persistenced",
+	"nvidia-cuda-mps-control",
+	"nvidia-cuda-mps-server",
+	"nvidia-modprobe",
+}
+
+// gpuModuleDeps are the dependencies between the driver's kernel modules,
+// used when depmod is unavailable.
+var gpuModuleDeps = map[string][]string{
+	"nvidia_modeset": {"nvidia"},
+	"nvidia_uvm":     {"nvidia"},
+	"nvidia_drm":     {"nvidia_modeset", "nvidia"},
+	"nvidia_peermem": {"nvidia"},
+}
+
+// gpuPayload holds the host paths of the driver files to install.
+type gpuPayload struct {
+	version  string
+	libs     []string
+	tools    []string
+	firmware string // directory copied to /lib/firmware/nvidia/<version>
+	modules  []string
+}
+
+// applyGPUDriver extracts the [gpu] driver payload and installs it into the
+// rootfs: libraries with their soname links and an ld.so.conf.d entry,
+// tools, firmware and kernel modules for the guest kernel.
+func applyGPUDriver(ctx context.Context, cfg *config.Config, workDir, rootfsDir string, kernel *guestKernel, tracker *lock.Tracker) error {
+	g := cfg.GPU
+	if g == nil {
+		return nil
+	}
+
+	scratch, err := os.MkdirTemp("", "fledge-gpu-*")
+	if err != nil {
+		return fmt.Errorf("failed to create GPU driver dir: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	var payload *gpuPayload
+	if g.DriverRunFile != "" {
+		payload, err = extractRunFile(ctx, g, workDir, scratch, kernel, tracker)
+	} else {
+		payload, err = extractDriverImage(ctx, g.DriverImage, scratch, tracker)
+	}
+	if err != nil {
+		return err
+	}
+	if len(payload.libs) == 0 {
+		return fmt.Errorf("no NVIDIA driver libraries found in the GPU driver payload")
+	}
+	logging.InfoContext(ctx, "Installing GPU driver", "version", payload.version,
+		"libraries", len(payload.libs), "tools", len(payload.tools), "modules", len(payload.modules))
+
+	if err := installGPULibraries(ctx, payload.libs, rootfsDir, g.LibraryDir()); err != nil {
+		return err
+	}
+	for _, tool := range payload.tools {
+		if err := CopyFile(tool, filepath.Join(rootfsDir, "usr/bin", filepath.Base(tool)), 0755); err != nil {
+			return fmt.Errorf("failed to install %s: %w", filepath.Base(tool), err)
+		}
+	}
+	if payload.firmware != "" {
+		dest := filepath.Join(rootfsDir, "lib/firmware/nvidia", payload.version)
+		if err := CopyDirectory(ctx, payload.firmware, dest, 0644); err != nil {
+			return fmt.Errorf("failed to install GPU firmware: %w", err)
+		}
+	}
+	if len(payload.modules) == 0 {
+		logging.WarnClassContext(ctx, logging.WarnKernelModules, "No GPU kernel modules installed; the guest kernel must provide them (set gpu.build_modules to compile them)")
+		return nil
+	}
+	return installGPUModules(ctx, payload.modules, rootfsDir, kernel)
+}
+
+// extractRunFile unpacks an NVIDIA-Linux-*.run installer and optionally
+// builds its kernel modules against the guest kernel.
+func extractRunFile(ctx context.Context, g *config.GPUConfig, workDir, scratch string, kernel *guestKernel, tracker *lock.Tracker) (*gpuPayload, error) {
+	runFile := resolveWorkPath(g.DriverRunFile, workDir)
+	if remote, ok, err := config.ParseRemoteSource(g.DriverRunFile); err != nil {
+		return nil, err
+	} else if ok {
+		logging.InfoContext(ctx, "Fetching GPU driver", "url", remote.URL)
+		path, cached, err := utils.DownloadCached(ctx, remote.URL, remote.Checksum, progress.Bars())
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", remote.URL, err)
+		}
+		recordFileDownload(ctx, "gpu driver", remote.URL, path, cached)
+		if err := tracker.RecordDownload(lock.Download{URL: remote.URL, Digest: remote.Checksum}); err != nil {
+			return nil, err
+		}
+		runFile = path
+	}
+
+	dir := filepath.Join(scratch, "driver")
+	logging.InfoContext(ctx, "Extracting GPU driver", "run_file", filepath.Base(g.DriverRunFile))
+	out, err := exec.CommandContext(ctx, "sh", runFile, "--extract-only", "--target", dir).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract %s: %w\nOutput: %s", filepath.Base(runFile), err, out)
+	}
+
+	payload := &gpuPayload{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read extracted driver: %w", err)
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		switch {
+		case !e.Type().IsRegular():
+		case gpuLibraryRe.MatchString(e.Name()):
+			payload.addLibrary(path)
+		case isGPUTool(e.Name()):
+			payload.tools = append(payload.tools, path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "firmware")); err == nil {
+		payload.firmware = filepath.Join(dir, "firmware")
+	}
+
+	kernelDir := filepath.Join(dir, "kernel")
+	if g.BuildModules {
+		_, modulesDir, err := kernel.modules(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sysSrc := filepath.Join(modulesDir, "build")
+		logging.InfoContext(ctx, "Building GPU kernel modules", "kernel_source", sysSrc)
+		cmd := exec.CommandContext(ctx, "make", "-C", kernelDir, "SYSSRC="+sysSrc, "-j", strconv.Itoa(runtime.NumCPU()), "modules")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to build GPU kernel modules (guest kernel headers must be at %s): %w\nOutput: %s", sysSrc, err, out)
+		}
+	}
+	modules, _ := filepath.Glob(filepath.Join(kernelDir, "*.ko"))
+	payload.modules = modules
+	return payload, nil
+}
+
+// extractDriverImage pulls a driver container image and collects the driver
+// files it holds.
+func extractDriverImage(ctx context.Context, ref, scratch string, tracker *lock.Tracker) (*gpuPayload, error) {
+	root, err := fetchOCIAsset(ctx, ref, scratch, tracker)
+	if err != nil {
+		return nil, fmt.Errorf("GPU driver image %s: %w", ref, err)
+	}
+
+	payload := &gpuPayload{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		name := d.Name()
+		switch {
+		case d.IsDir():
+			if rel == "lib/firmware/nvidia" || rel == "usr/lib/firmware/nvidia" {
+				// Firmware is kept per driver version; take the newest
+				versions, _ := os.ReadDir(path)
+				if len(versions) > 0 {
+					payload.firmware = filepath.Join(path, versions[len(versions)-1].Name())
+				}
+				return filepath.SkipDir
+			}
+		case !d.Type().IsRegular():
+		case strings.HasPrefix(rel, "lib/modules/") && strings.HasPrefix(name, "nvidia") && strings.Contains(name, ".ko"):
+			payload.modules = append(payload.modules, path)
+		case strings.Contains(rel, "lib") && gpuLibraryRe.MatchString(name):
+			payload.addLibrary(path)
+		case strings.Contains(rel, "bin/") && isGPUTool(name):
+			payload.tools = append(payload.tools, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan GPU driver image: %w", err)
+	}
+	return payload, nil
+}
+
+// addLibrary adds a driver library, taking the driver version from
+// libnvidia-ml.
+func (p *gpuPayload) addLibrary(path string) {
+	p.libs = append(p.libs, path)
+	if m := gpuVersionRe.FindStringSubmatch(filepath.Base(path)); m != nil {
+		p.version = m[1]
+	}
+}
+
+func isGPUTool(name string) bool {
+	for _, tool := range gpuTools {
+		if name == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// installGPULibraries copies the driver libraries to libDir, links their
+// sonames, registers libDir with the dynamic loader and refreshes the
+// rootfs loader cache.
+func installGPULibraries(ctx context.Context, libs []string, rootfsDir, libDir string) error {
+	destDir := filepath.Join(rootfsDir, libDir)
+	sort.Strings(libs)
+	for _, lib := range libs {
+		name := filepath.Base(lib)
+		if err := CopyFile(lib, filepath.Join(destDir, name), 0755); err != nil {
+			return fmt.Errorf("failed to install %s: %w", name, err)
+		}
+		soname := librarySoname(lib)
+		if soname == "" || soname == name {
+			continue
+		}
+		link := filepath.Join(destDir, soname)
+		os.Remove(link)
+		if err := os.Symlink(name, link); err != nil {
+			return fmt.Errorf("failed to link %s: %w", soname, err)
+		}
+	}
+
+	if err := writeRootfsFile(rootfsDir, gpuLdConfPath, libDir+"\n"); err != nil {
+		return err
+	}
+	if out, err := exec.CommandContext(ctx, "ldconfig", "-r", rootfsDir).CombinedOutput(); err != nil {
+		logging.WarnContext(ctx, "Could not update the rootfs loader cache; run ldconfig in the guest if the driver libraries are not found",
+			"error", err, "output", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// librarySoname returns the DT_SONAME of a shared library, or "" if it has
+// none.
+func librarySoname(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	names, err := f.DynString(elf.DT_SONAME)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// installGPUModules copies the driver's kernel modules into the guest
+// kernel's module tree, regenerates its module index and loads nvidia and
+// nvidia_uvm at boot.
+func installGPUModules(ctx context.Context, modules []string, rootfsDir string, kernel *guestKernel) error {
+	release, _, err := kernel.modules(ctx)
+	if err != nil {
+		return err
+	}
+	destDir := filepath.Join(rootfsDir, "lib/modules", release, gpuModuleSubdir)
+	for _, mod := range modules {
+		if err := CopyFile(mod, filepath.Join(destDir, filepath.Base(mod)), 0644); err != nil {
+			return fmt.Errorf("failed to install GPU kernel module %s: %w", filepath.Base(mod), err)
+		}
+	}
+	if out, err := exec.CommandContext(ctx, "depmod", "-b", rootfsDir, release).CombinedOutput(); err != nil {
+		logging.WarnContext(ctx, "Could not run depmod, registering the GPU modules in modules.dep directly",
+			"error", err, "output", strings.TrimSpace(string(out)))
+		if err := appendGPUModulesDep(filepath.Join(rootfsDir, "lib/modules", release), modules); err != nil {
+			return err
+		}
+	}
+	if err := writeRootfsFile(rootfsDir, gpuModulesLoadPath, "nvidia\nnvidia_uvm\n"); err != nil {
+		return err
+	}
+	logging.InfoContext(ctx, "Installed GPU kernel modules", "kernel", release, "count", len(modules))
+	return nil
+}
+
+// appendGPUModulesDep adds the installed GPU modules to modules.dep in
+// moduleDir.
+func appendGPUModulesDep(moduleDir string, modules []string) error {
+	rel := make(map[string]string, len(modules))
+	for _, mod := range modules {
+		rel[moduleName(mod)] = path.Join(gpuModuleSubdir, filepath.Base(mod))
+	}
+	names := make([]string, 0, len(rel))
+	for name := range rel {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(rel[name] + ":")
+		for _, dep := range gpuModuleDeps[name] {
+			if depRel, ok := rel[dep]; ok {
+				b.WriteString(" " + depRel)
+			}
+		}
+		b.WriteString("\n")
+	}
+	f, err := os.OpenFile(filepath.Join(moduleDir, "modules.dep"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write modules.dep: %w", err)
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write modules.dep: %w", err)
+	}
+	return f.Close()
+}
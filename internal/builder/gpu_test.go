@@ -0,0 +1,45 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestAppendGPUModulesDep tests registering GPU modules without depmod.
+func TestAppendGPUModulesDep(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "modules.dep"), []byte("kernel/fs/fuse/fuse.ko:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modules := []string{"/tmp/kernel/nvidia.ko", "/tmp/kernel/nvidia-uvm.ko", "/tmp/kernel/nvidia-drm.ko"}
+	if err := appendGPUModulesDep(dir, modules); err != nil {
+		t.Fatalf("appendGPUModulesDep failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "modules.dep"))
+	want := "kernel/fs/fuse/fuse.ko:\n" +
+		"kernel/drivers/video/nvidia.ko:\n" +
+		"kernel/drivers/video/nvidia-drm.ko: kernel/drivers/video/nvidia.ko\n" +
+		"kernel/drivers/video/nvidia-uvm.ko: kernel/drivers/video/nvidia.ko\n"
+	if err != nil || string(data) != want {
+		t.Errorf("modules.dep = %q, %v; want %q", data, err, want)
+	}
+}
+
+// TestGPULibraryRe tests which files are taken as driver libraries.
+func TestGPULibraryRe(t *testing.T) {
+	for name, want := range map[string]bool{
+		"libcuda.so.550.54.14":           true,
+		"libnvidia-ml.so.550.54.14":      true,
+		"libEGL_nvidia.so.550.54.14":     true,
+		"libGLESv2_nvidia.so.550.54.14":  true,
+		"libnvidia-ptxjitcompiler.so.1":  true,
+		"libc.so.6":                      false,
+		"nvidia-smi":                     false,
+		"libnvidia-ml.so.550.54.14.orig": false,
+	} {
+		if got := gpuLibraryRe.MatchString(name); got != want {
+			t.Errorf("gpuLibraryRe.MatchString(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
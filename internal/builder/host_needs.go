@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"os"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/hostcaps"
+	"github.com/volantvm/fledge/internal/vmnet"
+)
+
+// HostNeeds returns the capabilities and devices a build of cfg needs from
+// the host, so that a missing one fails the build up front by name.
+func HostNeeds(cfg *config.Config) []hostcaps.Need {
+	needs := []hostcaps.Need{
+		hostcaps.Cap(hostcaps.CapChown, "to give rootfs files their image's owners"),
+		hostcaps.Cap(hostcaps.CapFowner, "to set the modes and times of files owned by others"),
+		hostcaps.Cap(hostcaps.CapDACOverride, "to write into read-only directories of the image"),
+		hostcaps.Cap(hostcaps.CapMknod, "to create the image's device nodes"),
+	}
+	if cfg.Strategy == config.StrategyOCIRootfs && cfg.Filesystem != nil && cfg.Filesystem.Type != "squashfs" &&
+		cfg.Filesystem.Populate != config.PopulateMkfs {
+		needs = append(needs,
+			hostcaps.Cap(hostcaps.CapSysAdmin, "to mount the "+cfg.Filesystem.Type+" image"),
+			hostcaps.Device("/dev/loop-control", "to attach the image to a loop device"))
+	}
+	// A block image artifact is copied out of a read-only mount; squashfs
+	// and initramfs artifacts are unpacked
+	if strings.HasSuffix(cfg.Source.Artifact, ".img") {
+		needs = append(needs,
+			hostcaps.Cap(hostcaps.CapSysAdmin, "to mount the source artifact"),
+			hostcaps.Device("/dev/loop-control", "to attach the source artifact to a loop device"))
+	}
+	if cfg.Source.Dockerfile != "" {
+		needs = append(needs, hostcaps.Cap(hostcaps.CapSysAdmin, "to run the embedded BuildKit's mounts"))
+		// With the default executor, a host without KVM falls back to runc
+		if os.Getenv("FLEDGE_EXECUTOR") == "microvm" {
+			needs = append(needs, hostcaps.Device("/dev/kvm", "to run Dockerfile steps in microVMs"))
+		}
+		if net := networkOptions(cfg); net.Mode != vmnet.ModeUser && net.Provider != vmnet.ProviderNone {
+			needs = append(needs, hostcaps.Cap(hostcaps.CapNetAdmin, "to create tap devices for step VMs"))
+		}
+	}
+	return needs
+}
+
+// ConvertNeeds returns what converting an image of type from into fs needs
+// from the host: what packing fs needs, and mounting the input when it is a
+// block image rather than squashfs, which is unpacked.
+func ConvertNeeds(from string, fs *config.FilesystemConfig) []hostcaps.Need {
+	needs := HostNeeds(&config.Config{Strategy: config.StrategyOCIRootfs, Filesystem: fs})
+	if from != "squashfs" {
+		needs = append(needs,
+			hostcaps.Cap(hostcaps.CapSysAdmin, "to mount the "+from+" input image"),
+			hostcaps.Device("/dev/loop-control", "to attach the input image to a loop device"))
+	}
+	return needs
+}
@@ -0,0 +1,42 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestHostNeeds tests that builds only need mounts, loop devices and
+// network administration when their strategy uses them.
+func TestHostNeeds(t *testing.T) {
+	has := func(cfg *config.Config, what string) bool {
+		for _, n := range HostNeeds(cfg) {
+			if n.What == what {
+				return true
+			}
+		}
+		return false
+	}
+	squashfs := &config.Config{Strategy: config.StrategyOCIRootfs, Filesystem: &config.FilesystemConfig{Type: "squashfs"}}
+	ext4 := &config.Config{Strategy: config.StrategyOCIRootfs, Filesystem: &config.FilesystemConfig{Type: "ext4"}}
+	ext4Mkfs := &config.Config{Strategy: config.StrategyOCIRootfs, Filesystem: &config.FilesystemConfig{Type: "ext4", Populate: config.PopulateMkfs}}
+	dockerfile := &config.Config{Strategy: config.StrategyInitramfs, Source: config.SourceConfig{Dockerfile: "Dockerfile"}}
+	userNet := &config.Config{Strategy: config.StrategyInitramfs, Source: config.SourceConfig{Dockerfile: "Dockerfile"},
+		Build: &config.BuildConfig{Network: &config.BuildNetworkConfig{Mode: "user"}}}
+
+	if !has(squashfs, "CAP_CHOWN") || has(squashfs, "CAP_SYS_ADMIN") || has(squashfs, "/dev/loop-control") {
+		t.Error("Expected a squashfs build to need file ownership but no mounts")
+	}
+	if !has(ext4, "CAP_SYS_ADMIN") || !has(ext4, "/dev/loop-control") {
+		t.Error("Expected an ext4 build to need mounts and loop devices")
+	}
+	if has(ext4Mkfs, "CAP_SYS_ADMIN") || has(ext4Mkfs, "/dev/loop-control") {
+		t.Error("Expected an ext4 image populated by mkfs to need no mounts")
+	}
+	if !has(dockerfile, "CAP_SYS_ADMIN") || !has(dockerfile, "CAP_NET_ADMIN") {
+		t.Error("Expected a Dockerfile build to need mounts and tap devices")
+	}
+	if has(userNet, "CAP_NET_ADMIN") {
+		t.Error("Expected user-mode networking to need no tap devices")
+	}
+}
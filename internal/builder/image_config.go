@@ -0,0 +1,116 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// loadImageConfig reads an OCI image config JSON file written by the
+// Dockerfile builder. A missing file yields a nil config.
+func loadImageConfig(path string) (*ocispec.Image, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	var img ocispec.Image
+	if err := json.Unmarshal(data, &img); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	return &img, nil
+}
+
+// applyImageConfig returns a copy of tpl with workload, env and network
+// defaults filled in from the OCI image config. Values already set in the
+// manifest template always take precedence over the image.
+func applyImageConfig(tpl *config.ManifestTemplate, img *ocispec.Image) *config.ManifestTemplate {
+	if tpl == nil || img == nil {
+		return tpl
+	}
+	merged := *tpl
+	ic := img.Config
+
+	// ENTRYPOINT/CMD/WORKDIR/USER -> [workload]
+	workload := config.WorkloadConfig{}
+	if tpl.Workload != nil {
+		workload = *tpl.Workload
+	}
+	if workload.Entrypoint == "" {
+		argv := append(append([]string{}, ic.Entrypoint...), ic.Cmd...)
+		if len(argv) > 0 {
+			workload.Entrypoint = argv[0]
+			if len(workload.Args) == 0 && len(argv) > 1 {
+				workload.Args = argv[1:]
+			}
+		}
+	}
+	if workload.WorkDir == "" {
+		workload.WorkDir = ic.WorkingDir
+	}
+	if workload.User == "" {
+		workload.User = ic.User
+	}
+	if workload.Entrypoint != "" || workload.WorkDir != "" || workload.User != "" {
+		merged.Workload = &workload
+	}
+
+	// ENV -> [env]
+	if len(ic.Env) > 0 {
+		env := make(map[string]string, len(ic.Env)+len(tpl.Env))
+		for _, kv := range ic.Env {
+			key, value, _ := strings.Cut(kv, "=")
+			if key != "" {
+				env[key] = value
+			}
+		}
+		for k, v := range tpl.Env {
+			env[k] = v
+		}
+		merged.Env = env
+	}
+
+	// EXPOSE -> [network] expose
+	if ports := exposedPorts(ic.ExposedPorts); len(ports) > 0 {
+		if tpl.Network == nil {
+			merged.Network = &config.NetworkConfig{Mode: "bridged", Expose: ports}
+		} else if len(tpl.Network.Expose) == 0 {
+			network := *tpl.Network
+			network.Expose = ports
+			merged.Network = &network
+		}
+	}
+
+	return &merged
+}
+
+// exposedPorts converts OCI "port/proto" keys into sorted port mappings.
+func exposedPorts(exposed map[string]struct{}) []config.PortMappingConfig {
+	var ports []config.PortMappingConfig
+	for key := range exposed {
+		portStr, proto, _ := strings.Cut(key, "/")
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			continue
+		}
+		if proto == "" {
+			proto = "tcp"
+		}
+		ports = append(ports, config.PortMappingConfig{Port: port, Protocol: strings.ToLower(proto)})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return ports[i].Port < ports[j].Port
+		}
+		return ports[i].Protocol < ports[j].Protocol
+	})
+	return ports
+}
@@ -0,0 +1,122 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/volantvm/fledge/internal/config"
+)
+
+func testImage() *ocispec.Image {
+	return &ocispec.Image{
+		Config: ocispec.ImageConfig{
+			Entrypoint:   []string{"/docker-entrypoint.sh"},
+			Cmd:          []string{"nginx", "-g", "daemon off;"},
+			Env:          []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.25.3"},
+			WorkingDir:   "/usr/share/nginx",
+			User:         "101:101",
+			ExposedPorts: map[string]struct{}{"443/tcp": {}, "80/tcp": {}, "53/udp": {}},
+		},
+	}
+}
+
+// TestApplyImageConfig_FillsDefaults tests translation of an image config into an empty template.
+func TestApplyImageConfig_FillsDefaults(t *testing.T) {
+	tpl := config.DefaultManifestTemplate()
+	merged := applyImageConfig(tpl, testImage())
+
+	if merged.Workload == nil {
+		t.Fatal("Expected workload to be populated")
+	}
+	if merged.Workload.Entrypoint != "/docker-entrypoint.sh" {
+		t.Errorf("Expected entrypoint /docker-entrypoint.sh, got %q", merged.Workload.Entrypoint)
+	}
+	wantArgs := []string{"nginx", "-g", "daemon off;"}
+	if !reflect.DeepEqual(merged.Workload.Args, wantArgs) {
+		t.Errorf("Expected args %v, got %v", wantArgs, merged.Workload.Args)
+	}
+	if merged.Workload.WorkDir != "/usr/share/nginx" {
+		t.Errorf("Expected workdir /usr/share/nginx, got %q", merged.Workload.WorkDir)
+	}
+	if merged.Workload.User != "101:101" {
+		t.Errorf("Expected user 101:101, got %q", merged.Workload.User)
+	}
+	if merged.Env["NGINX_VERSION"] != "1.25.3" {
+		t.Errorf("Expected NGINX_VERSION env, got %v", merged.Env)
+	}
+
+	wantPorts := []config.PortMappingConfig{
+		{Port: 53, Protocol: "udp"},
+		{Port: 80, Protocol: "tcp"},
+		{Port: 443, Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(merged.Network.Expose, wantPorts) {
+		t.Errorf("Expected ports %v, got %v", wantPorts, merged.Network.Expose)
+	}
+	if merged.Network.Mode != "bridged" {
+		t.Errorf("Expected network mode to be kept, got %q", merged.Network.Mode)
+	}
+
+	// The original template must not be modified
+	if tpl.Workload != nil || tpl.Env != nil || len(tpl.Network.Expose) != 0 {
+		t.Errorf("Expected template to be left untouched, got %+v", tpl)
+	}
+}
+
+// TestApplyImageConfig_TemplateWins tests that manifest template values take precedence.
+func TestApplyImageConfig_TemplateWins(t *testing.T) {
+	tpl := &config.ManifestTemplate{
+		SchemaVersion: "v1",
+		Workload:      &config.WorkloadConfig{Entrypoint: "/usr/sbin/nginx"},
+		Env:           map[string]string{"NGINX_VERSION": "custom"},
+		Network: &config.NetworkConfig{
+			Mode:   "bridged",
+			Expose: []config.PortMappingConfig{{Port: 8080, Protocol: "tcp"}},
+		},
+	}
+	merged := applyImageConfig(tpl, testImage())
+
+	if merged.Workload.Entrypoint != "/usr/sbin/nginx" {
+		t.Errorf("Expected template entrypoint, got %q", merged.Workload.Entrypoint)
+	}
+	if len(merged.Workload.Args) != 0 {
+		t.Errorf("Expected no image args with a template entrypoint, got %v", merged.Workload.Args)
+	}
+	if merged.Workload.WorkDir != "/usr/share/nginx" {
+		t.Errorf("Expected workdir from image, got %q", merged.Workload.WorkDir)
+	}
+	if merged.Env["NGINX_VERSION"] != "custom" {
+		t.Errorf("Expected template env to win, got %q", merged.Env["NGINX_VERSION"])
+	}
+	if merged.Env["PATH"] != "/usr/sbin:/usr/bin" {
+		t.Errorf("Expected PATH from image, got %q", merged.Env["PATH"])
+	}
+	if len(merged.Network.Expose) != 1 || merged.Network.Expose[0].Port != 8080 {
+		t.Errorf("Expected template ports to win, got %v", merged.Network.Expose)
+	}
+}
+
+// TestApplyImageConfig_CmdOnly tests images that only define CMD.
+func TestApplyImageConfig_CmdOnly(t *testing.T) {
+	img := &ocispec.Image{Config: ocispec.ImageConfig{Cmd: []string{"/bin/sh"}}}
+	merged := applyImageConfig(&config.ManifestTemplate{SchemaVersion: "v1"}, img)
+
+	if merged.Workload == nil || merged.Workload.Entrypoint != "/bin/sh" {
+		t.Fatalf("Expected entrypoint /bin/sh, got %+v", merged.Workload)
+	}
+	if len(merged.Workload.Args) != 0 {
+		t.Errorf("Expected no args, got %v", merged.Workload.Args)
+	}
+	if merged.Network != nil {
+		t.Errorf("Expected no network section without exposed ports, got %+v", merged.Network)
+	}
+}
+
+// TestApplyImageConfig_Nil tests that a missing image config leaves the template as-is.
+func TestApplyImageConfig_Nil(t *testing.T) {
+	tpl := config.DefaultManifestTemplate()
+	if got := applyImageConfig(tpl, nil); got != tpl {
+		t.Errorf("Expected template to be returned unchanged")
+	}
+}
@@ -0,0 +1,78 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/report"
+	"github.com/volantvm/fledge/internal/retry"
+)
+
+// imageExport is the container image a Dockerfile build writes alongside the
+// rootfs, as requested by source.export_image and source.push_image.
+type imageExport struct {
+	// TarPath receives the OCI image tarball; empty when no image is wanted.
+	TarPath string
+	push    string
+	temp    bool
+}
+
+// newImageExport returns the image export src asks for, with a relative
+// export_image resolved against workDir. Pushing without export_image
+// writes the tarball to a temporary file.
+func newImageExport(src config.SourceConfig, workDir string) (*imageExport, error) {
+	e := &imageExport{TarPath: src.ExportImage, push: src.PushImage}
+	if e.TarPath != "" && !filepath.IsAbs(e.TarPath) {
+		e.TarPath = filepath.Join(workDir, e.TarPath)
+	}
+	if e.TarPath == "" && e.push != "" {
+		f, err := os.CreateTemp("", "fledge-image-*.tar")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create image tarball: %w", err)
+		}
+		f.Close()
+		e.TarPath, e.temp = f.Name(), true
+	} else if e.TarPath != "" {
+		if err := os.MkdirAll(filepath.Dir(e.TarPath), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create image tarball directory: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// Finish pushes the exported image when requested. It must be called after
+// a successful build.
+func (e *imageExport) Finish(ctx context.Context) error {
+	if e.TarPath == "" {
+		return nil
+	}
+	if !e.temp {
+		logging.InfoContext(ctx, "Exported container image", "path", e.TarPath)
+	}
+	if e.push == "" {
+		return nil
+	}
+	logging.InfoContext(ctx, "Pushing container image", "ref", e.push)
+	if rep := report.FromContext(ctx); rep != nil {
+		rep.UseTool("skopeo")
+	}
+	return retry.FromContext(ctx).Network.Do(ctx, "skopeo copy "+e.push, func(ctx context.Context) error {
+		output, err := exec.CommandContext(ctx, "skopeo", "copy", "oci-archive:"+e.TarPath, "docker://"+e.push).CombinedOutput()
+		if err != nil {
+			return classifySkopeo(fmt.Errorf("failed to push %s: %w\nOutput: %s", e.push, err, string(output)), output)
+		}
+		return nil
+	})
+}
+
+// Cleanup removes a tarball that was only written for pushing.
+func (e *imageExport) Cleanup() {
+	if e.temp {
+		os.Remove(e.TarPath)
+	}
+}
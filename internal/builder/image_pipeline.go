@@ -0,0 +1,662 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/ledger"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/loopdev"
+	"github.com/volantvm/fledge/internal/progress"
+)
+
+// buildStep is a named step of a build pipeline.
+type buildStep struct {
+	name string
+	fn   func() error
+}
+
+// imagePipeline packages the assembled rootfs into the filesystem image at
+// ImagePath. Each filesystem type family has its own, so a squashfs build
+// never touches loop devices or mounts.
+type imagePipeline interface {
+	// steps returns the packaging steps, run after the rootfs is assembled.
+	steps() []buildStep
+	// release frees what the steps acquired; it runs after a failure too.
+	release()
+}
+
+// newImagePipeline returns the pipeline for b's filesystem type.
+func newImagePipeline(b *OCIRootfsBuilder) imagePipeline {
+	if b.Config.Filesystem.Type == "squashfs" {
+		return &squashfsPipeline{OCIRootfsBuilder: b}
+	}
+	block := &blockImagePipeline{OCIRootfsBuilder: b, mountPoint: filepath.Join(b.TempDir, "mnt")}
+	if b.Config.Filesystem.Populate == config.PopulateMkfs {
+		return &mkfsImagePipeline{blockImagePipeline: block}
+	}
+	return block
+}
+
+// squashfsPipeline compresses the rootfs directory with mksquashfs, which
+// needs neither loop devices nor mounts.
+type squashfsPipeline struct {
+	*OCIRootfsBuilder
+}
+
+func (b *squashfsPipeline) steps() []buildStep {
+	return []buildStep{
+		{"Create squashfs image", b.createSquashfs},
+	}
+}
+
+func (b *squashfsPipeline) release() {}
+
+// createSquashfs creates a squashfs compressed read-only filesystem.
+func (b *squashfsPipeline) createSquashfs() error {
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+
+	// Verify rootfs exists
+	if _, err := os.Stat(rootfsPath); err != nil {
+		return fmt.Errorf("rootfs directory does not exist: %w", err)
+	}
+
+	compressionLevel := b.Config.Filesystem.CompressionLevel
+	if compressionLevel == 0 {
+		compressionLevel = 15 // default
+	}
+
+	logging.InfoContext(b.stepContext(), "Creating squashfs image", "compression_level", compressionLevel)
+	rootfsSize := b.measureRootfs()
+	if err := checkSpace(b.imageNeeds(rootfsSize / squashfsRatio)...); err != nil {
+		return err
+	}
+
+	// Build mksquashfs command
+	// Note: xz compression uses -Xdict-size instead of -Xcompression-level
+	// Dictionary size affects compression ratio (higher = better compression but more RAM)
+	// Map compression level to dictionary size:
+	// Low (1-7): 25% (fast, lower compression)
+	// Medium (8-15): 50% (balanced, default)
+	// High (16-22): 100% (best compression, more RAM)
+	var dictSize string
+	switch {
+	case compressionLevel <= 7:
+		dictSize = "25%"
+	case compressionLevel <= 15:
+		dictSize = "50%"
+	default:
+		dictSize = "100%"
+	}
+
+	args := []string{
+		rootfsPath,
+		b.ImagePath,
+		"-comp", "xz", // xz compression (best for size)
+		"-Xdict-size", dictSize, // dictionary size for xz
+		"-noappend",    // don't append to existing image
+		"-no-progress", // disable progress bar
+	}
+
+	b.Report.UseTool("mksquashfs")
+	if _, err := b.runTool(b.ImagePath, "mksquashfs", args...); err != nil {
+		return fmt.Errorf("mksquashfs failed: %w", err)
+	}
+
+	// Get final size
+	info, err := os.Stat(b.ImagePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat squashfs image: %w", err)
+	}
+
+	sizeMB := float64(info.Size()) / (1024 * 1024)
+	logging.InfoContext(b.stepContext(), "Squashfs image created", "size_mb", fmt.Sprintf("%.2f", sizeMB))
+
+	return nil
+}
+
+// blockImagePipeline creates an ext4, xfs or btrfs image, mounts it on a
+// loop device, copies the rootfs in and shrinks it to fit.
+type blockImagePipeline struct {
+	*OCIRootfsBuilder
+	mountPoint string
+	loopDevice string
+	mounted    bool
+}
+
+func (b *blockImagePipeline) steps() []buildStep {
+	return []buildStep{
+		{"Calculate disk size", b.createImageFile},
+		{"Create filesystem", b.createFilesystem},
+		{"Mount image", b.mountImage},
+		{"Copy rootfs to image", b.copyRootfsToImage},
+		{"Unmount image", b.unmountImage},
+		{"Shrink to optimal size", b.shrinkFilesystem},
+	}
+}
+
+// release unmounts the image and detaches its loop device if a step
+// failed while they were in use.
+func (b *blockImagePipeline) release() {
+	b.unmountImage()
+}
+
+// createImageFile calculates disk size and creates the image file.
+func (b *blockImagePipeline) createImageFile() error {
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+	b.measureRootfs()
+
+	// Calculate rootfs size
+	output, err := b.runTool("", "du", "-sk", rootfsPath)
+	if err != nil {
+		return fmt.Errorf("failed to calculate rootfs size: %w", err)
+	}
+
+	parts := strings.Fields(string(output))
+	if len(parts) < 1 {
+		return fmt.Errorf("failed to parse du output: %q", string(output))
+	}
+
+	sizeKB, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse size %q: %w", parts[0], err)
+	}
+
+	// Determine buffer (tiered if SizeBufferMB == 0)
+	bufferMB := b.computeBufferMB(sizeKB)
+	bufferKB := bufferMB * 1024
+	totalSizeKB := sizeKB + bufferKB
+	totalSizeBytes := totalSizeKB * 1024
+
+	logging.InfoContext(b.stepContext(), "Calculated image size",
+		"rootfs_kb", sizeKB,
+		"buffer_kb", bufferKB,
+		"total_kb", totalSizeKB)
+	b.Report.RecordSize("image_allocated", int64(totalSizeBytes))
+	if err := checkSpace(b.imageNeeds(int64(totalSizeBytes))...); err != nil {
+		return err
+	}
+
+	// Create image file
+	if b.Config.Filesystem.Preallocate {
+		// Use fallocate for preallocated space
+		cmd := exec.CommandContext(b.stepContext(), "fallocate", "-l", strconv.Itoa(totalSizeBytes), b.ImagePath)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("fallocate failed: %w\nOutput: %s", err, string(output))
+		}
+	} else {
+		// Use sparse allocation with dd
+		cmd := exec.CommandContext(b.stepContext(), "dd", "if=/dev/zero", "of="+b.ImagePath,
+			"bs=1K", "count=0", "seek="+strconv.Itoa(totalSizeKB))
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("dd failed: %w\nOutput: %s", err, string(output))
+		}
+	}
+
+	logging.DebugContext(b.stepContext(), "Image file created", "path", b.ImagePath)
+	return nil
+}
+
+// computeBufferMB returns the buffer size in MB based on config and rootfs size.
+// If SizeBufferMB > 0, that explicit value is used. Otherwise uses a percentage-based
+// approach: 25% of rootfs size, with minimum 64MB (for kestrel bootstrap) and maximum 1GB.
+func (b *blockImagePipeline) computeBufferMB(rootfsKB int) int {
+	if b.Config != nil && b.Config.Filesystem != nil && b.Config.Filesystem.SizeBufferMB > 0 {
+		return b.Config.Filesystem.SizeBufferMB
+	}
+
+	sizeMB := rootfsKB / 1024
+
+	// Use 25% of rootfs size as buffer
+	bufferMB := sizeMB / 4
+
+	// Enforce minimum 64MB (needed for kestrel bootstrap and system operations)
+	const minBufferMB = 64
+	if bufferMB < minBufferMB {
+		bufferMB = minBufferMB
+	}
+
+	// Enforce maximum 1GB (reasonable upper bound)
+	const maxBufferMB = 1024
+	if bufferMB > maxBufferMB {
+		bufferMB = maxBufferMB
+	}
+
+	return bufferMB
+}
+
+// createFilesystem creates the filesystem on the image file.
+func (b *blockImagePipeline) createFilesystem() error {
+	fsType := b.Config.Filesystem.Type
+	mkfsCmd := "mkfs." + fsType
+
+	// Type-specific flags
+	args := []string{}
+	switch fsType {
+	case "ext4":
+		args = append(args, "-F")
+	case "xfs":
+		args = append(args, "-f")
+	case "btrfs":
+		args = append(args, "-f")
+	}
+	args = append(args, b.ImagePath)
+
+	b.Report.UseTool(mkfsCmd)
+	cmd := exec.CommandContext(b.stepContext(), mkfsCmd, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w\nOutput: %s", mkfsCmd, err, string(output))
+	}
+
+	logging.DebugContext(b.stepContext(), "Filesystem created", "type", fsType)
+	return nil
+}
+
+// mountImage attaches the image to a loop device and mounts it.
+func (b *blockImagePipeline) mountImage() error {
+	if err := os.MkdirAll(b.mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", b.mountPoint, err)
+	}
+	if b.Privileged != nil {
+		device, err := b.Privileged.Attach(b.ImagePath)
+		if err != nil {
+			return err
+		}
+		b.loopDevice = device
+		if err := b.Privileged.Mount(device, b.mountPoint, b.Config.Filesystem.Type); err != nil {
+			return err
+		}
+		b.mounted = true
+		return nil
+	}
+
+	// Find and attach loop device
+	device, err := loopdev.Attach(b.ImagePath, false)
+	if err != nil {
+		return err
+	}
+	b.loopDevice = device
+	ledger.Record(ledger.KindLoop, device, b.ImagePath)
+
+	logging.DebugContext(b.stepContext(), "Attached to loop device", "device", b.loopDevice)
+
+	// Mount the loop device
+	if err := loopdev.Mount(b.loopDevice, b.mountPoint, b.Config.Filesystem.Type, false); err != nil {
+		return err
+	}
+	b.mounted = true
+	ledger.Record(ledger.KindMount, b.mountPoint, device)
+
+	logging.DebugContext(b.stepContext(), "Image mounted", "mount_point", b.mountPoint)
+	return nil
+}
+
+// copyRootfsToImage copies the unpacked rootfs to the mounted image with progress.
+func (b *blockImagePipeline) copyRootfsToImage() error {
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+	if b.Privileged != nil {
+		// The rootfs now belongs to root; cp -a keeps owners, modes,
+		// device nodes and hardlinks
+		b.Report.UseTool("cp")
+		_, err := b.Privileged.Run("cp", []string{"-a", rootfsPath + "/.", b.mountPoint}, "")
+		return err
+	}
+
+	// Calculate total size for progress bar
+	var totalSize int64
+	err := filepath.WalkDir(rootfsPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			totalSize += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to calculate total size: %w", err)
+	}
+
+	// Create progress bar
+	bar := progressbar.NewOptions64(totalSize,
+		progressbar.OptionSetDescription("Copying files"),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetWidth(15),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetVisibility(progress.Bars()),
+	)
+
+	// Directory ownership/modes are applied once all children have been written
+	type dirEntry struct {
+		src  string
+		path string
+		info os.FileInfo
+	}
+	var dirs []dirEntry
+
+	// Walk and copy files
+	ctx := b.stepContext()
+	err = filepath.WalkDir(rootfsPath, func(srcPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Get relative path
+		relPath, err := filepath.Rel(rootfsPath, srcPath)
+		if err != nil {
+			return err
+		}
+
+		destPath := filepath.Join(b.mountPoint, relPath)
+
+		// Get file info
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to get info for %s: %w", srcPath, err)
+		}
+
+		if info.IsDir() {
+			if err := os.MkdirAll(destPath, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirEntry{src: srcPath, path: destPath, info: info})
+			return nil
+		}
+
+		// Handle symlinks
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", srcPath, err)
+			}
+			if err := os.Symlink(target, destPath); err != nil {
+				return err
+			}
+			return b.preserveMetadata(srcPath, destPath, info)
+		}
+
+		// Copy regular file
+		srcFile, err := os.Open(srcPath)
+		if err != nil {
+			return fmt.Errorf("failed to open source %s: %w", srcPath, err)
+		}
+		defer srcFile.Close()
+
+		destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return fmt.Errorf("failed to create destination %s: %w", destPath, err)
+		}
+		defer destFile.Close()
+
+		// Copy with progress
+		writer := io.MultiWriter(destFile, bar)
+		if _, err := io.Copy(writer, srcFile); err != nil {
+			return err
+		}
+		return b.preserveMetadata(srcPath, destPath, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := b.preserveMetadata(dirs[i].src, dirs[i].path, dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preserveMetadata applies the ownership and mode of the rootfs file src to
+// its copy dst in the image, and its SELinux label when [selinux] is set.
+func (b *blockImagePipeline) preserveMetadata(src, dst string, info os.FileInfo) error {
+	if err := preserveOwnership(dst, info); err != nil {
+		return err
+	}
+	if b.Config.SELinux == nil {
+		return nil
+	}
+	return copyXattr(src, dst, selinuxLabelXattr)
+}
+
+// unmountImage unmounts the image and detaches the loop device.
+func (b *blockImagePipeline) unmountImage() error {
+	if b.Privileged != nil {
+		return b.unmountPrivileged()
+	}
+
+	// Unmount
+	if b.mounted {
+		if err := loopdev.Unmount(b.mountPoint); err != nil {
+			logging.WarnClassContext(b.stepContext(), logging.WarnCleanup, "Failed to unmount", "mount_point", b.mountPoint, "error", err)
+		} else {
+			ledger.Release(ledger.KindMount, b.mountPoint)
+		}
+		b.mounted = false
+	}
+
+	// Detach loop device
+	if b.loopDevice != "" {
+		if err := loopdev.Detach(b.loopDevice); err != nil {
+			logging.WarnClassContext(b.stepContext(), logging.WarnCleanup, "Failed to detach loop device", "device", b.loopDevice, "error", err)
+		} else {
+			ledger.Release(ledger.KindLoop, b.loopDevice)
+		}
+		b.loopDevice = ""
+	}
+
+	return nil
+}
+
+// unmountPrivileged unmounts the image and detaches the loop device through
+// the privileged helper, which keeps the ledger.
+func (b *blockImagePipeline) unmountPrivileged() error {
+	if b.mounted {
+		if err := b.Privileged.Unmount(b.mountPoint); err != nil {
+			logging.WarnClassContext(b.stepContext(), logging.WarnCleanup, "Failed to unmount", "mount_point", b.mountPoint, "error", err)
+		}
+		b.mounted = false
+	}
+	if b.loopDevice != "" {
+		if err := b.Privileged.Detach(b.loopDevice); err != nil {
+			logging.WarnClassContext(b.stepContext(), logging.WarnCleanup, "Failed to detach loop device", "device", b.loopDevice, "error", err)
+		}
+		b.loopDevice = ""
+	}
+	return nil
+}
+
+// shrinkFilesystem shrinks the filesystem to optimal size (ext4 only).
+func (b *blockImagePipeline) shrinkFilesystem() error {
+	// Only ext4 supports shrinking
+	if b.Config.Filesystem.Type != "ext4" {
+		logging.DebugContext(b.stepContext(), "Skipping shrink for non-ext4 filesystem")
+		return nil
+	}
+
+	logging.InfoContext(b.stepContext(), "Shrinking filesystem while preserving free space buffer")
+
+	// Run e2fsck before any resize operations
+	b.Report.UseTool("e2fsck")
+	b.Report.UseTool("resize2fs")
+	cmd := exec.CommandContext(b.stepContext(), "e2fsck", "-f", "-y", b.ImagePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		// e2fsck may return non-zero even if it fixed issues; log and continue
+		logging.DebugContext(b.stepContext(), "e2fsck completed with non-zero exit", "output", string(output))
+	}
+
+	// Get current block count and block size
+	cmd = exec.CommandContext(b.stepContext(), "dumpe2fs", "-h", b.ImagePath)
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("dumpe2fs failed: %w", err)
+	}
+
+	var curBlocks, blockSize int64
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Block count:") {
+			fmt.Sscanf(line, "Block count: %d", &curBlocks)
+		} else if strings.HasPrefix(line, "Block size:") {
+			fmt.Sscanf(line, "Block size: %d", &blockSize)
+		}
+	}
+	if curBlocks == 0 || blockSize == 0 {
+		return fmt.Errorf("failed to parse current filesystem size from dumpe2fs")
+	}
+
+	// Query minimal required size in blocks
+	cmd = exec.CommandContext(b.stepContext(), "resize2fs", "-P", b.ImagePath)
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resize2fs -P failed: %w\nOutput: %s", err, string(output))
+	}
+
+	var minBlocks int64
+	// Expected line: "Estimated minimum size of the filesystem: N"
+	sc := bufio.NewScanner(strings.NewReader(string(output)))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "Estimated minimum size of the filesystem:") {
+			// Parse last field as the block count
+			fields := strings.Fields(line)
+			if len(fields) > 0 {
+				// last token should be N
+				fmt.Sscanf(fields[len(fields)-1], "%d", &minBlocks)
+			}
+		}
+	}
+	if minBlocks == 0 {
+		return fmt.Errorf("failed to parse minimum block count from resize2fs -P output: %q", string(output))
+	}
+
+	// Recalculate rootfs size to apply the same tiered buffer policy used at allocation time
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+	duOut, duErr := b.runTool("", "du", "-sk", rootfsPath)
+	var rootfsKB int
+	if duErr == nil {
+		parts := strings.Fields(string(duOut))
+		if len(parts) >= 1 {
+			if v, err := strconv.Atoi(parts[0]); err == nil {
+				rootfsKB = v
+			}
+		}
+	}
+	// Fallback if du failed
+	if rootfsKB == 0 {
+		// Use minimal blocks as approximation
+		rootfsKB = int(minBlocks * (blockSize / 1024))
+	}
+
+	// Compute buffer in blocks from tiered or explicit buffer MB
+	bufferMB := b.computeBufferMB(rootfsKB)
+	bufBlocks := int64(bufferMB) * 1024 * 1024 / blockSize
+	// Ensure at least 1 block buffer to avoid zero-free-space images
+	if bufBlocks < 1 {
+		bufBlocks = 1
+	}
+
+	// Desired final size: minimal + buffer, but never larger than current size
+	desiredBlocks := minBlocks + bufBlocks
+	if desiredBlocks > curBlocks {
+		desiredBlocks = curBlocks
+	}
+
+	// Only resize if it actually changes the size
+	if desiredBlocks < curBlocks {
+		// Shrink to desired size in filesystem blocks
+		cmd = exec.CommandContext(b.stepContext(), "resize2fs", b.ImagePath, strconv.FormatInt(desiredBlocks, 10))
+		if output, err = cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("resize2fs to target size failed: %w\nOutput: %s", err, string(output))
+		}
+	}
+
+	// Truncate backing file to match filesystem size
+	fsSize := desiredBlocks * blockSize
+	if err := os.Truncate(b.ImagePath, fsSize); err != nil {
+		return fmt.Errorf("failed to truncate image: %w", err)
+	}
+
+	sizeMB := float64(fsSize) / (1024 * 1024)
+	logging.InfoContext(b.stepContext(), "Filesystem resized", "final_size_mb", fmt.Sprintf("%.2f", sizeMB), "free_buffer_mb", b.Config.Filesystem.SizeBufferMB)
+
+	return nil
+}
+
+// mkfsImagePipeline has mkfs copy the rootfs directory into a new ext4 or
+// btrfs image itself, so the image is never mounted and needs neither loop
+// devices nor CAP_SYS_ADMIN.
+type mkfsImagePipeline struct {
+	*blockImagePipeline
+}
+
+func (b *mkfsImagePipeline) steps() []buildStep {
+	return []buildStep{
+		{"Calculate disk size", b.createImageFile},
+		{"Create filesystem from rootfs", b.populateFilesystem},
+		{"Shrink to optimal size", b.shrinkFilesystem},
+	}
+}
+
+func (b *mkfsImagePipeline) release() {}
+
+// populateFilesystem creates the filesystem on the image file with the
+// rootfs copied in, keeping owners, modes, device nodes, hardlinks and
+// extended attributes (and so SELinux labels).
+func (b *mkfsImagePipeline) populateFilesystem() error {
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+	fsType := b.Config.Filesystem.Type
+
+	name, args, err := mkfsPopulateArgs(fsType, rootfsPath, b.ImagePath)
+	if err != nil {
+		return err
+	}
+	b.Report.UseTool(name)
+	// Under --drop-privileges the rootfs belongs to root by now, so mkfs
+	// runs in the helper to read it
+	if _, err := b.runTool(b.ImagePath, name, args...); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+
+	logging.DebugContext(b.stepContext(), "Filesystem created from rootfs", "type", fsType)
+	return nil
+}
+
+// mkfsPopulateArgs returns the mkfs command that creates a filesystem of
+// fsType on image holding the contents of dir. The image keeps its size,
+// and every argument but the flags is a path, as the privileged helper
+// requires.
+func mkfsPopulateArgs(fsType, dir, image string) (string, []string, error) {
+	switch fsType {
+	case "ext4":
+		// -d needs e2fsprogs 1.43 or newer
+		return "mkfs.ext4", []string{"-F", "-d", dir, image}, nil
+	case "btrfs":
+		return "mkfs.btrfs", []string{"-f", "--rootdir=" + dir, image}, nil
+	}
+	return "", nil, fmt.Errorf("%s images cannot be populated by mkfs; set filesystem.populate = \"mount\"", fsType)
+}
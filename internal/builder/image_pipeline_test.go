@@ -0,0 +1,68 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestNewImagePipeline tests that each filesystem type and populate mode
+// gets its own packaging pipeline.
+func TestNewImagePipeline(t *testing.T) {
+	for _, tc := range []struct {
+		fsType, populate, want string
+	}{
+		{"squashfs", "", "*builder.squashfsPipeline"},
+		{"ext4", config.PopulateMkfs, "*builder.mkfsImagePipeline"},
+		{"ext4", config.PopulateMount, "*builder.blockImagePipeline"},
+		{"btrfs", config.PopulateMkfs, "*builder.mkfsImagePipeline"},
+		{"xfs", config.PopulateMount, "*builder.blockImagePipeline"},
+	} {
+		b := &OCIRootfsBuilder{Config: &config.Config{Filesystem: &config.FilesystemConfig{Type: tc.fsType, Populate: tc.populate}}}
+		if got := fmt.Sprintf("%T", newImagePipeline(b)); got != tc.want {
+			t.Errorf("Expected %s for %s populated by %q, got %s", tc.want, tc.fsType, tc.populate, got)
+		}
+	}
+
+	if _, _, err := mkfsPopulateArgs("xfs", "rootfs", "rootfs.img"); err == nil {
+		t.Error("Expected xfs to be refused for populating by mkfs")
+	}
+}
+
+// TestMkfsImagePipeline tests creating an ext4 image from the rootfs
+// directory without mounting it.
+func TestMkfsImagePipeline(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not installed")
+	}
+	dir := t.TempDir()
+	rootfs := filepath.Join(dir, "unpacked", "rootfs")
+	os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+	os.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("fledge\n"), 0644)
+
+	b := &OCIRootfsBuilder{
+		Config:       &config.Config{Filesystem: &config.FilesystemConfig{Type: "ext4", Populate: config.PopulateMkfs, SizeBufferMB: 8}},
+		UnpackedPath: filepath.Join(dir, "unpacked"),
+		ImagePath:    filepath.Join(dir, "rootfs.img"),
+	}
+	pipeline := newImagePipeline(b)
+	defer pipeline.release()
+	for _, step := range pipeline.steps() {
+		if err := step.fn(); err != nil {
+			t.Fatalf("%s failed: %v", step.name, err)
+		}
+	}
+
+	out, err := exec.Command("debugfs", "-R", "cat /etc/hostname", b.ImagePath).Output()
+	if err != nil {
+		t.Skipf("debugfs not usable: %v", err)
+	}
+	if !strings.Contains(string(out), "fledge") {
+		t.Errorf("Expected the image to hold the rootfs, got %q", out)
+	}
+}
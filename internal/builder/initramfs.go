@@ -14,9 +14,20 @@ import (
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/gzip"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/schollz/progressbar/v3"
 	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
 	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/oci"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/report"
+	"github.com/volantvm/fledge/internal/retry"
+	"github.com/volantvm/fledge/internal/telemetry"
 	"github.com/volantvm/fledge/internal/utils"
+	"github.com/volantvm/fledge/internal/vmnet"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 //go:embed embed/init.c
@@ -36,6 +47,39 @@ type InitramfsBuilder struct {
 	OutputPath       string
 	EphemeralTag     string
 	BusyboxLocalPath string
+	ImageConfig      *ocispec.Image
+	// TempRoot is where the build's temporary files are created; empty
+	// uses TMPDIR.
+	TempRoot string
+	// Lock records resolved remote inputs and, in locked mode, checks them.
+	Lock  *lock.Tracker
+	Agent *ResolvedAgent
+	// Report collects step timings and statistics; nil disables reporting.
+	Report *report.Report
+	// TrackSizes attributes the rootfs to the steps that wrote it; the
+	// result is stored in SizeBreakdown and the report.
+	TrackSizes    bool
+	SizeBreakdown *report.SizeBreakdown
+	sizes         *sizeTracker
+	kernel        *guestKernel
+	// CopyDeps copies shared libraries that mapped executables need from
+	// the host instead of only warning that they are missing.
+	CopyDeps bool
+	// SkipVerify skips the consistency check of the finished archive.
+	SkipVerify bool
+	// checksum is the SHA256 of the verified archive.
+	checksum string
+	// Checksums lists the algorithms <output>.<algorithm> checksum files
+	// are written for.
+	Checksums []string
+	// SBOM writes an SPDX document of the artifact and its resolved inputs
+	// to <output>.spdx.json.
+	SBOM bool
+	// OnStep, if set, is called as each build step starts and finishes.
+	OnStep func(StepEvent)
+
+	// ctx is the context of the running build step.
+	ctx context.Context
 }
 
 // NewInitramfsBuilder creates a new initramfs builder.
@@ -50,132 +94,329 @@ func NewInitramfsBuilder(cfg *config.Config, manifestTpl *config.ManifestTemplat
 
 // Build creates the initramfs archive.
 func (b *InitramfsBuilder) Build() error {
-	logging.Info("Building initramfs", "output", b.OutputPath)
+	return b.BuildContext(context.Background())
+}
+
+// Checksum returns the SHA256 of the finished archive, once the build
+// succeeded.
+func (b *InitramfsBuilder) Checksum() string {
+	return b.checksum
+}
+
+// BuildContext is like Build but traces the build and each step as spans
+// under ctx.
+func (b *InitramfsBuilder) BuildContext(ctx context.Context) (err error) {
+	ctx, span := telemetry.Start(ctx, "fledge.build",
+		attribute.String("fledge.strategy", config.StrategyInitramfs))
+	defer func() { telemetry.End(span, err) }()
+	ctx = report.NewContext(ctx, b.Report)
+	ctx = retry.NewContext(ctx, retryPolicies(b.Config))
+	ctx = vmnet.NewContext(ctx, networkOptions(b.Config))
+	ctx = logging.NewContext(ctx, logging.KeyStrategy, config.StrategyInitramfs)
+	b.ctx = ctx
+
+	logging.InfoContext(b.stepContext(), "Building initramfs", "output", b.OutputPath)
 
 	// Create temporary directory for rootfs
-	tmpDir, err := os.MkdirTemp("", "fledge-initramfs-*")
+	tmpDir, err := os.MkdirTemp(b.TempRoot, "fledge-initramfs-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
 	b.RootfsDir = tmpDir
-	logging.Debug("Created rootfs directory", "path", b.RootfsDir)
+	logging.DebugContext(b.stepContext(), "Created rootfs directory", "path", b.RootfsDir)
+
+	if err := checkSpace(b.preflightNeeds()...); err != nil {
+		return err
+	}
+
+	b.kernel = newGuestKernel(b.Config.Kernel, b.WorkDir, b.Lock)
+	defer b.kernel.cleanup()
+
+	if b.TrackSizes {
+		b.sizes = newSizeTracker()
+	}
 
 	// Build steps
-	if err := b.setupDirectoryStructure(); err != nil {
+	if err := b.runStep(ctx, "Set up directory structure", b.setupDirectoryStructure); err != nil {
 		return fmt.Errorf("failed to setup directory structure: %w", err)
 	}
 
 	// Install kernel modules for squashfs and overlay
-	if err := b.installKernelModules(); err != nil {
-		logging.Warn("Failed to install kernel modules (they may be built-in to kernel)", "error", err)
+	if err := b.runStep(ctx, "Install kernel modules", b.installKernelModules); err != nil {
+		logging.WarnClassContext(b.stepContext(), logging.WarnKernelModules, "Failed to install kernel modules (they may be built-in to kernel)", "error", err)
 	}
 
 	// 1) Overlay Docker rootfs if provided (Dockerfile/image)
-	if err := b.overlayDockerRootfsIfProvided(); err != nil {
+	if err := b.runStep(ctx, "Overlay image rootfs", b.overlayDockerRootfsIfProvided); err != nil {
 		return fmt.Errorf("failed to overlay docker rootfs: %w", err)
 	}
 
-	if err := b.installBusybox(); err != nil {
-		return fmt.Errorf("failed to install busybox: %w", err)
+	// Merge additional [[source.layers]] images on top, in order
+	if err := b.runStep(ctx, "Merge source layers", func() error {
+		return mergeSourceLayers(b.stepContext(), b.Config.Source, b.RootfsDir, b.Lock)
+	}); err != nil {
+		return fmt.Errorf("failed to merge source layers: %w", err)
+	}
+
+	if err := b.runStep(ctx, "Install userland", b.installUserland); err != nil {
+		return fmt.Errorf("failed to install userland: %w", err)
 	}
 
-	// Determine init mode and handle accordingly (after busybox is present)
+	// Determine init mode and handle accordingly (after the userland is present)
 	initMode := b.getInitMode()
-	logging.Info("Init mode detected", "mode", initMode)
+	logging.InfoContext(b.stepContext(), "Init mode detected", "mode", initMode)
 
 	switch initMode {
 	case "default":
 		// Mode 1: C init + Kestrel (batteries-included)
-		if err := b.compileInit(); err != nil {
+		if err := b.runStep(ctx, "Compile init", b.compileInit); err != nil {
 			return fmt.Errorf("failed to compile init: %w", err)
 		}
-		if err := b.installAgent(); err != nil {
+		if err := b.runStep(ctx, "Install kestrel agent", b.installAgent); err != nil {
 			return fmt.Errorf("failed to install agent: %w", err)
 		}
 
 	case "custom":
 		// Mode 2: User's custom init binary as PID 1
-		if err := b.installCustomInit(); err != nil {
+		if err := b.runStep(ctx, "Install custom init", b.installCustomInit); err != nil {
 			return fmt.Errorf("failed to install custom init: %w", err)
 		}
-		logging.Info("Custom init configured", "path", b.Config.Init.Path)
+		logging.InfoContext(b.stepContext(), "Custom init configured", "path", b.Config.Init.Path)
 
 	case "none":
 		// Mode 3: No init wrapper - user must provide init via mappings
-		logging.Info("No init wrapper - user must provide init via mappings")
+		logging.InfoContext(b.stepContext(), "No init wrapper - user must provide init via mappings")
 		// Skip compileInit() and installAgent()
 	}
 
-	if err := b.applyMappings(); err != nil {
+	if err := b.runStep(ctx, "Apply file mappings", b.applyMappings); err != nil {
 		return fmt.Errorf("failed to apply file mappings: %w", err)
 	}
 
-	if err := b.normalizeTimestamps(); err != nil {
+	if err := b.runStep(ctx, "Create users and groups", func() error {
+		return applyAccounts(b.stepContext(), b.Config, b.RootfsDir)
+	}); err != nil {
+		return fmt.Errorf("failed to create users and groups: %w", err)
+	}
+
+	if err := b.runStep(ctx, "Apply system configuration", func() error {
+		return applySystemConfig(b.stepContext(), b.Config.System, b.RootfsDir, b.kernel)
+	}); err != nil {
+		return fmt.Errorf("failed to apply system configuration: %w", err)
+	}
+
+	if err := b.runStep(ctx, "Install GPU driver", func() error {
+		return applyGPUDriver(b.stepContext(), b.Config, b.WorkDir, b.RootfsDir, b.kernel, b.Lock)
+	}); err != nil {
+		return fmt.Errorf("failed to install GPU driver: %w", err)
+	}
+
+	if err := b.runStep(ctx, "Check shared library dependencies", func() error {
+		return checkMappedLibraries(b.stepContext(), b.Config, b.RootfsDir, b.CopyDeps || b.Config.Binary != nil)
+	}); err != nil {
+		return fmt.Errorf("failed to check shared library dependencies: %w", err)
+	}
+	if b.sizes != nil {
+		b.SizeBreakdown = b.sizes.breakdown()
+		b.Report.RecordSizeBreakdown(b.SizeBreakdown)
+	}
+
+	if err := b.runStep(ctx, "Normalize timestamps", b.normalizeTimestamps); err != nil {
 		return fmt.Errorf("failed to normalize timestamps: %w", err)
 	}
 
-	if err := b.createArchive(); err != nil {
+	if err := b.runStep(ctx, "Create archive", b.createArchive); err != nil {
 		return fmt.Errorf("failed to create archive: %w", err)
 	}
 
+	if err := b.runStep(ctx, "Check size budget", func() error {
+		return checkSizeBudget(b.stepContext(), b.Config.Limits, "max_initramfs_mb", b.OutputPath, b.RootfsDir)
+	}); err != nil {
+		os.Remove(b.OutputPath)
+		return fmt.Errorf("initramfs exceeds its size budget: %w", err)
+	}
+
+	if !b.SkipVerify {
+		if err := b.runStep(ctx, "Verify archive", func() error {
+			checksum, err := verifyInitramfs(b.stepContext(), b.OutputPath)
+			if err != nil {
+				return err
+			}
+			b.checksum = checksum
+			b.Report.RecordChecksum(checksum)
+			return nil
+		}); err != nil {
+			os.Remove(b.OutputPath)
+			return fmt.Errorf("initramfs failed verification: %w", err)
+		}
+	}
+
 	// Generate manifest.json
-	if err := b.generateManifest(); err != nil {
+	if err := b.runStep(ctx, "Generate manifest", b.generateManifest); err != nil {
 		return fmt.Errorf("failed to generate manifest: %w", err)
 	}
+	if processors := buildPostProcessors(b.Config); len(processors) > 0 {
+		if err := b.runStep(ctx, "Post-process artifact", func() error {
+			checksum, err := postProcess(b.stepContext(), processors, config.StrategyInitramfs, b.OutputPath, b.WorkDir, b.checksum)
+			if err != nil {
+				return err
+			}
+			b.checksum = checksum
+			b.Report.RecordChecksum(checksum)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("post-processing failed: %w", err)
+		}
+	}
+	if err := b.runStep(ctx, "Write checksums", func() error {
+		return writeChecksumFiles(b.stepContext(), b.OutputPath, b.checksum, b.Checksums)
+	}); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	if b.SBOM {
+		if err := b.runStep(ctx, "Write SBOM", func() error {
+			return writeSBOM(b.stepContext(), b.OutputPath, b.checksum, b.Lock.Resolved())
+		}); err != nil {
+			return fmt.Errorf("failed to write SBOM: %w", err)
+		}
+	}
+	b.Report.RecordArtifact(b.OutputPath)
 
-	logging.Info("Initramfs build complete", "output", b.OutputPath)
+	logging.InfoContext(b.stepContext(), "Initramfs build complete", "output", b.OutputPath)
 	return nil
 }
 
+// tempRoot returns the directory temporary files are created in.
+func (b *InitramfsBuilder) tempRoot() string {
+	if b.TempRoot != "" {
+		return b.TempRoot
+	}
+	return os.TempDir()
+}
+
+// preflightNeeds estimates the space the build needs before it starts.
+func (b *InitramfsBuilder) preflightNeeds() []spaceNeed {
+	needs := []spaceNeed{{"build workspace", b.RootfsDir, minTempSpace}}
+	if b.Config.Source.Dockerfile != "" {
+		needs = append(needs, buildKitNeed()...)
+	} else if compressed := estimateImageSize(b.stepContext(), b.Config.Source.Image); compressed > 0 {
+		needs = append(needs, spaceNeed{"unpacked image", b.RootfsDir, compressed * unpackRatio})
+	}
+	return needs
+}
+
+// runStep runs fn as a traced and timed build step, making its span the
+// parent of anything fn starts. Steps are skipped once ctx is cancelled.
+func (b *InitramfsBuilder) runStep(ctx context.Context, name string, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	ctx = logging.NewContext(ctx, logging.KeyStep, name)
+	logging.DebugContext(ctx, "Step started")
+	notifyStep(b.OnStep, StepEvent{Name: name})
+	err := telemetry.Step(ctx, name, func(ctx context.Context) error {
+		parent := b.ctx
+		b.ctx = ctx
+		defer func() { b.ctx = parent }()
+		return fn()
+	})
+	b.Report.RecordStep(name, time.Since(start), err)
+	notifyStep(b.OnStep, StepEvent{Name: name, Done: true, Duration: time.Since(start), Err: err})
+	logging.DebugContext(ctx, "Step finished", "duration", time.Since(start).Round(time.Millisecond), "error", err)
+	b.observeSizes(name)
+	return explainNoSpace(err)
+}
+
+// observeSizes attributes the rootfs files written by step to its source.
+// Timestamps are normalized after the last step observed.
+func (b *InitramfsBuilder) observeSizes(step string) {
+	if b.sizes == nil {
+		return
+	}
+	source, ok := map[string]string{
+		"Set up directory structure":        sizeSourceFledge,
+		"Install kernel modules":            sizeSourceModules,
+		"Overlay image rootfs":              imageSizeSource(b.Config),
+		"Merge source layers":               sizeSourceLayers,
+		"Install userland":                  sizeSourceUserland,
+		"Compile init":                      sizeSourceInit,
+		"Install custom init":               sizeSourceInit,
+		"Install kestrel agent":             sizeSourceAgent,
+		"Apply file mappings":               sizeSourceMappings,
+		"Create users and groups":           sizeSourceFledge,
+		"Apply system configuration":        sizeSourceModules,
+		"Install GPU driver":                sizeSourceGPU,
+		"Check shared library dependencies": sizeSourceMappings,
+	}[step]
+	if !ok {
+		return
+	}
+	if err := b.sizes.observe(b.RootfsDir, source); err != nil {
+		logging.WarnContext(b.stepContext(), "Failed to measure rootfs; no size breakdown", "error", err)
+		b.sizes = nil
+	}
+}
+
+// stepContext returns the context of the running step.
+func (b *InitramfsBuilder) stepContext() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// baseRootfsDirs are the directories every rootfs fledge assembles from
+// scratch starts with.
+var baseRootfsDirs = []string{
+	"/bin",
+	"/sbin",
+	"/etc",
+	"/proc",
+	"/sys",
+	"/dev",
+	"/tmp",
+	"/run",
+	"/usr/bin",
+	"/usr/sbin",
+	"/usr/lib",
+	"/var/log",
+}
+
 // setupDirectoryStructure creates the FHS directory structure.
 func (b *InitramfsBuilder) setupDirectoryStructure() error {
-	logging.Info("Setting up directory structure")
-
-	dirs := []string{
-		"/bin",
-		"/sbin",
-		"/etc",
-		"/proc",
-		"/sys",
-		"/dev",
-		"/tmp",
-		"/run",
-		"/usr/bin",
-		"/usr/sbin",
-		"/usr/lib",
-		"/var/log",
-	}
-
-	for _, dir := range dirs {
+	logging.InfoContext(b.stepContext(), "Setting up directory structure")
+
+	for _, dir := range baseRootfsDirs {
 		fullPath := filepath.Join(b.RootfsDir, dir)
 		if err := os.MkdirAll(fullPath, 0755); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
 
-	logging.Debug("Directory structure created")
+	logging.DebugContext(b.stepContext(), "Directory structure created")
 	return nil
 }
 
 // installKernelModules copies essential kernel modules (squashfs, overlay) into the initramfs.
 // This allows the init to load these modules if they're not built-in to the kernel.
 func (b *InitramfsBuilder) installKernelModules() error {
-	logging.Info("Installing kernel modules")
+	logging.InfoContext(b.stepContext(), "Installing kernel modules")
 
-	// Determine kernel version from running system
-	cmd := exec.Command("uname", "-r")
-	output, err := cmd.Output()
+	// Determine the guest kernel's module directory
+	_, kernelDir, err := b.kernel.modules(b.stepContext())
 	if err != nil {
-		return fmt.Errorf("failed to detect kernel version: %w", err)
+		return err
 	}
-	kernelVersion := strings.TrimSpace(string(output))
 
 	// Common module locations
 	moduleBasePaths := []string{
-		fmt.Sprintf("/lib/modules/%s/kernel/fs", kernelVersion),
-		"/lib/modules/kernel/fs", // Generic fallback
+		filepath.Join(kernelDir, "kernel", "fs"),
+	}
+	if b.Config.Kernel == nil {
+		moduleBasePaths = append(moduleBasePaths, "/lib/modules/kernel/fs") // Generic fallback
 	}
 
 	// Modules we need
@@ -209,11 +450,11 @@ func (b *InitramfsBuilder) installKernelModules() error {
 				destPath := filepath.Join(modulesDir, destName)
 
 				if err := CopyFile(fullPath, destPath, 0644); err != nil {
-					logging.Warn("Failed to copy kernel module", "module", fullPath, "error", err)
+					logging.WarnClassContext(b.stepContext(), logging.WarnKernelModules, "Failed to copy kernel module", "module", fullPath, "error", err)
 					continue
 				}
 
-				logging.Info("Installed kernel module", "module", destName)
+				logging.InfoContext(b.stepContext(), "Installed kernel module", "module", destName)
 				foundAny = true
 			}
 		}
@@ -228,7 +469,7 @@ func (b *InitramfsBuilder) installKernelModules() error {
 
 // compileInit compiles the init.c source to /init.
 func (b *InitramfsBuilder) compileInit() error {
-	logging.Info("Compiling init binary")
+	logging.InfoContext(b.stepContext(), "Compiling init binary")
 
 	// Write init.c to temp file
 	initCPath := filepath.Join(b.RootfsDir, "init.c")
@@ -237,8 +478,9 @@ func (b *InitramfsBuilder) compileInit() error {
 	}
 
 	// Compile with gcc
+	b.Report.UseTool("gcc")
 	initBinaryPath := filepath.Join(b.RootfsDir, "init")
-	cmd := exec.Command("gcc",
+	cmd := exec.CommandContext(b.stepContext(), "gcc",
 		"-static",
 		"-Os",
 		"-Wall",
@@ -259,7 +501,54 @@ func (b *InitramfsBuilder) compileInit() error {
 		return fmt.Errorf("failed to chmod init: %w", err)
 	}
 
-	logging.Info("Init binary compiled successfully")
+	logging.InfoContext(b.stepContext(), "Init binary compiled successfully")
+	return nil
+}
+
+// installUserland installs the configured userland: busybox, toybox or dash.
+func (b *InitramfsBuilder) installUserland() error {
+	switch b.Config.Source.Userland {
+	case config.UserlandToybox, config.UserlandDash:
+		return b.installDownloadedUserland()
+	default:
+		return b.installBusybox()
+	}
+}
+
+// installDownloadedUserland installs toybox with its applet symlinks, or dash
+// as /bin/sh, from source.userland_url.
+func (b *InitramfsBuilder) installDownloadedUserland() error {
+	src := b.Config.Source
+	logging.InfoContext(b.stepContext(), "Installing userland", "userland", src.Userland, "url", src.UserlandURL)
+
+	tmpPath, err := utils.DownloadToTempFile(b.stepContext(), src.UserlandURL, progress.Bars())
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", src.Userland, err)
+	}
+	defer os.Remove(tmpPath)
+
+	if err := utils.VerifyChecksum(tmpPath, src.UserlandSHA256); err != nil {
+		return fmt.Errorf("%s checksum verification failed: %w", src.Userland, err)
+	}
+	recordFileDownload(b.stepContext(), src.Userland, src.UserlandURL, tmpPath, false)
+	if err := b.Lock.RecordDownload(lock.Download{URL: src.UserlandURL, Digest: "sha256:" + strings.ToLower(strings.TrimPrefix(src.UserlandSHA256, "sha256:"))}); err != nil {
+		return err
+	}
+
+	binDir := filepath.Join(b.RootfsDir, "bin")
+	if err := CopyFile(tmpPath, filepath.Join(binDir, src.Userland), 0755); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src.Userland, err)
+	}
+
+	if src.Userland == config.UserlandToybox {
+		if err := b.createAppletSymlinks(src.Userland); err != nil {
+			return fmt.Errorf("failed to create toybox symlinks: %w", err)
+		}
+	} else if err := os.Symlink(src.Userland, filepath.Join(binDir, "sh")); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to link /bin/sh: %w", err)
+	}
+
+	logging.InfoContext(b.stepContext(), "Userland installed successfully", "userland", src.Userland)
 	return nil
 }
 
@@ -268,15 +557,23 @@ func (b *InitramfsBuilder) installBusybox() error {
 	busyboxPath := filepath.Join(b.RootfsDir, "bin", "busybox")
 
 	if b.BusyboxLocalPath != "" {
-		logging.Info("Installing busybox from host", "path", b.BusyboxLocalPath)
+		logging.InfoContext(b.stepContext(), "Installing busybox from host", "path", b.BusyboxLocalPath)
 		if err := CopyFile(b.BusyboxLocalPath, busyboxPath, 0755); err != nil {
 			return fmt.Errorf("failed to copy busybox from host: %w", err)
 		}
+	} else if vendored := vendoredBusybox(b.Config.Source.BusyboxURL, b.Config.Source.BusyboxSHA256); vendored != nil {
+		logging.InfoContext(b.stepContext(), "Installing vendored busybox", "version", vendored.Version)
+		if err := vendored.WriteFile(busyboxPath); err != nil {
+			return err
+		}
+		if err := recordBusybox(b.Lock, b.Config.Source.BusyboxURL, busyboxPath); err != nil {
+			return err
+		}
 	} else {
-		logging.Info("Installing busybox", "url", b.Config.Source.BusyboxURL)
+		logging.InfoContext(b.stepContext(), "Installing busybox", "url", b.Config.Source.BusyboxURL)
 
 		// Download busybox
-		tmpPath, err := utils.DownloadToTempFile(b.Config.Source.BusyboxURL, true)
+		tmpPath, err := utils.DownloadToTempFile(b.stepContext(), b.Config.Source.BusyboxURL, progress.Bars())
 		if err != nil {
 			return fmt.Errorf("failed to download busybox: %w", err)
 		}
@@ -284,11 +581,15 @@ func (b *InitramfsBuilder) installBusybox() error {
 
 		// Verify checksum if provided
 		if b.Config.Source.BusyboxSHA256 != "" {
-			logging.Info("Verifying busybox checksum")
+			logging.InfoContext(b.stepContext(), "Verifying busybox checksum")
 			if err := utils.VerifyChecksum(tmpPath, b.Config.Source.BusyboxSHA256); err != nil {
 				return fmt.Errorf("busybox checksum verification failed: %w", err)
 			}
 		}
+		recordFileDownload(b.stepContext(), "busybox", b.Config.Source.BusyboxURL, tmpPath, false)
+		if err := recordBusybox(b.Lock, b.Config.Source.BusyboxURL, tmpPath); err != nil {
+			return err
+		}
 
 		if err := CopyFile(tmpPath, busyboxPath, 0755); err != nil {
 			return fmt.Errorf("failed to copy busybox: %w", err)
@@ -296,162 +597,258 @@ func (b *InitramfsBuilder) installBusybox() error {
 	}
 
 	// Create busybox symlinks
-	if err := b.createBusyboxSymlinks(); err != nil {
+	if err := b.createAppletSymlinks("busybox"); err != nil {
 		return fmt.Errorf("failed to create busybox symlinks: %w", err)
 	}
 
-	logging.Info("Busybox installed successfully")
+	logging.InfoContext(b.stepContext(), "Busybox installed successfully")
 	return nil
 }
 
-// createBusyboxSymlinks creates symlinks for common busybox applets.
-func (b *InitramfsBuilder) createBusyboxSymlinks() error {
-	logging.Debug("Creating busybox symlinks")
+// defaultApplets are linked when source.busybox_applets is unset.
+var defaultApplets = []string{
+	"sh", "ash", "ls", "cat", "cp", "mv", "rm", "mkdir", "rmdir",
+	"ln", "chmod", "chown", "ps", "kill", "mount", "umount",
+	"grep", "sed", "awk", "find", "test", "echo", "printf",
+	"true", "false", "sleep", "pwd", "cd", "env", "which",
+	"tar", "gzip", "gunzip", "wget", "vi",
+}
 
-	// Common busybox applets
-	applets := []string{
-		"sh", "ash", "ls", "cat", "cp", "mv", "rm", "mkdir", "rmdir",
-		"ln", "chmod", "chown", "ps", "kill", "mount", "umount",
-		"grep", "sed", "awk", "find", "test", "echo", "printf",
-		"true", "false", "sleep", "pwd", "cd", "env", "which",
-		"tar", "gzip", "gunzip", "wget", "vi",
-	}
+// createAppletSymlinks creates symlinks to the multi-call binary /bin/<name>
+// (busybox or toybox) for the configured applets.
+func (b *InitramfsBuilder) createAppletSymlinks(name string) error {
+	logging.DebugContext(b.stepContext(), "Creating applet symlinks", "binary", name)
 
 	binDir := filepath.Join(b.RootfsDir, "bin")
+	applets := b.Config.Source.BusyboxApplets
+	all := len(applets) == 1 && applets[0] == config.BusyboxAppletsAll
+	switch {
+	case len(applets) == 0:
+		applets = defaultApplets
+	case all:
+		var err error
+		if applets, err = listApplets(b.stepContext(), filepath.Join(binDir, name)); err != nil {
+			return err
+		}
+	}
+
 	for _, applet := range applets {
 		linkPath := filepath.Join(binDir, applet)
-		if err := os.Symlink("busybox", linkPath); err != nil {
-			logging.Warn("Failed to create symlink", "applet", applet, "error", err)
+		// With every applet linked, files from the image quietly win
+		if _, err := os.Lstat(linkPath); all && err == nil {
+			continue
+		}
+		if err := os.Symlink(name, linkPath); err != nil {
+			logging.WarnClassContext(b.stepContext(), logging.WarnSymlinks, "Failed to create symlink", "applet", applet, "error", err)
 		}
 	}
 
-	logging.Debug("Busybox symlinks created")
+	logging.DebugContext(b.stepContext(), "Applet symlinks created", "binary", name, "applets", len(applets))
 	return nil
 }
 
+// listApplets runs `busybox --list`, or toybox without arguments, to find
+// the applets the multi-call binary was built with.
+func listApplets(ctx context.Context, binary string) ([]string, error) {
+	name := filepath.Base(binary)
+	var args []string
+	if name == "busybox" {
+		args = []string{"--list"}
+	}
+	out, err := exec.CommandContext(ctx, binary, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s applets (%s must run on the build host for busybox_applets = [\"all\"]): %w", name, name, err)
+	}
+	var applets []string
+	for _, applet := range strings.Fields(string(out)) {
+		if applet != name {
+			applets = append(applets, applet)
+		}
+	}
+	if len(applets) == 0 {
+		return nil, fmt.Errorf("%s reported no applets", name)
+	}
+	return applets, nil
+}
+
 // installAgent installs the kestrel agent binary.
 func (b *InitramfsBuilder) installAgent() error {
-	logging.Info("Installing kestrel agent")
+	logging.InfoContext(b.stepContext(), "Installing kestrel agent")
 
 	// Source the agent
-	agentPath, err := SourceAgent(b.Config.Agent, true)
+	agent, err := ResolveAgent(b.stepContext(), b.Config.Agent, progress.Bars())
 	if err != nil {
 		return fmt.Errorf("failed to source agent: %w", err)
 	}
-	defer CleanupAgent(agentPath)
+	defer CleanupAgent(agent.Path)
+
+	recordAgentDownload(b.stepContext(), agent)
+	if err := b.Lock.RecordAgent(agent.LockEntry()); err != nil {
+		return err
+	}
+	b.Agent = agent
 
 	// Copy agent to /bin/kestrel
 	kestrelPath := filepath.Join(b.RootfsDir, "bin", "kestrel")
 	if err := ensureDestDir(b.RootfsDir, filepath.Dir(kestrelPath)); err != nil {
 		return err
 	}
-	if err := CopyFile(agentPath, kestrelPath, 0755); err != nil {
+	if err := CopyFile(agent.Path, kestrelPath, 0755); err != nil {
 		return fmt.Errorf("failed to copy kestrel: %w", err)
 	}
 
-	logging.Info("Kestrel agent installed")
+	logging.InfoContext(b.stepContext(), "Kestrel agent installed")
 	return nil
 }
 
 // overlayDockerRootfsIfProvided builds (if needed) and overlays a Docker image rootfs onto the initramfs root.
 func (b *InitramfsBuilder) overlayDockerRootfsIfProvided() error {
-	// If Dockerfile provided, use BuildKit to export rootfs and overlay
-	if b.Config.Source.Dockerfile != "" {
-		dfPath := b.Config.Source.Dockerfile
-		if !filepath.IsAbs(dfPath) {
-			dfPath = filepath.Join(b.WorkDir, dfPath)
+	// The binary strategy has no image; its base is assembled from the host
+	if b.Config.Binary != nil {
+		img, err := prepareBinaryRootfs(b.stepContext(), b.Config.Binary, b.RootfsDir)
+		if err != nil {
+			return err
 		}
-		ctxDir := b.Config.Source.Context
-		if ctxDir == "" {
-			ctxDir = filepath.Dir(dfPath)
+		b.ImageConfig = img
+		return nil
+	}
+
+	// A previously built artifact is unpacked over the skeleton as is
+	if artifact := b.Config.Source.Artifact; artifact != "" {
+		img, err := extractArtifact(b.stepContext(), resolveWorkPath(artifact, b.WorkDir), b.RootfsDir, b.TempRoot)
+		if err != nil {
+			return fmt.Errorf("failed to extract source artifact: %w", err)
 		}
-		if !filepath.IsAbs(ctxDir) {
-			ctxDir = filepath.Join(b.WorkDir, ctxDir)
+		b.ImageConfig = img
+		return nil
+	}
+
+	// If Dockerfile provided, use BuildKit to export rootfs and overlay
+	if b.Config.Source.Dockerfile != "" {
+		overlay := !stageMappingsOnly(b.Config)
+		if !overlay && b.Config.Source.ExportImage == "" && b.Config.Source.PushImage == "" {
+			logging.InfoContext(b.stepContext(), "Dockerfile only feeds stage mappings; not overlaying its final stage")
+			return nil
 		}
+		dfPath, ctxDir := resolveDockerfileInputs(b.Config.Source, b.WorkDir)
 
-		exportDir, err := os.MkdirTemp("", "fledge-init-df-rootfs-*")
+		exportDir, err := os.MkdirTemp(b.TempRoot, "fledge-init-df-rootfs-*")
 		if err != nil {
 			return fmt.Errorf("failed to create export dir: %w", err)
 		}
 		defer os.RemoveAll(exportDir)
 
-		logging.Info("Building Dockerfile via BuildKit for initramfs overlay", "dockerfile", dfPath, "context", ctxDir)
-		err = invokeDockerfileBuilder(context.Background(), DockerfileBuildInput{
-			Dockerfile: dfPath,
-			ContextDir: ctxDir,
-			Target:     b.Config.Source.Target,
-			BuildArgs:  b.Config.Source.BuildArgs,
-			DestDir:    exportDir,
+		// Keep the image config outside exportDir so it is not overlaid into the rootfs
+		configDir, err := os.MkdirTemp(b.TempRoot, "fledge-init-df-config-*")
+		if err != nil {
+			return fmt.Errorf("failed to create config dir: %w", err)
+		}
+		defer os.RemoveAll(configDir)
+		configPath := filepath.Join(configDir, "image-config.json")
+
+		frontend, err := pinFrontendImage(b.stepContext(), b.Config.Source.FrontendImage, b.Lock)
+		if err != nil {
+			return err
+		}
+
+		image, err := newImageExport(b.Config.Source, b.WorkDir)
+		if err != nil {
+			return err
+		}
+		defer image.Cleanup()
+
+		logging.InfoContext(b.stepContext(), "Building Dockerfile via BuildKit for initramfs overlay", "dockerfile", dfPath, "context", ctxDir)
+		err = invokeDockerfileBuilder(b.stepContext(), DockerfileBuildInput{
+			Dockerfile:      dfPath,
+			ContextDir:      ctxDir,
+			Target:          b.Config.Source.Target,
+			BuildArgs:       b.Config.Source.BuildArgs,
+			DestDir:         exportDir,
+			ImageConfigPath: configPath,
+			FrontendImage:   frontend,
+			ImageTarPath:    image.TarPath,
 		})
 		if err != nil {
 			return fmt.Errorf("buildkit build failed: %w", err)
 		}
+		if err := image.Finish(b.stepContext()); err != nil {
+			return err
+		}
+		if !overlay {
+			return nil
+		}
+
+		b.ImageConfig, err = loadImageConfig(configPath)
+		if err != nil {
+			return err
+		}
 
 		// Overlay exported rootfs (exportDir contains the full rootfs)
-		if err := overlayCopyPreserve(exportDir, b.RootfsDir); err != nil {
+		if err := overlayCopyPreserve(b.stepContext(), exportDir, b.RootfsDir); err != nil {
 			return fmt.Errorf("failed to overlay buildkit rootfs: %w", err)
 		}
 		return nil
 	}
 
-	// If an image reference is provided, fetch via skopeo/umoci and overlay
+	// If an image reference is provided, fetch via skopeo and apply its layers
 	imgRef := b.Config.Source.Image
 	if imgRef == "" {
 		// Nothing to overlay
 		return nil
 	}
 
-	// Create temp oci layout and unpack
-	tmpDir, err := os.MkdirTemp("", "fledge-init-overlay-*")
+	// Create temp oci layout
+	tmpDir, err := os.MkdirTemp(b.TempRoot, "fledge-init-overlay-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp dir: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
 	ociLayout := filepath.Join(tmpDir, "oci-layout")
-	unpackDir := filepath.Join(tmpDir, "unpacked")
 	if err := os.MkdirAll(ociLayout, 0755); err != nil {
 		return fmt.Errorf("failed to create oci layout dir: %w", err)
 	}
 
-	// Try local docker-daemon first
-	cmd := exec.Command("skopeo", "copy",
-		fmt.Sprintf("docker-daemon:%s", imgRef),
-		fmt.Sprintf("oci:%s:latest", ociLayout))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		// Try remote registry fallback
-		cmd = exec.Command("skopeo", "copy",
-			fmt.Sprintf("docker://%s", imgRef),
-			fmt.Sprintf("oci:%s:latest", ociLayout))
-		if output2, err2 := cmd.CombinedOutput(); err2 != nil {
-			return fmt.Errorf("skopeo copy failed: %w\nLocal output: %s\nRemote output: %s", err2, string(output), string(output2))
-		}
+	if err := pullImage(b.stepContext(), b.Lock, lock.RoleSource, imgRef, ociLayout); err != nil {
+		return err
 	}
 
-	// Unpack
-	if err := os.MkdirAll(unpackDir, 0755); err != nil {
-		return fmt.Errorf("failed to create unpack dir: %w", err)
+	// Apply the image layers directly onto b.RootfsDir so whiteouts and opaque
+	// directories also take effect against the initramfs skeleton.
+	manifest, err := oci.ResolveManifest(ociLayout, "latest")
+	if err != nil {
+		return fmt.Errorf("failed to resolve image manifest: %w", err)
 	}
-	cmd = exec.Command("umoci", "unpack", "--image", fmt.Sprintf("%s:latest", ociLayout), unpackDir)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("umoci unpack failed: %w\nOutput: %s", err, string(output))
+	img, err := oci.ReadConfig(ociLayout, manifest)
+	if err != nil {
+		return err
 	}
+	b.ImageConfig = &img
 
-	// Overlay the unpacked rootfs onto b.RootfsDir
-	srcRoot := filepath.Join(unpackDir, "rootfs")
-	if err := overlayCopyPreserve(srcRoot, b.RootfsDir); err != nil {
-		return fmt.Errorf("failed to overlay rootfs: %w", err)
+	if err := oci.ApplyLayout(b.stepContext(), ociLayout, "latest", b.RootfsDir); err != nil {
+		return fmt.Errorf("failed to apply image layers: %w", err)
 	}
 
 	return nil
 }
 
-// overlayCopyPreserve copies srcRoot onto dstRoot preserving file modes and symlinks.
-func overlayCopyPreserve(srcRoot, dstRoot string) error {
-	return filepath.WalkDir(srcRoot, func(srcPath string, d os.DirEntry, err error) error {
+// overlayCopyPreserve copies srcRoot onto dstRoot preserving file modes, ownership and symlinks.
+func overlayCopyPreserve(ctx context.Context, srcRoot, dstRoot string) error {
+	// Directory ownership and modes are applied after the walk so that restrictive
+	// modes (e.g. 0555) do not prevent their children from being written.
+	type dirEntry struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dirEntry
+
+	err := filepath.WalkDir(srcRoot, func(srcPath string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		rel, err := filepath.Rel(srcRoot, srcPath)
 		if err != nil {
 			return err
@@ -467,7 +864,11 @@ func overlayCopyPreserve(srcRoot, dstRoot string) error {
 		}
 
 		if info.IsDir() {
-			return os.MkdirAll(dstPath, 0755)
+			if err := os.MkdirAll(dstPath, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirEntry{path: dstPath, info: info})
+			return nil
 		}
 		if info.Mode()&os.ModeSymlink != 0 {
 			target, err := os.Readlink(srcPath)
@@ -476,7 +877,10 @@ func overlayCopyPreserve(srcRoot, dstRoot string) error {
 			}
 			// Remove existing path if any to avoid dangling copies
 			_ = os.RemoveAll(dstPath)
-			return os.Symlink(target, dstPath)
+			if err := os.Symlink(target, dstPath); err != nil {
+				return err
+			}
+			return preserveOwnership(dstPath, info)
 		}
 
 		// Regular file
@@ -496,44 +900,73 @@ func overlayCopyPreserve(srcRoot, dstRoot string) error {
 		if _, err := io.Copy(dstFile, srcFile); err != nil {
 			return err
 		}
-		return nil
+		return preserveOwnership(dstPath, info)
 	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := preserveOwnership(dirs[i].path, dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // applyMappings applies user-defined file mappings.
 func (b *InitramfsBuilder) applyMappings() error {
+	if len(b.Config.Mappings) == 0 && len(b.Config.StageMappings) == 0 && len(b.Config.Assets) == 0 {
+		logging.InfoContext(b.stepContext(), "No custom file mappings to apply")
+		return nil
+	}
+
+	// Stage mappings and assets go first so local files can still override them
+	if err := applyStageMappings(b.stepContext(), b.Config, b.WorkDir, b.RootfsDir, b.Lock); err != nil {
+		return fmt.Errorf("failed to apply stage mappings: %w", err)
+	}
+	if err := applyAssets(b.stepContext(), b.Config.Assets, b.WorkDir, b.RootfsDir, b.Lock); err != nil {
+		return fmt.Errorf("failed to apply assets: %w", err)
+	}
 	if len(b.Config.Mappings) == 0 {
-		logging.Info("No custom file mappings to apply")
 		return nil
 	}
 
-	logging.Info("Applying custom file mappings")
+	logging.InfoContext(b.stepContext(), "Applying custom file mappings")
 
-	// Prepare mappings
-	mappings, err := PrepareFileMappings(b.Config.Mappings, b.WorkDir)
+	// Download remote sources, then prepare mappings
+	sources, err := resolveRemoteMappings(b.stepContext(), b.Config.Mappings, b.Lock)
+	if err != nil {
+		return err
+	}
+	mappings, err := PrepareFileMappings(sources, b.WorkDir)
 	if err != nil {
 		return fmt.Errorf("failed to prepare mappings: %w", err)
 	}
 
 	// Apply mappings
-	if err := ApplyFileMappings(mappings, b.RootfsDir); err != nil {
+	if err := ApplyFileMappings(b.stepContext(), mappings, b.RootfsDir); err != nil {
 		return fmt.Errorf("failed to apply mappings: %w", err)
 	}
 
-	logging.Info("Custom file mappings applied")
+	logging.InfoContext(b.stepContext(), "Custom file mappings applied")
 	return nil
 }
 
 // normalizeTimestamps sets all file timestamps to a reproducible epoch for deterministic builds.
 func (b *InitramfsBuilder) normalizeTimestamps() error {
-	logging.Info("Normalizing timestamps for reproducible builds")
+	logging.InfoContext(b.stepContext(), "Normalizing timestamps for reproducible builds")
 
 	epoch := time.Unix(ReproducibleEpoch, 0)
 
+	ctx := b.stepContext()
 	err := filepath.Walk(b.RootfsDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		// Set mtime and atime to epoch
 		if err := os.Chtimes(path, epoch, epoch); err != nil {
@@ -547,22 +980,30 @@ func (b *InitramfsBuilder) normalizeTimestamps() error {
 		return fmt.Errorf("failed to normalize timestamps: %w", err)
 	}
 
-	logging.Info("Timestamps normalized")
+	logging.InfoContext(b.stepContext(), "Timestamps normalized")
 	return nil
 }
 
 // createArchive creates the compressed CPIO archive.
 func (b *InitramfsBuilder) createArchive() error {
-	logging.Info("Creating CPIO archive")
+	logging.InfoContext(b.stepContext(), "Creating CPIO archive")
+	rootfsSize := measureDir(b.Report, "rootfs", b.RootfsDir)
+	b.Report.UseTool("cpio")
 
 	// Ensure output directory exists
 	outputDir := filepath.Dir(b.OutputPath)
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
+	if err := checkSpace(
+		spaceNeed{"cpio archive", b.tempRoot(), rootfsSize},
+		spaceNeed{"compressed initramfs", outputDir, rootfsSize / 2},
+	); err != nil {
+		return err
+	}
 
 	// Create a temporary file for the uncompressed CPIO
-	tmpCpio, err := os.CreateTemp("", "fledge-cpio-*")
+	tmpCpio, err := os.CreateTemp(b.TempRoot, "fledge-cpio-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp cpio file: %w", err)
 	}
@@ -572,10 +1013,10 @@ func (b *InitramfsBuilder) createArchive() error {
 
 	// Use find + cpio to create the archive
 	// We change to the rootfs directory to get relative paths
-	findCmd := exec.Command("find", ".", "-print0")
+	findCmd := exec.CommandContext(b.stepContext(), "find", ".", "-print0")
 	findCmd.Dir = b.RootfsDir
 
-	cpioCmd := exec.Command("cpio", "--null", "-ov", "--format=newc")
+	cpioCmd := exec.CommandContext(b.stepContext(), "cpio", "--null", "-ov", "--format=newc")
 	cpioCmd.Dir = b.RootfsDir
 
 	// Create the output file for cpio
@@ -621,37 +1062,83 @@ func (b *InitramfsBuilder) createArchive() error {
 	}
 
 	cpioOut.Close()
+	if info, err := os.Stat(tmpCpioPath); err == nil {
+		b.Report.RecordSize("cpio", info.Size())
+	}
 
-	// Compress the CPIO with gzip (use -n for reproducibility)
-	logging.Info("Compressing archive with gzip")
+	logging.InfoContext(b.stepContext(), "Compressing archive with gzip")
+	if err := b.compressArchive(tmpCpioPath); err != nil {
+		return err
+	}
+
+	logging.InfoContext(b.stepContext(), "Archive created successfully", "output", b.OutputPath)
+	return nil
+}
 
-	cpioFile, err := os.Open(tmpCpioPath)
+// compressArchive gzips the cpio archive at cpioPath into the output at the
+// highest level. The gzip header carries no name or time, as with gzip -n,
+// so identical archives compress to identical artifacts.
+func (b *InitramfsBuilder) compressArchive(cpioPath string) error {
+	cpioFile, err := os.Open(cpioPath)
 	if err != nil {
 		return fmt.Errorf("failed to open cpio file: %w", err)
 	}
 	defer cpioFile.Close()
+	info, err := cpioFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat cpio file: %w", err)
+	}
 
+	// A previous output may be hardlinked into an artifact store; a new
+	// file leaves the stored copy intact
+	if err := os.Remove(b.OutputPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace output file: %w", err)
+	}
 	outputFile, err := os.Create(b.OutputPath)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
 	defer outputFile.Close()
 
-	gzipCmd := exec.Command("gzip", "-n", "-9")
-	gzipCmd.Stdin = cpioFile
-	gzipCmd.Stdout = outputFile
-
-	var gzipStderr strings.Builder
-	gzipCmd.Stderr = &gzipStderr
+	bar := progressbar.NewOptions64(info.Size(),
+		progressbar.OptionSetDescription("Compressing initramfs"),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetWidth(15),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetVisibility(progress.Bars()),
+	)
+	defer bar.Finish()
 
-	if err := gzipCmd.Run(); err != nil {
-		return fmt.Errorf("gzip command failed: %w\nStderr: %s", err, gzipStderr.String())
+	zw, err := gzip.NewWriterLevel(outputFile, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	ctx := b.stepContext()
+	src := io.TeeReader(readerFunc(func(p []byte) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return cpioFile.Read(p)
+	}), bar)
+	if _, err := io.Copy(zw, src); err != nil {
+		return fmt.Errorf("failed to compress archive: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress archive: %w", err)
+	}
+	if err := outputFile.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", b.OutputPath, err)
 	}
-
-	logging.Info("Archive created successfully", "output", b.OutputPath)
 	return nil
 }
 
+// readerFunc adapts a function to io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
 // getInitMode determines which init mode is configured.
 // Returns "default", "custom", or "none".
 func (b *InitramfsBuilder) getInitMode() string {
@@ -670,7 +1157,7 @@ func (b *InitramfsBuilder) getInitMode() string {
 // writeCustomInitPath writes the custom init path to /.volant_init
 // so the C init knows what to exec.
 func (b *InitramfsBuilder) installCustomInit() error {
-	logging.Info("Installing custom init binary", "source", b.Config.Init.Path)
+	logging.InfoContext(b.stepContext(), "Installing custom init binary", "source", b.Config.Init.Path)
 
 	// Resolve the source path relative to WorkDir
 	srcPath := b.Config.Init.Path
@@ -697,65 +1184,78 @@ func (b *InitramfsBuilder) installCustomInit() error {
 		return fmt.Errorf("failed to write custom init: %w", err)
 	}
 
-	logging.Info("Custom init binary installed successfully")
+	logging.InfoContext(b.stepContext(), "Custom init binary installed successfully")
 	return nil
 }
 
 // generateManifest creates the manifest.json file by merging the manifest template
 // with build metadata (checksum, URL, format).
 func (b *InitramfsBuilder) generateManifest() error {
-	logging.Info("Generating manifest.json")
-
-	// Compute SHA256 checksum of the built initramfs
-	checksum, err := computeInitramfsSHA256(b.OutputPath)
-	if err != nil {
-		return fmt.Errorf("failed to compute checksum: %w", err)
+	logging.InfoContext(b.stepContext(), "Generating manifest.json")
+
+	// Compute SHA256 checksum of the built initramfs unless verification did
+	checksum := b.checksum
+	if checksum == "" {
+		var err error
+		if checksum, err = computeInitramfsSHA256(b.OutputPath); err != nil {
+			return fmt.Errorf("failed to compute checksum: %w", err)
+		}
+		b.checksum = checksum
 	}
 
-	logging.Info("Computed initramfs checksum", "sha256", checksum)
+	logging.InfoContext(b.stepContext(), "Computed initramfs checksum", "sha256", checksum)
+
+	// Fill gaps in the template from the image config (ENTRYPOINT, ENV, EXPOSE, ...)
+	tpl := applyImageConfig(b.ManifestTpl, b.ImageConfig)
 
 	// Build the final manifest by merging template + build metadata
 	manifest := make(map[string]interface{})
 
 	// Copy fields from manifest template
-	if b.ManifestTpl != nil {
-		manifest["schema_version"] = b.ManifestTpl.SchemaVersion
-		manifest["name"] = b.ManifestTpl.Name
-		manifest["version"] = b.ManifestTpl.Version
-		manifest["runtime"] = b.ManifestTpl.Runtime
+	if tpl != nil {
+		manifest["schema_version"] = tpl.SchemaVersion
+		manifest["name"] = tpl.Name
+		manifest["version"] = tpl.Version
+		manifest["runtime"] = tpl.Runtime
 
 		// Resources
-		if b.ManifestTpl.Resources != nil {
+		if tpl.Resources != nil {
 			manifest["resources"] = map[string]interface{}{
-				"cpu_cores": b.ManifestTpl.Resources.CPUCores,
-				"memory_mb": b.ManifestTpl.Resources.MemoryMB,
+				"cpu_cores": tpl.Resources.CPUCores,
+				"memory_mb": tpl.Resources.MemoryMB,
 			}
 		}
 
 		// Workload
-		if b.ManifestTpl.Workload != nil {
+		if tpl.Workload != nil {
 			workload := map[string]interface{}{
-				"entrypoint": b.ManifestTpl.Workload.Entrypoint,
+				"entrypoint": tpl.Workload.Entrypoint,
+			}
+			if len(tpl.Workload.Args) > 0 {
+				workload["args"] = tpl.Workload.Args
+			}
+			if tpl.Workload.WorkDir != "" {
+				workload["workdir"] = tpl.Workload.WorkDir
 			}
-			if len(b.ManifestTpl.Workload.Args) > 0 {
-				workload["args"] = b.ManifestTpl.Workload.Args
+			if tpl.Workload.User != "" {
+				workload["user"] = tpl.Workload.User
 			}
 			manifest["workload"] = workload
 		}
 
 		// Environment variables
-		if len(b.ManifestTpl.Env) > 0 {
-			manifest["env"] = b.ManifestTpl.Env
+		if len(tpl.Env) > 0 {
+			manifest["env"] = tpl.Env
 		}
 
 		// Network
-		if b.ManifestTpl.Network != nil {
+		if tpl.Network != nil {
 			network := map[string]interface{}{
-				"mode": b.ManifestTpl.Network.Mode,
+				"mode": tpl.Network.Mode,
 			}
-			if len(b.ManifestTpl.Network.Expose) > 0 {
-				expose := make([]map[string]interface{}, len(b.ManifestTpl.Network.Expose))
-				for i, port := range b.ManifestTpl.Network.Expose {
+			if len(tpl.Network.Expose) > 0 {
+				expose := make([]map[string]interface{}, len(tpl.Network.Expose))
+				for i, port := range tpl.Network.Expose {
 					portMap := map[string]interface{}{
 						"port":     port.Port,
 						"protocol": port.Protocol,
@@ -771,9 +1271,9 @@ func (b *InitramfsBuilder) generateManifest() error {
 		}
 
 		// Actions
-		if len(b.ManifestTpl.Actions) > 0 {
+		if len(tpl.Actions) > 0 {
 			actions := make(map[string]interface{})
-			for name, action := range b.ManifestTpl.Actions {
+			for name, action := range tpl.Actions {
 				actions[name] = map[string]interface{}{
 					"path":   action.Path,
 					"method": action.Method,
@@ -783,20 +1283,27 @@ func (b *InitramfsBuilder) generateManifest() error {
 		}
 
 		// Cloud-init
-		if b.ManifestTpl.CloudInit != nil {
+		if tpl.CloudInit != nil {
 			cloudInit := make(map[string]interface{})
-			if b.ManifestTpl.CloudInit.Datasource != "" {
-				cloudInit["datasource"] = b.ManifestTpl.CloudInit.Datasource
+			if tpl.CloudInit.Datasource != "" {
+				cloudInit["datasource"] = tpl.CloudInit.Datasource
 			}
-			if b.ManifestTpl.CloudInit.UserData != nil {
+			if tpl.CloudInit.UserData != nil {
 				userData := map[string]interface{}{
-					"inline":  b.ManifestTpl.CloudInit.UserData.Inline,
-					"content": b.ManifestTpl.CloudInit.UserData.Content,
+					"inline":  tpl.CloudInit.UserData.Inline,
+					"content": tpl.CloudInit.UserData.Content,
 				}
 				cloudInit["user_data"] = userData
 			}
-			if len(b.ManifestTpl.CloudInit.MetaData) > 0 {
-				cloudInit["meta_data"] = b.ManifestTpl.CloudInit.MetaData
+			if len(tpl.CloudInit.MetaData) > 0 {
+				cloudInit["meta_data"] = tpl.CloudInit.MetaData
+			}
+			seed, err := writeCloudInitSeed(b.stepContext(), tpl, b.OutputPath)
+			if err != nil {
+				return err
+			}
+			if seed != nil {
+				cloudInit["seed"] = seed
 			}
 			if len(cloudInit) > 0 {
 				manifest["cloud_init"] = cloudInit
@@ -804,9 +1311,9 @@ func (b *InitramfsBuilder) generateManifest() error {
 		}
 
 		// Devices
-		if b.ManifestTpl.Devices != nil && len(b.ManifestTpl.Devices.PCIPassthrough) > 0 {
+		if tpl.Devices != nil && len(tpl.Devices.PCIPassthrough) > 0 {
 			manifest["devices"] = map[string]interface{}{
-				"pci_passthrough": b.ManifestTpl.Devices.PCIPassthrough,
+				"pci_passthrough": tpl.Devices.PCIPassthrough,
 			}
 		}
 	}
@@ -819,6 +1326,10 @@ func (b *InitramfsBuilder) generateManifest() error {
 		"checksum": "sha256:" + checksum,
 	}
 
+	if b.Agent != nil {
+		manifest["agent"] = agentManifest(b.Agent)
+	}
+
 	// Write manifest.json
 	manifestPath := b.OutputPath + ".manifest.json"
 	manifestData, err := json.MarshalIndent(manifest, "", "  ")
@@ -830,7 +1341,7 @@ func (b *InitramfsBuilder) generateManifest() error {
 		return fmt.Errorf("failed to write manifest file: %w", err)
 	}
 
-	logging.Info("Manifest generated successfully", "path", manifestPath)
+	logging.InfoContext(b.stepContext(), "Manifest generated successfully", "path", manifestPath)
 	return nil
 }
 
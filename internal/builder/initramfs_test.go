@@ -0,0 +1,59 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestCreateAppletSymlinks tests the default, configured and "all" applet
+// sets.
+func TestCreateAppletSymlinks(t *testing.T) {
+	links := func(applets ...string) []string {
+		t.Helper()
+		root := t.TempDir()
+		binDir := filepath.Join(root, "bin")
+		if err := os.MkdirAll(binDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// A stand-in busybox that lists its applets, and a file from the image
+		script := "#!/bin/sh\n[ \"$1\" = --list ] && printf 'busybox\\nip\\nls\\nudhcpc\\n'\n"
+		if err := os.WriteFile(filepath.Join(binDir, "busybox"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(binDir, "ls"), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		b := NewInitramfsBuilder(&config.Config{Source: config.SourceConfig{BusyboxApplets: applets}}, nil, root, "")
+		b.RootfsDir = root
+		if err := b.createAppletSymlinks("busybox"); err != nil {
+			t.Fatalf("createAppletSymlinks(%v) failed: %v", applets, err)
+		}
+		entries, err := os.ReadDir(binDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var linked []string
+		for _, e := range entries {
+			if e.Type()&os.ModeSymlink != 0 {
+				linked = append(linked, e.Name())
+			}
+		}
+		sort.Strings(linked)
+		return linked
+	}
+
+	if got := links(); len(got) != len(defaultApplets)-1 {
+		t.Errorf("Expected the default applets except ls, got %v", got)
+	}
+	if got := links("ip", "httpd"); len(got) != 2 || got[0] != "httpd" || got[1] != "ip" {
+		t.Errorf("Expected only the configured applets, got %v", got)
+	}
+	if got := links(config.BusyboxAppletsAll); len(got) != 2 || got[0] != "ip" || got[1] != "udhcpc" {
+		t.Errorf("Expected every listed applet but the image's ls, got %v", got)
+	}
+}
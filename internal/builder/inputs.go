@@ -0,0 +1,347 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tonistiigi/fsutil"
+	"github.com/volantvm/fledge/internal/buildkit/buildctx"
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// InputsSuffix is appended to the artifact path for the file recording the
+// inputs digest of the build that produced the artifact.
+const InputsSuffix = ".inputs"
+
+// ErrUnpinnedInput is returned by InputsDigest when a build reads an input
+// whose content cannot be identified without downloading it.
+var ErrUnpinnedInput = errors.New("build input cannot be pinned")
+
+// InputsDigest returns a digest of everything a build of cfg reads: the
+// fledge version, the effective configuration and manifest template, the
+// host files it reads (those of cfg.HostPaths, the Dockerfile's context
+// without ignored paths) and the current digests of the remote images, git
+// refs and agent release it uses. Base images named inside a Dockerfile are
+// not resolved. Files the build writes, such as output and its manifest and
+// report, are skipped should they lie in a hashed directory.
+func InputsDigest(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output, fledgeVersion string) (string, error) {
+	d := &inputsHasher{h: sha256.New()}
+	hostPaths := cfg.HostPaths()
+	d.skip = append(d.skip, absPath(output))
+	for _, p := range hostPaths {
+		if p.Write {
+			d.skip = append(d.skip, absPath(resolveWorkPath(p.Path, workDir)))
+		}
+	}
+	d.add("fledge", fledgeVersion)
+	if err := d.addJSON("config", artifactConfig(cfg)); err != nil {
+		return "", err
+	}
+	if err := d.addJSON("manifest", manifestTpl); err != nil {
+		return "", err
+	}
+
+	for _, p := range hostPaths {
+		// The Dockerfile and its context are hashed as BuildKit receives
+		// them, and local repositories by the commit checked out
+		if p.Write || p.Field == "source.dockerfile" || p.Field == "source.context" || p.Field == "assets.source" {
+			continue
+		}
+		if err := d.addPath(p.Field+" "+p.Path, resolveWorkPath(p.Path, workDir)); err != nil {
+			return "", err
+		}
+	}
+	if path := postProcessCommandPath(cfg, workDir); path != "" {
+		if err := d.addPath("postprocess command", path); err != nil {
+			return "", err
+		}
+	}
+	if cfg.Source.Dockerfile != "" {
+		dfPath, ctxDir := resolveDockerfileInputs(cfg.Source, workDir)
+		if err := d.addPath("dockerfile", dfPath); err != nil {
+			return "", err
+		}
+		if err := d.addContext(ctx, ctxDir, dfPath); err != nil {
+			return "", err
+		}
+	}
+
+	if err := d.addAgent(ctx, cfg.Agent); err != nil {
+		return "", err
+	}
+	var images []string
+	if cfg.Source.Dockerfile == "" && cfg.Source.Image != "" {
+		images = append(images, cfg.Source.Image)
+	}
+	for _, layer := range cfg.Source.Layers {
+		images = append(images, layer.Image)
+	}
+	if cfg.Source.Dockerfile != "" && cfg.Source.FrontendImage != "" {
+		images = append(images, cfg.Source.FrontendImage)
+	}
+	if cfg.Kernel != nil && cfg.Kernel.ModulesImage != "" {
+		images = append(images, cfg.Kernel.ModulesImage)
+	}
+	if cfg.GPU != nil && cfg.GPU.DriverImage != "" {
+		images = append(images, cfg.GPU.DriverImage)
+	}
+	for _, asset := range cfg.Assets {
+		if ref, ok := strings.CutPrefix(asset.Source, config.AssetSchemeOCI); ok {
+			images = append(images, ref)
+			continue
+		}
+		commit, err := resolveGitRef(ctx, asset.Source, asset.Ref, workDir)
+		if err != nil {
+			return "", err
+		}
+		d.add("git "+asset.Source+" "+asset.Ref, commit)
+	}
+	for _, ref := range images {
+		digest, err := resolveImageDigest(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+		d.add("image "+ref, digest)
+	}
+
+	return "sha256:" + hex.EncodeToString(d.h.Sum(nil)), nil
+}
+
+// UpToDate reports whether the artifact at output, its manifest and any
+// exported image tarball exist and were built from inputs with digest.
+func UpToDate(cfg *config.Config, workDir, output, digest string) bool {
+	recorded, err := os.ReadFile(output + InputsSuffix)
+	if err != nil || strings.TrimSpace(string(recorded)) != digest {
+		return false
+	}
+	required := []string{output, output + ".manifest.json"}
+	if cfg.Source.ExportImage != "" {
+		required = append(required, resolveWorkPath(cfg.Source.ExportImage, workDir))
+	}
+	for _, path := range required {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordInputs records that the artifact at output was built from inputs
+// with digest.
+func RecordInputs(output, digest string) error {
+	if err := os.WriteFile(output+InputsSuffix, []byte(digest+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record build inputs: %w", err)
+	}
+	return nil
+}
+
+// artifactConfig returns cfg without the settings that do not change the
+// artifact, such as the scratch directory, timeouts and logging.
+func artifactConfig(cfg *config.Config) *config.Config {
+	c := *cfg
+	c.Logging = nil
+	if cfg.Build != nil {
+		b := *cfg.Build
+		b.TempDir = ""
+		b.Timeout = ""
+		b.Retries = nil
+		c.Build = &b
+	}
+	return &c
+}
+
+// resolveWorkPath resolves a path from fledge.toml against workDir.
+func resolveWorkPath(path, workDir string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(workDir, path)
+}
+
+// absPath returns path made absolute, or path itself if that fails.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// resolveImageDigest returns the digest ref currently resolves to.
+func resolveImageDigest(ctx context.Context, ref string) (string, error) {
+	if _, digest, pinned := strings.Cut(ref, "@"); pinned {
+		return digest, nil
+	}
+	digest, err := inspectImageDigest(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	return digest, nil
+}
+
+// resolveGitRef returns the commit ref of the repository at source currently
+// points to, without cloning it.
+func resolveGitRef(ctx context.Context, source, ref, workDir string) (string, error) {
+	if len(ref) == 40 && strings.Trim(strings.ToLower(ref), "0123456789abcdef") == "" {
+		return ref, nil
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := runGit(ctx, "", "ls-remote", gitCloneURL(source, workDir), ref)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return "", fmt.Errorf("%w: git ref %s of %s is not a branch or tag", ErrUnpinnedInput, ref, source)
+	}
+	// Every matching ref is kept so an annotated tag's peeled commit counts.
+	return out, nil
+}
+
+// inputsHasher writes labelled records to h.
+type inputsHasher struct {
+	h hash.Hash
+	// skip holds absolute path prefixes of files left out of directories.
+	skip []string
+}
+
+func (d *inputsHasher) skipped(path string) bool {
+	path = absPath(path)
+	for _, prefix := range d.skip {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *inputsHasher) add(label, value string) {
+	fmt.Fprintf(d.h, "%s\x00%d\x00%s\n", label, len(value), value)
+}
+
+func (d *inputsHasher) addJSON(label string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", label, err)
+	}
+	d.add(label, string(data))
+	return nil
+}
+
+// addAgent adds the remote agent binary a build installs.
+func (d *inputsHasher) addAgent(ctx context.Context, agent *config.AgentConfig) error {
+	if agent == nil {
+		return nil
+	}
+	// A local agent is one of the host paths
+	switch agent.SourceStrategy {
+	case config.AgentSourceHTTP:
+		if agent.Checksum == "" {
+			return fmt.Errorf("%w: agent %s has no checksum", ErrUnpinnedInput, agent.URL)
+		}
+	case config.AgentSourceOCI:
+		digest, err := resolveImageDigest(ctx, agent.Image)
+		if err != nil {
+			return err
+		}
+		d.add("agent image", digest)
+	case config.AgentSourceRelease:
+		if vendored := vendoredAgent(agent.Version); vendored != nil {
+			d.add("agent release", vendored.Version)
+			return nil
+		}
+		if agent.Version == "" || agent.Version == "latest" {
+			release, err := fetchRelease(ctx, DefaultGitHubRepo, "latest")
+			if err != nil {
+				return err
+			}
+			d.add("agent release", release.TagName)
+		}
+	}
+	return nil
+}
+
+// addPath adds the file or directory tree at path. Absolute paths are left
+// out, so moving the project does not change the digest.
+func (d *inputsHasher) addPath(label, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	d.add(label, "")
+	if !info.IsDir() {
+		return d.addEntry(path, "", info)
+	}
+	return filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		return d.addEntry(p, rel, info)
+	})
+}
+
+// addContext adds the Dockerfile context at ctxDir as BuildKit receives it.
+func (d *inputsHasher) addContext(ctx context.Context, ctxDir, dockerfile string) error {
+	patterns, err := buildctx.ExcludePatterns(ctxDir, dockerfile)
+	if err != nil {
+		return err
+	}
+	d.add("context", "")
+	return fsutil.WalkDir(ctx, ctxDir, &fsutil.FilterOpt{ExcludePatterns: patterns}, func(rel string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return d.addEntry(filepath.Join(ctxDir, rel), rel, info)
+	})
+}
+
+// addEntry adds the name, mode and content of the file at path, recorded
+// under name.
+func (d *inputsHasher) addEntry(path, name string, info fs.FileInfo) error {
+	if d.skipped(path) {
+		return nil
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		d.add("symlink "+name, target)
+	case info.Mode().IsRegular():
+		fmt.Fprintf(d.h, "file %s\x00%o\x00%d\n", name, info.Mode().Perm(), info.Size())
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(d.h, f); err != nil {
+			return fmt.Errorf("failed to hash %s: %w", path, err)
+		}
+	default:
+		d.add("entry "+name, info.Mode().String())
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestInputsDigest tests which changes to a Dockerfile build alter its inputs
+// digest.
+func TestInputsDigest(t *testing.T) {
+	workDir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Dockerfile", "FROM scratch\nCOPY app /app\n")
+	write("app", "v1")
+	write(".dockerignore", "notes.txt\n")
+	write("extra.conf", "a=1")
+
+	cfg := &config.Config{
+		Strategy: config.StrategyOCIRootfs,
+		Source:   config.SourceConfig{Dockerfile: "Dockerfile", Context: "."},
+		Mappings: map[string]string{"extra.conf": "/etc/extra.conf"},
+		Logging:  &config.LoggingConfig{File: "build.log"},
+	}
+	manifestTpl := &config.ManifestTemplate{Name: "app"}
+	output := filepath.Join(workDir, "app.img")
+	digest := func() string {
+		t.Helper()
+		d, err := InputsDigest(context.Background(), cfg, manifestTpl, workDir, output, "v1.0.0")
+		if err != nil {
+			t.Fatalf("InputsDigest failed: %v", err)
+		}
+		return d
+	}
+
+	base := digest()
+	write("notes.txt", "ignored by .dockerignore")
+	write("app.img", "artifact")
+	write("app.img.report.json", "{}")
+	write("build.log", "log")
+	if got := digest(); got != base {
+		t.Errorf("Digest changed after writing ignored files and build outputs")
+	}
+
+	write("app", "v2")
+	changed := digest()
+	if changed == base {
+		t.Errorf("Digest unchanged after editing a context file")
+	}
+	write("extra.conf", "a=2")
+	if digest() == changed {
+		t.Errorf("Digest unchanged after editing a mapping source")
+	}
+
+	cfg.Source.BuildArgs = map[string]string{"VERSION": "2"}
+	withArgs := digest()
+	cfg.Logging.Format = "json"
+	if digest() != withArgs {
+		t.Errorf("Digest changed with the log format")
+	}
+}
+
+// TestUpToDate tests that a build is only up to date with its recorded
+// inputs and outputs present.
+func TestUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "app.img")
+	cfg := &config.Config{}
+
+	if UpToDate(cfg, dir, output, "sha256:a") {
+		t.Fatal("Expected build without a record to be out of date")
+	}
+	if err := RecordInputs(output, "sha256:a"); err != nil {
+		t.Fatalf("RecordInputs failed: %v", err)
+	}
+	if UpToDate(cfg, dir, output, "sha256:a") {
+		t.Error("Expected build without its artifact to be out of date")
+	}
+	for _, name := range []string{"app.img", "app.img.manifest.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !UpToDate(cfg, dir, output, "sha256:a") {
+		t.Error("Expected build with unchanged inputs to be up to date")
+	}
+	if UpToDate(cfg, dir, output, "sha256:b") {
+		t.Error("Expected build with changed inputs to be out of date")
+	}
+}
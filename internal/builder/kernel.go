@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// guestKernel locates the modules of the kernel the artifact boots with:
+// the build host's by default, or the one [kernel] points at. A modules
+// image is fetched once per build.
+type guestKernel struct {
+	cfg     *config.KernelConfig
+	workDir string
+	tracker *lock.Tracker
+
+	once    sync.Once
+	release string
+	dir     string
+	scratch string
+	err     error
+}
+
+func newGuestKernel(cfg *config.KernelConfig, workDir string, tracker *lock.Tracker) *guestKernel {
+	return &guestKernel{cfg: cfg, workDir: workDir, tracker: tracker}
+}
+
+// modules returns the guest kernel release and the host directory holding
+// its lib/modules/<release> tree.
+func (k *guestKernel) modules(ctx context.Context) (release, dir string, err error) {
+	k.once.Do(func() {
+		k.release, k.dir, k.err = k.resolve(ctx)
+		if k.err == nil {
+			logging.InfoContext(ctx, "Using guest kernel modules", "kernel", k.release, "dir", k.dir)
+		}
+	})
+	return k.release, k.dir, k.err
+}
+
+func (k *guestKernel) resolve(ctx context.Context) (string, string, error) {
+	var version string
+	if k.cfg != nil {
+		version = k.cfg.Version
+	}
+	switch {
+	case k.cfg != nil && k.cfg.ModulesDir != "":
+		return findModulesDir(resolveWorkPath(k.cfg.ModulesDir, k.workDir), version)
+
+	case k.cfg != nil && k.cfg.ModulesImage != "":
+		scratch, err := os.MkdirTemp("", "fledge-kernel-*")
+		if err != nil {
+			return "", "", fmt.Errorf("failed to create kernel modules dir: %w", err)
+		}
+		k.scratch = scratch
+		root, err := fetchOCIAsset(ctx, k.cfg.ModulesImage, scratch, k.tracker)
+		if err != nil {
+			return "", "", fmt.Errorf("kernel modules image %s: %w", k.cfg.ModulesImage, err)
+		}
+		return findModulesDir(root, version)
+
+	case version != "":
+		return version, filepath.Join("/lib/modules", version), nil
+	}
+
+	release, err := hostKernelRelease(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return release, filepath.Join("/lib/modules", release), nil
+}
+
+// cleanup removes a fetched modules image.
+func (k *guestKernel) cleanup() {
+	if k != nil && k.scratch != "" {
+		os.RemoveAll(k.scratch)
+	}
+}
+
+// findModulesDir locates the module directory of release under root, which
+// is either such a directory itself or a tree containing
+// lib/modules/<release>. An empty release is detected when root holds
+// exactly one.
+func findModulesDir(root, release string) (string, string, error) {
+	if _, err := os.Stat(filepath.Join(root, "modules.dep")); err == nil {
+		if release == "" {
+			release = filepath.Base(root)
+		}
+		return release, root, nil
+	}
+
+	base := filepath.Join(root, "lib", "modules")
+	if release != "" {
+		dir := filepath.Join(base, release)
+		if _, err := os.Stat(dir); err != nil {
+			return "", "", fmt.Errorf("kernel modules for %s not found: %w", release, err)
+		}
+		return release, dir, nil
+	}
+
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return "", "", fmt.Errorf("no kernel modules found in %s: %w", root, err)
+	}
+	var releases []string
+	for _, e := range entries {
+		if e.IsDir() {
+			releases = append(releases, e.Name())
+		}
+	}
+	if len(releases) != 1 {
+		return "", "", fmt.Errorf("found %d kernel releases in %s, set kernel.version to pick one: %v", len(releases), base, releases)
+	}
+	return releases[0], filepath.Join(base, releases[0]), nil
+}
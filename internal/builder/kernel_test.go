@@ -0,0 +1,46 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFindModulesDir tests locating a guest kernel's modules in a module
+// directory or a tree holding lib/modules.
+func TestFindModulesDir(t *testing.T) {
+	root := t.TempDir()
+	for _, release := range []string{"6.1.0-volant", "6.6.0-volant"} {
+		dir := filepath.Join(root, "lib/modules", release)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "modules.dep"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	release, dir, err := findModulesDir(root, "6.6.0-volant")
+	if err != nil || release != "6.6.0-volant" || dir != filepath.Join(root, "lib/modules/6.6.0-volant") {
+		t.Errorf("findModulesDir() = %q, %q, %v", release, dir, err)
+	}
+	if _, _, err := findModulesDir(root, ""); err == nil {
+		t.Error("Expected an ambiguous release to fail")
+	}
+	if _, _, err := findModulesDir(root, "5.10.0"); err == nil {
+		t.Error("Expected a missing release to fail")
+	}
+
+	// A module directory given directly names its release
+	release, dir, err = findModulesDir(filepath.Join(root, "lib/modules/6.1.0-volant"), "")
+	if err != nil || release != "6.1.0-volant" || dir != filepath.Join(root, "lib/modules/6.1.0-volant") {
+		t.Errorf("findModulesDir() = %q, %q, %v", release, dir, err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "lib/modules/6.6.0-volant")); err != nil {
+		t.Fatal(err)
+	}
+	if release, _, err := findModulesDir(root, ""); err != nil || release != "6.1.0-volant" {
+		t.Errorf("Expected the only release to be detected, got %q, %v", release, err)
+	}
+}
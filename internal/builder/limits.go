@@ -0,0 +1,114 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+const (
+	// budgetDirDepth is how deep directories are broken down when an
+	// artifact exceeds its size budget.
+	budgetDirDepth = 2
+	// budgetDirCount is how many of the largest directories are listed.
+	budgetDirCount = 10
+)
+
+// dirSize is the total size of the files below a rootfs directory.
+type dirSize struct {
+	path  string
+	bytes int64
+}
+
+// checkSizeBudget checks the artifact at path against the [limits] key. If
+// it is larger, the largest directories of rootfsDir are logged and the
+// build fails, or only warns with on_exceed = "warn".
+func checkSizeBudget(ctx context.Context, limits *config.LimitsConfig, key, path, rootfsDir string) error {
+	if limits == nil {
+		return nil
+	}
+	maxMB := limits.MaxRootfsMB
+	if key == "max_initramfs_mb" {
+		maxMB = limits.MaxInitramfsMB
+	}
+	if maxMB == 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat artifact: %w", err)
+	}
+	budget := int64(maxMB) << 20
+	if info.Size() <= budget {
+		logging.DebugContext(ctx, "Artifact within size budget", "size", utils.FormatBytes(info.Size()), "budget", utils.FormatBytes(budget))
+		return nil
+	}
+
+	dirs, err := largestDirs(rootfsDir, budgetDirDepth, budgetDirCount)
+	if err != nil {
+		logging.DebugContext(ctx, "Failed to measure rootfs directories", "path", rootfsDir, "error", err)
+	}
+	breakdown := make([]string, len(dirs))
+	for i, d := range dirs {
+		breakdown[i] = fmt.Sprintf("%s %s", d.path, utils.FormatBytes(d.bytes))
+	}
+	msg := fmt.Sprintf("artifact is %s, over the %s budget of limits.%s", utils.FormatBytes(info.Size()), utils.FormatBytes(budget), key)
+	if len(breakdown) > 0 {
+		msg += "; largest directories (unpacked): " + strings.Join(breakdown, ", ")
+	}
+	if limits.OnExceed == config.LimitsWarn {
+		logging.WarnClassContext(ctx, logging.WarnSizeBudget, "Artifact exceeds size budget", "detail", msg)
+		return nil
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// largestDirs returns the n directories up to depth levels below root with
+// the most file content, largest first.
+func largestDirs(root string, depth, n int) ([]dirSize, error) {
+	sizes := make(map[string]int64)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil || rel == "." {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for i := 1; i <= len(parts) && i <= depth; i++ {
+			sizes["/"+strings.Join(parts[:i], "/")] += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]dirSize, 0, len(sizes))
+	for p, b := range sizes {
+		dirs = append(dirs, dirSize{path: p, bytes: b})
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].bytes != dirs[j].bytes {
+			return dirs[i].bytes > dirs[j].bytes
+		}
+		return dirs[i].path < dirs[j].path
+	})
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	return dirs, nil
+}
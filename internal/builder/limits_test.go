@@ -0,0 +1,78 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestLargestDirs tests the directory breakdown of an oversized rootfs.
+func TestLargestDirs(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]int{
+		"usr/lib/libbig.so":  3000,
+		"usr/bin/tool":       1000,
+		"usr/share/doc/a/b":  500,
+		"etc/config":         10,
+		"top-level-file.txt": 99999,
+	}
+	for name, size := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs, err := largestDirs(root, 2, 3)
+	if err != nil {
+		t.Fatalf("largestDirs failed: %v", err)
+	}
+	want := []dirSize{{"/usr", 4500}, {"/usr/lib", 3000}, {"/usr/bin", 1000}}
+	if !reflect.DeepEqual(dirs, want) {
+		t.Errorf("largestDirs() = %v, want %v", dirs, want)
+	}
+}
+
+// TestCheckSizeBudget tests failing and warning on an oversized artifact.
+func TestCheckSizeBudget(t *testing.T) {
+	dir := t.TempDir()
+	artifact := filepath.Join(dir, "initramfs.cpio.gz")
+	if err := os.WriteFile(artifact, make([]byte, 2<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := filepath.Join(dir, "rootfs", "usr")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "blob"), make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rootfsDir := filepath.Join(dir, "rootfs")
+
+	if err := checkSizeBudget(ctx, nil, "max_initramfs_mb", artifact, rootfsDir); err != nil {
+		t.Errorf("Expected no error without limits, got %v", err)
+	}
+	if err := checkSizeBudget(ctx, &config.LimitsConfig{MaxInitramfsMB: 4}, "max_initramfs_mb", artifact, rootfsDir); err != nil {
+		t.Errorf("Expected artifact within budget, got %v", err)
+	}
+
+	err := checkSizeBudget(ctx, &config.LimitsConfig{MaxInitramfsMB: 1}, "max_initramfs_mb", artifact, rootfsDir)
+	if err == nil || !strings.Contains(err.Error(), "max_initramfs_mb") || !strings.Contains(err.Error(), "/usr 1.0 KiB") {
+		t.Errorf("Expected budget error with breakdown, got %v", err)
+	}
+	if err := checkSizeBudget(ctx, &config.LimitsConfig{MaxInitramfsMB: 1, OnExceed: config.LimitsWarn}, "max_initramfs_mb", artifact, rootfsDir); err != nil {
+		t.Errorf("Expected only a warning, got %v", err)
+	}
+	if err := checkSizeBudget(ctx, &config.LimitsConfig{MaxInitramfsMB: 1}, "max_rootfs_mb", artifact, rootfsDir); err != nil {
+		t.Errorf("Expected the rootfs budget to be unset, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/oci"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/report"
+	"github.com/volantvm/fledge/internal/retry"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// pullImage copies the image ref into layoutDir under the "latest" tag,
+// records its pulled size in the build report and its digest in the lock
+// file. With a lock file, images are pulled from their registry by manifest
+// digest even when the local Docker daemon has them: the digest resolved,
+// or in locked mode the one fledge.lock records and checks before pulling,
+// is the registry's and the same on every machine. Only images no registry
+// has, built locally, are copied from the daemon and recorded by the digest
+// of their copy.
+func pullImage(ctx context.Context, tracker *lock.Tracker, role, ref, layoutDir string) error {
+	if tracker == nil {
+		if err := copyImageToLayout(ctx, ref, layoutDir); err != nil {
+			return err
+		}
+		recordImagePull(ctx, role, ref, layoutDir)
+		return nil
+	}
+
+	digest, err := lockedImageDigest(ctx, tracker, role, ref)
+	if err == nil {
+		if err := tracker.RecordImage(lock.Image{Role: role, Ref: ref, Digest: digest}); err != nil {
+			return err
+		}
+		if err = copyRegistryImageToLayout(ctx, pinnedRef(ref, digest), layoutDir); err == nil {
+			recordImagePull(ctx, role, ref, layoutDir)
+			return nil
+		}
+		// A locked digest may be that of a local image's copy
+		if !tracker.Locked() {
+			return err
+		}
+	}
+	if !imageInDaemon(ctx, ref) {
+		return err
+	}
+	logging.DebugContext(ctx, "Image is not in a registry, copying it from the local daemon", "role", role, "ref", ref, "error", err)
+	if err := copyImageToLayout(ctx, ref, layoutDir); err != nil {
+		return err
+	}
+	recordImagePull(ctx, role, ref, layoutDir)
+	if digest, err = oci.ImageDigest(layoutDir, "latest"); err != nil {
+		return fmt.Errorf("failed to read digest of %s: %w", ref, err)
+	}
+	logging.DebugContext(ctx, "Resolved local daemon image", "role", role, "ref", ref, "digest", digest)
+	return tracker.RecordImage(lock.Image{Role: role, Ref: ref, Digest: digest})
+}
+
+// recordImagePull records the image ref pulled into layoutDir in the build
+// report.
+func recordImagePull(ctx context.Context, role, ref, layoutDir string) {
+	if rep := report.FromContext(ctx); rep != nil {
+		size, _ := report.DirSize(filepath.Join(layoutDir, "blobs"))
+		rep.UseTool("skopeo")
+		rep.RecordDownload(report.Download{Kind: role, Source: ref, Bytes: size})
+	}
+}
+
+// imageInDaemon reports whether the local Docker daemon has the image ref.
+func imageInDaemon(ctx context.Context, ref string) bool {
+	return exec.CommandContext(ctx, "skopeo", "inspect", "--format", "{{.Digest}}", "docker-daemon:"+ref).Run() == nil
+}
+
+// lockedImageDigest returns the registry manifest digest of the image ref in
+// role: in locked mode the one fledge.lock records, otherwise the one ref
+// carries or the registry reports.
+func lockedImageDigest(ctx context.Context, tracker *lock.Tracker, role, ref string) (string, error) {
+	if digest, ok := tracker.LockedImage(role, ref); ok {
+		return digest, nil
+	}
+	digest, err := resolveImageDigest(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s image: %w", role, err)
+	}
+	logging.DebugContext(ctx, "Resolved image", "role", role, "ref", ref, "digest", digest)
+	return digest, nil
+}
+
+// pinnedRef returns ref pinned to digest and without its tag, which skopeo
+// does not accept together with a digest.
+func pinnedRef(ref, digest string) string {
+	name, _, _ := strings.Cut(ref, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name + "@" + digest
+}
+
+// recordBusybox hashes a downloaded BusyBox binary into the lock file.
+func recordBusybox(tracker *lock.Tracker, url, path string) error {
+	if tracker == nil {
+		return nil
+	}
+	hash, err := utils.CalculateSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash busybox: %w", err)
+	}
+	return tracker.RecordBusybox(lock.Download{URL: url, Digest: "sha256:" + hash})
+}
+
+// pinFrontendImage resolves a Dockerfile frontend image to a digest, records
+// it and returns the reference pinned to that digest so BuildKit runs exactly
+// the recorded frontend; in locked mode the digest of fledge.lock is used.
+// Without a tracker ref is returned unchanged.
+func pinFrontendImage(ctx context.Context, ref string, tracker *lock.Tracker) (string, error) {
+	if ref == "" || tracker == nil {
+		return ref, nil
+	}
+
+	digest, err := lockedImageDigest(ctx, tracker, lock.RoleFrontend, ref)
+	if err != nil {
+		return "", err
+	}
+	if err := tracker.RecordImage(lock.Image{Role: lock.RoleFrontend, Ref: ref, Digest: digest}); err != nil {
+		return "", err
+	}
+	return pinnedRef(ref, digest), nil
+}
+
+// inspectImageDigest returns the registry manifest digest of ref, retrying
+// transient registry failures.
+func inspectImageDigest(ctx context.Context, ref string) (string, error) {
+	var output []byte
+	err := retry.FromContext(ctx).Network.Do(ctx, "skopeo inspect "+ref, func(ctx context.Context) error {
+		var err error
+		output, err = exec.CommandContext(ctx, "skopeo", "inspect", "--format", "{{.Digest}}", "docker://"+ref).CombinedOutput()
+		if err != nil {
+			return classifySkopeo(fmt.Errorf("skopeo inspect failed: %w\nOutput: %s", err, string(output)), output)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	digest := strings.TrimSpace(string(output))
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unexpected digest %q from skopeo inspect", digest)
+	}
+	return digest, nil
+}
+
+// resolveRemoteMappings returns mappings with every remote source replaced by
+// the path of its verified, cached download, recording each in the lock file.
+// Local sources are returned unchanged.
+func resolveRemoteMappings(ctx context.Context, mappings map[string]string, tracker *lock.Tracker) (map[string]string, error) {
+	resolved := make(map[string]string, len(mappings))
+	for src, dst := range mappings {
+		remote, ok, err := config.ParseRemoteSource(src)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			resolved[src] = dst
+			continue
+		}
+
+		logging.InfoContext(ctx, "Fetching remote mapping source", "url", remote.URL, "dest", dst)
+		path, cached, err := utils.DownloadCached(ctx, remote.URL, remote.Checksum, progress.Bars())
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", remote.URL, err)
+		}
+		recordFileDownload(ctx, "mapping", remote.URL, path, cached)
+		if err := tracker.RecordDownload(lock.Download{URL: remote.URL, Digest: remote.Checksum}); err != nil {
+			return nil, err
+		}
+		resolved[path] = dst
+	}
+	return resolved, nil
+}
@@ -0,0 +1,185 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// TestPinFrontendImage tests pinning frontend images that already carry a digest.
+func TestPinFrontendImage(t *testing.T) {
+	const ref = "docker/dockerfile:1.7-labs@sha256:2a7d0f1a0ff6d1b2e3e4f5a6b7c8d9e0f1a2b3c4d5e6f708192a3b4c5d6e7f80"
+
+	if got, err := pinFrontendImage(context.Background(), "docker/dockerfile:1.7-labs", nil); err != nil || got != "docker/dockerfile:1.7-labs" {
+		t.Errorf("Expected unchanged reference without a tracker, got %q (%v)", got, err)
+	}
+
+	tracker, err := lock.Open(filepath.Join(t.TempDir(), lock.FileName), false)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err := pinFrontendImage(context.Background(), ref, tracker)
+	if err != nil {
+		t.Fatalf("pinFrontendImage failed: %v", err)
+	}
+	// skopeo and BuildKit take a digest without the tag
+	if want := "docker/dockerfile@sha256:2a7d0f1a0ff6d1b2e3e4f5a6b7c8d9e0f1a2b3c4d5e6f708192a3b4c5d6e7f80"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+// TestPinFrontendImage_Locked tests that locked builds take the frontend
+// digest from fledge.lock instead of the registry.
+func TestPinFrontendImage_Locked(t *testing.T) {
+	const digest = "sha256:2a7d0f1a0ff6d1b2e3e4f5a6b7c8d9e0f1a2b3c4d5e6f708192a3b4c5d6e7f80"
+	path := filepath.Join(t.TempDir(), lock.FileName)
+	tracker, _ := lock.Open(path, false)
+	tracker.RecordImage(lock.Image{Role: lock.RoleFrontend, Ref: "docker/dockerfile:1", Digest: digest})
+	if err := tracker.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	locked, err := lock.Open(path, true)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err := pinFrontendImage(context.Background(), "docker/dockerfile:1", locked)
+	if err != nil {
+		t.Fatalf("pinFrontendImage failed: %v", err)
+	}
+	if got != "docker/dockerfile@"+digest {
+		t.Errorf("Expected the locked digest, got %s", got)
+	}
+}
+
+// TestPullImage_LockedChecksFirst tests that a locked build fails for an
+// image missing from fledge.lock before pulling anything.
+func TestPullImage_LockedChecksFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lock.FileName)
+	tracker, _ := lock.Open(path, false)
+	if err := tracker.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	locked, err := lock.Open(path, true)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	layoutDir := t.TempDir()
+	ref := "registry.invalid/app@sha256:" + strings.Repeat("a", 64)
+	err = pullImage(context.Background(), locked, lock.RoleSource, ref, layoutDir)
+	if err == nil || !strings.Contains(err.Error(), "is not recorded") {
+		t.Fatalf("Expected an error for an unrecorded image, got %v", err)
+	}
+	if entries, _ := os.ReadDir(layoutDir); len(entries) != 0 {
+		t.Errorf("Expected nothing to be pulled, got %d entries", len(entries))
+	}
+}
+
+// TestPullImage_BypassesDaemon tests that a tracked pull takes the image
+// from its registry by digest, even when the local daemon has it, so the
+// recorded digest is the registry's.
+func TestPullImage_BypassesDaemon(t *testing.T) {
+	const digest = "sha256:2a7d0f1a0ff6d1b2e3e4f5a6b7c8d9e0f1a2b3c4d5e6f708192a3b4c5d6e7f80"
+	bin := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	// Every image is in the daemon; the registry reports digest
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\ncase \"$*\" in *docker://*) [ \"$1\" = inspect ] && echo " + digest + " ;; esac\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(bin, "skopeo"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write skopeo: %v", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tracker, _ := lock.Open(filepath.Join(t.TempDir(), lock.FileName), false)
+	if err := pullImage(context.Background(), tracker, lock.RoleSource, "nginx:alpine", t.TempDir()); err != nil {
+		t.Fatalf("pullImage failed: %v", err)
+	}
+	data, _ := os.ReadFile(calls)
+	if !strings.Contains(string(data), "copy docker://nginx@"+digest) || strings.Contains(string(data), "copy docker-daemon:") {
+		t.Errorf("Expected a registry pull by digest only, got calls:\n%s", data)
+	}
+	if images := tracker.Resolved().Images; len(images) != 1 || images[0].Digest != digest {
+		t.Errorf("Expected the registry digest to be recorded, got %+v", images)
+	}
+}
+
+// TestPinnedRef tests pinning references, with registry ports and tags.
+func TestPinnedRef(t *testing.T) {
+	const digest = "sha256:abc"
+	for ref, want := range map[string]string{
+		"nginx:alpine":                  "nginx@sha256:abc",
+		"nginx":                         "nginx@sha256:abc",
+		"localhost:5000/app":            "localhost:5000/app@sha256:abc",
+		"localhost:5000/app:v1":         "localhost:5000/app@sha256:abc",
+		"ghcr.io/org/app:v1@sha256:abc": "ghcr.io/org/app@sha256:abc",
+	} {
+		if got := pinnedRef(ref, digest); got != want {
+			t.Errorf("pinnedRef(%q) = %q, want %q", ref, got, want)
+		}
+	}
+}
+
+// TestResolveRemoteMappings tests downloading, verifying and caching URL sources.
+func TestResolveRemoteMappings(t *testing.T) {
+	t.Setenv("FLEDGE_CACHE_DIR", t.TempDir())
+	content := []byte("model weights")
+	sum := sha256.Sum256(content)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	url := srv.URL + "/model.bin"
+	mappings := map[string]string{
+		url + " " + checksum: "/opt/models/model.bin",
+		"./app":              "/usr/bin/app",
+	}
+	tracker, _ := lock.Open(filepath.Join(t.TempDir(), lock.FileName), false)
+	rep := report.New("test", "oci_rootfs", "")
+	ctx := report.NewContext(context.Background(), rep)
+
+	for i := 0; i < 2; i++ {
+		resolved, err := resolveRemoteMappings(ctx, mappings, tracker)
+		if err != nil {
+			t.Fatalf("resolveRemoteMappings failed: %v", err)
+		}
+		if resolved["./app"] != "/usr/bin/app" {
+			t.Errorf("Expected local mapping to be kept, got %v", resolved)
+		}
+		var cached string
+		for src, dst := range resolved {
+			if dst == "/opt/models/model.bin" {
+				cached = src
+			}
+		}
+		data, err := os.ReadFile(cached)
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("Expected cached download with model content, got %q (%v)", data, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the second resolution to use the cache, got %d requests", requests)
+	}
+	if rep.Cache.DownloadHits != 1 || rep.Cache.DownloadMisses != 1 || rep.DownloadedBytes != int64(len(content)) {
+		t.Errorf("Expected one cache hit and one download in the report, got %+v (%d bytes)", rep.Cache, rep.DownloadedBytes)
+	}
+
+	bad := map[string]string{srv.URL + "/other.bin sha256:" + strings.Repeat("0", 64): "/opt/other.bin"}
+	if _, err := resolveRemoteMappings(context.Background(), bad, nil); err == nil {
+		t.Errorf("Expected checksum mismatch error")
+	}
+}
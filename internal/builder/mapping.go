@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -209,9 +210,10 @@ func CopyFile(src, dst string, mode os.FileMode) error {
 	return nil
 }
 
-// CopyDirectory recursively copies a directory from source to destination.
-func CopyDirectory(src, dst string, baseMode os.FileMode) error {
-	logging.Debug("Copying directory", "src", src, "dst", dst)
+// CopyDirectory recursively copies a directory from source to destination,
+// stopping between files once ctx is cancelled.
+func CopyDirectory(ctx context.Context, src, dst string, baseMode os.FileMode) error {
+	logging.DebugContext(ctx, "Copying directory", "src", src, "dst", dst)
 
 	// Create the destination directory
 	if err := os.MkdirAll(dst, 0755); err != nil {
@@ -226,12 +228,15 @@ func CopyDirectory(src, dst string, baseMode os.FileMode) error {
 
 	// Copy each entry
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		srcPath := filepath.Join(src, entry.Name())
 		dstPath := filepath.Join(dst, entry.Name())
 
 		if entry.IsDir() {
 			// Recursively copy subdirectories
-			if err := CopyDirectory(srcPath, dstPath, baseMode); err != nil {
+			if err := CopyDirectory(ctx, srcPath, dstPath, baseMode); err != nil {
 				return err
 			}
 		} else {
@@ -255,19 +260,22 @@ func CopyDirectory(src, dst string, baseMode os.FileMode) error {
 }
 
 // ApplyFileMappings applies all file mappings to the target directory.
-func ApplyFileMappings(mappings []FileMapping, targetDir string) error {
+func ApplyFileMappings(ctx context.Context, mappings []FileMapping, targetDir string) error {
 	if len(mappings) == 0 {
-		logging.Info("No file mappings to apply")
+		logging.InfoContext(ctx, "No file mappings to apply")
 		return nil
 	}
 
-	logging.Info("Applying file mappings", "count", len(mappings), "target", targetDir)
+	logging.InfoContext(ctx, "Applying file mappings", "count", len(mappings), "target", targetDir)
 
 	for i, mapping := range mappings {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		dstPath := filepath.Join(targetDir, strings.TrimPrefix(mapping.Destination, "/"))
 
 		if mapping.IsDirectory {
-			if err := CopyDirectory(mapping.Source, dstPath, mapping.Mode); err != nil {
+			if err := CopyDirectory(ctx, mapping.Source, dstPath, mapping.Mode); err != nil {
 				return fmt.Errorf("failed to copy directory %s -> %s: %w",
 					mapping.Source, mapping.Destination, err)
 			}
@@ -278,13 +286,13 @@ func ApplyFileMappings(mappings []FileMapping, targetDir string) error {
 			}
 		}
 
-		logging.Info("Applied mapping",
+		logging.InfoContext(ctx, "Applied mapping",
 			"index", i+1,
 			"total", len(mappings),
 			"src", mapping.Source,
 			"dst", mapping.Destination)
 	}
 
-	logging.Info("All file mappings applied successfully")
+	logging.InfoContext(ctx, "All file mappings applied successfully")
 	return nil
 }
@@ -1,6 +1,8 @@
 package builder
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -301,7 +303,7 @@ func TestCopyDirectory(t *testing.T) {
 
 	// Copy directory
 	dstDir := filepath.Join(tmpDir, "dest")
-	if err := CopyDirectory(srcDir, dstDir, 0755); err != nil {
+	if err := CopyDirectory(context.Background(), srcDir, dstDir, 0755); err != nil {
 		t.Fatalf("CopyDirectory failed: %v", err)
 	}
 
@@ -347,7 +349,7 @@ func TestApplyFileMappings(t *testing.T) {
 
 	// Apply mappings to target
 	targetDir := filepath.Join(tmpDir, "target")
-	if err := ApplyFileMappings(mappings, targetDir); err != nil {
+	if err := ApplyFileMappings(context.Background(), mappings, targetDir); err != nil {
 		t.Fatalf("ApplyFileMappings failed: %v", err)
 	}
 
@@ -383,3 +385,23 @@ func TestNormalizeExecutableMode(t *testing.T) {
 		})
 	}
 }
+
+// TestApplyFileMappings_Cancelled tests that mappings are not applied once ctx is cancelled.
+func TestApplyFileMappings_Cancelled(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "app")
+	if err := os.WriteFile(src, []byte("bin"), 0755); err != nil {
+		t.Fatalf("Failed to create source: %v", err)
+	}
+	targetDir := filepath.Join(tmpDir, "rootfs")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mappings := []FileMapping{{Source: src, Destination: "/usr/bin/app", Mode: 0755}}
+	if err := ApplyFileMappings(ctx, mappings, targetDir); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "usr", "bin", "app")); !os.IsNotExist(err) {
+		t.Errorf("Expected mapping to be skipped, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package builder
+
+import (
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/vmnet"
+)
+
+// networkOptions returns the step VM network options for cfg's
+// [build.network], which has already been validated.
+func networkOptions(cfg *config.Config) vmnet.Options {
+	o := vmnet.Defaults()
+	if cfg == nil || cfg.Build == nil {
+		o.Proxy = vmnet.ProxyFromEnv()
+		return o
+	}
+	o.Proxy = proxySettings(cfg.Build.Proxy)
+	if c := cfg.Build.PackageCache; c != nil && c.Enabled {
+		o.PackageCache = vmnet.PackageCache{Enabled: true, Dir: c.Dir, MaxBytes: int64(c.MaxSizeMB) << 20}
+	}
+	n := cfg.Build.Network
+	if n == nil {
+		return o
+	}
+	if n.Mode != "" {
+		o.Mode = vmnet.Mode(n.Mode)
+	}
+	if n.Provider != "" {
+		o.Provider = vmnet.Provider(n.Provider)
+	}
+	o.Pool, o.Gateway, o.Netmask, o.Bridge = n.Pool, n.Gateway, n.Netmask, n.Bridge
+	return o
+}
+
+// proxySettings merges [build.proxy] over the proxy of fledge's environment.
+func proxySettings(pc *config.ProxyConfig) vmnet.Proxy {
+	var p vmnet.Proxy
+	if pc == nil || pc.Inherit == nil || *pc.Inherit {
+		p = vmnet.ProxyFromEnv()
+	}
+	if pc == nil {
+		return p
+	}
+	if pc.HTTP != "" {
+		p.HTTP = pc.HTTP
+	}
+	if pc.HTTPS != "" {
+		p.HTTPS = pc.HTTPS
+	}
+	if pc.NoProxy != "" {
+		p.NoProxy = pc.NoProxy
+	}
+	return p
+}
+
+// withProxyBuildArgs returns args plus BuildKit's predefined proxy args for
+// p, without overriding args the build sets itself.
+func withProxyBuildArgs(args map[string]string, p vmnet.Proxy) map[string]string {
+	env := p.Env()
+	if len(env) == 0 {
+		return args
+	}
+	merged := make(map[string]string, len(args)+len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		merged[k] = v
+	}
+	for k, v := range args {
+		merged[k] = v
+	}
+	return merged
+}
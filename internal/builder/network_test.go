@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/vmnet"
+)
+
+// TestNetworkOptions tests that [build.network] selects the step VM network mode.
+func TestNetworkOptions(t *testing.T) {
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	if got := networkOptions(&config.Config{}); got != vmnet.Defaults() {
+		t.Errorf("Expected defaults without [build.network], got %+v", got)
+	}
+	cfg := &config.Config{Build: &config.BuildConfig{Network: &config.BuildNetworkConfig{Mode: "dhcp", Provider: "pool", Bridge: "br0"}}}
+	got := networkOptions(cfg)
+	if got.Mode != vmnet.ModeDHCP || got.Provider != vmnet.ProviderPool || got.Bridge != "br0" {
+		t.Errorf("Expected dhcp mode from the br0 pool, got %+v", got)
+	}
+}
+
+// TestNetworkOptions_Proxy tests merging [build.proxy] over the host proxy and
+// passing it as build args.
+func TestNetworkOptions_Proxy(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://host-proxy:3128")
+	t.Setenv("NO_PROXY", "localhost")
+
+	cfg := &config.Config{Build: &config.BuildConfig{Proxy: &config.ProxyConfig{HTTPS: "http://secure:3128"}}}
+	got := networkOptions(cfg).Proxy
+	want := vmnet.Proxy{HTTP: "http://host-proxy:3128", HTTPS: "http://secure:3128", NoProxy: "localhost"}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	inherit := false
+	cfg.Build.Proxy.Inherit = &inherit
+	if got := networkOptions(cfg).Proxy; got.HTTP != "" || got.NoProxy != "" {
+		t.Errorf("Expected the host proxy to be ignored, got %+v", got)
+	}
+
+	args := withProxyBuildArgs(map[string]string{"HTTP_PROXY": "http://override:8080"}, want)
+	if args["HTTP_PROXY"] != "http://override:8080" || args["https_proxy"] != "http://secure:3128" {
+		t.Errorf("Unexpected build args %v", args)
+	}
+}
+
+// TestNetworkOptions_PackageCache tests that [build.package_cache] enables the
+// worker's package cache.
+func TestNetworkOptions_PackageCache(t *testing.T) {
+	cfg := &config.Config{Build: &config.BuildConfig{PackageCache: &config.PackageCacheConfig{Enabled: true, MaxSizeMB: 512}}}
+	got := networkOptions(cfg).PackageCache
+	if !got.Enabled || got.MaxBytes != 512<<20 {
+		t.Errorf("Expected an enabled 512 MiB cache, got %+v", got)
+	}
+}
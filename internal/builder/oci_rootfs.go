@@ -1,7 +1,6 @@
 package builder
 
 import (
-	"bufio"
 	"context"
 	"crypto/sha256"
 	"encoding/json"
@@ -10,30 +9,23 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
 	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/oci"
+	"github.com/volantvm/fledge/internal/privsep"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/report"
+	"github.com/volantvm/fledge/internal/retry"
+	"github.com/volantvm/fledge/internal/telemetry"
+	"github.com/volantvm/fledge/internal/vmnet"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// OCIIndex represents the OCI index.json structure
-type OCIIndex struct {
-	Manifests []OCIManifest `json:"manifests"`
-}
-
-// OCIManifest represents an OCI manifest entry
-type OCIManifest struct {
-	Config OCIDescriptor `json:"config"`
-}
-
-// OCIDescriptor represents an OCI descriptor with digest
-type OCIDescriptor struct {
-	Digest string `json:"digest"`
-}
-
 // OCIRootfsBuilder builds OCI rootfs filesystem images.
 type OCIRootfsBuilder struct {
 	Config          *config.Config
@@ -41,13 +33,49 @@ type OCIRootfsBuilder struct {
 	WorkDir         string
 	OutputPath      string
 	TempDir         string
+	// TempRoot is where TempDir is created; empty uses TMPDIR.
+	TempRoot        string
 	OciLayoutPath   string
 	UnpackedPath    string
 	ImagePath       string
-	MountPoint      string
-	LoopDevicePath  string
 	EphemeralTag    string
 	RootfsReady     bool
+	ImageConfig     *ocispec.Image
+	// Lock records resolved remote inputs and, in locked mode, checks them.
+	Lock            *lock.Tracker
+	Agent           *ResolvedAgent
+	// Report collects step timings and statistics; nil disables reporting.
+	Report          *report.Report
+	// TrackSizes attributes the rootfs to the steps that wrote it; the
+	// result is stored in SizeBreakdown and the report.
+	TrackSizes      bool
+	SizeBreakdown   *report.SizeBreakdown
+	sizes           *sizeTracker
+	kernel          *guestKernel
+	// CopyDeps copies shared libraries that mapped executables need from
+	// the host instead of only warning that they are missing.
+	CopyDeps        bool
+	// SkipVerify skips the consistency check of the finished image.
+	SkipVerify      bool
+	// checksum is the SHA256 of the verified image.
+	checksum        string
+	// Checksums lists the algorithms <output>.<algorithm> checksum files
+	// are written for.
+	Checksums       []string
+	// SBOM writes an SPDX document of the artifact and its resolved inputs
+	// to <output>.spdx.json.
+	SBOM            bool
+	// OnStep, if set, is called as each build step starts and finishes.
+	OnStep          func(StepEvent)
+	// Privileged is the root helper of a build that dropped privileges;
+	// ownership, mounts and the tools reading the finished rootfs go
+	// through it. Nil runs everything in this process.
+	Privileged      *privsep.Helper
+	// rootfsSize is the rootfs size measured before packaging.
+	rootfsSize      int64
+
+	// ctx is the context of the running build step.
+	ctx context.Context
 }
 
 // NewOCIRootfsBuilder creates a new OCI rootfs builder.
@@ -62,6 +90,28 @@ func NewOCIRootfsBuilder(cfg *config.Config, manifestTpl *config.ManifestTemplat
 
 // Build creates the OCI rootfs filesystem image.
 func (b *OCIRootfsBuilder) Build() error {
+	return b.BuildContext(context.Background())
+}
+
+// Checksum returns the SHA256 of the finished image, once the build
+// succeeded.
+func (b *OCIRootfsBuilder) Checksum() string {
+	return b.checksum
+}
+
+// BuildContext is like Build but traces the build and each step as spans
+// under ctx.
+func (b *OCIRootfsBuilder) BuildContext(ctx context.Context) (err error) {
+	ctx, span := telemetry.Start(ctx, "fledge.build",
+		attribute.String("fledge.strategy", config.StrategyOCIRootfs),
+		attribute.String("fledge.filesystem", b.Config.Filesystem.Type))
+	defer func() { telemetry.End(span, err) }()
+	ctx = report.NewContext(ctx, b.Report)
+	ctx = retry.NewContext(ctx, retryPolicies(b.Config))
+	ctx = vmnet.NewContext(ctx, networkOptions(b.Config))
+	ctx = logging.NewContext(ctx, logging.KeyStrategy, config.StrategyOCIRootfs)
+	b.ctx = ctx
+
 	// Adjust output extension based on filesystem type
 	if b.Config.Filesystem.Type == "squashfs" && !strings.HasSuffix(b.OutputPath, ".squashfs") {
 		// Replace .img with .squashfs if using squashfs
@@ -72,10 +122,10 @@ func (b *OCIRootfsBuilder) Build() error {
 		}
 	}
 
-	logging.Info("Building OCI rootfs", "output", b.OutputPath, "type", b.Config.Filesystem.Type)
+	logging.InfoContext(b.stepContext(), "Building OCI rootfs", "output", b.OutputPath, "type", b.Config.Filesystem.Type)
 
 	// Create temporary directory
-	tmpDir, err := os.MkdirTemp("", "fledge-oci-*")
+	tmpDir, err := os.MkdirTemp(b.TempRoot, "fledge-oci-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
@@ -84,7 +134,7 @@ func (b *OCIRootfsBuilder) Build() error {
 	if os.Getenv("FLEDGE_KEEP_TEMP") == "" {
 		defer os.RemoveAll(tmpDir)
 	} else {
-		logging.Info("Keeping temp directory for debugging", "path", tmpDir)
+		logging.InfoContext(b.stepContext(), "Keeping temp directory for debugging", "path", tmpDir)
 	}
 	defer b.cleanup()
 
@@ -98,201 +148,337 @@ func (b *OCIRootfsBuilder) Build() error {
 		tempExt = ".squashfs"
 	}
 	b.ImagePath = filepath.Join(tmpDir, "fs-image"+tempExt)
-	b.MountPoint = filepath.Join(tmpDir, "mnt")
 
-	logging.Debug("Created temporary directories", "temp", tmpDir)
+	logging.DebugContext(b.stepContext(), "Created temporary directories", "temp", tmpDir)
 
 	// Create required directories
-	for _, dir := range []string{b.OciLayoutPath, b.UnpackedPath, b.MountPoint} {
+	for _, dir := range []string{b.OciLayoutPath, b.UnpackedPath} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
 
-	// Build steps differ based on filesystem type
-	var steps []struct {
-		name string
-		fn   func() error
+	if err := checkSpace(b.preflightNeeds()...); err != nil {
+		return err
 	}
 
-	if b.Config.Filesystem.Type == "squashfs" {
-		// Squashfs pipeline: Build rootfs → Install agent → Create squashfs
-		steps = []struct {
-			name string
-			fn   func() error
-		}{
-			{"Build Dockerfile (if provided)", b.buildDockerfileIfNeeded},
-			{"Download OCI image", b.downloadOCIImage},
-			{"Unpack image layers", b.unpackOCIImage},
-			{"Extract OCI config", b.extractOCIConfig},
-			{"Install kestrel agent", b.installAgent},
-			{"Apply file mappings", b.applyMappings},
-			{"Create squashfs image", b.createSquashfs},
-			{"Move to final location", b.moveToFinal},
-		}
-	} else {
-		// Legacy ext4/xfs/btrfs pipeline: Build rootfs → Create image → Mount → Copy → Shrink
-		steps = []struct {
-			name string
-			fn   func() error
-		}{
-			{"Build Dockerfile (if provided)", b.buildDockerfileIfNeeded},
-			{"Download OCI image", b.downloadOCIImage},
-			{"Unpack image layers", b.unpackOCIImage},
-			{"Extract OCI config", b.extractOCIConfig},
-			{"Install kestrel agent", b.installAgent},
-			{"Apply file mappings", b.applyMappings},
-			{"Calculate disk size", b.createImageFile},
-			{"Create filesystem", b.createFilesystem},
-			{"Mount image", b.mountImage},
-			{"Copy rootfs to image", b.copyRootfsToImage},
-			{"Unmount image", b.unmountImage},
-			{"Shrink to optimal size", b.shrinkFilesystem},
-			{"Move to final location", b.moveToFinal},
-		}
-	}
+	// The rootfs is assembled the same way for every filesystem; packaging
+	// it is up to the filesystem's pipeline
+	pipeline := newImagePipeline(b)
+	defer pipeline.release()
+	steps := append(b.assemblySteps(), pipeline.steps()...)
+	steps = append(steps,
+		buildStep{"Check size budget", b.enforceSizeBudget},
+		buildStep{"Verify image", b.verifyImage},
+		buildStep{"Move to final location", b.moveToFinal},
+	)
 
+	b.kernel = newGuestKernel(b.Config.Kernel, b.WorkDir, b.Lock)
+	defer b.kernel.cleanup()
+	if b.TrackSizes {
+		b.sizes = newSizeTracker()
+	}
 	for _, step := range steps {
-		logging.Info(step.name)
-		if err := step.fn(); err != nil {
+		logging.InfoContext(b.stepContext(), step.name)
+		if err := b.runStep(ctx, step.name, step.fn); err != nil {
 			return fmt.Errorf("%s failed: %w", step.name, err)
 		}
 	}
+	if b.sizes != nil {
+		b.SizeBreakdown = b.sizes.breakdown()
+		b.Report.RecordSizeBreakdown(b.SizeBreakdown)
+	}
 
 	// Generate manifest.json (merge template + build metadata)
-	logging.Info("Generating manifest.json")
-	if err := b.generateManifest(); err != nil {
+	logging.InfoContext(b.stepContext(), "Generating manifest.json")
+	if err := b.runStep(ctx, "Generate manifest", b.generateManifest); err != nil {
 		return fmt.Errorf("manifest generation failed: %w", err)
 	}
+	if processors := buildPostProcessors(b.Config); len(processors) > 0 {
+		if err := b.runStep(ctx, "Post-process artifact", func() error {
+			checksum, err := postProcess(b.stepContext(), processors, config.StrategyOCIRootfs, b.OutputPath, b.WorkDir, b.checksum)
+			if err != nil {
+				return err
+			}
+			b.checksum = checksum
+			b.Report.RecordChecksum(checksum)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("post-processing failed: %w", err)
+		}
+	}
+	if err := b.runStep(ctx, "Write checksums", func() error {
+		return writeChecksumFiles(b.stepContext(), b.OutputPath, b.checksum, b.Checksums)
+	}); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	if b.SBOM {
+		if err := b.runStep(ctx, "Write SBOM", func() error {
+			return writeSBOM(b.stepContext(), b.OutputPath, b.checksum, b.Lock.Resolved())
+		}); err != nil {
+			return fmt.Errorf("failed to write SBOM: %w", err)
+		}
+	}
+	b.Report.RecordArtifact(b.OutputPath)
 
-	logging.Info("OCI rootfs build complete", "output", b.OutputPath)
+	logging.InfoContext(b.stepContext(), "OCI rootfs build complete", "output", b.OutputPath)
 	return nil
 }
 
-// downloadOCIImage downloads the OCI image using skopeo.
-func (b *OCIRootfsBuilder) downloadOCIImage() error {
-	imageRef := b.Config.Source.Image
-
-	if b.RootfsReady {
-		logging.Debug("Skipping OCI image download: rootfs built via BuildKit")
-		return nil
+// assemblySteps returns the steps that assemble the rootfs directory.
+func (b *OCIRootfsBuilder) assemblySteps() []buildStep {
+	return []buildStep{
+		{"Build Dockerfile (if provided)", b.buildDockerfileIfNeeded},
+		{"Download OCI image", b.downloadOCIImage},
+		{"Unpack image layers", b.unpackOCIImage},
+		{"Merge source layers", b.mergeSourceLayers},
+		{"Extract OCI config", b.extractOCIConfig},
+		{"Install kestrel agent", b.installAgent},
+		{"Apply file mappings", b.applyMappings},
+		{"Create users and groups", b.createAccounts},
+		{"Apply system configuration", b.applySystemConfig},
+		{"Install GPU driver", b.installGPUDriver},
+		{"Generate systemd unit", b.writeSystemdUnit},
+		{"Prepare read-only root", b.prepareReadOnlyRoot},
+		{"Check shared library dependencies", b.checkLibraries},
+		{"Apply SELinux labels", b.relabelRootfs},
+		{"Apply ownership", b.applyOwnership},
 	}
-	// Try local Docker daemon first
-	cmd := exec.Command("skopeo", "copy",
-		fmt.Sprintf("docker-daemon:%s", imageRef),
-		fmt.Sprintf("oci:%s:latest", b.OciLayoutPath))
+}
 
-	output, err := cmd.CombinedOutput()
-	if err == nil {
-		logging.Debug("Copied from local Docker daemon")
-		return nil
+// runStep runs fn as a traced and timed build step, making its span the
+// parent of anything fn starts. Steps are skipped once ctx is cancelled.
+func (b *OCIRootfsBuilder) runStep(ctx context.Context, name string, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	start := time.Now()
+	ctx = logging.NewContext(ctx, logging.KeyStep, name)
+	logging.DebugContext(ctx, "Step started")
+	notifyStep(b.OnStep, StepEvent{Name: name})
+	err := telemetry.Step(ctx, name, func(ctx context.Context) error {
+		parent := b.ctx
+		b.ctx = ctx
+		defer func() { b.ctx = parent }()
+		return fn()
+	})
+	b.Report.RecordStep(name, time.Since(start), err)
+	notifyStep(b.OnStep, StepEvent{Name: name, Done: true, Duration: time.Since(start), Err: err})
+	logging.DebugContext(ctx, "Step finished", "duration", time.Since(start).Round(time.Millisecond), "error", err)
+	b.observeSizes(name)
+	return explainNoSpace(err)
+}
 
-	logging.Debug("Local Docker daemon copy failed, trying remote registry",
-		"error", string(output))
+// observeSizes attributes the rootfs files written by step to its source.
+func (b *OCIRootfsBuilder) observeSizes(step string) {
+	if b.sizes == nil {
+		return
+	}
+	source, ok := map[string]string{
+		"Build Dockerfile (if provided)":    sizeSourceDockerfile,
+		"Unpack image layers":               imageSizeSource(b.Config),
+		"Merge source layers":               sizeSourceLayers,
+		"Install kestrel agent":             sizeSourceAgent,
+		"Apply file mappings":               sizeSourceMappings,
+		"Create users and groups":           sizeSourceFledge,
+		"Apply system configuration":        sizeSourceModules,
+		"Install GPU driver":                sizeSourceGPU,
+		"Generate systemd unit":             sizeSourceFledge,
+		"Prepare read-only root":            sizeSourceFledge,
+		"Check shared library dependencies": sizeSourceMappings,
+	}[step]
+	if !ok {
+		return
+	}
+	if err := b.sizes.observe(filepath.Join(b.UnpackedPath, "rootfs"), source); err != nil {
+		logging.WarnContext(b.stepContext(), "Failed to measure rootfs; no size breakdown", "error", err)
+		b.sizes = nil
+	}
+}
 
-	// Try remote registry
-	cmd = exec.Command("skopeo", "copy",
-		fmt.Sprintf("docker://%s", imageRef),
-		fmt.Sprintf("oci:%s:latest", b.OciLayoutPath))
+// stepContext returns the context of the running step.
+func (b *OCIRootfsBuilder) stepContext() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
 
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("skopeo copy failed: %w\nOutput: %s", err, string(output))
+// preflightNeeds estimates the space the build needs before it starts. For
+// images the compressed size is looked up; the unpacked rootfs and the
+// filesystem image are derived from it.
+func (b *OCIRootfsBuilder) preflightNeeds() []spaceNeed {
+	if b.Config.Source.Dockerfile != "" {
+		return append(buildKitNeed(), spaceNeed{"build workspace", b.TempDir, minTempSpace})
 	}
+	compressed := estimateImageSize(b.stepContext(), b.Config.Source.Image)
+	if compressed == 0 {
+		return []spaceNeed{{"build workspace", b.TempDir, minTempSpace}}
+	}
+	unpacked := compressed * unpackRatio
+	image := unpacked
+	if b.Config.Filesystem.Type == "squashfs" {
+		image = unpacked / squashfsRatio
+	}
+	return append([]spaceNeed{
+		{"pulled image", b.TempDir, compressed},
+		{"unpacked rootfs", b.TempDir, unpacked},
+	}, b.imageNeeds(image)...)
+}
 
-	logging.Debug("Copied from remote registry")
-	return nil
+// imageNeeds returns the space needed to write a filesystem image of size
+// bytes in the temp directory and move it to the output directory.
+func (b *OCIRootfsBuilder) imageNeeds(size int64) []spaceNeed {
+	needs := []spaceNeed{{"filesystem image", b.TempDir, size}}
+	outDir := filepath.Dir(b.OutputPath)
+	if !sameFilesystem(b.TempDir, outDir) {
+		needs = append(needs, spaceNeed{"output", outDir, size})
+	}
+	return needs
 }
 
-// unpackOCIImage unpacks the OCI image layers using umoci.
-func (b *OCIRootfsBuilder) unpackOCIImage() error {
+// downloadOCIImage downloads the OCI image using skopeo.
+func (b *OCIRootfsBuilder) downloadOCIImage() error {
+	imageRef := b.Config.Source.Image
+
 	if b.RootfsReady {
-		logging.Debug("Skipping OCI unpack: rootfs built via BuildKit")
+		logging.DebugContext(b.stepContext(), "Skipping OCI image download: rootfs built via BuildKit")
 		return nil
 	}
-	cmd := exec.Command("umoci", "unpack",
-		"--image", fmt.Sprintf("%s:latest", b.OciLayoutPath),
-		b.UnpackedPath)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("umoci unpack failed: %w\nOutput: %s", err, string(output))
+	if b.Config.Binary != nil {
+		logging.DebugContext(b.stepContext(), "Skipping OCI image download: rootfs assembled from host executables")
+		return nil
 	}
-
-	return nil
-}
-
-// extractOCIConfig extracts the OCI config and saves it to /etc/fsify-entrypoint.
-func (b *OCIRootfsBuilder) extractOCIConfig() error {
-	configPath := filepath.Join(b.OciLayoutPath, "blobs", "sha256")
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		logging.Debug("No config blobs found, skipping OCI config extraction")
+	if b.Config.Source.Artifact != "" {
+		logging.DebugContext(b.stepContext(), "Skipping OCI image download: rootfs extracted from an artifact")
 		return nil
 	}
+	return pullImage(b.stepContext(), b.Lock, lock.RoleSource, imageRef, b.OciLayoutPath)
+}
 
-	// Read index.json
-	indexPath := filepath.Join(b.OciLayoutPath, "index.json")
-	indexData, err := os.ReadFile(indexPath)
-	if err != nil {
-		logging.Debug("Could not read index.json, skipping config extraction")
+// unpackOCIImage applies the OCI image layers onto the unpacked rootfs.
+func (b *OCIRootfsBuilder) unpackOCIImage() error {
+	if b.RootfsReady {
+		logging.DebugContext(b.stepContext(), "Skipping OCI unpack: rootfs built via BuildKit")
+		if sel := b.Config.SELinux; sel != nil && sel.PreserveLabels {
+			logging.WarnContext(b.stepContext(), "SELinux labels of Dockerfile builds are not preserved; set selinux.relabel to label the rootfs")
+		}
 		return nil
 	}
-
-	// Parse JSON
-	var index OCIIndex
-	if err := json.Unmarshal(indexData, &index); err != nil {
-		logging.Debug("Could not parse index.json, skipping config extraction")
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+	if b.Config.Binary != nil {
+		img, err := prepareBinaryRootfs(b.stepContext(), b.Config.Binary, rootfsPath)
+		if err != nil {
+			return err
+		}
+		b.ImageConfig = img
 		return nil
 	}
-
-	if len(index.Manifests) == 0 {
-		logging.Debug("No manifests found in index.json")
+	if artifact := b.Config.Source.Artifact; artifact != "" {
+		if err := os.MkdirAll(rootfsPath, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", rootfsPath, err)
+		}
+		img, err := extractArtifact(b.stepContext(), resolveWorkPath(artifact, b.WorkDir), rootfsPath, b.TempDir)
+		if err != nil {
+			return fmt.Errorf("failed to extract source artifact: %w", err)
+		}
+		b.ImageConfig = img
 		return nil
 	}
-
-	configDigest := index.Manifests[0].Config.Digest
-	if configDigest == "" {
-		logging.Debug("No config digest found")
+	if sel := b.Config.SELinux; sel != nil && sel.PreserveLabels {
+		if err := oci.ApplyLayoutXattrs(b.stepContext(), b.OciLayoutPath, "latest", rootfsPath, []string{selinuxLabelXattr}); err != nil {
+			return fmt.Errorf("failed to apply image layers with SELinux labels: %w", err)
+		}
 		return nil
 	}
+	if err := oci.ApplyLayout(b.stepContext(), b.OciLayoutPath, "latest", rootfsPath); err != nil {
+		return fmt.Errorf("failed to apply image layers: %w", err)
+	}
 
-	// Extract config file
-	if strings.HasPrefix(configDigest, "sha256:") {
-		configDigest = strings.TrimPrefix(configDigest, "sha256:")
-		sourceConfig := filepath.Join(configPath, configDigest)
-
-		if _, err := os.Stat(sourceConfig); err == nil {
-			// Create /etc directory in unpacked rootfs
-			rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
-			etcDir := filepath.Join(rootfsPath, "etc")
-			if err := os.MkdirAll(etcDir, 0755); err != nil {
-				return fmt.Errorf("failed to create /etc directory: %w", err)
-			}
+	return nil
+}
 
-			// Copy config to /etc/fsify-entrypoint
-			entrypointFile := filepath.Join(etcDir, "fsify-entrypoint")
-			if err := copyFile(sourceConfig, entrypointFile); err != nil {
-				return fmt.Errorf("failed to copy OCI config: %w", err)
-			}
+// mergeSourceLayers overlays any additional [[source.layers]] images onto the rootfs.
+func (b *OCIRootfsBuilder) mergeSourceLayers() error {
+	return mergeSourceLayers(b.stepContext(), b.Config.Source, filepath.Join(b.UnpackedPath, "rootfs"), b.Lock)
+}
 
-			logging.Debug("OCI config saved to /etc/fsify-entrypoint")
+// extractOCIConfig reads the image config, keeps it for manifest generation and
+// saves a copy to /etc/fsify-entrypoint.
+func (b *OCIRootfsBuilder) extractOCIConfig() error {
+	if b.Config.Binary != nil {
+		// Synthesized from the executables when the rootfs was prepared
+	} else if b.Config.Source.Artifact != "" {
+		// Read from the artifact when it was extracted
+		if b.ImageConfig == nil {
+			logging.DebugContext(b.stepContext(), "Source artifact has no image config, skipping OCI config extraction")
+			return nil
+		}
+	} else if b.RootfsReady {
+		img, err := loadImageConfig(b.dockerfileImageConfigPath())
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			logging.DebugContext(b.stepContext(), "Dockerfile builder did not provide an image config, skipping OCI config extraction")
+			return nil
+		}
+		b.ImageConfig = img
+	} else {
+		manifest, err := oci.ResolveManifest(b.OciLayoutPath, "latest")
+		if err != nil {
+			return fmt.Errorf("failed to resolve image manifest: %w", err)
+		}
+		img, err := oci.ReadConfig(b.OciLayoutPath, manifest)
+		if err != nil {
+			return err
 		}
+		b.ImageConfig = &img
+	}
+
+	configJSON, err := json.Marshal(b.ImageConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal OCI config: %w", err)
+	}
+
+	// Create /etc directory in unpacked rootfs
+	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
+	etcDir := filepath.Join(rootfsPath, "etc")
+	if err := os.MkdirAll(etcDir, 0755); err != nil {
+		return fmt.Errorf("failed to create /etc directory: %w", err)
+	}
+
+	entrypointFile := filepath.Join(etcDir, "fsify-entrypoint")
+	if err := os.WriteFile(entrypointFile, configJSON, 0644); err != nil {
+		return fmt.Errorf("failed to write OCI config: %w", err)
 	}
 
+	logging.DebugContext(b.stepContext(), "OCI config saved to /etc/fsify-entrypoint",
+		"entrypoint", b.ImageConfig.Config.Entrypoint, "cmd", b.ImageConfig.Config.Cmd)
 	return nil
 }
 
+// dockerfileImageConfigPath is where the Dockerfile builder writes the image config.
+func (b *OCIRootfsBuilder) dockerfileImageConfigPath() string {
+	return filepath.Join(b.TempDir, "image-config.json")
+}
+
 // installAgent installs the kestrel agent binary.
 func (b *OCIRootfsBuilder) installAgent() error {
-	logging.Info("Installing kestrel agent")
+	logging.InfoContext(b.stepContext(), "Installing kestrel agent")
 
 	// Source the agent
-	agentPath, err := SourceAgent(b.Config.Agent, true)
+	agent, err := ResolveAgent(b.stepContext(), b.Config.Agent, progress.Bars())
 	if err != nil {
 		return fmt.Errorf("failed to source agent: %w", err)
 	}
-	defer CleanupAgent(agentPath)
+	defer CleanupAgent(agent.Path)
+
+	recordAgentDownload(b.stepContext(), agent)
+	if err := b.Lock.RecordAgent(agent.LockEntry()); err != nil {
+		return err
+	}
+	b.Agent = agent
 
 	// Copy agent to /bin/kestrel in unpacked rootfs
 	// Ensure UnpackedPath exists first
@@ -305,7 +491,7 @@ func (b *OCIRootfsBuilder) installAgent() error {
 	// Verify rootfs directory exists and is a directory
 	if info, err := os.Stat(rootfsPath); err != nil {
 		if os.IsNotExist(err) {
-			logging.Warn("Rootfs directory does not exist, creating it", "path", rootfsPath)
+			logging.WarnContext(b.stepContext(), "Rootfs directory does not exist, creating it", "path", rootfsPath)
 			if mkdirErr := os.MkdirAll(rootfsPath, 0755); mkdirErr != nil {
 				return fmt.Errorf("rootfs directory does not exist and cannot be created: %w", mkdirErr)
 			}
@@ -333,11 +519,11 @@ func (b *OCIRootfsBuilder) installAgent() error {
 		return fmt.Errorf("failed to remove existing kestrel: %w", err)
 	}
 
-	if err := CopyFile(agentPath, kestrelPath, 0755); err != nil {
+	if err := CopyFile(agent.Path, kestrelPath, 0755); err != nil {
 		return fmt.Errorf("failed to copy kestrel: %w", err)
 	}
 
-	logging.Info("Kestrel agent installed")
+	logging.InfoContext(b.stepContext(), "Kestrel agent installed")
 	return nil
 }
 
@@ -385,453 +571,162 @@ func resolveSymlinkTarget(rootfsPath, linkPath, target string) string {
 
 // applyMappings applies user-defined file mappings.
 func (b *OCIRootfsBuilder) applyMappings() error {
-	if len(b.Config.Mappings) == 0 {
-		logging.Info("No custom file mappings to apply")
+	if len(b.Config.Mappings) == 0 && len(b.Config.StageMappings) == 0 && len(b.Config.Assets) == 0 {
+		logging.InfoContext(b.stepContext(), "No custom file mappings to apply")
 		return nil
 	}
 
-	logging.Info("Applying custom file mappings")
-
-	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
-
-	// Prepare mappings
-	mappings, err := PrepareFileMappings(b.Config.Mappings, b.WorkDir)
-	if err != nil {
-		return fmt.Errorf("failed to prepare mappings: %w", err)
-	}
-
-	// Apply mappings to the unpacked rootfs
-	if err := ApplyFileMappings(mappings, rootfsPath); err != nil {
-		return fmt.Errorf("failed to apply mappings: %w", err)
-	}
-
-	logging.Info("Custom file mappings applied")
-	return nil
-}
-
-// createSquashfs creates a squashfs compressed read-only filesystem.
-func (b *OCIRootfsBuilder) createSquashfs() error {
 	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
 
-	// Verify rootfs exists
-	if _, err := os.Stat(rootfsPath); err != nil {
-		return fmt.Errorf("rootfs directory does not exist: %w", err)
-	}
-
-	compressionLevel := b.Config.Filesystem.CompressionLevel
-	if compressionLevel == 0 {
-		compressionLevel = 15 // default
-	}
-
-	logging.Info("Creating squashfs image", "compression_level", compressionLevel)
-
-	// Build mksquashfs command
-	// Note: xz compression uses -Xdict-size instead of -Xcompression-level
-	// Dictionary size affects compression ratio (higher = better compression but more RAM)
-	// Map compression level to dictionary size:
-	// Low (1-7): 25% (fast, lower compression)
-	// Medium (8-15): 50% (balanced, default)
-	// High (16-22): 100% (best compression, more RAM)
-	var dictSize string
-	switch {
-	case compressionLevel <= 7:
-		dictSize = "25%"
-	case compressionLevel <= 15:
-		dictSize = "50%"
-	default:
-		dictSize = "100%"
-	}
-
-	args := []string{
-		rootfsPath,
-		b.ImagePath,
-		"-comp", "xz", // xz compression (best for size)
-		"-Xdict-size", dictSize, // dictionary size for xz
-		"-noappend",    // don't append to existing image
-		"-no-progress", // disable progress bar
+	// Stage mappings and assets go first so local files can still override them
+	if err := applyStageMappings(b.stepContext(), b.Config, b.WorkDir, rootfsPath, b.Lock); err != nil {
+		return fmt.Errorf("failed to apply stage mappings: %w", err)
 	}
-
-	cmd := exec.Command("mksquashfs", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mksquashfs failed: %w\nOutput: %s", err, string(output))
+	if err := applyAssets(b.stepContext(), b.Config.Assets, b.WorkDir, rootfsPath, b.Lock); err != nil {
+		return fmt.Errorf("failed to apply assets: %w", err)
 	}
-
-	// Get final size
-	info, err := os.Stat(b.ImagePath)
-	if err != nil {
-		return fmt.Errorf("failed to stat squashfs image: %w", err)
+	if len(b.Config.Mappings) == 0 {
+		return nil
 	}
 
-	sizeMB := float64(info.Size()) / (1024 * 1024)
-	logging.Info("Squashfs image created", "size_mb", fmt.Sprintf("%.2f", sizeMB))
-
-	return nil
-}
+	logging.InfoContext(b.stepContext(), "Applying custom file mappings")
 
-// createImageFile calculates disk size and creates the image file.
-func (b *OCIRootfsBuilder) createImageFile() error {
-	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
-
-	// Calculate rootfs size
-	cmd := exec.Command("du", "-sk", rootfsPath)
-	output, err := cmd.Output()
+	// Download remote sources, then prepare mappings
+	sources, err := resolveRemoteMappings(b.stepContext(), b.Config.Mappings, b.Lock)
 	if err != nil {
-		return fmt.Errorf("failed to calculate rootfs size: %w", err)
-	}
-
-	parts := strings.Fields(string(output))
-	if len(parts) < 1 {
-		return fmt.Errorf("failed to parse du output: %q", string(output))
+		return err
 	}
-
-	sizeKB, err := strconv.Atoi(parts[0])
+	mappings, err := PrepareFileMappings(sources, b.WorkDir)
 	if err != nil {
-		return fmt.Errorf("failed to parse size %q: %w", parts[0], err)
+		return fmt.Errorf("failed to prepare mappings: %w", err)
 	}
 
-	// Determine buffer (tiered if SizeBufferMB == 0)
-	bufferMB := b.computeBufferMB(sizeKB)
-	bufferKB := bufferMB * 1024
-	totalSizeKB := sizeKB + bufferKB
-	totalSizeBytes := totalSizeKB * 1024
-
-	logging.Info("Calculated image size",
-		"rootfs_kb", sizeKB,
-		"buffer_kb", bufferKB,
-		"total_kb", totalSizeKB)
-
-	// Create image file
-	if b.Config.Filesystem.Preallocate {
-		// Use fallocate for preallocated space
-		cmd := exec.Command("fallocate", "-l", strconv.Itoa(totalSizeBytes), b.ImagePath)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("fallocate failed: %w\nOutput: %s", err, string(output))
-		}
-	} else {
-		// Use sparse allocation with dd
-		cmd := exec.Command("dd", "if=/dev/zero", "of="+b.ImagePath,
-			"bs=1K", "count=0", "seek="+strconv.Itoa(totalSizeKB))
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("dd failed: %w\nOutput: %s", err, string(output))
-		}
+	// Apply mappings to the unpacked rootfs
+	if err := ApplyFileMappings(b.stepContext(), mappings, rootfsPath); err != nil {
+		return fmt.Errorf("failed to apply mappings: %w", err)
 	}
 
-	logging.Debug("Image file created", "path", b.ImagePath)
+	logging.InfoContext(b.stepContext(), "Custom file mappings applied")
 	return nil
 }
 
-// computeBufferMB returns the buffer size in MB based on config and rootfs size.
-// If SizeBufferMB > 0, that explicit value is used. Otherwise uses a percentage-based
-// approach: 25% of rootfs size, with minimum 64MB (for kestrel bootstrap) and maximum 1GB.
-func (b *OCIRootfsBuilder) computeBufferMB(rootfsKB int) int {
-	if b.Config != nil && b.Config.Filesystem != nil && b.Config.Filesystem.SizeBufferMB > 0 {
-		return b.Config.Filesystem.SizeBufferMB
-	}
-
-	sizeMB := rootfsKB / 1024
-
-	// Use 25% of rootfs size as buffer
-	bufferMB := sizeMB / 4
-
-	// Enforce minimum 64MB (needed for kestrel bootstrap and system operations)
-	const minBufferMB = 64
-	if bufferMB < minBufferMB {
-		bufferMB = minBufferMB
-	}
-
-	// Enforce maximum 1GB (reasonable upper bound)
-	const maxBufferMB = 1024
-	if bufferMB > maxBufferMB {
-		bufferMB = maxBufferMB
+// applyOwnership hands the rootfs to the privileged helper of a build that
+// dropped root, which gives it the owners, modes and device nodes recorded
+// while it was assembled. The rootfs is measured first, as the build can no
+// longer read it afterwards.
+func (b *OCIRootfsBuilder) applyOwnership() error {
+	if b.Privileged == nil {
+		return nil
 	}
-
-	return bufferMB
+	b.measureRootfs()
+	return b.Privileged.Apply(filepath.Join(b.UnpackedPath, "rootfs"))
 }
 
-// createFilesystem creates the filesystem on the image file.
-func (b *OCIRootfsBuilder) createFilesystem() error {
-	fsType := b.Config.Filesystem.Type
-	mkfsCmd := "mkfs." + fsType
-
-	// Type-specific flags
-	args := []string{}
-	switch fsType {
-	case "ext4":
-		args = append(args, "-F")
-	case "xfs":
-		args = append(args, "-f")
-	case "btrfs":
-		args = append(args, "-f")
-	}
-	args = append(args, b.ImagePath)
-
-	cmd := exec.Command(mkfsCmd, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s failed: %w\nOutput: %s", mkfsCmd, err, string(output))
+// measureRootfs records the size of the finished rootfs and returns it.
+func (b *OCIRootfsBuilder) measureRootfs() int64 {
+	if b.rootfsSize == 0 {
+		b.rootfsSize = measureDir(b.Report, "rootfs", filepath.Join(b.UnpackedPath, "rootfs"))
 	}
-
-	logging.Debug("Filesystem created", "type", fsType)
-	return nil
+	return b.rootfsSize
 }
 
-// mountImage attaches the image to a loop device and mounts it.
-func (b *OCIRootfsBuilder) mountImage() error {
-	// Find and attach loop device
-	cmd := exec.Command("losetup", "--find", "--show", b.ImagePath)
-	output, err := cmd.Output()
+// runTool runs name and returns its standard output, in the privileged
+// helper once root is dropped. Output, if set, is the file the tool
+// creates, which the helper hands back to the invoking user.
+func (b *OCIRootfsBuilder) runTool(output, name string, args ...string) ([]byte, error) {
+	if b.Privileged != nil {
+		return b.Privileged.Run(name, args, output)
+	}
+	var stderr strings.Builder
+	cmd := exec.CommandContext(b.stepContext(), name, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("losetup failed: %w\nOutput: %s", err, string(output))
-	}
-
-	b.LoopDevicePath = strings.TrimSpace(string(output))
-	if b.LoopDevicePath == "" {
-		return fmt.Errorf("losetup did not return a device path")
+		return stdout, fmt.Errorf("%w\nOutput: %s%s", err, stdout, stderr.String())
 	}
-
-	logging.Debug("Attached to loop device", "device", b.LoopDevicePath)
-
-	// Mount the loop device
-	cmd = exec.Command("mount", b.LoopDevicePath, b.MountPoint)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mount failed: %w\nOutput: %s", err, string(output))
-	}
-
-	logging.Debug("Image mounted", "mount_point", b.MountPoint)
-	return nil
+	return stdout, nil
 }
 
-// copyRootfsToImage copies the unpacked rootfs to the mounted image with progress.
-func (b *OCIRootfsBuilder) copyRootfsToImage() error {
-	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
-
-	// Calculate total size for progress bar
-	var totalSize int64
-	err := filepath.WalkDir(rootfsPath, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !d.IsDir() {
-			info, err := d.Info()
-			if err != nil {
-				return err
-			}
-			totalSize += info.Size()
-		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to calculate total size: %w", err)
-	}
-
-	// Create progress bar
-	bar := progressbar.NewOptions64(totalSize,
-		progressbar.OptionSetDescription("Copying files"),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWidth(15),
-		progressbar.OptionThrottle(65*time.Millisecond),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSpinnerType(14),
-		progressbar.OptionFullWidth(),
-	)
-
-	// Walk and copy files
-	return filepath.WalkDir(rootfsPath, func(srcPath string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get relative path
-		relPath, err := filepath.Rel(rootfsPath, srcPath)
-		if err != nil {
-			return err
-		}
-
-		destPath := filepath.Join(b.MountPoint, relPath)
-
-		// Get file info
-		info, err := d.Info()
-		if err != nil {
-			return fmt.Errorf("failed to get info for %s: %w", srcPath, err)
-		}
-
-		if info.IsDir() {
-			return os.MkdirAll(destPath, 0755)
-		}
-
-		// Handle symlinks
-		if info.Mode()&os.ModeSymlink != 0 {
-			target, err := os.Readlink(srcPath)
-			if err != nil {
-				return fmt.Errorf("failed to read symlink %s: %w", srcPath, err)
-			}
-			return os.Symlink(target, destPath)
-		}
-
-		// Copy regular file
-		srcFile, err := os.Open(srcPath)
-		if err != nil {
-			return fmt.Errorf("failed to open source %s: %w", srcPath, err)
-		}
-		defer srcFile.Close()
+// createAccounts adds the configured users and groups to the rootfs.
+func (b *OCIRootfsBuilder) createAccounts() error {
+	return applyAccounts(b.stepContext(), b.Config, filepath.Join(b.UnpackedPath, "rootfs"))
+}
 
-		destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
-		if err != nil {
-			return fmt.Errorf("failed to create destination %s: %w", destPath, err)
-		}
-		defer destFile.Close()
+// applySystemConfig writes the [system] settings into the rootfs.
+func (b *OCIRootfsBuilder) applySystemConfig() error {
+	return applySystemConfig(b.stepContext(), b.Config.System, filepath.Join(b.UnpackedPath, "rootfs"), b.kernel)
+}
 
-		// Copy with progress
-		writer := io.MultiWriter(destFile, bar)
-		_, err = io.Copy(writer, srcFile)
-		return err
-	})
+// installGPUDriver installs the [gpu] driver payload into the rootfs.
+func (b *OCIRootfsBuilder) installGPUDriver() error {
+	return applyGPUDriver(b.stepContext(), b.Config, b.WorkDir, filepath.Join(b.UnpackedPath, "rootfs"), b.kernel, b.Lock)
 }
 
-// unmountImage unmounts the image and detaches the loop device.
-func (b *OCIRootfsBuilder) unmountImage() error {
-	// Unmount
-	if b.MountPoint != "" {
-		if _, err := os.Stat(b.MountPoint); err == nil {
-			cmd := exec.Command("umount", b.MountPoint)
-			output, err := cmd.CombinedOutput()
-			if err != nil && !strings.Contains(string(output), "not mounted") {
-				logging.Warn("Failed to unmount", "mount_point", b.MountPoint, "error", err)
-			}
-		}
+// prepareReadOnlyRoot creates the mount points of the tmpfs overlays of a
+// read-only root, which cannot be created at boot.
+func (b *OCIRootfsBuilder) prepareReadOnlyRoot() error {
+	fs := b.Config.Filesystem
+	if !fs.ReadOnly {
+		return nil
 	}
-
-	// Detach loop device
-	if b.LoopDevicePath != "" {
-		cmd := exec.Command("losetup", "-d", b.LoopDevicePath)
-		output, err := cmd.CombinedOutput()
-		if err != nil && !strings.Contains(string(output), "No such device") {
-			logging.Warn("Failed to detach loop device", "device", b.LoopDevicePath, "error", err)
+	rootfsDir := filepath.Join(b.UnpackedPath, "rootfs")
+	for _, p := range fs.Tmpfs {
+		if err := os.MkdirAll(filepath.Join(rootfsDir, p), 0755); err != nil {
+			return fmt.Errorf("failed to create tmpfs mount point %s: %w", p, err)
 		}
 	}
-
+	logging.InfoContext(b.stepContext(), "Root filesystem is read-only", "tmpfs", fs.Tmpfs, "size", fs.OverlaySize)
 	return nil
 }
 
-// shrinkFilesystem shrinks the filesystem to optimal size (ext4 only).
-func (b *OCIRootfsBuilder) shrinkFilesystem() error {
-	// Only ext4 supports shrinking
-	if b.Config.Filesystem.Type != "ext4" {
-		logging.Debug("Skipping shrink for non-ext4 filesystem")
-		return nil
-	}
-
-	logging.Info("Shrinking filesystem while preserving free space buffer")
-
-	// Run e2fsck before any resize operations
-	cmd := exec.Command("e2fsck", "-f", "-y", b.ImagePath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		// e2fsck may return non-zero even if it fixed issues; log and continue
-		logging.Debug("e2fsck completed with non-zero exit", "output", string(output))
-	}
-
-	// Get current block count and block size
-	cmd = exec.Command("dumpe2fs", "-h", b.ImagePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("dumpe2fs failed: %w", err)
-	}
-
-	var curBlocks, blockSize int64
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "Block count:") {
-			fmt.Sscanf(line, "Block count: %d", &curBlocks)
-		} else if strings.HasPrefix(line, "Block size:") {
-			fmt.Sscanf(line, "Block size: %d", &blockSize)
-		}
-	}
-	if curBlocks == 0 || blockSize == 0 {
-		return fmt.Errorf("failed to parse current filesystem size from dumpe2fs")
-	}
+// readOnlyKernelArgs returns the kernel arguments that make the guest init
+// mount a read-only root with tmpfs overlays.
+func readOnlyKernelArgs(fs *config.FilesystemConfig) string {
+	return "ro fledge.tmpfs=" + strings.Join(fs.Tmpfs, ",") + " overlay_size=" + fs.OverlaySize
+}
 
-	// Query minimal required size in blocks
-	cmd = exec.Command("resize2fs", "-P", b.ImagePath)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("resize2fs -P failed: %w\nOutput: %s", err, string(output))
-	}
-
-	var minBlocks int64
-	// Expected line: "Estimated minimum size of the filesystem: N"
-	sc := bufio.NewScanner(strings.NewReader(string(output)))
-	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if strings.HasPrefix(line, "Estimated minimum size of the filesystem:") {
-			// Parse last field as the block count
-			fields := strings.Fields(line)
-			if len(fields) > 0 {
-				// last token should be N
-				fmt.Sscanf(fields[len(fields)-1], "%d", &minBlocks)
-			}
-		}
-	}
-	if minBlocks == 0 {
-		return fmt.Errorf("failed to parse minimum block count from resize2fs -P output: %q", string(output))
-	}
+// relabelRootfs applies the [selinux] policy's labels to the rootfs.
+func (b *OCIRootfsBuilder) relabelRootfs() error {
+	return relabelRootfs(b.stepContext(), b.Config.SELinux, b.WorkDir, filepath.Join(b.UnpackedPath, "rootfs"))
+}
 
-	// Recalculate rootfs size to apply the same tiered buffer policy used at allocation time
-	rootfsPath := filepath.Join(b.UnpackedPath, "rootfs")
-	cmd = exec.Command("du", "-sk", rootfsPath)
-	duOut, duErr := cmd.Output()
-	var rootfsKB int
-	if duErr == nil {
-		parts := strings.Fields(string(duOut))
-		if len(parts) >= 1 {
-			if v, err := strconv.Atoi(parts[0]); err == nil {
-				rootfsKB = v
-			}
-		}
+// writeSystemdUnit runs the workload as the [systemd] service unit.
+func (b *OCIRootfsBuilder) writeSystemdUnit() error {
+	if b.Config.Systemd == nil {
+		return nil
 	}
-	// Fallback if du failed
-	if rootfsKB == 0 {
-		// Use minimal blocks as approximation
-		rootfsKB = int(minBlocks * (blockSize / 1024))
+	tpl := b.ManifestTpl
+	if tpl == nil {
+		tpl = &config.ManifestTemplate{}
 	}
+	return writeSystemdUnit(b.stepContext(), b.Config.Systemd, applyImageConfig(tpl, b.ImageConfig), filepath.Join(b.UnpackedPath, "rootfs"))
+}
 
-	// Compute buffer in blocks from tiered or explicit buffer MB
-	bufferMB := b.computeBufferMB(rootfsKB)
-	bufBlocks := int64(bufferMB) * 1024 * 1024 / blockSize
-	// Ensure at least 1 block buffer to avoid zero-free-space images
-	if bufBlocks < 1 {
-		bufBlocks = 1
-	}
+// checkLibraries checks that mapped executables find their shared
+// libraries in the rootfs.
+func (b *OCIRootfsBuilder) checkLibraries() error {
+	return checkMappedLibraries(b.stepContext(), b.Config, filepath.Join(b.UnpackedPath, "rootfs"), b.CopyDeps || b.Config.Binary != nil)
+}
 
-	// Desired final size: minimal + buffer, but never larger than current size
-	desiredBlocks := minBlocks + bufBlocks
-	if desiredBlocks > curBlocks {
-		desiredBlocks = curBlocks
-	}
+// enforceSizeBudget checks the filesystem image against [limits]
+// max_rootfs_mb before it is moved into place.
+func (b *OCIRootfsBuilder) enforceSizeBudget() error {
+	return checkSizeBudget(b.stepContext(), b.Config.Limits, "max_rootfs_mb", b.ImagePath, filepath.Join(b.UnpackedPath, "rootfs"))
+}
 
-	// Only resize if it actually changes the size
-	if desiredBlocks < curBlocks {
-		// Shrink to desired size in filesystem blocks
-		cmd = exec.Command("resize2fs", b.ImagePath, strconv.FormatInt(desiredBlocks, 10))
-		if output, err = cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("resize2fs to target size failed: %w\nOutput: %s", err, string(output))
-		}
+// verifyImage checks the finished image with its filesystem's checker
+// before it is moved to the output, and records its SHA256.
+func (b *OCIRootfsBuilder) verifyImage() error {
+	if b.SkipVerify {
+		logging.InfoContext(b.stepContext(), "Skipping image verification (--skip-verify)")
+		return nil
 	}
-
-	// Truncate backing file to match filesystem size
-	fsSize := desiredBlocks * blockSize
-	if err := os.Truncate(b.ImagePath, fsSize); err != nil {
-		return fmt.Errorf("failed to truncate image: %w", err)
+	checksum, err := verifyImage(b.stepContext(), b.ImagePath, b.Config.Filesystem.Type)
+	if err != nil {
+		return err
 	}
-
-	sizeMB := float64(fsSize) / (1024 * 1024)
-	logging.Info("Filesystem resized", "final_size_mb", fmt.Sprintf("%.2f", sizeMB), "free_buffer_mb", b.Config.Filesystem.SizeBufferMB)
-
+	b.checksum = checksum
+	b.Report.RecordChecksum(checksum)
 	return nil
 }
 
@@ -848,24 +743,19 @@ func (b *OCIRootfsBuilder) moveToFinal() error {
 		return fmt.Errorf("failed to move image to %s: %w", b.OutputPath, err)
 	}
 
-	logging.Debug("Moved image to final location", "path", b.OutputPath)
+	logging.DebugContext(b.stepContext(), "Moved image to final location", "path", b.OutputPath)
 	return nil
 }
 
 // cleanup performs cleanup operations.
 func (b *OCIRootfsBuilder) cleanup() {
-	// Try to unmount and detach if needed
-	if b.MountPoint != "" || b.LoopDevicePath != "" {
-		b.unmountImage()
-	}
-
 	// Remove ephemeral docker image tag if created
 	if b.EphemeralTag != "" {
 		cmd := exec.Command("docker", "rmi", "-f", b.EphemeralTag)
 		if output, err := cmd.CombinedOutput(); err != nil {
-			logging.Warn("Failed to remove ephemeral docker image", "tag", b.EphemeralTag, "error", err, "output", string(output))
+			logging.WarnClassContext(b.stepContext(), logging.WarnCleanup, "Failed to remove ephemeral docker image", "tag", b.EphemeralTag, "error", err, "output", string(output))
 		} else {
-			logging.Debug("Removed ephemeral docker image", "tag", b.EphemeralTag)
+			logging.DebugContext(b.stepContext(), "Removed ephemeral docker image", "tag", b.EphemeralTag)
 		}
 	}
 }
@@ -898,31 +788,38 @@ func (b *OCIRootfsBuilder) buildDockerfileIfNeeded() error {
 	}
 
 	// Resolve Dockerfile and context paths
-	dfPath := df
-	if !filepath.IsAbs(dfPath) {
-		dfPath = filepath.Join(b.WorkDir, dfPath)
-	}
-	ctxDir := b.Config.Source.Context
-	if ctxDir == "" {
-		ctxDir = filepath.Dir(dfPath)
-	}
-	if !filepath.IsAbs(ctxDir) {
-		ctxDir = filepath.Join(b.WorkDir, ctxDir)
-	}
+	dfPath, ctxDir := resolveDockerfileInputs(b.Config.Source, b.WorkDir)
 
-	// Destination rootfs directory - don't create it yet, umoci will create it
+	// Destination rootfs directory - created by the Dockerfile builder
 	destRootfs := filepath.Join(b.UnpackedPath, "rootfs")
 
-	logging.Info("Building Dockerfile via BuildKit", "dockerfile", dfPath, "context", ctxDir, "dest", destRootfs)
-	if err := invokeDockerfileBuilder(context.Background(), DockerfileBuildInput{
-		Dockerfile: dfPath,
-		ContextDir: ctxDir,
-		Target:     b.Config.Source.Target,
-		BuildArgs:  b.Config.Source.BuildArgs,
-		DestDir:    destRootfs,
+	frontend, err := pinFrontendImage(b.stepContext(), b.Config.Source.FrontendImage, b.Lock)
+	if err != nil {
+		return err
+	}
+
+	image, err := newImageExport(b.Config.Source, b.WorkDir)
+	if err != nil {
+		return err
+	}
+	defer image.Cleanup()
+
+	logging.InfoContext(b.stepContext(), "Building Dockerfile via BuildKit", "dockerfile", dfPath, "context", ctxDir, "dest", destRootfs)
+	if err := invokeDockerfileBuilder(b.stepContext(), DockerfileBuildInput{
+		Dockerfile:      dfPath,
+		ContextDir:      ctxDir,
+		Target:          b.Config.Source.Target,
+		BuildArgs:       b.Config.Source.BuildArgs,
+		DestDir:         destRootfs,
+		ImageConfigPath: b.dockerfileImageConfigPath(),
+		FrontendImage:   frontend,
+		ImageTarPath:    image.TarPath,
 	}); err != nil {
 		return fmt.Errorf("buildkit build failed: %w", err)
 	}
+	if err := image.Finish(b.stepContext()); err != nil {
+		return err
+	}
 
 	// Verify the rootfs was actually created
 	if info, err := os.Stat(destRootfs); err != nil {
@@ -950,20 +847,24 @@ func (b *OCIRootfsBuilder) buildDockerfileIfNeeded() error {
 		}
 	}
 
-	logging.Debug("Essential FHS directories ensured in rootfs")
+	logging.DebugContext(b.stepContext(), "Essential FHS directories ensured in rootfs")
 
 	b.RootfsReady = true
-	logging.Info("Dockerfile build complete via BuildKit; rootfs prepared")
+	logging.InfoContext(b.stepContext(), "Dockerfile build complete via BuildKit; rootfs prepared")
 	return nil
 }
 
 // generateManifest creates the final manifest.json by merging the template with build metadata.
 // Output: <outputPath>.manifest.json (e.g., myapp-rootfs.img.manifest.json)
 func (b *OCIRootfsBuilder) generateManifest() error {
-	// Compute checksum of the built artifact
-	checksum, err := computeSHA256(b.OutputPath)
-	if err != nil {
-		return fmt.Errorf("failed to compute artifact checksum: %w", err)
+	// Compute checksum of the built artifact unless verification did
+	checksum := b.checksum
+	if checksum == "" {
+		var err error
+		if checksum, err = computeSHA256(b.OutputPath); err != nil {
+			return fmt.Errorf("failed to compute artifact checksum: %w", err)
+		}
+		b.checksum = checksum
 	}
 
 	// Determine artifact format from filesystem config
@@ -972,53 +873,79 @@ func (b *OCIRootfsBuilder) generateManifest() error {
 		format = "squashfs" // default
 	}
 
+	// Fill gaps in the template from the image config (ENTRYPOINT, ENV, EXPOSE, ...)
+	tpl := applyImageConfig(b.ManifestTpl, b.ImageConfig)
+
 	// Build the final manifest by merging template + build metadata
 	manifest := map[string]interface{}{
-		"schema_version": b.ManifestTpl.SchemaVersion,
-		"name":           b.ManifestTpl.Name,
-		"version":        b.ManifestTpl.Version,
-		"runtime":        b.ManifestTpl.Runtime,
+		"schema_version": tpl.SchemaVersion,
+		"name":           tpl.Name,
+		"version":        tpl.Version,
+		"runtime":        tpl.Runtime,
 	}
 
 	// Add rootfs section (build metadata)
-	manifest["rootfs"] = map[string]interface{}{
+	rootfs := map[string]interface{}{
 		"url":      "file://" + b.OutputPath, // Local file URL
 		"format":   format,
 		"checksum": "sha256:" + checksum,
 	}
+	if fs := b.Config.Filesystem; fs.ReadOnly {
+		// The guest init mounts the root read-only and overlays tmpfs on
+		// these paths when booted with kernel_args
+		rootfs["read_only"] = true
+		rootfs["tmpfs"] = fs.Tmpfs
+		rootfs["overlay_size"] = fs.OverlaySize
+		rootfs["kernel_args"] = readOnlyKernelArgs(fs)
+	}
+	manifest["rootfs"] = rootfs
+
+	if b.Agent != nil {
+		manifest["agent"] = agentManifest(b.Agent)
+	}
 
 	// Add resources from template (runtime defaults)
-	if b.ManifestTpl.Resources != nil {
+	if tpl.Resources != nil {
 		manifest["resources"] = map[string]interface{}{
-			"cpu_cores": b.ManifestTpl.Resources.CPUCores,
-			"memory_mb": b.ManifestTpl.Resources.MemoryMB,
+			"cpu_cores": tpl.Resources.CPUCores,
+			"memory_mb": tpl.Resources.MemoryMB,
 		}
 	}
 
 	// Add workload from template
-	if b.ManifestTpl.Workload != nil {
+	if tpl.Workload != nil {
 		workload := map[string]interface{}{
-			"entrypoint": b.ManifestTpl.Workload.Entrypoint,
+			"entrypoint": tpl.Workload.Entrypoint,
+		}
+		if len(tpl.Workload.Args) > 0 {
+			workload["args"] = tpl.Workload.Args
+		}
+		if tpl.Workload.WorkDir != "" {
+			workload["workdir"] = tpl.Workload.WorkDir
+		}
+		if tpl.Workload.User != "" {
+			workload["user"] = tpl.Workload.User
 		}
-		if len(b.ManifestTpl.Workload.Args) > 0 {
-			workload["args"] = b.ManifestTpl.Workload.Args
+		if b.Config.Systemd != nil {
+			// systemd starts the workload; the agent must not exec it again
+			workload["service"] = b.Config.Systemd.UnitName()
 		}
 		manifest["workload"] = workload
 	}
 
 	// Add environment variables from template
-	if len(b.ManifestTpl.Env) > 0 {
-		manifest["env"] = b.ManifestTpl.Env
+	if len(tpl.Env) > 0 {
+		manifest["env"] = tpl.Env
 	}
 
 	// Add network config from template
-	if b.ManifestTpl.Network != nil {
+	if tpl.Network != nil {
 		network := map[string]interface{}{
-			"mode": b.ManifestTpl.Network.Mode,
+			"mode": tpl.Network.Mode,
 		}
-		if len(b.ManifestTpl.Network.Expose) > 0 {
-			expose := make([]map[string]interface{}, len(b.ManifestTpl.Network.Expose))
-			for i, port := range b.ManifestTpl.Network.Expose {
+		if len(tpl.Network.Expose) > 0 {
+			expose := make([]map[string]interface{}, len(tpl.Network.Expose))
+			for i, port := range tpl.Network.Expose {
 				expose[i] = map[string]interface{}{
 					"port":     port.Port,
 					"protocol": port.Protocol,
@@ -1033,9 +960,9 @@ func (b *OCIRootfsBuilder) generateManifest() error {
 	}
 
 	// Add actions from template
-	if len(b.ManifestTpl.Actions) > 0 {
+	if len(tpl.Actions) > 0 {
 		actions := make(map[string]interface{})
-		for name, action := range b.ManifestTpl.Actions {
+		for name, action := range tpl.Actions {
 			actions[name] = map[string]interface{}{
 				"path":   action.Path,
 				"method": action.Method,
@@ -1045,19 +972,26 @@ func (b *OCIRootfsBuilder) generateManifest() error {
 	}
 
 	// Add cloud-init from template
-	if b.ManifestTpl.CloudInit != nil {
+	if tpl.CloudInit != nil {
 		cloudInit := make(map[string]interface{})
-		if b.ManifestTpl.CloudInit.Datasource != "" {
-			cloudInit["datasource"] = b.ManifestTpl.CloudInit.Datasource
+		if tpl.CloudInit.Datasource != "" {
+			cloudInit["datasource"] = tpl.CloudInit.Datasource
 		}
-		if b.ManifestTpl.CloudInit.UserData != nil {
+		if tpl.CloudInit.UserData != nil {
 			cloudInit["user_data"] = map[string]interface{}{
-				"inline":  b.ManifestTpl.CloudInit.UserData.Inline,
-				"content": b.ManifestTpl.CloudInit.UserData.Content,
+				"inline":  tpl.CloudInit.UserData.Inline,
+				"content": tpl.CloudInit.UserData.Content,
 			}
 		}
-		if len(b.ManifestTpl.CloudInit.MetaData) > 0 {
-			cloudInit["meta_data"] = b.ManifestTpl.CloudInit.MetaData
+		if len(tpl.CloudInit.MetaData) > 0 {
+			cloudInit["meta_data"] = tpl.CloudInit.MetaData
+		}
+		seed, err := writeCloudInitSeed(b.stepContext(), tpl, b.OutputPath)
+		if err != nil {
+			return err
+		}
+		if seed != nil {
+			cloudInit["seed"] = seed
 		}
 		if len(cloudInit) > 0 {
 			manifest["cloud_init"] = cloudInit
@@ -1065,9 +999,9 @@ func (b *OCIRootfsBuilder) generateManifest() error {
 	}
 
 	// Add devices from template
-	if b.ManifestTpl.Devices != nil && len(b.ManifestTpl.Devices.PCIPassthrough) > 0 {
+	if tpl.Devices != nil && len(tpl.Devices.PCIPassthrough) > 0 {
 		manifest["devices"] = map[string]interface{}{
-			"pci_passthrough": b.ManifestTpl.Devices.PCIPassthrough,
+			"pci_passthrough": tpl.Devices.PCIPassthrough,
 		}
 	}
 
@@ -1083,7 +1017,7 @@ func (b *OCIRootfsBuilder) generateManifest() error {
 		return fmt.Errorf("failed to write manifest file: %w", err)
 	}
 
-	logging.Info("Manifest generated", "path", manifestPath, "checksum", checksum[:16]+"...")
+	logging.InfoContext(b.stepContext(), "Manifest generated", "path", manifestPath, "checksum", checksum[:16]+"...")
 	return nil
 }
 
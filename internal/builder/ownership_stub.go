@@ -0,0 +1,10 @@
+//go:build !unix
+
+package builder
+
+import "os"
+
+// preserveOwnership is a no-op on platforms without POSIX ownership.
+func preserveOwnership(dstPath string, info os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,157 @@
+//go:build unix
+
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// requireRoot skips tests that need to chown files to arbitrary owners.
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root to chown files")
+	}
+}
+
+// ownerOf returns the uid/gid of path without following symlinks.
+func ownerOf(t *testing.T, path string) (uint32, uint32) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return st.Uid, st.Gid
+}
+
+// TestOverlayCopyPreserve_Ownership tests that uid/gid survive the initramfs overlay copy.
+func TestOverlayCopyPreserve_Ownership(t *testing.T) {
+	requireRoot(t)
+
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	dataDir := filepath.Join(src, "var", "lib", "postgresql")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		t.Fatalf("Failed to create source dir: %v", err)
+	}
+	confPath := filepath.Join(dataDir, "postgresql.conf")
+	if err := os.WriteFile(confPath, []byte("listen_addresses = '*'\n"), 0600); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	linkPath := filepath.Join(dataDir, "current")
+	if err := os.Symlink("postgresql.conf", linkPath); err != nil {
+		t.Fatalf("Failed to create source symlink: %v", err)
+	}
+	for _, p := range []string{dataDir, confPath} {
+		if err := os.Chown(p, 999, 999); err != nil {
+			t.Fatalf("Failed to chown %s: %v", p, err)
+		}
+	}
+	if err := os.Lchown(linkPath, 33, 33); err != nil {
+		t.Fatalf("Failed to lchown symlink: %v", err)
+	}
+
+	if err := overlayCopyPreserve(context.Background(), src, dst); err != nil {
+		t.Fatalf("overlayCopyPreserve failed: %v", err)
+	}
+
+	testCases := []struct {
+		path     string
+		uid, gid uint32
+	}{
+		{"var/lib/postgresql", 999, 999},
+		{"var/lib/postgresql/postgresql.conf", 999, 999},
+		{"var/lib/postgresql/current", 33, 33},
+		{"var/lib", 0, 0},
+	}
+	for _, tc := range testCases {
+		uid, gid := ownerOf(t, filepath.Join(dst, tc.path))
+		if uid != tc.uid || gid != tc.gid {
+			t.Errorf("%s: expected owner %d:%d, got %d:%d", tc.path, tc.uid, tc.gid, uid, gid)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "var", "lib", "postgresql"))
+	if err != nil {
+		t.Fatalf("Failed to stat copied dir: %v", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("Expected directory mode 0700, got %04o", info.Mode().Perm())
+	}
+}
+
+// TestPreserveOwnership_RestoresSetuid tests that setuid bits survive the chown.
+func TestPreserveOwnership_RestoresSetuid(t *testing.T) {
+	requireRoot(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("bin"), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", p, err)
+		}
+	}
+	if err := os.Chown(src, 1000, 1000); err != nil {
+		t.Fatalf("Failed to chown source: %v", err)
+	}
+	if err := os.Chmod(src, 0755|os.ModeSetuid); err != nil {
+		t.Fatalf("Failed to chmod source: %v", err)
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		t.Fatalf("Failed to stat source: %v", err)
+	}
+	if err := preserveOwnership(dst, info); err != nil {
+		t.Fatalf("preserveOwnership failed: %v", err)
+	}
+
+	if uid, gid := ownerOf(t, dst); uid != 1000 || gid != 1000 {
+		t.Errorf("Expected owner 1000:1000, got %d:%d", uid, gid)
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Failed to stat destination: %v", err)
+	}
+	if dstInfo.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("Expected setuid bit to be preserved, got mode %v", dstInfo.Mode())
+	}
+}
+
+// TestPreserveOwnership_FixesForeignDestination tests that a copy whose
+// owner is neither the source's nor the effective one, such as a file that
+// was overwritten, gets the source owner even when that is the effective
+// owner.
+func TestPreserveOwnership_FixesForeignDestination(t *testing.T) {
+	requireRoot(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("conf"), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", p, err)
+		}
+	}
+	if err := os.Chown(dst, 1000, 1000); err != nil {
+		t.Fatalf("Failed to chown destination: %v", err)
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		t.Fatalf("Failed to stat source: %v", err)
+	}
+	if err := preserveOwnership(dst, info); err != nil {
+		t.Fatalf("preserveOwnership failed: %v", err)
+	}
+	if uid, gid := ownerOf(t, dst); int(uid) != os.Geteuid() || int(gid) != os.Getegid() {
+		t.Errorf("Expected owner %d:%d, got %d:%d", os.Geteuid(), os.Getegid(), uid, gid)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package builder
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// preserveOwnership applies the uid/gid recorded in info (as returned by Lstat on
+// the source tree) to dstPath without following symlinks. chown(2) clears the
+// setuid/setgid bits, so the original mode is re-applied for non-symlinks.
+func preserveOwnership(dstPath string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return nil
+	}
+
+	// Skip the syscall when the copy already carries the right owner, which also
+	// keeps unprivileged copies of self-owned trees working. The copy's own
+	// owner is what counts: it need not be the effective one, as in a setgid
+	// directory or when overwriting an existing file.
+	dstInfo, err := os.Lstat(dstPath)
+	if err != nil {
+		return err
+	}
+	dst, ok := dstInfo.Sys().(*syscall.Stat_t)
+	if !ok || dst.Uid != st.Uid || dst.Gid != st.Gid {
+		if err := os.Lchown(dstPath, int(st.Uid), int(st.Gid)); err != nil {
+			return fmt.Errorf("failed to chown %s to %d:%d: %w", dstPath, st.Uid, st.Gid, err)
+		}
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(dstPath, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return fmt.Errorf("failed to restore mode on %s: %w", dstPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// PostProcessInput is a finished artifact handed to a PostProcessor, once
+// its manifest.json is written and before its checksum files are.
+type PostProcessInput struct {
+	// Artifact is the path of the artifact and ManifestPath that of its
+	// manifest.json.
+	Artifact     string
+	ManifestPath string
+	// Manifest is the parsed manifest.json. Changes a processor makes to
+	// it are written back.
+	Manifest map[string]any
+	// Strategy is the artifact's strategy, oci_rootfs or initramfs.
+	Strategy string
+	// WorkDir is the directory of fledge.toml.
+	WorkDir string
+}
+
+// PostProcessResult is what a PostProcessor made of an artifact.
+type PostProcessResult struct {
+	// Artifact, if set, is a new artifact that replaces the input. A
+	// processor may also rewrite the input in place and leave it empty.
+	Artifact string
+	// Metadata is recorded in the manifest.json's postprocess section
+	// under the processor's name.
+	Metadata map[string]any
+}
+
+// PostProcessor processes finished artifacts, such as scanning them for
+// viruses or watermarking them. An error fails the build.
+type PostProcessor interface {
+	Process(ctx context.Context, in PostProcessInput) (*PostProcessResult, error)
+}
+
+// PostProcessFunc adapts a function to a PostProcessor.
+type PostProcessFunc func(ctx context.Context, in PostProcessInput) (*PostProcessResult, error)
+
+// Process calls f.
+func (f PostProcessFunc) Process(ctx context.Context, in PostProcessInput) (*PostProcessResult, error) {
+	return f(ctx, in)
+}
+
+var (
+	postProcessorsMu sync.RWMutex
+	postProcessors   = map[string]PostProcessor{}
+)
+
+// RegisterPostProcessor registers p to process the artifact of every build
+// as name, replacing the processor registered as name before; a nil p
+// unregisters it. Registered processors run in name order, before the
+// [postprocess] command of the build's config.
+func RegisterPostProcessor(name string, p PostProcessor) {
+	postProcessorsMu.Lock()
+	defer postProcessorsMu.Unlock()
+	if p == nil {
+		delete(postProcessors, name)
+		return
+	}
+	postProcessors[name] = p
+}
+
+// namedPostProcessor is a post-processor of a build with the name its
+// metadata is recorded under.
+type namedPostProcessor struct {
+	name string
+	p    PostProcessor
+}
+
+// buildPostProcessors returns the post-processors of a build of cfg, in
+// the order they run.
+func buildPostProcessors(cfg *config.Config) []namedPostProcessor {
+	postProcessorsMu.RLock()
+	var list []namedPostProcessor
+	for name, p := range postProcessors {
+		list = append(list, namedPostProcessor{name, p})
+	}
+	postProcessorsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	if pp := cfg.Postprocess; pp != nil && len(pp.Command) > 0 {
+		list = append(list, namedPostProcessor{filepath.Base(pp.Command[0]), &commandPostProcessor{pp}})
+	}
+	return list
+}
+
+// postProcess runs processors on the artifact at output and returns its
+// SHA-256 checksum, which is checksum unless a processor changed the
+// artifact. The manifest.json is rewritten with the new checksum and the
+// processors' metadata.
+func postProcess(ctx context.Context, processors []namedPostProcessor, strategy, output, workDir, checksum string) (string, error) {
+	manifestPath := output + ".manifest.json"
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest map[string]any
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("failed to parse manifest %s: %w", manifestPath, err)
+	}
+
+	metadata := map[string]any{}
+	for _, np := range processors {
+		logging.InfoContext(ctx, "Running post-processor", "processor", np.name)
+		res, err := np.p.Process(ctx, PostProcessInput{
+			Artifact:     output,
+			ManifestPath: manifestPath,
+			Manifest:     manifest,
+			Strategy:     strategy,
+			WorkDir:      workDir,
+		})
+		if err != nil {
+			return "", fmt.Errorf("post-processor %s failed: %w", np.name, err)
+		}
+		if res == nil {
+			continue
+		}
+		if res.Artifact != "" && res.Artifact != output {
+			if err := replaceArtifact(res.Artifact, output); err != nil {
+				return "", fmt.Errorf("post-processor %s: %w", np.name, err)
+			}
+		}
+		if res.Metadata != nil {
+			metadata[np.name] = res.Metadata
+		}
+	}
+
+	sum, err := computeSHA256(output)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute artifact checksum: %w", err)
+	}
+	if sum != checksum {
+		logging.InfoContext(ctx, "Post-processors changed the artifact", "sha256", sum)
+		for _, key := range []string{"rootfs", "initramfs"} {
+			if section, ok := manifest[key].(map[string]any); ok {
+				section["checksum"] = "sha256:" + sum
+			}
+		}
+	}
+	if len(metadata) > 0 {
+		manifest["postprocess"] = metadata
+	}
+
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if err := os.WriteFile(manifestPath, out, 0644); err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return sum, nil
+}
+
+// replaceArtifact moves the artifact a post-processor wrote at src over
+// output, copying it when src is on another filesystem.
+func replaceArtifact(src, output string) error {
+	if err := os.Rename(src, output); err == nil {
+		return nil
+	}
+	if err := copyFile(src, output); err != nil {
+		return fmt.Errorf("failed to replace artifact with %s: %w", src, err)
+	}
+	return os.Remove(src)
+}
+
+// commandPostProcessor runs the [postprocess] command of a config.
+type commandPostProcessor struct {
+	cfg *config.PostprocessConfig
+}
+
+// Process runs the command in the directory of fledge.toml with the
+// artifact, manifest and strategy in FLEDGE_ARTIFACT, FLEDGE_MANIFEST and
+// FLEDGE_STRATEGY. The command may write a JSON object to the file named
+// by FLEDGE_RESULT, whose "artifact" replaces the artifact and whose
+// "metadata" is recorded in the manifest.
+func (c *commandPostProcessor) Process(ctx context.Context, in PostProcessInput) (*PostProcessResult, error) {
+	if c.cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(c.cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	resultFile, err := os.CreateTemp("", "fledge-postprocess-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create result file: %w", err)
+	}
+	resultFile.Close()
+	defer os.Remove(resultFile.Name())
+
+	name := c.cfg.Command[0]
+	cmd := exec.CommandContext(ctx, name, c.cfg.Command[1:]...)
+	cmd.Dir = in.WorkDir
+	cmd.Env = append(os.Environ(),
+		"FLEDGE_ARTIFACT="+in.Artifact,
+		"FLEDGE_MANIFEST="+in.ManifestPath,
+		"FLEDGE_STRATEGY="+in.Strategy,
+		"FLEDGE_RESULT="+resultFile.Name(),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w\nOutput: %s", name, err, string(output))
+	}
+	if len(output) > 0 {
+		logging.DebugContext(ctx, "Post-process command output", "output", string(output))
+	}
+
+	data, err := os.ReadFile(resultFile.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result: %w", err)
+	}
+	var res struct {
+		Artifact string         `json:"artifact"`
+		Metadata map[string]any `json:"metadata"`
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &res); err != nil {
+			return nil, fmt.Errorf("invalid result in FLEDGE_RESULT: %w", err)
+		}
+	}
+	if res.Artifact != "" {
+		if !filepath.IsAbs(res.Artifact) {
+			res.Artifact = filepath.Join(in.WorkDir, res.Artifact)
+		}
+		if res.Artifact, err = resultArtifact(res.Artifact, filepath.Dir(in.Artifact)); err != nil {
+			return nil, err
+		}
+	}
+	return &PostProcessResult{Artifact: res.Artifact, Metadata: res.Metadata}, nil
+}
+
+// resultArtifact returns the canonical path of the artifact a command
+// reported, which must be a regular file inside outputDir: it is moved into
+// the artifact, so any other path would publish a file of the host.
+func resultArtifact(path, outputDir string) (string, error) {
+	root, err := utils.CanonicalPath(outputDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid artifact in FLEDGE_RESULT: %w", err)
+	}
+	if !utils.Within(resolved, root) {
+		return "", fmt.Errorf("artifact %s in FLEDGE_RESULT is outside the output directory %s", path, outputDir)
+	}
+	if info, err := os.Lstat(resolved); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("artifact %s in FLEDGE_RESULT is not a regular file", path)
+	}
+	return resolved, nil
+}
+
+// postProcessCommandPath returns the path of the [postprocess] program
+// when it is a file relative to fledge.toml, such as ./scan.sh, rather
+// than one looked up in PATH.
+func postProcessCommandPath(cfg *config.Config, workDir string) string {
+	if cfg.Postprocess == nil || len(cfg.Postprocess.Command) == 0 {
+		return ""
+	}
+	name := cfg.Postprocess.Command[0]
+	if filepath.IsAbs(name) || !strings.ContainsRune(name, filepath.Separator) {
+		return ""
+	}
+	return filepath.Join(workDir, name)
+}
@@ -0,0 +1,162 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// writePostProcessArtifact writes an artifact and its manifest.json to dir
+// and returns the artifact's path and checksum.
+func writePostProcessArtifact(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	output := filepath.Join(dir, "plugin.img")
+	if err := os.WriteFile(output, []byte("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := computeSHA256(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"name": "plugin", "rootfs": {"format": "squashfs", "checksum": "sha256:` + checksum + `"}}`
+	if err := os.WriteFile(output+".manifest.json", []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return output, checksum
+}
+
+// readPostProcessManifest reads the manifest.json of output.
+func readPostProcessManifest(t *testing.T, output string) map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(output + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest map[string]any
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// TestPostProcess tests that a registered processor's new artifact replaces
+// the output and its metadata and the new checksum land in the manifest.
+func TestPostProcess(t *testing.T) {
+	dir := t.TempDir()
+	output, checksum := writePostProcessArtifact(t, dir)
+
+	RegisterPostProcessor("watermark", PostProcessFunc(func(ctx context.Context, in PostProcessInput) (*PostProcessResult, error) {
+		if in.Artifact != output || in.Strategy != config.StrategyOCIRootfs || in.Manifest["name"] != "plugin" {
+			t.Errorf("Unexpected input: %+v", in)
+		}
+		marked := filepath.Join(dir, "marked.img")
+		if err := os.WriteFile(marked, []byte("watermarked artifact"), 0644); err != nil {
+			return nil, err
+		}
+		return &PostProcessResult{Artifact: marked, Metadata: map[string]any{"mark": "team-a"}}, nil
+	}))
+	defer RegisterPostProcessor("watermark", nil)
+
+	processors := buildPostProcessors(&config.Config{})
+	if len(processors) != 1 {
+		t.Fatalf("Expected the registered processor, got %d", len(processors))
+	}
+	sum, err := postProcess(context.Background(), processors, config.StrategyOCIRootfs, output, dir, checksum)
+	if err != nil {
+		t.Fatalf("postProcess failed: %v", err)
+	}
+	if sum == checksum {
+		t.Error("Expected the checksum to change with the artifact")
+	}
+	if data, _ := os.ReadFile(output); string(data) != "watermarked artifact" {
+		t.Errorf("Artifact = %q", data)
+	}
+
+	manifest := readPostProcessManifest(t, output)
+	if got := manifest["rootfs"].(map[string]any)["checksum"]; got != "sha256:"+sum {
+		t.Errorf("Manifest checksum = %v, want sha256:%s", got, sum)
+	}
+	meta, _ := manifest["postprocess"].(map[string]any)["watermark"].(map[string]any)
+	if meta["mark"] != "team-a" {
+		t.Errorf("Expected the processor's metadata in the manifest, got %v", manifest["postprocess"])
+	}
+
+	RegisterPostProcessor("watermark", nil)
+	if processors := buildPostProcessors(&config.Config{}); len(processors) != 0 {
+		t.Errorf("Expected no processors once unregistered, got %d", len(processors))
+	}
+}
+
+// TestCommandPostProcessor tests the [postprocess] command: its environment,
+// its JSON result and a failing command failing the build.
+func TestCommandPostProcessor(t *testing.T) {
+	dir := t.TempDir()
+	output, checksum := writePostProcessArtifact(t, dir)
+	script := `echo scanned >> "$FLEDGE_ARTIFACT"
+printf '{"metadata": {"strategy": "%s", "clean": true}}' "$FLEDGE_STRATEGY" > "$FLEDGE_RESULT"`
+	if err := os.WriteFile(filepath.Join(dir, "scan.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Postprocess: &config.PostprocessConfig{Command: []string{"sh", "./scan.sh"}, Timeout: "1m"}}
+	processors := buildPostProcessors(cfg)
+	if len(processors) != 1 || processors[0].name != "sh" {
+		t.Fatalf("Unexpected processors: %+v", processors)
+	}
+	sum, err := postProcess(context.Background(), processors, config.StrategyInitramfs, output, dir, checksum)
+	if err != nil {
+		t.Fatalf("postProcess failed: %v", err)
+	}
+	if data, _ := os.ReadFile(output); string(data) != "artifactscanned\n" {
+		t.Errorf("Artifact = %q", data)
+	}
+	manifest := readPostProcessManifest(t, output)
+	if got := manifest["rootfs"].(map[string]any)["checksum"]; got != "sha256:"+sum {
+		t.Errorf("Manifest checksum = %v, want sha256:%s", got, sum)
+	}
+	meta, _ := manifest["postprocess"].(map[string]any)["sh"].(map[string]any)
+	if meta["strategy"] != config.StrategyInitramfs || meta["clean"] != true {
+		t.Errorf("Unexpected metadata: %v", manifest["postprocess"])
+	}
+
+	cfg.Postprocess.Command = []string{"sh", "-c", "echo infected; exit 1"}
+	if _, err := postProcess(context.Background(), buildPostProcessors(cfg), config.StrategyInitramfs, output, dir, sum); err == nil {
+		t.Error("Expected a failing command to fail post-processing")
+	}
+
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("host file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Postprocess.Command = []string{"sh", "-c", `printf '{"artifact": "%s"}' "$1" > "$FLEDGE_RESULT"`, "sh", outside}
+	if _, err := postProcess(context.Background(), buildPostProcessors(cfg), config.StrategyInitramfs, output, dir, sum); err == nil || !strings.Contains(err.Error(), "outside the output directory") {
+		t.Errorf("Expected an artifact outside the output directory to be refused, got %v", err)
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "host file" {
+		t.Errorf("Expected the outside file to be left alone, got %q", data)
+	}
+}
+
+// TestPostProcessCommandPath tests which [postprocess] programs are files
+// relative to fledge.toml.
+func TestPostProcessCommandPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"./scan.sh":     "/work/scan.sh",
+		"tools/scan":    "/work/tools/scan",
+		"clamscan":      "",
+		"/usr/bin/scan": "",
+	} {
+		cfg := &config.Config{Postprocess: &config.PostprocessConfig{Command: []string{name}}}
+		if got := postProcessCommandPath(cfg, "/work"); got != want {
+			t.Errorf("postProcessCommandPath(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := postProcessCommandPath(&config.Config{}, "/work"); got != "" {
+		t.Errorf("Expected no path without [postprocess], got %q", got)
+	}
+}
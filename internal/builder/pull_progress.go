@@ -0,0 +1,198 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+const (
+	// pullPollInterval is how often the layout is measured during a pull.
+	pullPollInterval = 250 * time.Millisecond
+	// pullLogInterval is how often plain mode logs the pull's progress.
+	pullLogInterval = 5 * time.Second
+)
+
+// imageLayer is a layer blob of an image, as skopeo inspect reports it.
+type imageLayer struct {
+	Digest string `json:"Digest"`
+	Size   int64  `json:"Size"`
+}
+
+// inspectImageLayers returns the layers of imageRef through transport
+// (such as "docker://"), for the host's platform.
+func inspectImageLayers(ctx context.Context, transport, imageRef string) ([]imageLayer, error) {
+	output, err := exec.CommandContext(ctx, "skopeo", "inspect", transport+imageRef).Output()
+	if err != nil {
+		return nil, fmt.Errorf("skopeo inspect failed: %w", err)
+	}
+	var info struct {
+		LayersData []imageLayer `json:"LayersData"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse skopeo inspect output: %w", err)
+	}
+	return info.LayersData, nil
+}
+
+// pullProgress shows the progress of a skopeo copy from a registry into an
+// OCI layout. skopeo draws nothing useful off a terminal and nothing at all
+// machine-readable, so the layout is watched instead: skopeo writes each
+// blob to a temporary file in it and renames the finished blob to its
+// digest, which gives the bytes so far and the layers done against the
+// sizes the registry reported.
+type pullProgress struct {
+	ctx    context.Context
+	image  string
+	layout string
+	layers []imageLayer
+	total  int64
+
+	// base is the size of the layout before the pull, such as blobs of an
+	// earlier attempt.
+	base  int64
+	start time.Time
+	done  map[string]bool
+}
+
+// startPullProgress starts showing the progress of pulling imageRef into
+// layout, and returns the function that stops it. Nothing is shown when
+// progress is quiet or the layer sizes cannot be looked up.
+func startPullProgress(ctx context.Context, imageRef, layout string) (stop func()) {
+	if progress.Current() == progress.ModeQuiet {
+		return func() {}
+	}
+	layers, err := inspectImageLayers(ctx, "docker://", imageRef)
+	if err != nil || len(layers) == 0 {
+		logging.DebugContext(ctx, "Pull progress unavailable", "image", imageRef, "error", err)
+		return func() {}
+	}
+	p := &pullProgress{
+		ctx:    ctx,
+		image:  imageRef,
+		layout: layout,
+		layers: layers,
+		start:  time.Now(),
+		done:   map[string]bool{},
+	}
+	for _, l := range layers {
+		p.total += l.Size
+	}
+	p.base = layoutSize(layout)
+
+	stopCh := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		p.watch(stopCh)
+	}()
+	return func() {
+		close(stopCh)
+		<-finished
+	}
+}
+
+// watch updates the display until stop is closed.
+func (p *pullProgress) watch(stop <-chan struct{}) {
+	var bar *progressbar.ProgressBar
+	if progress.Bars() {
+		bar = progressbar.NewOptions64(p.total,
+			progressbar.OptionSetDescription(p.describe()),
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetWidth(15),
+			progressbar.OptionThrottle(65*time.Millisecond),
+			progressbar.OptionShowCount(),
+			progressbar.OptionSpinnerType(14),
+			progressbar.OptionFullWidth(),
+			progressbar.OptionSetPredictTime(true),
+			progressbar.OptionClearOnFinish(),
+		)
+		defer bar.Close()
+	}
+	logging.InfoContext(p.ctx, "Pulling image", "image", p.image,
+		"layers", len(p.layers), "size", utils.FormatBytes(p.total))
+
+	ticker := time.NewTicker(pullPollInterval)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			pulled := p.poll()
+			if bar != nil {
+				bar.Describe(p.describe())
+				bar.Set64(pulled)
+			} else if now.Sub(lastLog) >= pullLogInterval {
+				lastLog = now
+				logging.InfoContext(p.ctx, "Pull progress", "image", p.image,
+					"layers", fmt.Sprintf("%d/%d", len(p.done), len(p.layers)),
+					"pulled", utils.FormatBytes(pulled),
+					"size", utils.FormatBytes(p.total),
+					"eta", pullETA(pulled, p.total, now.Sub(p.start)).Round(time.Second))
+			}
+		}
+	}
+}
+
+// poll returns the bytes pulled so far, and logs each layer as it lands.
+func (p *pullProgress) poll() int64 {
+	for _, l := range p.layers {
+		if p.done[l.Digest] {
+			continue
+		}
+		algorithm, hex, ok := strings.Cut(l.Digest, ":")
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(p.layout, "blobs", algorithm, hex)); err == nil {
+			p.done[l.Digest] = true
+			logging.DebugContext(p.ctx, "Pulled layer", "digest", l.Digest, "size", utils.FormatBytes(l.Size))
+		}
+	}
+	return min(max(layoutSize(p.layout)-p.base, 0), p.total)
+}
+
+// layoutSize returns the size of the files in layout. Unlike
+// report.DirSize it carries on past files that skopeo renames or removes
+// while they are counted.
+func layoutSize(layout string) int64 {
+	var size int64
+	filepath.WalkDir(layout, func(_ string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// describe labels the progress bar with the layers done.
+func (p *pullProgress) describe() string {
+	return fmt.Sprintf("Pulling layers %d/%d", len(p.done), len(p.layers))
+}
+
+// pullETA estimates the time left to pull total bytes at the rate pulled
+// bytes took elapsed, or 0 before anything arrived.
+func pullETA(pulled, total int64, elapsed time.Duration) time.Duration {
+	if pulled <= 0 || elapsed <= 0 || pulled >= total {
+		return 0
+	}
+	rate := float64(pulled) / elapsed.Seconds()
+	return time.Duration(float64(total-pulled) / rate * float64(time.Second))
+}
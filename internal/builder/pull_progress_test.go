@@ -0,0 +1,54 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPullProgressPoll tests counting the bytes and layers skopeo has
+// written into the layout since the pull started.
+func TestPullProgressPoll(t *testing.T) {
+	layout := t.TempDir()
+	blobs := filepath.Join(layout, "blobs", "sha256")
+	os.MkdirAll(blobs, 0755)
+	os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+
+	p := &pullProgress{
+		ctx:    context.Background(),
+		layout: layout,
+		layers: []imageLayer{{Digest: "sha256:aaaa", Size: 100}, {Digest: "sha256:bbbb", Size: 300}},
+		total:  400,
+		done:   map[string]bool{},
+	}
+	p.base = layoutSize(layout)
+
+	os.WriteFile(filepath.Join(blobs, "aaaa"), make([]byte, 100), 0644)
+	os.WriteFile(filepath.Join(layout, "oci-put-blob123"), make([]byte, 50), 0644)
+	if pulled := p.poll(); pulled != 150 || len(p.done) != 1 || !p.done["sha256:aaaa"] {
+		t.Errorf("Expected 150 bytes and the first layer pulled, got %d and %v", pulled, p.done)
+	}
+	if got := p.describe(); got != "Pulling layers 1/2" {
+		t.Errorf("Unexpected description %q", got)
+	}
+
+	os.WriteFile(filepath.Join(layout, "oci-put-blob123"), make([]byte, 500), 0644)
+	if pulled := p.poll(); pulled != p.total {
+		t.Errorf("Expected progress to stop at the image size, got %d", pulled)
+	}
+}
+
+// TestPullETA tests estimating the time left from the rate so far.
+func TestPullETA(t *testing.T) {
+	if eta := pullETA(25, 100, 10*time.Second); eta != 30*time.Second {
+		t.Errorf("Expected 30s left, got %v", eta)
+	}
+	if eta := pullETA(0, 100, 10*time.Second); eta != 0 {
+		t.Errorf("Expected no estimate before any bytes arrived, got %v", eta)
+	}
+	if eta := pullETA(100, 100, 10*time.Second); eta != 0 {
+		t.Errorf("Expected nothing left once pulled, got %v", eta)
+	}
+}
@@ -0,0 +1,50 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// recordFileDownload records a downloaded file in the build report.
+func recordFileDownload(ctx context.Context, kind, source, path string, cached bool) {
+	rep := report.FromContext(ctx)
+	if rep == nil {
+		return
+	}
+	d := report.Download{Kind: kind, Source: source, Cached: cached}
+	if info, err := os.Stat(path); err == nil {
+		d.Bytes = info.Size()
+	}
+	rep.RecordDownload(d)
+}
+
+// measureDir returns the size of dir in bytes, or 0 if it cannot be walked,
+// and records it as name in rep.
+func measureDir(rep *report.Report, name, dir string) int64 {
+	size, err := report.DirSize(dir)
+	if err != nil {
+		logging.Debug("Failed to measure directory", "path", dir, "error", err)
+		return 0
+	}
+	rep.RecordSize(name, size)
+	return size
+}
+
+// StepEvent reports that a build step started or, with Done set, finished.
+type StepEvent struct {
+	Name     string
+	Done     bool
+	Duration time.Duration
+	Err      error
+}
+
+// notifyStep passes ev to fn, if set.
+func notifyStep(fn func(StepEvent), ev StepEvent) {
+	if fn != nil {
+		fn(ev)
+	}
+}
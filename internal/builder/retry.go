@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"strings"
+	"time"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/retry"
+)
+
+// permanentSkopeoErrors are skopeo messages for failures that retrying cannot
+// fix: the image does not exist or the registry refused the credentials.
+var permanentSkopeoErrors = []string{
+	"manifest unknown",
+	"name unknown",
+	"not found",
+	"unauthorized",
+	"denied",
+	"invalid reference format",
+}
+
+// retryPolicies returns the retry policies for cfg's [build.retries],
+// filling unset values from retry.Defaults. The durations have already been
+// validated.
+func retryPolicies(cfg *config.Config) retry.Policies {
+	p := retry.Defaults()
+	if cfg == nil || cfg.Build == nil || cfg.Build.Retries == nil {
+		return p
+	}
+	r := cfg.Build.Retries
+	if r.Attempts > 0 {
+		p.Network.Attempts = r.Attempts
+	}
+	if r.VMAttempts > 0 {
+		p.VM.Attempts = r.VMAttempts
+	}
+	if d, err := time.ParseDuration(r.Delay); err == nil {
+		p.Network.Delay = d
+		p.VM.Delay = d
+	}
+	if d, err := time.ParseDuration(r.MaxDelay); err == nil {
+		p.Network.MaxDelay = d
+		p.VM.MaxDelay = d
+	}
+	return p
+}
+
+// classifySkopeo marks err permanent when skopeo's output shows that
+// retrying the same request cannot succeed.
+func classifySkopeo(err error, output []byte) error {
+	msg := strings.ToLower(string(output))
+	for _, s := range permanentSkopeoErrors {
+		if strings.Contains(msg, s) {
+			return retry.Permanent(err)
+		}
+	}
+	return err
+}
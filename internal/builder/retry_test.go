@@ -0,0 +1,48 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/retry"
+)
+
+// TestRetryPolicies tests that [build.retries] overrides only the values it sets.
+func TestRetryPolicies(t *testing.T) {
+	if got := retryPolicies(&config.Config{}); got != retry.Defaults() {
+		t.Errorf("Expected defaults without [build.retries], got %+v", got)
+	}
+
+	cfg := &config.Config{Build: &config.BuildConfig{Retries: &config.RetryConfig{Attempts: 5, MaxDelay: "10s"}}}
+	got := retryPolicies(cfg)
+	if got.Network.Attempts != 5 || got.Network.MaxDelay != 10*time.Second || got.VM.MaxDelay != 10*time.Second {
+		t.Errorf("Expected overridden attempts and max delay, got %+v", got)
+	}
+	if got.Network.Delay != retry.Defaults().Network.Delay || got.VM.Attempts != retry.Defaults().VM.Attempts {
+		t.Errorf("Expected unset values to keep defaults, got %+v", got)
+	}
+}
+
+// TestClassifySkopeo tests that missing images are not retried but network errors are.
+func TestClassifySkopeo(t *testing.T) {
+	calls := 0
+	fail := func(output string) error {
+		calls = 0
+		return retry.Policy{Attempts: 3, Delay: time.Millisecond}.Do(t.Context(), "copy", func(ctx context.Context) error {
+			calls++
+			return classifySkopeo(errors.New("exit status 1"), []byte(output))
+		})
+	}
+
+	fail("reading manifest latest in docker.io/library/nope: manifest unknown")
+	if calls != 1 {
+		t.Errorf("Expected a missing image to fail at once, got %d attempts", calls)
+	}
+	fail("pinging container registry: dial tcp: i/o timeout")
+	if calls != 3 {
+		t.Errorf("Expected a network error to be retried, got %d attempts", calls)
+	}
+}
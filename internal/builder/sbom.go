@@ -0,0 +1,173 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// SBOMSuffix is appended to the output path for the artifact's SPDX
+// document.
+const SBOMSuffix = ".spdx.json"
+
+// spdxDocument is the subset of an SPDX 2.3 JSON document fledge writes:
+// the artifact and the remote inputs it was generated from.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string         `json:"name"`
+	SPDXID           string         `json:"SPDXID"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	Comment          string         `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// writeSBOM writes the SPDX document of the artifact at output, whose
+// SHA256 is checksum, to <output>.spdx.json. Its inputs are the images,
+// downloads and repositories resolved during the build.
+func writeSBOM(ctx context.Context, output, checksum string, inputs lock.File) error {
+	doc := newSBOM(filepath.Base(output), checksum, inputs, time.Now().UTC())
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode SBOM: %w", err)
+	}
+	path := output + SBOMSuffix
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	logging.InfoContext(ctx, "SBOM written", "path", path, "inputs", len(doc.Packages)-1)
+	return nil
+}
+
+// newSBOM builds the SPDX document of the artifact name.
+func newSBOM(name, checksum string, inputs lock.File, created time.Time) spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://volantvm.dev/spdx/%s-%s", name, checksum),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.Format(time.RFC3339),
+			Creators: []string{"Tool: fledge"},
+		},
+		Packages: []spdxPackage{{
+			Name:             name,
+			SPDXID:           "SPDXRef-Artifact",
+			DownloadLocation: "NOASSERTION",
+			Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: checksum}},
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: "SPDXRef-Artifact",
+		}},
+	}
+
+	add := func(pkg spdxPackage) {
+		pkg.SPDXID = fmt.Sprintf("SPDXRef-Input-%d", len(doc.Packages))
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-Artifact",
+			RelationshipType:   "GENERATED_FROM",
+			RelatedSPDXElement: pkg.SPDXID,
+		})
+	}
+	for _, img := range inputs.Images {
+		add(spdxPackage{
+			Name:             img.Ref,
+			DownloadLocation: img.Ref,
+			Checksums:        spdxDigest(img.Digest),
+			Comment:          img.Role + " image",
+		})
+	}
+	if a := inputs.Agent; a != nil {
+		location := a.URL
+		if location == "" {
+			location = a.Image
+		}
+		add(spdxPackage{
+			Name:             "kestrel",
+			VersionInfo:      a.Version,
+			DownloadLocation: spdxLocation(location),
+			Checksums:        spdxDigest(a.Digest),
+			Comment:          "agent",
+		})
+	}
+	if bb := inputs.Busybox; bb != nil {
+		add(spdxPackage{
+			Name:             "busybox",
+			DownloadLocation: spdxLocation(bb.URL),
+			Checksums:        spdxDigest(bb.Digest),
+			Comment:          "userland",
+		})
+	}
+	for _, d := range inputs.Downloads {
+		add(spdxPackage{
+			Name:             filepath.Base(d.URL),
+			DownloadLocation: spdxLocation(d.URL),
+			Checksums:        spdxDigest(d.Digest),
+			Comment:          "download",
+		})
+	}
+	for _, r := range inputs.Repositories {
+		add(spdxPackage{
+			Name:             r.URL,
+			VersionInfo:      r.Commit,
+			DownloadLocation: "git+" + r.URL + "@" + r.Commit,
+			Comment:          "git repository at " + r.Ref,
+		})
+	}
+	return doc
+}
+
+// spdxDigest converts an "algorithm:hex" digest to SPDX checksums.
+func spdxDigest(digest string) []spdxChecksum {
+	algorithm, value, ok := strings.Cut(digest, ":")
+	if !ok || value == "" {
+		return nil
+	}
+	return []spdxChecksum{{Algorithm: strings.ToUpper(algorithm), ChecksumValue: value}}
+}
+
+// spdxLocation returns location, or NOASSERTION when it is unknown.
+func spdxLocation(location string) string {
+	if location == "" {
+		return "NOASSERTION"
+	}
+	return location
+}
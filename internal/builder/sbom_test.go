@@ -0,0 +1,48 @@
+package builder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/volantvm/fledge/internal/lock"
+)
+
+// TestNewSBOM tests that every resolved input becomes a package the
+// artifact is generated from.
+func TestNewSBOM(t *testing.T) {
+	inputs := lock.File{
+		Agent: &lock.Agent{Version: "v0.4.2", URL: "https://example.com/kestrel", Digest: "sha256:aa"},
+		Images: []lock.Image{
+			{Role: lock.RoleSource, Ref: "docker.io/library/nginx:1.27", Digest: "sha256:bb"},
+		},
+		Downloads:    []lock.Download{{URL: "https://example.com/tool.tar.gz", Digest: "sha256:cc"}},
+		Repositories: []lock.Repository{{URL: "https://github.com/example/repo", Ref: "main", Commit: "0123abcd"}},
+	}
+	doc := newSBOM("plugin.img", "ff", inputs, time.Unix(0, 0).UTC())
+
+	if doc.SPDXVersion != "SPDX-2.3" || doc.CreationInfo.Created != "1970-01-01T00:00:00Z" {
+		t.Errorf("Unexpected document header: %+v", doc)
+	}
+	if len(doc.Packages) != 5 || len(doc.Relationships) != 5 {
+		t.Fatalf("Expected the artifact and 4 inputs, got %d packages and %d relationships", len(doc.Packages), len(doc.Relationships))
+	}
+	artifact := doc.Packages[0]
+	if artifact.SPDXID != "SPDXRef-Artifact" || artifact.Checksums[0] != (spdxChecksum{"SHA256", "ff"}) {
+		t.Errorf("Unexpected artifact package: %+v", artifact)
+	}
+	image := doc.Packages[1]
+	if image.Name != "docker.io/library/nginx:1.27" || image.Checksums[0] != (spdxChecksum{"SHA256", "bb"}) {
+		t.Errorf("Unexpected image package: %+v", image)
+	}
+	if agent := doc.Packages[2]; agent.VersionInfo != "v0.4.2" || agent.DownloadLocation != "https://example.com/kestrel" {
+		t.Errorf("Unexpected agent package: %+v", agent)
+	}
+	if repo := doc.Packages[4]; repo.DownloadLocation != "git+https://github.com/example/repo@0123abcd" {
+		t.Errorf("Unexpected repository package: %+v", repo)
+	}
+	for i, rel := range doc.Relationships[1:] {
+		if rel.SPDXElementID != "SPDXRef-Artifact" || rel.RelationshipType != "GENERATED_FROM" || rel.RelatedSPDXElement != doc.Packages[i+1].SPDXID {
+			t.Errorf("Unexpected relationship %d: %+v", i+1, rel)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// selinuxLabelXattr is the extended attribute holding a file's SELinux
+// label.
+const selinuxLabelXattr = "security.selinux"
+
+// relabelRootfs labels rootfsDir with setfiles from the [selinux]
+// file_contexts or the image's own policy.
+func relabelRootfs(ctx context.Context, cfg *config.SELinuxConfig, workDir, rootfsDir string) error {
+	if cfg == nil || !cfg.Relabel {
+		return nil
+	}
+
+	contexts := resolveWorkPath(cfg.FileContexts, workDir)
+	if cfg.FileContexts == "" {
+		var err error
+		if contexts, err = imageFileContexts(rootfsDir); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(contexts); err != nil {
+		return fmt.Errorf("SELinux file_contexts not found: %w", err)
+	}
+
+	logging.InfoContext(ctx, "Relabelling rootfs", "file_contexts", contexts)
+	cmd := exec.CommandContext(ctx, "setfiles", "-F", "-r", rootfsDir, contexts, rootfsDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("setfiles failed (it ships with policycoreutils): %w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// imageFileContexts returns the host path of the file_contexts of the policy
+// the image's /etc/selinux/config selects.
+func imageFileContexts(rootfsDir string) (string, error) {
+	f, err := os.Open(filepath.Join(rootfsDir, "etc/selinux/config"))
+	if err != nil {
+		return "", fmt.Errorf("image has no SELinux policy, set selinux.file_contexts: %w", err)
+	}
+	defer f.Close()
+
+	policy := "targeted"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "SELINUXTYPE="); ok {
+			policy = strings.Trim(value, `"'`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read /etc/selinux/config: %w", err)
+	}
+	return filepath.Join(rootfsDir, "etc/selinux", policy, "contexts/files/file_contexts"), nil
+}
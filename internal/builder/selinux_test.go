@@ -0,0 +1,28 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestImageFileContexts tests locating the file_contexts of the image's
+// configured policy.
+func TestImageFileContexts(t *testing.T) {
+	root := t.TempDir()
+	if _, err := imageFileContexts(root); err == nil {
+		t.Error("Expected an image without /etc/selinux/config to fail")
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "etc/selinux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "# This file controls the state of SELinux\nSELINUX=enforcing\nSELINUXTYPE=mls\n"
+	if err := os.WriteFile(filepath.Join(root, "etc/selinux/config"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := imageFileContexts(root)
+	if want := filepath.Join(root, "etc/selinux/mls/contexts/files/file_contexts"); err != nil || got != want {
+		t.Errorf("imageFileContexts() = %q, %v; want %q", got, err, want)
+	}
+}
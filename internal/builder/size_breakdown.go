@@ -0,0 +1,140 @@
+package builder
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// Sources rootfs files are attributed to in a size breakdown.
+const (
+	sizeSourceImage      = "image"
+	sizeSourceDockerfile = "dockerfile"
+	sizeSourceLayers     = "source layers"
+	sizeSourceUserland   = "userland"
+	sizeSourceModules    = "kernel modules"
+	sizeSourceGPU        = "gpu driver"
+	sizeSourceInit       = "init"
+	sizeSourceAgent      = "agent"
+	sizeSourceMappings   = "mappings"
+	sizeSourceFledge     = "fledge"
+	sizeSourceHost       = "host"
+)
+
+// sizeTracker attributes each rootfs file to the last build step that
+// created or changed it, by walking the rootfs after every step that writes
+// to it.
+type sizeTracker struct {
+	files map[string]trackedFile
+}
+
+type trackedFile struct {
+	source string
+	info   fs.FileInfo
+}
+
+func newSizeTracker() *sizeTracker {
+	return &sizeTracker{files: make(map[string]trackedFile)}
+}
+
+// imageSizeSource is the source of the primary image rootfs.
+func imageSizeSource(cfg *config.Config) string {
+	if cfg.Binary != nil {
+		return sizeSourceHost
+	}
+	if cfg.Source.Dockerfile != "" {
+		return sizeSourceDockerfile
+	}
+	return sizeSourceImage
+}
+
+// observe walks root after a step of source ran. New and changed files are
+// attributed to source; files that are gone are forgotten.
+func (t *sizeTracker) observe(root, source string) error {
+	files := make(map[string]trackedFile, len(t.files))
+	if _, err := os.Lstat(root); errors.Is(err, fs.ErrNotExist) {
+		t.files = files
+		return nil
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		f := trackedFile{source: source, info: info}
+		if prev, ok := t.files[rel]; ok && sameFile(prev.info, info) {
+			f.source = prev.source
+		}
+		files[rel] = f
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.files = files
+	return nil
+}
+
+// sameFile reports whether a and b describe the same, unchanged file.
+func sameFile(a, b fs.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime()) && a.Mode() == b.Mode()
+}
+
+// breakdown groups the observed files by top-level directory and by source,
+// largest first.
+func (t *sizeTracker) breakdown() *report.SizeBreakdown {
+	b := &report.SizeBreakdown{}
+	byDir := make(map[string]*report.SizeShare)
+	bySource := make(map[string]*report.SizeShare)
+	add := func(m map[string]*report.SizeShare, name string, size int64) {
+		s, ok := m[name]
+		if !ok {
+			s = &report.SizeShare{Name: name}
+			m[name] = s
+		}
+		s.Bytes += size
+		s.Files++
+	}
+	for rel, f := range t.files {
+		dir := "/"
+		if top, _, nested := strings.Cut(filepath.ToSlash(rel), "/"); nested {
+			dir += top
+		}
+		size := f.info.Size()
+		add(byDir, dir, size)
+		add(bySource, f.source, size)
+		b.Bytes += size
+		b.Files++
+	}
+	b.ByDirectory = rankShares(byDir)
+	b.BySource = rankShares(bySource)
+	return b
+}
+
+// rankShares returns the shares in m, largest first.
+func rankShares(m map[string]*report.SizeShare) []report.SizeShare {
+	shares := make([]report.SizeShare, 0, len(m))
+	for _, s := range m {
+		shares = append(shares, *s)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Bytes != shares[j].Bytes {
+			return shares[i].Bytes > shares[j].Bytes
+		}
+		return shares[i].Name < shares[j].Name
+	})
+	return shares
+}
@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// TestSizeTracker tests attributing rootfs files to the step that last wrote
+// them.
+func TestSizeTracker(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "rootfs")
+	write := func(name string, size int) {
+		t.Helper()
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := newSizeTracker()
+	// A step running before the rootfs exists sees nothing.
+	if err := tracker.observe(root, sizeSourceDockerfile); err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+
+	write("usr/bin/app", 1000)
+	write("etc/app.conf", 100)
+	write("bin/busybox", 400)
+	if err := tracker.observe(root, sizeSourceImage); err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+
+	write("usr/bin/kestrel", 300)
+	write("etc/app.conf", 50)
+	if err := os.Remove(filepath.Join(root, "bin/busybox")); err != nil {
+		t.Fatal(err)
+	}
+	write("init", 10)
+	if err := tracker.observe(root, sizeSourceMappings); err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+
+	b := tracker.breakdown()
+	if b.Bytes != 1360 || b.Files != 4 {
+		t.Errorf("Expected 1360 bytes in 4 files, got %d in %d", b.Bytes, b.Files)
+	}
+	wantDirs := []report.SizeShare{{Name: "/usr", Bytes: 1300, Files: 2}, {Name: "/etc", Bytes: 50, Files: 1}, {Name: "/", Bytes: 10, Files: 1}}
+	if len(b.ByDirectory) != len(wantDirs) {
+		t.Fatalf("Unexpected directories: %+v", b.ByDirectory)
+	}
+	for i, want := range wantDirs {
+		if b.ByDirectory[i] != want {
+			t.Errorf("ByDirectory[%d] = %+v, want %+v", i, b.ByDirectory[i], want)
+		}
+	}
+	wantSources := []report.SizeShare{{Name: sizeSourceImage, Bytes: 1000, Files: 1}, {Name: sizeSourceMappings, Bytes: 360, Files: 3}}
+	if len(b.BySource) != len(wantSources) {
+		t.Fatalf("Unexpected sources: %+v", b.BySource)
+	}
+	for i, want := range wantSources {
+		if b.BySource[i] != want {
+			t.Errorf("BySource[%d] = %+v, want %+v", i, b.BySource[i], want)
+		}
+	}
+}
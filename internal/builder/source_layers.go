@@ -0,0 +1,131 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/oci"
+	"github.com/volantvm/fledge/internal/retry"
+)
+
+// maxReportedConflicts bounds the paths listed in a conflict error.
+const maxReportedConflicts = 10
+
+// copyImageToLayout fetches imageRef into an OCI layout at layoutDir tagged
+// "latest", preferring the local Docker daemon over the remote registry.
+// Registry pulls are retried according to the network retry policy in ctx.
+func copyImageToLayout(ctx context.Context, imageRef, layoutDir string) error {
+	cmd := exec.CommandContext(ctx, "skopeo", "copy",
+		fmt.Sprintf("docker-daemon:%s", imageRef),
+		fmt.Sprintf("oci:%s:latest", layoutDir))
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		logging.DebugContext(ctx, "Copied from local Docker daemon", "image", imageRef)
+		return nil
+	}
+
+	logging.DebugContext(ctx, "Local Docker daemon copy failed, trying remote registry",
+		"image", imageRef, "error", string(output))
+	if err := copyRegistryImageToLayout(ctx, imageRef, layoutDir); err != nil {
+		return fmt.Errorf("%w\nLocal output: %s", err, string(output))
+	}
+	return nil
+}
+
+// copyRegistryImageToLayout pulls imageRef from its registry into an OCI
+// layout at layoutDir tagged "latest", never from the local Docker daemon.
+func copyRegistryImageToLayout(ctx context.Context, imageRef, layoutDir string) error {
+	err := retry.FromContext(ctx).Network.Do(ctx, "skopeo copy "+imageRef, func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, "skopeo", "copy",
+			fmt.Sprintf("docker://%s", imageRef),
+			fmt.Sprintf("oci:%s:latest", layoutDir))
+		stop := startPullProgress(ctx, imageRef, layoutDir)
+		output, err := cmd.CombinedOutput()
+		stop()
+		if err != nil {
+			return classifySkopeo(fmt.Errorf("skopeo copy failed: %w\nOutput: %s", err, string(output)), output)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logging.DebugContext(ctx, "Copied from remote registry", "image", imageRef)
+	return nil
+}
+
+// mergeSourceLayers overlays each image in src.Layers, in order, onto rootDir.
+// Paths that a layer image replaces or deletes from earlier content are
+// reported according to src.LayerConflicts.
+func mergeSourceLayers(ctx context.Context, src config.SourceConfig, rootDir string, tracker *lock.Tracker) error {
+	if len(src.Layers) == 0 {
+		return nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "fledge-layers-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i, layer := range src.Layers {
+		layoutDir := filepath.Join(tmpDir, fmt.Sprintf("layer-%d", i))
+		if err := os.MkdirAll(layoutDir, 0755); err != nil {
+			return fmt.Errorf("failed to create oci layout dir: %w", err)
+		}
+
+		logging.InfoContext(ctx, "Merging source layer image", "image", layer.Image, "index", i)
+		if err := pullImage(ctx, tracker, lock.RoleLayer, layer.Image, layoutDir); err != nil {
+			return fmt.Errorf("failed to fetch layer image %s: %w", layer.Image, err)
+		}
+		conflicts, err := oci.OverlayLayout(ctx, layoutDir, "latest", rootDir)
+		if err != nil {
+			return fmt.Errorf("failed to apply layer image %s: %w", layer.Image, err)
+		}
+		if err := reportLayerConflicts(layer.Image, conflicts, src.LayerConflicts); err != nil {
+			return err
+		}
+
+		// Drop each layout once applied instead of keeping every image's blobs.
+		if err := os.RemoveAll(layoutDir); err != nil {
+			logging.WarnClassContext(ctx, logging.WarnCleanup, "Failed to remove layer image layout", "path", layoutDir, "error", err)
+		}
+	}
+	return nil
+}
+
+// reportLayerConflicts logs each conflict introduced by image and fails when
+// policy is "error".
+func reportLayerConflicts(image string, conflicts []oci.Conflict, policy string) error {
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		action := "replaced"
+		if c.Removed {
+			action = "removed"
+		}
+		logging.Warn("Layer image conflicts with earlier content", "image", image, "path", "/"+c.Path, "action", action)
+		paths = append(paths, "/"+c.Path)
+	}
+
+	if policy != config.LayerConflictsError {
+		logging.Warn("Layer image overrode existing paths", "image", image, "count", len(conflicts))
+		return nil
+	}
+
+	if len(paths) > maxReportedConflicts {
+		paths = append(paths[:maxReportedConflicts], fmt.Sprintf("... and %d more", len(conflicts)-maxReportedConflicts))
+	}
+	return fmt.Errorf("layer image %s conflicts with %d existing path(s): %s", image, len(conflicts), strings.Join(paths, ", "))
+}
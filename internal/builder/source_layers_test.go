@@ -0,0 +1,34 @@
+package builder
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/oci"
+)
+
+// TestReportLayerConflicts tests the warn and error conflict policies.
+func TestReportLayerConflicts(t *testing.T) {
+	conflicts := []oci.Conflict{
+		{Path: "etc/os-release"},
+		{Path: "usr/bin/tool", Removed: true},
+	}
+
+	if err := reportLayerConflicts("sidecar:1.0", conflicts, ""); err != nil {
+		t.Errorf("Expected conflicts to only warn by default, got %v", err)
+	}
+	if err := reportLayerConflicts("sidecar:1.0", nil, config.LayerConflictsError); err != nil {
+		t.Errorf("Expected no error without conflicts, got %v", err)
+	}
+
+	err := reportLayerConflicts("sidecar:1.0", conflicts, config.LayerConflictsError)
+	if err == nil {
+		t.Fatal("Expected error with the error policy")
+	}
+	for _, want := range []string{"sidecar:1.0", "/etc/os-release", "/usr/bin/tool"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %s, got: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// resolveDockerfileInputs returns absolute Dockerfile and context paths for src,
+// resolving relative paths against workDir. The context defaults to the
+// Dockerfile's directory.
+func resolveDockerfileInputs(src config.SourceConfig, workDir string) (dfPath, ctxDir string) {
+	dfPath = src.Dockerfile
+	if !filepath.IsAbs(dfPath) {
+		dfPath = filepath.Join(workDir, dfPath)
+	}
+	ctxDir = src.Context
+	if ctxDir == "" {
+		ctxDir = filepath.Dir(dfPath)
+	}
+	if !filepath.IsAbs(ctxDir) {
+		ctxDir = filepath.Join(workDir, ctxDir)
+	}
+	return dfPath, ctxDir
+}
+
+// stageMappingsOnly reports whether an initramfs takes only the paths of its
+// [[stage_mappings]] from the Dockerfile. Without a source.target, the final
+// stage is then not overlaid as the base rootfs: it is often the builder
+// stage the mapped binary comes from.
+func stageMappingsOnly(cfg *config.Config) bool {
+	return len(cfg.StageMappings) > 0 && cfg.Source.Target == ""
+}
+
+// applyStageMappings builds each stage referenced by cfg.StageMappings once,
+// exporting only the mapped paths, and copies them into targetDir.
+func applyStageMappings(ctx context.Context, cfg *config.Config, workDir, targetDir string, tracker *lock.Tracker) error {
+	if len(cfg.StageMappings) == 0 {
+		return nil
+	}
+
+	src := cfg.Source
+	frontend, err := pinFrontendImage(ctx, src.FrontendImage, tracker)
+	if err != nil {
+		return err
+	}
+	src.FrontendImage = frontend
+
+	byStage := make(map[string][]config.StageMapping)
+	for _, m := range cfg.StageMappings {
+		byStage[m.FromStage] = append(byStage[m.FromStage], m)
+	}
+	stages := make([]string, 0, len(byStage))
+	for stage := range byStage {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+
+	dfPath, ctxDir := resolveDockerfileInputs(src, workDir)
+
+	for _, stage := range stages {
+		mappings := byStage[stage]
+		paths := make([]string, 0, len(mappings))
+		seen := make(map[string]bool)
+		for _, m := range mappings {
+			if !seen[m.Path] {
+				seen[m.Path] = true
+				paths = append(paths, m.Path)
+			}
+		}
+
+		if err := applyStage(ctx, src, dfPath, ctxDir, stage, paths, mappings, targetDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyStage exports paths from a single stage and applies its mappings.
+func applyStage(ctx context.Context, src config.SourceConfig, dfPath, ctxDir, stage string, paths []string, mappings []config.StageMapping, targetDir string) error {
+	exportDir, err := os.MkdirTemp("", "fledge-stage-*")
+	if err != nil {
+		return fmt.Errorf("failed to create stage export dir: %w", err)
+	}
+	defer os.RemoveAll(exportDir)
+
+	logging.InfoContext(ctx, "Exporting paths from Dockerfile stage", "stage", stage, "paths", paths)
+	if err := invokeDockerfileBuilder(ctx, DockerfileBuildInput{
+		Dockerfile:    dfPath,
+		ContextDir:    ctxDir,
+		Target:        stage,
+		BuildArgs:     src.BuildArgs,
+		DestDir:       exportDir,
+		FrontendImage: src.FrontendImage,
+		ExportPaths:   paths,
+	}); err != nil {
+		return fmt.Errorf("failed to build stage %q: %w", stage, err)
+	}
+
+	for _, m := range mappings {
+		srcPath := filepath.Join(exportDir, filepath.Clean(m.Path))
+		prepared, err := PrepareFileMappings(map[string]string{srcPath: m.Dest}, exportDir)
+		if err != nil {
+			return fmt.Errorf("stage %q path %s: %w", stage, m.Path, err)
+		}
+		if err := ApplyFileMappings(ctx, prepared, targetDir); err != nil {
+			return fmt.Errorf("failed to map %s from stage %q: %w", m.Path, stage, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestApplyStageMappings tests copying exported stage paths into the rootfs.
+func TestApplyStageMappings(t *testing.T) {
+	var calls []DockerfileBuildInput
+	RegisterDockerfileBuilder(func(ctx context.Context, input DockerfileBuildInput) error {
+		calls = append(calls, input)
+		for _, p := range input.ExportPaths {
+			path := filepath.Join(input.DestDir, p)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, []byte(input.Target+":"+p), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	defer RegisterDockerfileBuilder(nil)
+
+	workDir := t.TempDir()
+	cfg := &config.Config{
+		Source: config.SourceConfig{Dockerfile: "Dockerfile", BuildArgs: map[string]string{"GO": "1.24"}},
+		StageMappings: []config.StageMapping{
+			{FromStage: "builder", Path: "/out/app", Dest: "/usr/bin/app"},
+			{FromStage: "builder", Path: "/out/app", Dest: "/usr/local/bin/app"},
+			{FromStage: "assets", Path: "/srv/index.html", Dest: "/var/www/index.html"},
+		},
+	}
+
+	rootDir := t.TempDir()
+	if err := applyStageMappings(context.Background(), cfg, workDir, rootDir, nil); err != nil {
+		t.Fatalf("applyStageMappings failed: %v", err)
+	}
+
+	// Each stage is built once, with duplicate paths collapsed
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 builds, got %d", len(calls))
+	}
+	targets := []string{calls[0].Target, calls[1].Target}
+	sort.Strings(targets)
+	if !reflect.DeepEqual(targets, []string{"assets", "builder"}) {
+		t.Errorf("Expected targets [assets builder], got %v", targets)
+	}
+	for _, call := range calls {
+		if call.Dockerfile != filepath.Join(workDir, "Dockerfile") || call.ContextDir != workDir {
+			t.Errorf("Unexpected Dockerfile inputs: %s, %s", call.Dockerfile, call.ContextDir)
+		}
+		if call.BuildArgs["GO"] != "1.24" {
+			t.Errorf("Expected build args to be passed through, got %v", call.BuildArgs)
+		}
+		if call.Target == "builder" && !reflect.DeepEqual(call.ExportPaths, []string{"/out/app"}) {
+			t.Errorf("Expected export paths [/out/app], got %v", call.ExportPaths)
+		}
+	}
+
+	for dest, want := range map[string]string{
+		"/usr/bin/app":        "builder:/out/app",
+		"/usr/local/bin/app":  "builder:/out/app",
+		"/var/www/index.html": "assets:/srv/index.html",
+	} {
+		data, err := os.ReadFile(filepath.Join(rootDir, dest))
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", dest, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("Expected %s to contain %q, got %q", dest, want, data)
+		}
+	}
+}
+
+// TestApplyStageMappings_MissingPath tests a stage that does not produce the mapped path.
+func TestApplyStageMappings_MissingPath(t *testing.T) {
+	RegisterDockerfileBuilder(func(ctx context.Context, input DockerfileBuildInput) error {
+		return nil
+	})
+	defer RegisterDockerfileBuilder(nil)
+
+	cfg := &config.Config{
+		Source:        config.SourceConfig{Dockerfile: "Dockerfile"},
+		StageMappings: []config.StageMapping{{FromStage: "builder", Path: "/out/app", Dest: "/usr/bin/app"}},
+	}
+	if err := applyStageMappings(context.Background(), cfg, t.TempDir(), t.TempDir(), nil); err == nil {
+		t.Fatal("Expected error for a path missing from the stage")
+	}
+}
+
+// TestOverlayDockerRootfs_StageMappingsOnly tests that an initramfs whose
+// Dockerfile only feeds stage mappings does not get its final stage
+// overlaid, unless source.target names the stage to overlay.
+func TestOverlayDockerRootfs_StageMappingsOnly(t *testing.T) {
+	var targets []string
+	RegisterDockerfileBuilder(func(ctx context.Context, input DockerfileBuildInput) error {
+		targets = append(targets, input.Target)
+		if err := os.WriteFile(filepath.Join(input.DestDir, "from-"+input.Target), nil, 0644); err != nil {
+			return err
+		}
+		return os.WriteFile(input.ImageConfigPath, []byte(`{"config":{}}`), 0644)
+	})
+	defer RegisterDockerfileBuilder(nil)
+
+	cfg := &config.Config{
+		Source:        config.SourceConfig{Dockerfile: "Dockerfile"},
+		StageMappings: []config.StageMapping{{FromStage: "builder", Path: "/out/app", Dest: "/usr/bin/app"}},
+	}
+	b := &InitramfsBuilder{Config: cfg, WorkDir: t.TempDir(), RootfsDir: t.TempDir(), TempRoot: t.TempDir()}
+	if err := b.overlayDockerRootfsIfProvided(); err != nil {
+		t.Fatalf("overlayDockerRootfsIfProvided failed: %v", err)
+	}
+	if len(targets) != 0 || b.ImageConfig != nil {
+		t.Errorf("Expected no final stage build, got targets %v", targets)
+	}
+
+	cfg.Source.Target = "runtime"
+	if err := b.overlayDockerRootfsIfProvided(); err != nil {
+		t.Fatalf("overlayDockerRootfsIfProvided failed: %v", err)
+	}
+	if !reflect.DeepEqual(targets, []string{"runtime"}) {
+		t.Errorf("Expected the runtime stage to be built, got %v", targets)
+	}
+	if _, err := os.Stat(filepath.Join(b.RootfsDir, "from-runtime")); err != nil {
+		t.Errorf("Expected the runtime stage to be overlaid: %v", err)
+	}
+}
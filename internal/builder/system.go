@@ -0,0 +1,211 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// Files generated from [system].
+const (
+	sysctlConfPath      = "/etc/sysctl.d/90-fledge.conf"
+	modulesLoadConfPath = "/etc/modules-load.d/fledge.conf"
+)
+
+// hostKernelRelease returns the kernel release of the build host.
+func hostKernelRelease(ctx context.Context) (string, error) {
+	output, err := exec.CommandContext(ctx, "uname", "-r").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to detect kernel version: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// applySystemConfig writes the [system] sysctl and modules-load.d entries
+// and copies the listed modules of the guest kernel into the rootfs.
+func applySystemConfig(ctx context.Context, sys *config.SystemConfig, rootfsDir string, kernel *guestKernel) error {
+	if sys == nil {
+		return nil
+	}
+
+	if len(sys.Sysctls) > 0 {
+		keys := make([]string, 0, len(sys.Sysctls))
+		for key := range sys.Sysctls {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString("# Generated by fledge from [system] sysctls\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s = %s\n", key, sys.Sysctls[key])
+		}
+		if err := writeRootfsFile(rootfsDir, sysctlConfPath, b.String()); err != nil {
+			return err
+		}
+		logging.InfoContext(ctx, "Wrote sysctl settings", "path", sysctlConfPath, "count", len(keys))
+	}
+
+	if len(sys.ModulesLoad) == 0 {
+		return nil
+	}
+	content := "# Generated by fledge from [system] modules_load\n" + strings.Join(sys.ModulesLoad, "\n") + "\n"
+	if err := writeRootfsFile(rootfsDir, modulesLoadConfPath, content); err != nil {
+		return err
+	}
+
+	release, hostDir, err := kernel.modules(ctx)
+	if err != nil {
+		return err
+	}
+	if err := installModules(ctx, hostDir, filepath.Join(rootfsDir, "lib/modules", release), sys.ModulesLoad); err != nil {
+		return err
+	}
+	logging.InfoContext(ctx, "Installed boot-time kernel modules", "kernel", release, "modules", sys.ModulesLoad)
+	return nil
+}
+
+// writeRootfsFile writes content to path inside the rootfs.
+func writeRootfsFile(rootfsDir, path, content string) error {
+	dest := filepath.Join(rootfsDir, path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(dest, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// moduleName returns the module name of a modules.dep path such as
+// "kernel/net/bridge/br_netfilter.ko.zst". Dashes and underscores are
+// interchangeable in module names.
+func moduleName(path string) string {
+	name := filepath.Base(path)
+	if i := strings.Index(name, ".ko"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// readModulesDep parses a modules.dep file into each module's path and
+// dependency line.
+func readModulesDep(path string) (paths map[string]string, deps map[string][]string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	paths = make(map[string]string)
+	deps = make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		mod, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		paths[moduleName(mod)] = mod
+		deps[mod] = strings.Fields(rest)
+	}
+	return paths, deps, scanner.Err()
+}
+
+// installModules copies modules and their dependencies from the host module
+// directory hostDir to destDir, keeping their relative paths, and writes a
+// modules.dep covering them so modprobe finds them. Modules built into the
+// kernel need no file and are skipped.
+func installModules(ctx context.Context, hostDir, destDir string, modules []string) error {
+	paths, deps, err := readModulesDep(filepath.Join(hostDir, "modules.dep"))
+	if err != nil {
+		return fmt.Errorf("failed to read modules.dep of the guest kernel (set [kernel] to point at its modules): %w", err)
+	}
+	builtin := make(map[string]bool)
+	if data, err := os.ReadFile(filepath.Join(hostDir, "modules.builtin")); err == nil {
+		for _, line := range strings.Fields(string(data)) {
+			builtin[moduleName(line)] = true
+		}
+	}
+
+	copied := make(map[string]bool)
+	var copyModule func(rel string) error
+	copyModule = func(rel string) error {
+		if copied[rel] {
+			return nil
+		}
+		copied[rel] = true
+		if err := CopyFile(filepath.Join(hostDir, rel), filepath.Join(destDir, rel), 0644); err != nil {
+			return fmt.Errorf("failed to copy kernel module %s: %w", rel, err)
+		}
+		for _, dep := range deps[rel] {
+			if err := copyModule(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, m := range modules {
+		name := strings.ReplaceAll(m, "-", "_")
+		rel, ok := paths[name]
+		if !ok {
+			if builtin[name] {
+				logging.DebugContext(ctx, "Kernel module is built in", "module", m)
+				continue
+			}
+			return fmt.Errorf("kernel module %s not found in %s", m, hostDir)
+		}
+		if err := copyModule(rel); err != nil {
+			return err
+		}
+	}
+	if len(copied) == 0 {
+		return nil
+	}
+
+	// Extend the image's modules.dep, if any, with the copied modules
+	depPath := filepath.Join(destDir, "modules.dep")
+	existing, _, err := readModulesDep(depPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read modules.dep: %w", err)
+	}
+	have := make(map[string]bool, len(existing))
+	for _, rel := range existing {
+		have[rel] = true
+	}
+	rels := make([]string, 0, len(copied))
+	for rel := range copied {
+		if !have[rel] {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	f, err := os.OpenFile(depPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write modules.dep: %w", err)
+	}
+	for _, rel := range rels {
+		line := rel + ":"
+		if len(deps[rel]) > 0 {
+			line += " " + strings.Join(deps[rel], " ")
+		}
+		fmt.Fprintln(f, line)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write modules.dep: %w", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(destDir, "modules.builtin")); os.IsNotExist(err) {
+		if err := CopyFile(filepath.Join(hostDir, "modules.builtin"), filepath.Join(destDir, "modules.builtin"), 0644); err != nil {
+			logging.DebugContext(ctx, "No modules.builtin copied", "error", err)
+		}
+	}
+	return nil
+}
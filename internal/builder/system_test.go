@@ -0,0 +1,70 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestInstallModules tests copying modules with their dependencies from a
+// host module directory.
+func TestInstallModules(t *testing.T) {
+	hostDir := t.TempDir()
+	files := map[string]string{
+		"modules.dep":                           "kernel/net/bridge/br_netfilter.ko.zst: kernel/net/bridge/bridge.ko.zst kernel/net/802/stp.ko.zst\nkernel/net/bridge/bridge.ko.zst: kernel/net/802/stp.ko.zst\nkernel/net/802/stp.ko.zst:\nkernel/fs/fuse/fuse.ko.zst:\n",
+		"modules.builtin":                       "kernel/net/ipv4/tcp_cubic.ko\n",
+		"kernel/net/bridge/br_netfilter.ko.zst": "br_netfilter",
+		"kernel/net/bridge/bridge.ko.zst":       "bridge",
+		"kernel/net/802/stp.ko.zst":             "stp",
+		"kernel/fs/fuse/fuse.ko.zst":            "fuse",
+	}
+	for name, content := range files {
+		path := filepath.Join(hostDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	destDir := filepath.Join(t.TempDir(), "lib/modules/6.1.0")
+	ctx := context.Background()
+
+	if err := installModules(ctx, hostDir, destDir, []string{"br-netfilter", "tcp_cubic"}); err != nil {
+		t.Fatalf("installModules failed: %v", err)
+	}
+	for _, rel := range []string{"kernel/net/bridge/br_netfilter.ko.zst", "kernel/net/bridge/bridge.ko.zst", "kernel/net/802/stp.ko.zst"} {
+		if _, err := os.Stat(filepath.Join(destDir, rel)); err != nil {
+			t.Errorf("Expected %s to be copied: %v", rel, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "kernel/fs/fuse/fuse.ko.zst")); !os.IsNotExist(err) {
+		t.Errorf("Expected unrelated modules to be left out, got %v", err)
+	}
+	dep, err := os.ReadFile(filepath.Join(destDir, "modules.dep"))
+	want := "kernel/net/802/stp.ko.zst:\nkernel/net/bridge/br_netfilter.ko.zst: kernel/net/bridge/bridge.ko.zst kernel/net/802/stp.ko.zst\nkernel/net/bridge/bridge.ko.zst: kernel/net/802/stp.ko.zst\n"
+	if err != nil || string(dep) != want {
+		t.Errorf("modules.dep = %q, %v; want %q", dep, err, want)
+	}
+
+	if err := installModules(ctx, hostDir, destDir, []string{"missing"}); err == nil {
+		t.Error("Expected a missing module to fail")
+	}
+}
+
+// TestApplySystemConfig tests writing sysctl.d settings.
+func TestApplySystemConfig(t *testing.T) {
+	root := t.TempDir()
+	sys := &config.SystemConfig{Sysctls: map[string]string{"vm.swappiness": "10", "net.ipv4.ip_forward": "1"}}
+	if err := applySystemConfig(context.Background(), sys, root, nil); err != nil {
+		t.Fatalf("applySystemConfig failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, sysctlConfPath))
+	want := "# Generated by fledge from [system] sysctls\nnet.ipv4.ip_forward = 1\nvm.swappiness = 10\n"
+	if err != nil || string(data) != want {
+		t.Errorf("sysctl.d = %q, %v; want %q", data, err, want)
+	}
+}
@@ -0,0 +1,140 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// systemdUnitDir is where generated units are installed.
+const systemdUnitDir = "/etc/systemd/system"
+
+// systemdBinaries are the paths a systemd-based image has its init at.
+var systemdBinaries = []string{"/lib/systemd/systemd", "/usr/lib/systemd/systemd"}
+
+// defaultExecPath is searched for a relative ENTRYPOINT when the workload
+// does not set PATH.
+const defaultExecPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// writeSystemdUnit writes the workload of tpl as the [systemd] service unit
+// and enables it in its target.
+func writeSystemdUnit(ctx context.Context, sd *config.SystemdConfig, tpl *config.ManifestTemplate, rootfsDir string) error {
+	if sd == nil {
+		return nil
+	}
+	if !hasSystemd(rootfsDir) {
+		return fmt.Errorf("[systemd] requires an image that boots systemd, but none of %v exists", systemdBinaries)
+	}
+	if tpl == nil || tpl.Workload == nil || tpl.Workload.Entrypoint == "" {
+		return fmt.Errorf("[systemd] needs a workload: the image has no ENTRYPOINT or CMD and manifest.toml sets no [workload] entrypoint")
+	}
+
+	unit := systemdUnit(sd, tpl, resolveExecutable(rootfsDir, tpl.Workload.Entrypoint, tpl.Env["PATH"]))
+	unitPath := path.Join(systemdUnitDir, sd.UnitName())
+	if err := writeRootfsFile(rootfsDir, unitPath, unit); err != nil {
+		return err
+	}
+
+	if sd.IsEnabled() {
+		wantsDir := filepath.Join(rootfsDir, systemdUnitDir, sd.Target()+".wants")
+		if err := os.MkdirAll(wantsDir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s.wants: %w", sd.Target(), err)
+		}
+		link := filepath.Join(wantsDir, sd.UnitName())
+		os.Remove(link)
+		if err := os.Symlink(unitPath, link); err != nil {
+			return fmt.Errorf("failed to enable %s: %w", sd.UnitName(), err)
+		}
+	}
+	logging.InfoContext(ctx, "Generated systemd unit", "unit", sd.UnitName(), "enabled", sd.IsEnabled(), "target", sd.Target())
+	return nil
+}
+
+// hasSystemd reports whether the rootfs contains systemd.
+func hasSystemd(rootfsDir string) bool {
+	for _, bin := range systemdBinaries {
+		if _, err := resolveInRoot(rootfsDir, bin); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveExecutable returns the absolute path of a relative entrypoint
+// inside the rootfs by searching pathEnv, or the entrypoint unchanged.
+func resolveExecutable(rootfsDir, entrypoint, pathEnv string) string {
+	if strings.Contains(entrypoint, "/") {
+		return entrypoint
+	}
+	if pathEnv == "" {
+		pathEnv = defaultExecPath
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		candidate := path.Join(dir, entrypoint)
+		if _, err := resolveInRoot(rootfsDir, candidate); err == nil {
+			return candidate
+		}
+	}
+	return entrypoint
+}
+
+// systemdUnit renders the service unit running the workload of tpl.
+func systemdUnit(sd *config.SystemdConfig, tpl *config.ManifestTemplate, entrypoint string) string {
+	w := tpl.Workload
+	description := tpl.Name
+	if description == "" {
+		description = strings.TrimSuffix(sd.UnitName(), ".service")
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by fledge from the image's ENTRYPOINT/CMD\n")
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s workload\n", description)
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=simple\n")
+
+	argv := append([]string{entrypoint}, w.Args...)
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = `"` + systemdExecEscaper.Replace(arg) + `"`
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quoted, " "))
+	if w.WorkDir != "" {
+		fmt.Fprintf(&b, "WorkingDirectory=%s\n", w.WorkDir)
+	}
+	if w.User != "" {
+		user, group, _ := strings.Cut(w.User, ":")
+		fmt.Fprintf(&b, "User=%s\n", user)
+		if group != "" {
+			fmt.Fprintf(&b, "Group=%s\n", group)
+		}
+	}
+	keys := make([]string, 0, len(tpl.Env))
+	for key := range tpl.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "Environment=\"%s\"\n", systemdEnvEscaper.Replace(key+"="+tpl.Env[key]))
+	}
+	fmt.Fprintf(&b, "Restart=%s\n", sd.RestartPolicy())
+	b.WriteString("\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=%s\n", sd.Target())
+	return b.String()
+}
+
+// Escapers for double-quoted unit file words. Both escape specifiers;
+// ExecStart= also expands $VARIABLES, Environment= does not.
+var (
+	systemdEnvEscaper  = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "%", "%%")
+	systemdExecEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "%", "%%", "$", "$$")
+)
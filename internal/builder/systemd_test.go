@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestWriteSystemdUnit tests translating a workload into an enabled
+// service unit.
+func TestWriteSystemdUnit(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"usr/lib/systemd/systemd", "usr/sbin/nginx"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, path), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tpl := &config.ManifestTemplate{
+		Name: "nginx",
+		Workload: &config.WorkloadConfig{
+			Entrypoint: "nginx",
+			Args:       []string{"-g", "daemon off;"},
+			WorkDir:    "/srv",
+			User:       "www:www",
+		},
+		Env: map[string]string{"GREETING": `say "100%"`},
+	}
+	sd := &config.SystemdConfig{Unit: "nginx"}
+
+	if err := writeSystemdUnit(context.Background(), sd, tpl, root); err != nil {
+		t.Fatalf("writeSystemdUnit failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "etc/systemd/system/nginx.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Generated by fledge from the image's ENTRYPOINT/CMD\n" +
+		"[Unit]\nDescription=nginx workload\nWants=network-online.target\nAfter=network-online.target\n" +
+		"\n[Service]\nType=simple\n" +
+		"ExecStart=\"/usr/sbin/nginx\" \"-g\" \"daemon off;\"\n" +
+		"WorkingDirectory=/srv\nUser=www\nGroup=www\n" +
+		"Environment=\"GREETING=say \\\"100%%\\\"\"\n" +
+		"Restart=on-failure\n" +
+		"\n[Install]\nWantedBy=multi-user.target\n"
+	if string(data) != want {
+		t.Errorf("unit =\n%s\nwant\n%s", data, want)
+	}
+	target, err := os.Readlink(filepath.Join(root, "etc/systemd/system/multi-user.target.wants/nginx.service"))
+	if err != nil || target != "/etc/systemd/system/nginx.service" {
+		t.Errorf("Expected the unit to be enabled, got %q, %v", target, err)
+	}
+
+	if err := writeSystemdUnit(context.Background(), sd, tpl, t.TempDir()); err == nil {
+		t.Error("Expected an image without systemd to fail")
+	}
+}
@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/vendored"
+)
+
+// vendoredBusybox returns the busybox embedded into fledge if the build
+// installs the default busybox, url with checksum sha256, or nil.
+func vendoredBusybox(url, sha256 string) *vendored.Binary {
+	b := vendored.Busybox
+	if !b.Available() || url != config.DefaultBusyboxURL {
+		return nil
+	}
+	if sha256 != "" && !strings.EqualFold(sha256, config.DefaultBusyboxSHA256) {
+		return nil
+	}
+	// A vendored binary other than the default one is not used for it
+	if b.SHA256() != config.DefaultBusyboxSHA256 {
+		return nil
+	}
+	return b
+}
+
+// vendoredAgent returns the kestrel agent embedded into fledge if version
+// names exactly its release tag, or nil. "latest" is resolved against the
+// releases instead, since the vendored agent falls behind them.
+func vendoredAgent(version string) *vendored.Binary {
+	a := vendored.Agent
+	if !a.Available() || version != a.Version {
+		return nil
+	}
+	return a
+}
+
+// sourceAgentFromVendored writes the vendored agent a to a temporary file
+// and returns its path along with its release tag and the URL the release
+// publishes it at.
+func sourceAgentFromVendored(ctx context.Context, a *vendored.Binary) (string, string, string, error) {
+	logging.InfoContext(ctx, "Using vendored agent", "version", a.Version)
+	f, err := os.CreateTemp("", "fledge-kestrel-*")
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	f.Close()
+	if err := a.WriteFile(f.Name()); err != nil {
+		os.Remove(f.Name())
+		return "", "", "", err
+	}
+	url := fmt.Sprintf("https://github.com/%s/releases/download/%s/%s", DefaultGitHubRepo, a.Version, DefaultAgentBinaryName)
+	return f.Name(), a.Version, url, nil
+}
@@ -0,0 +1,145 @@
+package builder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// imageCheckers are the read-only consistency checks run on a finished
+// filesystem image, by filesystem type. None of them modify the image.
+var imageCheckers = map[string][]string{
+	"squashfs": {"unsquashfs", "-stat"},
+	"ext4":     {"e2fsck", "-f", "-n"},
+	"xfs":      {"xfs_repair", "-n", "-f"},
+	"btrfs":    {"btrfs", "check", "--readonly"},
+}
+
+// verifyImage checks the filesystem image at path with the checker of
+// fsType and returns its SHA256. A missing checker is a warning, not a
+// failure, so hosts without e.g. xfsprogs can still build squashfs.
+func verifyImage(ctx context.Context, path, fsType string) (string, error) {
+	checker, ok := imageCheckers[fsType]
+	if !ok {
+		return "", fmt.Errorf("no verifier for filesystem type %q", fsType)
+	}
+	if _, err := exec.LookPath(checker[0]); err != nil {
+		logging.WarnClassContext(ctx, logging.WarnVerify, "Filesystem checker not found; skipping image verification", "tool", checker[0], "filesystem", fsType)
+	} else {
+		report.FromContext(ctx).UseTool(checker[0])
+		args := append(append([]string{}, checker[1:]...), path)
+		if out, err := exec.CommandContext(ctx, checker[0], args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("%s image is corrupt (%s): %w\nOutput: %s", fsType, checker[0], err, out)
+		}
+	}
+	return verifiedChecksum(ctx, path)
+}
+
+// verifyInitramfs checks that the gzip stream at path decompresses with
+// valid CRCs and holds a complete newc cpio archive, and returns its SHA256.
+func verifyInitramfs(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open initramfs: %w", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return "", fmt.Errorf("initramfs is not a gzip stream: %w", err)
+	}
+	defer zr.Close()
+	entries, err := checkCPIO(zr)
+	if err != nil {
+		return "", fmt.Errorf("initramfs is corrupt: %w", err)
+	}
+	// Drain the rest so the gzip trailer's CRC and size are checked
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return "", fmt.Errorf("initramfs is corrupt: %w", err)
+	}
+	logging.DebugContext(ctx, "Initramfs archive verified", "entries", entries)
+	return verifiedChecksum(ctx, path)
+}
+
+// cpioHeaderSize is the length of a newc header; its fields are 8 hex
+// digits each after the 6-byte magic.
+const cpioHeaderSize = 110
+
+// cpioTrailer is the name of the entry that ends a cpio archive.
+const cpioTrailer = "TRAILER!!!"
+
+// checkCPIO walks the newc cpio archive read from r up to its trailer and
+// returns the number of entries before it.
+func checkCPIO(r io.Reader) (int, error) {
+	var (
+		header [cpioHeaderSize]byte
+		offset int64
+		count  int
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return count, fmt.Errorf("cpio archive ends without %s after %d entries", cpioTrailer, count)
+			}
+			return count, fmt.Errorf("cpio archive truncated in header at offset %d: %w", offset, err)
+		}
+		if magic := string(header[:6]); magic != "070701" && magic != "070702" {
+			return count, fmt.Errorf("bad cpio header magic %q at offset %d", magic, offset)
+		}
+		fileSize, err := cpioField(header[:], 6)
+		if err != nil {
+			return count, fmt.Errorf("bad cpio header at offset %d: %w", offset, err)
+		}
+		nameSize, err := cpioField(header[:], 11)
+		if err != nil {
+			return count, fmt.Errorf("bad cpio header at offset %d: %w", offset, err)
+		}
+		if nameSize == 0 {
+			return count, fmt.Errorf("bad cpio header at offset %d: empty name", offset)
+		}
+
+		name := make([]byte, nameSize+cpioPad(cpioHeaderSize+nameSize))
+		if _, err := io.ReadFull(r, name); err != nil {
+			return count, fmt.Errorf("cpio archive truncated in entry %d: %w", count+1, err)
+		}
+		if string(name[:nameSize-1]) == cpioTrailer {
+			return count, nil
+		}
+		body := fileSize + cpioPad(fileSize)
+		if n, err := io.CopyN(io.Discard, r, body); err != nil {
+			return count, fmt.Errorf("cpio archive truncated in %s (%d of %d bytes): %w", name[:nameSize-1], n, body, err)
+		}
+		offset += cpioHeaderSize + int64(len(name)) + body
+		count++
+	}
+}
+
+// cpioField parses the i-th hex field of a newc header.
+func cpioField(header []byte, i int) (int64, error) {
+	start := 6 + 8*i
+	return strconv.ParseInt(string(header[start:start+8]), 16, 64)
+}
+
+// cpioPad returns the padding that aligns n to 4 bytes.
+func cpioPad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// verifiedChecksum returns the SHA256 of a verified artifact.
+func verifiedChecksum(ctx context.Context, path string) (string, error) {
+	checksum, err := computeSHA256(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute artifact checksum: %w", err)
+	}
+	logging.InfoContext(ctx, "Artifact verified", "path", path, "sha256", checksum)
+	return checksum, nil
+}
@@ -0,0 +1,80 @@
+package builder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newcEntry encodes one newc cpio entry.
+func newcEntry(name string, data []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		1, 0100644, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+	b.WriteString(name)
+	b.WriteByte(0)
+	b.Write(make([]byte, cpioPad(int64(b.Len()))))
+	b.Write(data)
+	b.Write(make([]byte, cpioPad(int64(len(data)))))
+	return b.Bytes()
+}
+
+// TestVerifyInitramfs tests that complete archives pass and truncated or
+// damaged ones fail.
+func TestVerifyInitramfs(t *testing.T) {
+	var archive []byte
+	archive = append(archive, newcEntry("init", []byte("#!/bin/sh\n"))...)
+	archive = append(archive, newcEntry("etc/hostname", []byte("fledge"))...)
+	complete := append(append([]byte{}, archive...), newcEntry(cpioTrailer, nil)...)
+
+	gz := func(data []byte) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(data)
+		zw.Close()
+		return b.Bytes()
+	}
+	good := gz(complete)
+	corrupt := append([]byte{}, good...)
+	corrupt[len(corrupt)-6] ^= 0xff // CRC32 in the gzip trailer
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"complete", good, ""},
+		{"no trailer", gz(archive), "ends without TRAILER!!!"},
+		{"truncated entry", gz(complete[:150]), "truncated"},
+		{"bad magic", gz(append([]byte("070707"), complete[6:]...)), "bad cpio header magic"},
+		{"bad crc", corrupt, "checksum"},
+		{"not gzip", complete, "not a gzip stream"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".cpio.gz")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			checksum, err := verifyInitramfs(context.Background(), path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyInitramfs failed: %v", err)
+				}
+				if want, _ := computeSHA256(path); checksum != want {
+					t.Errorf("checksum = %q, want %q", checksum, want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyInitramfs() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattr copies the extended attribute name from src to dst without
+// following symlinks. A missing attribute is not an error.
+func copyXattr(src, dst, name string) error {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(src, name, buf)
+	if errors.Is(err, unix.ERANGE) {
+		if n, err = unix.Lgetxattr(src, name, nil); err == nil {
+			buf = make([]byte, n)
+			n, err = unix.Lgetxattr(src, name, buf)
+		}
+	}
+	switch {
+	case errors.Is(err, unix.ENODATA), errors.Is(err, unix.ENOTSUP):
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to read %s of %s: %w", name, src, err)
+	}
+	if err := unix.Lsetxattr(dst, name, buf[:n], 0); err != nil {
+		return fmt.Errorf("failed to set %s on %s: %w", name, dst, err)
+	}
+	return nil
+}
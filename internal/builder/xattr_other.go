@@ -0,0 +1,8 @@
+//go:build !linux
+
+package builder
+
+// copyXattr is a no-op on platforms without Linux extended attributes.
+func copyXattr(src, dst, name string) error {
+	return nil
+}
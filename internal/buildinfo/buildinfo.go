@@ -0,0 +1,102 @@
+// Package buildinfo describes this fledge binary for fledge version --json:
+// its version, the platform it runs on, the features compiled into it and
+// the versions of the main libraries it was built with, so that tooling can
+// gate its behavior on what a fledge supports.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/vendored"
+)
+
+// Info describes a fledge binary.
+type Info struct {
+	Version   string `json:"version"`
+	BuildDate string `json:"build_date"`
+	GitCommit string `json:"git_commit"`
+	// GoVersion is the Go toolchain fledge was built with.
+	GoVersion string `json:"go_version"`
+	// Platform is the OS and architecture, such as "linux/amd64".
+	Platform string   `json:"platform"`
+	Features Features `json:"features"`
+	// Libraries maps the module path of each main library to its version.
+	Libraries map[string]string `json:"libraries"`
+}
+
+// Features are what a fledge binary can build with.
+type Features struct {
+	// EmbeddedBuildKit is whether Dockerfile builds run in-process,
+	// without a buildkitd.
+	EmbeddedBuildKit bool `json:"embedded_buildkit"`
+	// Hypervisors are the microVM backends that Dockerfile RUN steps can
+	// run in, the default first.
+	Hypervisors []string `json:"hypervisors"`
+	// PrivilegeDropping is whether fledge build --drop-privileges works.
+	PrivilegeDropping bool `json:"privilege_dropping"`
+	// Strategies are the build strategies a fledge.toml can select.
+	Strategies []string `json:"strategies"`
+	// Filesystems are the [filesystem] types of OCI rootfs builds.
+	Filesystems []string `json:"filesystems"`
+	// Userlands are the source.userland choices of initramfs builds.
+	Userlands []string `json:"userlands"`
+	// Vendored maps the binaries embedded with -tags fledge_vendor, such
+	// as "busybox" and "kestrel", to their versions.
+	Vendored map[string]string `json:"vendored"`
+}
+
+// libraries are the modules whose versions Info reports.
+var libraries = []string{
+	"github.com/moby/buildkit",
+	"github.com/containerd/containerd",
+	"github.com/volantvm/volant",
+	"github.com/opencontainers/image-spec",
+	"google.golang.org/grpc",
+	"go.opentelemetry.io/otel",
+}
+
+// Get describes this binary, built as version at buildDate from gitCommit.
+func Get(version, buildDate, gitCommit string) Info {
+	return Info{
+		Version:   version,
+		BuildDate: buildDate,
+		GitCommit: gitCommit,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features: Features{
+			EmbeddedBuildKit:  embeddedBuildKit,
+			Hypervisors:       hypervisors(),
+			PrivilegeDropping: privilegeDropping,
+			Strategies:        config.Strategies,
+			Filesystems:       config.FilesystemTypes,
+			Userlands:         []string{config.UserlandBusybox, config.UserlandToybox, config.UserlandDash},
+			Vendored:          vendored.Versions(),
+		},
+		Libraries: libraryVersions(),
+	}
+}
+
+// libraryVersions returns the versions of libraries linked into the binary,
+// as replaced in go.mod if they are. Libraries that are not linked, or all
+// of them when the binary has no module information, are left out.
+func libraryVersions() map[string]string {
+	versions := map[string]string{}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return versions
+	}
+	for _, dep := range info.Deps {
+		for _, lib := range libraries {
+			if dep.Path != lib {
+				continue
+			}
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			versions[lib] = dep.Version
+		}
+	}
+	return versions
+}
@@ -0,0 +1,53 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestGet tests describing the binary and its JSON keys.
+func TestGet(t *testing.T) {
+	info := Get("1.2.3", "2025-01-01", "abc123")
+	if info.Version != "1.2.3" || info.BuildDate != "2025-01-01" || info.GitCommit != "abc123" {
+		t.Errorf("Expected the version information to be kept, got %+v", info)
+	}
+	if info.Platform != runtime.GOOS+"/"+runtime.GOARCH || info.GoVersion != runtime.Version() {
+		t.Errorf("unexpected platform %s and Go version %s", info.Platform, info.GoVersion)
+	}
+	if runtime.GOOS == "linux" && (!info.Features.EmbeddedBuildKit || len(info.Features.Hypervisors) == 0) {
+		t.Errorf("Expected the embedded BuildKit and hypervisors on linux, got %+v", info.Features)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"platform"`, `"embedded_buildkit"`, `"hypervisors"`, `"filesystems":["squashfs"`, `"libraries"`} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("Expected %s in %s", key, data)
+		}
+	}
+}
+
+// TestProbeHost tests probing tools, with a hypervisor binary chosen
+// through the environment.
+func TestProbeHost(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	host := ProbeHost()
+	if len(host.Architectures) != 1 || host.Architectures[0] != runtime.GOARCH {
+		t.Errorf("Expected the host architecture, got %v", host.Architectures)
+	}
+	if len(host.Filesystems) != 4 || host.Filesystems[0].Name != "squashfs" || host.Filesystems[0].Tool != "mksquashfs" {
+		t.Errorf("unexpected filesystems: %+v", host.Filesystems)
+	}
+	for _, b := range append(host.Filesystems, host.Hypervisors...) {
+		if b.Available {
+			t.Errorf("Expected %s to be unavailable with an empty PATH", b.Name)
+		}
+	}
+	if len(host.CacheBackends) == 0 || host.CacheBackends[0] != "download" {
+		t.Errorf("unexpected cache backends: %v", host.CacheBackends)
+	}
+}
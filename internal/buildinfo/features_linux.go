@@ -0,0 +1,29 @@
+//go:build linux
+
+package buildinfo
+
+import (
+	"runtime"
+
+	"github.com/volantvm/fledge/internal/launcher"
+)
+
+const (
+	embeddedBuildKit  = true
+	privilegeDropping = true
+)
+
+func hypervisors() []string {
+	return []string{launcher.HypervisorCloudHypervisor, launcher.HypervisorQEMU}
+}
+
+// hypervisorBin returns the binary step VMs of hypervisor run.
+func hypervisorBin(hypervisor string) string {
+	return launcher.ConfiguredBin(hypervisor)
+}
+
+// hypervisorRuns reports whether hypervisor can boot step VMs on this
+// host's architecture: QEMU's microvm machine type is x86_64 only.
+func hypervisorRuns(hypervisor string) bool {
+	return hypervisor != launcher.HypervisorQEMU || runtime.GOARCH == "amd64"
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package buildinfo
+
+// The embedded BuildKit, step microVMs and the privileged helper need Linux.
+const (
+	embeddedBuildKit  = false
+	privilegeDropping = false
+)
+
+func hypervisors() []string {
+	return []string{}
+}
+
+func hypervisorBin(hypervisor string) string {
+	return hypervisor
+}
+
+func hypervisorRuns(hypervisor string) bool {
+	return false
+}
@@ -0,0 +1,68 @@
+package buildinfo
+
+import (
+	"os/exec"
+	"runtime"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// Host describes what builds this host can run, as far as the tools they
+// need are installed, for fledge serve's GET /v1/capabilities.
+type Host struct {
+	// Architectures are the CPU architectures of the artifacts built here:
+	// images are pulled and step VMs run for the host's own.
+	Architectures []string `json:"architectures"`
+	// Filesystems are the [filesystem] types and the tools that make them.
+	Filesystems []Backend `json:"filesystems"`
+	// Hypervisors are the microVM backends of Dockerfile RUN steps.
+	Hypervisors []Backend `json:"hypervisors"`
+	// CacheBackends are the caches builds use: "download" for pulled images
+	// and downloaded assets, "buildkit" for Dockerfile steps and "package"
+	// for the [build.package_cache] proxy of step VMs.
+	CacheBackends []string `json:"cache_backends"`
+}
+
+// Backend is a filesystem type or hypervisor and whether the tool it runs
+// is installed.
+type Backend struct {
+	Name      string `json:"name"`
+	Tool      string `json:"tool"`
+	Available bool   `json:"available"`
+}
+
+// mkfsTools are the tools that make each filesystem type.
+var mkfsTools = map[string]string{
+	"squashfs": "mksquashfs",
+	"ext4":     "mkfs.ext4",
+	"xfs":      "mkfs.xfs",
+	"btrfs":    "mkfs.btrfs",
+}
+
+// ProbeHost looks up the tools and hypervisors installed on this host.
+func ProbeHost() Host {
+	host := Host{
+		Architectures: []string{runtime.GOARCH},
+		Filesystems:   []Backend{},
+		Hypervisors:   []Backend{},
+		CacheBackends: []string{"download"},
+	}
+	for _, fsType := range config.FilesystemTypes {
+		host.Filesystems = append(host.Filesystems, probe(fsType, mkfsTools[fsType]))
+	}
+	for _, hypervisor := range hypervisors() {
+		b := probe(hypervisor, hypervisorBin(hypervisor))
+		b.Available = b.Available && hypervisorRuns(hypervisor)
+		host.Hypervisors = append(host.Hypervisors, b)
+	}
+	if embeddedBuildKit {
+		host.CacheBackends = append(host.CacheBackends, "buildkit", "package")
+	}
+	return host
+}
+
+// probe reports whether tool is installed for the backend name.
+func probe(name, tool string) Backend {
+	_, err := exec.LookPath(tool)
+	return Backend{Name: name, Tool: tool, Available: err == nil}
+}
@@ -0,0 +1,185 @@
+// Package buildctx prepares the inputs shared with BuildKit for a Dockerfile
+// build: the frontend selection and its attributes, and the local directories,
+// with .dockerignore and .fledgeignore exclusions applied before anything is
+// transferred into the build session.
+package buildctx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/patternmatcher/ignorefile"
+	"github.com/tonistiigi/fsutil"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+const (
+	// FrontendDockerfile is the built-in Dockerfile frontend.
+	FrontendDockerfile = "dockerfile.v0"
+	// FrontendGateway runs a frontend image (e.g. docker/dockerfile:1.7-labs)
+	// through the BuildKit gateway.
+	FrontendGateway = "gateway.v0"
+)
+
+// Frontend returns the frontend name and attributes for building dockerfile.
+// When frontendImage is set the build is routed through the gateway frontend
+// so that image is resolved and used to parse the Dockerfile.
+func Frontend(dockerfile, target string, buildArgs map[string]string, frontendImage string) (string, map[string]string) {
+	// The dockerfile frontend expects "filename" relative to the "dockerfile" local dir.
+	attrs := map[string]string{
+		"filename": filepath.Base(dockerfile),
+	}
+	if target != "" {
+		attrs["target"] = target
+	}
+	for k, v := range buildArgs {
+		attrs["build-arg:"+k] = v
+	}
+	if frontendImage == "" {
+		return FrontendDockerfile, attrs
+	}
+	attrs["source"] = frontendImage
+	return FrontendGateway, attrs
+}
+
+// ImageTarExport returns an export entry writing the built image to path as
+// an OCI image tarball, for use alongside the rootfs export.
+func ImageTarExport(path string) bkclient.ExportEntry {
+	return bkclient.ExportEntry{
+		Type: bkclient.ExporterOCI,
+		Output: func(map[string]string) (io.WriteCloser, error) {
+			return os.Create(path)
+		},
+	}
+}
+
+// IgnoreFiles lists the ignore files read from the context root, in the order
+// their patterns are applied. Later files may re-include paths with "!".
+var IgnoreFiles = []string{".dockerignore", ".fledgeignore"}
+
+// ExcludePatterns returns the exclusion patterns for contextDir. Patterns from
+// a Dockerfile-specific "<Dockerfile>.dockerignore" replace .dockerignore, as
+// in docker build.
+func ExcludePatterns(contextDir, dockerfile string) ([]string, error) {
+	var patterns []string
+	for _, name := range IgnoreFiles {
+		path := filepath.Join(contextDir, name)
+		if name == ".dockerignore" && dockerfile != "" {
+			if specific := dockerfile + ".dockerignore"; fileExists(specific) {
+				path = specific
+			}
+		}
+		p, err := readIgnoreFile(path)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p...)
+	}
+	return patterns, nil
+}
+
+// LocalMounts returns the "context" and "dockerfile" mounts expected by the
+// dockerfile.v0 frontend, with ignore patterns applied to the context.
+func LocalMounts(contextDir, dockerfile string) (map[string]fsutil.FS, error) {
+	patterns, err := ExcludePatterns(contextDir, dockerfile)
+	if err != nil {
+		return nil, err
+	}
+
+	contextFS, err := fsutil.NewFS(contextDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid build context %s: %w", contextDir, err)
+	}
+	if len(patterns) > 0 {
+		logging.Debug("Applying build context ignore patterns", "context", contextDir, "patterns", len(patterns))
+		contextFS, err = fsutil.NewFilterFS(contextFS, &fsutil.FilterOpt{ExcludePatterns: patterns})
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore patterns in %s: %w", contextDir, err)
+		}
+	}
+
+	dockerfileFS, err := fsutil.NewFS(filepath.Dir(dockerfile))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Dockerfile directory: %w", err)
+	}
+
+	return map[string]fsutil.FS{
+		"context":    contextFS,
+		"dockerfile": dockerfileFS,
+	}, nil
+}
+
+func readIgnoreFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	patterns, err := ignorefile.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return patterns, nil
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// ExportPathsBuildFunc returns a gateway build function that solves the
+// Dockerfile through frontend and returns a scratch filesystem containing only
+// paths copied from the result, each at its original location. Exporting that
+// result avoids transferring the whole stage rootfs.
+func ExportPathsBuildFunc(frontend string, attrs map[string]string, paths []string) gwclient.BuildFunc {
+	return func(ctx context.Context, c gwclient.Client) (*gwclient.Result, error) {
+		res, err := c.Solve(ctx, gwclient.SolveRequest{
+			Frontend:    frontend,
+			FrontendOpt: attrs,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ref, err := res.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+		stage, err := ref.ToState()
+		if err != nil {
+			return nil, err
+		}
+
+		var action *llb.FileAction
+		for _, p := range paths {
+			info := &llb.CopyInfo{
+				FollowSymlinks:      true,
+				CopyDirContentsOnly: true,
+				CreateDestPath:      true,
+			}
+			if action == nil {
+				action = llb.Copy(stage, p, p, info)
+			} else {
+				action = action.Copy(stage, p, p, info)
+			}
+		}
+		if action == nil {
+			return nil, fmt.Errorf("no paths to export")
+		}
+
+		def, err := llb.Scratch().File(action).Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.Solve(ctx, gwclient.SolveRequest{Definition: def.ToPB()})
+	}
+}
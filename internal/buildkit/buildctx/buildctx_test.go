@@ -0,0 +1,196 @@
+package buildctx
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir for %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+// TestExcludePatterns tests combining .dockerignore and .fledgeignore.
+func TestExcludePatterns(t *testing.T) {
+	ctxDir := t.TempDir()
+	writeFiles(t, ctxDir, map[string]string{
+		".dockerignore": "# comment\nnode_modules\n.git\n",
+		".fledgeignore": "*.log\n!keep.log\n",
+	})
+
+	patterns, err := ExcludePatterns(ctxDir, filepath.Join(ctxDir, "Dockerfile"))
+	if err != nil {
+		t.Fatalf("ExcludePatterns failed: %v", err)
+	}
+	want := []string{"node_modules", ".git", "*.log", "!keep.log"}
+	if !reflect.DeepEqual(patterns, want) {
+		t.Errorf("Expected %v, got %v", want, patterns)
+	}
+}
+
+// TestExcludePatterns_DockerfileSpecific tests that <Dockerfile>.dockerignore overrides .dockerignore.
+func TestExcludePatterns_DockerfileSpecific(t *testing.T) {
+	ctxDir := t.TempDir()
+	writeFiles(t, ctxDir, map[string]string{
+		".dockerignore":                     "node_modules\n",
+		"build/app.Dockerfile":              "FROM scratch\n",
+		"build/app.Dockerfile.dockerignore": "dist\n",
+	})
+
+	patterns, err := ExcludePatterns(ctxDir, filepath.Join(ctxDir, "build", "app.Dockerfile"))
+	if err != nil {
+		t.Fatalf("ExcludePatterns failed: %v", err)
+	}
+	if !reflect.DeepEqual(patterns, []string{"dist"}) {
+		t.Errorf("Expected [dist], got %v", patterns)
+	}
+}
+
+// TestExcludePatterns_None tests contexts without ignore files.
+func TestExcludePatterns_None(t *testing.T) {
+	patterns, err := ExcludePatterns(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("ExcludePatterns failed: %v", err)
+	}
+	if len(patterns) != 0 {
+		t.Errorf("Expected no patterns, got %v", patterns)
+	}
+}
+
+// TestLocalMounts tests that ignored paths are not visible in the context mount.
+func TestLocalMounts(t *testing.T) {
+	ctxDir := t.TempDir()
+	writeFiles(t, ctxDir, map[string]string{
+		".dockerignore":             "node_modules\n",
+		".fledgeignore":             "*.log\n!keep.log\n",
+		"Dockerfile":                "FROM scratch\n",
+		"main.go":                   "package main\n",
+		"node_modules/pkg/index.js": "module.exports = {}\n",
+		"debug.log":                 "noise\n",
+		"keep.log":                  "signal\n",
+	})
+
+	mounts, err := LocalMounts(ctxDir, filepath.Join(ctxDir, "Dockerfile"))
+	if err != nil {
+		t.Fatalf("LocalMounts failed: %v", err)
+	}
+	if _, ok := mounts["dockerfile"]; !ok {
+		t.Fatalf("Expected dockerfile mount")
+	}
+
+	var seen []string
+	err = mounts["context"].Walk(context.Background(), "", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			seen = append(seen, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	sort.Strings(seen)
+
+	want := []string{".dockerignore", ".fledgeignore", "Dockerfile", "keep.log", "main.go"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("Expected context files %v, got %v", want, seen)
+	}
+}
+
+// TestFrontend tests frontend selection and attribute construction.
+func TestFrontend(t *testing.T) {
+	name, attrs := Frontend("/src/docker/app.Dockerfile", "runtime", map[string]string{"VERSION": "1.2.3"}, "")
+	if name != FrontendDockerfile {
+		t.Errorf("Expected %s, got %s", FrontendDockerfile, name)
+	}
+	want := map[string]string{
+		"filename":          "app.Dockerfile",
+		"target":            "runtime",
+		"build-arg:VERSION": "1.2.3",
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("Expected attrs %v, got %v", want, attrs)
+	}
+
+	name, attrs = Frontend("/src/Dockerfile", "", nil, "docker/dockerfile:1.7-labs")
+	if name != FrontendGateway {
+		t.Errorf("Expected %s, got %s", FrontendGateway, name)
+	}
+	if attrs["source"] != "docker/dockerfile:1.7-labs" {
+		t.Errorf("Expected source attr to be the frontend image, got %q", attrs["source"])
+	}
+	if attrs["filename"] != "Dockerfile" {
+		t.Errorf("Expected filename Dockerfile, got %q", attrs["filename"])
+	}
+}
+
+// TestFrontend_SyntaxDirectiveHeredoc tests a Dockerfile that picks its
+// frontend with a syntax directive and runs a heredoc: without a frontend
+// image the built-in frontend gets it unchanged, so it can hand the build to
+// the image the directive names, and its parser reads the heredoc as the
+// script of the RUN.
+func TestFrontend_SyntaxDirectiveHeredoc(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Dockerfile": "# syntax=docker/dockerfile:1.7\nFROM alpine:3.20\nRUN <<EOF\nset -e\necho hello > /greeting\nEOF\n",
+	})
+	dockerfile := filepath.Join(dir, "Dockerfile")
+
+	name, attrs := Frontend(dockerfile, "", nil, "")
+	if name != FrontendDockerfile {
+		t.Errorf("Expected %s, got %s", FrontendDockerfile, name)
+	}
+	for _, attr := range []string{"source", "cmdline"} {
+		if v, ok := attrs[attr]; ok {
+			t.Errorf("Expected no %s attr overriding the syntax directive, got %q", attr, v)
+		}
+	}
+
+	dt, err := os.ReadFile(dockerfile)
+	if err != nil {
+		t.Fatalf("Failed to read Dockerfile: %v", err)
+	}
+	if syntax, _, _, ok := parser.DetectSyntax(dt); !ok || syntax != "docker/dockerfile:1.7" {
+		t.Errorf("Expected syntax docker/dockerfile:1.7, got %q", syntax)
+	}
+	ast, err := parser.Parse(bytes.NewReader(dt))
+	if err != nil {
+		t.Fatalf("Failed to parse Dockerfile: %v", err)
+	}
+	stages, _, err := instructions.Parse(ast.AST)
+	if err != nil {
+		t.Fatalf("Failed to parse instructions: %v", err)
+	}
+	if len(stages) != 1 || len(stages[0].Commands) != 1 {
+		t.Fatalf("Expected one stage with one command, got %+v", stages)
+	}
+	run, ok := stages[0].Commands[0].(*instructions.RunCommand)
+	if !ok || len(run.Files) != 1 || run.Files[0].Data != "set -e\necho hello > /greeting\n" {
+		t.Errorf("Expected a RUN with the heredoc script, got %+v", stages[0].Commands[0])
+	}
+
+	// A frontend image takes precedence over the directive
+	name, attrs = Frontend(dockerfile, "", nil, "docker/dockerfile:1.7-labs")
+	if name != FrontendGateway || attrs["source"] != "docker/dockerfile:1.7-labs" {
+		t.Errorf("Expected the gateway with the frontend image, got %s %v", name, attrs)
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"github.com/volantvm/fledge/internal/builder"
 	"os"
-	"path/filepath"
 	"strings"
 
 	bkclient "github.com/moby/buildkit/client"
+	"github.com/volantvm/fledge/internal/buildkit/buildctx"
 	embedded "github.com/volantvm/fledge/internal/buildkit/embedded"
+	"github.com/volantvm/fledge/internal/progress"
 )
 
 // Options for building a Dockerfile to a local rootfs directory using BuildKit.
@@ -31,6 +32,20 @@ type DockerfileBuildOptions struct {
 
 	// Destination directory to export the built rootfs (will be created if not exists)
 	DestDir string
+
+	// Optional file to receive the built image's OCI config JSON (embedded mode only)
+	ImageConfigPath string
+
+	// Optional frontend image (e.g. docker/dockerfile:1.7-labs) resolved through
+	// the gateway instead of the built-in Dockerfile frontend
+	FrontendImage string
+
+	// Optional absolute paths to export from the target stage instead of the
+	// whole rootfs; each lands at the same path under DestDir
+	ExportPaths []string
+
+	// Optional file to also receive the built image as an OCI image tarball
+	ImageTarPath string
 }
 
 // BuildDockerfileToRootfs uses BuildKit's dockerfile.v0 frontend to build the given Dockerfile
@@ -39,7 +54,17 @@ func BuildDockerfileToRootfs(ctx context.Context, opts DockerfileBuildOptions) e
 	// Embedded is now the default unless explicitly set to daemon/external
 	mode := strings.ToLower(strings.TrimSpace(os.Getenv("FLEDGE_BUILDKIT_MODE")))
 	if mode == "" || mode == "embedded" {
-		return embedded.BuildDockerfileToRootfs(ctx, opts.Dockerfile, opts.ContextDir, opts.Target, opts.BuildArgs, opts.DestDir)
+		return embedded.BuildDockerfileToRootfs(ctx, embedded.Options{
+			Dockerfile:      opts.Dockerfile,
+			ContextDir:      opts.ContextDir,
+			Target:          opts.Target,
+			BuildArgs:       opts.BuildArgs,
+			DestDir:         opts.DestDir,
+			ImageConfigPath: opts.ImageConfigPath,
+			FrontendImage:   opts.FrontendImage,
+			ExportPaths:     opts.ExportPaths,
+			ImageTarPath:    opts.ImageTarPath,
+		})
 	}
 
 	addr := opts.Address
@@ -58,28 +83,18 @@ func BuildDockerfileToRootfs(ctx context.Context, opts DockerfileBuildOptions) e
 	}
 	defer c.Close()
 
-	// dockerfile.v0 frontend expects local dirs named "context" and "dockerfile"
-	// "filename" is the dockerfile path relative to dockerfile local dir.
-	dfDir := filepath.Dir(opts.Dockerfile)
-	dfBase := filepath.Base(opts.Dockerfile)
+	frontendName, frontendAttrs := buildctx.Frontend(opts.Dockerfile, opts.Target, opts.BuildArgs, opts.FrontendImage)
 
-	frontendAttrs := map[string]string{
-		"filename": dfBase,
-	}
-	if opts.Target != "" {
-		frontendAttrs["target"] = opts.Target
-	}
-	for k, v := range opts.BuildArgs {
-		frontendAttrs["build-arg:"+k] = v
+	// Ship the context through .dockerignore/.fledgeignore filters
+	localMounts, err := buildctx.LocalMounts(opts.ContextDir, opts.Dockerfile)
+	if err != nil {
+		return fmt.Errorf("buildkit context: %w", err)
 	}
 
 	solveOpt := bkclient.SolveOpt{
-		Frontend:      "dockerfile.v0",
+		Frontend:      frontendName,
 		FrontendAttrs: frontendAttrs,
-		LocalDirs: map[string]string{
-			"context":    opts.ContextDir,
-			"dockerfile": dfDir,
-		},
+		LocalMounts:   localMounts,
 		Exports: []bkclient.ExportEntry{
 			{
 				Type:      bkclient.ExporterLocal,
@@ -87,8 +102,24 @@ func BuildDockerfileToRootfs(ctx context.Context, opts DockerfileBuildOptions) e
 			},
 		},
 	}
+	if opts.ImageTarPath != "" {
+		solveOpt.Exports = append(solveOpt.Exports, buildctx.ImageTarExport(opts.ImageTarPath))
+	}
 
-	_, err = c.Solve(ctx, nil, solveOpt, nil)
+	statusCh := make(chan *bkclient.SolveStatus, 16)
+	displayed := make(chan struct{})
+	go func() {
+		defer close(displayed)
+		progress.DisplaySolve(os.Stderr, statusCh)
+	}()
+
+	if len(opts.ExportPaths) > 0 {
+		buildFn := buildctx.ExportPathsBuildFunc(frontendName, frontendAttrs, opts.ExportPaths)
+		_, err = c.Build(ctx, solveOpt, "fledge", buildFn, statusCh)
+	} else {
+		_, err = c.Solve(ctx, nil, solveOpt, statusCh)
+	}
+	<-displayed
 	if err != nil {
 		return fmt.Errorf("buildkit solve failed: %w", err)
 	}
@@ -98,13 +129,28 @@ func BuildDockerfileToRootfs(ctx context.Context, opts DockerfileBuildOptions) e
 func init() {
 	builder.RegisterDockerfileBuilder(func(ctx context.Context, input builder.DockerfileBuildInput) error {
 		return BuildDockerfileToRootfs(ctx, DockerfileBuildOptions{
-			Dockerfile: input.Dockerfile,
-			ContextDir: input.ContextDir,
-			Target:     input.Target,
-			BuildArgs:  input.BuildArgs,
-			DestDir:    input.DestDir,
+			Dockerfile:      input.Dockerfile,
+			ContextDir:      input.ContextDir,
+			Target:          input.Target,
+			BuildArgs:       input.BuildArgs,
+			DestDir:         input.DestDir,
+			ImageConfigPath: input.ImageConfigPath,
+			FrontendImage:   input.FrontendImage,
+			ExportPaths:     input.ExportPaths,
+			ImageTarPath:    input.ImageTarPath,
 		})
 	})
+	builder.RegisterDockerfileStateDir(func() string {
+		mode := strings.ToLower(strings.TrimSpace(os.Getenv("FLEDGE_BUILDKIT_MODE")))
+		if mode != "" && mode != "embedded" {
+			return ""
+		}
+		dir, err := embedded.StateDir()
+		if err != nil {
+			return ""
+		}
+		return dir
+	})
 }
 
 // Compose minimal schema (subset) for build configuration
@@ -4,13 +4,11 @@ package embedded
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -30,7 +28,15 @@ import (
 	"github.com/moby/buildkit/solver/bboltcachestorage"
 	"github.com/moby/buildkit/util/resolver"
 	"github.com/moby/buildkit/worker"
+	"github.com/volantvm/fledge/internal/buildkit/buildctx"
+	"github.com/volantvm/fledge/internal/logging"
 	"github.com/volantvm/fledge/internal/microvmworker"
+	"github.com/volantvm/fledge/internal/oci"
+	"github.com/volantvm/fledge/internal/progress"
+	"github.com/volantvm/fledge/internal/report"
+	"github.com/volantvm/fledge/internal/retry"
+	"github.com/volantvm/fledge/internal/utils"
+	"github.com/volantvm/fledge/internal/vmnet"
 	"go.etcd.io/bbolt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/test/bufconn"
@@ -42,14 +48,15 @@ const (
 
 // BuildDockerfileToRootfs executes a Dockerfile build using an embedded BuildKit
 // controller backed by the microVM worker. The build output is exported to the
-// provided destination directory.
-func BuildDockerfileToRootfs(ctx context.Context, dockerfile, contextDir, target string, buildArgs map[string]string, destDir string) error {
-	stateDir, err := ensureStateDir()
+// provided destination directory. When opts.ImageConfigPath is non-empty the
+// image config JSON is written there as well.
+func BuildDockerfileToRootfs(ctx context.Context, opts Options) error {
+	stateDir, err := ensureStateDir(ctx)
 	if err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(destDir, 0o755); err != nil {
+	if err := os.MkdirAll(opts.DestDir, 0o755); err != nil {
 		return fmt.Errorf("embedded buildkit: create dest dir: %w", err)
 	}
 
@@ -66,114 +73,132 @@ func BuildDockerfileToRootfs(ctx context.Context, dockerfile, contextDir, target
 	}
 	defer cleanup()
 
-	dfDir := filepath.Dir(dockerfile)
-	dfBase := filepath.Base(dockerfile)
-
-	frontendAttrs := map[string]string{
-		"filename": dfBase,
-	}
-	if target != "" {
-		frontendAttrs["target"] = target
+	frontendName, frontendAttrs := buildctx.Frontend(opts.Dockerfile, opts.Target, opts.BuildArgs, opts.FrontendImage)
+	if opts.FrontendImage != "" {
+		logging.Info("Using Dockerfile frontend image", "image", opts.FrontendImage)
 	}
-	for k, v := range buildArgs {
-		frontendAttrs["build-arg:"+k] = v
+
+	// Ship the context through .dockerignore/.fledgeignore filters
+	localMounts, err := buildctx.LocalMounts(opts.ContextDir, opts.Dockerfile)
+	if err != nil {
+		return fmt.Errorf("embedded buildkit: build context: %w", err)
 	}
 
-	// Export to OCI image format instead of local directory (much faster)
+	// Export to an OCI layout directory instead of a local directory (much faster)
+	ociLayoutDir := filepath.Join(ociDir, "oci-layout")
 	solveOpt := bkclient.SolveOpt{
-		Frontend:      "dockerfile.v0",
+		Frontend:      frontendName,
 		FrontendAttrs: frontendAttrs,
-		LocalDirs: map[string]string{
-			"context":    contextDir,
-			"dockerfile": dfDir,
-		},
+		LocalMounts:   localMounts,
 		Exports: []bkclient.ExportEntry{
 			{
-				Type:   bkclient.ExporterOCI,
-				Output: func(_ map[string]string) (io.WriteCloser, error) {
-					return os.Create(filepath.Join(ociDir, "image.tar"))
-				},
+				Type:      bkclient.ExporterOCI,
+				Attrs:     map[string]string{"tar": "false"},
+				OutputDir: ociLayoutDir,
 			},
 		},
 	}
 
+	if opts.ImageTarPath != "" {
+		solveOpt.Exports = append(solveOpt.Exports, buildctx.ImageTarExport(opts.ImageTarPath))
+	}
+
+	exportPaths := len(opts.ExportPaths) > 0
+	if exportPaths {
+		// Only the requested paths are exported, straight into the destination
+		solveOpt.Exports = []bkclient.ExportEntry{
+			{
+				Type:      bkclient.ExporterLocal,
+				OutputDir: opts.DestDir,
+			},
+		}
+	}
+
 	statusCh := make(chan *bkclient.SolveStatus, 16)
+	var stats progress.SolveStats
 	var progressWG sync.WaitGroup
 	progressWG.Add(1)
 	go func() {
 		defer progressWG.Done()
-		for st := range statusCh {
-			for _, v := range st.Vertexes {
-				if v == nil {
-					continue
-				}
-				switch {
-				case v.Completed != nil:
-					log.Printf("embedded buildkit: step complete: %s", v.Name)
-				case v.Error != "":
-					log.Printf("embedded buildkit: step error: %s: %s", v.Name, v.Error)
-				case v.Started != nil:
-					log.Printf("embedded buildkit: step started: %s", v.Name)
-				}
-			}
-			for _, s := range st.Statuses {
-				if s == nil {
-					continue
-				}
-				name := s.Name
-				if name == "" {
-					name = s.ID
-				}
-				if name == "" {
-					continue
-				}
-				if s.Total > 0 {
-					pct := float64(s.Current) / float64(s.Total) * 100
-					log.Printf("embedded buildkit: status %s %d/%d (%.1f%%)", name, s.Current, s.Total, pct)
-					continue
-				}
-				log.Printf("embedded buildkit: status %s", name)
-			}
-		}
+		stats = progress.DisplaySolve(os.Stderr, statusCh)
 	}()
 
-	_, err = client.Solve(ctx, nil, solveOpt, statusCh)
+	if exportPaths {
+		buildFn := buildctx.ExportPathsBuildFunc(frontendName, frontendAttrs, opts.ExportPaths)
+		_, err = client.Build(ctx, solveOpt, "fledge", buildFn, statusCh)
+	} else {
+		_, err = client.Solve(ctx, nil, solveOpt, statusCh)
+	}
 	progressWG.Wait()
+	report.FromContext(ctx).RecordBuildKit(stats.Steps, stats.Cached)
 	if err != nil {
 		return fmt.Errorf("embedded buildkit: solve failed: %w", err)
 	}
 
-	// Extract the OCI tar to the destination directory using umoci
-	log.Printf("embedded buildkit: extracting OCI image to rootfs")
-	tarPath := filepath.Join(ociDir, "image.tar")
-	ociLayoutDir := filepath.Join(ociDir, "oci-layout")
-
-	// Import tar to OCI layout
-	cmd := exec.CommandContext(ctx, "skopeo", "copy",
-		fmt.Sprintf("oci-archive:%s", tarPath),
-		fmt.Sprintf("oci:%s:latest", ociLayoutDir))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("embedded buildkit: skopeo import failed: %w\nOutput: %s", err, string(output))
+	if exportPaths {
+		logging.Info("Exported paths from BuildKit build", "count", len(opts.ExportPaths))
+		return nil
 	}
 
-	// Unpack OCI layout to rootfs
-	// Remove destDir if it exists (umoci requires it to not exist)
-	if err := os.RemoveAll(destDir); err != nil && !os.IsNotExist(err) {
+	// Apply the exported image layers to the destination directory
+	logging.Debug("Extracting BuildKit image to rootfs", "dest", opts.DestDir)
+
+	// Start from an empty rootfs so stale files never leak into the result
+	if err := os.RemoveAll(opts.DestDir); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("embedded buildkit: failed to remove existing destDir: %w", err)
 	}
 
-	cmd = exec.CommandContext(ctx, "umoci", "unpack",
-		"--image", fmt.Sprintf("%s:latest", ociLayoutDir),
-		filepath.Dir(destDir))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("embedded buildkit: umoci unpack failed: %w\nOutput: %s", err, string(output))
+	if err := oci.ApplyLayout(ctx, ociLayoutDir, "", opts.DestDir); err != nil {
+		return fmt.Errorf("embedded buildkit: apply image layers: %w", err)
+	}
+
+	if opts.ImageConfigPath != "" {
+		if err := writeImageConfig(ociLayoutDir, opts.ImageConfigPath); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("embedded buildkit: rootfs extracted successfully")
+	logging.Debug("BuildKit rootfs extracted", "dest", opts.DestDir)
 	return nil
 }
 
-func ensureStateDir() (string, error) {
+// writeImageConfig copies the image config of the exported layout to path.
+func writeImageConfig(layoutDir, path string) error {
+	manifest, err := oci.ResolveManifest(layoutDir, "")
+	if err != nil {
+		return fmt.Errorf("embedded buildkit: resolve manifest: %w", err)
+	}
+	img, err := oci.ReadConfig(layoutDir, manifest)
+	if err != nil {
+		return fmt.Errorf("embedded buildkit: %w", err)
+	}
+	data, err := json.Marshal(img)
+	if err != nil {
+		return fmt.Errorf("embedded buildkit: marshal image config: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("embedded buildkit: write image config: %w", err)
+	}
+	return nil
+}
+
+// StateDir returns the directory holding embedded BuildKit's state and cache,
+// creating it if needed.
+func StateDir() (string, error) {
+	return ensureStateDir(context.Background())
+}
+
+// ensureStateDir returns the state directory of builds under ctx: the
+// buildkit directory of a cache set with utils.WithCacheDir, such as a
+// fledge serve tenant's, or else the shared one.
+func ensureStateDir(ctx context.Context) (string, error) {
+	if base := utils.CacheBase(ctx); base != "" {
+		path := filepath.Join(base, "buildkit")
+		if err := os.MkdirAll(path, 0o700); err != nil {
+			return "", fmt.Errorf("embedded buildkit: create state dir: %w", err)
+		}
+		return path, nil
+	}
 	if v := strings.TrimSpace(os.Getenv("FLEDGE_BUILDKIT_STATE_DIR")); v != "" {
 		abs, err := filepath.Abs(v)
 		if err != nil {
@@ -207,10 +232,16 @@ func newEmbeddedClient(ctx context.Context, stateDir string) (_ *bkclient.Client
 	}
 
 	runtimeDir := filepath.Join(stateDir, "runtime")
-	mw, err := microvmworker.NewFromEnv(runtimeDir)
+	mw, err := microvmworker.NewFromEnv(runtimeDir, vmnet.FromContext(ctx))
 	if err != nil {
 		return nil, nil, err
 	}
+	mw.BootRetry = retry.FromContext(ctx).VM
+	defer func() {
+		if err != nil {
+			mw.Close()
+		}
+	}()
 
 	workerRoot := filepath.Join(stateDir, "worker")
 	registryHosts := resolver.NewRegistryConfig(nil)
@@ -334,12 +365,15 @@ func newEmbeddedClient(ctx context.Context, stateDir string) (_ *bkclient.Client
 		server.Stop()
 		listener.Close()
 		if err := controller.Close(); err != nil {
-			log.Printf("embedded buildkit: controller close error: %v", err)
+			logging.Warn("Failed to close embedded BuildKit controller", "error", err)
+		}
+		if err := mw.Close(); err != nil {
+			logging.Warn("Failed to stop the package cache", "error", err)
 		}
 		select {
 		case err := <-serverErr:
 			if err != nil {
-				log.Printf("embedded buildkit: server error: %v", err)
+				logging.Warn("Embedded BuildKit server failed", "error", err)
 			}
 		default:
 		}
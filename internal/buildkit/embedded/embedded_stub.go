@@ -7,6 +7,10 @@ import (
     "fmt"
 )
 
-func BuildDockerfileToRootfs(ctx context.Context, dockerfile, contextDir, target string, buildArgs map[string]string, destDir string) error {
+func BuildDockerfileToRootfs(ctx context.Context, opts Options) error {
     return fmt.Errorf("embedded buildkit: unsupported platform (requires linux)")
 }
+
+func StateDir() (string, error) {
+    return "", fmt.Errorf("embedded buildkit: unsupported platform (requires linux)")
+}
@@ -0,0 +1,33 @@
+package embedded
+
+// Options describes a Dockerfile build executed by the embedded controller.
+type Options struct {
+	// Absolute path to the Dockerfile
+	Dockerfile string
+
+	// Build context directory (absolute path)
+	ContextDir string
+
+	// Build target stage (optional)
+	Target string
+
+	// Build-arg key/value map
+	BuildArgs map[string]string
+
+	// Destination directory for the built rootfs (replaced if it exists)
+	DestDir string
+
+	// Optional file to receive the built image's OCI config JSON
+	ImageConfigPath string
+
+	// Optional frontend image (e.g. docker/dockerfile:1.7-labs) used instead
+	// of the built-in Dockerfile frontend
+	FrontendImage string
+
+	// Optional absolute paths to export from the target stage instead of the
+	// whole rootfs; each lands at the same path under DestDir
+	ExportPaths []string
+
+	// Optional file to also receive the built image as an OCI image tarball
+	ImageTarPath string
+}
@@ -0,0 +1,292 @@
+// Package cigen generates CI pipelines that build, verify and publish a
+// plugin with fledge.
+package cigen
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// Supported CI providers.
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+)
+
+// Options describe the plugin a pipeline builds.
+type Options struct {
+	// Config is the loaded fledge.toml.
+	Config *config.Config
+	// ConfigPath is the slash-separated path of fledge.toml relative to the
+	// repository root.
+	ConfigPath string
+	// Artifact is the file name of the artifact the build writes.
+	Artifact string
+	// Locked passes --locked, for repositories that commit fledge.lock.
+	Locked bool
+	// Version is the fledge release the pipeline installs; empty or "dev"
+	// installs the latest release.
+	Version string
+}
+
+// DefaultPath returns where provider reads its pipeline from, relative to
+// the repository root.
+func DefaultPath(provider string) string {
+	if provider == ProviderGitLab {
+		return ".gitlab-ci.yml"
+	}
+	return ".github/workflows/fledge.yml"
+}
+
+// safePathRe matches paths that need no quoting in YAML or shell.
+var safePathRe = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// Generate renders the pipeline of provider for opts.
+func Generate(provider string, opts Options) ([]byte, error) {
+	var tpl *template.Template
+	switch provider {
+	case ProviderGitHub:
+		tpl = githubTemplate
+	case ProviderGitLab:
+		tpl = gitlabTemplate
+	default:
+		return nil, fmt.Errorf("unknown CI provider %q (expected %s or %s)", provider, ProviderGitHub, ProviderGitLab)
+	}
+	if opts.Config == nil {
+		return nil, fmt.Errorf("a configuration is required")
+	}
+	for _, p := range []string{opts.ConfigPath, opts.Artifact} {
+		if !safePathRe.MatchString(p) || strings.HasPrefix(p, "../") || path.IsAbs(p) {
+			return nil, fmt.Errorf("path %q must be relative to the repository root and contain only letters, digits, '.', '_', '-' and '/'", p)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, newPipeline(opts)); err != nil {
+		return nil, fmt.Errorf("failed to render %s pipeline: %w", provider, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// pipeline is the data the templates render.
+type pipeline struct {
+	ConfigPath string
+	ConfigDir  string
+	Artifact   string
+	BuildArgs  string
+	Packages   string
+	FledgeURL  string
+	KeyFiles   []string
+	Dockerfile bool
+}
+
+func newPipeline(opts Options) pipeline {
+	p := pipeline{
+		ConfigPath: opts.ConfigPath,
+		ConfigDir:  path.Dir(opts.ConfigPath),
+		Artifact:   opts.Artifact,
+		Packages:   strings.Join(Packages(opts.Config), " "),
+		FledgeURL:  releaseURL(opts.Version),
+		Dockerfile: opts.Config.Source.Dockerfile != "",
+	}
+	args := []string{"-c", opts.ConfigPath}
+	if opts.Locked {
+		args = append(args, "--locked")
+	}
+	p.BuildArgs = strings.Join(append(args, "--output-dir", "dist"), " ")
+
+	p.KeyFiles = []string{opts.ConfigPath}
+	if opts.Locked {
+		p.KeyFiles = append(p.KeyFiles, path.Join(p.ConfigDir, "fledge.lock"))
+	}
+	return p
+}
+
+// releaseURL returns the download URL of the fledge binary of version.
+func releaseURL(version string) string {
+	if version == "" || version == "dev" {
+		return "https://github.com/volantvm/fledge/releases/latest/download/fledge-linux-amd64"
+	}
+	return "https://github.com/volantvm/fledge/releases/download/" + version + "/fledge-linux-amd64"
+}
+
+// Packages returns the Debian/Ubuntu packages providing the host tools a
+// build of cfg runs.
+func Packages(cfg *config.Config) []string {
+	pkgs := map[string]bool{"ca-certificates": true, "curl": true}
+	if cfg.Strategy == config.StrategyInitramfs {
+		pkgs["cpio"] = true
+	} else {
+		fsType := "squashfs"
+		if cfg.Filesystem != nil && cfg.Filesystem.Type != "" {
+			fsType = cfg.Filesystem.Type
+		}
+		switch fsType {
+		case "ext4":
+			pkgs["e2fsprogs"] = true
+		case "xfs":
+			pkgs["xfsprogs"] = true
+		case "btrfs":
+			pkgs["btrfs-progs"] = true
+		default:
+			pkgs["squashfs-tools"] = true
+		}
+	}
+	if cfg.Source.Image != "" {
+		pkgs["skopeo"] = true
+	}
+	out := make([]string, 0, len(pkgs))
+	for pkg := range pkgs {
+		out = append(out, pkg)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// The templates use [[ ]] as delimiters, leaving {{ }} to GitHub
+// expressions.
+var githubTemplate = template.Must(template.New("github").Delims("[[", "]]").Parse(`# Generated by "fledge generate ci --github". Set the FLEDGE_VOLANT_API
+# variable and the FLEDGE_VOLANT_TOKEN secret to publish tagged releases.
+name: Plugin
+
+on:
+  push:
+    branches: [main, master]
+    tags: ["v*"]
+  pull_request:
+
+env:
+  FLEDGE_CACHE_DIR: ${{ github.workspace }}/.fledge-cache
+[[- if .Dockerfile]]
+  FLEDGE_BUILDKIT_STATE_DIR: ${{ github.workspace }}/.fledge-cache/buildkit
+[[- end]]
+  FLEDGE_PROGRESS: plain
+
+jobs:
+  build:
+    name: Build and verify
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@v4
+
+      - name: Install build tools
+        run: sudo apt-get update && sudo apt-get install -y --no-install-recommends [[.Packages]]
+
+      - name: Install fledge
+        run: |
+          curl -fsSL -o fledge [[.FledgeURL]]
+          sudo install -m 0755 fledge /usr/local/bin/fledge
+[[- if .Dockerfile]]
+
+      # Dockerfile builds run in a microVM and need /dev/kvm
+      - name: Enable KVM
+        run: sudo chmod 666 /dev/kvm
+[[- end]]
+
+      - name: Cache downloads
+        uses: actions/cache@v4
+        with:
+          path: .fledge-cache
+          key: fledge-${{ runner.os }}-${{ hashFiles([[range $i, $f := .KeyFiles]][[if $i]], [[end]]'[[$f]]'[[end]]) }}
+          restore-keys: fledge-${{ runner.os }}-
+
+      - name: Build
+        run: |
+          mkdir -p .fledge-cache
+          sudo --preserve-env=FLEDGE_CACHE_DIR[[if .Dockerfile]],FLEDGE_BUILDKIT_STATE_DIR[[end]],FLEDGE_PROGRESS fledge build [[.BuildArgs]]
+
+      - name: Verify checksums
+        run: |
+          sudo chown -R "$USER" dist .fledge-cache
+          cd dist && sha256sum -c [[.Artifact]].sha256
+
+      - uses: actions/upload-artifact@v4
+        with:
+          name: plugin
+          path: dist/
+
+  publish:
+    name: Publish
+    if: startsWith(github.ref, 'refs/tags/v')
+    needs: build
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/download-artifact@v4
+        with:
+          name: plugin
+          path: dist
+
+      - name: Install fledge
+        run: |
+          curl -fsSL -o fledge [[.FledgeURL]]
+          sudo install -m 0755 fledge /usr/local/bin/fledge
+
+      - name: Publish to Volant
+        env:
+          FLEDGE_VOLANT_API: ${{ vars.FLEDGE_VOLANT_API }}
+          FLEDGE_VOLANT_TOKEN: ${{ secrets.FLEDGE_VOLANT_TOKEN }}
+        run: fledge publish dist/[[.Artifact]]
+`))
+
+var gitlabTemplate = template.Must(template.New("gitlab").Delims("[[", "]]").Parse(`# Generated by "fledge generate ci --gitlab". The build job needs a runner
+# that allows privileged containers for loop devices and mounts[[if .Dockerfile]]
+# and that exposes /dev/kvm, as Dockerfile builds run in a microVM[[end]]. Set
+# the FLEDGE_VOLANT_API and FLEDGE_VOLANT_TOKEN CI/CD variables to publish
+# tagged releases.
+stages:
+  - build
+  - publish
+
+variables:
+  FLEDGE_CACHE_DIR: $CI_PROJECT_DIR/.fledge-cache
+[[- if .Dockerfile]]
+  FLEDGE_BUILDKIT_STATE_DIR: $CI_PROJECT_DIR/.fledge-cache/buildkit
+[[- end]]
+  FLEDGE_PROGRESS: plain
+  FLEDGE_URL: [[.FledgeURL]]
+
+.install-fledge: &install-fledge
+  - curl -fsSL -o /usr/local/bin/fledge "$FLEDGE_URL"
+  - chmod 0755 /usr/local/bin/fledge
+
+build:
+  stage: build
+  image: ubuntu:24.04
+  before_script:
+    - apt-get update && apt-get install -y --no-install-recommends [[.Packages]]
+    - *install-fledge
+  cache:
+    key:
+      files:
+[[- range .KeyFiles]]
+        - [[.]]
+[[- end]]
+    paths:
+      - .fledge-cache/
+  script:
+    - fledge build [[.BuildArgs]]
+    - cd dist && sha256sum -c [[.Artifact]].sha256
+  artifacts:
+    paths:
+      - dist/
+    expire_in: 1 week
+
+publish:
+  stage: publish
+  image: ubuntu:24.04
+  needs: [build]
+  rules:
+    - if: $CI_COMMIT_TAG =~ /^v/
+  before_script:
+    - apt-get update && apt-get install -y --no-install-recommends ca-certificates curl
+    - *install-fledge
+  script:
+    - fledge publish dist/[[.Artifact]]
+`))
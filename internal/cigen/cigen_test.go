@@ -0,0 +1,90 @@
+package cigen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestGenerate tests the pipelines generated for an ext4 image build.
+func TestGenerate(t *testing.T) {
+	opts := Options{
+		Config: &config.Config{
+			Strategy:   config.StrategyOCIRootfs,
+			Source:     config.SourceConfig{Image: "nginx:1.27"},
+			Filesystem: &config.FilesystemConfig{Type: "ext4"},
+		},
+		ConfigPath: "plugins/nginx/fledge.toml",
+		Artifact:   "nginx.img",
+		Locked:     true,
+		Version:    "v0.9.0",
+	}
+
+	for provider, wants := range map[string][]string{
+		ProviderGitHub: {
+			"${{ github.workspace }}/.fledge-cache",
+			"install -y --no-install-recommends ca-certificates curl e2fsprogs skopeo",
+			"releases/download/v0.9.0/fledge-linux-amd64",
+			"hashFiles('plugins/nginx/fledge.toml', 'plugins/nginx/fledge.lock')",
+			"fledge build -c plugins/nginx/fledge.toml --locked --output-dir dist",
+			"sha256sum -c nginx.img.sha256",
+			"fledge publish dist/nginx.img",
+		},
+		ProviderGitLab: {
+			"FLEDGE_CACHE_DIR: $CI_PROJECT_DIR/.fledge-cache",
+			"- plugins/nginx/fledge.lock",
+			"- fledge build -c plugins/nginx/fledge.toml --locked --output-dir dist",
+			"fledge publish dist/nginx.img",
+		},
+	} {
+		out, err := Generate(provider, opts)
+		if err != nil {
+			t.Fatalf("Generate(%s) failed: %v", provider, err)
+		}
+		for _, want := range wants {
+			if !strings.Contains(string(out), want) {
+				t.Errorf("Expected %s pipeline to contain %q:\n%s", provider, want, out)
+			}
+		}
+		if strings.Contains(string(out), "BUILDKIT") || strings.Contains(string(out), "[[") {
+			t.Errorf("Unexpected content in %s pipeline:\n%s", provider, out)
+		}
+	}
+
+	if _, err := Generate("jenkins", opts); err == nil {
+		t.Error("Expected an unknown provider to fail")
+	}
+	opts.ConfigPath = "../fledge.toml"
+	if _, err := Generate(ProviderGitHub, opts); err == nil {
+		t.Error("Expected a config outside the repository to fail")
+	}
+}
+
+// TestGenerateDockerfile tests that Dockerfile builds cache the BuildKit
+// state and build without --locked when no lock file is committed.
+func TestGenerateDockerfile(t *testing.T) {
+	out, err := Generate(ProviderGitHub, Options{
+		Config: &config.Config{
+			Strategy: config.StrategyInitramfs,
+			Source:   config.SourceConfig{Dockerfile: "Dockerfile"},
+		},
+		ConfigPath: "fledge.toml",
+		Artifact:   "plugin.cpio.gz",
+	})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	for _, want := range []string{
+		"FLEDGE_BUILDKIT_STATE_DIR",
+		"sudo chmod 666 /dev/kvm",
+		"ca-certificates cpio curl",
+		"releases/latest/download",
+		"hashFiles('fledge.toml')",
+		"fledge build -c fledge.toml --output-dir dist",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Expected pipeline to contain %q:\n%s", want, out)
+		}
+	}
+}
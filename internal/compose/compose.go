@@ -0,0 +1,528 @@
+// Package compose imports a docker-compose service as a Volant plugin: it
+// translates the service's image or build, environment, ports, volumes and
+// command into a fledge.toml and manifest.toml, for fledge import compose.
+//
+// Only what a plugin can express is carried over. Everything else, such as
+// named volumes, depends_on or healthcheck, is reported as a note for the
+// user to review rather than failing the import.
+package compose
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the subset of a compose file the importer reads.
+type File struct {
+	Services map[string]*Service `yaml:"services"`
+}
+
+// Service is the subset of a compose service the importer reads.
+type Service struct {
+	Image       string       `yaml:"image"`
+	Build       *Build       `yaml:"build"`
+	Command     stringOrList `yaml:"command"`
+	Entrypoint  stringOrList `yaml:"entrypoint"`
+	Environment mapOrList    `yaml:"environment"`
+	EnvFile     envFiles     `yaml:"env_file"`
+	Ports       []Port       `yaml:"ports"`
+	Expose      []yamlString `yaml:"expose"`
+	Volumes     []Volume     `yaml:"volumes"`
+	WorkingDir  string       `yaml:"working_dir"`
+	User        string       `yaml:"user"`
+	Sysctls     mapOrList    `yaml:"sysctls"`
+	CPUs        yamlString   `yaml:"cpus"`
+	MemLimit    yamlString   `yaml:"mem_limit"`
+	Deploy      *Deploy      `yaml:"deploy"`
+	// Extra holds the keys the importer does not read, to report them.
+	Extra map[string]any `yaml:",inline"`
+}
+
+// Build is a service's build section; the short form is its context.
+type Build struct {
+	Context    string    `yaml:"context"`
+	Dockerfile string    `yaml:"dockerfile"`
+	Target     string    `yaml:"target"`
+	Args       mapOrList `yaml:"args"`
+}
+
+// UnmarshalYAML accepts the short form, a context path, and the long one.
+func (b *Build) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		b.Context = n.Value
+		return nil
+	}
+	type plain Build
+	return n.Decode((*plain)(b))
+}
+
+// Deploy is the resource limits of a service's deploy section.
+type Deploy struct {
+	Resources struct {
+		Limits struct {
+			CPUs   yamlString `yaml:"cpus"`
+			Memory yamlString `yaml:"memory"`
+		} `yaml:"limits"`
+	} `yaml:"resources"`
+}
+
+// Port is a published port: the container port and protocol, and the host
+// port, if any.
+type Port struct {
+	Target    int
+	Published int
+	Protocol  string
+	// Ports is the number of ports of a range, which Target and Published
+	// start.
+	Ports int
+}
+
+// UnmarshalYAML parses the short syntax, such as "8080:80/udp" or
+// "127.0.0.1:8000-8001:8000-8001", and the long one.
+func (p *Port) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return p.parse(n.Value)
+	}
+	var long struct {
+		Target    int        `yaml:"target"`
+		Published yamlString `yaml:"published"`
+		Protocol  string     `yaml:"protocol"`
+	}
+	if err := n.Decode(&long); err != nil {
+		return err
+	}
+	if long.Target == 0 {
+		return fmt.Errorf("line %d: port has no target", n.Line)
+	}
+	*p = Port{Target: long.Target, Protocol: long.Protocol, Ports: 1}
+	if long.Published != "" {
+		published, _, err := parsePortRange(string(long.Published))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		p.Published = published
+	}
+	return nil
+}
+
+func (p *Port) parse(s string) error {
+	spec, protocol, _ := strings.Cut(s, "/")
+	// [[host IP:]host port:]container port, where the host IP may be a
+	// bracketed IPv6 address and the host port empty
+	host, container := "", spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		host, container = spec[:i], spec[i+1:]
+		if j := strings.LastIndex(host, ":"); j >= 0 {
+			host = host[j+1:]
+		}
+	}
+	target, n, err := parsePortRange(container)
+	if err != nil {
+		return err
+	}
+	*p = Port{Target: target, Protocol: protocol, Ports: n}
+	if host != "" {
+		published, hn, err := parsePortRange(host)
+		if err != nil {
+			return err
+		}
+		if hn != n {
+			return fmt.Errorf("port %q maps %d host ports to %d container ports", s, hn, n)
+		}
+		p.Published = published
+	}
+	return nil
+}
+
+// parsePortRange parses a port, or a range such as "8000-8010", returning
+// its first port and the number of ports.
+func parsePortRange(s string) (int, int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 1 || start > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return start, 1, nil
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil || end < start || end > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return start, end - start + 1, nil
+}
+
+// Volume types.
+const (
+	VolumeBind  = "bind"
+	VolumeNamed = "volume"
+	VolumeTmpfs = "tmpfs"
+	// VolumeOther is any other type, such as npipe or cluster.
+	VolumeOther = "other"
+)
+
+// Volume is a volume mounted into a service's container.
+type Volume struct {
+	Type     string
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// UnmarshalYAML parses the short syntax, such as "./data:/data:ro", and
+// the long one.
+func (v *Volume) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		parts := strings.Split(n.Value, ":")
+		switch len(parts) {
+		case 1:
+			*v = Volume{Type: VolumeNamed, Target: parts[0]}
+		case 2, 3:
+			*v = Volume{Type: VolumeNamed, Source: parts[0], Target: parts[1]}
+			if len(parts) == 3 {
+				v.ReadOnly = strings.Contains(","+parts[2]+",", ",ro,")
+			}
+			if isHostPath(v.Source) {
+				v.Type = VolumeBind
+			}
+		default:
+			return fmt.Errorf("line %d: invalid volume %q", n.Line, n.Value)
+		}
+		return nil
+	}
+	var long struct {
+		Type     string `yaml:"type"`
+		Source   string `yaml:"source"`
+		Target   string `yaml:"target"`
+		ReadOnly bool   `yaml:"read_only"`
+	}
+	if err := n.Decode(&long); err != nil {
+		return err
+	}
+	*v = Volume(long)
+	switch v.Type {
+	case VolumeBind, VolumeNamed, VolumeTmpfs:
+	default:
+		v.Type = VolumeOther
+	}
+	return nil
+}
+
+// isHostPath reports whether a volume source is a host path rather than a
+// volume name.
+func isHostPath(s string) bool {
+	return strings.HasPrefix(s, ".") || strings.HasPrefix(s, "/") || strings.HasPrefix(s, "~")
+}
+
+// stringOrList is a command or entrypoint: a list, or a string split the
+// way a shell would.
+type stringOrList []string
+
+func (s *stringOrList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		words, err := splitWords(n.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		*s = words
+		return nil
+	}
+	return n.Decode((*[]string)(s))
+}
+
+// mapOrList is a mapping such as environment, either a map or a list of
+// KEY=VALUE entries. A key without a value maps to nil.
+type mapOrList map[string]*string
+
+func (m *mapOrList) UnmarshalYAML(n *yaml.Node) error {
+	*m = mapOrList{}
+	if n.Kind == yaml.SequenceNode {
+		var list []string
+		if err := n.Decode(&list); err != nil {
+			return err
+		}
+		for _, entry := range list {
+			key, value, ok := strings.Cut(entry, "=")
+			if ok {
+				(*m)[key] = &value
+			} else {
+				(*m)[key] = nil
+			}
+		}
+		return nil
+	}
+	var raw map[string]*yamlString
+	if err := n.Decode(&raw); err != nil {
+		return err
+	}
+	for key, value := range raw {
+		if value == nil {
+			(*m)[key] = nil
+			continue
+		}
+		s := string(*value)
+		(*m)[key] = &s
+	}
+	return nil
+}
+
+// envFiles is a service's env_file: a path, a list of paths or a list of
+// {path, required} entries.
+type envFiles []envFile
+
+type envFile struct {
+	Path     string
+	Required bool
+}
+
+func (e *envFiles) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*e = envFiles{{Path: n.Value, Required: true}}
+		return nil
+	}
+	for _, item := range n.Content {
+		if item.Kind == yaml.ScalarNode {
+			*e = append(*e, envFile{Path: item.Value, Required: true})
+			continue
+		}
+		var long struct {
+			Path     string `yaml:"path"`
+			Required *bool  `yaml:"required"`
+		}
+		if err := item.Decode(&long); err != nil {
+			return err
+		}
+		*e = append(*e, envFile{Path: long.Path, Required: long.Required == nil || *long.Required})
+	}
+	return nil
+}
+
+// yamlString is a scalar taken as written, such as a number or a size.
+type yamlString string
+
+func (s *yamlString) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a scalar", n.Line)
+	}
+	*s = yamlString(n.Value)
+	return nil
+}
+
+// Load reads the compose file at path, interpolating variables from the
+// environment and the .env file next to it, as docker compose does.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dotEnv, err := readEnvFile(filepath.Join(filepath.Dir(path), ".env"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err = interpolate(data, func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		v, ok := dotEnv[name]
+		return v, ok
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return Parse(data)
+}
+
+// Parse parses a compose file whose variables are interpolated.
+func Parse(data []byte) (*File, error) {
+	var f File
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	if len(f.Services) == 0 {
+		return nil, fmt.Errorf("compose file has no services")
+	}
+	return &f, nil
+}
+
+// ServiceNames returns the names of the services, sorted.
+func (f *File) ServiceNames() []string {
+	names := make([]string, 0, len(f.Services))
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// interpolate substitutes $VAR, ${VAR}, ${VAR:-default}, ${VAR-default},
+// ${VAR:?error} and ${VAR?error} in data; $$ is a literal $.
+func interpolate(data []byte, lookup func(string) (string, bool)) ([]byte, error) {
+	var out bytes.Buffer
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c != '$' || i+1 == len(data) {
+			out.WriteByte(c)
+			continue
+		}
+		next := data[i+1]
+		switch {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := bytes.IndexByte(data[i+2:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ${ in %q", firstLine(data[i:]))
+			}
+			value, err := expand(string(data[i+2:i+2+end]), lookup)
+			if err != nil {
+				return nil, err
+			}
+			out.WriteString(value)
+			i += 2 + end
+		case isNameByte(next, true):
+			j := i + 1
+			for j < len(data) && isNameByte(data[j], false) {
+				j++
+			}
+			value, _ := lookup(string(data[i+1 : j]))
+			out.WriteString(value)
+			i = j - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// expand expands the contents of a ${...} reference.
+func expand(ref string, lookup func(string) (string, bool)) (string, error) {
+	name, op, arg := ref, "", ""
+	for _, candidate := range []string{":-", ":?", "-", "?"} {
+		if i := strings.Index(ref, candidate); i > 0 {
+			name, op, arg = ref[:i], candidate, ref[i+len(candidate):]
+			break
+		}
+	}
+	value, set := lookup(name)
+	switch op {
+	case ":-":
+		if value == "" {
+			return arg, nil
+		}
+	case "-":
+		if !set {
+			return arg, nil
+		}
+	case ":?", "?":
+		if !set || op == ":?" && value == "" {
+			if arg == "" {
+				arg = "required variable is not set"
+			}
+			return "", fmt.Errorf("%s: %s", name, arg)
+		}
+	}
+	return value, nil
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func firstLine(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return string(data[:i])
+	}
+	return string(data)
+}
+
+// readEnvFile reads KEY=VALUE lines, skipping blank lines and comments and
+// unquoting quoted values.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	env := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[strings.TrimSpace(key)] = value
+	}
+	return env, scanner.Err()
+}
+
+// splitWords splits s into words the way a POSIX shell would, honouring
+// single and double quotes and backslash escapes.
+func splitWords(s string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+		quote  rune
+	)
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]):
+				i++
+				word.WriteRune(runes[i])
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
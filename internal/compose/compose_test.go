@@ -0,0 +1,204 @@
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+const testCompose = `services:
+  web:
+    build:
+      context: ./app
+      target: prod
+      args:
+        GO_VERSION: "1.24"
+    command: ["serve", "--port", "8080"]
+    entrypoint: /usr/bin/app
+    environment:
+      LOG_LEVEL: debug
+      MODE: ${MODE:-production}
+    env_file: app.env
+    ports:
+      - "80:8080"
+      - "127.0.0.1:9000-9001:9000-9001/udp"
+    expose:
+      - "3000"
+    volumes:
+      - ./static:/srv/static:ro
+      - data:/var/lib/app
+      - /var/run/docker.sock:/var/run/docker.sock
+    working_dir: /srv
+    user: "1000"
+    sysctls:
+      - net.core.somaxconn=1024
+    deploy:
+      resources:
+        limits:
+          cpus: "1.5"
+          memory: 512M
+    depends_on: [db]
+    healthcheck:
+      test: ["CMD", "true"]
+  db:
+    image: postgres:16
+`
+
+// TestImport tests translating a compose service into a fledge.toml and
+// manifest.toml that load.
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.env"), []byte("# comment\nDB_HOST=db\nLOG_LEVEL=info\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "docker-compose.yml")
+	if err := os.WriteFile(path, []byte(testCompose), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MODE", "")
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, err := f.Import("", Options{ComposeDir: dir, OutDir: dir}); err == nil {
+		t.Error("Expected several services to need a choice")
+	}
+	plugin, err := f.Import("web", Options{ComposeDir: dir, OutDir: dir, Source: "docker-compose.yml"})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	cfg, err := config.Parse(plugin.FledgeTOML, nil)
+	if err != nil {
+		t.Fatalf("Generated fledge.toml does not load: %v\n%s", err, plugin.FledgeTOML)
+	}
+	if cfg.Source.Dockerfile != "./app/Dockerfile" || cfg.Source.Context != "./app" || cfg.Source.Target != "prod" || cfg.Source.BuildArgs["GO_VERSION"] != "1.24" {
+		t.Errorf("Unexpected source: %+v", cfg.Source)
+	}
+	if want := map[string]string{"./static": "/srv/static"}; !reflect.DeepEqual(cfg.Mappings, want) {
+		t.Errorf("Mappings = %v, want %v", cfg.Mappings, want)
+	}
+	if cfg.System == nil || cfg.System.Sysctls["net.core.somaxconn"] != "1024" {
+		t.Errorf("Unexpected system: %+v", cfg.System)
+	}
+
+	tpl, err := config.ParseManifestTemplate(plugin.ManifestTOML, dir)
+	if err != nil {
+		t.Fatalf("Generated manifest.toml does not load: %v\n%s", err, plugin.ManifestTOML)
+	}
+	if tpl.Name != "web" || tpl.Resources.CPUCores != 2 || tpl.Resources.MemoryMB != 512 {
+		t.Errorf("Unexpected manifest: %+v %+v", tpl, tpl.Resources)
+	}
+	wantWorkload := config.WorkloadConfig{Entrypoint: "/usr/bin/app", Args: []string{"serve", "--port", "8080"}, WorkDir: "/srv", User: "1000"}
+	if tpl.Workload == nil || !reflect.DeepEqual(*tpl.Workload, wantWorkload) {
+		t.Errorf("Workload = %+v, want %+v", tpl.Workload, wantWorkload)
+	}
+	// environment wins over env_file, and empty variables take defaults
+	wantEnv := map[string]string{"DB_HOST": "db", "LOG_LEVEL": "debug", "MODE": "production"}
+	if !reflect.DeepEqual(tpl.Env, wantEnv) {
+		t.Errorf("Env = %v, want %v", tpl.Env, wantEnv)
+	}
+	wantPorts := []config.PortMappingConfig{
+		{Port: 8080, Protocol: "tcp", HostPort: 80},
+		{Port: 9000, Protocol: "udp", HostPort: 9000},
+		{Port: 9001, Protocol: "udp", HostPort: 9001},
+		{Port: 3000, Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(tpl.Network.Expose, wantPorts) {
+		t.Errorf("Ports = %+v, want %+v", tpl.Network.Expose, wantPorts)
+	}
+
+	notes := strings.Join(plugin.Notes, "\n")
+	for _, want := range []string{"volume data at /var/lib/app", "docker.sock is a host resource", "not carried over: depends_on, healthcheck", "bind mount source ./static does not exist"} {
+		if !strings.Contains(notes, want) {
+			t.Errorf("Expected a note about %q, got:\n%s", want, notes)
+		}
+	}
+	if !strings.HasPrefix(string(plugin.FledgeTOML), "# Imported from docker-compose.yml (service \"web\")") {
+		t.Errorf("Expected a header, got:\n%s", plugin.FledgeTOML)
+	}
+}
+
+// TestImportImage tests a service running an image with a shell-form
+// command and the default resources.
+func TestImportImage(t *testing.T) {
+	f, err := Parse([]byte("services:\n  cache:\n    image: redis:7\n    command: redis-server --save '' --appendonly \"no\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, err := f.Import("", Options{ComposeDir: "/c", OutDir: "/c", Name: "redis"})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	cfg, err := config.Parse(plugin.FledgeTOML, nil)
+	if err != nil {
+		t.Fatalf("Generated fledge.toml does not load: %v", err)
+	}
+	if cfg.Source.Image != "redis:7" {
+		t.Errorf("Image = %q", cfg.Source.Image)
+	}
+	tpl, err := config.ParseManifestTemplate(plugin.ManifestTOML, "/c")
+	if err != nil {
+		t.Fatalf("Generated manifest.toml does not load: %v", err)
+	}
+	if tpl.Name != "redis" || tpl.Resources.CPUCores != 1 || tpl.Resources.MemoryMB != 256 {
+		t.Errorf("Unexpected manifest: %+v", tpl)
+	}
+	if w := tpl.Workload; w == nil || w.Entrypoint != "redis-server" || !reflect.DeepEqual(w.Args, []string{"--save", "", "--appendonly", "no"}) {
+		t.Errorf("Unexpected workload: %+v", w)
+	}
+
+	if _, err := f.Import("web", Options{}); err == nil {
+		t.Error("Expected an unknown service to be rejected")
+	}
+}
+
+// TestInterpolate tests compose variable substitution.
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"SET": "value", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	for in, want := range map[string]string{
+		"$SET ${SET}":                  "value value",
+		"${EMPTY:-default} ${EMPTY-x}": "default ",
+		"${UNSET-fallback}$$HOME":      "fallback$HOME",
+		"cost: $5":                     "cost: $5",
+	} {
+		got, err := interpolate([]byte(in), lookup)
+		if err != nil || string(got) != want {
+			t.Errorf("interpolate(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := interpolate([]byte("${UNSET:?must be set}"), lookup); err == nil || !strings.Contains(err.Error(), "must be set") {
+		t.Errorf("Expected a required variable to fail, got %v", err)
+	}
+}
+
+// TestParsePort tests the short port syntax.
+func TestParsePort(t *testing.T) {
+	for in, want := range map[string]Port{
+		"80":                  {Target: 80, Ports: 1},
+		"8080:80/udp":         {Target: 80, Published: 8080, Protocol: "udp", Ports: 1},
+		"127.0.0.1::53":       {Target: 53, Ports: 1},
+		"[::1]:8443:443":      {Target: 443, Published: 8443, Ports: 1},
+		"5000-5002:6000-6002": {Target: 6000, Published: 5000, Ports: 3},
+	} {
+		var p Port
+		if err := p.parse(in); err != nil || p != want {
+			t.Errorf("parse(%q) = %+v, %v; want %+v", in, p, err, want)
+		}
+	}
+	for _, bad := range []string{"http", "80:0", "5000-5001:6000"} {
+		var p Port
+		if err := p.parse(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
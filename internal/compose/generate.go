@@ -0,0 +1,513 @@
+package compose
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Options configure an import.
+type Options struct {
+	// ComposeDir is the directory of the compose file, against which its
+	// relative paths resolve.
+	ComposeDir string
+	// OutDir is the directory fledge.toml and manifest.toml are written
+	// to, against which their relative paths resolve.
+	OutDir string
+	// Name names the plugin in manifest.toml; empty uses the service's
+	// name.
+	Name string
+	// Source is the compose file's path as the user gave it, for the
+	// header of fledge.toml.
+	Source string
+}
+
+// Plugin is the configuration imported from a compose service.
+type Plugin struct {
+	// Service is the name of the imported service.
+	Service string
+	// FledgeTOML and ManifestTOML are the contents of fledge.toml and
+	// manifest.toml.
+	FledgeTOML   []byte
+	ManifestTOML []byte
+	// Notes are what the import could not carry over or the user should
+	// check, also written at the top of fledge.toml.
+	Notes []string
+}
+
+// minMemoryMB is the least memory manifest.toml allows.
+const minMemoryMB = 128
+
+// Import translates service, or the only service of f when empty, into a
+// plugin.
+func (f *File) Import(service string, opts Options) (*Plugin, error) {
+	if service == "" {
+		if len(f.Services) > 1 {
+			return nil, fmt.Errorf("compose file has several services (%s); choose one with --service", strings.Join(f.ServiceNames(), ", "))
+		}
+		service = f.ServiceNames()[0]
+	}
+	svc, ok := f.Services[service]
+	if !ok || svc == nil {
+		return nil, fmt.Errorf("compose file has no service %q (available: %s)", service, strings.Join(f.ServiceNames(), ", "))
+	}
+	if opts.Name == "" {
+		opts.Name = service
+	}
+	imp := &importer{svc: svc, opts: opts}
+	fledge, err := imp.fledgeTOML()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := imp.manifestTOML()
+	if err != nil {
+		return nil, err
+	}
+	if len(svc.Extra) > 0 {
+		var keys []string
+		for key := range svc.Extra {
+			// The artifact's root overlay is writable already
+			if key != "tmpfs" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			imp.note("not carried over: %s", strings.Join(keys, ", "))
+		}
+	}
+
+	var header strings.Builder
+	fmt.Fprintf(&header, "# Imported from %s (service %q) by fledge import compose.\n", opts.Source, service)
+	if len(imp.notes) > 0 {
+		header.WriteString("# Review these notes before building:\n")
+		for _, n := range imp.notes {
+			fmt.Fprintf(&header, "#   - %s\n", n)
+		}
+	}
+	return &Plugin{
+		Service:      service,
+		FledgeTOML:   append([]byte(header.String()), fledge...),
+		ManifestTOML: manifest,
+		Notes:        imp.notes,
+	}, nil
+}
+
+// importer translates a service, collecting notes as it goes.
+type importer struct {
+	svc   *Service
+	opts  Options
+	notes []string
+}
+
+func (imp *importer) note(format string, args ...any) {
+	imp.notes = append(imp.notes, fmt.Sprintf(format, args...))
+}
+
+// fledgeTOML renders fledge.toml: the image or Dockerfile, sysctls and
+// bind mounts.
+func (imp *importer) fledgeTOML() ([]byte, error) {
+	svc := imp.svc
+	var w tomlWriter
+	w.kv("version", quote("1"))
+	w.kv("strategy", quote("oci_rootfs"))
+	w.table("agent")
+	w.kv("source_strategy", quote("release"))
+	w.kv("version", quote("latest"))
+
+	w.table("source")
+	var buildArgs map[string]string
+	switch {
+	case svc.Build != nil:
+		context := svc.Build.Context
+		if context == "" {
+			context = "."
+		}
+		if strings.Contains(context, "://") || strings.HasPrefix(context, "git@") {
+			return nil, fmt.Errorf("build context %s is remote; fledge builds local contexts only", context)
+		}
+		dockerfile := svc.Build.Dockerfile
+		if dockerfile == "" {
+			dockerfile = "Dockerfile"
+		}
+		contextPath := imp.composePath(context)
+		w.kv("dockerfile", quote(imp.relPath(filepath.Join(contextPath, dockerfile))))
+		w.kv("context", quote(imp.relPath(contextPath)))
+		if svc.Build.Target != "" {
+			w.kv("target", quote(svc.Build.Target))
+		}
+		buildArgs = imp.resolve("build arg", svc.Build.Args)
+	case svc.Image != "":
+		w.kv("image", quote(svc.Image))
+	default:
+		return nil, fmt.Errorf("service has neither image nor build")
+	}
+	if len(buildArgs) > 0 {
+		w.table("source.build_args")
+		w.kvs(buildArgs)
+	}
+
+	w.table("filesystem")
+	w.kv("type", quote("squashfs"))
+	w.kv("compression_level", "15")
+	w.kv("overlay_size", quote("512M"))
+
+	if sysctls := imp.resolve("sysctl", svc.Sysctls); len(sysctls) > 0 {
+		w.table("system.sysctls")
+		w.kvs(sysctls)
+	}
+
+	mappings := map[string]string{}
+	for _, v := range svc.Volumes {
+		switch v.Type {
+		case VolumeBind:
+			if src, ok := imp.bindSource(v); ok {
+				mappings[src] = v.Target
+			}
+		case VolumeNamed:
+			name := v.Source
+			if name == "" {
+				name = "anonymous volume"
+			} else {
+				name = "volume " + name
+			}
+			imp.note("%s at %s is not carried over; data written there does not outlive the VM", name, v.Target)
+		case VolumeTmpfs:
+			// The artifact's root overlay is writable already
+		default:
+			imp.note("volume at %s is not carried over", v.Target)
+		}
+	}
+	if len(mappings) > 0 {
+		w.table("mappings")
+		w.kvs(mappings)
+	}
+	return w.bytes(), nil
+}
+
+// bindSource returns the mapping source of a bind mount, relative to the
+// output directory, or false if it cannot be baked into the artifact.
+func (imp *importer) bindSource(v Volume) (string, bool) {
+	src := imp.composePath(v.Source)
+	for _, prefix := range []string{"/dev", "/proc", "/sys", "/run", "/var/run"} {
+		if src == prefix || strings.HasPrefix(src, prefix+"/") {
+			imp.note("bind mount of %s is a host resource and is not carried over", v.Source)
+			return "", false
+		}
+	}
+	if _, err := os.Stat(src); err != nil {
+		imp.note("bind mount source %s does not exist; create it before building", v.Source)
+	}
+	imp.note("bind mount %s is copied to %s at build time; the VM does not share later changes with the host", v.Source, v.Target)
+	return imp.relPath(src), true
+}
+
+// manifestTOML renders manifest.toml: the workload, resources, environment
+// and ports.
+func (imp *importer) manifestTOML() ([]byte, error) {
+	svc := imp.svc
+	var w tomlWriter
+	w.kv("schema_version", quote("v1"))
+	w.kv("name", quote(imp.opts.Name))
+	w.kv("version", quote("0.1.0"))
+	w.kv("runtime", quote(imp.opts.Name))
+
+	cpus, memory, err := imp.resources()
+	if err != nil {
+		return nil, err
+	}
+	w.table("resources")
+	w.kv("cpu_cores", strconv.Itoa(cpus))
+	w.kv("memory_mb", strconv.Itoa(memory))
+
+	// The image config fills in what the service leaves unset
+	argv := append(append([]string{}, svc.Entrypoint...), svc.Command...)
+	if len(svc.Entrypoint) == 0 && len(svc.Command) > 0 {
+		imp.note("command %q runs as the whole workload; prepend the image's ENTRYPOINT if it has one", strings.Join(svc.Command, " "))
+	}
+	if len(argv) > 0 || svc.WorkingDir != "" || svc.User != "" {
+		w.table("workload")
+		if len(argv) > 0 {
+			w.kv("entrypoint", quote(argv[0]))
+			if len(argv) > 1 {
+				w.kv("args", list(argv[1:]))
+			}
+		}
+		if svc.WorkingDir != "" {
+			w.kv("workdir", quote(svc.WorkingDir))
+		}
+		if svc.User != "" {
+			w.kv("user", quote(svc.User))
+		}
+	}
+
+	env, err := imp.environment()
+	if err != nil {
+		return nil, err
+	}
+	if len(env) > 0 {
+		w.table("env")
+		w.kvs(env)
+	}
+
+	w.table("network")
+	w.kv("mode", quote("bridged"))
+	for _, p := range imp.ports() {
+		w.arrayTable("network.expose")
+		w.kv("port", strconv.Itoa(p.Target))
+		w.kv("protocol", quote(p.Protocol))
+		if p.Published > 0 {
+			w.kv("host_port", strconv.Itoa(p.Published))
+		}
+	}
+	return w.bytes(), nil
+}
+
+// resources returns the CPU cores and memory of the service's limits, or
+// the manifest defaults.
+func (imp *importer) resources() (int, int, error) {
+	svc := imp.svc
+	cpuLimit, memLimit := svc.CPUs, svc.MemLimit
+	if d := svc.Deploy; d != nil {
+		if d.Resources.Limits.CPUs != "" {
+			cpuLimit = d.Resources.Limits.CPUs
+		}
+		if d.Resources.Limits.Memory != "" {
+			memLimit = d.Resources.Limits.Memory
+		}
+	}
+	cpus, memory := 1, 256
+	if cpuLimit != "" {
+		n, err := strconv.ParseFloat(string(cpuLimit), 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid cpus %q", cpuLimit)
+		}
+		cpus = int(math.Ceil(n))
+	}
+	if memLimit != "" {
+		bytes, err := parseMemory(string(memLimit))
+		if err != nil {
+			return 0, 0, err
+		}
+		memory = int((bytes + 1<<20 - 1) >> 20)
+		if memory < minMemoryMB {
+			imp.note("memory limit %s is raised to the %d MB a VM needs at least", memLimit, minMemoryMB)
+			memory = minMemoryMB
+		}
+	}
+	return cpus, memory, nil
+}
+
+// parseMemory parses a compose memory size such as "512m" or "1gb".
+func parseMemory(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	mult := int64(1)
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory limit %q", s)
+	}
+	return n * mult, nil
+}
+
+// environment merges the service's env files and environment.
+func (imp *importer) environment() (map[string]string, error) {
+	env := map[string]string{}
+	for _, f := range imp.svc.EnvFile {
+		vars, err := readEnvFile(imp.composePath(f.Path))
+		if os.IsNotExist(err) && !f.Required {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env_file: %w", err)
+		}
+		for k, v := range vars {
+			env[k] = v
+		}
+	}
+	for k, v := range imp.resolve("environment variable", imp.svc.Environment) {
+		env[k] = v
+	}
+	if len(env) > 0 {
+		imp.note("environment values are baked into manifest.toml; move secrets out before committing it")
+	}
+	return env, nil
+}
+
+// resolve returns the values of m, taking keys without a value from the
+// environment as compose does.
+func (imp *importer) resolve(kind string, m mapOrList) map[string]string {
+	values := map[string]string{}
+	for k, v := range m {
+		if v != nil {
+			values[k] = *v
+		} else if env, ok := os.LookupEnv(k); ok {
+			values[k] = env
+		} else {
+			imp.note("%s %s has no value and is not set; left out", kind, k)
+		}
+	}
+	return values
+}
+
+// ports returns the service's ports, with ranges expanded, and its
+// exposed ports that are not published.
+func (imp *importer) ports() []Port {
+	var ports []Port
+	add := func(p Port) {
+		if p.Protocol == "" {
+			p.Protocol = "tcp"
+		}
+		if p.Protocol != "tcp" && p.Protocol != "udp" {
+			imp.note("port %d/%s is not carried over; only tcp and udp are", p.Target, p.Protocol)
+			return
+		}
+		for i := 0; i < max(p.Ports, 1); i++ {
+			q := Port{Target: p.Target + i, Protocol: p.Protocol}
+			if p.Published > 0 {
+				q.Published = p.Published + i
+			}
+			ports = append(ports, q)
+		}
+	}
+	for _, p := range imp.svc.Ports {
+		add(p)
+	}
+	for _, e := range imp.svc.Expose {
+		var p Port
+		if err := p.parse(string(e)); err != nil {
+			imp.note("expose %q is not carried over: %v", e, err)
+			continue
+		}
+		p.Published = 0
+		add(p)
+	}
+	return ports
+}
+
+// composePath resolves a path of the compose file.
+func (imp *importer) composePath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			p = filepath.Join(home, p[1:])
+		}
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(imp.opts.ComposeDir, p)
+	}
+	return filepath.Clean(p)
+}
+
+// relPath returns path relative to the output directory when it is inside
+// it, and absolute otherwise.
+func (imp *importer) relPath(path string) string {
+	rel, err := filepath.Rel(imp.opts.OutDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	if rel == "." {
+		return "."
+	}
+	return "./" + filepath.ToSlash(rel)
+}
+
+// tomlWriter writes TOML tables, separated by blank lines.
+type tomlWriter struct {
+	b strings.Builder
+}
+
+func (w *tomlWriter) table(name string) {
+	fmt.Fprintf(&w.b, "\n[%s]\n", name)
+}
+
+func (w *tomlWriter) arrayTable(name string) {
+	fmt.Fprintf(&w.b, "\n[[%s]]\n", name)
+}
+
+// kv writes key = value, value already in TOML.
+func (w *tomlWriter) kv(key, value string) {
+	fmt.Fprintf(&w.b, "%s = %s\n", bareKey(key), value)
+}
+
+// kvs writes the string values of m, sorted by key.
+func (w *tomlWriter) kvs(m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.kv(k, quote(m[k]))
+	}
+}
+
+func (w *tomlWriter) bytes() []byte {
+	return []byte(w.b.String())
+}
+
+// bareKey returns key as is if TOML allows it bare, and quoted otherwise.
+func bareKey(key string) string {
+	for _, r := range key {
+		if !(r == '_' || r == '-' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+			return quote(key)
+		}
+	}
+	if key == "" {
+		return quote(key)
+	}
+	return key
+}
+
+// quote renders s as a TOML basic string.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// list renders a TOML array of strings.
+func list(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quote(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FilesystemTypes are the supported [filesystem] types, squashfs first as
+// the recommended one.
+var FilesystemTypes = []string{"squashfs", "ext4", "xfs", "btrfs"}
+
+// Strategies are the build strategies a fledge.toml can select.
+var Strategies = []string{StrategyOCIRootfs, StrategyInitramfs}
+
+// overrideValues are the values of settings that take one of a fixed set,
+// keyed by their dotted key.
+var overrideValues = map[string][]string{
+	"strategy":               Strategies,
+	"filesystem.type":        FilesystemTypes,
+	"filesystem.populate":    {PopulateMkfs, PopulateMount},
+	"agent.source_strategy":  {AgentSourceRelease, AgentSourceLocal, AgentSourceHTTP, AgentSourceOCI},
+	"source.userland":        {UserlandBusybox, UserlandToybox, UserlandDash},
+	"source.layer_conflicts": {LayerConflictsWarn, LayerConflictsError},
+	"limits.on_exceed":       {LimitsError, LimitsWarn},
+	"logging.format":         {"text", "json"},
+	"systemd.restart":        sortedKeys(validSystemdRestart),
+}
+
+// OverrideKeys returns the dotted keys of the fledge.toml settings a --set
+// override can change, for shell completion. Tables keyed by user data,
+// such as [mappings], and arrays of tables are left out.
+func OverrideKeys() []string {
+	var keys []string
+	collectOverrideKeys(reflect.TypeOf(Config{}), "", &keys)
+	sort.Strings(keys)
+	return keys
+}
+
+// OverrideValues returns the values the setting key can take, or nil when
+// they are not from a fixed set.
+func OverrideValues(key string) []string {
+	if values, ok := overrideValues[key]; ok {
+		return values
+	}
+	t := reflect.TypeOf(Config{})
+	for _, name := range strings.Split(key, ".") {
+		field, ok := tomlField(t, name)
+		if !ok {
+			return nil
+		}
+		t = field.Type
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+	}
+	if t.Kind() == reflect.Bool {
+		return []string{"true", "false"}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func collectOverrideKeys(t reflect.Type, prefix string, keys *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		name := tomlName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		ft := t.Field(i).Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct && !reflect.PointerTo(ft).Implements(textUnmarshaler):
+			collectOverrideKeys(ft, prefix+name+".", keys)
+		case ft.Kind() == reflect.Map, ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+		default:
+			*keys = append(*keys, prefix+name)
+		}
+	}
+}
+
+// tomlField returns the field of struct t encoded as name.
+func tomlField(t reflect.Type, name string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if tomlName(t.Field(i)) == name {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// tomlName returns the key f is encoded as, or "" when it is not encoded.
+func tomlName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
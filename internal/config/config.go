@@ -2,25 +2,62 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/vmnet"
 )
 
 // Load reads and parses a fledge.toml configuration file.
 func Load(path string) (*Config, error) {
+	return LoadWithOverrides(path, nil)
+}
+
+// LoadWithOverrides reads a fledge.toml configuration file and applies
+// "key=value" overrides (as given to --set) before defaults and validation.
+func LoadWithOverrides(path string, overrides []string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
 	}
+	return Parse(data, overrides)
+}
+
+// Parse is like LoadWithOverrides but reads the configuration from data.
+func Parse(data []byte, overrides []string) (*Config, error) {
+	var overridden []string
+	var err error
+	if len(overrides) > 0 {
+		data, overridden, err = applyOverrides(data, overrides)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	var cfg Config
-	if err := toml.Unmarshal(data, &cfg); err != nil {
+	md, err := toml.Decode(string(data), &cfg)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse TOML: %w", err)
 	}
 
+	// Reject overrides of keys fledge.toml does not define, so typos fail
+	for _, undecoded := range md.Undecoded() {
+		for _, key := range overridden {
+			if undecoded.String() == key {
+				return nil, fmt.Errorf("unknown config key '%s' in override", key)
+			}
+		}
+	}
+
 	// Apply defaults
 	if err := applyDefaults(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to apply defaults: %w", err)
@@ -41,11 +78,21 @@ func LoadManifestTemplate(path string) (*ManifestTemplate, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read manifest template %s: %w", path, err)
 	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		dir = ""
+	}
+	return ParseManifestTemplate(data, dir)
+}
 
+// ParseManifestTemplate is like LoadManifestTemplate but reads the template
+// from data. Relative paths in it resolve against dir.
+func ParseManifestTemplate(data []byte, dir string) (*ManifestTemplate, error) {
 	var tpl ManifestTemplate
 	if err := toml.Unmarshal(data, &tpl); err != nil {
 		return nil, fmt.Errorf("failed to parse manifest TOML: %w", err)
 	}
+	tpl.Dir = dir
 
 	// Apply defaults for missing fields
 	if err := applyManifestDefaults(&tpl); err != nil {
@@ -80,6 +127,12 @@ func applyManifestDefaults(tpl *ManifestTemplate) error {
 		tpl.Network.Mode = "bridged"
 	}
 
+	// The nocloud datasource gets a seed image unless disabled
+	if tpl.CloudInit != nil && tpl.CloudInit.Seed == "" &&
+		(tpl.CloudInit.Datasource == "" || tpl.CloudInit.Datasource == "nocloud") {
+		tpl.CloudInit.Seed = CloudInitSeedISO
+	}
+
 	// Default protocol for port mappings
 	if tpl.Network != nil {
 		for i := range tpl.Network.Expose {
@@ -142,11 +195,32 @@ func ValidateManifestTemplate(tpl *ManifestTemplate) error {
 		}
 	}
 
+	if ci := tpl.CloudInit; ci != nil {
+		switch ci.Seed {
+		case "", CloudInitSeedNone:
+		case CloudInitSeedISO, CloudInitSeedVFAT:
+			if ci.Datasource != "" && ci.Datasource != "nocloud" {
+				return fmt.Errorf("cloud_init.seed requires the nocloud datasource, got %q", ci.Datasource)
+			}
+		default:
+			return fmt.Errorf("invalid cloud_init.seed %q (must be iso, vfat or none)", ci.Seed)
+		}
+		if ci.UserData != nil && !ci.UserData.Inline && ci.UserData.Content == "" {
+			return fmt.Errorf("cloud_init.user_data.content must name a file when inline is false")
+		}
+	}
+
 	return nil
 }
 
 // applyDefaults applies default values for optional fields.
 func applyDefaults(cfg *Config) error {
+	// Expand the binary strategy first so the defaults of the artifact it
+	// builds apply
+	if err := expandBinary(cfg); err != nil {
+		return err
+	}
+
 	// Apply default agent config for initramfs if not provided
 	// Only apply default agent in "default" init mode, not for custom or none modes
 	if cfg.Strategy == StrategyInitramfs && cfg.Agent == nil {
@@ -157,7 +231,10 @@ func applyDefaults(cfg *Config) error {
 	}
 
 	// Initramfs: provide default Busybox if not specified
-	if cfg.Strategy == StrategyInitramfs {
+	if cfg.Strategy == StrategyInitramfs && cfg.Source.Userland == "" {
+		cfg.Source.Userland = UserlandBusybox
+	}
+	if cfg.Strategy == StrategyInitramfs && cfg.Source.Userland == UserlandBusybox {
 		if cfg.Source.BusyboxURL == "" {
 			cfg.Source.BusyboxURL = DefaultBusyboxURL
 		}
@@ -188,8 +265,70 @@ func applyDefaults(cfg *Config) error {
 		if cfg.Filesystem.SizeBufferMB == 0 {
 			cfg.Filesystem.SizeBufferMB = defaults.SizeBufferMB
 		}
+		if cfg.Filesystem.Populate == "" && cfg.Filesystem.Type != "squashfs" {
+			cfg.Filesystem.Populate = DefaultPopulate(cfg.Filesystem.Type)
+		}
+		if cfg.Filesystem.ReadOnly {
+			if cfg.Filesystem.Tmpfs == nil {
+				cfg.Filesystem.Tmpfs = append([]string(nil), DefaultTmpfsPaths...)
+			}
+			if cfg.Filesystem.OverlaySize == "" {
+				cfg.Filesystem.OverlaySize = defaults.OverlaySize
+			}
+		}
+	}
+
+	return nil
+}
+
+// expandBinary turns a "binary" strategy config into the initramfs or
+// oci_rootfs config that builds it: each executable becomes a mapping, and
+// the builders copy its shared libraries from the host.
+func expandBinary(cfg *Config) error {
+	if cfg.Strategy != StrategyBinary {
+		if cfg.Binary != nil {
+			return fmt.Errorf("'binary' section requires strategy '%s'", StrategyBinary)
+		}
+		return nil
+	}
+	if cfg.Binary == nil || len(cfg.Binary.Executables) == 0 {
+		return fmt.Errorf("'binary.executables' is required for binary strategy")
+	}
+	if cfg.Source.Image != "" || cfg.Source.Dockerfile != "" || len(cfg.Source.Layers) > 0 {
+		return fmt.Errorf("binary strategy does not use a base image; remove 'source.image', 'source.dockerfile' and 'source.layers'")
+	}
+
+	if cfg.Binary.Output == "" {
+		cfg.Binary.Output = StrategyInitramfs
+	}
+	if cfg.Binary.Output != StrategyInitramfs && cfg.Binary.Output != StrategyOCIRootfs {
+		return fmt.Errorf("invalid binary.output '%s', must be '%s' or '%s'",
+			cfg.Binary.Output, StrategyInitramfs, StrategyOCIRootfs)
+	}
+
+	if cfg.Mappings == nil {
+		cfg.Mappings = make(map[string]string)
+	}
+	seen := make(map[string]string)
+	for _, exe := range cfg.Binary.Executables {
+		if exe == "" {
+			return fmt.Errorf("binary.executables entries must not be empty")
+		}
+		if _, remote, _ := ParseRemoteSource(exe); remote {
+			return fmt.Errorf("binary executable '%s' must be a host path", exe)
+		}
+		dest := BinaryDest(exe)
+		if other, ok := seen[dest]; ok {
+			return fmt.Errorf("binary executables '%s' and '%s' both map to '%s'", other, exe, dest)
+		}
+		seen[dest] = exe
+		// An explicit mapping of the same file wins
+		if _, ok := cfg.Mappings[exe]; !ok {
+			cfg.Mappings[exe] = dest
+		}
 	}
 
+	cfg.Strategy = cfg.Binary.Output
 	return nil
 }
 
@@ -208,8 +347,8 @@ func Validate(cfg *Config) error {
 		return fmt.Errorf("'strategy' field is required")
 	}
 	if cfg.Strategy != StrategyOCIRootfs && cfg.Strategy != StrategyInitramfs {
-		return fmt.Errorf("invalid strategy '%s', must be '%s' or '%s'",
-			cfg.Strategy, StrategyOCIRootfs, StrategyInitramfs)
+		return fmt.Errorf("invalid strategy '%s', must be '%s', '%s' or '%s'",
+			cfg.Strategy, StrategyOCIRootfs, StrategyInitramfs, StrategyBinary)
 	}
 
 	// Strategy-specific validation
@@ -224,6 +363,50 @@ func Validate(cfg *Config) error {
 		}
 	}
 
+	if err := validateSource(cfg); err != nil {
+		return err
+	}
+
+	if err := validateBuild(cfg.Build); err != nil {
+		return err
+	}
+
+	if err := validateLogging(cfg.Logging); err != nil {
+		return err
+	}
+
+	if err := validateAccounts(cfg.Users, cfg.Groups); err != nil {
+		return err
+	}
+
+	if err := validateSystem(cfg.System); err != nil {
+		return err
+	}
+
+	if err := validateKernel(cfg.Kernel); err != nil {
+		return err
+	}
+
+	if err := validateGPU(cfg.GPU); err != nil {
+		return err
+	}
+
+	if err := validateSystemd(cfg); err != nil {
+		return err
+	}
+
+	if err := validateSELinux(cfg); err != nil {
+		return err
+	}
+
+	if err := validateLimits(cfg.Limits); err != nil {
+		return err
+	}
+
+	if err := validatePostprocess(cfg.Postprocess); err != nil {
+		return err
+	}
+
 	// Validate mappings
 	if err := validateMappings(cfg.Mappings); err != nil {
 		return err
@@ -232,11 +415,575 @@ func Validate(cfg *Config) error {
 	return nil
 }
 
+// validateBuild validates the [build] section.
+func validateBuild(build *BuildConfig) error {
+	if build == nil {
+		return nil
+	}
+	if err := validateDuration("build.timeout", build.Timeout); err != nil {
+		return err
+	}
+	if r := build.Retries; r != nil {
+		if r.Attempts < 0 {
+			return fmt.Errorf("build.retries.attempts must not be negative, got %d", r.Attempts)
+		}
+		if r.VMAttempts < 0 {
+			return fmt.Errorf("build.retries.vm_attempts must not be negative, got %d", r.VMAttempts)
+		}
+		if err := validateDuration("build.retries.delay", r.Delay); err != nil {
+			return err
+		}
+		if err := validateDuration("build.retries.max_delay", r.MaxDelay); err != nil {
+			return err
+		}
+	}
+	if p := build.Proxy; p != nil {
+		for key, value := range map[string]string{"build.proxy.http": p.HTTP, "build.proxy.https": p.HTTPS} {
+			if err := validateProxyURL(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	for _, class := range build.StrictWarnings {
+		if !slices.Contains(logging.WarningClasses, class) {
+			return fmt.Errorf("invalid build.strict_warnings class %q (expected one of %s)", class, strings.Join(logging.WarningClasses, ", "))
+		}
+	}
+	if c := build.PackageCache; c != nil && c.MaxSizeMB < 0 {
+		return fmt.Errorf("build.package_cache.max_size_mb must not be negative, got %d", c.MaxSizeMB)
+	}
+	if n := build.Network; n != nil {
+		switch n.Mode {
+		case "", "static", "dhcp", "user":
+		default:
+			return fmt.Errorf("invalid build.network.mode %q (expected static, dhcp or user)", n.Mode)
+		}
+		if err := validateNetworkProvider(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateProxyURL checks that value, when set, is an absolute proxy URL.
+func validateProxyURL(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid %s %q (expected a URL such as http://proxy:3128)", key, value)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q: unsupported scheme %q", key, value, u.Scheme)
+}
+
+// validateNetworkProvider validates the provider settings of [build.network].
+func validateNetworkProvider(n *BuildNetworkConfig) error {
+	if n.Mode == "user" && n.Provider != "" {
+		return fmt.Errorf("build.network.provider does not apply to mode \"user\"")
+	}
+	switch n.Provider {
+	case "", "volant", "none":
+		return nil
+	case "pool":
+	default:
+		return fmt.Errorf("invalid build.network.provider %q (expected volant, pool or none)", n.Provider)
+	}
+	if n.Bridge == "" {
+		return fmt.Errorf("build.network.bridge is required with provider \"pool\"")
+	}
+	if n.Netmask != "" && net.ParseIP(n.Netmask).To4() == nil {
+		return fmt.Errorf("invalid build.network.netmask %q", n.Netmask)
+	}
+	if n.Mode == "dhcp" {
+		return nil
+	}
+	if _, _, err := vmnet.ParsePool(n.Pool); err != nil {
+		return fmt.Errorf("invalid build.network.pool: %w", err)
+	}
+	if net.ParseIP(n.Gateway).To4() == nil {
+		return fmt.Errorf("build.network.gateway must be an IPv4 address with provider \"pool\", got %q", n.Gateway)
+	}
+	return nil
+}
+
+// validateLogging validates the [logging] section.
+func validateLogging(l *LoggingConfig) error {
+	if l == nil {
+		return nil
+	}
+	switch l.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("invalid logging.format %q (expected text or json)", l.Format)
+	}
+	if l.MaxSize != "" {
+		if _, err := ParseByteSize(l.MaxSize); err != nil {
+			return fmt.Errorf("invalid logging.max_size: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateLimits validates the [limits] section.
+func validateLimits(l *LimitsConfig) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxInitramfsMB < 0 {
+		return fmt.Errorf("limits.max_initramfs_mb must not be negative, got %d", l.MaxInitramfsMB)
+	}
+	if l.MaxRootfsMB < 0 {
+		return fmt.Errorf("limits.max_rootfs_mb must not be negative, got %d", l.MaxRootfsMB)
+	}
+	switch l.OnExceed {
+	case "", LimitsError, LimitsWarn:
+	default:
+		return fmt.Errorf("invalid limits.on_exceed %q (expected %s or %s)", l.OnExceed, LimitsError, LimitsWarn)
+	}
+	return nil
+}
+
+// validatePostprocess validates the [postprocess] section.
+func validatePostprocess(p *PostprocessConfig) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Command) == 0 || strings.TrimSpace(p.Command[0]) == "" {
+		return fmt.Errorf("postprocess.command must name a program")
+	}
+	return validateDuration("postprocess.timeout", p.Timeout)
+}
+
+// ParseByteSize parses a size such as "512K", "50M" or "1G" (powers of
+// 1024); a plain number is taken as bytes.
+func ParseByteSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mult := int64(1)
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			v = v[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// validateDuration checks that an optional duration setting is a positive
+// Go duration.
+func validateDuration(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("%s must be positive, got %q", key, value)
+	}
+	return nil
+}
+
+// BuildTimeout returns the [build] timeout, or 0 when none is configured.
+// The value is assumed to have passed Validate.
+func (c *Config) BuildTimeout() time.Duration {
+	if c.Build == nil || c.Build.Timeout == "" {
+		return 0
+	}
+	d, _ := time.ParseDuration(c.Build.Timeout)
+	return d
+}
+
+// StrictWarnings returns the warning classes that fail a build run with
+// --strict: [build] strict_warnings, or every class but logging.WarnOther.
+func (c *Config) StrictWarnings() []string {
+	if c.Build != nil && len(c.Build.StrictWarnings) > 0 {
+		return c.Build.StrictWarnings
+	}
+	var classes []string
+	for _, class := range logging.WarningClasses {
+		if class != logging.WarnOther {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+// validateSource validates options shared by both strategies' [source] section.
+func validateSource(cfg *Config) error {
+	if (cfg.Source.ExportImage != "" || cfg.Source.PushImage != "") && cfg.Source.Dockerfile == "" {
+		return fmt.Errorf("'source.export_image' and 'source.push_image' require 'source.dockerfile'")
+	}
+	if cfg.Source.FrontendImage != "" && cfg.Source.Dockerfile == "" {
+		return fmt.Errorf("'source.frontend_image' requires 'source.dockerfile'")
+	}
+	if len(cfg.StageMappings) > 0 && cfg.Source.Dockerfile == "" {
+		return fmt.Errorf("'stage_mappings' require 'source.dockerfile'")
+	}
+	if cfg.Source.Artifact != "" && (cfg.Source.Image != "" || cfg.Source.Dockerfile != "" || cfg.Binary != nil) {
+		return fmt.Errorf("'source.artifact' cannot be combined with 'source.image', 'source.dockerfile' or the binary strategy")
+	}
+	for i, layer := range cfg.Source.Layers {
+		if layer.Image == "" {
+			return fmt.Errorf("source.layers[%d]: 'image' is required", i)
+		}
+	}
+	switch cfg.Source.LayerConflicts {
+	case "", LayerConflictsWarn, LayerConflictsError:
+	default:
+		return fmt.Errorf("invalid source.layer_conflicts '%s', must be '%s' or '%s'",
+			cfg.Source.LayerConflicts, LayerConflictsWarn, LayerConflictsError)
+	}
+	if len(cfg.Source.BusyboxApplets) > 0 && cfg.Strategy != StrategyInitramfs {
+		return fmt.Errorf("'source.busybox_applets' is only supported for initramfs strategy")
+	}
+	if err := validateBusyboxApplets(cfg.Source.BusyboxApplets); err != nil {
+		return err
+	}
+	if err := validateUserland(cfg); err != nil {
+		return err
+	}
+	if err := validateStageMappings(cfg.StageMappings); err != nil {
+		return err
+	}
+	return validateAssets(cfg.Assets)
+}
+
+// validateUserland validates source.userland and its download.
+func validateUserland(cfg *Config) error {
+	src := cfg.Source
+	if src.Userland == "" && src.UserlandURL == "" && src.UserlandSHA256 == "" {
+		return nil
+	}
+	if cfg.Strategy != StrategyInitramfs {
+		return fmt.Errorf("'source.userland' is only supported for initramfs strategy")
+	}
+	switch src.Userland {
+	case UserlandBusybox:
+		if src.UserlandURL != "" || src.UserlandSHA256 != "" {
+			return fmt.Errorf("busybox userland is set with 'source.busybox_url' and 'source.busybox_sha256', not 'source.userland_url'")
+		}
+		return nil
+	case UserlandToybox, UserlandDash:
+	default:
+		return fmt.Errorf("invalid source.userland '%s', must be '%s', '%s' or '%s'",
+			src.Userland, UserlandBusybox, UserlandToybox, UserlandDash)
+	}
+
+	if src.BusyboxURL != "" || src.BusyboxSHA256 != "" {
+		return fmt.Errorf("'source.busybox_url' and 'source.busybox_sha256' cannot be used with %s userland", src.Userland)
+	}
+	if src.Userland == UserlandDash && len(src.BusyboxApplets) > 0 {
+		return fmt.Errorf("'source.busybox_applets' cannot be used with dash userland")
+	}
+	if !strings.HasPrefix(src.UserlandURL, "http://") && !strings.HasPrefix(src.UserlandURL, "https://") {
+		return fmt.Errorf("'source.userland_url' must be an http(s) URL for %s userland", src.Userland)
+	}
+	hexSum := strings.ToLower(strings.TrimPrefix(src.UserlandSHA256, "sha256:"))
+	if len(hexSum) != 64 || strings.Trim(hexSum, "0123456789abcdef") != "" {
+		return fmt.Errorf("'source.userland_sha256' must be a sha256 checksum for %s userland", src.Userland)
+	}
+	return nil
+}
+
+// sysctlKeyRe and moduleNameRe match sysctl keys and kernel module names.
+var (
+	sysctlKeyRe  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_./-]*$`)
+	moduleNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// validateSystem validates the [system] section.
+func validateSystem(s *SystemConfig) error {
+	if s == nil {
+		return nil
+	}
+	for key, value := range s.Sysctls {
+		if !sysctlKeyRe.MatchString(key) {
+			return fmt.Errorf("system.sysctls: invalid key '%s'", key)
+		}
+		if value == "" || strings.ContainsAny(value, "\n") {
+			return fmt.Errorf("system.sysctls: invalid value for '%s'", key)
+		}
+	}
+	for _, m := range s.ModulesLoad {
+		if !moduleNameRe.MatchString(m) {
+			return fmt.Errorf("system.modules_load: invalid module name '%s'", m)
+		}
+	}
+	return nil
+}
+
+// validateKernel validates the [kernel] section.
+func validateKernel(k *KernelConfig) error {
+	if k == nil {
+		return nil
+	}
+	if k.ModulesDir != "" && k.ModulesImage != "" {
+		return fmt.Errorf("only one of 'kernel.modules_dir' or 'kernel.modules_image' may be specified")
+	}
+	if k.Version == "" && k.ModulesDir == "" && k.ModulesImage == "" {
+		return fmt.Errorf("'kernel' section requires 'version', 'modules_dir' or 'modules_image'")
+	}
+	if strings.ContainsAny(k.Version, "/ ") || k.Version == "." || k.Version == ".." {
+		return fmt.Errorf("invalid kernel.version '%s'", k.Version)
+	}
+	return nil
+}
+
+// validateGPU validates the [gpu] section.
+func validateGPU(g *GPUConfig) error {
+	if g == nil {
+		return nil
+	}
+	if (g.DriverRunFile == "") == (g.DriverImage == "") {
+		return fmt.Errorf("exactly one of 'gpu.driver_run_file' or 'gpu.driver_image' is required")
+	}
+	if _, _, err := ParseRemoteSource(g.DriverRunFile); err != nil {
+		return fmt.Errorf("gpu.driver_run_file: %w", err)
+	}
+	if g.BuildModules && g.DriverRunFile == "" {
+		return fmt.Errorf("'gpu.build_modules' requires 'gpu.driver_run_file'")
+	}
+	if !strings.HasPrefix(g.LibraryDir(), "/") {
+		return fmt.Errorf("gpu.lib_dir must be an absolute path, got '%s'", g.LibDir)
+	}
+	return nil
+}
+
+// systemdUnitRe matches systemd unit names.
+var systemdUnitRe = regexp.MustCompile(`^[a-zA-Z0-9:_.@-]+$`)
+
+// validSystemdRestart lists the Restart= policies systemd accepts.
+var validSystemdRestart = map[string]bool{
+	"no": true, "always": true, "on-success": true, "on-failure": true,
+	"on-abnormal": true, "on-abort": true, "on-watchdog": true,
+}
+
+// validateSystemd validates the [systemd] section.
+func validateSystemd(cfg *Config) error {
+	s := cfg.Systemd
+	if s == nil {
+		return nil
+	}
+	if cfg.Strategy != StrategyOCIRootfs {
+		return fmt.Errorf("'systemd' is only supported by the oci_rootfs strategy")
+	}
+	if s.Unit != "" && !systemdUnitRe.MatchString(s.Unit) {
+		return fmt.Errorf("systemd.unit: invalid unit name '%s'", s.Unit)
+	}
+	if !validSystemdRestart[s.RestartPolicy()] {
+		return fmt.Errorf("invalid systemd.restart '%s'", s.Restart)
+	}
+	if !systemdUnitRe.MatchString(s.Target()) || !strings.HasSuffix(s.Target(), ".target") {
+		return fmt.Errorf("systemd.wanted_by must name a target, got '%s'", s.WantedBy)
+	}
+	return nil
+}
+
+// validateSELinux validates the [selinux] section.
+func validateSELinux(cfg *Config) error {
+	s := cfg.SELinux
+	if s == nil {
+		return nil
+	}
+	if cfg.Strategy != StrategyOCIRootfs {
+		return fmt.Errorf("'selinux' is only supported by the oci_rootfs strategy; initramfs archives carry no labels")
+	}
+	if !s.PreserveLabels && !s.Relabel {
+		return fmt.Errorf("'selinux' section requires 'preserve_labels' or 'relabel'")
+	}
+	if s.FileContexts != "" && !s.Relabel {
+		return fmt.Errorf("'selinux.file_contexts' requires 'selinux.relabel'")
+	}
+	return nil
+}
+
+// accountNameRe matches portable user and group names.
+var accountNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// validateAccounts validates the [[users]] and [[groups]] entries.
+func validateAccounts(users []UserConfig, groups []GroupConfig) error {
+	groupNames := make(map[string]bool)
+	gids := make(map[int]bool)
+	for i, g := range groups {
+		if !accountNameRe.MatchString(g.Name) {
+			return fmt.Errorf("groups[%d]: invalid name '%s'", i, g.Name)
+		}
+		if g.GID == nil || *g.GID < 0 {
+			return fmt.Errorf("groups[%d] (%s): a non-negative 'gid' is required", i, g.Name)
+		}
+		if groupNames[g.Name] || gids[*g.GID] {
+			return fmt.Errorf("groups[%d] (%s): duplicate group name or gid", i, g.Name)
+		}
+		groupNames[g.Name] = true
+		gids[*g.GID] = true
+		for _, m := range g.Members {
+			if !accountNameRe.MatchString(m) {
+				return fmt.Errorf("groups[%d] (%s): invalid member '%s'", i, g.Name, m)
+			}
+		}
+	}
+
+	userNames := make(map[string]bool)
+	uids := make(map[int]bool)
+	for i, u := range users {
+		if !accountNameRe.MatchString(u.Name) {
+			return fmt.Errorf("users[%d]: invalid name '%s'", i, u.Name)
+		}
+		if u.UID == nil || *u.UID < 0 {
+			return fmt.Errorf("users[%d] (%s): a non-negative 'uid' is required", i, u.Name)
+		}
+		if userNames[u.Name] || uids[*u.UID] {
+			return fmt.Errorf("users[%d] (%s): duplicate user name or uid", i, u.Name)
+		}
+		userNames[u.Name] = true
+		uids[*u.UID] = true
+		if u.GID != nil && u.Group != "" {
+			return fmt.Errorf("users[%d] (%s): only one of 'gid' or 'group' may be set", i, u.Name)
+		}
+		if u.GID != nil && *u.GID < 0 {
+			return fmt.Errorf("users[%d] (%s): 'gid' must be non-negative", i, u.Name)
+		}
+		if u.Group != "" && !accountNameRe.MatchString(u.Group) {
+			return fmt.Errorf("users[%d] (%s): invalid group '%s'", i, u.Name, u.Group)
+		}
+		for _, g := range u.Groups {
+			if !accountNameRe.MatchString(g) {
+				return fmt.Errorf("users[%d] (%s): invalid group '%s'", i, u.Name, g)
+			}
+		}
+		if !strings.HasPrefix(u.HomeDir(), "/") || !strings.HasPrefix(u.LoginShell(), "/") {
+			return fmt.Errorf("users[%d] (%s): 'home' and 'shell' must be absolute paths", i, u.Name)
+		}
+		if strings.ContainsAny(u.Comment+u.HomeDir()+u.LoginShell(), ":\n") {
+			return fmt.Errorf("users[%d] (%s): 'comment', 'home' and 'shell' must not contain ':' or newlines", i, u.Name)
+		}
+	}
+	return nil
+}
+
+// validateBusyboxApplets validates source.busybox_applets.
+func validateBusyboxApplets(applets []string) error {
+	seen := make(map[string]bool)
+	for _, applet := range applets {
+		switch {
+		case applet == BusyboxAppletsAll:
+			if len(applets) != 1 {
+				return fmt.Errorf("source.busybox_applets: '%s' cannot be combined with other applets", BusyboxAppletsAll)
+			}
+		case applet == "" || applet == "busybox" || strings.ContainsAny(applet, "/ "):
+			return fmt.Errorf("source.busybox_applets: invalid applet name '%s'", applet)
+		case seen[applet]:
+			return fmt.Errorf("source.busybox_applets: duplicate applet '%s'", applet)
+		}
+		seen[applet] = true
+	}
+	return nil
+}
+
+// validateStageMappings validates the [[stage_mappings]] entries.
+func validateStageMappings(mappings []StageMapping) error {
+	for i, m := range mappings {
+		if m.FromStage == "" {
+			return fmt.Errorf("stage_mappings[%d]: 'from_stage' is required", i)
+		}
+		for _, f := range []struct{ name, value string }{{"path", m.Path}, {"dest", m.Dest}} {
+			if f.value == "" {
+				return fmt.Errorf("stage_mappings[%d]: '%s' is required", i, f.name)
+			}
+			if !filepath.IsAbs(f.value) {
+				return fmt.Errorf("stage_mappings[%d]: %s '%s' must be an absolute path (start with /)", i, f.name, f.value)
+			}
+			if strings.Contains(f.value, "..") {
+				return fmt.Errorf("stage_mappings[%d]: %s '%s' contains '..' which is not allowed", i, f.name, f.value)
+			}
+		}
+	}
+	return nil
+}
+
+// validateAssets validates the [[assets]] entries.
+func validateAssets(assets []Asset) error {
+	for i, a := range assets {
+		switch {
+		case a.Source == "":
+			return fmt.Errorf("assets[%d]: 'source' is required", i)
+		case strings.HasPrefix(a.Source, AssetSchemeOCI):
+			if strings.TrimPrefix(a.Source, AssetSchemeOCI) == "" {
+				return fmt.Errorf("assets[%d]: source '%s' is missing an image reference", i, a.Source)
+			}
+			if a.Ref != "" {
+				return fmt.Errorf("assets[%d]: 'ref' is only valid for git sources, put the tag or digest in the image reference", i)
+			}
+		case IsGitAssetSource(a.Source):
+			if a.Ref == "" {
+				return fmt.Errorf("assets[%d]: 'ref' (tag, branch or commit) is required for git source '%s'", i, a.Source)
+			}
+			if strings.HasPrefix(a.Ref, "-") {
+				return fmt.Errorf("assets[%d]: ref '%s' must not start with '-'", i, a.Ref)
+			}
+		default:
+			return fmt.Errorf("assets[%d]: unsupported source '%s', must start with 'oci://', 'git://' or 'git+<scheme>://'", i, a.Source)
+		}
+
+		if a.Path != "" && strings.Contains(a.Path, "..") {
+			return fmt.Errorf("assets[%d]: path '%s' contains '..' which is not allowed", i, a.Path)
+		}
+		if a.Dest == "" {
+			return fmt.Errorf("assets[%d]: 'dest' is required", i)
+		}
+		if !filepath.IsAbs(a.Dest) {
+			return fmt.Errorf("assets[%d]: dest '%s' must be an absolute path (start with /)", i, a.Dest)
+		}
+		if strings.Contains(a.Dest, "..") {
+			return fmt.Errorf("assets[%d]: dest '%s' contains '..' which is not allowed", i, a.Dest)
+		}
+	}
+	return nil
+}
+
+// IsGitAssetSource reports whether an asset source names a git repository.
+func IsGitAssetSource(src string) bool {
+	if strings.HasPrefix(src, AssetSchemeGit) {
+		return true
+	}
+	rest, ok := strings.CutPrefix(src, "git+")
+	return ok && strings.Contains(rest, "://")
+}
+
+// LocalGitPath returns the repository path of a git source using git's
+// local transport, "git+file://<path>", and whether src is one. The path is
+// absolute or relative to the directory of fledge.toml.
+func LocalGitPath(src string) (string, bool) {
+	scheme, path, ok := strings.Cut(strings.TrimPrefix(src, "git+"), "://")
+	if !ok || !strings.HasPrefix(src, "git+") || !strings.EqualFold(scheme, "file") {
+		return "", false
+	}
+	return path, true
+}
+
 // validateOCIRootfs validates configuration for oci_rootfs strategy.
 func validateOCIRootfs(cfg *Config) error {
 	// Allow either an existing image reference OR a Dockerfile build input
-	if cfg.Source.Image == "" && cfg.Source.Dockerfile == "" {
-		return fmt.Errorf("either 'source.image' or 'source.dockerfile' is required for oci_rootfs strategy")
+	if cfg.Source.Image == "" && cfg.Source.Dockerfile == "" && cfg.Source.Artifact == "" && cfg.Binary == nil {
+		return fmt.Errorf("one of 'source.image', 'source.dockerfile' or 'source.artifact' is required for oci_rootfs strategy")
 	}
 	if cfg.Source.Image != "" && cfg.Source.Dockerfile != "" {
 		return fmt.Errorf("only one of 'source.image' or 'source.dockerfile' may be specified for oci_rootfs strategy")
@@ -246,14 +993,8 @@ func validateOCIRootfs(cfg *Config) error {
 		return fmt.Errorf("'filesystem' section is required for oci_rootfs strategy")
 	}
 
-	// Validate filesystem type
-	validFsTypes := map[string]bool{
-		"squashfs": true,
-		"ext4":     true, // legacy
-		"xfs":      true, // legacy
-		"btrfs":    true, // legacy
-	}
-	if !validFsTypes[cfg.Filesystem.Type] {
+	// Validate filesystem type; all but squashfs are legacy
+	if !slices.Contains(FilesystemTypes, cfg.Filesystem.Type) {
 		return fmt.Errorf("invalid filesystem type '%s', must be one of: squashfs (recommended), ext4, xfs, btrfs",
 			cfg.Filesystem.Type)
 	}
@@ -273,6 +1014,71 @@ func validateOCIRootfs(cfg *Config) error {
 			cfg.Filesystem.SizeBufferMB)
 	}
 
+	if err := validateReadOnlyRoot(cfg.Filesystem); err != nil {
+		return err
+	}
+
+	if err := validatePopulate(cfg.Filesystem); err != nil {
+		return err
+	}
+
+	if cfg.Agent != nil {
+		return validateAgentConfig(cfg.Agent)
+	}
+
+	return nil
+}
+
+// DefaultPopulate returns how an image of filesystem type fsType is
+// populated by default: by mkfs where it can copy a directory in, by
+// mounting otherwise.
+func DefaultPopulate(fsType string) string {
+	if fsType == "xfs" {
+		return PopulateMount
+	}
+	return PopulateMkfs
+}
+
+// validatePopulate validates filesystem.populate.
+func validatePopulate(fs *FilesystemConfig) error {
+	switch fs.Populate {
+	case "":
+		return nil
+	case PopulateMount:
+	case PopulateMkfs:
+		if fs.Type == "xfs" {
+			return fmt.Errorf("filesystem.populate = \"mkfs\" is not supported for xfs, whose mkfs cannot copy a directory in; use \"mount\"")
+		}
+	default:
+		return fmt.Errorf("invalid filesystem.populate '%s', must be mkfs or mount", fs.Populate)
+	}
+	if fs.Type == "squashfs" {
+		return fmt.Errorf("filesystem.populate applies to ext4, xfs and btrfs; squashfs images are always made from the directory")
+	}
+	return nil
+}
+
+// validateReadOnlyRoot validates filesystem.read_only and filesystem.tmpfs.
+func validateReadOnlyRoot(fs *FilesystemConfig) error {
+	if !fs.ReadOnly {
+		if len(fs.Tmpfs) > 0 {
+			return fmt.Errorf("filesystem.tmpfs requires filesystem.read_only")
+		}
+		return nil
+	}
+	if fs.Type == "squashfs" {
+		return fmt.Errorf("filesystem.read_only applies to ext4, xfs and btrfs; squashfs roots are always read-only with an overlay")
+	}
+	seen := make(map[string]bool)
+	for _, p := range fs.Tmpfs {
+		if !strings.HasPrefix(p, "/") || p == "/" || filepath.Clean(p) != p || strings.ContainsAny(p, ", \t\n") {
+			return fmt.Errorf("filesystem.tmpfs: invalid path '%s'", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("filesystem.tmpfs: duplicate path '%s'", p)
+		}
+		seen[p] = true
+	}
 	return nil
 }
 
@@ -369,8 +1175,12 @@ func validateAgentConfig(agent *AgentConfig) error {
 			return fmt.Errorf("'agent.url' is required when using 'http' source strategy")
 		}
 		// Checksum is optional but recommended
+	case AgentSourceOCI:
+		if agent.Image == "" {
+			return fmt.Errorf("'agent.image' is required when using 'oci' source strategy")
+		}
 	default:
-		return fmt.Errorf("invalid agent.source_strategy '%s', must be one of: release, local, http",
+		return fmt.Errorf("invalid agent.source_strategy '%s', must be one of: release, local, http, oci",
 			agent.SourceStrategy)
 	}
 
@@ -384,6 +1194,9 @@ func validateMappings(mappings map[string]string) error {
 		if src == "" {
 			return fmt.Errorf("mapping source path cannot be empty")
 		}
+		if _, _, err := ParseRemoteSource(src); err != nil {
+			return err
+		}
 
 		// Destination path validation
 		if dst == "" {
@@ -402,3 +1215,29 @@ func validateMappings(mappings map[string]string) error {
 
 	return nil
 }
+
+// RemoteSource is a mapping source downloaded over HTTP(S).
+type RemoteSource struct {
+	URL string
+	// Checksum is the expected "sha256:<hex>" digest of the download.
+	Checksum string
+}
+
+// ParseRemoteSource parses a mapping source of the form
+// "https://host/file sha256:<hex>". It reports false for local paths. Remote
+// sources must carry a sha256 checksum so downloads can be verified and cached.
+func ParseRemoteSource(src string) (RemoteSource, bool, error) {
+	fields := strings.Fields(src)
+	if len(fields) == 0 || !(strings.HasPrefix(fields[0], "http://") || strings.HasPrefix(fields[0], "https://")) {
+		return RemoteSource{}, false, nil
+	}
+	if len(fields) != 2 {
+		return RemoteSource{}, true, fmt.Errorf("remote mapping source '%s' must be '<url> sha256:<checksum>'", src)
+	}
+
+	hexSum, ok := strings.CutPrefix(strings.ToLower(fields[1]), "sha256:")
+	if !ok || len(hexSum) != 64 || strings.Trim(hexSum, "0123456789abcdef") != "" {
+		return RemoteSource{}, true, fmt.Errorf("remote mapping source '%s' has an invalid checksum, expected sha256:<64 hex digits>", src)
+	}
+	return RemoteSource{URL: fields[0], Checksum: "sha256:" + hexSum}, true, nil
+}
@@ -3,8 +3,12 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
 )
 
 // TestLoadValidInitramfs tests loading a valid initramfs configuration.
@@ -364,6 +368,1063 @@ busybox_url = "https://test.com/busybox"
 	}
 }
 
+// TestLoadFrontendImage tests loading a Dockerfile build with a frontend override.
+func TestLoadFrontendImage(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[source]
+dockerfile = "./Dockerfile"
+frontend_image = "docker/dockerfile:1.7-labs"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Source.FrontendImage != "docker/dockerfile:1.7-labs" {
+		t.Errorf("expected frontend_image 'docker/dockerfile:1.7-labs', got '%s'", cfg.Source.FrontendImage)
+	}
+}
+
+// TestValidationFrontendImageRequiresDockerfile tests frontend_image without a Dockerfile.
+func TestValidationFrontendImageRequiresDockerfile(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[source]
+image = "nginx:alpine"
+frontend_image = "docker/dockerfile:1.7-labs"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	_, err := Load(tmpFile)
+	if err == nil {
+		t.Fatal("expected error for frontend_image without dockerfile, got nil")
+	}
+	if !strings.Contains(err.Error(), "frontend_image") {
+		t.Errorf("error should mention 'frontend_image', got: %v", err)
+	}
+}
+
+// TestLoadStageMappings tests loading mappings from named Dockerfile stages.
+func TestLoadStageMappings(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[source]
+dockerfile = "./Dockerfile"
+
+[[stage_mappings]]
+from_stage = "builder"
+path = "/out/app"
+dest = "/usr/bin/app"
+
+[[stage_mappings]]
+from_stage = "assets"
+path = "/srv/static"
+dest = "/var/www"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.StageMappings) != 2 {
+		t.Fatalf("expected 2 stage mappings, got %d", len(cfg.StageMappings))
+	}
+	want := StageMapping{FromStage: "builder", Path: "/out/app", Dest: "/usr/bin/app"}
+	if cfg.StageMappings[0] != want {
+		t.Errorf("expected %+v, got %+v", want, cfg.StageMappings[0])
+	}
+}
+
+// TestValidationStageMappingsRequireDockerfile tests stage mappings without a Dockerfile.
+func TestValidationStageMappingsRequireDockerfile(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[source]
+image = "nginx:alpine"
+
+[[stage_mappings]]
+from_stage = "builder"
+path = "/out/app"
+dest = "/usr/bin/app"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	_, err := Load(tmpFile)
+	if err == nil {
+		t.Fatal("expected error for stage_mappings without dockerfile, got nil")
+	}
+	if !strings.Contains(err.Error(), "stage_mappings") {
+		t.Errorf("error should mention 'stage_mappings', got: %v", err)
+	}
+}
+
+// TestValidationStageMappingsRelativePath tests stage mappings with a relative stage path.
+func TestValidationStageMappingsRelativePath(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[source]
+dockerfile = "./Dockerfile"
+
+[[stage_mappings]]
+from_stage = "builder"
+path = "out/app"
+dest = "/usr/bin/app"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	_, err := Load(tmpFile)
+	if err == nil {
+		t.Fatal("expected error for relative stage path, got nil")
+	}
+	if !strings.Contains(err.Error(), "absolute") {
+		t.Errorf("error should mention 'absolute', got: %v", err)
+	}
+}
+
+// TestLoadSourceLayers tests loading additional layer images.
+func TestLoadSourceLayers(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[source]
+image = "debian:bookworm-slim"
+layer_conflicts = "error"
+
+[[source.layers]]
+image = "busybox:musl"
+
+[[source.layers]]
+image = "ghcr.io/example/sidecar:1.0"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Source.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(cfg.Source.Layers))
+	}
+	if cfg.Source.Layers[1].Image != "ghcr.io/example/sidecar:1.0" {
+		t.Errorf("expected second layer 'ghcr.io/example/sidecar:1.0', got '%s'", cfg.Source.Layers[1].Image)
+	}
+	if cfg.Source.LayerConflicts != LayerConflictsError {
+		t.Errorf("expected layer_conflicts 'error', got '%s'", cfg.Source.LayerConflicts)
+	}
+}
+
+// TestValidationSourceLayersInvalidConflicts tests an unknown layer_conflicts policy.
+func TestValidationSourceLayersInvalidConflicts(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[source]
+image = "debian:bookworm-slim"
+layer_conflicts = "ignore"
+
+[[source.layers]]
+image = "busybox:musl"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	_, err := Load(tmpFile)
+	if err == nil {
+		t.Fatal("expected error for invalid layer_conflicts, got nil")
+	}
+	if !strings.Contains(err.Error(), "layer_conflicts") {
+		t.Errorf("error should mention 'layer_conflicts', got: %v", err)
+	}
+}
+
+// TestLoadAgentOCI tests loading an agent sourced from an OCI registry.
+func TestLoadAgentOCI(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[agent]
+source_strategy = "oci"
+image = "ghcr.io/volantvm/kestrel:v1.2.3"
+
+[source]
+image = "nginx:alpine"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Agent.SourceStrategy != AgentSourceOCI {
+		t.Errorf("expected source_strategy 'oci', got '%s'", cfg.Agent.SourceStrategy)
+	}
+	if cfg.Agent.Image != "ghcr.io/volantvm/kestrel:v1.2.3" {
+		t.Errorf("expected agent image 'ghcr.io/volantvm/kestrel:v1.2.3', got '%s'", cfg.Agent.Image)
+	}
+}
+
+// TestValidationAgentOCIMissingImage tests the oci strategy without an image.
+func TestValidationAgentOCIMissingImage(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[agent]
+source_strategy = "oci"
+
+[source]
+image = "nginx:alpine"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	_, err := Load(tmpFile)
+	if err == nil {
+		t.Fatal("expected error for oci agent without image, got nil")
+	}
+	if !strings.Contains(err.Error(), "agent.image") {
+		t.Errorf("error should mention 'agent.image', got: %v", err)
+	}
+}
+
+// TestLoadRemoteMappings tests URL mapping sources with checksums.
+func TestLoadRemoteMappings(t *testing.T) {
+	content := `
+version = "1"
+strategy = "initramfs"
+
+[mappings]
+"https://example.com/model.bin sha256:9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08" = "/opt/models/model.bin"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	for src := range cfg.Mappings {
+		remote, ok, err := ParseRemoteSource(src)
+		if err != nil || !ok {
+			t.Fatalf("expected remote source, got ok=%v err=%v", ok, err)
+		}
+		if remote.URL != "https://example.com/model.bin" {
+			t.Errorf("expected URL 'https://example.com/model.bin', got '%s'", remote.URL)
+		}
+		if remote.Checksum != "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" {
+			t.Errorf("expected normalized checksum, got '%s'", remote.Checksum)
+		}
+	}
+}
+
+// TestValidationRemoteMappingRequiresChecksum tests URL mapping sources without a checksum.
+func TestValidationRemoteMappingRequiresChecksum(t *testing.T) {
+	content := `
+version = "1"
+strategy = "initramfs"
+
+[mappings]
+"https://example.com/model.bin" = "/opt/models/model.bin"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	_, err := Load(tmpFile)
+	if err == nil {
+		t.Fatal("expected error for remote mapping without checksum, got nil")
+	}
+	if !strings.Contains(err.Error(), "sha256") {
+		t.Errorf("error should mention 'sha256', got: %v", err)
+	}
+}
+
+// TestLoadAssets tests parsing [[assets]] entries.
+func TestLoadAssets(t *testing.T) {
+	content := `
+version = "1"
+strategy = "initramfs"
+
+[[assets]]
+source = "oci://ghcr.io/example/models:v1"
+path = "/models/model.bin"
+dest = "/opt/models/model.bin"
+
+[[assets]]
+source = "git+https://github.com/example/plugin.git"
+ref = "v1.2.0"
+path = "payload"
+dest = "/opt/plugin"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Assets) != 2 {
+		t.Fatalf("expected 2 assets, got %d", len(cfg.Assets))
+	}
+	if cfg.Assets[1].Ref != "v1.2.0" || cfg.Assets[1].Dest != "/opt/plugin" {
+		t.Errorf("unexpected git asset: %+v", cfg.Assets[1])
+	}
+	if !IsGitAssetSource(cfg.Assets[1].Source) || IsGitAssetSource(cfg.Assets[0].Source) {
+		t.Errorf("IsGitAssetSource misclassified assets")
+	}
+}
+
+// TestValidationAssets tests rejection of invalid [[assets]] entries.
+func TestValidationAssets(t *testing.T) {
+	tests := []struct {
+		name  string
+		asset string
+		want  string
+	}{
+		{"unsupported scheme", `source = "s3://bucket/file"` + "\n" + `dest = "/opt/file"`, "unsupported source"},
+		{"git without ref", `source = "git://example.com/repo.git"` + "\n" + `dest = "/opt/repo"`, "'ref'"},
+		{"git option as ref", `source = "git://example.com/repo.git"` + "\n" + `ref = "--upload-pack=touch /tmp/pwned"` + "\n" + `dest = "/opt/repo"`, "must not start with '-'"},
+		{"oci with ref", `source = "oci://example.com/image:v1"` + "\n" + `ref = "main"` + "\n" + `dest = "/opt/x"`, "only valid for git"},
+		{"relative dest", `source = "oci://example.com/image:v1"` + "\n" + `dest = "opt/x"`, "absolute path"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "version = \"1\"\nstrategy = \"initramfs\"\n\n[[assets]]\n" + tt.asset + "\n"
+			tmpFile := writeTempConfig(t, content)
+			defer os.Remove(tmpFile)
+
+			_, err := Load(tmpFile)
+			if err == nil {
+				t.Fatal("expected validation error, got nil")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error should mention %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestLoadWithOverrides tests --set style overrides of config values.
+func TestLoadWithOverrides(t *testing.T) {
+	content := `
+version = "1"
+strategy = "oci_rootfs"
+
+[agent]
+source_strategy = "release"
+version = "latest"
+
+[source]
+image = "nginx:alpine"
+
+[filesystem]
+type = "squashfs"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := LoadWithOverrides(tmpFile, []string{
+		"filesystem.type=ext4",
+		"filesystem.size_buffer_mb=200",
+		"agent.version=v0.9.0",
+		`mappings."./app"=/usr/bin/app`,
+	})
+	if err != nil {
+		t.Fatalf("LoadWithOverrides failed: %v", err)
+	}
+	if cfg.Filesystem.Type != "ext4" {
+		t.Errorf("expected filesystem.type 'ext4', got '%s'", cfg.Filesystem.Type)
+	}
+	if cfg.Filesystem.SizeBufferMB != 200 {
+		t.Errorf("expected filesystem.size_buffer_mb 200, got %d", cfg.Filesystem.SizeBufferMB)
+	}
+	if cfg.Agent.Version != "v0.9.0" {
+		t.Errorf("expected agent.version 'v0.9.0', got '%s'", cfg.Agent.Version)
+	}
+	if cfg.Mappings["./app"] != "/usr/bin/app" {
+		t.Errorf("expected mapping for ./app, got %v", cfg.Mappings)
+	}
+}
+
+// TestLoadWithOverrides_Errors tests rejection of malformed and unknown overrides.
+func TestLoadWithOverrides_Errors(t *testing.T) {
+	content := `
+version = "1"
+strategy = "initramfs"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	tests := []struct {
+		override string
+		want     string
+	}{
+		{"filesystem.type", "key=value"},
+		{"filesystem..type=ext4", "empty key segment"},
+		{"version.major=1", "not a table"},
+		{"source.imgae=nginx:alpine", "unknown config key"},
+		{"strategy=oci", "invalid strategy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.override, func(t *testing.T) {
+			_, err := LoadWithOverrides(tmpFile, []string{tt.override})
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error should mention %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestLoadBuildTempDir tests parsing [build] temp_dir and overriding it with --set.
+func TestLoadBuildTempDir(t *testing.T) {
+	content := `
+version = "1"
+strategy = "initramfs"
+
+[build]
+temp_dir = "scratch"
+`
+
+	tmpFile := writeTempConfig(t, content)
+	defer os.Remove(tmpFile)
+
+	cfg, err := Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Build == nil || cfg.Build.TempDir != "scratch" {
+		t.Fatalf("expected temp_dir scratch, got %+v", cfg.Build)
+	}
+
+	cfg, err = LoadWithOverrides(tmpFile, []string{"build.temp_dir=/mnt/scratch"})
+	if err != nil {
+		t.Fatalf("LoadWithOverrides failed: %v", err)
+	}
+	if cfg.Build.TempDir != "/mnt/scratch" {
+		t.Errorf("expected overridden temp_dir, got %q", cfg.Build.TempDir)
+	}
+}
+
+// TestLoadBuildTimeout tests parsing and validating [build] timeout.
+func TestLoadBuildTimeout(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[build]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"timeout = \"45m\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := cfg.BuildTimeout(); got != 45*time.Minute {
+		t.Errorf("expected 45m timeout, got %s", got)
+	}
+
+	for _, bad := range []string{"forever", "0s", "-5m"} {
+		if _, err := Load(writeTempConfig(t, base+"timeout = \""+bad+"\"\n")); err == nil {
+			t.Errorf("expected timeout %q to be rejected", bad)
+		}
+	}
+
+	if got := (&Config{}).BuildTimeout(); got != 0 {
+		t.Errorf("expected no timeout by default, got %s", got)
+	}
+}
+
+// TestLoadBuildRetries tests parsing and validating [build.retries].
+func TestLoadBuildRetries(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[build.retries]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"attempts = 5\ndelay = \"1s\"\nmax_delay = \"20s\"\nvm_attempts = 3\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	r := cfg.Build.Retries
+	if r.Attempts != 5 || r.Delay != "1s" || r.MaxDelay != "20s" || r.VMAttempts != 3 {
+		t.Errorf("unexpected retries: %+v", r)
+	}
+
+	for _, bad := range []string{"attempts = -1", "vm_attempts = -2", "delay = \"soon\"", "max_delay = \"0s\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadBuildNetwork tests parsing and validating [build.network].
+func TestLoadBuildNetwork(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[build.network]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"mode = \"dhcp\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Build.Network.Mode != "dhcp" {
+		t.Errorf("unexpected network config: %+v", cfg.Build.Network)
+	}
+
+	pool := "provider = \"pool\"\nbridge = \"br0\"\npool = \"10.0.3.10-10.0.3.50\"\ngateway = \"10.0.3.1\"\n"
+	cfg, err = Load(writeTempConfig(t, base+pool))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if n := cfg.Build.Network; n.Provider != "pool" || n.Pool != "10.0.3.10-10.0.3.50" || n.Bridge != "br0" {
+		t.Errorf("unexpected network config: %+v", n)
+	}
+
+	for _, bad := range []string{
+		"mode = \"bridge\"",
+		"provider = \"cni\"",
+		"mode = \"user\"\nprovider = \"none\"",
+		"provider = \"pool\"\npool = \"10.0.3.10-10.0.3.50\"\ngateway = \"10.0.3.1\"",
+		"provider = \"pool\"\nbridge = \"br0\"\npool = \"10.0.3.50-10.0.3.10\"\ngateway = \"10.0.3.1\"",
+		"provider = \"pool\"\nbridge = \"br0\"\npool = \"10.0.3.10-10.0.3.50\"",
+	} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadBuildProxy tests parsing and validating [build.proxy].
+func TestLoadBuildProxy(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[build.proxy]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"http = \"http://proxy:3128\"\nno_proxy = \"localhost,.internal\"\ninherit = false\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	p := cfg.Build.Proxy
+	if p.HTTP != "http://proxy:3128" || p.NoProxy != "localhost,.internal" || p.Inherit == nil || *p.Inherit {
+		t.Errorf("unexpected proxy config: %+v", p)
+	}
+
+	for _, bad := range []string{"http = \"proxy:3128\"", "https = \"ftp://proxy\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadBuildPackageCache tests parsing and validating [build.package_cache].
+func TestLoadBuildPackageCache(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[build.package_cache]\nenabled = true\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"max_size_mb = 2048\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if c := cfg.Build.PackageCache; !c.Enabled || c.MaxSizeMB != 2048 {
+		t.Errorf("unexpected package cache config: %+v", c)
+	}
+
+	if _, err := Load(writeTempConfig(t, base+"max_size_mb = -1\n")); err == nil {
+		t.Error("expected a negative max_size_mb to be rejected")
+	}
+}
+
+// TestLoadSourceImageExport tests that source.export_image needs a Dockerfile.
+func TestLoadSourceImageExport(t *testing.T) {
+	cfg, err := Load(writeTempConfig(t, "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\ndockerfile = \"Dockerfile\"\nexport_image = \"dist/app.tar\"\npush_image = \"registry.example.com/app:1\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Source.ExportImage != "dist/app.tar" || cfg.Source.PushImage != "registry.example.com/app:1" {
+		t.Errorf("unexpected source: %+v", cfg.Source)
+	}
+
+	if _, err := Load(writeTempConfig(t, "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nimage = \"alpine:3.20\"\nexport_image = \"app.tar\"\n")); err == nil {
+		t.Error("expected export_image without a Dockerfile to be rejected")
+	}
+}
+
+// TestLoadSourceArtifact tests source.artifact as the base of both
+// strategies, and that it cannot be combined with another base.
+func TestLoadSourceArtifact(t *testing.T) {
+	for _, strategy := range []string{StrategyOCIRootfs, StrategyInitramfs} {
+		cfg, err := Load(writeTempConfig(t, "version = \"1\"\nstrategy = \""+strategy+"\"\n\n[source]\nartifact = \"base.squashfs\"\n"))
+		if err != nil {
+			t.Fatalf("Load %s failed: %v", strategy, err)
+		}
+		if cfg.Source.Artifact != "base.squashfs" {
+			t.Errorf("unexpected source: %+v", cfg.Source)
+		}
+	}
+
+	for _, bad := range []string{"image = \"alpine:3.20\"", "dockerfile = \"Dockerfile\""} {
+		if _, err := Load(writeTempConfig(t, "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nartifact = \"base.img\"\n"+bad+"\n")); err == nil {
+			t.Errorf("expected artifact with %s to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadLimits tests parsing and validating [limits].
+func TestLoadLimits(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[limits]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"max_initramfs_mb = 64\non_exceed = \"warn\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if l := cfg.Limits; l == nil || l.MaxInitramfsMB != 64 || l.OnExceed != LimitsWarn {
+		t.Errorf("unexpected limits config: %+v", l)
+	}
+
+	for _, bad := range []string{"max_initramfs_mb = -1", "max_rootfs_mb = -1", "on_exceed = \"ignore\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadPostprocess tests parsing and validating [postprocess].
+func TestLoadPostprocess(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[postprocess]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"command = [\"./scan.sh\", \"--strict\"]\ntimeout = \"10m\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if p := cfg.Postprocess; p == nil || len(p.Command) != 2 || p.Command[0] != "./scan.sh" || p.Timeout != "10m" {
+		t.Errorf("unexpected postprocess config: %+v", p)
+	}
+
+	for _, bad := range []string{"command = []", "command = [\"\"]", "command = [\"scan\"]\ntimeout = \"soon\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadStrictWarnings tests [build] strict_warnings and its default.
+func TestLoadStrictWarnings(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n"
+
+	cfg, err := Load(writeTempConfig(t, base))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := cfg.StrictWarnings(); len(got) != len(logging.WarningClasses)-1 || slices.Contains(got, logging.WarnOther) {
+		t.Errorf("Expected every class but other by default, got %v", got)
+	}
+
+	cfg, err = Load(writeTempConfig(t, base+"\n[build]\nstrict_warnings = [\"kernel-modules\", \"other\"]\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := cfg.StrictWarnings(); !slices.Equal(got, []string{logging.WarnKernelModules, logging.WarnOther}) {
+		t.Errorf("unexpected strict warnings: %v", got)
+	}
+
+	if _, err := Load(writeTempConfig(t, base+"\n[build]\nstrict_warnings = [\"modules\"]\n")); err == nil {
+		t.Error("expected an unknown warning class to be rejected")
+	}
+}
+
+// TestLoadReadOnlyRoot tests filesystem.read_only defaults and validation.
+func TestLoadReadOnlyRoot(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nimage = \"nginx:alpine\"\n\n[filesystem]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"type = \"ext4\"\nread_only = true\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if strings.Join(cfg.Filesystem.Tmpfs, ",") != "/tmp,/run,/var" || cfg.Filesystem.OverlaySize != "1G" {
+		t.Errorf("unexpected read-only defaults: %+v", cfg.Filesystem)
+	}
+
+	for _, bad := range []string{
+		"type = \"squashfs\"\nread_only = true",
+		"type = \"ext4\"\ntmpfs = [\"/var\"]",
+		"type = \"ext4\"\nread_only = true\ntmpfs = [\"var\"]",
+		"type = \"ext4\"\nread_only = true\ntmpfs = [\"/var\", \"/var\"]",
+		"type = \"ext4\"\nread_only = true\ntmpfs = [\"/srv,/data\"]",
+	} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadPopulate tests filesystem.populate defaults and validation.
+func TestLoadPopulate(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nimage = \"nginx:alpine\"\n\n[filesystem]\n"
+
+	for fsType, want := range map[string]string{"ext4": PopulateMkfs, "btrfs": PopulateMkfs, "xfs": PopulateMount, "squashfs": ""} {
+		cfg, err := Load(writeTempConfig(t, base+"type = \""+fsType+"\"\n"))
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if cfg.Filesystem.Populate != want {
+			t.Errorf("expected %s to be populated by %q, got %q", fsType, want, cfg.Filesystem.Populate)
+		}
+	}
+
+	for _, bad := range []string{
+		"type = \"xfs\"\npopulate = \"mkfs\"",
+		"type = \"squashfs\"\npopulate = \"mount\"",
+		"type = \"ext4\"\npopulate = \"guestfs\"",
+	} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadBinary tests expanding the binary strategy into the artifact
+// strategy it builds.
+func TestLoadBinary(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"binary\"\n\n[binary]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"executables = [\"/usr/local/bin/app\", \"bin/helper\"]\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Strategy != StrategyInitramfs || cfg.Agent == nil {
+		t.Errorf("expected initramfs defaults, got strategy %q agent %+v", cfg.Strategy, cfg.Agent)
+	}
+	if cfg.Mappings["/usr/local/bin/app"] != "/usr/local/bin/app" || cfg.Mappings["bin/helper"] != "/usr/local/bin/helper" {
+		t.Errorf("unexpected mappings: %v", cfg.Mappings)
+	}
+	if !cfg.Binary.WantsCertificates() {
+		t.Error("expected certificates by default")
+	}
+
+	cfg, err = Load(writeTempConfig(t, base+"executables = [\"/app\"]\noutput = \"oci_rootfs\"\ncertificates = false\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Strategy != StrategyOCIRootfs || cfg.Filesystem == nil || cfg.Binary.WantsCertificates() {
+		t.Errorf("unexpected oci_rootfs binary config: %+v", cfg)
+	}
+
+	for _, bad := range []string{
+		"",
+		"executables = [\"/app\"]\noutput = \"disk\"",
+		"executables = [\"/a/app\", \"/a/app\"]",
+		"executables = [\"https://example.com/app\"]",
+		"executables = [\"/app\"]\n[source]\nimage = \"alpine\"",
+	} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	if _, err := Load(writeTempConfig(t, "version = \"1\"\nstrategy = \"initramfs\"\n\n[binary]\nexecutables = [\"/app\"]\n")); err == nil {
+		t.Error("expected [binary] to require the binary strategy")
+	}
+}
+
+// TestLoadBusyboxApplets tests validating source.busybox_applets.
+func TestLoadBusyboxApplets(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[source]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"busybox_applets = [\"ip\", \"udhcpc\"]\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Source.BusyboxApplets) != 2 {
+		t.Errorf("unexpected applets: %v", cfg.Source.BusyboxApplets)
+	}
+	if _, err := Load(writeTempConfig(t, base+"busybox_applets = [\"all\"]\n")); err != nil {
+		t.Errorf("expected \"all\" to be accepted, got %v", err)
+	}
+
+	for _, bad := range []string{"[\"all\", \"ls\"]", "[\"ls\", \"ls\"]", "[\"bin/ls\"]", "[\"busybox\"]", "[\"\"]"} {
+		if _, err := Load(writeTempConfig(t, base+"busybox_applets = "+bad+"\n")); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadUserland tests selecting and validating source.userland.
+func TestLoadUserland(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[source]\n"
+	sum := strings.Repeat("ab", 32)
+
+	cfg, err := Load(writeTempConfig(t, base))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Source.Userland != UserlandBusybox || cfg.Source.BusyboxURL != DefaultBusyboxURL {
+		t.Errorf("expected default busybox userland, got %+v", cfg.Source)
+	}
+
+	cfg, err = Load(writeTempConfig(t, base+"userland = \"toybox\"\nuserland_url = \"https://example.com/toybox\"\nuserland_sha256 = \"sha256:"+sum+"\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Source.BusyboxURL != "" {
+		t.Errorf("expected no busybox default with toybox, got %q", cfg.Source.BusyboxURL)
+	}
+
+	for _, bad := range []string{
+		"userland = \"coreutils\"",
+		"userland = \"dash\"",
+		"userland = \"dash\"\nuserland_url = \"https://example.com/dash\"",
+		"userland = \"dash\"\nuserland_url = \"https://example.com/dash\"\nuserland_sha256 = \"" + sum + "\"\nbusybox_applets = [\"ls\"]",
+		"userland = \"toybox\"\nuserland_url = \"https://example.com/toybox\"\nuserland_sha256 = \"" + sum + "\"\nbusybox_url = \"https://example.com/busybox\"",
+		"userland_url = \"https://example.com/busybox\"",
+	} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadAccounts tests parsing and validating [[users]] and [[groups]].
+func TestLoadAccounts(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"[[groups]]\nname = \"svc\"\ngid = 900\n\n[[users]]\nname = \"app\"\nuid = 900\ngroup = \"svc\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Users) != 1 || cfg.Users[0].HomeDir() != "/home/app" || cfg.Users[0].LoginShell() != "/bin/sh" || *cfg.Groups[0].GID != 900 {
+		t.Errorf("unexpected accounts: %+v %+v", cfg.Users, cfg.Groups)
+	}
+
+	for _, bad := range []string{
+		"[[users]]\nname = \"app\"",
+		"[[users]]\nname = \"App!\"\nuid = 1",
+		"[[users]]\nname = \"app\"\nuid = 1\ngid = 1\ngroup = \"svc\"",
+		"[[users]]\nname = \"app\"\nuid = 1\nhome = \"relative\"",
+		"[[users]]\nname = \"app\"\nuid = 1\n\n[[users]]\nname = \"app2\"\nuid = 1",
+		"[[groups]]\nname = \"svc\"",
+		"[[groups]]\nname = \"svc\"\ngid = 1\nmembers = [\"a:b\"]",
+	} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadSystem tests parsing and validating [system].
+func TestLoadSystem(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[system]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"modules_load = [\"br_netfilter\"]\n\n[system.sysctls]\n\"net.ipv4.ip_forward\" = \"1\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if s := cfg.System; s == nil || s.Sysctls["net.ipv4.ip_forward"] != "1" || len(s.ModulesLoad) != 1 {
+		t.Errorf("unexpected system config: %+v", s)
+	}
+
+	for _, bad := range []string{"modules_load = [\"../evil\"]", "sysctls = { \"net ipv4\" = \"1\" }", "sysctls = { \"vm.swappiness\" = \"\" }"} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadKernel tests validating [kernel].
+func TestLoadKernel(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[kernel]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"version = \"6.1.0-volant\"\nmodules_image = \"ghcr.io/volantvm/kernel-modules:6.1\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Kernel == nil || cfg.Kernel.Version != "6.1.0-volant" {
+		t.Errorf("unexpected kernel config: %+v", cfg.Kernel)
+	}
+
+	for _, bad := range []string{"", "version = \"../6.1\"", "modules_dir = \"kmods\"\nmodules_image = \"kmods:1\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadGPU tests validating [gpu].
+func TestLoadGPU(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[gpu]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"driver_run_file = \"NVIDIA-Linux-x86_64-550.54.14.run\"\nbuild_modules = true\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.GPU == nil || !cfg.GPU.BuildModules || cfg.GPU.LibraryDir() != DefaultGPULibDir {
+		t.Errorf("unexpected gpu config: %+v", cfg.GPU)
+	}
+
+	for _, bad := range []string{
+		"",
+		"driver_run_file = \"driver.run\"\ndriver_image = \"nvcr.io/nvidia/driver:550\"",
+		"driver_run_file = \"https://example.com/driver.run\"",
+		"driver_image = \"nvcr.io/nvidia/driver:550\"\nbuild_modules = true",
+		"driver_image = \"nvcr.io/nvidia/driver:550\"\nlib_dir = \"usr/lib\"",
+	} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadSystemd tests validating [systemd].
+func TestLoadSystemd(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nimage = \"debian:12\"\n\n[systemd]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"unit = \"app\"\nrestart = \"always\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Systemd.UnitName() != "app.service" || cfg.Systemd.Target() != "multi-user.target" || !cfg.Systemd.IsEnabled() {
+		t.Errorf("unexpected systemd config: %+v", cfg.Systemd)
+	}
+
+	for _, bad := range []string{"unit = \"my app\"", "restart = \"sometimes\"", "wanted_by = \"multi-user\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	if _, err := Load(writeTempConfig(t, "version = \"1\"\nstrategy = \"initramfs\"\n\n[systemd]\n")); err == nil {
+		t.Error("expected [systemd] to be rejected for initramfs")
+	}
+}
+
+// TestLoadSELinux tests validating [selinux].
+func TestLoadSELinux(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nimage = \"registry.access.redhat.com/ubi9/ubi\"\n\n[selinux]\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"preserve_labels = true\nrelabel = true\nfile_contexts = \"policy/file_contexts\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.SELinux == nil || !cfg.SELinux.PreserveLabels || !cfg.SELinux.Relabel {
+		t.Errorf("unexpected selinux config: %+v", cfg.SELinux)
+	}
+
+	for _, bad := range []string{"", "preserve_labels = true\nfile_contexts = \"file_contexts\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	if _, err := Load(writeTempConfig(t, "version = \"1\"\nstrategy = \"initramfs\"\n\n[selinux]\nrelabel = true\n")); err == nil {
+		t.Error("expected [selinux] to be rejected for initramfs")
+	}
+}
+
+// TestLoadManifestCloudInit tests the [cloud_init] seed defaults and
+// validation of manifest.toml.
+func TestLoadManifestCloudInit(t *testing.T) {
+	base := "schema_version = \"v1\"\nname = \"web\"\nversion = \"1.0.0\"\nruntime = \"web\"\n\n[cloud_init]\n"
+
+	path := writeTempConfig(t, base+"[cloud_init.user_data]\ncontent = \"user-data.yaml\"\n")
+	tpl, err := LoadManifestTemplate(path)
+	if err != nil {
+		t.Fatalf("LoadManifestTemplate failed: %v", err)
+	}
+	if tpl.CloudInit.Seed != CloudInitSeedISO || tpl.Dir != filepath.Dir(path) {
+		t.Errorf("unexpected cloud_init defaults: seed %q, dir %q", tpl.CloudInit.Seed, tpl.Dir)
+	}
+
+	tpl, err = LoadManifestTemplate(writeTempConfig(t, base+"datasource = \"ec2\"\n"))
+	if err != nil || tpl.CloudInit.WantsSeed() {
+		t.Errorf("expected no seed for the ec2 datasource, got %+v, %v", tpl, err)
+	}
+
+	for _, bad := range []string{"seed = \"qcow2\"", "datasource = \"ec2\"\nseed = \"vfat\"", "[cloud_init.user_data]\ninline = false"} {
+		if _, err := LoadManifestTemplate(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestLoadLogging tests parsing and validating [logging].
+func TestLoadLogging(t *testing.T) {
+	base := "version = \"1\"\nstrategy = \"initramfs\"\n\n[logging]\nfile = \"build.log\"\n"
+
+	cfg, err := Load(writeTempConfig(t, base+"format = \"json\"\nmax_size = \"50M\"\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Logging == nil || cfg.Logging.File != "build.log" || cfg.Logging.Format != "json" {
+		t.Errorf("unexpected logging config: %+v", cfg.Logging)
+	}
+
+	for _, bad := range []string{"format = \"xml\"", "max_size = \"lots\"", "max_size = \"0\""} {
+		if _, err := Load(writeTempConfig(t, base+bad+"\n")); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestParseByteSize tests size suffixes.
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{"4096": 4096, "512K": 512 << 10, "50M": 50 << 20, "50MiB": 50 << 20, "1g": 1 << 30} {
+		got, err := ParseByteSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+}
+
+// TestOverrideKeys tests the keys and values offered for --set completion.
+func TestOverrideKeys(t *testing.T) {
+	keys := OverrideKeys()
+	for _, want := range []string{"strategy", "filesystem.type", "agent.version", "build.timeout"} {
+		if !slices.Contains(keys, want) {
+			t.Errorf("OverrideKeys() lacks %q", want)
+		}
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "mappings") {
+			t.Errorf("OverrideKeys() contains %q", key)
+		}
+	}
+
+	for key, want := range map[string][]string{
+		"filesystem.type":      FilesystemTypes,
+		"strategy":             Strategies,
+		"filesystem.read_only": {"true", "false"},
+		"agent.version":        nil,
+		"filesystem.unknown":   nil,
+	} {
+		if got := OverrideValues(key); !slices.Equal(got, want) {
+			t.Errorf("OverrideValues(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
 // writeTempConfig writes a temporary config file for testing.
 func writeTempConfig(t *testing.T, content string) string {
 	t.Helper()
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// HostPath is a file or directory on the build host that a config names.
+type HostPath struct {
+	// Field is the config field naming the path, such as "init.path".
+	Field string
+	// Path is the path as written: absolute, or relative to the directory
+	// of fledge.toml.
+	Path string
+	// Write is set for paths the build writes rather than reads.
+	Write bool
+}
+
+// HostPaths returns the host paths a build of c reads and writes. Remote
+// sources, such as https:// mappings, are not host paths. Every path field
+// of the config must be listed here: builds for untrusted clients are
+// confined by checking these paths.
+func (c *Config) HostPaths() []HostPath {
+	var paths []HostPath
+	c.eachHostPath(func(p HostPath) (string, error) {
+		paths = append(paths, p)
+		return p.Path, nil
+	})
+	return paths
+}
+
+// ResolveHostPaths replaces each host path of c with what resolve returns
+// for it joined to workDir, such as its canonical form, so that the build
+// reads exactly the paths that were checked. Relative binary executables
+// stay relative to workDir, since that decides their place in the artifact.
+func (c *Config) ResolveHostPaths(workDir string, resolve func(p HostPath, path string) (string, error)) error {
+	return c.eachHostPath(func(p HostPath) (string, error) {
+		path := p.Path
+		if !filepath.IsAbs(path) {
+			// Joined without cleaning, which would resolve "link/.."
+			// differently from the kernel
+			path = workDir + string(filepath.Separator) + path
+		}
+		resolved, err := resolve(p, path)
+		if err != nil {
+			return "", err
+		}
+		if p.Field == "binary.executables" && !filepath.IsAbs(p.Path) {
+			return filepath.Rel(workDir, resolved)
+		}
+		return resolved, nil
+	})
+}
+
+// eachHostPath calls fn for each host path of c, in a stable order, and
+// sets the path to its result.
+func (c *Config) eachHostPath(fn func(p HostPath) (string, error)) error {
+	visit := func(field string, path *string, write bool) error {
+		if *path == "" {
+			return nil
+		}
+		v, err := fn(HostPath{Field: field, Path: *path, Write: write})
+		if err != nil {
+			return err
+		}
+		*path = v
+		return nil
+	}
+	local := func(src string) bool {
+		_, remote, err := ParseRemoteSource(src)
+		return err == nil && !remote
+	}
+
+	if err := visit("source.dockerfile", &c.Source.Dockerfile, false); err != nil {
+		return err
+	}
+	if err := visit("source.context", &c.Source.Context, false); err != nil {
+		return err
+	}
+	if err := visit("source.artifact", &c.Source.Artifact, false); err != nil {
+		return err
+	}
+	if err := visit("source.export_image", &c.Source.ExportImage, true); err != nil {
+		return err
+	}
+	if c.Agent != nil && c.Agent.SourceStrategy == AgentSourceLocal {
+		if err := visit("agent.path", &c.Agent.Path, false); err != nil {
+			return err
+		}
+	}
+	if c.Init != nil {
+		if err := visit("init.path", &c.Init.Path, false); err != nil {
+			return err
+		}
+	}
+	if err := c.eachMappingSource(fn, local); err != nil {
+		return err
+	}
+	for i := range c.Assets {
+		// Local repositories are read from the host by git itself
+		path, ok := LocalGitPath(c.Assets[i].Source)
+		if !ok {
+			continue
+		}
+		resolved := path
+		if err := visit("assets.source", &resolved, false); err != nil {
+			return err
+		}
+		if resolved != path {
+			c.Assets[i].Source = "git+file://" + resolved
+		}
+	}
+	if c.Binary != nil {
+		for i := range c.Binary.Executables {
+			if err := visit("binary.executables", &c.Binary.Executables[i], false); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Kernel != nil {
+		if err := visit("kernel.modules_dir", &c.Kernel.ModulesDir, false); err != nil {
+			return err
+		}
+	}
+	if c.GPU != nil && local(c.GPU.DriverRunFile) {
+		if err := visit("gpu.driver_run_file", &c.GPU.DriverRunFile, false); err != nil {
+			return err
+		}
+	}
+	if c.SELinux != nil {
+		if err := visit("selinux.file_contexts", &c.SELinux.FileContexts, false); err != nil {
+			return err
+		}
+	}
+	if c.Logging != nil {
+		if err := visit("logging.file", &c.Logging.File, true); err != nil {
+			return err
+		}
+	}
+	if c.Build != nil {
+		if err := visit("build.temp_dir", &c.Build.TempDir, true); err != nil {
+			return err
+		}
+		if c.Build.PackageCache != nil {
+			if err := visit("build.package_cache.dir", &c.Build.PackageCache.Dir, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eachMappingSource calls fn for the local mapping sources of c in sorted
+// order and re-keys the mappings by its results when one differs.
+func (c *Config) eachMappingSource(fn func(p HostPath) (string, error), local func(string) bool) error {
+	sources := make([]string, 0, len(c.Mappings))
+	mappings := make(map[string]string, len(c.Mappings))
+	for src, dest := range c.Mappings {
+		if local(src) {
+			sources = append(sources, src)
+		} else {
+			mappings[src] = dest
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	sort.Strings(sources)
+
+	changed := false
+	for _, src := range sources {
+		v, err := fn(HostPath{Field: "mapping source", Path: src})
+		if err != nil {
+			return err
+		}
+		if _, ok := mappings[v]; ok {
+			return fmt.Errorf("mapping source %s names the same file as another", src)
+		}
+		mappings[v] = c.Mappings[src]
+		changed = changed || v != src
+	}
+	if changed {
+		c.Mappings = mappings
+	}
+	return nil
+}
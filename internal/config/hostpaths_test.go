@@ -0,0 +1,145 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// nonHostPathFields are the string fields of Config that do not name a file
+// of the build host. A new field must be added here or to HostPaths.
+var nonHostPathFields = map[string]bool{
+	"Version": true, "Strategy": true,
+	"Agent.SourceStrategy": true, "Agent.Version": true, "Agent.URL": true, "Agent.Checksum": true, "Agent.Image": true,
+	"Source.Image": true, "Source.Target": true, "Source.BuildArgs": true, "Source.FrontendImage": true,
+	"Source.PushImage": true, "Source.Layers.Image": true, "Source.LayerConflicts": true,
+	"Source.BusyboxURL": true, "Source.BusyboxSHA256": true, "Source.BusyboxApplets": true,
+	"Source.Userland": true, "Source.UserlandURL": true, "Source.UserlandSHA256": true,
+	"Filesystem.Type": true, "Filesystem.OverlaySize": true, "Filesystem.Tmpfs": true, "Filesystem.Populate": true,
+	// Paths inside build stages and repositories, and in the artifact;
+	// git+file:// asset sources are listed
+	"StageMappings.FromStage": true, "StageMappings.Path": true, "StageMappings.Dest": true,
+	"Assets.Source": true, "Assets.Ref": true, "Assets.Path": true, "Assets.Dest": true,
+	"Build.Timeout": true, "Build.Retries.Delay": true, "Build.Retries.MaxDelay": true,
+	"Build.Network.Mode": true, "Build.Network.Provider": true, "Build.Network.Pool": true,
+	"Build.Network.Gateway": true, "Build.Network.Netmask": true, "Build.Network.Bridge": true,
+	"Build.Proxy.HTTP": true, "Build.Proxy.HTTPS": true, "Build.Proxy.NoProxy": true,
+	"Build.StrictWarnings": true,
+	"Logging.Format":       true, "Logging.MaxSize": true,
+	"Limits.OnExceed": true,
+	"Binary.Output":   true,
+	"Users.Name":      true, "Users.Group": true, "Users.Groups": true, "Users.Comment": true,
+	"Users.Home": true, "Users.Shell": true,
+	"Groups.Name": true, "Groups.Members": true,
+	"System.Sysctls": true, "System.ModulesLoad": true,
+	"Kernel.Version": true, "Kernel.ModulesImage": true,
+	"GPU.DriverImage": true, "GPU.LibDir": true,
+	"Systemd.Unit": true, "Systemd.Restart": true, "Systemd.WantedBy": true,
+	// A program run on the host, which builds for clients refuse
+	"Postprocess.Command": true, "Postprocess.Timeout": true,
+}
+
+// fillStrings sets every string of v, the elements of string slices and the
+// keys of string maps to "/host/<field>", allocating the structs it reaches,
+// and returns the fields it set.
+func fillStrings(v reflect.Value, field string) []string {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("/host/" + field)
+		return []string{field}
+	case reflect.Pointer:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return fillStrings(v.Elem(), field)
+	case reflect.Slice:
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fields := fillStrings(elem, field)
+		v.Set(reflect.Append(reflect.MakeSlice(v.Type(), 0, 1), elem))
+		return fields
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		m := reflect.MakeMap(v.Type())
+		m.SetMapIndex(reflect.ValueOf("/host/"+field), reflect.New(v.Type().Elem()).Elem())
+		v.Set(m)
+		return []string{field}
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if field != "" {
+				name = field + "." + f.Name
+			}
+			fields = append(fields, fillStrings(v.Field(i), name)...)
+		}
+		return fields
+	}
+	return nil
+}
+
+// TestHostPaths_CoversEveryPathField tests that every string field of
+// Config is either listed by HostPaths or known not to be a host path, so a
+// new path field cannot slip past the checks of builds for clients.
+func TestHostPaths_CoversEveryPathField(t *testing.T) {
+	var cfg Config
+	fields := fillStrings(reflect.ValueOf(&cfg).Elem(), "")
+	cfg.Agent.SourceStrategy = AgentSourceLocal
+
+	listed := map[string]bool{}
+	for _, p := range cfg.HostPaths() {
+		listed[p.Path] = true
+	}
+	known := map[string]bool{}
+	for _, field := range fields {
+		known[field] = true
+		if !nonHostPathFields[field] && !listed["/host/"+field] {
+			t.Errorf("%s is neither listed by HostPaths nor in nonHostPathFields", field)
+		}
+	}
+	for field := range nonHostPathFields {
+		if !known[field] {
+			t.Errorf("nonHostPathFields lists %s, which is not a field of Config", field)
+		}
+	}
+}
+
+// TestResolveHostPaths tests rewriting host paths, mapping sources and
+// relative executables included.
+func TestResolveHostPaths(t *testing.T) {
+	cfg := &Config{
+		Mappings: map[string]string{"app": "/app", "https://example.com/x": "/x"},
+		Binary:   &BinaryConfig{Executables: []string{"bin/tool", "/usr/bin/env"}},
+		Source:   SourceConfig{ExportImage: "out/image.tar"},
+		Assets:   []Asset{{Source: "git+file://repo"}, {Source: "git+https://example.com/repo.git"}},
+	}
+	workDir := filepath.FromSlash("/work")
+	var writes []string
+	err := cfg.ResolveHostPaths(workDir, func(p HostPath, path string) (string, error) {
+		if p.Write {
+			writes = append(writes, p.Field)
+		}
+		return filepath.Join("/resolved", path), nil
+	})
+	if err != nil {
+		t.Fatalf("ResolveHostPaths failed: %v", err)
+	}
+	if cfg.Mappings[filepath.Join("/resolved", workDir, "app")] != "/app" || cfg.Mappings["https://example.com/x"] != "/x" || len(cfg.Mappings) != 2 {
+		t.Errorf("Unexpected mappings %v", cfg.Mappings)
+	}
+	if got := cfg.Binary.Executables; got[0] != filepath.Join("..", "resolved", "work", "bin", "tool") || got[1] != filepath.Join("/resolved", "/usr/bin/env") {
+		t.Errorf("Unexpected executables %v", got)
+	}
+	if got := cfg.Assets; got[0].Source != "git+file://"+filepath.Join("/resolved", workDir, "repo") || got[1].Source != "git+https://example.com/repo.git" {
+		t.Errorf("Unexpected asset sources %v", got)
+	}
+	if len(writes) != 1 || writes[0] != "source.export_image" {
+		t.Errorf("Expected export_image as the only write, got %v", writes)
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyOverrides applies "key=value" overrides to the TOML document data and
+// returns the re-encoded document. Keys are dotted paths into the document
+// (e.g. "filesystem.type"); a segment may be double-quoted to contain dots,
+// as in `mappings."./app"`. Values are parsed as TOML (numbers, booleans,
+// quoted strings, arrays) and fall back to a plain string.
+func applyOverrides(data []byte, overrides []string) ([]byte, []string, error) {
+	doc := make(map[string]interface{})
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse TOML: %w", err)
+	}
+
+	keys := make([]string, 0, len(overrides))
+	for _, override := range overrides {
+		key, raw, ok := strings.Cut(override, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid override %q: must be in key=value form", override)
+		}
+		path, err := splitKey(strings.TrimSpace(key))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid override %q: %w", override, err)
+		}
+		if err := setPath(doc, path, parseOverrideValue(raw)); err != nil {
+			return nil, nil, fmt.Errorf("invalid override %q: %w", override, err)
+		}
+		keys = append(keys, toml.Key(path).String())
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode overridden config: %w", err)
+	}
+	return buf.Bytes(), keys, nil
+}
+
+// splitKey splits a dotted key into its segments, honouring double quotes.
+func splitKey(key string) ([]string, error) {
+	var (
+		segments []string
+		current  strings.Builder
+		quoted   bool
+		wasQuote bool
+	)
+	for _, r := range key {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			wasQuote = true
+		case r == '.' && !quoted:
+			if current.Len() == 0 && !wasQuote {
+				return nil, fmt.Errorf("empty key segment")
+			}
+			segments = append(segments, current.String())
+			current.Reset()
+			wasQuote = false
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in key")
+	}
+	if current.Len() == 0 && !wasQuote {
+		return nil, fmt.Errorf("empty key segment")
+	}
+	return append(segments, current.String()), nil
+}
+
+// setPath sets doc[path...] to value, creating intermediate tables.
+func setPath(doc map[string]interface{}, path []string, value interface{}) error {
+	table := doc
+	for i, segment := range path[:len(path)-1] {
+		next, exists := table[segment]
+		if !exists {
+			child := make(map[string]interface{})
+			table[segment] = child
+			table = child
+			continue
+		}
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("'%s' is not a table", strings.Join(path[:i+1], "."))
+		}
+		table = child
+	}
+	table[path[len(path)-1]] = value
+	return nil
+}
+
+// parseOverrideValue interprets raw as a TOML value, or as a string if it is
+// not valid TOML (so "--set agent.version=v0.9.0" needs no quoting).
+func parseOverrideValue(raw string) interface{} {
+	var v struct {
+		V interface{} `toml:"v"`
+	}
+	if _, err := toml.Decode("v = "+raw, &v); err == nil && v.V != nil {
+		return v.V
+	}
+	return raw
+}
@@ -1,6 +1,11 @@
 // Package config provides configuration parsing and validation for fledge.toml.
 package config
 
+import (
+	"path"
+	"strings"
+)
+
 // Config represents the complete fledge.toml configuration.
 type Config struct {
 	Version    string            `toml:"version"`
@@ -10,6 +15,371 @@ type Config struct {
 	Source     SourceConfig      `toml:"source"`
 	Filesystem *FilesystemConfig `toml:"filesystem,omitempty"`
 	Mappings   map[string]string `toml:"mappings,omitempty"`
+
+	// StageMappings copy individual paths out of named Dockerfile stages.
+	StageMappings []StageMapping `toml:"stage_mappings,omitempty"`
+
+	// Assets copy paths out of OCI artifacts and git repositories.
+	Assets []Asset `toml:"assets,omitempty"`
+
+	// Build holds settings for the build host rather than the artifact.
+	Build *BuildConfig `toml:"build,omitempty"`
+
+	// Logging writes the build log to a file as well as the console.
+	Logging *LoggingConfig `toml:"logging,omitempty"`
+
+	// Limits sets size budgets for the artifact.
+	Limits *LimitsConfig `toml:"limits,omitempty"`
+
+	// Binary lists the host executables of the "binary" strategy.
+	Binary *BinaryConfig `toml:"binary,omitempty"`
+
+	// Users and Groups add accounts to the artifact's /etc/passwd,
+	// /etc/group and /etc/shadow.
+	Users  []UserConfig  `toml:"users,omitempty"`
+	Groups []GroupConfig `toml:"groups,omitempty"`
+
+	// System bakes runtime kernel settings into the artifact.
+	System *SystemConfig `toml:"system,omitempty"`
+
+	// Kernel selects the guest kernel whose modules are installed.
+	Kernel *KernelConfig `toml:"kernel,omitempty"`
+
+	// GPU installs a GPU driver's userspace libraries and kernel modules.
+	GPU *GPUConfig `toml:"gpu,omitempty"`
+
+	// Systemd runs the image's ENTRYPOINT/CMD as a systemd service.
+	Systemd *SystemdConfig `toml:"systemd,omitempty"`
+
+	// SELinux keeps or applies SELinux file labels.
+	SELinux *SELinuxConfig `toml:"selinux,omitempty"`
+
+	// Postprocess runs a command on the finished artifact.
+	Postprocess *PostprocessConfig `toml:"postprocess,omitempty"`
+}
+
+// PostprocessConfig runs an external command on the finished artifact once
+// its manifest.json is written, such as a virus scan or a watermark, before
+// its checksum files are.
+type PostprocessConfig struct {
+	// Command is the program and its arguments, run in the directory of
+	// fledge.toml. It finds the artifact and manifest in FLEDGE_ARTIFACT
+	// and FLEDGE_MANIFEST, and may write a JSON result to FLEDGE_RESULT.
+	Command []string `toml:"command"`
+	// Timeout bounds the command, e.g. "10m"; the build timeout applies
+	// otherwise.
+	Timeout string `toml:"timeout,omitempty"`
+}
+
+// SELinuxConfig carries SELinux file labels (security.selinux extended
+// attributes) into oci_rootfs artifacts, so images of SELinux-enforcing
+// distros boot with correct labels.
+type SELinuxConfig struct {
+	// PreserveLabels restores the labels recorded in the source image's
+	// layers. The build host must allow setting them.
+	PreserveLabels bool `toml:"preserve_labels,omitempty"`
+	// Relabel runs setfiles over the finished rootfs, labelling files
+	// fledge added as well.
+	Relabel bool `toml:"relabel,omitempty"`
+	// FileContexts is the policy's file_contexts used to relabel, relative
+	// to fledge.toml. By default the image's own policy is used:
+	// /etc/selinux/<SELINUXTYPE>/contexts/files/file_contexts.
+	FileContexts string `toml:"file_contexts,omitempty"`
+}
+
+// SystemdConfig translates the workload (the image's ENTRYPOINT/CMD,
+// overridden by manifest.toml [workload]) into a systemd service unit, for
+// oci_rootfs images that boot systemd instead of relying on the kestrel
+// agent to exec it.
+type SystemdConfig struct {
+	// Unit is the service name (default "workload").
+	Unit string `toml:"unit,omitempty"`
+	// Restart is the unit's Restart= policy (default "on-failure").
+	Restart string `toml:"restart,omitempty"`
+	// WantedBy is the target the unit is enabled in (default
+	// "multi-user.target").
+	WantedBy string `toml:"wanted_by,omitempty"`
+	// Enabled links the unit into WantedBy (default true).
+	Enabled *bool `toml:"enabled,omitempty"`
+}
+
+// UnitName returns the service unit file name, e.g. "workload.service".
+func (s *SystemdConfig) UnitName() string {
+	name := s.Unit
+	if name == "" {
+		name = "workload"
+	}
+	if !strings.HasSuffix(name, ".service") {
+		name += ".service"
+	}
+	return name
+}
+
+// RestartPolicy returns the unit's Restart= value.
+func (s *SystemdConfig) RestartPolicy() string {
+	if s.Restart != "" {
+		return s.Restart
+	}
+	return "on-failure"
+}
+
+// Target returns the target the unit is enabled in.
+func (s *SystemdConfig) Target() string {
+	if s.WantedBy != "" {
+		return s.WantedBy
+	}
+	return "multi-user.target"
+}
+
+// IsEnabled reports whether the unit is enabled at boot.
+func (s *SystemdConfig) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// GPUConfig installs an NVIDIA driver payload for PCI passthrough: the
+// userspace libraries, tools, firmware and kernel modules.
+type GPUConfig struct {
+	// DriverRunFile is an NVIDIA-Linux-*.run installer, relative to
+	// fledge.toml or "https://host/file sha256:<hex>".
+	DriverRunFile string `toml:"driver_run_file,omitempty"`
+	// DriverImage is a driver container image holding the libraries under
+	// /usr/lib and prebuilt modules under /lib/modules.
+	DriverImage string `toml:"driver_image,omitempty"`
+	// LibDir is where the libraries are installed (default
+	// /usr/lib/x86_64-linux-gnu).
+	LibDir string `toml:"lib_dir,omitempty"`
+	// BuildModules compiles the run file's kernel modules against the guest
+	// kernel's build tree (<modules dir>/build).
+	BuildModules bool `toml:"build_modules,omitempty"`
+}
+
+// DefaultGPULibDir is the default GPUConfig.LibDir.
+const DefaultGPULibDir = "/usr/lib/x86_64-linux-gnu"
+
+// LibraryDir returns the directory the driver libraries are installed in.
+func (g *GPUConfig) LibraryDir() string {
+	if g.LibDir != "" {
+		return g.LibDir
+	}
+	return DefaultGPULibDir
+}
+
+// KernelConfig points module installation at the guest kernel instead of the
+// build host's. Without it modules come from /lib/modules/$(uname -r).
+type KernelConfig struct {
+	// Version is the guest kernel release, as `uname -r` prints it in the
+	// guest. It may be omitted when the modules source holds one release.
+	Version string `toml:"version,omitempty"`
+	// ModulesDir is a module directory relative to fledge.toml: either a
+	// lib/modules/<version> directory itself or a tree containing one.
+	ModulesDir string `toml:"modules_dir,omitempty"`
+	// ModulesImage is an OCI image or artifact containing
+	// lib/modules/<version>, such as a kernel modules or headers image.
+	ModulesImage string `toml:"modules_image,omitempty"`
+}
+
+// SystemConfig generates /etc/sysctl.d and /etc/modules-load.d entries,
+// applied at boot by the guest's init system.
+type SystemConfig struct {
+	Sysctls map[string]string `toml:"sysctls,omitempty"`
+	// ModulesLoad lists kernel modules loaded at boot. They are copied, with
+	// their dependencies, from the build host's /lib/modules.
+	ModulesLoad []string `toml:"modules_load,omitempty"`
+}
+
+// UserConfig declares a [[users]] account. Its password is locked.
+type UserConfig struct {
+	Name string `toml:"name"`
+	UID  *int   `toml:"uid"`
+	// GID selects the primary group by id and Group by name. Without
+	// either, a group named after the user with gid = uid is used, and
+	// created if no group has that gid.
+	GID   *int   `toml:"gid,omitempty"`
+	Group string `toml:"group,omitempty"`
+	// Groups are supplementary groups the user is added to.
+	Groups  []string `toml:"groups,omitempty"`
+	Comment string   `toml:"comment,omitempty"`
+	// Home defaults to /home/<name> and is created owned by the user.
+	Home string `toml:"home,omitempty"`
+	// Shell defaults to /bin/sh.
+	Shell string `toml:"shell,omitempty"`
+}
+
+// GroupConfig declares a [[groups]] group.
+type GroupConfig struct {
+	Name    string   `toml:"name"`
+	GID     *int     `toml:"gid"`
+	Members []string `toml:"members,omitempty"`
+}
+
+// HomeDir returns the user's home directory.
+func (u UserConfig) HomeDir() string {
+	if u.Home != "" {
+		return u.Home
+	}
+	return "/home/" + u.Name
+}
+
+// LoginShell returns the user's shell.
+func (u UserConfig) LoginShell() string {
+	if u.Shell != "" {
+		return u.Shell
+	}
+	return "/bin/sh"
+}
+
+// BinaryConfig configures the "binary" strategy: a minimal artifact holding
+// host executables, their shared libraries and the host's CA certificates,
+// built without a base image.
+type BinaryConfig struct {
+	// Executables are host paths. Absolute paths keep their location in the
+	// artifact; relative ones (to fledge.toml's directory) go to
+	// /usr/local/bin. The first executable is the workload entrypoint.
+	Executables []string `toml:"executables"`
+	// Output is the artifact built: "initramfs" (default) or "oci_rootfs".
+	Output string `toml:"output,omitempty"`
+	// Certificates copies the host's CA bundle (default true).
+	Certificates *bool `toml:"certificates,omitempty"`
+}
+
+// BinaryDest returns where executable exe is placed in the artifact.
+func BinaryDest(exe string) string {
+	if path.IsAbs(exe) {
+		return path.Clean(exe)
+	}
+	return path.Join("/usr/local/bin", path.Base(exe))
+}
+
+// WantsCertificates reports whether the host's CA bundle is copied.
+func (b *BinaryConfig) WantsCertificates() bool {
+	return b.Certificates == nil || *b.Certificates
+}
+
+// LimitsConfig sets size budgets checked once the artifact is built. An
+// oversized initramfs inflates the memory every VM booting it needs.
+type LimitsConfig struct {
+	// MaxInitramfsMB bounds the compressed initramfs archive.
+	MaxInitramfsMB int `toml:"max_initramfs_mb,omitempty"`
+	// MaxRootfsMB bounds the rootfs filesystem image.
+	MaxRootfsMB int `toml:"max_rootfs_mb,omitempty"`
+	// OnExceed is "error" (default), failing the build, or "warn".
+	OnExceed string `toml:"on_exceed,omitempty"`
+}
+
+// LoggingConfig configures the persistent build log.
+type LoggingConfig struct {
+	// File receives every log record, debug included, relative to
+	// fledge.toml. --log-file takes precedence.
+	File string `toml:"file,omitempty"`
+	// Format is "text" (default) or "json".
+	Format string `toml:"format,omitempty"`
+	// MaxSize rotates the file once it grows beyond this size, e.g. "50M";
+	// defaults to 100M. Three rotated files are kept.
+	MaxSize string `toml:"max_size,omitempty"`
+}
+
+// BuildConfig configures how the artifact is built on the host.
+type BuildConfig struct {
+	// TempDir is the scratch directory for temporary build files (image
+	// layers, unpacked rootfs, filesystem images), relative to fledge.toml.
+	// Defaults to TMPDIR, usually /tmp.
+	TempDir string `toml:"temp_dir,omitempty"`
+	// Timeout bounds the whole build as a Go duration, e.g. "45m".
+	Timeout string `toml:"timeout,omitempty"`
+	// Retries controls how flaky network and VM operations are retried.
+	Retries *RetryConfig `toml:"retries,omitempty"`
+	// Network configures the microVMs that run Dockerfile steps.
+	Network *BuildNetworkConfig `toml:"network,omitempty"`
+	// Proxy sets the HTTP(S) proxy used by Dockerfile steps.
+	Proxy *ProxyConfig `toml:"proxy,omitempty"`
+	// PackageCache caches package downloads of Dockerfile steps.
+	PackageCache *PackageCacheConfig `toml:"package_cache,omitempty"`
+	// StrictWarnings are the warning classes that fail a build run with
+	// --strict; they default to every class but "other".
+	StrictWarnings []string `toml:"strict_warnings,omitempty"`
+}
+
+// PackageCacheConfig enables a caching proxy, run by the build worker, that
+// step VMs fetch plain-HTTP package downloads (.deb, .apk, .rpm, wheels,
+// source tarballs) through, so repeated builds do not download them again.
+// HTTPS downloads bypass it.
+type PackageCacheConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Dir holds cached packages; it defaults to the "packages" directory
+	// of fledge's cache.
+	Dir string `toml:"dir,omitempty"`
+	// MaxSizeMB evicts the least recently used packages beyond this size;
+	// zero keeps everything.
+	MaxSizeMB int `toml:"max_size_mb,omitempty"`
+}
+
+// ProxyConfig sets the proxy exported to Dockerfile RUN steps and passed as
+// the predefined HTTP_PROXY, HTTPS_PROXY and NO_PROXY build args. Values
+// set here override those inherited from fledge's own environment.
+type ProxyConfig struct {
+	HTTP    string `toml:"http,omitempty"`
+	HTTPS   string `toml:"https,omitempty"`
+	NoProxy string `toml:"no_proxy,omitempty"`
+	// Inherit copies the proxy variables of fledge's environment; it
+	// defaults to true.
+	Inherit *bool `toml:"inherit,omitempty"`
+}
+
+// BuildNetworkConfig configures networking of the microVMs that run Dockerfile
+// steps.
+type BuildNetworkConfig struct {
+	// Mode is "static" (default), leasing an address from volant's pool and
+	// passing it on the kernel command line, "dhcp", leaving addressing to
+	// a DHCP server on the worker bridge, or "user", using passt's user-mode
+	// networking without a bridge or tap devices.
+	Mode string `toml:"mode,omitempty"`
+	// Provider allocates addresses and tap devices: "volant" (default)
+	// uses volant's database and bridge, "pool" the settings below, and
+	// "none" gives step VMs no network at all.
+	Provider string `toml:"provider,omitempty"`
+	// Pool is the "first-last" IPv4 range the pool provider leases from.
+	Pool string `toml:"pool,omitempty"`
+	// Gateway and Netmask are handed to guests of the pool provider;
+	// Netmask defaults to 255.255.255.0.
+	Gateway string `toml:"gateway,omitempty"`
+	Netmask string `toml:"netmask,omitempty"`
+	// Bridge is the existing host bridge the pool provider attaches taps to.
+	Bridge string `toml:"bridge,omitempty"`
+}
+
+// RetryConfig tunes retries for network-bound steps (image pulls, busybox and
+// agent downloads) and microVM launches. Zero values keep fledge's defaults.
+type RetryConfig struct {
+	// Attempts is the total number of tries for network steps; 1 disables
+	// retries.
+	Attempts int `toml:"attempts,omitempty"`
+	// Delay is the first backoff as a Go duration; it doubles per attempt
+	// and is jittered.
+	Delay string `toml:"delay,omitempty"`
+	// MaxDelay caps a single backoff.
+	MaxDelay string `toml:"max_delay,omitempty"`
+	// VMAttempts is the total number of tries for launching a step microVM.
+	VMAttempts int `toml:"vm_attempts,omitempty"`
+}
+
+// Asset copies Path from a remote OCI image/artifact or git repository to Dest
+// in the artifact. Source is "oci://<image ref>" or a git URL ("git://",
+// "git+https://", "git+ssh://" or "git+file://"); git sources are checked out
+// at Ref. An empty Path copies the whole image or repository.
+type Asset struct {
+	Source string `toml:"source"`
+	Ref    string `toml:"ref,omitempty"`
+	Path   string `toml:"path,omitempty"`
+	Dest   string `toml:"dest"`
+}
+
+// StageMapping copies Path from the Dockerfile stage FromStage to Dest in the
+// artifact. Only the referenced paths are exported from the stage, so an
+// initramfs can embed a compiled binary without the rest of the builder rootfs.
+type StageMapping struct {
+	FromStage string `toml:"from_stage"`
+	Path      string `toml:"path"`
+	Dest      string `toml:"dest"`
 }
 
 // InitConfig defines init/PID1 behavior for initramfs.
@@ -35,6 +405,9 @@ type AgentConfig struct {
 	// For "http" strategy
 	URL      string `toml:"url,omitempty"`
 	Checksum string `toml:"checksum,omitempty"`
+
+	// For "oci" strategy: an image or artifact reference containing the binary
+	Image string `toml:"image,omitempty"`
 }
 
 // SourceConfig defines the source for the build strategy.
@@ -50,10 +423,48 @@ type SourceConfig struct {
 	Context    string            `toml:"context,omitempty"`
 	Target     string            `toml:"target,omitempty"`
 	BuildArgs  map[string]string `toml:"build_args,omitempty"`
+	// FrontendImage optionally selects an alternative Dockerfile frontend
+	// image (e.g. "docker/dockerfile:1.7-labs") resolved through the gateway.
+	FrontendImage string `toml:"frontend_image,omitempty"`
+	// ExportImage also writes the Dockerfile build's image to this OCI
+	// image tarball (relative to fledge.toml's directory).
+	ExportImage string `toml:"export_image,omitempty"`
+	// PushImage also pushes the Dockerfile build's image to this registry
+	// reference with skopeo.
+	PushImage string `toml:"push_image,omitempty"`
+
+	// Artifact is a previously built fledge artifact (a rootfs image or an
+	// initramfs, relative to fledge.toml's directory) used as the base
+	// rootfs in place of an image, for derivative builds that only change
+	// mappings or the agent.
+	Artifact string `toml:"artifact,omitempty"`
+
+	// Layers lists additional images overlaid, in order, on top of the
+	// primary image or Dockerfile output (e.g. a sidecar tool image).
+	Layers []SourceLayer `toml:"layers,omitempty"`
+	// LayerConflicts controls how files replaced or deleted by a later layer
+	// image are handled: "warn" (default) logs them, "error" fails the build.
+	LayerConflicts string `toml:"layer_conflicts,omitempty"`
 
 	// For "initramfs" strategy
 	BusyboxURL    string `toml:"busybox_url,omitempty"`
 	BusyboxSHA256 string `toml:"busybox_sha256,omitempty"`
+	// BusyboxApplets selects the applets linked into /bin. Empty keeps the
+	// default set; ["all"] links every applet the binary lists. It applies to
+	// toybox as well.
+	BusyboxApplets []string `toml:"busybox_applets,omitempty"`
+
+	// Userland is the initramfs userland: "busybox" (default), "toybox", or
+	// "dash" for a shell only. toybox and dash are downloaded from
+	// UserlandURL and verified against UserlandSHA256.
+	Userland       string `toml:"userland,omitempty"`
+	UserlandURL    string `toml:"userland_url,omitempty"`
+	UserlandSHA256 string `toml:"userland_sha256,omitempty"`
+}
+
+// SourceLayer is an additional image merged into the rootfs.
+type SourceLayer struct {
+	Image string `toml:"image"`
 }
 
 // FilesystemConfig defines filesystem options for oci_rootfs strategy.
@@ -65,8 +476,20 @@ type FilesystemConfig struct {
 	Preallocate       bool   `toml:"preallocate"`           // Only used for ext4/xfs/btrfs (legacy)
 	CompressionLevel  int    `toml:"compression_level"`    // Squashfs compression level (1-22, default 15)
 	OverlaySize       string `toml:"overlay_size"`          // Overlay tmpfs size (e.g., "512M", "1G", "50%"), default "1G"
+	// ReadOnly mounts an ext4/xfs/btrfs root read-only, with tmpfs-backed
+	// overlays on the Tmpfs paths (default /tmp, /run and /var) sharing
+	// OverlaySize.
+	ReadOnly          bool     `toml:"read_only"`
+	Tmpfs             []string `toml:"tmpfs"`
+	// Populate is how an ext4/xfs/btrfs image gets the rootfs: "mkfs"
+	// (default for ext4 and btrfs) has mkfs copy it in from the directory,
+	// "mount" (default for xfs) loop-mounts the image and copies it in.
+	Populate string `toml:"populate,omitempty"`
 }
 
+// DefaultTmpfsPaths are the writable paths of a read-only root.
+var DefaultTmpfsPaths = []string{"/tmp", "/run", "/var"}
+
 // DefaultFilesystemConfig returns the default filesystem configuration.
 func DefaultFilesystemConfig() *FilesystemConfig {
 	return &FilesystemConfig{
@@ -91,10 +514,31 @@ func DefaultAgentConfig() *AgentConfig {
 const (
 	StrategyOCIRootfs = "oci_rootfs"
 	StrategyInitramfs = "initramfs"
+	StrategyBinary    = "binary"
+
+	// BusyboxAppletsAll links every applet busybox provides.
+	BusyboxAppletsAll = "all"
+
+	UserlandBusybox = "busybox"
+	UserlandToybox  = "toybox"
+	UserlandDash    = "dash"
 
 	AgentSourceRelease = "release"
 	AgentSourceLocal   = "local"
 	AgentSourceHTTP    = "http"
+	AgentSourceOCI     = "oci"
+
+	PopulateMkfs  = "mkfs"
+	PopulateMount = "mount"
+
+	LayerConflictsWarn  = "warn"
+	LayerConflictsError = "error"
+
+	LimitsWarn  = "warn"
+	LimitsError = "error"
+
+	AssetSchemeOCI = "oci://"
+	AssetSchemeGit = "git://"
 )
 
 // Default Busybox (musl static) used when not provided by user.
@@ -120,6 +564,10 @@ type ManifestTemplate struct {
 	Actions       map[string]ActionConfig `toml:"actions,omitempty"`
 	CloudInit     *CloudInitConfig       `toml:"cloud_init,omitempty"`
 	Devices       *DevicesConfig         `toml:"devices,omitempty"`
+
+	// Dir is the directory holding manifest.toml, against which file
+	// references such as cloud_init.user_data.content are resolved.
+	Dir string `toml:"-"`
 }
 
 // ResourcesConfig defines default CPU and memory requirements.
@@ -132,6 +580,8 @@ type ResourcesConfig struct {
 type WorkloadConfig struct {
 	Entrypoint string   `toml:"entrypoint"`
 	Args       []string `toml:"args,omitempty"`
+	WorkDir    string   `toml:"workdir,omitempty"`
+	User       string   `toml:"user,omitempty"`
 }
 
 // NetworkConfig defines network configuration.
@@ -158,14 +608,31 @@ type CloudInitConfig struct {
 	Datasource string                 `toml:"datasource,omitempty"` // "nocloud", etc.
 	UserData   *CloudInitUserData     `toml:"user_data,omitempty"`
 	MetaData   map[string]interface{} `toml:"meta_data,omitempty"`
+	// Seed is the NoCloud seed image written next to the artifact: "iso"
+	// (the default for the nocloud datasource), "vfat" or "none".
+	Seed string `toml:"seed,omitempty"`
 }
 
 // CloudInitUserData defines cloud-init user-data.
 type CloudInitUserData struct {
+	// Inline means Content is the user-data itself; otherwise it is a
+	// file path relative to manifest.toml.
 	Inline  bool   `toml:"inline,omitempty"`
 	Content string `toml:"content,omitempty"`
 }
 
+// Cloud-init seed image formats.
+const (
+	CloudInitSeedISO  = "iso"
+	CloudInitSeedVFAT = "vfat"
+	CloudInitSeedNone = "none"
+)
+
+// WantsSeed reports whether a NoCloud seed image is generated.
+func (c *CloudInitConfig) WantsSeed() bool {
+	return c != nil && c.Seed != "" && c.Seed != CloudInitSeedNone
+}
+
 // DevicesConfig defines device passthrough configuration.
 type DevicesConfig struct {
 	PCIPassthrough []string `toml:"pci_passthrough,omitempty"`
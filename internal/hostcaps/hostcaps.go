@@ -0,0 +1,106 @@
+// Package hostcaps checks that fledge holds what an operation needs from
+// the host — Linux capabilities and access to devices — rather than that it
+// runs as root, so builds also run in containers granted only those, and a
+// missing privilege is reported by name before the step that needs it.
+package hostcaps
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Capability is a Linux capability number.
+type Capability uint
+
+// Capabilities fledge needs.
+const (
+	CapChown       Capability = 0
+	CapDACOverride Capability = 1
+	CapFowner      Capability = 3
+	CapKill        Capability = 5
+	CapNetAdmin    Capability = 12
+	CapSysAdmin    Capability = 21
+	CapMknod       Capability = 27
+)
+
+var capNames = map[Capability]string{
+	CapChown:       "CAP_CHOWN",
+	CapDACOverride: "CAP_DAC_OVERRIDE",
+	CapFowner:      "CAP_FOWNER",
+	CapKill:        "CAP_KILL",
+	CapNetAdmin:    "CAP_NET_ADMIN",
+	CapSysAdmin:    "CAP_SYS_ADMIN",
+	CapMknod:       "CAP_MKNOD",
+}
+
+func (c Capability) String() string {
+	if name, ok := capNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("capability %d", uint(c))
+}
+
+// Has reports whether the process holds c in its effective set.
+func Has(c Capability) bool {
+	set, err := effective()
+	return err == nil && set&(1<<c) != 0
+}
+
+// Need is one thing an operation needs from the host.
+type Need struct {
+	// What names the capability or device.
+	What string
+	// Why says what it is needed for.
+	Why   string
+	check func() error
+}
+
+// Cap needs the capability c, for why.
+func Cap(c Capability, why string) Need {
+	return Need{What: c.String(), Why: why, check: func() error {
+		set, err := effective()
+		if err != nil {
+			return err
+		}
+		if set&(1<<c) == 0 {
+			return errors.New("not in the effective capability set")
+		}
+		return nil
+	}}
+}
+
+// Device needs read-write access to the device node at path, for why.
+func Device(path, why string) Need {
+	return Need{What: path, Why: why, check: func() error {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		var pe *os.PathError
+		if errors.As(err, &pe) {
+			return pe.Err
+		} else if err != nil {
+			return err
+		}
+		return f.Close()
+	}}
+}
+
+// Check returns an error listing every need the host does not meet, each
+// once, or nil when all are met.
+func Check(needs ...Need) error {
+	var missing []string
+	seen := map[string]bool{}
+	for _, n := range needs {
+		if seen[n.What] {
+			continue
+		}
+		seen[n.What] = true
+		if err := n.check(); err != nil {
+			missing = append(missing, fmt.Sprintf("  %s (%s): %v", n.What, n.Why, err))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("missing host privileges:\n%s\nrun as root (use sudo), or grant the container these capabilities and devices", strings.Join(missing, "\n"))
+}
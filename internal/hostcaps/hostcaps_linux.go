@@ -0,0 +1,35 @@
+//go:build linux
+
+package hostcaps
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// effective returns the effective capability set of the process.
+func effective() (uint64, error) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read capabilities: %w", err)
+	}
+	return parseCapEff(string(status))
+}
+
+// parseCapEff returns the CapEff field of a /proc/<pid>/status file.
+func parseCapEff(status string) (uint64, error) {
+	for _, line := range strings.Split(status, "\n") {
+		value, ok := strings.CutPrefix(line, "CapEff:")
+		if !ok {
+			continue
+		}
+		set, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CapEff %q: %w", value, err)
+		}
+		return set, nil
+	}
+	return 0, fmt.Errorf("no CapEff in process status")
+}
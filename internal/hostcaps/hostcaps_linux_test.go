@@ -0,0 +1,47 @@
+//go:build linux
+
+package hostcaps
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseCapEff tests reading the effective set from a process status.
+func TestParseCapEff(t *testing.T) {
+	status := "Name:\tfledge\nCapInh:\t0000000000000000\nCapPrm:\t00000000a80425fb\nCapEff:\t00000000a80425fb\n"
+	set, err := parseCapEff(status)
+	if err != nil {
+		t.Fatalf("parseCapEff failed: %v", err)
+	}
+	for c, want := range map[Capability]bool{CapChown: true, CapMknod: true, CapSysAdmin: false, CapNetAdmin: false} {
+		if got := set&(1<<c) != 0; got != want {
+			t.Errorf("%s held = %v, want %v", c, got, want)
+		}
+	}
+	if _, err := parseCapEff("Name:\tfledge\n"); err == nil {
+		t.Error("Expected an error without CapEff")
+	}
+}
+
+// TestCheck tests that unmet needs are listed once each with their reason.
+func TestCheck(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "kvm")
+	err := Check(
+		Device(missing, "to run microVMs"),
+		Device(missing, "to run microVMs again"),
+	)
+	if err == nil {
+		t.Fatal("Expected a missing device to fail the check")
+	}
+	if msg := err.Error(); strings.Count(msg, missing) != 1 || !strings.Contains(msg, "to run microVMs") {
+		t.Errorf("Expected the device listed once with its reason, got %q", msg)
+	}
+	if err := Check(Device("/dev/null", "to discard output")); err != nil {
+		t.Errorf("Expected /dev/null to be accessible, got %v", err)
+	}
+	if Check() != nil {
+		t.Error("Expected no needs to be met")
+	}
+}
@@ -13,8 +13,13 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
+// DefaultBootTimeout is how long a VM may take to write its first console
+// output before it is considered hung.
+const DefaultBootTimeout = 60 * time.Second
+
 // LaunchSpec describes a minimal VM configuration for Cloud Hypervisor.
 type LaunchSpec struct {
 	Name          string
@@ -26,10 +31,13 @@ type LaunchSpec struct {
 	ReadOnlyRoot  bool
 	InitramfsPath string // optional initramfs archive supplied via --initramfs
 	TapDevice     string // host tap interface to attach to the VM
+	VhostUserNet  string // vhost-user-net backend socket (e.g. passt), used instead of TapDevice
 	MACAddress    string // optional guest MAC address override
 	IPAddress     string // optional guest IP address hint for Cloud Hypervisor
 	Gateway       string // optional gateway (used in kernel args)
 	Netmask       string // optional netmask hint for Cloud Hypervisor
+	VsockCID      uint32 // guest context ID for the vsock device
+	VsockSocket   string // host Unix socket backing the vsock device; empty disables it
 }
 
 // Instance represents a running VM process.
@@ -39,13 +47,49 @@ type Instance interface {
 	Stop(ctx context.Context) error
 }
 
-// Launcher provides a minimal Cloud Hypervisor process launcher.
+// Hypervisors a Launcher can run.
+const (
+	HypervisorCloudHypervisor = "cloud-hypervisor"
+	// HypervisorQEMU runs QEMU's x86_64 microvm machine type, for hosts
+	// without cloud-hypervisor.
+	HypervisorQEMU = "qemu"
+)
+
+// DefaultBin returns the binary run for hypervisor when none is configured.
+func DefaultBin(hypervisor string) string {
+	if hypervisor == HypervisorQEMU {
+		return "qemu-system-x86_64"
+	}
+	return "cloud-hypervisor"
+}
+
+// ConfiguredBin returns the binary run for hypervisor: CLOUDHYPERVISOR or
+// FLEDGE_QEMU when set, DefaultBin otherwise.
+func ConfiguredBin(hypervisor string) string {
+	env := "CLOUDHYPERVISOR"
+	if hypervisor == HypervisorQEMU {
+		env = "FLEDGE_QEMU"
+	}
+	if bin := os.Getenv(env); bin != "" {
+		return bin
+	}
+	return DefaultBin(hypervisor)
+}
+
+// Launcher provides a minimal microVM process launcher for Cloud Hypervisor
+// or QEMU.
 type Launcher struct {
+	// Hypervisor is HypervisorCloudHypervisor (the default when empty) or
+	// HypervisorQEMU.
+	Hypervisor    string
 	Bin           string
 	KernelBZImage string
 	KernelVMLinux string
 	RuntimeDir    string
 	LogDir        string
+	// BootTimeout bounds how long Launch waits for the guest's first serial
+	// console output; zero disables the check.
+	BootTimeout time.Duration
 }
 
 // New constructs a new Launcher.
@@ -93,10 +137,10 @@ func (i *chInstance) Stop(ctx context.Context) error {
 	}
 }
 
-// Launch starts a Cloud Hypervisor VM process.
+// Launch starts a VM process with l's hypervisor.
 func (l *Launcher) Launch(ctx context.Context, spec LaunchSpec) (Instance, error) {
 	if l.Bin == "" {
-		l.Bin = "cloud-hypervisor"
+		l.Bin = DefaultBin(l.Hypervisor)
 	}
 	if spec.CPUCores <= 0 {
 		spec.CPUCores = 2
@@ -166,20 +210,6 @@ func (l *Launcher) Launch(ctx context.Context, spec LaunchSpec) (Instance, error
 
 	cmdlineArg := strings.Join(cmdline, " ")
 
-	args := []string{
-		"--cpus", "boot=" + strconv.Itoa(spec.CPUCores),
-		"--memory", fmt.Sprintf("size=%dM", spec.MemoryMB),
-		"--kernel", kernel,
-		"--cmdline", cmdlineArg,
-	}
-	if spec.DiskPath != "" {
-		ro := "off"
-		if spec.ReadOnlyRoot {
-			ro = "on"
-		}
-		args = append(args, "--disk", fmt.Sprintf("path=%s,readonly=%s", spec.DiskPath, ro))
-	}
-
 	if spec.InitramfsPath != "" {
 		initramfs := spec.InitramfsPath
 		if !filepath.IsAbs(initramfs) {
@@ -196,47 +226,194 @@ func (l *Launcher) Launch(ctx context.Context, spec LaunchSpec) (Instance, error
 		if fi.IsDir() {
 			return nil, fmt.Errorf("initramfs path: is a directory")
 		}
-		args = append(args, "--initramfs", initramfs)
+		spec.InitramfsPath = initramfs
 	}
 
-	if spec.TapDevice != "" {
-		netParts := []string{fmt.Sprintf("tap=%s", spec.TapDevice)}
-		mac := spec.MACAddress
-		if mac == "" {
-			var err error
-			mac, err = generateLocalMAC()
+	if spec.TapDevice != "" && spec.VhostUserNet == "" {
+		if spec.MACAddress == "" {
+			mac, err := generateLocalMAC()
 			if err != nil {
 				return nil, fmt.Errorf("tap mac: %w", err)
 			}
-		} else {
-			if _, err := net.ParseMAC(mac); err != nil {
-				return nil, fmt.Errorf("tap mac: %w", err)
-			}
-		}
-		netParts = append(netParts, fmt.Sprintf("mac=%s", mac))
-		if ip := strings.TrimSpace(spec.IPAddress); ip != "" {
-			netParts = append(netParts, fmt.Sprintf("ip=%s", ip))
-		}
-		if mask := strings.TrimSpace(spec.Netmask); mask != "" {
-			netParts = append(netParts, fmt.Sprintf("mask=%s", mask))
+			spec.MACAddress = mac
+		} else if _, err := net.ParseMAC(spec.MACAddress); err != nil {
+			return nil, fmt.Errorf("tap mac: %w", err)
 		}
-		args = append(args, "--net", strings.Join(netParts, ","))
 	}
 
 	// Serial to file per-VM
 	if spec.Name == "" {
 		spec.Name = "vm"
 	}
-	serialLog := filepath.Join(l.LogDir, spec.Name+"-serial.log")
-	args = append(args, "--serial", "file="+serialLog)
+	serialLog := l.SerialLogPath(spec.Name)
+
+	var args []string
+	switch l.Hypervisor {
+	case "", HypervisorCloudHypervisor:
+		args = cloudHypervisorArgs(spec, kernel, cmdlineArg, serialLog)
+	case HypervisorQEMU:
+		var err error
+		if args, err = qemuArgs(spec, kernel, cmdlineArg, serialLog); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown hypervisor %q", l.Hypervisor)
+	}
 
 	cmd := exec.CommandContext(ctx, l.Bin, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("launch cloud-hypervisor: %w", err)
+		return nil, fmt.Errorf("launch %s: %w", l.hypervisorName(), err)
+	}
+	inst := &chInstance{name: spec.Name, cmd: cmd}
+	if err := l.awaitConsole(ctx, inst, serialLog, kernel); err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// cloudHypervisorArgs returns the cloud-hypervisor command line for spec.
+func cloudHypervisorArgs(spec LaunchSpec, kernel, cmdline, serialLog string) []string {
+	memory := fmt.Sprintf("size=%dM", spec.MemoryMB)
+	if spec.VhostUserNet != "" {
+		// vhost-user backends access guest memory directly.
+		memory += ",shared=on"
+	}
+	args := []string{
+		"--cpus", "boot=" + strconv.Itoa(spec.CPUCores),
+		"--memory", memory,
+		"--kernel", kernel,
+		"--cmdline", cmdline,
+	}
+	if spec.DiskPath != "" {
+		ro := "off"
+		if spec.ReadOnlyRoot {
+			ro = "on"
+		}
+		args = append(args, "--disk", fmt.Sprintf("path=%s,readonly=%s", spec.DiskPath, ro))
+	}
+	if spec.InitramfsPath != "" {
+		args = append(args, "--initramfs", spec.InitramfsPath)
+	}
+
+	if spec.VhostUserNet != "" {
+		netParts := []string{"vhost_user=true", "socket=" + spec.VhostUserNet}
+		if spec.MACAddress != "" {
+			netParts = append(netParts, "mac="+spec.MACAddress)
+		}
+		args = append(args, "--net", strings.Join(netParts, ","))
+	} else if spec.TapDevice != "" {
+		netParts := []string{fmt.Sprintf("tap=%s", spec.TapDevice), fmt.Sprintf("mac=%s", spec.MACAddress)}
+		if ip := strings.TrimSpace(spec.IPAddress); ip != "" {
+			netParts = append(netParts, fmt.Sprintf("ip=%s", ip))
+		}
+		if mask := strings.TrimSpace(spec.Netmask); mask != "" {
+			netParts = append(netParts, fmt.Sprintf("mask=%s", mask))
+		}
+		args = append(args, "--net", strings.Join(netParts, ","))
+	}
+
+	if spec.VsockSocket != "" {
+		args = append(args, "--vsock", fmt.Sprintf("cid=%d,socket=%s", spec.VsockCID, spec.VsockSocket))
+	}
+	return append(args, "--serial", "file="+serialLog)
+}
+
+// HybridVsock reports whether VMs get Cloud Hypervisor's Unix socket backed
+// vsock device, which LaunchSpec.VsockSocket requires.
+func (l *Launcher) HybridVsock() bool {
+	return l.Hypervisor == "" || l.Hypervisor == HypervisorCloudHypervisor
+}
+
+func (l *Launcher) hypervisorName() string {
+	if l.Hypervisor == "" {
+		return HypervisorCloudHypervisor
+	}
+	return l.Hypervisor
+}
+
+// SerialLogPath returns the file Launch writes the serial console of VM name to.
+func (l *Launcher) SerialLogPath(name string) string {
+	dir := l.LogDir
+	if dir == "" {
+		dir = l.RuntimeDir
+	}
+	return filepath.Join(dir, name+"-serial.log")
+}
+
+// ConsoleTail returns up to max bytes from the end of the serial console of
+// VM name, starting at a line boundary, or "" when nothing was logged.
+func (l *Launcher) ConsoleTail(name string, max int64) string {
+	f, err := os.Open(l.SerialLogPath(name))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	offset := info.Size() - max
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, info.Size()-offset)
+	n, _ := f.ReadAt(buf, offset)
+	tail := string(buf[:n])
+	if offset > 0 {
+		if i := strings.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+	return strings.TrimRight(strings.ReplaceAll(tail, "\r", ""), "\n")
+}
+
+// awaitConsole waits up to l.BootTimeout for the guest to write to its serial
+// log, stopping the VM if it stays silent so that a bad kernel or disk fails
+// the step instead of hanging it. A VM that exits early is left for Wait to
+// report.
+func (l *Launcher) awaitConsole(ctx context.Context, inst *chInstance, serialLog, kernel string) error {
+	if l.BootTimeout <= 0 {
+		return nil
+	}
+	deadline := time.NewTimer(l.BootTimeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if fi, err := os.Stat(serialLog); err == nil && fi.Size() > 0 {
+			return nil
+		}
+		if processExited(inst.PID()) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-deadline.C:
+			stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = inst.Stop(stopCtx)
+			return fmt.Errorf("vm %s wrote no console output within %s (kernel %s); set FLEDGE_VM_BOOT_TIMEOUT to wait longer", inst.name, l.BootTimeout, kernel)
+		case <-tick.C:
+		}
+	}
+}
+
+// processExited reports whether pid has exited and awaits reaping.
+func processExited(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesised command name, which may itself
+	// contain spaces or parentheses.
+	s := string(data)
+	if i := strings.LastIndexByte(s, ')'); i >= 0 && i+2 < len(s) {
+		return s[i+2] == 'Z'
 	}
-	return &chInstance{name: spec.Name, cmd: cmd}, nil
+	return false
 }
 
 func generateLocalMAC() (string, error) {
@@ -0,0 +1,28 @@
+//go:build linux
+
+package launcher
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestConsoleTail tests reading the end of a serial log from a line boundary.
+func TestConsoleTail(t *testing.T) {
+	l := &Launcher{LogDir: t.TempDir()}
+	if got := l.ConsoleTail("vm", 1024); got != "" {
+		t.Errorf("Expected no tail for a missing log, got %q", got)
+	}
+
+	log := "[    0.000000] Linux version 6.1\r\n" + strings.Repeat("x", 40) + "\r\nudhcpc: no lease, failing\r\n"
+	if err := os.WriteFile(l.SerialLogPath("vm"), []byte(log), 0644); err != nil {
+		t.Fatalf("failed to write serial log: %v", err)
+	}
+	if got := l.ConsoleTail("vm", 1024); !strings.HasPrefix(got, "[    0.000000] Linux") || strings.Contains(got, "\r") {
+		t.Errorf("Expected the whole log without carriage returns, got %q", got)
+	}
+	if got := l.ConsoleTail("vm", 40); got != "udhcpc: no lease, failing" {
+		t.Errorf("Expected the last complete line, got %q", got)
+	}
+}
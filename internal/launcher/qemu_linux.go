@@ -0,0 +1,77 @@
+//go:build linux
+
+package launcher
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// qemuArgs returns the qemu-system-x86_64 command line booting spec on the
+// microvm machine type. Devices sit on virtio-mmio, which QEMU announces on
+// the kernel command line, so the guest sees the same /dev/vda and eth0 as
+// under Cloud Hypervisor. KVM is used when available, falling back to TCG.
+func qemuArgs(spec LaunchSpec, kernel, cmdline, serialLog string) ([]string, error) {
+	if runtime.GOARCH != "amd64" {
+		return nil, fmt.Errorf("qemu launcher: the microvm machine type needs an x86_64 host, not %s", runtime.GOARCH)
+	}
+	if spec.VsockSocket != "" {
+		return nil, fmt.Errorf("qemu launcher: Unix socket backed vsock devices are not supported")
+	}
+
+	machine := "microvm,x-option-roms=off,isa-serial=on,rtc=on"
+	var memory []string
+	if spec.VhostUserNet != "" {
+		// vhost-user backends access guest memory directly, so it must be
+		// a shareable memfd.
+		machine += ",memory-backend=mem"
+		memory = []string{"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", spec.MemoryMB)}
+	}
+	args := []string{
+		"-M", machine,
+		"-accel", "kvm", "-accel", "tcg",
+		"-cpu", "max",
+		"-smp", strconv.Itoa(spec.CPUCores),
+		"-m", strconv.Itoa(spec.MemoryMB) + "M",
+		"-nodefaults", "-no-user-config", "-no-reboot",
+		"-display", "none",
+		"-kernel", kernel,
+		"-append", cmdline,
+		"-serial", "file:" + serialLog,
+	}
+	args = append(args, memory...)
+
+	if spec.DiskPath != "" {
+		drive := []string{"id=root", "file=" + qemuOptValue(spec.DiskPath), "format=raw", "if=none"}
+		if spec.ReadOnlyRoot {
+			drive = append(drive, "readonly=on")
+		}
+		args = append(args, "-drive", strings.Join(drive, ","), "-device", "virtio-blk-device,drive=root")
+	}
+	if spec.InitramfsPath != "" {
+		args = append(args, "-initrd", spec.InitramfsPath)
+	}
+
+	device := "virtio-net-device,netdev=net0"
+	if spec.MACAddress != "" {
+		device += ",mac=" + spec.MACAddress
+	}
+	if spec.VhostUserNet != "" {
+		args = append(args,
+			"-chardev", "socket,id=net0sock,path="+qemuOptValue(spec.VhostUserNet),
+			"-netdev", "vhost-user,id=net0,chardev=net0sock",
+			"-device", device)
+	} else if spec.TapDevice != "" {
+		args = append(args,
+			"-netdev", "tap,id=net0,ifname="+spec.TapDevice+",script=no,downscript=no",
+			"-device", device)
+	}
+	return args, nil
+}
+
+// qemuOptValue escapes commas in a QEMU option value.
+func qemuOptValue(v string) string {
+	return strings.ReplaceAll(v, ",", ",,")
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package launcher
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestQEMUArgs tests the microvm command line for a disk, tap and vhost-user
+// network.
+func TestQEMUArgs(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the microvm machine type is x86_64 only")
+	}
+	spec := LaunchSpec{CPUCores: 2, MemoryMB: 512, DiskPath: "/tmp/a,b.img", TapDevice: "tap0", MACAddress: "02:00:00:00:00:01"}
+	args, err := qemuArgs(spec, "/boot/bzImage", "console=ttyS0", "/tmp/serial.log")
+	if err != nil {
+		t.Fatalf("qemuArgs() error = %v", err)
+	}
+	joined := strings.Join(args, " ")
+	for _, want := range []string{
+		"-M microvm,",
+		"-drive id=root,file=/tmp/a,,b.img,format=raw,if=none",
+		"-netdev tap,id=net0,ifname=tap0,script=no,downscript=no",
+		"-device virtio-net-device,netdev=net0,mac=02:00:00:00:00:01",
+		"-serial file:/tmp/serial.log",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Expected %q in %q", want, joined)
+		}
+	}
+
+	spec.TapDevice, spec.VhostUserNet = "", "/run/passt.sock"
+	args, _ = qemuArgs(spec, "/boot/bzImage", "console=ttyS0", "/tmp/serial.log")
+	if joined := strings.Join(args, " "); !strings.Contains(joined, "memory-backend-memfd,id=mem,size=512M,share=on") || !strings.Contains(joined, "vhost-user,id=net0") {
+		t.Errorf("Expected shared memory and a vhost-user netdev, got %q", joined)
+	}
+
+	spec.VsockSocket = "/tmp/vm.sock"
+	if _, err := qemuArgs(spec, "/boot/bzImage", "", "/tmp/serial.log"); err == nil {
+		t.Error("Expected a vsock socket to be rejected")
+	}
+}
@@ -0,0 +1,279 @@
+// Package ledger keeps a persistent record of host resources fledge creates
+// (loop devices, mounts, tap interfaces, leased IPs and microVM processes) so
+// that ones left behind by a crash or SIGKILL can be found and reclaimed.
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// FileName is the name of the ledger file in fledge's state directory.
+const FileName = "ledger.json"
+
+// Kind identifies a type of resource.
+type Kind string
+
+// Resource kinds, listed in the order they are reclaimed: processes first,
+// then what they were using.
+const (
+	KindVM    Kind = "vm"
+	KindMount Kind = "mount"
+	KindLoop  Kind = "loop"
+	KindTap   Kind = "tap"
+	KindIP    Kind = "ip"
+)
+
+var reclaimOrder = []Kind{KindVM, KindMount, KindLoop, KindTap, KindIP}
+
+// Entry is a resource created by a fledge process.
+type Entry struct {
+	Kind Kind   `json:"kind"`
+	ID   string `json:"id"`
+	// Detail carries kind specific data, e.g. the binary of a VM process.
+	Detail  string    `json:"detail,omitempty"`
+	Owner   int       `json:"owner"`
+	Created time.Time `json:"created"`
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %s", e.Kind, e.ID)
+}
+
+// Reclaimer releases an orphaned resource. Resources that no longer exist
+// should not be reported as errors.
+type Reclaimer func(ctx context.Context, e Entry) error
+
+var (
+	reclaimersMu sync.RWMutex
+	reclaimers   = map[Kind]Reclaimer{}
+)
+
+// RegisterReclaimer registers how resources of kind are reclaimed.
+func RegisterReclaimer(kind Kind, fn Reclaimer) {
+	reclaimersMu.Lock()
+	defer reclaimersMu.Unlock()
+	reclaimers[kind] = fn
+}
+
+func reclaimerFor(kind Kind) Reclaimer {
+	reclaimersMu.RLock()
+	defer reclaimersMu.RUnlock()
+	return reclaimers[kind]
+}
+
+// Ledger is a ledger file shared by all fledge processes on the host.
+type Ledger struct {
+	path string
+}
+
+// Open returns the ledger stored at path.
+func Open(path string) *Ledger {
+	return &Ledger{path: path}
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultLedger *Ledger
+)
+
+// Default returns the ledger in fledge's state directory, or nil if the
+// directory cannot be created; a nil Ledger ignores all calls.
+func Default() *Ledger {
+	defaultOnce.Do(func() {
+		dir, err := utils.CacheDir("state")
+		if err != nil {
+			logging.Debug("Resource ledger disabled", "error", err)
+			return
+		}
+		defaultLedger = Open(filepath.Join(dir, FileName))
+	})
+	return defaultLedger
+}
+
+// Record adds a resource created by this process to the default ledger.
+func Record(kind Kind, id, detail string) {
+	Default().Record(kind, id, detail)
+}
+
+// Release removes a resource from the default ledger once it is cleaned up.
+func Release(kind Kind, id string) {
+	Default().Release(kind, id)
+}
+
+// Record adds a resource created by this process. Failures are logged rather
+// than returned: the ledger must never fail a build.
+func (l *Ledger) Record(kind Kind, id, detail string) {
+	if l == nil || id == "" {
+		return
+	}
+	err := l.update(func(entries []Entry) []Entry {
+		entries = remove(entries, kind, id)
+		return append(entries, Entry{Kind: kind, ID: id, Detail: detail, Owner: os.Getpid(), Created: time.Now().UTC()})
+	})
+	if err != nil {
+		logging.Debug("Failed to record resource", "kind", kind, "id", id, "error", err)
+	}
+}
+
+// Release removes a resource.
+func (l *Ledger) Release(kind Kind, id string) {
+	if l == nil || id == "" {
+		return
+	}
+	err := l.update(func(entries []Entry) []Entry {
+		return remove(entries, kind, id)
+	})
+	if err != nil {
+		logging.Debug("Failed to release resource", "kind", kind, "id", id, "error", err)
+	}
+}
+
+// Entries returns all recorded resources.
+func (l *Ledger) Entries() ([]Entry, error) {
+	if l == nil {
+		return nil, nil
+	}
+	var out []Entry
+	err := l.update(func(entries []Entry) []Entry {
+		out = entries
+		return entries
+	})
+	return out, err
+}
+
+// Outcome is the result of reclaiming one resource.
+type Outcome struct {
+	Entry Entry
+	Err   error
+}
+
+// Reclaim releases resources whose owning process has exited, or all
+// resources when force is set. Reclaimed resources are removed from the
+// ledger; failures stay recorded so a later run can retry them.
+func (l *Ledger) Reclaim(ctx context.Context, force bool) ([]Outcome, error) {
+	if l == nil {
+		return nil, nil
+	}
+	var outcomes []Outcome
+	err := l.update(func(entries []Entry) []Entry {
+		var keep, orphans []Entry
+		for _, e := range entries {
+			if !force && ownerAlive(e.Owner) {
+				keep = append(keep, e)
+				continue
+			}
+			orphans = append(orphans, e)
+		}
+		sort.SliceStable(orphans, func(i, j int) bool {
+			return kindRank(orphans[i].Kind) < kindRank(orphans[j].Kind)
+		})
+		for _, e := range orphans {
+			err := reclaim(ctx, e)
+			outcomes = append(outcomes, Outcome{Entry: e, Err: err})
+			if err != nil {
+				keep = append(keep, e)
+			}
+		}
+		return keep
+	})
+	return outcomes, err
+}
+
+// ReclaimOrphans reclaims resources left behind by dead fledge processes,
+// logging what it did. It is run best-effort when fledge starts.
+func ReclaimOrphans(ctx context.Context) {
+	outcomes, err := Default().Reclaim(ctx, false)
+	if err != nil {
+		logging.Debug("Failed to check resource ledger", "error", err)
+		return
+	}
+	for _, o := range outcomes {
+		if o.Err != nil {
+			logging.Warn("Failed to reclaim orphaned resource; run fledge cleanup", "resource", o.Entry.String(), "error", o.Err)
+			continue
+		}
+		logging.Info("Reclaimed orphaned resource", "resource", o.Entry.String(), "owner", o.Entry.Owner)
+	}
+}
+
+func reclaim(ctx context.Context, e Entry) error {
+	fn := reclaimerFor(e.Kind)
+	if fn == nil {
+		return fmt.Errorf("no reclaimer for %s resources in this build of fledge", e.Kind)
+	}
+	return fn(ctx, e)
+}
+
+func kindRank(kind Kind) int {
+	for i, k := range reclaimOrder {
+		if k == kind {
+			return i
+		}
+	}
+	return len(reclaimOrder)
+}
+
+func remove(entries []Entry, kind Kind, id string) []Entry {
+	out := entries[:0]
+	for _, e := range entries {
+		if e.Kind != kind || e.ID != id {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// update applies fn to the ledger under an exclusive file lock.
+func (l *Ledger) update(fn func([]Entry) []Entry) error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create ledger directory: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open ledger: %w", err)
+	}
+	defer f.Close()
+	unlock, err := lockFile(f)
+	if err != nil {
+		return fmt.Errorf("failed to lock ledger: %w", err)
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read ledger: %w", err)
+	}
+	var entries []Entry
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			logging.Warn("Resetting unreadable resource ledger", "path", l.path, "error", err)
+			entries = nil
+		}
+	}
+
+	entries = fn(entries)
+	if entries == nil {
+		entries = []Entry{}
+	}
+	data, err = json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode ledger: %w", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	if _, err := f.WriteAt(append(data, '\n'), 0); err != nil {
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	return nil
+}
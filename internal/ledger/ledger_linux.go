@@ -0,0 +1,117 @@
+//go:build linux
+
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/volantvm/fledge/internal/loopdev"
+)
+
+func init() {
+	RegisterReclaimer(KindVM, reclaimVM)
+	RegisterReclaimer(KindMount, reclaimMount)
+	RegisterReclaimer(KindLoop, reclaimLoop)
+}
+
+// reclaimMount unmounts a mount point left mounted, after checking that it
+// is still mounted from the recorded device rather than by someone else
+// since.
+func reclaimMount(ctx context.Context, e Entry) error {
+	if e.Detail == "" {
+		return nil
+	}
+	ok, err := loopdev.MountedFrom(e.ID, e.Detail)
+	if err != nil || !ok {
+		return err
+	}
+	return loopdev.Unmount(e.ID)
+}
+
+// reclaimLoop detaches a loop device left attached, after checking that it
+// still backs the recorded image rather than one a later attach reused it
+// for.
+func reclaimLoop(ctx context.Context, e Entry) error {
+	if e.Detail == "" {
+		return nil
+	}
+	ok, err := loopdev.BackedBy(e.ID, e.Detail)
+	if err != nil || !ok {
+		return err
+	}
+	return loopdev.Detach(e.ID)
+}
+
+// reclaimVM stops a microVM process left running, after checking that the
+// PID still belongs to the recorded binary rather than a reused PID.
+func reclaimVM(ctx context.Context, e Entry) error {
+	pid, err := strconv.Atoi(e.ID)
+	if err != nil {
+		return fmt.Errorf("invalid pid %q", e.ID)
+	}
+	if !processMatches(pid, e.Detail) {
+		return nil
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	return terminate(ctx, proc)
+}
+
+// lockFile takes an exclusive flock on f.
+func lockFile(f *os.File) (func(), error) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	return func() { syscall.Flock(int(f.Fd()), syscall.LOCK_UN) }, nil
+}
+
+// ownerAlive reports whether the process with pid is running.
+func ownerAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// processMatches reports whether pid runs binary, judged by argv[0].
+func processMatches(pid int, binary string) bool {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(cmdline) == 0 {
+		return false
+	}
+	argv0, _, _ := bytes.Cut(cmdline, []byte{0})
+	if binary == "" {
+		return false
+	}
+	return string(argv0) == binary || filepath.Base(string(argv0)) == filepath.Base(binary)
+}
+
+// terminate sends SIGTERM, then SIGKILL if the process outlives ctx or a
+// short grace period.
+func terminate(ctx context.Context, proc *os.Process) error {
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		return nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		if proc.Signal(syscall.Signal(0)) != nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := proc.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to kill pid %d: %w", proc.Pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package ledger
+
+import "os"
+
+// lockFile is a no-op; fledge only creates host resources on Linux.
+func lockFile(f *os.File) (func(), error) {
+	return func() {}, nil
+}
+
+// ownerAlive reports whether pid is this process.
+func ownerAlive(pid int) bool {
+	return pid == os.Getpid()
+}
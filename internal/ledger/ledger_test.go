@@ -0,0 +1,110 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRecordRelease tests adding and removing resources.
+func TestRecordRelease(t *testing.T) {
+	l := Open(filepath.Join(t.TempDir(), FileName))
+
+	l.Record(KindLoop, "/dev/loop3", "/tmp/image.img")
+	l.Record(KindMount, "/tmp/mnt", "/dev/loop3")
+	l.Record(KindLoop, "/dev/loop3", "/tmp/image.img")
+
+	entries, err := l.Entries()
+	if err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", entries)
+	}
+	if entries[0].Owner != os.Getpid() {
+		t.Errorf("Expected owner %d, got %d", os.Getpid(), entries[0].Owner)
+	}
+
+	l.Release(KindLoop, "/dev/loop3")
+	entries, _ = l.Entries()
+	if len(entries) != 1 || entries[0].Kind != KindMount {
+		t.Errorf("Expected only the mount to remain, got %+v", entries)
+	}
+}
+
+// TestNilLedger tests that a nil ledger ignores all calls.
+func TestNilLedger(t *testing.T) {
+	var l *Ledger
+	l.Record(KindTap, "tap0", "")
+	l.Release(KindTap, "tap0")
+	if entries, err := l.Entries(); err != nil || entries != nil {
+		t.Errorf("Expected nothing, got %v, %v", entries, err)
+	}
+}
+
+// TestReclaim tests reclaiming orphans in dependency order and keeping
+// failures and resources of live processes.
+func TestReclaim(t *testing.T) {
+	l := Open(filepath.Join(t.TempDir(), FileName))
+
+	var order []string
+	record := func(ctx context.Context, e Entry) error {
+		order = append(order, e.ID)
+		if e.ID == "stuck" {
+			return errors.New("busy")
+		}
+		return nil
+	}
+	for _, kind := range []Kind{KindVM, KindMount, KindLoop} {
+		RegisterReclaimer(kind, record)
+	}
+
+	const dead = 1 << 30
+	if err := l.update(func([]Entry) []Entry {
+		return []Entry{
+			{Kind: KindLoop, ID: "/dev/loop1", Owner: dead},
+			{Kind: KindMount, ID: "stuck", Owner: dead},
+			{Kind: KindVM, ID: "123", Owner: dead},
+			{Kind: KindLoop, ID: "/dev/loop2", Owner: os.Getpid()},
+			{Kind: "unknown", ID: "x", Owner: dead},
+		}
+	}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	outcomes, err := l.Reclaim(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Reclaim failed: %v", err)
+	}
+	if len(outcomes) != 4 {
+		t.Fatalf("Expected 4 outcomes, got %+v", outcomes)
+	}
+	want := []string{"123", "stuck", "/dev/loop1"}
+	if len(order) != len(want) {
+		t.Fatalf("Expected reclaim order %v, got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("Expected reclaim order %v, got %v", want, order)
+		}
+	}
+
+	entries, _ := l.Entries()
+	remaining := map[string]bool{}
+	for _, e := range entries {
+		remaining[e.ID] = true
+	}
+	if len(entries) != 3 || !remaining["stuck"] || !remaining["/dev/loop2"] || !remaining["x"] {
+		t.Errorf("Expected failed, live and unknown entries to remain, got %+v", entries)
+	}
+
+	order = nil
+	if _, err := l.Reclaim(context.Background(), true); err != nil {
+		t.Fatalf("forced Reclaim failed: %v", err)
+	}
+	if len(order) != 2 {
+		t.Errorf("Expected forced reclaim to include live entries, got %v", order)
+	}
+}
@@ -0,0 +1,375 @@
+// Package lock reads and writes fledge.lock, which records how remote build
+// inputs (source, layer, frontend and asset images, BusyBox, the kestrel agent,
+// remote mapping sources and git assets) were resolved so that later builds can be checked
+// against it.
+package lock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// FileName is the lock file written next to fledge.toml.
+const FileName = "fledge.lock"
+
+// FormatVersion is the current lock file format.
+const FormatVersion = "1"
+
+// File is the on-disk representation of fledge.lock.
+type File struct {
+	Version   string     `toml:"version"`
+	Agent     *Agent     `toml:"agent,omitempty"`
+	Busybox   *Download  `toml:"busybox,omitempty"`
+	Images    []Image    `toml:"images,omitempty"`
+	Downloads []Download `toml:"downloads,omitempty"`
+	// Repositories records the commits git assets were checked out at.
+	Repositories []Repository `toml:"repositories,omitempty"`
+}
+
+// Image roles recorded in the lock file.
+const (
+	RoleSource   = "source"
+	RoleLayer    = "layer"
+	RoleFrontend = "frontend"
+	RoleAsset    = "asset"
+)
+
+// Image records the digest an image reference resolved to.
+type Image struct {
+	Role   string `toml:"role"`
+	Ref    string `toml:"ref"`
+	Digest string `toml:"digest"`
+}
+
+// Download records the digest of a file fetched over HTTP, such as BusyBox or
+// a remote mapping source.
+type Download struct {
+	URL    string `toml:"url"`
+	Digest string `toml:"digest"`
+}
+
+// Repository records the commit a git ref resolved to.
+type Repository struct {
+	URL    string `toml:"url"`
+	Ref    string `toml:"ref"`
+	Commit string `toml:"commit"`
+}
+
+// Agent records the resolved kestrel agent.
+type Agent struct {
+	SourceStrategy string `toml:"source_strategy"`
+	// Version is the resolved release tag, never "latest".
+	Version string `toml:"version,omitempty"`
+	URL     string `toml:"url,omitempty"`
+	Image   string `toml:"image,omitempty"`
+	Digest  string `toml:"digest"`
+}
+
+// Load reads a lock file from path.
+func Load(path string) (*File, error) {
+	var f File
+	if _, err := toml.DecodeFile(path, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if f.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported lock file version '%s' in %s, expected '%s'", f.Version, path, FormatVersion)
+	}
+	return &f, nil
+}
+
+// Encode renders f as TOML.
+func (f *File) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("# This file is generated by fledge. Commit it and use `fledge build --locked`\n")
+	buf.WriteString("# to fail builds whose remote inputs resolve differently.\n\n")
+	if err := toml.NewEncoder(&buf).Encode(f); err != nil {
+		return nil, fmt.Errorf("failed to encode lock file: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Tracker collects the inputs resolved during a build. In locked mode every
+// recorded input must match the committed lock file. A nil *Tracker accepts
+// and discards everything, for builds that do not use a lock file.
+type Tracker struct {
+	path      string
+	locked    bool
+	committed *File
+
+	mu       sync.Mutex
+	resolved File
+}
+
+// Open prepares a tracker for the lock file at path. In locked mode the file
+// must already exist.
+func Open(path string, locked bool) (*Tracker, error) {
+	t := &Tracker{path: path, locked: locked, resolved: File{Version: FormatVersion}}
+
+	f, err := Load(path)
+	switch {
+	case err == nil:
+		t.committed = f
+	case errors.Is(err, os.ErrNotExist):
+		if locked {
+			return nil, fmt.Errorf("--locked requires %s, run a build without --locked to create it", path)
+		}
+	default:
+		return nil, err
+	}
+	return t, nil
+}
+
+// Locked reports whether resolution differences are errors.
+func (t *Tracker) Locked() bool {
+	return t != nil && t.locked
+}
+
+// RecordAgent records the resolved agent, failing in locked mode if it differs
+// from the committed lock file.
+func (t *Tracker) RecordAgent(a Agent) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locked {
+		var want *Agent
+		if t.committed != nil {
+			want = t.committed.Agent
+		}
+		if want == nil {
+			return fmt.Errorf("agent is not recorded in %s", t.path)
+		}
+		if want.Digest != a.Digest {
+			return fmt.Errorf("agent resolved to %s (%s), but %s has %s (%s)",
+				a.Digest, describeAgent(a), t.path, want.Digest, describeAgent(*want))
+		}
+		if want.Version != "" && a.Version != "" && want.Version != a.Version {
+			return fmt.Errorf("agent resolved to version %s, but %s has %s", a.Version, t.path, want.Version)
+		}
+	}
+	t.resolved.Agent = &a
+	return nil
+}
+
+// RecordImage records the digest an image resolved to, failing in locked mode
+// if it is missing from or differs from the committed lock file.
+func (t *Tracker) RecordImage(img Image) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locked {
+		var committed []Image
+		if t.committed != nil {
+			committed = t.committed.Images
+		}
+		want, ok := findImage(committed, img.Role, img.Ref)
+		if !ok {
+			return fmt.Errorf("%s image %s is not recorded in %s", img.Role, img.Ref, t.path)
+		}
+		if want.Digest != img.Digest {
+			return fmt.Errorf("%s image %s resolved to %s, but %s has %s", img.Role, img.Ref, img.Digest, t.path, want.Digest)
+		}
+	}
+	if _, ok := findImage(t.resolved.Images, img.Role, img.Ref); !ok {
+		t.resolved.Images = append(t.resolved.Images, img)
+	}
+	return nil
+}
+
+// LockedImage returns the digest the committed lock file records for the
+// image ref in role, in locked mode only, so the build can pull exactly that
+// digest instead of resolving ref again.
+func (t *Tracker) LockedImage(role, ref string) (string, bool) {
+	if !t.Locked() || t.committed == nil {
+		return "", false
+	}
+	img, ok := findImage(t.committed.Images, role, ref)
+	return img.Digest, ok
+}
+
+// RecordBusybox records the downloaded BusyBox binary, failing in locked mode
+// if it differs from the committed lock file.
+func (t *Tracker) RecordBusybox(d Download) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locked {
+		var want *Download
+		if t.committed != nil {
+			want = t.committed.Busybox
+		}
+		if want == nil {
+			return fmt.Errorf("busybox is not recorded in %s", t.path)
+		}
+		if want.URL != d.URL || want.Digest != d.Digest {
+			return fmt.Errorf("busybox resolved to %s (%s), but %s has %s (%s)", d.URL, d.Digest, t.path, want.URL, want.Digest)
+		}
+	}
+	t.resolved.Busybox = &d
+	return nil
+}
+
+// RecordDownload records a remote mapping source, failing in locked mode if
+// its URL is missing from or has a different digest in the committed lock file.
+func (t *Tracker) RecordDownload(d Download) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locked {
+		var want *Download
+		if t.committed != nil {
+			for i := range t.committed.Downloads {
+				if t.committed.Downloads[i].URL == d.URL {
+					want = &t.committed.Downloads[i]
+					break
+				}
+			}
+		}
+		if want == nil {
+			return fmt.Errorf("download %s is not recorded in %s", d.URL, t.path)
+		}
+		if want.Digest != d.Digest {
+			return fmt.Errorf("download %s resolved to %s, but %s has %s", d.URL, d.Digest, t.path, want.Digest)
+		}
+	}
+	for _, existing := range t.resolved.Downloads {
+		if existing.URL == d.URL {
+			return nil
+		}
+	}
+	t.resolved.Downloads = append(t.resolved.Downloads, d)
+	return nil
+}
+
+// RecordRepository records the commit a git asset resolved to, failing in
+// locked mode if it is missing from or differs from the committed lock file.
+func (t *Tracker) RecordRepository(r Repository) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locked {
+		var committed []Repository
+		if t.committed != nil {
+			committed = t.committed.Repositories
+		}
+		want, ok := findRepository(committed, r.URL, r.Ref)
+		if !ok {
+			return fmt.Errorf("repository %s@%s is not recorded in %s", r.URL, r.Ref, t.path)
+		}
+		if want.Commit != r.Commit {
+			return fmt.Errorf("repository %s@%s resolved to %s, but %s has %s", r.URL, r.Ref, r.Commit, t.path, want.Commit)
+		}
+	}
+	if _, ok := findRepository(t.resolved.Repositories, r.URL, r.Ref); !ok {
+		t.resolved.Repositories = append(t.resolved.Repositories, r)
+	}
+	return nil
+}
+
+// Resolved returns a copy of the inputs resolved so far. A nil tracker
+// returns an empty File.
+func (t *Tracker) Resolved() File {
+	if t == nil {
+		return File{Version: FormatVersion}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f := t.resolved
+	if f.Agent != nil {
+		agent := *f.Agent
+		f.Agent = &agent
+	}
+	if f.Busybox != nil {
+		busybox := *f.Busybox
+		f.Busybox = &busybox
+	}
+	f.Images = append([]Image(nil), f.Images...)
+	f.Downloads = append([]Download(nil), f.Downloads...)
+	f.Repositories = append([]Repository(nil), f.Repositories...)
+	return f
+}
+
+// Save writes the resolved inputs to the lock file. It does nothing in locked
+// mode or when the file content would not change.
+func (t *Tracker) Save() error {
+	if t == nil || t.locked {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sort.Slice(t.resolved.Images, func(i, j int) bool {
+		a, b := t.resolved.Images[i], t.resolved.Images[j]
+		if a.Role != b.Role {
+			return a.Role < b.Role
+		}
+		return a.Ref < b.Ref
+	})
+	sort.Slice(t.resolved.Downloads, func(i, j int) bool {
+		return t.resolved.Downloads[i].URL < t.resolved.Downloads[j].URL
+	})
+	sort.Slice(t.resolved.Repositories, func(i, j int) bool {
+		a, b := t.resolved.Repositories[i], t.resolved.Repositories[j]
+		if a.URL != b.URL {
+			return a.URL < b.URL
+		}
+		return a.Ref < b.Ref
+	})
+	data, err := t.resolved.Encode()
+	if err != nil {
+		return err
+	}
+	if existing, err := os.ReadFile(t.path); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	if err := os.WriteFile(t.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", t.path, err)
+	}
+	return nil
+}
+
+func findImage(images []Image, role, ref string) (Image, bool) {
+	for _, img := range images {
+		if img.Role == role && img.Ref == ref {
+			return img, true
+		}
+	}
+	return Image{}, false
+}
+
+func findRepository(repos []Repository, url, ref string) (Repository, bool) {
+	for _, r := range repos {
+		if r.URL == url && r.Ref == ref {
+			return r, true
+		}
+	}
+	return Repository{}, false
+}
+
+func describeAgent(a Agent) string {
+	if a.Version != "" {
+		return a.SourceStrategy + " " + a.Version
+	}
+	return a.SourceStrategy
+}
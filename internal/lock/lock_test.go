@@ -0,0 +1,212 @@
+package lock
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testAgent = Agent{
+	SourceStrategy: "release",
+	Version:        "v0.4.2",
+	URL:            "https://github.com/volantvm/volant/releases/download/v0.4.2/kestrel",
+	Digest:         "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+}
+
+// TestTracker_SaveAndLoad tests writing a lock file and reading it back.
+func TestTracker_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+
+	tracker, err := Open(path, false)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := tracker.RecordAgent(testAgent); err != nil {
+		t.Fatalf("RecordAgent failed: %v", err)
+	}
+	if err := tracker.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if f.Agent == nil || *f.Agent != testAgent {
+		t.Errorf("Expected agent %+v, got %+v", testAgent, f.Agent)
+	}
+}
+
+// TestTracker_Locked tests that locked mode rejects differing resolutions.
+func TestTracker_Locked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	if _, err := Open(path, true); err == nil {
+		t.Fatal("Expected error for --locked without a lock file")
+	}
+
+	tracker, _ := Open(path, false)
+	tracker.RecordAgent(testAgent)
+	if err := tracker.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	before, _ := os.ReadFile(path)
+
+	locked, err := Open(path, true)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := locked.RecordAgent(testAgent); err != nil {
+		t.Errorf("Expected matching agent to pass, got %v", err)
+	}
+
+	changed := testAgent
+	changed.Version = "v0.5.0"
+	changed.Digest = "sha256:60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752"
+	err = locked.RecordAgent(changed)
+	if err == nil {
+		t.Fatal("Expected error for a differing agent digest")
+	}
+	if !strings.Contains(err.Error(), changed.Digest) {
+		t.Errorf("Error should mention the resolved digest, got: %v", err)
+	}
+
+	// Locked builds never rewrite the lock file
+	if err := locked.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	after, _ := os.ReadFile(path)
+	if string(before) != string(after) {
+		t.Errorf("Expected lock file to be left untouched in locked mode")
+	}
+}
+
+// TestTracker_Nil tests that a nil tracker is a no-op.
+func TestTracker_Nil(t *testing.T) {
+	var tracker *Tracker
+	if err := tracker.RecordAgent(testAgent); err != nil {
+		t.Errorf("Expected nil tracker to accept agent, got %v", err)
+	}
+	if err := tracker.Save(); err != nil {
+		t.Errorf("Expected nil tracker save to succeed, got %v", err)
+	}
+	if tracker.Locked() {
+		t.Errorf("Expected nil tracker to be unlocked")
+	}
+}
+
+// TestTracker_Images tests recording and checking image digests.
+func TestTracker_Images(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	source := Image{Role: RoleSource, Ref: "nginx:alpine", Digest: "sha256:aaaa"}
+	layer := Image{Role: RoleLayer, Ref: "busybox:musl", Digest: "sha256:bbbb"}
+	busybox := Download{URL: "https://busybox.net/busybox", Digest: "sha256:cccc"}
+
+	tracker, _ := Open(path, false)
+	for _, img := range []Image{layer, source, source} {
+		if err := tracker.RecordImage(img); err != nil {
+			t.Fatalf("RecordImage failed: %v", err)
+		}
+	}
+	tracker.RecordBusybox(busybox)
+	if err := tracker.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(f.Images) != 2 || f.Images[0] != layer || f.Images[1] != source {
+		t.Errorf("Expected sorted, deduplicated images, got %+v", f.Images)
+	}
+	if f.Busybox == nil || *f.Busybox != busybox {
+		t.Errorf("Expected busybox %+v, got %+v", busybox, f.Busybox)
+	}
+
+	locked, err := Open(path, true)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if digest, ok := locked.LockedImage(RoleSource, source.Ref); !ok || digest != source.Digest {
+		t.Errorf("Expected the locked digest %s, got %q", source.Digest, digest)
+	}
+	if _, ok := tracker.LockedImage(RoleSource, source.Ref); ok {
+		t.Errorf("Expected no locked digest outside locked mode")
+	}
+	if err := locked.RecordImage(source); err != nil {
+		t.Errorf("Expected matching image to pass, got %v", err)
+	}
+	moved := source
+	moved.Digest = "sha256:dddd"
+	if err := locked.RecordImage(moved); err == nil {
+		t.Errorf("Expected error for a moved tag")
+	}
+	if err := locked.RecordImage(Image{Role: RoleFrontend, Ref: "docker/dockerfile:1", Digest: "sha256:eeee"}); err == nil {
+		t.Errorf("Expected error for an image missing from the lock file")
+	}
+	if err := locked.RecordBusybox(Download{URL: busybox.URL, Digest: "sha256:ffff"}); err == nil {
+		t.Errorf("Expected error for a differing busybox digest")
+	}
+}
+
+// TestTracker_Repositories tests locking git asset commits.
+func TestTracker_Repositories(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	repo := Repository{URL: "git+https://github.com/example/plugin.git", Ref: "v1.0.0", Commit: "0123456789abcdef0123456789abcdef01234567"}
+
+	tracker, err := Open(path, false)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := tracker.RecordRepository(repo); err != nil {
+		t.Fatalf("RecordRepository failed: %v", err)
+	}
+	if err := tracker.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	locked, err := Open(path, true)
+	if err != nil {
+		t.Fatalf("Open locked failed: %v", err)
+	}
+	if err := locked.RecordRepository(repo); err != nil {
+		t.Errorf("Expected matching commit to pass, got %v", err)
+	}
+	moved := repo
+	moved.Commit = "fedcba9876543210fedcba9876543210fedcba98"
+	if err := locked.RecordRepository(moved); err == nil {
+		t.Errorf("Expected error when the ref moved")
+	}
+	other := repo
+	other.Ref = "v2.0.0"
+	if err := locked.RecordRepository(other); err == nil {
+		t.Errorf("Expected error for unrecorded ref")
+	}
+}
+
+// TestTracker_Resolved tests that Resolved returns a copy of the recorded
+// inputs.
+func TestTracker_Resolved(t *testing.T) {
+	tracker, err := Open(filepath.Join(t.TempDir(), FileName), false)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	tracker.RecordAgent(testAgent)
+	tracker.RecordImage(Image{Role: RoleSource, Ref: "nginx:1.27", Digest: "sha256:aa"})
+
+	f := tracker.Resolved()
+	if f.Agent == nil || *f.Agent != testAgent || len(f.Images) != 1 {
+		t.Fatalf("Unexpected resolved inputs: %+v", f)
+	}
+	f.Agent.Version = "changed"
+	f.Images[0].Digest = "changed"
+	if again := tracker.Resolved(); again.Agent.Version != testAgent.Version || again.Images[0].Digest != "sha256:aa" {
+		t.Error("Expected Resolved to return a copy")
+	}
+
+	var nilTracker *Tracker
+	if f := nilTracker.Resolved(); f.Version != FormatVersion || f.Agent != nil {
+		t.Errorf("Unexpected resolved inputs of a nil tracker: %+v", f)
+	}
+}
@@ -0,0 +1,180 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Standard attribute keys, so that text and JSON logs from the CLI and the
+// daemon can be filtered the same way.
+const (
+	// KeyBuildID identifies one build across all of its log records.
+	KeyBuildID = "build_id"
+	// KeyStep names the build step a record was logged from.
+	KeyStep = "step"
+	// KeyStrategy is the build strategy, oci_rootfs or initramfs.
+	KeyStrategy = "strategy"
+	// KeyPlugin names the plugin of a record in multi-config builds.
+	KeyPlugin = "plugin"
+	// KeyTenant names the fledge serve tenant a build runs for.
+	KeyTenant = "tenant"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx whose records, when logged with the
+// *Context functions, carry args as attributes in addition to those already
+// attached to ctx.
+func NewContext(ctx context.Context, args ...any) context.Context {
+	attrs := append(attrsFrom(ctx), argsToAttrs(args)...)
+	return context.WithValue(ctx, contextKey{}, attrs)
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	// Copy so that derived contexts never share a backing array
+	return append([]slog.Attr(nil), attrs...)
+}
+
+// buildIDFrom returns the KeyBuildID attribute of ctx, if any.
+func buildIDFrom(ctx context.Context) string {
+	attrs := attrsFrom(ctx)
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if attrs[i].Key == KeyBuildID {
+			return attrs[i].Value.String()
+		}
+	}
+	return ""
+}
+
+func argsToAttrs(args []any) []slog.Attr {
+	var r slog.Record
+	r.Add(args...)
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return attrs
+}
+
+// contextHandler adds the attributes attached to a record's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs := attrsFrom(ctx); len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Entry is a log record passed to the functions registered with
+// OnBuildLog.
+type Entry struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	// Attrs are the attributes of the record's context followed by its own.
+	Attrs []slog.Attr
+}
+
+var (
+	logHooksMu    sync.Mutex
+	logHooks      = map[int]logHook{}
+	nextLogHookID int
+)
+
+type logHook struct {
+	buildID string
+	fn      func(Entry)
+}
+
+// OnBuildLog registers fn to be called with every record logged through the
+// *Context functions with the build ID of ctx, whatever the logger's level
+// and whether or not it is initialized, and returns a function that
+// unregisters it. ctx must carry a KeyBuildID attribute, and fn must not
+// log.
+func OnBuildLog(ctx context.Context, fn func(Entry)) func() {
+	logHooksMu.Lock()
+	defer logHooksMu.Unlock()
+	id := nextLogHookID
+	nextLogHookID++
+	logHooks[id] = logHook{buildID: buildIDFrom(ctx), fn: fn}
+	return func() {
+		logHooksMu.Lock()
+		defer logHooksMu.Unlock()
+		delete(logHooks, id)
+	}
+}
+
+// runLogHooks passes a record to the OnBuildLog functions of its build.
+func runLogHooks(ctx context.Context, level slog.Level, msg string, args []any) {
+	logHooksMu.Lock()
+	defer logHooksMu.Unlock()
+	if len(logHooks) == 0 {
+		return
+	}
+	buildID := buildIDFrom(ctx)
+	if buildID == "" {
+		return
+	}
+	var entry *Entry
+	for _, hook := range logHooks {
+		if hook.buildID != buildID {
+			continue
+		}
+		if entry == nil {
+			entry = &Entry{Time: time.Now(), Level: level, Message: msg, Attrs: append(attrsFrom(ctx), argsToAttrs(args)...)}
+		}
+		hook.fn(*entry)
+	}
+}
+
+// InfoContext logs an informational message with the attributes of ctx.
+func InfoContext(ctx context.Context, msg string, args ...any) {
+	if Logger != nil {
+		Logger.InfoContext(ctx, msg, args...)
+	}
+	runLogHooks(ctx, slog.LevelInfo, msg, args)
+}
+
+// DebugContext logs a debug message with the attributes of ctx.
+func DebugContext(ctx context.Context, msg string, args ...any) {
+	if Logger != nil {
+		Logger.DebugContext(ctx, msg, args...)
+	}
+	runLogHooks(ctx, slog.LevelDebug, msg, args)
+}
+
+// WarnContext logs a warning message with the attributes of ctx.
+func WarnContext(ctx context.Context, msg string, args ...any) {
+	if Logger != nil {
+		Logger.WarnContext(ctx, msg, args...)
+	}
+	runLogHooks(ctx, slog.LevelWarn, msg, args)
+	runWarnHooks(ctx, msg, args)
+}
+
+// ErrorContext logs an error message with the attributes of ctx.
+func ErrorContext(ctx context.Context, msg string, args ...any) {
+	if Logger != nil {
+		Logger.ErrorContext(ctx, msg, args...)
+	}
+	runLogHooks(ctx, slog.LevelError, msg, args)
+}
@@ -0,0 +1,251 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Defaults for log files.
+const (
+	// DefaultMaxFileSize is the size at which a log file is rotated.
+	DefaultMaxFileSize = 100 << 20
+	// DefaultMaxBackups is how many rotated files (<path>.1 being the newest)
+	// are kept.
+	DefaultMaxBackups = 3
+)
+
+// Log formats, for the console and log files.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// FileOptions configures the log file written alongside the console.
+type FileOptions struct {
+	Path string
+	// Format is FormatText (default) or FormatJSON.
+	Format string
+	// MaxSize rotates the file once it would grow beyond this many bytes;
+	// zero means DefaultMaxFileSize.
+	MaxSize int64
+	// MaxBackups is how many rotated files are kept; zero means
+	// DefaultMaxBackups.
+	MaxBackups int
+}
+
+var (
+	fileMu      sync.Mutex
+	file        *rotatingFile
+	fileHandler slog.Handler
+	console     slog.Handler
+)
+
+// SetFile tees every log record, debug messages included, into a rotated
+// file so that long builds and the daemon leave logs to attach to bug
+// reports. It replaces any earlier log file.
+func SetFile(opts FileOptions) error {
+	if opts.Path == "" {
+		return fmt.Errorf("log file path is empty")
+	}
+	if err := checkFormat(opts.Format); err != nil {
+		return err
+	}
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFileSize
+	}
+	backups := opts.MaxBackups
+	if backups <= 0 {
+		backups = DefaultMaxBackups
+	}
+
+	f, err := openRotatingFile(opts.Path, maxSize, backups)
+	if err != nil {
+		return err
+	}
+	h := newHandler(f, opts.Format, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+	fileMu.Lock()
+	old := file
+	file, fileHandler = f, h
+	fileMu.Unlock()
+	rebuild()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// CloseFile stops writing to the log file, if any.
+func CloseFile() error {
+	fileMu.Lock()
+	f := file
+	file, fileHandler = nil, nil
+	fileMu.Unlock()
+	rebuild()
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
+
+// rebuild points Logger at the console handler and the file handler, if set.
+func rebuild() {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	var handlers []slog.Handler
+	if console != nil {
+		handlers = append(handlers, console)
+	}
+	if fileHandler != nil {
+		handlers = append(handlers, fileHandler)
+	}
+	switch len(handlers) {
+	case 0:
+		Logger = nil
+		return
+	case 1:
+		Logger = slog.New(contextHandler{handlers[0]})
+	default:
+		Logger = slog.New(contextHandler{teeHandler(handlers)})
+	}
+	slog.SetDefault(Logger)
+}
+
+// checkFormat validates a log format; empty means FormatText.
+func checkFormat(format string) error {
+	switch format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q (expected %s or %s)", format, FormatText, FormatJSON)
+}
+
+// newHandler returns a slog handler writing format to w.
+func newHandler(w io.Writer, format string, opts *slog.HandlerOptions) slog.Handler {
+	if format == FormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// teeHandler passes each record to every handler that accepts its level.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// rotatingFile is an append-only file that is renamed to <path>.1 once it
+// reaches maxSize, shifting older backups up and dropping the oldest.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, io.ErrClosedPipe
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to <path>.1 and starts a new one.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,148 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSetFile tests that records reach both the console and the log file, debug included.
+func TestSetFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "fledge.log")
+	InitLogger(false, true)
+	if err := SetFile(FileOptions{Path: path, Format: FormatJSON}); err != nil {
+		t.Fatalf("SetFile failed: %v", err)
+	}
+	Debug("debug detail", "step", "unpack")
+	Error("step failed", "step", "unpack")
+	if err := CloseFile(); err != nil {
+		t.Fatalf("CloseFile failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"msg":"debug detail"`) || !strings.Contains(lines[1], `"level":"ERROR"`) {
+		t.Errorf("Unexpected log file contents:\n%s", data)
+	}
+}
+
+// TestRotatingFile tests rotation into numbered backups and dropping the oldest.
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fledge.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	r.Close()
+
+	for file, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if data, _ := os.ReadFile(file); string(data) != want {
+			t.Errorf("Expected %s to hold %q, got %q", filepath.Base(file), want, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only 2 backups to be kept")
+	}
+}
+
+// TestNewContext tests that context attributes are added to records, and
+// that derived contexts keep their parents' attributes.
+func TestNewContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fledge.log")
+	if err := InitLoggerFormat(false, true, FormatJSON); err != nil {
+		t.Fatalf("InitLoggerFormat failed: %v", err)
+	}
+	if err := SetFile(FileOptions{Path: path, Format: FormatJSON}); err != nil {
+		t.Fatalf("SetFile failed: %v", err)
+	}
+	ctx := NewContext(context.Background(), KeyBuildID, "abc123", KeyStrategy, "initramfs")
+	DebugContext(NewContext(ctx, KeyStep, "Unpack"), "unpacking")
+	DebugContext(ctx, "done")
+	CloseFile()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got:\n%s", data)
+	}
+	for _, want := range []string{`"build_id":"abc123"`, `"strategy":"initramfs"`, `"step":"Unpack"`} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("Expected %s in %s", want, lines[0])
+		}
+	}
+	if strings.Contains(lines[1], `"step"`) || !strings.Contains(lines[1], `"build_id":"abc123"`) {
+		t.Errorf("Expected only the build attributes in %s", lines[1])
+	}
+	if err := InitLoggerFormat(false, false, "xml"); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
+
+// TestOnBuildWarn tests that build warning hooks only see the warnings of
+// their own build and those logged without a build.
+func TestOnBuildWarn(t *testing.T) {
+	a := NewContext(context.Background(), KeyBuildID, "a", KeyPlugin, "nginx")
+	b := NewContext(context.Background(), KeyBuildID, "b")
+	var got, all []string
+	stopA := OnBuildWarn(a, func(msg string, args []any) { got = append(got, msg) })
+	defer stopA()
+	stopAll := OnWarn(func(msg string, args []any) { all = append(all, msg) })
+	defer stopAll()
+
+	WarnContext(NewContext(a, KeyStep, "Unpack"), "from a")
+	WarnContext(b, "from b")
+	Warn("from process")
+
+	if strings.Join(got, ",") != "from a,from process" {
+		t.Errorf("OnBuildWarn saw %v", got)
+	}
+	if len(all) != 3 {
+		t.Errorf("OnWarn saw %v", all)
+	}
+}
+
+// TestOnBuildLog tests that build log hooks see every record of their own
+// build, with the context's attributes, and nothing else.
+func TestOnBuildLog(t *testing.T) {
+	a := NewContext(context.Background(), KeyBuildID, "a")
+	var got []Entry
+	stop := OnBuildLog(a, func(e Entry) { got = append(got, e) })
+
+	DebugContext(NewContext(a, KeyStep, "Unpack"), "unpacking", "layers", 3)
+	ErrorContext(a, "failed")
+	InfoContext(NewContext(context.Background(), KeyBuildID, "b"), "from b")
+	Info("from process")
+	stop()
+	InfoContext(a, "after stop")
+
+	if len(got) != 2 {
+		t.Fatalf("OnBuildLog saw %d records, want 2: %v", len(got), got)
+	}
+	if got[0].Level != slog.LevelDebug || got[0].Message != "unpacking" {
+		t.Errorf("first record = %v", got[0])
+	}
+	var attrs []string
+	for _, a := range got[0].Attrs {
+		attrs = append(attrs, a.String())
+	}
+	if want := "build_id=a,step=Unpack,layers=3"; strings.Join(attrs, ",") != want {
+		t.Errorf("attrs = %v, want %s", attrs, want)
+	}
+	if got[1].Level != slog.LevelError {
+		t.Errorf("second record level = %v", got[1].Level)
+	}
+}
@@ -2,18 +2,66 @@
 package logging
 
 import (
+	"context"
 	"io"
 	"log/slog"
 	"os"
+	"sync"
 )
 
 var (
 	// Logger is the global structured logger instance.
 	Logger *slog.Logger
+
+	warnHooksMu sync.Mutex
+	warnHooks   = map[int]warnHook{}
+	nextHookID  int
 )
 
-// InitLogger initializes the global logger with the specified verbosity.
+// warnHook is a function registered with OnWarn or OnBuildWarn.
+type warnHook struct {
+	buildID string
+	fn      func(msg string, args []any)
+}
+
+// OnWarn registers fn to be called with every warning, whether or not the
+// logger is initialized, and returns a function that unregisters it.
+func OnWarn(fn func(msg string, args []any)) func() {
+	return addWarnHook(warnHook{fn: fn})
+}
+
+// OnBuildWarn is like OnWarn, but skips warnings logged with a context
+// whose build ID differs from that of ctx, so that concurrent builds in one
+// process each see only their own.
+func OnBuildWarn(ctx context.Context, fn func(msg string, args []any)) func() {
+	return addWarnHook(warnHook{buildID: buildIDFrom(ctx), fn: fn})
+}
+
+func addWarnHook(hook warnHook) func() {
+	warnHooksMu.Lock()
+	defer warnHooksMu.Unlock()
+	id := nextHookID
+	nextHookID++
+	warnHooks[id] = hook
+	return func() {
+		warnHooksMu.Lock()
+		defer warnHooksMu.Unlock()
+		delete(warnHooks, id)
+	}
+}
+
+// InitLogger initializes the global logger with the specified verbosity,
+// writing text to the console.
 func InitLogger(verbose bool, quiet bool) {
+	_ = InitLoggerFormat(verbose, quiet, FormatText)
+}
+
+// InitLoggerFormat initializes the global logger with the specified
+// verbosity, writing to the console in format (FormatText or FormatJSON).
+func InitLoggerFormat(verbose bool, quiet bool, format string) error {
+	if err := checkFormat(format); err != nil {
+		return err
+	}
 	var level slog.Level
 	var output io.Writer = os.Stdout
 
@@ -29,9 +77,21 @@ func InitLogger(verbose bool, quiet bool) {
 		Level: level,
 	}
 
-	handler := slog.NewTextHandler(output, opts)
-	Logger = slog.New(handler)
-	slog.SetDefault(Logger)
+	fileMu.Lock()
+	console = newHandler(output, format, opts)
+	fileMu.Unlock()
+	rebuild()
+	return nil
+}
+
+// SetHandler sends console records to h instead, e.g. to the logger of a
+// program embedding fledge; nil discards them. A log file set with SetFile
+// keeps receiving records.
+func SetHandler(h slog.Handler) {
+	fileMu.Lock()
+	console = h
+	fileMu.Unlock()
+	rebuild()
 }
 
 // Info logs an informational message.
@@ -53,6 +113,21 @@ func Warn(msg string, args ...any) {
 	if Logger != nil {
 		Logger.Warn(msg, args...)
 	}
+	runWarnHooks(nil, msg, args)
+}
+
+// runWarnHooks calls the functions registered with OnWarn and, unless the
+// warning was logged by another build, OnBuildWarn.
+func runWarnHooks(ctx context.Context, msg string, args []any) {
+	buildID := buildIDFrom(ctx)
+	warnHooksMu.Lock()
+	defer warnHooksMu.Unlock()
+	for _, hook := range warnHooks {
+		if hook.buildID != "" && buildID != "" && hook.buildID != buildID {
+			continue
+		}
+		hook.fn(msg, args)
+	}
 }
 
 // Error logs an error message.
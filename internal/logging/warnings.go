@@ -0,0 +1,50 @@
+package logging
+
+import "context"
+
+// KeyWarning classifies a warning, for the warning summary of a build and
+// for fledge build --strict, which fails builds that logged warnings of
+// selected classes.
+const KeyWarning = "warning"
+
+// Warning classes. A warning logged without a class is WarnOther.
+const (
+	// WarnKernelModules: kernel modules could not be installed into the
+	// artifact, so the guest kernel must have them built in.
+	WarnKernelModules = "kernel-modules"
+	// WarnSymlinks: links, such as busybox applets, could not be created.
+	WarnSymlinks = "symlinks"
+	// WarnLibraries: shared libraries that mapped executables need are
+	// missing from the artifact.
+	WarnLibraries = "libraries"
+	// WarnVerify: the artifact could not be verified.
+	WarnVerify = "verify"
+	// WarnSizeBudget: the artifact is over its [limits] budget.
+	WarnSizeBudget = "size-budget"
+	// WarnCleanup: a mount, loop device, network or temporary file of the
+	// build could not be released.
+	WarnCleanup = "cleanup"
+	// WarnOther is every other warning, such as a retried download.
+	WarnOther = "other"
+)
+
+// WarningClasses are the warning classes, in the order summaries list them.
+var WarningClasses = []string{WarnKernelModules, WarnSymlinks, WarnLibraries, WarnVerify, WarnSizeBudget, WarnCleanup, WarnOther}
+
+// WarnClassContext logs a warning of class with the attributes of ctx.
+func WarnClassContext(ctx context.Context, class, msg string, args ...any) {
+	WarnContext(ctx, msg, append([]any{KeyWarning, class}, args...)...)
+}
+
+// WarningClass returns the class of a warning logged with args, the
+// logger's alternating key/value pairs.
+func WarningClass(args []any) string {
+	for i := 0; i+1 < len(args); i += 2 {
+		if key, ok := args[i].(string); ok && key == KeyWarning {
+			if class, ok := args[i+1].(string); ok {
+				return class
+			}
+		}
+	}
+	return WarnOther
+}
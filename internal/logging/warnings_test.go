@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"context"
+	"testing"
+)
+
+// TestWarnClassContext tests that warning hooks see the class of warnings
+// logged with one, and WarnOther for the rest.
+func TestWarnClassContext(t *testing.T) {
+	InitLogger(false, true)
+	ctx := NewContext(context.Background(), KeyBuildID, "b1")
+	var classes []string
+	stop := OnBuildWarn(ctx, func(msg string, args []any) {
+		classes = append(classes, WarningClass(args))
+	})
+	defer stop()
+
+	WarnClassContext(ctx, WarnSymlinks, "Failed to create symlink", "applet", "ls")
+	WarnContext(ctx, "Retrying after failure")
+	Warn("Failed to detach loop device", "device", "/dev/loop3", KeyWarning, WarnCleanup)
+
+	want := []string{WarnSymlinks, WarnOther, WarnCleanup}
+	if len(classes) != len(want) {
+		t.Fatalf("Expected classes %v, got %v", want, classes)
+	}
+	for i := range want {
+		if classes[i] != want[i] {
+			t.Errorf("Expected classes %v, got %v", want, classes)
+			break
+		}
+	}
+}
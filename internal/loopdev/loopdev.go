@@ -0,0 +1,20 @@
+// Package loopdev attaches image files to loop devices and mounts them through
+// the kernel interfaces directly, so builds do not depend on the util-linux
+// losetup, mount and umount binaries being installed.
+package loopdev
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoFreeDevice is returned when no loop device could be allocated.
+var ErrNoFreeDevice = errors.New("no free loop device")
+
+const (
+	// attempts bounds the retries for transient failures: another process
+	// claiming the free device first, or all devices being in use.
+	attempts = 5
+	// retryDelay is the base delay between attempts; it grows linearly.
+	retryDelay = 200 * time.Millisecond
+)
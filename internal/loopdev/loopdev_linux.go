@@ -0,0 +1,319 @@
+//go:build linux
+
+package loopdev
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	controlPath = "/dev/loop-control"
+	loopMajor   = 7
+)
+
+// Attach attaches the file at path to a free loop device and returns the
+// device path. Device nodes missing from a minimal /dev are created. Losing
+// the free device to a concurrent attach, or finding every device in use, is
+// retried a few times before giving up.
+func Attach(path string, readOnly bool) (string, error) {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	backing, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer backing.Close()
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay * time.Duration(attempt))
+		}
+		index, err := getFree()
+		if err != nil {
+			if !errors.Is(err, ErrNoFreeDevice) {
+				return "", err
+			}
+			lastErr = err
+			continue
+		}
+		device, err := configure(index, backing, readOnly)
+		if err == nil {
+			return device, nil
+		}
+		if !errors.Is(err, unix.EBUSY) {
+			return "", err
+		}
+		lastErr = err
+	}
+	return "", fmt.Errorf("failed to attach %s to a loop device after %d attempts: %w", path, attempts, lastErr)
+}
+
+// getFree asks the loop control device for the index of a free loop device,
+// which the kernel allocates if needed.
+func getFree() (int, error) {
+	ctl, err := os.OpenFile(controlPath, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s (is the loop module loaded? try modprobe loop): %w", controlPath, err)
+	}
+	defer ctl.Close()
+
+	index, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v (detach unused devices or raise the loop module's max_loop)", ErrNoFreeDevice, err)
+	}
+	return index, nil
+}
+
+// configure binds backing to /dev/loop<index>.
+func configure(index int, backing *os.File, readOnly bool) (string, error) {
+	device := fmt.Sprintf("/dev/loop%d", index)
+	if err := ensureNode(device, index); err != nil {
+		return "", err
+	}
+
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	dev, err := os.OpenFile(device, flags, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", device, err)
+	}
+	defer dev.Close()
+
+	info := unix.LoopInfo64{}
+	if readOnly {
+		info.Flags = unix.LO_FLAGS_READ_ONLY
+	}
+	copy(info.File_name[:len(info.File_name)-1], backing.Name())
+
+	fd := int(dev.Fd())
+	err = unix.IoctlLoopConfigure(fd, &unix.LoopConfig{Fd: uint32(backing.Fd()), Info: info})
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+		// LOOP_CONFIGURE needs Linux 5.8; fall back to the two-step setup.
+		err = setFD(fd, int(backing.Fd()), &info)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to attach %s: %w", device, err)
+	}
+	return device, nil
+}
+
+// setFD attaches backingFD with LOOP_SET_FD and applies info.
+func setFD(fd, backingFD int, info *unix.LoopInfo64) error {
+	if err := unix.IoctlSetInt(fd, unix.LOOP_SET_FD, backingFD); err != nil {
+		return err
+	}
+	if err := unix.IoctlLoopSetStatus64(fd, info); err != nil {
+		unix.IoctlSetInt(fd, unix.LOOP_CLR_FD, 0)
+		return err
+	}
+	return nil
+}
+
+// ensureNode creates the block device node for a loop device if /dev lacks
+// it, as is common in containers with a static /dev.
+func ensureNode(device string, index int) error {
+	if _, err := os.Stat(device); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	dev := int(unix.Mkdev(loopMajor, uint32(index)))
+	if err := unix.Mknod(device, unix.S_IFBLK|0o660, dev); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to create %s: %w", device, err)
+	}
+	return nil
+}
+
+// Detach releases a loop device. Devices that are no longer attached are not
+// an error; a device still busy right after an unmount is retried.
+func Detach(device string) error {
+	dev, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s: %w", device, err)
+	}
+	defer dev.Close()
+
+	for attempt := 0; ; attempt++ {
+		err = unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_CLR_FD, 0)
+		switch {
+		case err == nil, errors.Is(err, unix.ENXIO):
+			return nil
+		case errors.Is(err, unix.EBUSY) && attempt+1 < attempts:
+			time.Sleep(retryDelay * time.Duration(attempt+1))
+		default:
+			return fmt.Errorf("failed to detach %s: %w", device, err)
+		}
+	}
+}
+
+// BackedBy reports whether device is attached to the file at path, judged
+// by the device and inode the kernel reports for its backing file, or by
+// the name recorded at attach time when path no longer exists. A device that
+// is not attached is backed by nothing.
+func BackedBy(device, path string) (bool, error) {
+	dev, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open %s: %w", device, err)
+	}
+	defer dev.Close()
+
+	info, err := unix.IoctlLoopGetStatus64(int(dev.Fd()))
+	if errors.Is(err, unix.ENXIO) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query %s: %w", device, err)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err == nil {
+		return info.Device == st.Dev && info.Inode == st.Ino, nil
+	}
+	// The name is truncated to the size of File_name
+	name := unix.ByteSliceToString(info.File_name[:])
+	if len(name) == len(info.File_name)-1 {
+		return strings.HasPrefix(path, name), nil
+	}
+	return name == path, nil
+}
+
+// MountedFrom reports whether target is a mount point whose topmost mount
+// has source, such as the loop device it was mounted from.
+func MountedFrom(target, source string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("failed to list mounts: %w", err)
+	}
+	defer f.Close()
+	return mountSourceIs(f, target, source)
+}
+
+// mountSourceIs reports whether the last mount on target listed in the
+// mountinfo r has source.
+func mountSourceIs(r io.Reader, target, source string) (bool, error) {
+	target = filepath.Clean(target)
+	found, matches := false, false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// ID parent major:minor root mount-point options [optional...] - type source super-options
+		fields := strings.Fields(scanner.Text())
+		sep := slices.Index(fields, "-")
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		if unescapeMountinfo(fields[4]) != target {
+			continue
+		}
+		found = true
+		matches = unescapeMountinfo(fields[sep+2]) == source
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to list mounts: %w", err)
+	}
+	return found && matches, nil
+}
+
+// unescapeMountinfo decodes the octal escapes, such as \040 for a space,
+// that mountinfo uses in paths.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Mount mounts device on target. An empty fstype tries each block-device
+// filesystem the kernel supports, like mount(8) does.
+func Mount(device, target, fstype string, readOnly bool) error {
+	var flags uintptr
+	if readOnly {
+		flags = unix.MS_RDONLY
+	}
+	if fstype != "" {
+		if err := unix.Mount(device, target, fstype, flags, ""); err != nil {
+			return fmt.Errorf("failed to mount %s on %s as %s: %w", device, target, fstype, err)
+		}
+		return nil
+	}
+
+	types, err := blockFilesystems()
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		err := unix.Mount(device, target, t, flags, "")
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENODEV) {
+			return fmt.Errorf("failed to mount %s on %s as %s: %w", device, target, t, err)
+		}
+	}
+	return fmt.Errorf("failed to mount %s on %s: no supported filesystem recognised it", device, target)
+}
+
+// blockFilesystems lists the filesystems in /proc/filesystems that need a
+// block device.
+func blockFilesystems() ([]string, error) {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filesystems: %w", err)
+	}
+	defer f.Close()
+
+	var types []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 1 {
+			types = append(types, fields[0])
+		}
+	}
+	return types, scanner.Err()
+}
+
+// Unmount unmounts target. A target that is not mounted is not an error; a
+// busy target is retried briefly before giving up.
+func Unmount(target string) error {
+	for attempt := 0; ; attempt++ {
+		err := unix.Unmount(target, 0)
+		switch {
+		case err == nil, errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOENT):
+			return nil
+		case errors.Is(err, unix.EBUSY) && attempt+1 < attempts:
+			time.Sleep(retryDelay * time.Duration(attempt+1))
+		default:
+			return fmt.Errorf("failed to unmount %s: %w", target, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux
+
+package loopdev
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAttachDetach tests attaching an image to a loop device and releasing it.
+func TestAttachDetach(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := os.Stat(controlPath); err != nil {
+		t.Skip("loop devices not available")
+	}
+
+	image := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(image, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+
+	device, err := Attach(image, true)
+	if err != nil {
+		t.Skipf("Attach not permitted here: %v", err)
+	}
+	if ok, err := BackedBy(device, image); err != nil || !ok {
+		t.Errorf("Expected %s to be backed by %s, got %v, %v", device, image, ok, err)
+	}
+	if ok, _ := BackedBy(device, filepath.Dir(image)); ok {
+		t.Errorf("Expected %s not to be backed by another file", device)
+	}
+	if err := Detach(device); err != nil {
+		t.Fatalf("Detach failed: %v", err)
+	}
+	if err := Detach(device); err != nil {
+		t.Errorf("Expected detaching twice to succeed, got %v", err)
+	}
+}
+
+// TestUnmount_NotMounted tests that unmounting a plain directory is not an error.
+func TestUnmount_NotMounted(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if err := Unmount(t.TempDir()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+// TestBlockFilesystems tests that nodev filesystems are left out.
+func TestBlockFilesystems(t *testing.T) {
+	types, err := blockFilesystems()
+	if err != nil {
+		t.Skipf("cannot read /proc/filesystems: %v", err)
+	}
+	for _, fs := range types {
+		if fs == "proc" || fs == "tmpfs" {
+			t.Errorf("Expected %s to be excluded", fs)
+		}
+	}
+}
+
+// TestMountSourceIs tests matching the topmost mount of a target by its
+// source, with escaped paths.
+func TestMountSourceIs(t *testing.T) {
+	mountinfo := `22 1 0:21 / /proc rw,nosuid shared:5 - proc proc rw
+40 22 7:3 / /tmp/fledge\040mnt rw,relatime shared:9 - ext4 /dev/loop3 rw
+41 40 7:4 / /tmp/fledge\040mnt rw,relatime - ext4 /dev/loop4 rw
+42 22 7:5 / /tmp/other rw,relatime - squashfs /dev/loop5 ro
+`
+	for _, tc := range []struct {
+		target, source string
+		want           bool
+	}{
+		{"/tmp/fledge mnt", "/dev/loop4", true},
+		{"/tmp/fledge mnt/", "/dev/loop4", true},
+		// Shadowed by a later mount on the same target
+		{"/tmp/fledge mnt", "/dev/loop3", false},
+		{"/tmp/other", "/dev/loop3", false},
+		{"/tmp/missing", "/dev/loop5", false},
+	} {
+		got, err := mountSourceIs(strings.NewReader(mountinfo), tc.target, tc.source)
+		if err != nil {
+			t.Fatalf("mountSourceIs failed: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("mountSourceIs(%q, %q) = %v, want %v", tc.target, tc.source, got, tc.want)
+		}
+	}
+}
+
+// TestBackedBy_NotAttached tests that a device that does not exist backs
+// nothing.
+func TestBackedBy_NotAttached(t *testing.T) {
+	ok, err := BackedBy(filepath.Join(t.TempDir(), "loop9"), "/tmp/image.img")
+	if err != nil || ok {
+		t.Errorf("Expected no match and no error, got %v, %v", ok, err)
+	}
+}
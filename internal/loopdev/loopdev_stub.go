@@ -0,0 +1,37 @@
+//go:build !linux
+
+package loopdev
+
+import "errors"
+
+var errUnsupported = errors.New("loop devices require linux")
+
+// Attach is not supported on this platform.
+func Attach(path string, readOnly bool) (string, error) {
+	return "", errUnsupported
+}
+
+// Detach is not supported on this platform.
+func Detach(device string) error {
+	return errUnsupported
+}
+
+// BackedBy is not supported on this platform.
+func BackedBy(device, path string) (bool, error) {
+	return false, errUnsupported
+}
+
+// MountedFrom is not supported on this platform.
+func MountedFrom(target, source string) (bool, error) {
+	return false, errUnsupported
+}
+
+// Mount is not supported on this platform.
+func Mount(device, target, fstype string, readOnly bool) error {
+	return errUnsupported
+}
+
+// Unmount is not supported on this platform.
+func Unmount(target string) error {
+	return errUnsupported
+}
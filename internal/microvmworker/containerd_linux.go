@@ -0,0 +1,70 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/executor/resources"
+	"github.com/moby/buildkit/util/network/netproviders"
+	"github.com/moby/buildkit/version"
+	"github.com/moby/buildkit/worker"
+	"github.com/moby/buildkit/worker/base"
+	ctdworker "github.com/moby/buildkit/worker/containerd"
+	wlabel "github.com/moby/buildkit/worker/label"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// newContainerdWorker returns a BuildKit worker whose content store,
+// snapshotter and leases live in the containerd daemon at address, so its
+// layers and build cache are shared with other containerd clients. Steps
+// still run in w's executor. FLEDGE_CONTAINERD_NAMESPACE (default
+// "buildkit") and FLEDGE_CONTAINERD_SNAPSHOTTER (default "overlayfs") pick
+// where in containerd the data goes.
+func (w *Worker) newContainerdWorker(ctx context.Context, root, address string, hosts docker.RegistryHosts) (worker.Worker, error) {
+	ns := strings.TrimSpace(os.Getenv("FLEDGE_CONTAINERD_NAMESPACE"))
+	if ns == "" {
+		ns = "buildkit"
+	}
+	snapshotter := strings.TrimSpace(os.Getenv("FLEDGE_CONTAINERD_SNAPSHOTTER"))
+	if snapshotter == "" {
+		snapshotter = SnapshotterOverlay
+	}
+
+	opt, err := ctdworker.NewWorkerOpt(root, address, snapshotter, ns, os.Geteuid() != 0, nil, nil,
+		netproviders.Opt{Mode: "host"}, "", false, nil, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("microvmworker: containerd at %s: %w", address, err)
+	}
+
+	// NewWorkerOpt keeps its state in this subdirectory of root.
+	exe, err := w.newExecutor(filepath.Join(root, "containerd-"+snapshotter))
+	if err != nil {
+		return nil, err
+	}
+	rm, err := resources.NewMonitor()
+	if err != nil {
+		return nil, fmt.Errorf("microvmworker: resource monitor: %w", err)
+	}
+	opt.Executor = exe
+	opt.Labels[wlabel.Executor] = w.Executor
+	opt.RegistryHosts = hosts
+	opt.ResourceMonitor = rm
+	opt.BuildkitVersion = client.BuildkitVersion{Package: version.Package, Version: version.Version, Revision: version.Revision}
+	if err := os.MkdirAll(opt.MountPoolRoot, 0o755); err != nil {
+		return nil, fmt.Errorf("microvmworker: ensure mount pool: %w", err)
+	}
+
+	wk, err := base.NewWorker(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	logging.Info("Using containerd for build layers and cache", "address", address, "namespace", ns, "snapshotter", snapshotter)
+	return wk, nil
+}
@@ -0,0 +1,47 @@
+package microvmworker
+
+import (
+	"sync"
+	"time"
+)
+
+// VMEvent reports that a step VM booted or, with Exited set, exited.
+type VMEvent struct {
+	Name   string
+	PID    int
+	Time   time.Time
+	Exited bool
+	// Err is why the VM failed, for an exited VM.
+	Err error
+}
+
+var (
+	vmHooksMu  sync.Mutex
+	vmHooks    = map[int]func(VMEvent){}
+	nextVMHook int
+)
+
+// OnVM registers fn to be called as step VMs boot and exit, and returns a
+// function that unregisters it. fn must not block.
+func OnVM(fn func(VMEvent)) func() {
+	vmHooksMu.Lock()
+	defer vmHooksMu.Unlock()
+	id := nextVMHook
+	nextVMHook++
+	vmHooks[id] = fn
+	return func() {
+		vmHooksMu.Lock()
+		defer vmHooksMu.Unlock()
+		delete(vmHooks, id)
+	}
+}
+
+// notifyVM passes ev to the functions registered with OnVM.
+func notifyVM(ev VMEvent) {
+	ev.Time = time.Now()
+	vmHooksMu.Lock()
+	defer vmHooksMu.Unlock()
+	for _, fn := range vmHooks {
+		fn(ev)
+	}
+}
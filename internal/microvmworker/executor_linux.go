@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -25,9 +26,14 @@ import (
 	"github.com/volantvm/fledge/internal/builder"
 	"github.com/volantvm/fledge/internal/config"
 	ch "github.com/volantvm/fledge/internal/launcher"
+	"github.com/volantvm/fledge/internal/ledger"
 	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/loopdev"
+	"github.com/volantvm/fledge/internal/telemetry"
 	"github.com/volantvm/fledge/internal/utils"
+	"github.com/volantvm/fledge/internal/vsock"
 	volantorchestrator "github.com/volantvm/volant/pkg/orchestrator"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Executor runs BuildKit exec steps inside Cloud Hypervisor microVMs.
@@ -43,6 +49,13 @@ type Executor struct {
 	agentStubMu   sync.Mutex
 	agentStubPath string
 
+	guestAgentMu      sync.Mutex
+	guestAgentPath    string
+	guestAgentChecked bool
+
+	sessionsMu sync.Mutex
+	sessions   map[string]string // step id -> vsock socket of its VM
+
 	baseKernel string
 }
 
@@ -65,6 +78,7 @@ func NewExecutor(w *Worker) (*Executor, error) {
 		worker:     w,
 		workspace:  workspace,
 		supportDir: supportDir,
+		sessions:   make(map[string]string),
 		baseKernel: "init=/.fledge/init root=/dev/vda rootfstype=ext4 rw",
 	}, nil
 }
@@ -72,7 +86,10 @@ func NewExecutor(w *Worker) (*Executor, error) {
 // Run implements executor.Executor by staging the rootfs onto an ext4 disk image,
 // launching a Cloud Hypervisor microVM, executing the requested process, and
 // propagating filesystem changes back into the snapshot.
-func (e *Executor) Run(ctx context.Context, id string, root executor.Mount, mounts []executor.Mount, process executor.ProcessInfo, started chan<- struct{}) (resourcestypes.Recorder, error) {
+func (e *Executor) Run(ctx context.Context, id string, root executor.Mount, mounts []executor.Mount, process executor.ProcessInfo, started chan<- struct{}) (_ resourcestypes.Recorder, err error) {
+	ctx, span := telemetry.Start(ctx, "microvm.exec", attribute.String("fledge.command", strings.Join(process.Meta.Args, " ")))
+	defer func() { telemetry.End(span, err) }()
+
 	if e.worker == nil {
 		return nil, fmt.Errorf("microvm executor: worker not configured")
 	}
@@ -90,13 +107,14 @@ func (e *Executor) Run(ctx context.Context, id string, root executor.Mount, moun
 		return nil, err
 	}
 
-	imagePath, err := e.prepareDiskImage(ctx, rootDir)
-	if err != nil {
-		return nil, err
+	diskCtx, diskSpan := telemetry.Start(ctx, "microvm.disk.copy_in")
+	imagePath, err := e.prepareDiskImage(diskCtx, rootDir)
+	if err == nil {
+		defer os.Remove(imagePath)
+		err = e.populateDisk(diskCtx, imagePath, rootDir, process)
 	}
-	defer os.Remove(imagePath)
-
-	if err := e.populateDisk(ctx, imagePath, rootDir, process); err != nil {
+	telemetry.End(diskSpan, err)
+	if err != nil {
 		return nil, err
 	}
 
@@ -127,28 +145,84 @@ func (e *Executor) Run(ctx context.Context, id string, root executor.Mount, moun
 		ReadOnlyRoot:  false,
 		InitramfsPath: initramfsPath,
 		TapDevice:     netResources.tap,
+		VhostUserNet:  netResources.vhostUser,
 		MACAddress:    netResources.mac,
 		IPAddress:     netResources.ip,
-		Netmask:       e.worker.netmask,
+		Netmask:       netResources.netmask,
 		Gateway:       e.worker.gateway,
 	}
 
-	inst, err := e.worker.BootVM(ctx, vmName, spec)
+	ctl, err := e.openControl()
 	if err != nil {
-		return nil, fmt.Errorf("microvm executor: launch vm: %w", err)
+		return nil, err
+	}
+	if ctl != nil {
+		defer ctl.close()
+		spec.VsockCID = vsock.GuestCID
+		spec.VsockSocket = ctl.socket
+		e.trackSession(id, ctl.socket)
+		defer e.trackSession(id, "")
+		go ctl.serve(ctx, process)
 	}
 
+	bootCtx, bootSpan := telemetry.Start(ctx, "microvm.boot", attribute.String("fledge.vm", vmName))
+	var inst ch.Instance
+	err = e.worker.BootRetry.Do(bootCtx, "launch vm "+vmName, func(ctx context.Context) error {
+		var err error
+		inst, err = e.worker.BootVM(ctx, vmName, spec)
+		return err
+	})
+	telemetry.End(bootSpan, err)
+	if err != nil {
+		return nil, e.withConsole(vmName, fmt.Errorf("microvm executor: launch vm: %w", err))
+	}
+	vmPID := strconv.Itoa(inst.PID())
+	ledger.Record(ledger.KindVM, vmPID, e.worker.Launcher.Bin)
+	notifyVM(VMEvent{Name: vmName, PID: inst.PID()})
+
 	if started != nil {
 		close(started)
 	}
 
+	_, runSpan := telemetry.Start(ctx, "microvm.run", attribute.String("fledge.vm", vmName))
 	waitErr := inst.Wait(ctx)
+	telemetry.End(runSpan, waitErr)
+	if ctx.Err() != nil {
+		// The build was cancelled while the VM was still running.
+		stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := inst.Stop(stopCtx); err != nil {
+			logging.Debug("microvm executor: stop vm", "vm", vmName, "error", err)
+		}
+		cancel()
+	}
+	ledger.Release(ledger.KindVM, vmPID)
+	// The hypervisor's exit status is not the step's; that is collected
+	// from the guest below
+	if exitErr := (*exec.ExitError)(nil); errors.As(waitErr, &exitErr) {
+		notifyVM(VMEvent{Name: vmName, PID: inst.PID(), Exited: true})
+	} else {
+		notifyVM(VMEvent{Name: vmName, PID: inst.PID(), Exited: true, Err: waitErr})
+	}
 
-	stdoutBuf, stderrBuf, exitCode, err := e.collectResults(ctx, imagePath, rootDir, process)
+	collectCtx, collectSpan := telemetry.Start(ctx, "microvm.disk.copy_out")
+	stdoutBuf, stderrBuf, exitCode, err := e.collectResults(collectCtx, imagePath, rootDir, process)
+	telemetry.End(collectSpan, err)
 	if err != nil {
 		return nil, err
 	}
 
+	// Output the agent streamed has already been written; the files then
+	// only hold what the init script and agent printed themselves.
+	failedStderr := stderrBuf
+	if ctl != nil {
+		if code, err := ctl.wait(); err == nil {
+			exitCode = code
+			failedStderr = ctl.stderr.buf
+		} else if ctl.connected {
+			logging.Warn("microvm executor: control channel", "vm", vmName, "error", err)
+		}
+	}
+
 	if process.Stdout != nil && stdoutBuf != nil {
 		_, _ = io.Copy(process.Stdout, bytes.NewReader(stdoutBuf))
 	}
@@ -157,16 +231,16 @@ func (e *Executor) Run(ctx context.Context, id string, root executor.Mount, moun
 	}
 
 	// Log stderr if command failed
-	if exitCode != 0 && len(stderrBuf) > 0 {
-		logging.Error("microvm executor: command failed", "exit_code", exitCode, "stderr", string(stderrBuf))
+	if exitCode != 0 && len(failedStderr) > 0 {
+		logging.Error("microvm executor: command failed", "exit_code", exitCode, "stderr", string(failedStderr))
 	}
 
 	if exitCode < 0 {
 		logging.Warn("microvm executor: guest exit code not captured", "vm", vmName)
 		if waitErr != nil {
-			return nil, fmt.Errorf("microvm executor: vm wait: %w", waitErr)
+			return nil, e.withConsole(vmName, fmt.Errorf("microvm executor: vm wait: %w", waitErr))
 		}
-		return nil, fmt.Errorf("microvm executor: guest exit code missing (see previous warnings)")
+		return nil, e.withConsole(vmName, fmt.Errorf("microvm executor: guest exit code missing (see previous warnings)"))
 	}
 
 	if waitErr != nil {
@@ -174,20 +248,245 @@ func (e *Executor) Run(ctx context.Context, id string, root executor.Mount, moun
 		if errors.As(waitErr, &exitErr) && exitCode >= 0 {
 			// rely on exit code captured from guest
 		} else {
-			return nil, fmt.Errorf("microvm executor: vm wait: %w", waitErr)
+			return nil, e.withConsole(vmName, fmt.Errorf("microvm executor: vm wait: %w", waitErr))
 		}
 	}
 
 	if exitCode != 0 {
+		// The command failed rather than the VM; its stderr already tells the
+		// story, so the console is only shown with --verbose.
+		logging.Debug("microvm executor: vm console", "vm", vmName, "console", e.worker.Launcher.ConsoleTail(vmName, consoleTailBytes))
+		os.Remove(e.worker.Launcher.SerialLogPath(vmName))
 		return nil, &gatewayapi.ExitError{ExitCode: uint32(exitCode)}
 	}
 
+	os.Remove(e.worker.Launcher.SerialLogPath(vmName))
 	return nil, nil
 }
 
-// Exec is not supported for microVM executor; each Run creates an isolated VM.
+// consoleTailBytes bounds how much of a failed VM's serial console is
+// attached to its error.
+const consoleTailBytes = 8 << 10
+
+// consoleError attaches the end of a step VM's serial console to err, so
+// that boot and network failures inside the VM can be diagnosed from the
+// build error alone.
+type consoleError struct {
+	err  error
+	path string
+	tail string
+}
+
+func (e *consoleError) Error() string {
+	if e.tail == "" {
+		return fmt.Sprintf("%v (vm console log %s is empty)", e.err, e.path)
+	}
+	return fmt.Sprintf("%v\n--- vm console (last %s of %s) ---\n%s\n---", e.err, utils.FormatBytes(consoleTailBytes), e.path, e.tail)
+}
+
+func (e *consoleError) Unwrap() error { return e.err }
+
+// withConsole wraps err with the tail of vmName's serial console. The log
+// is kept for inspection.
+func (e *Executor) withConsole(vmName string, err error) error {
+	l := e.worker.Launcher
+	return &consoleError{err: err, path: l.SerialLogPath(vmName), tail: l.ConsoleTail(vmName, consoleTailBytes)}
+}
+
+// Exec runs process in the VM of the running step id through its vsock
+// control channel.
 func (e *Executor) Exec(ctx context.Context, id string, process executor.ProcessInfo) error {
-	return fmt.Errorf("microvm executor: Exec not supported")
+	e.sessionsMu.Lock()
+	socket := e.sessions[id]
+	e.sessionsMu.Unlock()
+	if socket == "" {
+		return fmt.Errorf("microvm executor: no running step %q with a control channel", id)
+	}
+
+	req := vsock.ExecRequest{Args: process.Meta.Args, Env: process.Meta.Env, Cwd: process.Meta.Cwd}
+	var stdin io.Reader
+	if process.Stdin != nil {
+		stdin = process.Stdin
+	}
+	code, err := vsock.Exec(ctx, socket, req, stdin, writerOrNil(process.Stdout), writerOrNil(process.Stderr))
+	if err != nil {
+		return fmt.Errorf("microvm executor: exec in %s: %w", id, err)
+	}
+	if code != 0 {
+		return &gatewayapi.ExitError{ExitCode: uint32(code)}
+	}
+	return nil
+}
+
+func (e *Executor) trackSession(id, socket string) {
+	e.sessionsMu.Lock()
+	defer e.sessionsMu.Unlock()
+	if socket == "" {
+		delete(e.sessions, id)
+		return
+	}
+	e.sessions[id] = socket
+}
+
+// controlChannel receives a step's output and exit code from the
+// fledge-agent in its VM as the command runs.
+type controlChannel struct {
+	dir    string
+	socket string
+	ln     net.Listener
+	done   chan struct{}
+
+	connected bool
+	exitCode  int
+	err       error
+	stderr    tailBuffer
+}
+
+// openControl listens for the guest agent of a new step VM, or returns nil
+// when no agent is available and the step reports through output files.
+func (e *Executor) openControl() (*controlChannel, error) {
+	if e.guestAgent() == "" {
+		return nil, nil
+	}
+	// Unix socket paths are limited to 108 bytes, so keep them out of the
+	// possibly deep runtime directory.
+	dir, err := os.MkdirTemp("", "fledge-vsock-")
+	if err != nil {
+		return nil, fmt.Errorf("microvm executor: create vsock dir: %w", err)
+	}
+	socket := filepath.Join(dir, "vm.sock")
+	ln, err := vsock.Listen(socket, vsock.RunPort)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("microvm executor: %w", err)
+	}
+	return &controlChannel{
+		dir:      dir,
+		socket:   socket,
+		ln:       ln,
+		done:     make(chan struct{}),
+		exitCode: -1,
+		stderr:   tailBuffer{max: 64 << 10},
+	}, nil
+}
+
+// serve attaches the step's stdio to the first guest connection.
+func (c *controlChannel) serve(ctx context.Context, process executor.ProcessInfo) {
+	defer close(c.done)
+	conn, err := c.ln.Accept()
+	if err != nil {
+		c.err = vsock.ErrNoExitCode
+		return
+	}
+	defer conn.Close()
+	c.connected = true
+
+	var stdin io.Reader
+	if process.Stdin != nil {
+		stdin = process.Stdin
+	}
+	stderr := io.Writer(&c.stderr)
+	if process.Stderr != nil {
+		stderr = io.MultiWriter(process.Stderr, &c.stderr)
+	}
+	c.exitCode, c.err = vsock.Attach(ctx, conn, stdin, writerOrNil(process.Stdout), stderr)
+}
+
+// wait returns the exit code the guest reported once its VM has exited.
+func (c *controlChannel) wait() (int, error) {
+	c.ln.Close()
+	<-c.done
+	return c.exitCode, c.err
+}
+
+func (c *controlChannel) close() {
+	c.ln.Close()
+	os.RemoveAll(c.dir)
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// writerOrNil avoids wrapping a nil stream in a non-nil interface.
+func writerOrNil(w io.WriteCloser) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return w
+}
+
+// guestAgent returns the static fledge-agent binary staged into step VMs,
+// or "" when none is installed.
+func (e *Executor) guestAgent() string {
+	e.guestAgentMu.Lock()
+	defer e.guestAgentMu.Unlock()
+	if !e.guestAgentChecked {
+		e.guestAgentChecked = true
+		if !e.worker.Launcher.HybridVsock() {
+			logging.Info("microvm executor: no vsock control channel with this hypervisor; step output is collected when each VM exits", "hypervisor", e.worker.Launcher.Hypervisor)
+			return ""
+		}
+		e.guestAgentPath = locateGuestAgent()
+		if e.guestAgentPath == "" {
+			logging.Info("microvm executor: fledge-agent not found; step output is collected when each VM exits", "hint", "build it with CGO_ENABLED=0 and install it next to fledge or set FLEDGE_GUEST_AGENT")
+		}
+	}
+	return e.guestAgentPath
+}
+
+// locateGuestAgent looks for a statically linked fledge-agent in
+// FLEDGE_GUEST_AGENT, next to the running executable, and in PATH.
+func locateGuestAgent() string {
+	var candidates []string
+	if envPath := strings.TrimSpace(os.Getenv("FLEDGE_GUEST_AGENT")); envPath != "" {
+		candidates = append(candidates, envPath)
+	}
+	if self, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(self), "fledge-agent"))
+	}
+	if path, err := exec.LookPath("fledge-agent"); err == nil {
+		candidates = append(candidates, path)
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if err := checkStaticBinary(candidate); err != nil {
+			logging.Warn("microvm executor: unusable fledge-agent", "path", candidate, "error", err)
+			continue
+		}
+		return candidate
+	}
+	return ""
+}
+
+// checkStaticBinary verifies that path is an ELF executable that needs no
+// dynamic loader, so it runs in any guest rootfs.
+func checkStaticBinary(path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("open ELF: %w", err)
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return fmt.Errorf("dynamically linked; build with CGO_ENABLED=0")
+		}
+	}
+	return nil
 }
 
 func (e *Executor) mountSnapshot(ctx context.Context, mnt executor.Mount) (string, func() error, error) {
@@ -285,7 +584,7 @@ func (e *Executor) populateDisk(ctx context.Context, imagePath, rootDir string,
 		if err := clearDir(mountPoint); err != nil {
 			return fmt.Errorf("clear mount: %w", err)
 		}
-		if err := copyTree(rootDir, mountPoint); err != nil {
+		if err := copyTree(ctx, rootDir, mountPoint); err != nil {
 			return fmt.Errorf("copy rootfs: %w", err)
 		}
 		return e.writeInitFiles(ctx, mountPoint, process)
@@ -318,7 +617,7 @@ func (e *Executor) collectResults(ctx context.Context, imagePath, rootDir string
 
 		_ = os.RemoveAll(ctrlDir)
 
-		if err := replaceDirContents(rootDir, mountPoint); err != nil {
+		if err := replaceDirContents(ctx, rootDir, mountPoint); err != nil {
 			return fmt.Errorf("sync rootfs: %w", err)
 		}
 		return nil
@@ -331,10 +630,11 @@ func (e *Executor) collectResults(ctx context.Context, imagePath, rootDir string
 }
 
 func (e *Executor) withDiskMount(ctx context.Context, imagePath string, fn func(mountPoint string) error) error {
-	loopDev, err := attachLoop(imagePath)
+	loopDev, err := loopdev.Attach(imagePath, false)
 	if err != nil {
-		return err
+		return fmt.Errorf("microvm executor: %w", err)
 	}
+	ledger.Record(ledger.KindLoop, loopDev, imagePath)
 	defer detachLoop(loopDev)
 
 	mountPoint, err := os.MkdirTemp(e.workspace, "mnt-*")
@@ -343,15 +643,16 @@ func (e *Executor) withDiskMount(ctx context.Context, imagePath string, fn func(
 	}
 	defer os.RemoveAll(mountPoint)
 
-	cmd := exec.CommandContext(ctx, "mount", loopDev, mountPoint)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("microvm executor: mount disk: %w output=%s", err, string(output))
+	if err := loopdev.Mount(loopDev, mountPoint, "ext4", false); err != nil {
+		return fmt.Errorf("microvm executor: mount disk: %w", err)
 	}
+	ledger.Record(ledger.KindMount, mountPoint, loopDev)
 	defer func() {
-		cmd := exec.Command("umount", mountPoint)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			logging.Warn("microvm executor: umount disk", "error", err, "output", string(output))
+		if err := loopdev.Unmount(mountPoint); err != nil {
+			logging.Warn("microvm executor: umount disk", "error", err, logging.KeyWarning, logging.WarnCleanup)
+			return
 		}
+		ledger.Release(ledger.KindMount, mountPoint)
 	}()
 
 	return fn(mountPoint)
@@ -368,7 +669,8 @@ func (e *Executor) writeInitFiles(ctx context.Context, mountPoint string, proces
 	}
 
 	initPath := filepath.Join(controlDir, "init")
-	script := buildInitScript(process)
+	process.Meta.Env = e.worker.stepEnv(process.Meta.Env)
+	script := buildInitScript(process, e.worker.Network.Proxy.Env())
 	if err := os.WriteFile(initPath, []byte(script), 0o755); err != nil {
 		return fmt.Errorf("write init script: %w", err)
 	}
@@ -459,6 +761,11 @@ func (e *Executor) installSupportBinaries(ctx context.Context, mountPoint, contr
 			return fmt.Errorf("microvm executor: link busybox %s: %w", applet, err)
 		}
 	}
+	if agent := e.guestAgent(); agent != "" {
+		if err := copyFile(agent, filepath.Join(binDir, "fledge-agent"), 0o755); err != nil {
+			return fmt.Errorf("microvm executor: stage fledge-agent: %w", err)
+		}
+	}
 	udhcpcScript := filepath.Join(binDir, "udhcpc-script")
 	if err := os.WriteFile(udhcpcScript, []byte(buildUDHCPCScript()), 0o755); err != nil {
 		return fmt.Errorf("microvm executor: write udhcpc script: %w", err)
@@ -522,7 +829,7 @@ func (e *Executor) buildInitramfs(ctx context.Context, vmName string) (string, f
 
 	cleanup := func() {
 		if err := os.Remove(outputPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-			logging.Warn("microvm executor: cleanup initramfs", "path", outputPath, "error", err)
+			logging.Warn("microvm executor: cleanup initramfs", "path", outputPath, "error", err, logging.KeyWarning, logging.WarnCleanup)
 		}
 	}
 
@@ -617,7 +924,7 @@ func (e *Executor) ensureBusybox(ctx context.Context) (string, error) {
 	}
 
 	logging.Info("microvm executor: downloading support busybox", "url", config.DefaultBusyboxURL)
-	tmpPath, err := utils.DownloadToTempFile(config.DefaultBusyboxURL, false)
+	tmpPath, err := utils.DownloadToTempFile(ctx, config.DefaultBusyboxURL, false)
 	if err != nil {
 		return "", fmt.Errorf("microvm executor: download busybox: %w (install busybox-static and ensure busybox is available locally for offline use)", err)
 	}
@@ -718,26 +1025,18 @@ func ensureSymlink(path, target string) error {
 	return os.Symlink(target, path)
 }
 
-func attachLoop(imagePath string) (string, error) {
-	cmd := exec.Command("losetup", "--find", "--show", imagePath)
-	out, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("microvm executor: losetup: %w", err)
-	}
-	return strings.TrimSpace(string(out)), nil
-}
-
 func detachLoop(device string) {
 	if device == "" {
 		return
 	}
-	cmd := exec.Command("losetup", "-d", device)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		logging.Warn("microvm executor: detach loop", "device", device, "error", err, "output", string(output))
+	if err := loopdev.Detach(device); err != nil {
+		logging.Warn("microvm executor: detach loop", "device", device, "error", err, logging.KeyWarning, logging.WarnCleanup)
+		return
 	}
+	ledger.Release(ledger.KindLoop, device)
 }
 
-func copyTree(src, dst string) error {
+func copyTree(ctx context.Context, src, dst string) error {
 	info, err := os.Lstat(src)
 	if err != nil {
 		return err
@@ -762,35 +1061,7 @@ func copyTree(src, dst string) error {
 		if err := clearDir(dst); err != nil {
 			return err
 		}
-
-		tarCmd := exec.Command("tar", "-C", src, "-cf", "-", ".")
-		untarCmd := exec.Command("tar", "-C", dst, "-xf", "-")
-
-		pipe, err := tarCmd.StdoutPipe()
-		if err != nil {
-			return err
-		}
-		untarCmd.Stdin = pipe
-
-		var stderr bytes.Buffer
-		tarCmd.Stderr = &stderr
-		untarCmd.Stderr = &stderr
-
-		if err := untarCmd.Start(); err != nil {
-			return err
-		}
-		if err := tarCmd.Start(); err != nil {
-			untarCmd.Wait()
-			return err
-		}
-		if err := tarCmd.Wait(); err != nil {
-			untarCmd.Wait()
-			return fmt.Errorf("tar copy: %w: %s", err, stderr.String())
-		}
-		if err := untarCmd.Wait(); err != nil {
-			return fmt.Errorf("tar extract: %w: %s", err, stderr.String())
-		}
-		return nil
+		return copyDir(ctx, src, dst)
 	}
 
 	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
@@ -822,6 +1093,11 @@ func copyFile(src, dst string, mode os.FileMode) error {
 	}
 	defer srcFile.Close()
 
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
 	tmpPath := dst + ".tmp"
 	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 		return err
@@ -830,7 +1106,12 @@ func copyFile(src, dst string, mode os.FileMode) error {
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
+	if isSparse(info) {
+		err = copySparse(dstFile, srcFile, info.Size())
+	} else {
+		_, err = io.Copy(dstFile, srcFile)
+	}
+	if err != nil {
 		dstFile.Close()
 		return err
 	}
@@ -843,7 +1124,7 @@ func copyFile(src, dst string, mode os.FileMode) error {
 	return nil
 }
 
-func replaceDirContents(dst, src string) error {
+func replaceDirContents(ctx context.Context, dst, src string) error {
 	dstEntries, err := os.ReadDir(dst)
 	if err != nil {
 		return err
@@ -861,7 +1142,7 @@ func replaceDirContents(dst, src string) error {
 	for _, entry := range srcEntries {
 		s := filepath.Join(src, entry.Name())
 		d := filepath.Join(dst, entry.Name())
-		if err := copyTree(s, d); err != nil {
+		if err := copyTree(ctx, s, d); err != nil {
 			return err
 		}
 	}
@@ -887,7 +1168,9 @@ func dirSize(path string) (int64, error) {
 	return size, err
 }
 
-func buildInitScript(process executor.ProcessInfo) string {
+// buildInitScript returns the guest init for process. baseEnv is exported
+// before the step's own environment, which may override it.
+func buildInitScript(process executor.ProcessInfo, baseEnv []string) string {
 	var buf strings.Builder
 	buf.WriteString("#!/.fledge/bin/busybox sh\n")
 	buf.WriteString("set -eu\n")
@@ -1090,6 +1373,29 @@ func buildInitScript(process executor.ProcessInfo) string {
 	buf.WriteString("\tlog_console \"microvm init: configured $iface with $ip/$prefix gateway ${gateway:-none}\"\n")
 	buf.WriteString("\treturn 0\n")
 	buf.WriteString("}\n")
+	buf.WriteString("configure_dhcp_network() {\n")
+	buf.WriteString("\tlocal candidates=\"$1\"\n")
+	buf.WriteString("\tfor iface in $candidates; do\n")
+	buf.WriteString("\t\t[ \"$iface\" = \"lo\" ] && continue\n")
+	buf.WriteString("\t\tif ! bring_iface_up \"$iface\"; then\n")
+	buf.WriteString("\t\t\tcontinue\n")
+	buf.WriteString("\t\tfi\n")
+	buf.WriteString("\t\twait_iface_ready \"$iface\" || true\n")
+	buf.WriteString("\t\tlog_console \"microvm init: requesting DHCP lease on $iface\"\n")
+	buf.WriteString("\t\tif /.fledge/bin/busybox udhcpc -i \"$iface\" -s /.fledge/bin/udhcpc-script -n -q -t 5 -T 2 >/dev/console 2>&1; then\n")
+	buf.WriteString("\t\t\tif [ ! -s /.fledge/resolv.conf ]; then\n")
+	buf.WriteString("\t\t\t\tprintf 'nameserver 1.1.1.1\\nnameserver 8.8.8.8\\n' > /.fledge/resolv.conf\n")
+	buf.WriteString("\t\t\t\tmkdir -p /etc\n")
+	buf.WriteString("\t\t\t\tcp /.fledge/resolv.conf /etc/resolv.conf >/dev/null 2>&1 || true\n")
+	buf.WriteString("\t\t\tfi\n")
+	buf.WriteString("\t\t\tlog_iface_state \"$iface\"\n")
+	buf.WriteString("\t\t\tlog_console \"microvm init: configured $iface via DHCP\"\n")
+	buf.WriteString("\t\t\treturn 0\n")
+	buf.WriteString("\t\tfi\n")
+	buf.WriteString("\t\tlog_console \"microvm init: no DHCP lease on $iface\"\n")
+	buf.WriteString("\tdone\n")
+	buf.WriteString("\treturn 1\n")
+	buf.WriteString("}\n")
 	buf.WriteString("mkdir -p /.fledge\n")
 	buf.WriteString("mount -t proc proc /proc 2>/dev/null || true\n")
 	buf.WriteString("mount -t sysfs sysfs /sys 2>/dev/null || true\n")
@@ -1103,9 +1409,18 @@ func buildInitScript(process executor.ProcessInfo) string {
 	buf.WriteString("\tinterfaces=\"eth0 ens3 enp0s1 tap0\"\n")
 	buf.WriteString("fi\n")
 	buf.WriteString("log_console \"microvm init: candidate interfaces: $interfaces\"\n")
-	buf.WriteString("if ! configure_static_network \"$interfaces\"; then\n")
-	buf.WriteString("\tlog_console \"microvm init: static configuration not applied\"\n")
-	buf.WriteString("fi\n")
+	buf.WriteString("case \" $(cat /proc/cmdline 2>/dev/null || true) \" in\n")
+	buf.WriteString("*\" fledge.net=dhcp \"*)\n")
+	buf.WriteString("\tif ! configure_dhcp_network \"$interfaces\"; then\n")
+	buf.WriteString("\t\tlog_console \"microvm init: DHCP configuration failed\"\n")
+	buf.WriteString("\tfi\n")
+	buf.WriteString("\t;;\n")
+	buf.WriteString("*)\n")
+	buf.WriteString("\tif ! configure_static_network \"$interfaces\"; then\n")
+	buf.WriteString("\t\tlog_console \"microvm init: static configuration not applied\"\n")
+	buf.WriteString("\tfi\n")
+	buf.WriteString("\t;;\n")
+	buf.WriteString("esac\n")
 	buf.WriteString("log_console \"microvm init: ip addr show\"\n")
 	buf.WriteString("if command -v ip >/dev/null 2>&1; then\n")
 	buf.WriteString("\tip addr show > /dev/console\n")
@@ -1128,7 +1443,7 @@ func buildInitScript(process executor.ProcessInfo) string {
 	buf.WriteString("exec 2> /.fledge/stderr\n")
 	buf.WriteString("export HOME=${HOME:-/root}\n")
 
-	for _, env := range process.Meta.Env {
+	for _, env := range append(baseEnv[:len(baseEnv):len(baseEnv)], process.Meta.Env...) {
 		key, val, found := strings.Cut(env, "=")
 		if !found {
 			continue
@@ -1165,7 +1480,11 @@ func buildInitScript(process executor.ProcessInfo) string {
 	buf.WriteString("esac\n")
 	buf.WriteString("fi\n")
 	buf.WriteString("log_console \"microvm init: executing command: $*\"\n")
+	buf.WriteString("if [ -x /.fledge/bin/fledge-agent ]; then\n")
+	buf.WriteString("/.fledge/bin/fledge-agent run -- \"$@\"\n")
+	buf.WriteString("else\n")
 	buf.WriteString("\"$@\"\n")
+	buf.WriteString("fi\n")
 	buf.WriteString("status=$?\n")
 	buf.WriteString("log_console \"microvm init: command exited with status $status\"\n")
 	buf.WriteString("set -e\n")
@@ -1221,61 +1540,55 @@ func sanitizeName(name string) string {
 
 type networkResources struct {
 	tap        string
+	vhostUser  string
 	mac        string
 	ip         string
+	netmask    string
 	kernelArgs string
 }
 
+// prepareNetworkResources attaches vmName to the network through the
+// worker's provider. The cleanup releases everything, also on error.
 func (e *Executor) prepareNetworkResources(ctx context.Context, vmName string) (*networkResources, func(), error) {
-	cleanup := func() {}
-	if e.worker == nil {
-		return nil, cleanup, fmt.Errorf("microvm executor: worker not configured")
-	}
-	if e.worker.network == nil {
-		return nil, cleanup, fmt.Errorf("microvm executor: network manager not configured")
-	}
-
-	alloc, err := e.worker.leaseIP(ctx)
-	if err != nil {
-		return nil, cleanup, err
+	if e.worker == nil || e.worker.NetProvider == nil {
+		return nil, func() {}, fmt.Errorf("microvm executor: network provider not configured")
 	}
-
-	releaseIP := func() {
-		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	p := e.worker.NetProvider
+	cleanup := func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if err := e.worker.releaseIP(releaseCtx, alloc.IPAddress); err != nil && !errors.Is(err, context.DeadlineExceeded) {
-			logging.Warn("microvm executor: release ip", "ip", alloc.IPAddress, "error", err)
+		if err := p.Cleanup(cleanupCtx, vmName); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			logging.Warn("microvm executor: cleanup network", "vm", vmName, "error", err, logging.KeyWarning, logging.WarnCleanup)
 		}
 	}
 
-	mac := volantorchestrator.DeriveMAC(vmName, alloc.IPAddress)
-	tapName, err := e.worker.network.PrepareTap(ctx, vmName, mac)
+	ip, err := p.LeaseIP(ctx, vmName)
 	if err != nil {
-		releaseIP()
-		return nil, cleanup, fmt.Errorf("microvm executor: prepare tap: %w", err)
+		cleanup()
+		return nil, func() {}, err
 	}
-
-	hostname := volantorchestrator.SanitizeHostname(vmName)
-	extra := strings.TrimSpace(e.baseKernel)
-	kernel := volantorchestrator.BuildKernelCmdline(alloc.IPAddress, e.worker.gateway, e.worker.netmask, hostname, extra)
-	kernel = strings.TrimSpace(kernel)
-
-	cleanup = func() {
-		cleanupCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := e.worker.network.CleanupTap(cleanupCtx, tapName); err != nil && !errors.Is(err, context.DeadlineExceeded) {
-			logging.Warn("microvm executor: cleanup tap", "tap", tapName, "error", err)
-		}
-		releaseIP()
+	var mac string
+	if ip != "" {
+		mac = volantorchestrator.DeriveMAC(vmName, ip)
+	} else if mac, err = ch.RandomMAC(); err != nil {
+		cleanup()
+		return nil, func() {}, fmt.Errorf("microvm executor: generate mac: %w", err)
+	}
+	link, err := p.PrepareTap(ctx, vmName, mac)
+	if err != nil {
+		cleanup()
+		return nil, func() {}, err
 	}
 
-	logging.Info("microvm executor: prepared network resources", "vm", vmName, "tap", tapName, "ip", alloc.IPAddress, "mac", mac)
+	logging.Info("microvm executor: prepared network resources", "vm", vmName, "tap", link.Tap, "vhost_user", link.VhostUser, "ip", ip, "mac", mac)
 
 	return &networkResources{
-		tap:        tapName,
+		tap:        link.Tap,
+		vhostUser:  link.VhostUser,
 		mac:        mac,
-		ip:         alloc.IPAddress,
-		kernelArgs: kernel,
+		ip:         ip,
+		netmask:    link.Netmask,
+		kernelArgs: p.KernelArgs(strings.TrimSpace(e.baseKernel), vmName, ip),
 	}, cleanup, nil
 }
 
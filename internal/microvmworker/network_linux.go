@@ -0,0 +1,404 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/ledger"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/vmnet"
+	volantconfig "github.com/volantvm/volant/pkg/config"
+	volantsqlite "github.com/volantvm/volant/pkg/db/sqlite"
+	volantnetwork "github.com/volantvm/volant/pkg/network"
+	volantorchestrator "github.com/volantvm/volant/pkg/orchestrator"
+)
+
+// NetworkProvider attaches step VMs to a network. For each VM the executor
+// calls LeaseIP, PrepareTap and KernelArgs in turn, and Cleanup once the VM
+// is gone, including after a failed LeaseIP or PrepareTap.
+type NetworkProvider interface {
+	// LeaseIP reserves a guest address, or returns "" when the guest
+	// configures itself over DHCP or has no network.
+	LeaseIP(ctx context.Context, vmName string) (string, error)
+	// PrepareTap creates the host side of the guest interface with mac.
+	PrepareTap(ctx context.Context, vmName, mac string) (NetworkLink, error)
+	// KernelArgs returns the guest kernel command line: base plus whatever
+	// the guest init needs to configure ip.
+	KernelArgs(base, vmName, ip string) string
+	// Cleanup releases what LeaseIP and PrepareTap allocated for vmName.
+	Cleanup(ctx context.Context, vmName string) error
+}
+
+// NetworkLink is the host side of a step VM's network interface. A zero
+// link means the VM gets no interface.
+type NetworkLink struct {
+	Tap       string // host tap device
+	VhostUser string // vhost-user-net backend socket, used instead of Tap
+	Netmask   string // netmask hint passed to the VMM with Tap
+}
+
+// dhcpKernelArg makes the guest init run udhcpc instead of reading ip=.
+const dhcpKernelArg = "fledge.net=dhcp"
+
+// newNetworkProvider returns the provider opts selects, preparing w's volant
+// state when that provider is used.
+func newNetworkProvider(w *Worker, opts vmnet.Options) (NetworkProvider, error) {
+	if opts.Mode == vmnet.ModeUser {
+		return newPasstProvider(), nil
+	}
+	dhcp := opts.Mode == vmnet.ModeDHCP
+	switch opts.Provider {
+	case vmnet.ProviderNone:
+		return noneProvider{}, nil
+	case vmnet.ProviderPool:
+		return newPoolProvider(opts, dhcp)
+	default:
+		return newVolantProvider(w, dhcp)
+	}
+}
+
+// tapSet creates and removes the tap devices of step VMs on a bridge.
+type tapSet struct {
+	mgr  volantnetwork.Manager
+	mu   sync.Mutex
+	taps map[string]string // vm name -> tap
+}
+
+func newTapSet(mgr volantnetwork.Manager) *tapSet {
+	return &tapSet{mgr: mgr, taps: make(map[string]string)}
+}
+
+func (s *tapSet) prepare(ctx context.Context, vmName, mac string) (string, error) {
+	tap, err := s.mgr.PrepareTap(ctx, vmName, mac)
+	if err != nil {
+		return "", fmt.Errorf("microvm executor: prepare tap: %w", err)
+	}
+	ledger.Record(ledger.KindTap, tap, vmName)
+	s.mu.Lock()
+	s.taps[vmName] = tap
+	s.mu.Unlock()
+	return tap, nil
+}
+
+func (s *tapSet) cleanup(ctx context.Context, vmName string) error {
+	s.mu.Lock()
+	tap, ok := s.taps[vmName]
+	delete(s.taps, vmName)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := s.mgr.CleanupTap(ctx, tap); err != nil {
+		return fmt.Errorf("cleanup tap %s: %w", tap, err)
+	}
+	ledger.Release(ledger.KindTap, tap)
+	return nil
+}
+
+// volantProvider leases addresses from volant's IP pool and attaches VMs to
+// its bridge, so step VMs share the network of volant-managed VMs.
+type volantProvider struct {
+	w    *Worker
+	dhcp bool
+	taps *tapSet
+
+	mu  sync.Mutex
+	ips map[string]string // vm name -> leased ip
+}
+
+// newVolantProvider loads volant's configuration, address database and
+// bridge into w.
+func newVolantProvider(w *Worker, dhcp bool) (*volantProvider, error) {
+	cfg, err := volantconfig.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("microvmworker: load volant config: %w", err)
+	}
+
+	ctx := context.Background()
+	store, err := volantsqlite.Open(ctx, cfg.DatabasePath)
+	if err != nil {
+		return nil, fmt.Errorf("microvmworker: open volant db: %w", err)
+	}
+
+	bridgeMgr, err := volantnetwork.NewBridgeManager(cfg.BridgeName)
+	if err != nil {
+		_ = store.Close(ctx)
+		return nil, fmt.Errorf("microvmworker: init network manager: %w", err)
+	}
+
+	if net.ParseIP(cfg.HostIP) == nil {
+		_ = store.Close(ctx)
+		return nil, fmt.Errorf("microvmworker: invalid host ip %q", cfg.HostIP)
+	}
+
+	_, subnet, err := net.ParseCIDR(cfg.SubnetCIDR)
+	if err != nil {
+		_ = store.Close(ctx)
+		return nil, fmt.Errorf("microvmworker: parse subnet %q: %w", cfg.SubnetCIDR, err)
+	}
+
+	w.config = cfg
+	w.store = store
+	w.network = bridgeMgr
+	w.gateway = cfg.HostIP
+	w.netmask = volantorchestrator.FormatNetmask(subnet.Mask)
+	return &volantProvider{w: w, dhcp: dhcp, taps: newTapSet(bridgeMgr), ips: make(map[string]string)}, nil
+}
+
+func (p *volantProvider) LeaseIP(ctx context.Context, vmName string) (string, error) {
+	if p.dhcp {
+		return "", nil
+	}
+	alloc, err := p.w.leaseIP(ctx)
+	if err != nil {
+		return "", err
+	}
+	ledger.Record(ledger.KindIP, alloc.IPAddress, vmName)
+	p.mu.Lock()
+	p.ips[vmName] = alloc.IPAddress
+	p.mu.Unlock()
+	return alloc.IPAddress, nil
+}
+
+func (p *volantProvider) PrepareTap(ctx context.Context, vmName, mac string) (NetworkLink, error) {
+	tap, err := p.taps.prepare(ctx, vmName, mac)
+	if err != nil {
+		return NetworkLink{}, err
+	}
+	return NetworkLink{Tap: tap, Netmask: p.w.netmask}, nil
+}
+
+func (p *volantProvider) KernelArgs(base, vmName, ip string) string {
+	if ip == "" {
+		return strings.TrimSpace(base + " " + dhcpKernelArg)
+	}
+	hostname := volantorchestrator.SanitizeHostname(vmName)
+	return strings.TrimSpace(volantorchestrator.BuildKernelCmdline(ip, p.w.gateway, p.w.netmask, hostname, base))
+}
+
+func (p *volantProvider) Cleanup(ctx context.Context, vmName string) error {
+	err := p.taps.cleanup(ctx, vmName)
+	p.mu.Lock()
+	ip, ok := p.ips[vmName]
+	delete(p.ips, vmName)
+	p.mu.Unlock()
+	if ok {
+		if releaseErr := p.w.releaseIP(ctx, ip); releaseErr != nil {
+			err = errors.Join(err, releaseErr)
+		} else {
+			ledger.Release(ledger.KindIP, ip)
+		}
+	}
+	return err
+}
+
+// poolProvider hands out addresses from a configured range and attaches VMs
+// to an existing bridge, for hosts without volant. Leases only coordinate
+// the builds of one fledge process, so concurrent processes need disjoint
+// pools.
+type poolProvider struct {
+	first, last uint32
+	gateway     string
+	netmask     string
+	dhcp        bool
+	taps        *tapSet
+
+	mu     sync.Mutex
+	leased map[uint32]string // address -> vm name
+	ips    map[string]uint32 // vm name -> address
+}
+
+func newPoolProvider(opts vmnet.Options, dhcp bool) (*poolProvider, error) {
+	bridgeMgr, err := volantnetwork.NewBridgeManager(opts.Bridge)
+	if err != nil {
+		return nil, fmt.Errorf("microvmworker: init network manager for bridge %s: %w", opts.Bridge, err)
+	}
+	p := &poolProvider{
+		gateway: opts.Gateway,
+		netmask: opts.Netmask,
+		dhcp:    dhcp,
+		taps:    newTapSet(bridgeMgr),
+		leased:  make(map[uint32]string),
+		ips:     make(map[string]uint32),
+	}
+	if p.netmask == "" {
+		p.netmask = "255.255.255.0"
+	}
+	if !dhcp {
+		first, last, err := vmnet.ParsePool(opts.Pool)
+		if err != nil {
+			return nil, fmt.Errorf("microvmworker: %w", err)
+		}
+		p.first, p.last = binary.BigEndian.Uint32(first), binary.BigEndian.Uint32(last)
+	}
+	return p, nil
+}
+
+func (p *poolProvider) LeaseIP(ctx context.Context, vmName string) (string, error) {
+	if p.dhcp {
+		return "", nil
+	}
+	gateway := net.ParseIP(p.gateway).To4()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr := p.first; addr <= p.last && addr >= p.first; addr++ {
+		if _, taken := p.leased[addr]; taken {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, addr)
+		if ip.Equal(gateway) {
+			continue
+		}
+		p.leased[addr] = vmName
+		p.ips[vmName] = addr
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("microvmworker: address pool exhausted")
+}
+
+func (p *poolProvider) PrepareTap(ctx context.Context, vmName, mac string) (NetworkLink, error) {
+	tap, err := p.taps.prepare(ctx, vmName, mac)
+	if err != nil {
+		return NetworkLink{}, err
+	}
+	return NetworkLink{Tap: tap, Netmask: p.netmask}, nil
+}
+
+func (p *poolProvider) KernelArgs(base, vmName, ip string) string {
+	if ip == "" {
+		return strings.TrimSpace(base + " " + dhcpKernelArg)
+	}
+	hostname := volantorchestrator.SanitizeHostname(vmName)
+	return strings.TrimSpace(volantorchestrator.BuildKernelCmdline(ip, p.gateway, p.netmask, hostname, base))
+}
+
+func (p *poolProvider) Cleanup(ctx context.Context, vmName string) error {
+	p.mu.Lock()
+	if addr, ok := p.ips[vmName]; ok {
+		delete(p.leased, addr)
+		delete(p.ips, vmName)
+	}
+	p.mu.Unlock()
+	return p.taps.cleanup(ctx, vmName)
+}
+
+// passtStartTimeout bounds how long passt may take to create its socket.
+const passtStartTimeout = 5 * time.Second
+
+// passtProvider connects each step VM to its own passt instance over
+// vhost-user, so hosts where fledge cannot create tap devices or bridges can
+// still run networked steps. passt serves DHCP and DNS to the guest and
+// translates its traffic to ordinary host sockets.
+type passtProvider struct {
+	mu    sync.Mutex
+	procs map[string]*passtProc // vm name -> instance
+}
+
+type passtProc struct {
+	cmd    *exec.Cmd
+	dir    string
+	exited chan error
+}
+
+func newPasstProvider() *passtProvider {
+	return &passtProvider{procs: make(map[string]*passtProc)}
+}
+
+func (p *passtProvider) LeaseIP(ctx context.Context, vmName string) (string, error) {
+	return "", nil
+}
+
+func (p *passtProvider) PrepareTap(ctx context.Context, vmName, mac string) (NetworkLink, error) {
+	bin := strings.TrimSpace(os.Getenv("FLEDGE_PASST"))
+	if bin == "" {
+		bin = "passt"
+	}
+	passt, err := exec.LookPath(bin)
+	if err != nil {
+		return NetworkLink{}, fmt.Errorf("microvm executor: user-mode networking needs passt (set FLEDGE_PASST): %w", err)
+	}
+
+	// Unix socket paths are limited to 108 bytes.
+	dir, err := os.MkdirTemp("", "fledge-passt-")
+	if err != nil {
+		return NetworkLink{}, fmt.Errorf("microvm executor: create passt dir: %w", err)
+	}
+	socket := filepath.Join(dir, "net.sock")
+	cmd := exec.Command(passt, "--vhost-user", "--socket", socket, "--foreground", "--one-off", "--quiet")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return NetworkLink{}, fmt.Errorf("microvm executor: start passt: %w", err)
+	}
+	ledger.Record(ledger.KindVM, strconv.Itoa(cmd.Process.Pid), passt)
+	proc := &passtProc{cmd: cmd, dir: dir, exited: make(chan error, 1)}
+	go func() { proc.exited <- cmd.Wait() }()
+	p.mu.Lock()
+	p.procs[vmName] = proc
+	p.mu.Unlock()
+
+	deadline := time.NewTimer(passtStartTimeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			logging.Debug("microvm executor: started passt", "vm", vmName, "passt", passt, "socket", socket)
+			return NetworkLink{VhostUser: socket}, nil
+		}
+		select {
+		case err := <-proc.exited:
+			proc.exited <- err
+			return NetworkLink{}, fmt.Errorf("microvm executor: passt exited before creating %s: %v", socket, err)
+		case <-deadline.C:
+			return NetworkLink{}, fmt.Errorf("microvm executor: passt did not create %s within %s", socket, passtStartTimeout)
+		case <-ctx.Done():
+			return NetworkLink{}, ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+func (p *passtProvider) KernelArgs(base, vmName, ip string) string {
+	return strings.TrimSpace(base + " " + dhcpKernelArg)
+}
+
+func (p *passtProvider) Cleanup(ctx context.Context, vmName string) error {
+	p.mu.Lock()
+	proc, ok := p.procs[vmName]
+	delete(p.procs, vmName)
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	_ = proc.cmd.Process.Kill()
+	<-proc.exited
+	ledger.Release(ledger.KindVM, strconv.Itoa(proc.cmd.Process.Pid))
+	return os.RemoveAll(proc.dir)
+}
+
+// noneProvider runs step VMs without a network interface.
+type noneProvider struct{}
+
+func (noneProvider) LeaseIP(ctx context.Context, vmName string) (string, error) { return "", nil }
+
+func (noneProvider) PrepareTap(ctx context.Context, vmName, mac string) (NetworkLink, error) {
+	return NetworkLink{}, nil
+}
+
+func (noneProvider) KernelArgs(base, vmName, ip string) string { return strings.TrimSpace(base) }
+
+func (noneProvider) Cleanup(ctx context.Context, vmName string) error { return nil }
@@ -0,0 +1,119 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/executor"
+	"github.com/moby/buildkit/executor/oci"
+	resourcestypes "github.com/moby/buildkit/executor/resources/types"
+	"github.com/moby/buildkit/executor/runcexecutor"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/network"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/vmnet"
+)
+
+// Executors a Worker can run build steps with.
+const (
+	// ExecutorMicroVM runs each step in its own microVM.
+	ExecutorMicroVM = "microvm"
+	// ExecutorOCI runs steps in runc containers sharing the host kernel and
+	// network, for hosts without /dev/kvm such as containers and nested CI.
+	ExecutorOCI = "oci"
+)
+
+// selectExecutor returns the executor FLEDGE_EXECUTOR selects. Unset or
+// "auto", it uses microVMs unless /dev/kvm is unusable and runc is
+// installed.
+func selectExecutor() (string, error) {
+	switch v := strings.TrimSpace(os.Getenv("FLEDGE_EXECUTOR")); v {
+	case ExecutorMicroVM, ExecutorOCI:
+		return v, nil
+	case "", "auto":
+		if err := kvmAvailable(); err != nil {
+			if _, lookErr := exec.LookPath("runc"); lookErr == nil {
+				logging.Warn("KVM unavailable; running build steps in runc containers without microVM isolation", "reason", err)
+				return ExecutorOCI, nil
+			}
+		}
+		return ExecutorMicroVM, nil
+	default:
+		return "", fmt.Errorf("microvmworker: invalid FLEDGE_EXECUTOR %q (expected auto, microvm or oci)", v)
+	}
+}
+
+// kvmAvailable reports why /dev/kvm cannot be used, if it cannot.
+func kvmAvailable() error {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// newOCIWorker returns a Worker running steps with runc. It needs neither a
+// kernel nor volant's network.
+func newOCIWorker(runtimeDir string, netOpts vmnet.Options) (*Worker, error) {
+	if _, err := exec.LookPath("runc"); err != nil {
+		return nil, fmt.Errorf("microvmworker: FLEDGE_EXECUTOR=oci needs runc: %w", err)
+	}
+	w := &Worker{
+		Executor:   ExecutorOCI,
+		RuntimeDir: runtimeDir,
+		Network:    netOpts,
+	}
+	if netOpts.PackageCache.Enabled {
+		if err := w.startPackageCache(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// newOCIExecutor returns BuildKit's runc executor, storing container state
+// under root. Steps use the host network; network=none steps get none.
+func newOCIExecutor(w *Worker, root string) (executor.Executor, error) {
+	providers := map[pb.NetMode]network.Provider{
+		pb.NetMode_UNSET: network.NewHostProvider(),
+		pb.NetMode_HOST:  network.NewHostProvider(),
+		pb.NetMode_NONE:  network.NewNoneProvider(),
+	}
+	exe, err := runcexecutor.New(runcexecutor.Opt{
+		Root:        filepath.Join(root, "executor"),
+		Rootless:    os.Geteuid() != 0,
+		ProcessMode: oci.ProcessSandbox,
+	}, providers)
+	if err != nil {
+		return nil, fmt.Errorf("microvmworker: create runc executor: %w", err)
+	}
+	return &ociExecutor{Executor: exe, w: w}, nil
+}
+
+// ociExecutor gives runc steps the proxy environment microVM steps get.
+type ociExecutor struct {
+	executor.Executor
+	w *Worker
+}
+
+func (e *ociExecutor) Run(ctx context.Context, id string, root executor.Mount, mounts []executor.Mount, process executor.ProcessInfo, started chan<- struct{}) (resourcestypes.Recorder, error) {
+	process.Meta.Env = e.env(process.Meta.Env)
+	return e.Executor.Run(ctx, id, root, mounts, process, started)
+}
+
+func (e *ociExecutor) Exec(ctx context.Context, id string, process executor.ProcessInfo) error {
+	process.Meta.Env = e.env(process.Meta.Env)
+	return e.Executor.Exec(ctx, id, process)
+}
+
+// env exports the configured proxy ahead of a step's own environment.
+func (e *ociExecutor) env(stepEnv []string) []string {
+	base := e.w.Network.Proxy.Env()
+	return append(base[:len(base):len(base)], e.w.stepEnv(stepEnv)...)
+}
@@ -0,0 +1,166 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/pkgcache"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// packageCache is the caching proxy a worker runs for its step VMs.
+type packageCache struct {
+	server   *http.Server
+	url      string // proxy URL as seen from step VMs
+	upstream string // HTTP proxy configured before the cache replaced it
+}
+
+// hostAddresser is implemented by providers whose guests can reach a host
+// address. listen is the host address to bind and guest the address step
+// VMs connect to for it.
+type hostAddresser interface {
+	hostAddr() (listen, guest string, err error)
+}
+
+func (p *volantProvider) hostAddr() (string, string, error) {
+	return p.w.gateway, p.w.gateway, nil
+}
+
+func (p *poolProvider) hostAddr() (string, string, error) {
+	return p.gateway, p.gateway, nil
+}
+
+// hostAddr relies on passt mapping the guest's gateway address to the host's
+// loopback interface; passt hands the guest the host's default gateway.
+func (p *passtProvider) hostAddr() (string, string, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return "", "", err
+	}
+	return "127.0.0.1", gw, nil
+}
+
+// hostLoopback is the host address of containers sharing the host network.
+type hostLoopback struct{}
+
+func (hostLoopback) hostAddr() (string, string, error) {
+	return "127.0.0.1", "127.0.0.1", nil
+}
+
+// startPackageCache starts the package cache for w's step VMs and points
+// their HTTP proxy at it. Providers without a host address get no cache.
+func (w *Worker) startPackageCache() error {
+	opts := w.Network.PackageCache
+	var provider any = w.NetProvider
+	if w.Executor == ExecutorOCI {
+		provider = hostLoopback{}
+	}
+	ha, ok := provider.(hostAddresser)
+	if !ok {
+		logging.Warn("microvmworker: package cache needs step VM networking; not starting it")
+		return nil
+	}
+	listen, guest, err := ha.hostAddr()
+	if err != nil {
+		return fmt.Errorf("microvmworker: package cache address: %w", err)
+	}
+
+	dir := opts.Dir
+	if dir == "" {
+		if dir, err = utils.CacheDir("packages"); err != nil {
+			return fmt.Errorf("microvmworker: package cache: %w", err)
+		}
+	}
+	upstream := w.Network.Proxy.HTTP
+	cache, err := pkgcache.New(dir, opts.MaxBytes, upstream, w.Network.Proxy.NoProxy)
+	if err != nil {
+		return fmt.Errorf("microvmworker: %w", err)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(listen, "0"))
+	if err != nil {
+		return fmt.Errorf("microvmworker: package cache listen on %s: %w", listen, err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	server := &http.Server{Handler: cache, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Warn("microvmworker: package cache stopped", "error", err)
+		}
+	}()
+
+	w.pkgCache = &packageCache{
+		server:   server,
+		url:      fmt.Sprintf("http://%s", net.JoinHostPort(guest, fmt.Sprint(port))),
+		upstream: upstream,
+	}
+	w.Network.Proxy.HTTP = w.pkgCache.url
+	logging.Info("Package cache started", "listen", ln.Addr().String(), "dir", dir)
+	return nil
+}
+
+// stepEnv redirects the HTTP proxy of a step's environment to the package
+// cache. BuildKit passes the configured proxy as a build arg, so only values
+// equal to it are replaced; a proxy the Dockerfile sets itself is kept.
+func (w *Worker) stepEnv(env []string) []string {
+	if w.pkgCache == nil {
+		return env
+	}
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		if (key == "HTTP_PROXY" || key == "http_proxy") && value == w.pkgCache.upstream {
+			kv = key + "=" + w.pkgCache.url
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// Close stops the services w started for its step VMs.
+func (w *Worker) Close() error {
+	if w == nil || w.pkgCache == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return w.pkgCache.server.Shutdown(ctx)
+}
+
+// defaultGateway returns the host's IPv4 default gateway.
+func defaultGateway() (string, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		return ip.String(), nil
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no IPv4 default route")
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	ctdsnapshot "github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/native"
+	"github.com/containerd/containerd/snapshots/overlay"
+	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// Snapshotters a Worker can store build layers with.
+const (
+	// SnapshotterNative copies the whole parent directory for every layer.
+	// It works on any filesystem but is slow for large images.
+	SnapshotterNative = "native"
+	// SnapshotterOverlay stacks layers with the kernel's overlayfs, so a new
+	// layer costs nothing until files are written.
+	SnapshotterOverlay = "overlayfs"
+)
+
+// selectSnapshotter returns the snapshotter FLEDGE_SNAPSHOTTER selects for a
+// worker state directory. Unset or "auto", overlayfs is used when the kernel
+// can mount it on root's filesystem.
+func selectSnapshotter(root string) (string, error) {
+	switch v := strings.TrimSpace(os.Getenv("FLEDGE_SNAPSHOTTER")); v {
+	case SnapshotterNative:
+		return v, nil
+	case SnapshotterOverlay:
+		if err := overlayutils.Supported(root); err != nil {
+			return "", fmt.Errorf("microvmworker: FLEDGE_SNAPSHOTTER=overlayfs is not supported on %s: %w", root, err)
+		}
+		return v, nil
+	case "", "auto":
+		if err := overlayutils.Supported(root); err != nil {
+			logging.Debug("overlayfs unavailable; using the native snapshotter", "dir", root, "reason", err)
+			return SnapshotterNative, nil
+		}
+		return SnapshotterOverlay, nil
+	default:
+		return "", fmt.Errorf("microvmworker: invalid FLEDGE_SNAPSHOTTER %q (expected auto, native or overlayfs)", v)
+	}
+}
+
+// newSnapshotter creates the named snapshotter storing its layers in root.
+func newSnapshotter(name, root string) (ctdsnapshot.Snapshotter, error) {
+	if name == SnapshotterOverlay {
+		return overlay.NewSnapshotter(root, overlay.AsynchronousRemove)
+	}
+	return native.NewSnapshotter(root)
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// isSparse reports whether the regular file of info has holes: fewer
+// blocks allocated than its size needs.
+func isSparse(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && st.Blocks*512 < info.Size()
+}
+
+// copySparse copies the first size bytes of src to dst, reading and
+// writing only the data segments SEEK_DATA and SEEK_HOLE find, and
+// truncates dst to size so the holes, including a trailing one, stay holes.
+// A filesystem that cannot report holes has its file copied whole.
+func copySparse(dst, src *os.File, size int64) error {
+	fd := int(src.Fd())
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // Only a hole is left
+		}
+		if errors.Is(err, unix.EINVAL) {
+			data = off
+		} else if err != nil {
+			return err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if errors.Is(err, unix.EINVAL) {
+			hole = size
+		} else if err != nil {
+			return err
+		}
+		hole = min(hole, size)
+		if data >= hole {
+			break
+		}
+		segment := io.NewSectionReader(src, data, hole-data)
+		if _, err := io.Copy(io.NewOffsetWriter(dst, data), segment); err != nil {
+			return err
+		}
+		off = hole
+	}
+	return dst.Truncate(size)
+}
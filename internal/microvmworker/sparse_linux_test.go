@@ -0,0 +1,145 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// writeSparseFile writes a file of size bytes holding data at offsets 0 and
+// 1 MiB, with holes elsewhere, a trailing one included. It skips the test
+// when the filesystem does not keep holes.
+func writeSparseFile(t *testing.T, path string, size int64) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+	for _, off := range []int64{0, 1 << 20} {
+		if _, err := f.WriteAt(bytes.Repeat([]byte("data"), 1024), off); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("Failed to truncate %s: %v", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	if !isSparse(info) {
+		t.Skip("filesystem does not keep holes")
+	}
+}
+
+// assertSameSparse checks that dst has the content of src and no more
+// blocks allocated.
+func assertSameSparse(t *testing.T, src, dst string) {
+	t.Helper()
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", src, err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", dst, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected %s to have the content of %s", dst, src)
+	}
+	var srcStat, dstStat syscall.Stat_t
+	if err := syscall.Stat(src, &srcStat); err != nil {
+		t.Fatalf("Failed to stat %s: %v", src, err)
+	}
+	if err := syscall.Stat(dst, &dstStat); err != nil {
+		t.Fatalf("Failed to stat %s: %v", dst, err)
+	}
+	if dstStat.Blocks > srcStat.Blocks {
+		t.Errorf("Expected %s to keep its holes: %d blocks, source has %d", dst, dstStat.Blocks, srcStat.Blocks)
+	}
+}
+
+// TestCopySparse tests that copying a sparse file keeps its content and
+// its holes, the trailing one included.
+func TestCopySparse(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.img")
+	const size = 8 << 20
+	writeSparseFile(t, srcPath, size)
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatalf("Failed to open source: %v", err)
+	}
+	defer src.Close()
+	dstPath := filepath.Join(dir, "dst.img")
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		t.Fatalf("Failed to create destination: %v", err)
+	}
+	if err := copySparse(dst, src, size); err != nil {
+		t.Fatalf("copySparse failed: %v", err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatalf("Failed to close destination: %v", err)
+	}
+
+	if info, err := os.Stat(dstPath); err != nil || info.Size() != size {
+		t.Fatalf("Expected a %d byte copy, got %v, %v", size, info, err)
+	}
+	assertSameSparse(t, srcPath, dstPath)
+}
+
+// TestCopyDir_Sparse tests that sparse files are archived without data,
+// marked by their PAX record, and extracted with their holes.
+func TestCopyDir_Sparse(t *testing.T) {
+	src := t.TempDir()
+	const size = 8 << 20
+	writeSparseFile(t, filepath.Join(src, "disk.img"), size)
+	if err := os.WriteFile(filepath.Join(src, "plain"), []byte("plain"), 0o644); err != nil {
+		t.Fatalf("Failed to write plain file: %v", err)
+	}
+
+	var archive bytes.Buffer
+	if err := writeTree(context.Background(), &archive, src); err != nil {
+		t.Fatalf("writeTree failed: %v", err)
+	}
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+		_, sparse := hdr.PAXRecords[paxSparseSize]
+		switch hdr.Name {
+		case "disk.img":
+			if !sparse || hdr.PAXRecords[paxSparseSize] != "8388608" || hdr.Size != 0 {
+				t.Errorf("Expected disk.img as a sparse entry without data, got %+v", hdr)
+			}
+		case "plain":
+			if sparse || hdr.Size != 5 {
+				t.Errorf("Expected plain as a regular entry with data, got %+v", hdr)
+			}
+		}
+	}
+
+	dst := t.TempDir()
+	if err := copyDir(context.Background(), src, dst); err != nil {
+		t.Fatalf("copyDir failed: %v", err)
+	}
+	assertSameSparse(t, filepath.Join(src, "disk.img"), filepath.Join(dst, "disk.img"))
+	if data, err := os.ReadFile(filepath.Join(dst, "plain")); err != nil || string(data) != "plain" {
+		t.Errorf("Expected plain to be copied, got %q, %v", data, err)
+	}
+}
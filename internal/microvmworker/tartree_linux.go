@@ -0,0 +1,274 @@
+//go:build linux
+
+package microvmworker
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyDir copies the contents of directory src into directory dst through a
+// tar stream, as `tar -C src -cf - . | tar -C dst -xf -` would: ownership,
+// modes, timestamps, hard links, symlinks, devices and fifos are preserved.
+// Sockets are skipped. Sparse files keep their holes: archive/tar cannot
+// write them, so their data bypasses the stream and is copied from src.
+func copyDir(ctx context.Context, src, dst string) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := writeTree(ctx, pw, src)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	err := extractTree(ctx, pr, src, dst)
+	if err != nil {
+		// Unblock the writer; its error is the one we already have
+		pr.CloseWithError(err)
+	} else {
+		_, _ = io.Copy(io.Discard, pr)
+	}
+	if werr := <-done; err == nil {
+		err = werr
+	}
+	return err
+}
+
+// paxSparseSize marks a regular file of the stream as sparse: its entry
+// carries no data and the record holds its size.
+const paxSparseSize = "FLEDGE.sparse.size"
+
+// fileID identifies an inode, to archive hard links once.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// writeTree writes the tree at src to w as a tar archive of paths relative
+// to src, with numeric owners and nanosecond timestamps.
+func writeTree(ctx context.Context, w io.Writer, src string) error {
+	tw := tar.NewWriter(w)
+	links := make(map[fileID]string)
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		if err := writeEntry(tw, path, rel, info, links); err != nil {
+			return fmt.Errorf("archive %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeEntry writes the file at path to tw as rel, as a link to the first
+// path archived with the same inode if it has several.
+func writeEntry(tw *tar.Writer, path, rel string, info os.FileInfo, links map[fileID]string) error {
+	var target string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if target, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Format = tar.FormatPAX
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() && st.Nlink > 1 {
+		id := fileID{dev: uint64(st.Dev), ino: st.Ino}
+		if first, ok := links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		links[id] = hdr.Name
+	}
+
+	if isSparse(info) {
+		hdr.PAXRecords = map[string]string{paxSparseSize: strconv.FormatInt(hdr.Size, 10)}
+		hdr.Size = 0
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractTree extracts the tar archive writeTree wrote of src into dst,
+// copying the data of its sparse files from src. Directory metadata is
+// applied last, so that creating their entries does not change their
+// timestamps or fail on read-only modes.
+func extractTree(ctx context.Context, r io.Reader, src, dst string) error {
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("extract: entry %q escapes %s", hdr.Name, dst)
+		}
+		if err := extractEntry(tr, hdr, src, dst); err != nil {
+			return fmt.Errorf("extract %s: %w", filepath.Join(dst, hdr.Name), err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(dst, dirs[i].Name)
+		if err := setMetadata(path, dirs[i]); err != nil {
+			return fmt.Errorf("extract %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// extractEntry creates the file of hdr under dst and, unless it is a
+// directory or hard link, applies its metadata.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, src, dst string) error {
+	path := filepath.Join(dst, hdr.Name)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		return nil
+	case tar.TypeLink:
+		return os.Link(filepath.Join(dst, hdr.Linkname), path)
+	case tar.TypeReg:
+		if err := extractFile(tr, hdr, filepath.Join(src, hdr.Name), path); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(unix.S_IFIFO)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode = unix.S_IFCHR
+		case tar.TypeBlock:
+			mode = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(path, mode|0o600, int(dev)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+	return setMetadata(path, hdr)
+}
+
+// extractFile writes the regular file of hdr to path: the entry's data, or
+// the data segments of srcPath for a sparse file.
+func extractFile(tr *tar.Reader, hdr *tar.Header, srcPath, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if sizeRecord, ok := hdr.PAXRecords[paxSparseSize]; ok {
+		err = copySparseFile(f, srcPath, sizeRecord)
+	} else {
+		_, err = io.Copy(f, tr)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copySparseFile copies the sparse file at srcPath, of the size recorded
+// by writeEntry, to dst.
+func copySparseFile(dst *os.File, srcPath, sizeRecord string) error {
+	size, err := strconv.ParseInt(sizeRecord, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sparse size %q: %w", sizeRecord, err)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copySparse(dst, src, size)
+}
+
+// setMetadata applies the owner, mode and timestamps of hdr to path, without
+// following symlinks. The mode is set after the owner, which clears setuid
+// and setgid bits.
+func setMetadata(path string, hdr *tar.Header) error {
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		mode := hdr.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -5,10 +5,11 @@ package microvmworker
 import (
 	"context"
 	"fmt"
-	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/diff/apply"
@@ -17,10 +18,10 @@ import (
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes/docker"
 	ctdsnapshot "github.com/containerd/containerd/snapshots"
-	"github.com/containerd/containerd/snapshots/native"
 	"github.com/moby/buildkit/cache"
 	bkmetadata "github.com/moby/buildkit/cache/metadata"
 	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/executor"
 	"github.com/moby/buildkit/executor/resources"
 	containerdsnapshot "github.com/moby/buildkit/snapshot/containerd"
 	"github.com/moby/buildkit/util/leaseutil"
@@ -33,11 +34,14 @@ import (
 	bolt "go.etcd.io/bbolt"
 
 	ch "github.com/volantvm/fledge/internal/launcher"
+	"github.com/volantvm/fledge/internal/ledger"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/retry"
+	"github.com/volantvm/fledge/internal/vmnet"
 	volantconfig "github.com/volantvm/volant/pkg/config"
 	volantdb "github.com/volantvm/volant/pkg/db"
 	volantsqlite "github.com/volantvm/volant/pkg/db/sqlite"
 	volantnetwork "github.com/volantvm/volant/pkg/network"
-	volantorchestrator "github.com/volantvm/volant/pkg/orchestrator"
 )
 
 // Worker is a skeleton for a BuildKit worker that executes steps inside
@@ -52,18 +56,74 @@ type Worker struct {
 	network       volantnetwork.Manager
 	gateway       string
 	netmask       string
+
+	// BootRetry retries step VMs that fail to launch or stay silent on
+	// their console, before the step runs.
+	BootRetry retry.Policy
+	// Network selects how step VMs configure their network interface.
+	Network vmnet.Options
+	// NetProvider allocates step VM addresses and host interfaces;
+	// NewFromEnv picks one from Network.
+	NetProvider NetworkProvider
+	// Executor is ExecutorMicroVM or ExecutorOCI.
+	Executor string
+
+	pkgCache *packageCache
+}
+
+func init() {
+	ledger.RegisterReclaimer(ledger.KindTap, reclaimTap)
+	ledger.RegisterReclaimer(ledger.KindIP, reclaimIP)
+}
+
+// reclaimTap removes a tap interface left behind by a crashed build.
+func reclaimTap(ctx context.Context, e ledger.Entry) error {
+	cfg, err := volantconfig.FromEnv()
+	if err != nil {
+		return fmt.Errorf("microvmworker: load volant config: %w", err)
+	}
+	mgr, err := volantnetwork.NewBridgeManager(cfg.BridgeName)
+	if err != nil {
+		return fmt.Errorf("microvmworker: init network manager: %w", err)
+	}
+	return mgr.CleanupTap(ctx, e.ID)
+}
+
+// reclaimIP returns an IP leased by a crashed build to the pool.
+func reclaimIP(ctx context.Context, e ledger.Entry) error {
+	cfg, err := volantconfig.FromEnv()
+	if err != nil {
+		return fmt.Errorf("microvmworker: load volant config: %w", err)
+	}
+	store, err := volantsqlite.Open(ctx, cfg.DatabasePath)
+	if err != nil {
+		return fmt.Errorf("microvmworker: open volant db: %w", err)
+	}
+	defer store.Close(ctx)
+	return (&Worker{store: store}).releaseIP(ctx, e.ID)
 }
 
 // NewFromEnv constructs a Worker using environment variables for configuration.
 // FLEDGE_KERNEL_BZIMAGE and FLEDGE_KERNEL_VMLINUX can override default kernel paths.
 // CLOUDHYPERVISOR points to the cloud-hypervisor binary (defaults to "cloud-hypervisor").
-func NewFromEnv(runtimeDir string) (*Worker, error) {
+// FLEDGE_VM_BOOT_TIMEOUT bounds how long a step VM may stay silent on its
+// console after launch (defaults to 60s). netOpts selects the network
+// provider; the default one reads volant's bridge and address pool.
+// FLEDGE_EXECUTOR=oci runs steps in runc containers instead of microVMs.
+func NewFromEnv(runtimeDir string, netOpts vmnet.Options) (*Worker, error) {
 	if runtimeDir == "" {
 		runtimeDir = filepath.Join(os.TempDir(), "fledge-microvm")
 	}
 	if err := os.MkdirAll(runtimeDir, 0o755); err != nil {
 		return nil, fmt.Errorf("microvmworker: ensure runtime dir: %w", err)
 	}
+	mode, err := selectExecutor()
+	if err != nil {
+		return nil, err
+	}
+	if mode == ExecutorOCI {
+		return newOCIWorker(runtimeDir, netOpts)
+	}
 	bzImage := os.Getenv("FLEDGE_KERNEL_BZIMAGE")
 	if bzImage == "" {
 		bzImage = "/var/lib/volant/kernel/bzImage"
@@ -72,51 +132,67 @@ func NewFromEnv(runtimeDir string) (*Worker, error) {
 	if vmlinux == "" {
 		vmlinux = "/var/lib/volant/kernel/vmlinux"
 	}
-	bin := os.Getenv("CLOUDHYPERVISOR")
-	if bin == "" {
-		bin = "cloud-hypervisor"
-	}
-
-	launcher := ch.New(bin, bzImage, vmlinux, runtimeDir, runtimeDir)
-	cfg, err := volantconfig.FromEnv()
+	hypervisor, bin, err := selectHypervisor()
 	if err != nil {
-		return nil, fmt.Errorf("microvmworker: load volant config: %w", err)
+		return nil, err
 	}
 
-	ctx := context.Background()
-	store, err := volantsqlite.Open(ctx, cfg.DatabasePath)
-	if err != nil {
-		return nil, fmt.Errorf("microvmworker: open volant db: %w", err)
+	launcher := ch.New(bin, bzImage, vmlinux, runtimeDir, runtimeDir)
+	launcher.Hypervisor = hypervisor
+	launcher.BootTimeout = ch.DefaultBootTimeout
+	if v := os.Getenv("FLEDGE_VM_BOOT_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("microvmworker: invalid FLEDGE_VM_BOOT_TIMEOUT %q", v)
+		}
+		launcher.BootTimeout = d
+	}
+
+	w := &Worker{
+		Executor:      ExecutorMicroVM,
+		Launcher:      launcher,
+		RuntimeDir:    runtimeDir,
+		KernelBZImage: bzImage,
+		KernelVMLinux: vmlinux,
+		BootRetry:     retry.Defaults().VM,
+		Network:       netOpts,
 	}
-
-	bridgeMgr, err := volantnetwork.NewBridgeManager(cfg.BridgeName)
+	provider, err := newNetworkProvider(w, netOpts)
 	if err != nil {
-		_ = store.Close(ctx)
-		return nil, fmt.Errorf("microvmworker: init network manager: %w", err)
+		return nil, err
 	}
-
-	if net.ParseIP(cfg.HostIP) == nil {
-		_ = store.Close(ctx)
-		return nil, fmt.Errorf("microvmworker: invalid host ip %q", cfg.HostIP)
+	w.NetProvider = provider
+	if netOpts.PackageCache.Enabled {
+		if err := w.startPackageCache(); err != nil {
+			return nil, err
+		}
 	}
+	return w, nil
+}
 
-	_, subnet, err := net.ParseCIDR(cfg.SubnetCIDR)
-	if err != nil {
-		_ = store.Close(ctx)
-		return nil, fmt.Errorf("microvmworker: parse subnet %q: %w", cfg.SubnetCIDR, err)
+// selectHypervisor returns the hypervisor and binary FLEDGE_HYPERVISOR
+// selects. Unset or "auto", it prefers cloud-hypervisor and falls back to
+// QEMU when only that is installed.
+func selectHypervisor() (string, string, error) {
+	chBin := ch.ConfiguredBin(ch.HypervisorCloudHypervisor)
+	qemuBin := ch.ConfiguredBin(ch.HypervisorQEMU)
+
+	switch v := strings.TrimSpace(os.Getenv("FLEDGE_HYPERVISOR")); v {
+	case ch.HypervisorCloudHypervisor:
+		return ch.HypervisorCloudHypervisor, chBin, nil
+	case ch.HypervisorQEMU:
+		return ch.HypervisorQEMU, qemuBin, nil
+	case "", "auto":
+		if _, err := exec.LookPath(chBin); err != nil {
+			if _, qerr := exec.LookPath(qemuBin); qerr == nil {
+				logging.Info("cloud-hypervisor not found; running build steps with QEMU", "qemu", qemuBin)
+				return ch.HypervisorQEMU, qemuBin, nil
+			}
+		}
+		return ch.HypervisorCloudHypervisor, chBin, nil
+	default:
+		return "", "", fmt.Errorf("microvmworker: invalid FLEDGE_HYPERVISOR %q (expected auto, cloud-hypervisor or qemu)", v)
 	}
-
-	return &Worker{
-		Launcher:      launcher,
-		RuntimeDir:    runtimeDir,
-		KernelBZImage: bzImage,
-		KernelVMLinux: vmlinux,
-		config:        cfg,
-		store:         store,
-		network:       bridgeMgr,
-		gateway:       cfg.HostIP,
-		netmask:       volantorchestrator.FormatNetmask(subnet.Mask),
-	}, nil
 }
 
 // BootVM boots a minimal microVM for executing build steps.
@@ -124,7 +200,7 @@ func NewFromEnv(runtimeDir string) (*Worker, error) {
 // a mechanism to run commands and capture filesystem diffs between steps.
 func (w *Worker) BootVM(ctx context.Context, name string, spec ch.LaunchSpec) (ch.Instance, error) {
 	if w.Launcher == nil {
-		return nil, fmt.Errorf("microvmworker: launcher not configured")
+		return nil, retry.Permanent(fmt.Errorf("microvmworker: launcher not configured"))
 	}
 	if spec.Name == "" {
 		spec.Name = name
@@ -149,8 +225,23 @@ func (w *Worker) NewBuildkitWorker(ctx context.Context, root string, hosts docke
 	if err := os.MkdirAll(root, 0o700); err != nil {
 		return nil, fmt.Errorf("microvmworker: ensure state dir: %w", err)
 	}
+	if address := strings.TrimSpace(os.Getenv("FLEDGE_CONTAINERD_ADDRESS")); address != "" {
+		return w.newContainerdWorker(ctx, root, address, hosts)
+	}
+	snapshotter, err := selectSnapshotter(root)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotter != SnapshotterNative {
+		// Snapshots of one snapshotter cannot be read by another, so each
+		// keeps its own cache and metadata.
+		root = filepath.Join(root, snapshotter)
+		if err := os.MkdirAll(root, 0o700); err != nil {
+			return nil, fmt.Errorf("microvmworker: ensure state dir: %w", err)
+		}
+	}
 
-	exe, err := NewExecutor(w)
+	exe, err := w.newExecutor(root)
 	if err != nil {
 		return nil, err
 	}
@@ -160,9 +251,9 @@ func (w *Worker) NewBuildkitWorker(ctx context.Context, root string, hosts docke
 		return nil, fmt.Errorf("microvmworker: ensure snapshot dir: %w", err)
 	}
 
-	sn, err := native.NewSnapshotter(snapshotRoot)
+	sn, err := newSnapshotter(snapshotter, snapshotRoot)
 	if err != nil {
-		return nil, fmt.Errorf("microvmworker: create snapshotter: %w", err)
+		return nil, fmt.Errorf("microvmworker: create %s snapshotter: %w", snapshotter, err)
 	}
 
 	contentStore, err := local.NewStore(filepath.Join(root, "content"))
@@ -176,7 +267,7 @@ func (w *Worker) NewBuildkitWorker(ctx context.Context, root string, hosts docke
 	}
 
 	mdb := ctdmetadata.NewDB(metadataDB, contentStore, map[string]ctdsnapshot.Snapshotter{
-		"native": sn,
+		snapshotter: sn,
 	})
 	if err := mdb.Init(ctx); err != nil {
 		return nil, fmt.Errorf("microvmworker: init metadata db: %w", err)
@@ -185,7 +276,7 @@ func (w *Worker) NewBuildkitWorker(ctx context.Context, root string, hosts docke
 	cs := containerdsnapshot.NewContentStore(mdb.ContentStore(), "buildkit")
 
 	lm := leaseutil.WithNamespace(ctdmetadata.NewLeaseManager(mdb), "buildkit")
-	snap := containerdsnapshot.NewSnapshotter("native", mdb.Snapshotter("native"), "buildkit", nil)
+	snap := containerdsnapshot.NewSnapshotter(snapshotter, mdb.Snapshotter(snapshotter), "buildkit", nil)
 	if err := cache.MigrateV2(ctx, filepath.Join(root, "metadata.db"), filepath.Join(root, "metadata_v2.db"), cs, snap, lm); err != nil {
 		return nil, fmt.Errorf("microvmworker: migrate metadata: %w", err)
 	}
@@ -211,8 +302,8 @@ func (w *Worker) NewBuildkitWorker(ctx context.Context, root string, hosts docke
 	}
 
 	labels := map[string]string{
-		wlabel.Executor:    "microvm",
-		wlabel.Snapshotter: "native",
+		wlabel.Executor:    w.Executor,
+		wlabel.Snapshotter: snapshotter,
 		wlabel.Hostname:    hostname,
 	}
 
@@ -247,6 +338,15 @@ func (w *Worker) NewBuildkitWorker(ctx context.Context, root string, hosts docke
 	return wk, nil
 }
 
+// newExecutor returns the executor running w's build steps, keeping its
+// state under root.
+func (w *Worker) newExecutor(root string) (executor.Executor, error) {
+	if w.Executor == ExecutorOCI {
+		return newOCIExecutor(w, root)
+	}
+	return NewExecutor(w)
+}
+
 func (w *Worker) leaseIP(ctx context.Context) (*volantdb.IPAllocation, error) {
 	if w.store == nil {
 		return nil, fmt.Errorf("microvmworker: ip store not configured")
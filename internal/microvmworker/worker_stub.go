@@ -5,14 +5,18 @@ package microvmworker
 import (
 	"context"
 	"fmt"
+
+	"github.com/volantvm/fledge/internal/vmnet"
 )
 
 type Worker struct{}
 
-func NewFromEnv(runtimeDir string) (*Worker, error) {
+func NewFromEnv(runtimeDir string, netOpts vmnet.Options) (*Worker, error) {
 	return nil, fmt.Errorf("microvmworker: unsupported platform (requires linux)")
 }
 
+func (w *Worker) Close() error { return nil }
+
 func (w *Worker) BootVM(ctx context.Context, name string, spec any) (any, error) {
 	return nil, fmt.Errorf("microvmworker: unsupported platform (requires linux)")
 }
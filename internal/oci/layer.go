@@ -0,0 +1,463 @@
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/privsep"
+)
+
+const (
+	// whiteoutPrefix marks a file that deletes its namesake from lower layers.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose lower-layer contents are hidden.
+	whiteoutOpaque = ".wh..wh..opq"
+	// maxSymlinkHops bounds symlink resolution while walking into the rootfs.
+	maxSymlinkHops = 255
+	// paxXattrPrefix prefixes the PAX records holding extended attributes.
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// ApplyLayer extracts a single layer tarball read from r onto rootDir. The
+// media type selects decompression. Whiteout entries remove the matching paths
+// from rootDir and opaque markers clear directory contents that were not
+// written by this layer. Entries can never escape rootDir, even through
+// symlinks created by earlier layers. Extraction stops between entries once
+// ctx is cancelled.
+func ApplyLayer(ctx context.Context, r io.Reader, mediaType, rootDir string) error {
+	return applyLayer(ctx, r, mediaType, rootDir, nil, nil)
+}
+
+func applyLayer(ctx context.Context, r io.Reader, mediaType, rootDir string, tracker *conflictTracker, xattrs []string) error {
+	rc, err := decompress(r, mediaType)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	a := &layerApplier{
+		ctx:     ctx,
+		root:    rootDir,
+		written: make(map[string]bool),
+		tracker: tracker,
+		xattrs:  xattrs,
+	}
+	return a.apply(tar.NewReader(rc))
+}
+
+// Conflict describes a path that existed in the rootfs before an image was
+// overlaid and that the image replaced or deleted.
+type Conflict struct {
+	// Path is the rootfs path, relative to "/".
+	Path string
+	// Removed is set when the image deleted the path through a whiteout.
+	Removed bool
+}
+
+// conflictTracker records conflicts across all layers of a single image.
+// Paths the image itself wrote in an earlier layer are not conflicts.
+type conflictTracker struct {
+	owned     map[string]bool
+	conflicts []Conflict
+}
+
+// check records a conflict if target exists and rel was not written by the
+// current image. Directories merging with directories never conflict.
+func (t *conflictTracker) check(rel, target string, dir, removed bool) {
+	if t == nil {
+		return
+	}
+	defer func() { t.owned[rel] = true }()
+	if t.owned[rel] {
+		return
+	}
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() && dir {
+		return
+	}
+	t.conflicts = append(t.conflicts, Conflict{Path: rel, Removed: removed})
+}
+
+// decompress wraps r according to the layer media type.
+func decompress(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".gzip"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip layer: %w", err)
+		}
+		return gz, nil
+	case strings.HasSuffix(mediaType, "+zstd"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zstd layer: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// dirEntry records a directory whose metadata is applied after extraction so
+// that restrictive modes do not block writing its children.
+type dirEntry struct {
+	path string
+	hdr  *tar.Header
+}
+
+type layerApplier struct {
+	ctx  context.Context
+	root string
+	// written holds the rootfs-relative paths created by the current layer,
+	// which opaque markers must not remove.
+	written map[string]bool
+	opaque  []string
+	dirs    []dirEntry
+	// tracker, when set, collects conflicts with previously overlaid content.
+	tracker *conflictTracker
+	// xattrs lists the prefixes of the extended attributes restored from
+	// the layer's tar headers; others are dropped.
+	xattrs []string
+}
+
+func (a *layerApplier) apply(tr *tar.Reader) error {
+	for {
+		if err := a.ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layer tar: %w", err)
+		}
+
+		rel := path.Clean("/" + hdr.Name)[1:]
+		if rel == "" {
+			continue
+		}
+		dir, base := path.Split(rel)
+		dir = strings.TrimSuffix(dir, "/")
+
+		switch {
+		case base == whiteoutOpaque:
+			a.opaque = append(a.opaque, dir)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if err := a.whiteout(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := a.extract(tr, hdr, rel); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		a.markWritten(rel)
+	}
+
+	// Opaque markers are resolved once the whole layer has been read, since
+	// tar ordering does not guarantee the marker precedes its siblings.
+	for _, dir := range a.opaque {
+		if err := a.clearOpaque(dir); err != nil {
+			return err
+		}
+	}
+
+	for i := len(a.dirs) - 1; i >= 0; i-- {
+		if err := applyMetadata(a.dirs[i].path, a.dirs[i].hdr); err != nil {
+			return err
+		}
+		if err := a.applyXattrs(a.dirs[i].path, a.dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyXattrs restores the extended attributes of hdr that match a.xattrs.
+func (a *layerApplier) applyXattrs(target string, hdr *tar.Header) error {
+	if len(a.xattrs) == 0 {
+		return nil
+	}
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok || !hasAnyPrefix(name, a.xattrs) {
+			continue
+		}
+		if err := lsetxattr(target, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// markWritten records rel and its parents as belonging to the current layer.
+func (a *layerApplier) markWritten(rel string) {
+	for rel != "" && rel != "." {
+		a.written[rel] = true
+		rel = path.Dir(rel)
+	}
+}
+
+// whiteout removes rel (and anything beneath it) from the rootfs.
+func (a *layerApplier) whiteout(rel string) error {
+	if rel == "" || rel == "." {
+		return nil
+	}
+	target, err := a.resolveParent(rel, false)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		return nil
+	}
+	a.tracker.check(rel, target, false, true)
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("failed to apply whiteout for %s: %w", rel, err)
+	}
+	return nil
+}
+
+// clearOpaque removes everything under dir that the current layer did not write.
+func (a *layerApplier) clearOpaque(dir string) error {
+	var target string
+	if dir == "" {
+		target = a.root
+	} else {
+		var err error
+		target, err = a.resolveParent(dir, false)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			return nil
+		}
+	}
+	return a.pruneUnwritten(target, dir)
+}
+
+func (a *layerApplier) pruneUnwritten(dirPath, rel string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read opaque directory %s: %w", rel, err)
+	}
+	for _, e := range entries {
+		childRel := path.Join(rel, e.Name())
+		childPath := filepath.Join(dirPath, e.Name())
+		if !a.written[childRel] {
+			a.tracker.check(childRel, childPath, false, true)
+			if err := os.RemoveAll(childPath); err != nil {
+				return fmt.Errorf("failed to clear opaque directory %s: %w", rel, err)
+			}
+			continue
+		}
+		if e.IsDir() {
+			if err := a.pruneUnwritten(childPath, childRel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extract materialises a single tar entry at rel inside the rootfs.
+func (a *layerApplier) extract(tr *tar.Reader, hdr *tar.Header, rel string) error {
+	target, err := a.resolveParent(rel, true)
+	if err != nil {
+		return err
+	}
+
+	a.tracker.check(rel, target, hdr.Typeflag == tar.TypeDir, false)
+
+	// Replace whatever a lower layer left at this path, unless both are directories.
+	if fi, err := os.Lstat(target); err == nil {
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		a.dirs = append(a.dirs, dirEntry{path: target, hdr: hdr})
+		return nil
+
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+		linkRel := path.Clean("/" + hdr.Linkname)[1:]
+		source, err := a.resolveParent(linkRel, false)
+		if err != nil {
+			return err
+		}
+		if source == "" {
+			return fmt.Errorf("hardlink target %s does not exist", hdr.Linkname)
+		}
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+		// Hardlinks share the inode of their target, so its metadata already applies.
+		return nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := mknod(target, hdr); err != nil {
+			return err
+		}
+
+	default:
+		logging.Debug("Skipping unsupported tar entry", "path", hdr.Name, "type", string(hdr.Typeflag))
+		return nil
+	}
+
+	if err := applyMetadata(target, hdr); err != nil {
+		return err
+	}
+	return a.applyXattrs(target, hdr)
+}
+
+// applyMetadata sets ownership, mode and modification time from hdr.
+func applyMetadata(target string, hdr *tar.Header) error {
+	if err := lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if privsep.Journaling() {
+		// Without root, later layers could not replace the file or write
+		// into the directory; the helper restores the mode
+		privsep.RecordMode(target, mode)
+		mode |= 0600
+		if hdr.Typeflag == tar.TypeDir {
+			mode |= 0700
+		}
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return fmt.Errorf("failed to chmod %s: %w", target, err)
+	}
+	mtime := hdr.ModTime
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	if err := os.Chtimes(target, mtime, mtime); err != nil {
+		return fmt.Errorf("failed to set times on %s: %w", target, err)
+	}
+	return nil
+}
+
+// resolveParent maps the rootfs-relative path rel to a host path, resolving
+// symlinks in every parent component as if rootDir were "/". The final
+// component is never followed. When create is true missing parents are
+// created; otherwise "" is returned if a parent does not exist.
+func (a *layerApplier) resolveParent(rel string, create bool) (string, error) {
+	parts := strings.Split(rel, "/")
+	current := ""
+	hops := 0
+
+	for len(parts) > 1 {
+		name := parts[0]
+		parts = parts[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			current = path.Dir("/" + current)[1:]
+			continue
+		}
+
+		next := path.Join(current, name)
+		hostPath := filepath.Join(a.root, filepath.FromSlash(next))
+		fi, err := os.Lstat(hostPath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if !create {
+				return "", nil
+			}
+			if err := os.Mkdir(hostPath, 0755); err != nil {
+				return "", err
+			}
+			current = next
+		case err != nil:
+			return "", err
+		case fi.Mode()&os.ModeSymlink != 0:
+			hops++
+			if hops > maxSymlinkHops {
+				return "", fmt.Errorf("too many levels of symbolic links in %s", rel)
+			}
+			link, err := os.Readlink(hostPath)
+			if err != nil {
+				return "", err
+			}
+			// Re-queue the link target in place of the symlink component.
+			if strings.HasPrefix(link, "/") {
+				current = ""
+			}
+			parts = append(strings.Split(link, "/"), parts...)
+		case fi.IsDir():
+			current = next
+		default:
+			if !create {
+				return "", nil
+			}
+			return "", fmt.Errorf("parent %s of %s is not a directory", next, rel)
+		}
+	}
+
+	base := parts[0]
+	if base == "" || base == "." || base == ".." {
+		return "", fmt.Errorf("invalid path %s", rel)
+	}
+	return filepath.Join(a.root, filepath.FromSlash(current), base), nil
+}
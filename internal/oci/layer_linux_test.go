@@ -0,0 +1,72 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestApplyLayer_Xattrs tests that only the requested extended attributes
+// are restored from PAX records.
+func TestApplyLayer_Xattrs(t *testing.T) {
+	root := t.TempDir()
+	probe := filepath.Join(root, "probe")
+	if err := unix.Mknod(probe, unix.S_IFREG|0644, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(probe, "user.probe", []byte("1"), 0); errors.Is(err, unix.ENOTSUP) {
+		t.Skip("user extended attributes are not supported here")
+	}
+
+	layer := buildLayer(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir, xattrs: map[string]string{"user.label": "etc_t"}},
+		{name: "etc/hosts", typeflag: tar.TypeReg, body: "127.0.0.1 localhost\n", xattrs: map[string]string{"user.label": "net_conf_t", "user.other": "x"}},
+	})
+	if err := applyLayer(context.Background(), bytes.NewReader(layer), "application/vnd.oci.image.layer.v1.tar", root, nil, []string{"user.label"}); err != nil {
+		t.Fatalf("applyLayer failed: %v", err)
+	}
+
+	for path, want := range map[string]string{"etc": "etc_t", "etc/hosts": "net_conf_t"} {
+		buf := make([]byte, 64)
+		n, err := unix.Lgetxattr(filepath.Join(root, path), "user.label", buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Errorf("%s label = %q, %v; want %q", path, buf[:n], err, want)
+		}
+	}
+	if _, err := unix.Lgetxattr(filepath.Join(root, "etc/hosts"), "user.other", nil); err == nil {
+		t.Error("Expected attributes outside the prefixes to be dropped")
+	}
+}
+
+// TestLchown_ForeignOwner tests that a target owned by someone else gets
+// the requested owner even when that is the effective one.
+func TestLchown_ForeignOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	target := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// As left by an earlier layer, or a setgid directory
+	if err := os.Chown(target, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lchown(target, os.Geteuid(), os.Getegid()); err != nil {
+		t.Fatalf("lchown failed: %v", err)
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(target, &st); err != nil {
+		t.Fatal(err)
+	}
+	if int(st.Uid) != os.Geteuid() || int(st.Gid) != os.Getegid() {
+		t.Errorf("Expected owner %d:%d, got %d:%d", os.Geteuid(), os.Getegid(), st.Uid, st.Gid)
+	}
+}
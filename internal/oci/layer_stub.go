@@ -0,0 +1,24 @@
+//go:build !linux
+
+package oci
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// lchown is a no-op on non-Linux platforms; rootfs ownership is only
+// meaningful when building on Linux.
+func lchown(target string, uid, gid int) error {
+	return nil
+}
+
+// lsetxattr is unsupported on non-Linux platforms.
+func lsetxattr(target, name, value string) error {
+	return fmt.Errorf("extended attributes are only supported on Linux: %s", target)
+}
+
+// mknod is unsupported on non-Linux platforms.
+func mknod(target string, hdr *tar.Header) error {
+	return fmt.Errorf("device nodes are only supported on Linux: %s", hdr.Name)
+}
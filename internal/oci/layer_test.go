@@ -0,0 +1,519 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tarEntry describes a single entry used to build test layers.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+	xattrs   map[string]string
+}
+
+func buildLayer(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+			if e.typeflag == tar.TypeDir {
+				mode = 0755
+			}
+		}
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     mode,
+			Size:     int64(len(e.body)),
+			Uid:      os.Geteuid(),
+			Gid:      os.Getegid(),
+		}
+		for name, value := range e.xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[paxXattrPrefix+name] = value
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatalf("Failed to write tar body: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func applyLayers(t *testing.T, root string, layers ...[]tarEntry) {
+	t.Helper()
+	for i, entries := range layers {
+		data := buildLayer(t, entries)
+		if err := ApplyLayer(context.Background(), bytes.NewReader(data), ocispec.MediaTypeImageLayer, root); err != nil {
+			t.Fatalf("ApplyLayer(%d) failed: %v", i, err)
+		}
+	}
+}
+
+func assertExists(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Lstat(path); err != nil {
+		t.Errorf("Expected %s to exist: %v", path, err)
+	}
+}
+
+func assertMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed, got err=%v", path, err)
+	}
+}
+
+// TestApplyLayer_Whiteout tests that whiteout files delete lower-layer paths.
+func TestApplyLayer_Whiteout(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root,
+		[]tarEntry{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/motd", typeflag: tar.TypeReg, body: "hello"},
+			{name: "etc/keep", typeflag: tar.TypeReg, body: "keep"},
+			{name: "var/cache/apt/", typeflag: tar.TypeDir},
+			{name: "var/cache/apt/pkg.bin", typeflag: tar.TypeReg, body: "pkg"},
+		},
+		[]tarEntry{
+			{name: "etc/.wh.motd", typeflag: tar.TypeReg},
+			{name: "var/cache/.wh.apt", typeflag: tar.TypeReg},
+		},
+	)
+
+	assertMissing(t, filepath.Join(root, "etc", "motd"))
+	assertMissing(t, filepath.Join(root, "etc", ".wh.motd"))
+	assertMissing(t, filepath.Join(root, "var", "cache", "apt"))
+	assertExists(t, filepath.Join(root, "etc", "keep"))
+	assertExists(t, filepath.Join(root, "var", "cache"))
+}
+
+// TestApplyLayer_Zstd tests extracting a zstd-compressed layer.
+func TestApplyLayer_Zstd(t *testing.T) {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	zw.Write(buildLayer(t, []tarEntry{{name: "etc/motd", typeflag: tar.TypeReg, body: "hello"}}))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zstd writer: %v", err)
+	}
+
+	root := t.TempDir()
+	if err := ApplyLayer(context.Background(), &buf, ocispec.MediaTypeImageLayerZstd, root); err != nil {
+		t.Fatalf("ApplyLayer failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "etc", "motd")); string(data) != "hello" {
+		t.Errorf("Expected the layer's file, got %q", data)
+	}
+}
+
+// TestApplyLayer_OpaqueDirectory tests that opaque markers hide lower contents only.
+func TestApplyLayer_OpaqueDirectory(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root,
+		[]tarEntry{
+			{name: "app/", typeflag: tar.TypeDir},
+			{name: "app/old.txt", typeflag: tar.TypeReg, body: "old"},
+			{name: "app/sub/", typeflag: tar.TypeDir},
+			{name: "app/sub/stale.txt", typeflag: tar.TypeReg, body: "stale"},
+			{name: "other/file", typeflag: tar.TypeReg, body: "other"},
+		},
+		[]tarEntry{
+			{name: "app/", typeflag: tar.TypeDir},
+			// The marker deliberately follows entries from the same layer.
+			{name: "app/new.txt", typeflag: tar.TypeReg, body: "new"},
+			{name: "app/sub/fresh.txt", typeflag: tar.TypeReg, body: "fresh"},
+			{name: "app/.wh..wh..opq", typeflag: tar.TypeReg},
+		},
+	)
+
+	assertMissing(t, filepath.Join(root, "app", "old.txt"))
+	assertMissing(t, filepath.Join(root, "app", "sub", "stale.txt"))
+	assertMissing(t, filepath.Join(root, "app", ".wh..wh..opq"))
+	assertExists(t, filepath.Join(root, "app", "new.txt"))
+	assertExists(t, filepath.Join(root, "app", "sub", "fresh.txt"))
+	assertExists(t, filepath.Join(root, "other", "file"))
+}
+
+// TestApplyLayer_ReplacesType tests that a file replacing a directory (and vice versa) wins.
+func TestApplyLayer_ReplacesType(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root,
+		[]tarEntry{
+			{name: "data/", typeflag: tar.TypeDir},
+			{name: "data/inner", typeflag: tar.TypeReg, body: "x"},
+			{name: "conf", typeflag: tar.TypeReg, body: "file"},
+		},
+		[]tarEntry{
+			{name: "data", typeflag: tar.TypeReg, body: "now a file"},
+			{name: "conf/", typeflag: tar.TypeDir},
+		},
+	)
+
+	content, err := os.ReadFile(filepath.Join(root, "data"))
+	if err != nil {
+		t.Fatalf("Failed to read data: %v", err)
+	}
+	if string(content) != "now a file" {
+		t.Errorf("Expected data to be replaced, got %q", content)
+	}
+	info, err := os.Stat(filepath.Join(root, "conf"))
+	if err != nil {
+		t.Fatalf("Failed to stat conf: %v", err)
+	}
+	if !info.IsDir() {
+		t.Errorf("Expected conf to be a directory")
+	}
+}
+
+// TestApplyLayer_ContainsPaths tests that entries cannot escape the rootfs.
+func TestApplyLayer_ContainsPaths(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "rootfs")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Failed to create root: %v", err)
+	}
+
+	applyLayers(t, root,
+		[]tarEntry{
+			{name: "lib", typeflag: tar.TypeSymlink, linkname: "/usr/lib"},
+			{name: "escape", typeflag: tar.TypeSymlink, linkname: "../../.."},
+			{name: "usr/lib/", typeflag: tar.TypeDir},
+		},
+		[]tarEntry{
+			{name: "../../outside.txt", typeflag: tar.TypeReg, body: "x"},
+			{name: "escape/escaped.txt", typeflag: tar.TypeReg, body: "x"},
+			{name: "lib/libc.so", typeflag: tar.TypeReg, body: "libc"},
+		},
+	)
+
+	assertMissing(t, filepath.Join(parent, "outside.txt"))
+	assertMissing(t, filepath.Join(parent, "escaped.txt"))
+	assertExists(t, filepath.Join(root, "outside.txt"))
+	assertExists(t, filepath.Join(root, "escaped.txt"))
+	assertExists(t, filepath.Join(root, "usr", "lib", "libc.so"))
+
+	target, err := os.Readlink(filepath.Join(root, "lib"))
+	if err != nil {
+		t.Fatalf("Failed to read lib symlink: %v", err)
+	}
+	if target != "/usr/lib" {
+		t.Errorf("Expected lib -> /usr/lib, got %s", target)
+	}
+}
+
+// TestApplyLayer_Hardlink tests that hardlinks share the target inode.
+func TestApplyLayer_Hardlink(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root, []tarEntry{
+		{name: "bin/busybox", typeflag: tar.TypeReg, body: "bb", mode: 0755},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+	})
+
+	a, err := os.Stat(filepath.Join(root, "bin", "busybox"))
+	if err != nil {
+		t.Fatalf("Failed to stat busybox: %v", err)
+	}
+	b, err := os.Stat(filepath.Join(root, "bin", "sh"))
+	if err != nil {
+		t.Fatalf("Failed to stat sh: %v", err)
+	}
+	if !os.SameFile(a, b) {
+		t.Errorf("Expected bin/sh to be a hardlink to bin/busybox")
+	}
+	if a.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755, got %04o", a.Mode().Perm())
+	}
+}
+
+// TestApplyLayer_Cancelled tests that extraction stops once ctx is cancelled.
+func TestApplyLayer_Cancelled(t *testing.T) {
+	root := t.TempDir()
+	data := buildLayer(t, []tarEntry{{name: "etc/motd", typeflag: tar.TypeReg, body: "hello"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ApplyLayer(ctx, bytes.NewReader(data), ocispec.MediaTypeImageLayer, root)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	assertMissing(t, filepath.Join(root, "etc", "motd"))
+}
+
+// writeBlob stores data in the layout and returns its descriptor.
+func writeBlob(t *testing.T, layoutDir, mediaType string, data []byte) ocispec.Descriptor {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	encoded := hex.EncodeToString(sum[:])
+	dir := filepath.Join(layoutDir, "blobs", "sha256")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create blobs dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, encoded), data, 0644); err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+	var desc ocispec.Descriptor
+	raw := fmt.Sprintf(`{"mediaType":%q,"digest":"sha256:%s","size":%d}`, mediaType, encoded, len(data))
+	if err := json.Unmarshal([]byte(raw), &desc); err != nil {
+		t.Fatalf("Failed to build descriptor: %v", err)
+	}
+	return desc
+}
+
+func writeJSONBlob(t *testing.T, layoutDir, mediaType string, v interface{}) ocispec.Descriptor {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to marshal %s: %v", mediaType, err)
+	}
+	return writeBlob(t, layoutDir, mediaType, data)
+}
+
+// writeLayout creates an OCI layout with a single image tagged "latest" and
+// returns the descriptor of its gzip layer.
+func writeLayout(t *testing.T, layoutDir string, entries []tarEntry) ocispec.Descriptor {
+	t.Helper()
+	return writeLayoutLayers(t, layoutDir, entries)[0]
+}
+
+// writeLayoutLayers creates an OCI layout with an image of one gzip layer
+// per entry list, tagged "latest", and returns the layer descriptors.
+func writeLayoutLayers(t *testing.T, layoutDir string, layerEntries ...[]tarEntry) []ocispec.Descriptor {
+	t.Helper()
+	var layers []ocispec.Descriptor
+	for _, entries := range layerEntries {
+		var gzBuf bytes.Buffer
+		gz := gzip.NewWriter(&gzBuf)
+		if _, err := gz.Write(buildLayer(t, entries)); err != nil {
+			t.Fatalf("Failed to compress layer: %v", err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatalf("Failed to close gzip writer: %v", err)
+		}
+		layers = append(layers, writeBlob(t, layoutDir, ocispec.MediaTypeImageLayerGzip, gzBuf.Bytes()))
+	}
+
+	cfg := writeJSONBlob(t, layoutDir, ocispec.MediaTypeImageConfig, ocispec.Image{
+		Config: ocispec.ImageConfig{WorkingDir: "/srv"},
+	})
+	manifest := writeJSONBlob(t, layoutDir, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    cfg,
+		Layers:    layers,
+	})
+	manifest.Annotations = map[string]string{ocispec.AnnotationRefName: "latest"}
+
+	index, err := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifest},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal index: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(layoutDir, "index.json"), index, 0644); err != nil {
+		t.Fatalf("Failed to write index.json: %v", err)
+	}
+	return layers
+}
+
+// TestApplyLayout tests applying a gzip-compressed image from an OCI layout.
+func TestApplyLayout(t *testing.T) {
+	layoutDir := t.TempDir()
+	root := filepath.Join(t.TempDir(), "rootfs")
+	writeLayout(t, layoutDir, []tarEntry{
+		{name: "usr/bin/app", typeflag: tar.TypeReg, body: "#!/bin/sh\n", mode: 0755},
+	})
+
+	if err := ApplyLayout(context.Background(), layoutDir, "latest", root); err != nil {
+		t.Fatalf("ApplyLayout failed: %v", err)
+	}
+	assertExists(t, filepath.Join(root, "usr", "bin", "app"))
+
+	manifest, err := ResolveManifest(layoutDir, "latest")
+	if err != nil {
+		t.Fatalf("ResolveManifest failed: %v", err)
+	}
+	img, err := ReadConfig(layoutDir, manifest)
+	if err != nil {
+		t.Fatalf("ReadConfig failed: %v", err)
+	}
+	if img.Config.WorkingDir != "/srv" {
+		t.Errorf("Expected working dir /srv, got %q", img.Config.WorkingDir)
+	}
+
+	if _, err := ResolveManifest(layoutDir, "missing"); err == nil {
+		t.Errorf("Expected error for unknown reference")
+	}
+}
+
+// TestApplyLayout_DigestMismatch tests that tampered layer blobs are rejected.
+func TestApplyLayout_DigestMismatch(t *testing.T) {
+	layoutDir := t.TempDir()
+	layer := writeLayout(t, layoutDir, []tarEntry{
+		{name: "etc/hostname", typeflag: tar.TypeReg, body: "vm"},
+	})
+
+	blob, err := BlobPath(layoutDir, layer)
+	if err != nil {
+		t.Fatalf("BlobPath failed: %v", err)
+	}
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write(buildLayer(t, []tarEntry{{name: "etc/hostname", typeflag: tar.TypeReg, body: "evil"}}))
+	gz.Close()
+	if err := os.WriteFile(blob, gzBuf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to tamper blob: %v", err)
+	}
+
+	if err := ApplyLayout(context.Background(), layoutDir, "latest", t.TempDir()); err == nil {
+		t.Errorf("Expected digest verification error")
+	}
+}
+
+// TestOverlayLayout tests conflict reporting when overlaying an image on existing content.
+func TestOverlayLayout(t *testing.T) {
+	root := t.TempDir()
+	base := t.TempDir()
+	writeLayout(t, base, []tarEntry{
+		{name: "etc", typeflag: tar.TypeDir, mode: 0755},
+		{name: "etc/os-release", typeflag: tar.TypeReg, body: "ID=alpine\n", mode: 0644},
+		{name: "usr/bin/tool", typeflag: tar.TypeReg, body: "base", mode: 0755},
+	})
+	if err := ApplyLayout(context.Background(), base, "latest", root); err != nil {
+		t.Fatalf("ApplyLayout failed: %v", err)
+	}
+
+	sidecar := t.TempDir()
+	writeLayout(t, sidecar, []tarEntry{
+		{name: "etc", typeflag: tar.TypeDir, mode: 0755},
+		{name: "etc/os-release", typeflag: tar.TypeReg, body: "ID=debian\n", mode: 0644},
+		{name: "usr/bin/.wh.tool", typeflag: tar.TypeReg},
+		{name: "opt/sidecar/run", typeflag: tar.TypeReg, body: "sidecar", mode: 0755},
+	})
+	conflicts, err := OverlayLayout(context.Background(), sidecar, "latest", root)
+	if err != nil {
+		t.Fatalf("OverlayLayout failed: %v", err)
+	}
+
+	want := []Conflict{
+		{Path: "etc/os-release"},
+		{Path: "usr/bin/tool", Removed: true},
+	}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("Expected conflicts %+v, got %+v", want, conflicts)
+	}
+	assertExists(t, filepath.Join(root, "opt", "sidecar", "run"))
+	assertMissing(t, filepath.Join(root, "usr", "bin", "tool"))
+}
+
+// TestApplyLayout_Parallel tests that layers decompressed concurrently are
+// still applied in order, with whiteouts and opaque directories removing
+// only what earlier layers wrote, and that a bad layer fails the unpack.
+func TestApplyLayout_Parallel(t *testing.T) {
+	defer func(n int) { unpackWorkers = n }(unpackWorkers)
+	unpackWorkers = 2
+
+	layoutDir := t.TempDir()
+	layers := writeLayoutLayers(t, layoutDir,
+		[]tarEntry{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/old.conf", typeflag: tar.TypeReg, body: "old"},
+			{name: "var/cache/", typeflag: tar.TypeDir},
+			{name: "var/cache/stale", typeflag: tar.TypeReg, body: "stale"},
+		},
+		[]tarEntry{{name: "etc/.wh.old.conf", typeflag: tar.TypeReg}},
+		[]tarEntry{
+			{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+			{name: "var/cache/fresh", typeflag: tar.TypeReg, body: "fresh"},
+		},
+		[]tarEntry{{name: "etc/old.conf", typeflag: tar.TypeReg, body: "new"}},
+		[]tarEntry{{name: "etc/hostname", typeflag: tar.TypeReg, body: "vm"}},
+	)
+
+	root := filepath.Join(t.TempDir(), "rootfs")
+	if err := ApplyLayout(context.Background(), layoutDir, "latest", root); err != nil {
+		t.Fatalf("ApplyLayout failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "etc", "old.conf")); err != nil || string(data) != "new" {
+		t.Errorf("Expected the last layer's etc/old.conf, got %q, %v", data, err)
+	}
+	assertMissing(t, filepath.Join(root, "var", "cache", "stale"))
+	assertExists(t, filepath.Join(root, "var", "cache", "fresh"))
+	assertExists(t, filepath.Join(root, "etc", "hostname"))
+
+	blob, err := BlobPath(layoutDir, layers[2])
+	if err != nil {
+		t.Fatalf("BlobPath failed: %v", err)
+	}
+	if err := os.WriteFile(blob, []byte("tampered"), 0644); err != nil {
+		t.Fatalf("Failed to tamper blob: %v", err)
+	}
+	root = filepath.Join(t.TempDir(), "rootfs")
+	if err := ApplyLayout(context.Background(), layoutDir, "latest", root); err == nil {
+		t.Error("Expected a tampered middle layer to fail the unpack")
+	}
+	assertMissing(t, filepath.Join(root, "etc", "hostname"))
+}
+
+// TestApplyLayout_StagingBudget tests that layers larger than the staging
+// budget are still applied, one at a time, and that they are staged next
+// to the rootfs rather than in the system temp dir.
+func TestApplyLayout_StagingBudget(t *testing.T) {
+	defer func(n int, b int64) { unpackWorkers, unpackStageBytes = n, b }(unpackWorkers, unpackStageBytes)
+	unpackWorkers, unpackStageBytes = 4, 1
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	layoutDir := t.TempDir()
+	writeLayoutLayers(t, layoutDir,
+		[]tarEntry{{name: "etc/", typeflag: tar.TypeDir}, {name: "etc/a", typeflag: tar.TypeReg, body: "a"}},
+		[]tarEntry{{name: "etc/b", typeflag: tar.TypeReg, body: "b"}},
+		[]tarEntry{{name: "etc/.wh.a", typeflag: tar.TypeReg}},
+	)
+
+	parent := t.TempDir()
+	root := filepath.Join(parent, "rootfs")
+	if err := ApplyLayout(context.Background(), layoutDir, "latest", root); err != nil {
+		t.Fatalf("ApplyLayout failed: %v", err)
+	}
+	assertMissing(t, filepath.Join(root, "etc", "a"))
+	assertExists(t, filepath.Join(root, "etc", "b"))
+	if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+		t.Errorf("Expected the staging directory to be removed, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,304 @@
+// Package oci reads OCI image layouts and applies their layers to a root
+// filesystem directory without relying on external tools such as umoci.
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// mediaTypeDockerManifestList is the Docker schema2 equivalent of an OCI image
+// index, which may appear in layouts copied from a registry.
+const mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// BlobPath returns the path of the blob identified by desc inside layoutDir.
+func BlobPath(layoutDir string, desc ocispec.Descriptor) (string, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return "", fmt.Errorf("invalid digest %q: %w", desc.Digest, err)
+	}
+	return filepath.Join(layoutDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()), nil
+}
+
+// CopyBlob writes the blob described by desc to w, failing if its content does
+// not match the descriptor digest.
+func CopyBlob(layoutDir string, desc ocispec.Descriptor, w io.Writer) error {
+	path, err := BlobPath(layoutDir, desc)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %w", desc.Digest, err)
+	}
+	defer f.Close()
+
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(io.MultiWriter(w, verifier), f); err != nil {
+		return fmt.Errorf("failed to copy blob %s: %w", desc.Digest, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s failed digest verification", desc.Digest)
+	}
+	return nil
+}
+
+// readJSONBlob decodes the blob identified by desc into v, verifying its digest.
+func readJSONBlob(layoutDir string, desc ocispec.Descriptor, v interface{}) error {
+	path, err := BlobPath(layoutDir, desc)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+	verifier := desc.Digest.Verifier()
+	verifier.Write(data)
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s failed digest verification", desc.Digest)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse blob %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// ResolveManifest returns the image manifest tagged ref in the layout at
+// layoutDir. An empty ref selects the only manifest in the index. Multi-platform
+// indexes are resolved to the manifest matching the host architecture.
+func ResolveManifest(layoutDir, ref string) (ocispec.Manifest, error) {
+	var manifest ocispec.Manifest
+
+	desc, err := resolveRef(layoutDir, ref)
+	if err != nil {
+		return manifest, err
+	}
+
+	// Descend through nested indexes (e.g. multi-arch images) until a manifest is found.
+	for depth := 0; isIndex(desc.MediaType); depth++ {
+		if depth >= 4 {
+			return manifest, fmt.Errorf("image index nesting too deep")
+		}
+		var nested ocispec.Index
+		if err := readJSONBlob(layoutDir, desc, &nested); err != nil {
+			return manifest, err
+		}
+		desc, err = selectByPlatform(nested.Manifests)
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	if err := readJSONBlob(layoutDir, desc, &manifest); err != nil {
+		return manifest, err
+	}
+	return manifest, nil
+}
+
+// ReadConfig returns the image configuration referenced by manifest.
+func ReadConfig(layoutDir string, manifest ocispec.Manifest) (ocispec.Image, error) {
+	var img ocispec.Image
+	if err := readJSONBlob(layoutDir, manifest.Config, &img); err != nil {
+		return img, fmt.Errorf("failed to read image config: %w", err)
+	}
+	return img, nil
+}
+
+// ApplyLayout applies every layer of the image tagged ref in layoutDir onto
+// rootDir, in order, honouring OCI whiteouts and opaque directories.
+func ApplyLayout(ctx context.Context, layoutDir, ref, rootDir string) error {
+	return applyLayout(ctx, layoutDir, ref, rootDir, nil, nil)
+}
+
+// ApplyLayoutXattrs applies the image like ApplyLayout and also restores the
+// extended attributes recorded in its layers whose names start with one of
+// prefixes, such as "security.selinux" for SELinux labels.
+func ApplyLayoutXattrs(ctx context.Context, layoutDir, ref, rootDir string, prefixes []string) error {
+	return applyLayout(ctx, layoutDir, ref, rootDir, nil, prefixes)
+}
+
+// OverlayLayout applies the image like ApplyLayout on top of content already
+// in rootDir, such as another image, and returns the pre-existing paths the
+// image replaced or removed, sorted by path.
+func OverlayLayout(ctx context.Context, layoutDir, ref, rootDir string) ([]Conflict, error) {
+	tracker := &conflictTracker{owned: make(map[string]bool)}
+	if err := applyLayout(ctx, layoutDir, ref, rootDir, tracker, nil); err != nil {
+		return nil, err
+	}
+	sort.Slice(tracker.conflicts, func(i, j int) bool {
+		return tracker.conflicts[i].Path < tracker.conflicts[j].Path
+	})
+	return tracker.conflicts, nil
+}
+
+func applyLayout(ctx context.Context, layoutDir, ref, rootDir string, tracker *conflictTracker, xattrs []string) error {
+	manifest, err := ResolveManifest(layoutDir, ref)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return fmt.Errorf("failed to create rootfs directory: %w", err)
+	}
+
+	if len(manifest.Layers) < 2 || unpackWorkers < 2 {
+		for i, layer := range manifest.Layers {
+			logging.Debug("Applying image layer", "index", i, "digest", layer.Digest.String(), "size", layer.Size)
+			if err := applyLayerBlob(ctx, layoutDir, layer, rootDir, tracker, xattrs); err != nil {
+				return fmt.Errorf("failed to apply layer %s: %w", layer.Digest, err)
+			}
+		}
+		return nil
+	}
+	return applyStagedLayers(ctx, layoutDir, manifest.Layers, rootDir, tracker, xattrs)
+}
+
+// applyStagedLayers applies layers in order while later ones are still
+// being decompressed, see stageLayers. They are staged next to rootDir, in
+// the build's own temp dir and on the filesystem that has to hold them
+// unpacked anyway, rather than in the system temp dir.
+func applyStagedLayers(ctx context.Context, layoutDir string, layers []ocispec.Descriptor, rootDir string, tracker *conflictTracker, xattrs []string) error {
+	dir, err := os.MkdirTemp(filepath.Dir(filepath.Clean(rootDir)), ".fledge-unpack-*")
+	if err != nil {
+		return fmt.Errorf("failed to create layer staging directory: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	results, release, wait := stageLayers(ctx, layoutDir, dir, layers)
+	defer func() {
+		cancel()
+		wait()
+		os.RemoveAll(dir)
+	}()
+
+	for i, layer := range layers {
+		staged := <-results[i]
+		if staged.err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", layer.Digest, staged.err)
+		}
+		logging.Debug("Applying image layer", "index", i, "digest", layer.Digest.String(), "size", layer.Size)
+		err := applyStagedLayer(ctx, staged.path, rootDir, tracker, xattrs)
+		os.Remove(staged.path)
+		release()
+		if err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// applyStagedLayer applies the uncompressed layer tar at path.
+func applyStagedLayer(ctx context.Context, path, rootDir string, tracker *conflictTracker, xattrs []string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open staged layer: %w", err)
+	}
+	defer f.Close()
+	return applyLayer(ctx, f, ocispec.MediaTypeImageLayer, rootDir, tracker, xattrs)
+}
+
+// applyLayerBlob streams a layer blob through ApplyLayer and verifies its digest.
+func applyLayerBlob(ctx context.Context, layoutDir string, desc ocispec.Descriptor, rootDir string, tracker *conflictTracker, xattrs []string) error {
+	path, err := BlobPath(layoutDir, desc)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open layer blob: %w", err)
+	}
+	defer f.Close()
+
+	verifier := desc.Digest.Verifier()
+	r := io.TeeReader(f, verifier)
+	if err := applyLayer(ctx, r, desc.MediaType, rootDir, tracker, xattrs); err != nil {
+		return err
+	}
+	// Drain any trailing bytes (tar padding, compression footers) before verifying.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to read layer blob: %w", err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("layer failed digest verification")
+	}
+	return nil
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == mediaTypeDockerManifestList
+}
+
+// ImageDigest returns the digest of the manifest or index tagged ref in the
+// layout at layoutDir, which identifies the image content that was copied.
+func ImageDigest(layoutDir, ref string) (string, error) {
+	desc, err := resolveRef(layoutDir, ref)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
+// resolveRef reads index.json and selects the descriptor tagged ref.
+func resolveRef(layoutDir, ref string) (ocispec.Descriptor, error) {
+	indexData, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read index.json: %w", err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to parse index.json: %w", err)
+	}
+	return selectByRef(index.Manifests, ref)
+}
+
+// selectByRef picks the descriptor annotated with ref, or the sole descriptor
+// when ref is empty or that descriptor carries no ref annotation.
+func selectByRef(descs []ocispec.Descriptor, ref string) (ocispec.Descriptor, error) {
+	if len(descs) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("index.json contains no manifests")
+	}
+	if ref != "" {
+		for _, d := range descs {
+			if d.Annotations[ocispec.AnnotationRefName] == ref {
+				return d, nil
+			}
+		}
+	}
+	if len(descs) == 1 && (ref == "" || descs[0].Annotations[ocispec.AnnotationRefName] == "") {
+		return descs[0], nil
+	}
+	if ref == "" {
+		return ocispec.Descriptor{}, fmt.Errorf("index.json contains %d manifests; a reference is required", len(descs))
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("reference %q not found in index.json", ref)
+}
+
+// selectByPlatform picks the linux manifest matching the host architecture,
+// falling back to the first entry that carries no platform information.
+func selectByPlatform(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if len(descs) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("image index contains no manifests")
+	}
+	for _, d := range descs {
+		if d.Platform == nil {
+			continue
+		}
+		if d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+			return d, nil
+		}
+	}
+	for _, d := range descs {
+		if d.Platform == nil {
+			return d, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("no manifest for linux/%s in image index", runtime.GOARCH)
+}
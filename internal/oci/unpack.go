@@ -0,0 +1,153 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
+)
+
+// unpackWorkers bounds the layers decompressed at once.
+var unpackWorkers = runtime.GOMAXPROCS(0)
+
+// unpackStageBytes bounds the estimated size of the decompressed layers
+// staged on disk at once, waiting to be applied.
+var unpackStageBytes int64 = 2 << 30
+
+// stagedLayer is the outcome of decompressing and verifying one layer.
+type stagedLayer struct {
+	// path is the uncompressed layer tar.
+	path string
+	err  error
+}
+
+// stagedSize estimates the disk space the decompressed layer desc takes.
+func stagedSize(desc ocispec.Descriptor) int64 {
+	switch {
+	case strings.HasSuffix(desc.MediaType, "+gzip"), strings.HasSuffix(desc.MediaType, ".gzip"),
+		strings.HasSuffix(desc.MediaType, "+zstd"):
+		// Typical for compressed root filesystems
+		return desc.Size * 3
+	}
+	return desc.Size
+}
+
+// stageLayers decompresses and verifies layers concurrently into
+// uncompressed tars in dir, and returns a channel per layer that delivers
+// its result. Decompression is what dominates unpacking, and it does not
+// depend on the order of the layers; applying them still happens one at a
+// time, in order, so whiteouts and opaque directories keep their meaning.
+// At most unpackWorkers layers are decompressed at once, and a new layer
+// is only started while the staged layers fit in unpackStageBytes; release
+// is called, in order, for each layer once it is applied to free its share.
+// A layer larger than the budget is staged alone. The returned wait blocks
+// until every started layer is done with dir.
+func stageLayers(ctx context.Context, layoutDir, dir string, layers []ocispec.Descriptor) (results []chan stagedLayer, release, wait func()) {
+	budget := max(unpackStageBytes, 1)
+	staging := semaphore.NewWeighted(budget)
+	workers := make(chan struct{}, max(unpackWorkers, 1))
+	sizes := make([]int64, len(layers))
+	results = make([]chan stagedLayer, len(layers))
+	for i := range results {
+		sizes[i] = min(max(stagedSize(layers[i]), 1), budget)
+		results[i] = make(chan stagedLayer, 1)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, desc := range layers {
+			if err := staging.Acquire(ctx, sizes[i]); err != nil {
+				for _, ch := range results[i:] {
+					ch <- stagedLayer{err: err}
+				}
+				return
+			}
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				for _, ch := range results[i:] {
+					ch <- stagedLayer{err: ctx.Err()}
+				}
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				path, err := stageLayer(ctx, layoutDir, desc, filepath.Join(dir, fmt.Sprintf("layer-%d.tar", i)))
+				<-workers
+				results[i] <- stagedLayer{path: path, err: err}
+			}()
+		}
+	}()
+
+	next := 0
+	release = func() {
+		staging.Release(sizes[next])
+		next++
+	}
+	return results, release, wg.Wait
+}
+
+// stageLayer writes the uncompressed content of the layer blob desc to
+// path, and verifies the blob against its digest.
+func stageLayer(ctx context.Context, layoutDir string, desc ocispec.Descriptor, path string) (string, error) {
+	blob, err := BlobPath(layoutDir, desc)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		return "", fmt.Errorf("failed to open layer blob: %w", err)
+	}
+	defer f.Close()
+
+	verifier := desc.Digest.Verifier()
+	r := io.TeeReader(f, verifier)
+	rc, err := decompress(r, desc.MediaType)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to stage layer: %w", err)
+	}
+	if _, err := io.Copy(out, &ctxReader{ctx: ctx, r: rc}); err != nil {
+		out.Close()
+		return "", fmt.Errorf("failed to decompress layer: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("failed to stage layer: %w", err)
+	}
+	// Drain any trailing bytes (compression footers) before verifying.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", fmt.Errorf("failed to read layer blob: %w", err)
+	}
+	if !verifier.Verified() {
+		return "", fmt.Errorf("layer failed digest verification")
+	}
+	return path, nil
+}
+
+// ctxReader stops reading once ctx is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
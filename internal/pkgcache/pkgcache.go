@@ -0,0 +1,337 @@
+// Package pkgcache implements the caching HTTP proxy step VMs download
+// distribution packages through. Package files (.deb, .apk, .rpm, wheels,
+// source tarballs and apt's by-hash indexes) never change once published, so
+// they are kept on disk and served locally on later builds; everything else,
+// such as repository indexes, is forwarded unchanged to public addresses.
+package pkgcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// packageSuffixes are the file extensions of immutable package artifacts.
+var packageSuffixes = []string{
+	".deb", ".udeb", ".apk", ".rpm", ".drpm", ".whl", ".gem", ".crate", ".jar",
+	".zip", ".tgz", ".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst",
+}
+
+// mutableNames are index files that share a package suffix.
+var mutableNames = map[string]bool{"APKINDEX.tar.gz": true}
+
+// hopHeaders are the hop-by-hop headers a proxy must not forward.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// errForbiddenDestination is returned for requests to addresses step VMs
+// must not reach through the cache.
+var errForbiddenDestination = errors.New("destination address is not public")
+
+// Cache is an http.Handler serving as a forward proxy for plain-HTTP
+// requests to public addresses.
+type Cache struct {
+	dir      string
+	maxBytes int64
+	client   *http.Client
+	// allowed reports whether a direct request may connect to ip.
+	allowed func(ip net.IP) bool
+
+	pruneMu sync.Mutex
+}
+
+// New returns a cache storing packages under dir. When maxBytes is positive,
+// the least recently used packages are evicted to keep the cache below it.
+// Upstream requests go through the upstream proxy, when set, for hosts not
+// matched by noProxy. Requests that connect directly may only reach public
+// addresses, so step VMs cannot use the cache to reach the host's loopback
+// services, cloud metadata endpoints or the private network.
+func New(dir string, maxBytes int64, upstream, noProxy string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("package cache: create %s: %w", dir, err)
+	}
+	c := &Cache{dir: dir, maxBytes: maxBytes, allowed: publicAddr}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	proxyFunc := (&httpproxy.Config{HTTPProxy: upstream, NoProxy: noProxy}).ProxyFunc()
+	transport.Proxy = func(r *http.Request) (*url.URL, error) { return proxyFunc(r.URL) }
+	upstreamAddr := proxyAddr(upstream)
+	// The address is checked once resolved, so a name cannot resolve to a
+	// public address for a check and a private one for the connection
+	direct := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !c.allowed(ip) {
+				return fmt.Errorf("%w: %s", errForbiddenDestination, host)
+			}
+			return nil
+		},
+	}
+	proxied := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if upstreamAddr != "" && addr == upstreamAddr {
+			return proxied.DialContext(ctx, network, addr)
+		}
+		return direct.DialContext(ctx, network, addr)
+	}
+	c.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return c, nil
+}
+
+// proxyAddr returns the host:port connections to the proxy at rawURL dial,
+// or "" without a proxy.
+func proxyAddr(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		// httpproxy accepts a bare host:port as http://host:port
+		if u, err = url.Parse("http://" + rawURL); err != nil {
+			return ""
+		}
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// publicAddr reports whether ip is a public unicast address: not loopback,
+// link-local, private, unspecified or multicast.
+func publicAddr(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Cacheable reports whether the file at urlPath is an immutable package
+// artifact.
+func Cacheable(urlPath string) bool {
+	if strings.Contains(urlPath, "/by-hash/") {
+		return true
+	}
+	name := path.Base(urlPath)
+	if mutableNames[name] {
+		return false
+	}
+	for _, suffix := range packageSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP proxies r, answering cacheable GET requests from disk when
+// possible.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect || r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "package cache: only plain HTTP requests are proxied", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodGet && Cacheable(r.URL.Path) {
+		if c.serveCached(w, r) {
+			return
+		}
+		c.fetch(w, r, true)
+		return
+	}
+	c.fetch(w, r, false)
+}
+
+// entryPath returns where the response for u is stored.
+func (c *Cache) entryPath(u *url.URL) string {
+	sum := sha256.Sum256([]byte(u.String()))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// serveCached answers r from disk, reporting whether the entry existed.
+func (c *Cache) serveCached(w http.ResponseWriter, r *http.Request) bool {
+	p := c.entryPath(r.URL)
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	logging.Debug("package cache hit", "url", r.URL.String(), "bytes", info.Size())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	return true
+}
+
+// fetch forwards r upstream and copies the response back, storing complete
+// 200 responses when store is set.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, store bool) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	if store {
+		// Partial responses cannot be stored; ranges are served from the
+		// cached copy on the next request instead.
+		out.Header.Del("Range")
+		out.Header.Del("If-Range")
+	}
+	resp, err := c.client.Do(out)
+	if errors.Is(err, errForbiddenDestination) {
+		http.Error(w, fmt.Sprintf("package cache: %v", err), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("package cache: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if !store || resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	p := c.entryPath(r.URL)
+	tmp, err := c.createTemp(p)
+	if err != nil {
+		logging.Warn("package cache: cannot store download", "url", r.URL.String(), "error", err)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	// The client gets the download even if it cannot be stored.
+	fw := &failSoftWriter{w: tmp}
+	n, copyErr := io.Copy(w, io.TeeReader(resp.Body, fw))
+	if err := tmp.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr == nil {
+		copyErr = fw.err
+	}
+	if copyErr != nil || (resp.ContentLength >= 0 && n != resp.ContentLength) {
+		return
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		logging.Warn("package cache: cannot store download", "url", r.URL.String(), "error", err)
+		return
+	}
+	logging.Debug("package cache stored", "url", r.URL.String(), "bytes", n)
+	if c.maxBytes > 0 {
+		go c.prune()
+	}
+}
+
+// createTemp creates the temporary file a download to p is written to.
+func (c *Cache) createTemp(p string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(filepath.Dir(p), ".partial-*")
+}
+
+// failSoftWriter stops writing to w after its first error instead of
+// failing the copy to the client.
+type failSoftWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (f *failSoftWriter) Write(p []byte) (int, error) {
+	if f.err == nil {
+		_, f.err = f.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// prune evicts the least recently used entries until the cache fits in
+// maxBytes.
+func (c *Cache) prune() {
+	c.pruneMu.Lock()
+	defer c.pruneMu.Unlock()
+
+	type entry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var total int64
+	_ = filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".partial-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path: p, size: info.Size(), used: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if total <= c.maxBytes {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		total -= e.size
+	}
+	logging.Debug("package cache pruned", "bytes", total)
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
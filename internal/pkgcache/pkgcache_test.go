@@ -0,0 +1,136 @@
+package pkgcache
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// TestCacheable tests which request paths are treated as immutable packages.
+func TestCacheable(t *testing.T) {
+	tests := map[string]bool{
+		"/debian/pool/main/c/curl/curl_7.88.1-10_amd64.deb":           true,
+		"/alpine/v3.20/main/x86_64/musl-1.2.5-r0.apk":                 true,
+		"/packages/py3/r/requests/requests-2.32.3-py3-none-any.whl":   true,
+		"/debian/dists/bookworm/main/binary-amd64/by-hash/SHA256/abc": true,
+		"/debian/dists/bookworm/InRelease":                            false,
+		"/debian/dists/bookworm/main/binary-amd64/Packages.xz":        false,
+		"/alpine/v3.20/main/x86_64/APKINDEX.tar.gz":                   false,
+		"/simple/requests/": false,
+	}
+	for p, want := range tests {
+		if got := Cacheable(p); got != want {
+			t.Errorf("Cacheable(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+// TestCache_ServeHTTP tests that packages are fetched once and then served
+// from disk, while indexes are always forwarded.
+func TestCache_ServeHTTP(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	cache, err := New(t.TempDir(), 0, "", "")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	// The test origin listens on loopback
+	cache.allowed = func(net.IP) bool { return true }
+	proxy := httptest.NewServer(cache)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(p string) string {
+		t.Helper()
+		resp, err := client.Get(origin.URL + p)
+		if err != nil {
+			t.Fatalf("GET %s: %v", p, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := get("/pool/curl.deb"); got != "content of /pool/curl.deb" {
+			t.Fatalf("Unexpected package body %q", got)
+		}
+		get("/dists/InRelease")
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("Expected 3 origin requests (one package, two indexes), got %d", n)
+	}
+}
+
+// TestCache_ForbiddenDestinations tests that loopback, link-local and
+// private addresses are refused.
+func TestCache_ForbiddenDestinations(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer origin.Close()
+
+	cache, err := New(t.TempDir(), 0, "", "")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, p := range []string{"/pool/curl.deb", "/dists/InRelease"} {
+		rec := httptest.NewRecorder()
+		cache.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, origin.URL+p, nil))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for %s on loopback, got %d", p, rec.Code)
+		}
+	}
+	if hits.Load() != 0 {
+		t.Errorf("Expected no request to reach the origin, got %d", hits.Load())
+	}
+
+	// An upstream proxy may be private: it decides what to reach
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "via upstream")
+	}))
+	defer upstream.Close()
+	viaUpstream, err := New(t.TempDir(), 0, upstream.URL, "")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	rec := httptest.NewRecorder()
+	viaUpstream.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://deb.debian.org/dists/InRelease", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "via upstream" {
+		t.Errorf("Expected the upstream proxy to answer, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for addr, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"10.1.2.3":        false,
+		"192.168.1.1":     false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+	} {
+		if got := publicAddr(net.ParseIP(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if got := proxyAddr("http://proxy.internal:3128"); got != "proxy.internal:3128" {
+		t.Errorf("Unexpected proxy address %q", got)
+	}
+	if got := proxyAddr("proxy.internal"); got != "proxy.internal:80" {
+		t.Errorf("Unexpected proxy address %q", got)
+	}
+}
@@ -0,0 +1,446 @@
+// Package privsep lets a build started as root drop to the user who invoked
+// it for everything but the steps that need root: giving the rootfs its
+// image's owners, mounting the filesystem image and running the packaging
+// tools that read the finished, root-owned rootfs. Those run in a helper
+// process that stays root, takes requests over a pipe and refuses to touch
+// anything outside the build's scratch directory.
+//
+// While root is dropped, the ownership, modes and device nodes the build
+// cannot create itself are recorded in a journal instead, and the helper
+// applies them in one pass once the rootfs is assembled.
+package privsep
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/volantvm/fledge/internal/ledger"
+	"github.com/volantvm/fledge/internal/loopdev"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// HelperArg is the hidden first argument that runs fledge as the privileged
+// helper. main dispatches it before parsing the command line.
+const HelperArg = "__privsep-helper"
+
+// scratchPrefix names the scratch directories the helper is confined to,
+// and is the only kind of directory it will remove.
+const scratchPrefix = "fledge-privsep-"
+
+// tools are the programs the helper runs for the build. Each reads the
+// root-owned rootfs or writes into a mounted image.
+var tools = map[string]bool{
+	"cp":         true,
+	"du":         true,
+	"mkfs.btrfs": true,
+	"mkfs.ext4":  true,
+	"mksquashfs": true,
+}
+
+// Entry is what the unprivileged build recorded for a rootfs path instead
+// of applying it. Paths without an entry are given to root.
+type Entry struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+	// Mode is the permission and special bits to restore, when the build
+	// kept itself access the image does not grant.
+	Mode *os.FileMode `json:"mode,omitempty"`
+	// Device is os.ModeDevice, with os.ModeCharDevice for character
+	// devices, when the path is a placeholder for a device node.
+	Device os.FileMode `json:"device,omitempty"`
+	Rdev   uint64      `json:"rdev,omitempty"`
+}
+
+var (
+	journalMu sync.Mutex
+	// journal is nil unless root was dropped.
+	journal map[string]*Entry
+)
+
+// Journaling reports whether root was dropped, so that ownership, modes and
+// device nodes are to be recorded rather than applied.
+func Journaling() bool {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	return journal != nil
+}
+
+// RecordOwner records the owner of path.
+func RecordOwner(path string, uid, gid int) {
+	record(path, func(e *Entry) { e.UID, e.GID = uid, gid })
+}
+
+// RecordMode records the mode of path, for a file the build left more
+// accessible to itself.
+func RecordMode(path string, mode os.FileMode) {
+	record(path, func(e *Entry) { e.Mode = &mode })
+}
+
+// RecordDevice records that path is a placeholder for the device node of
+// type mode (os.ModeDevice, plus os.ModeCharDevice for character devices)
+// and number rdev.
+func RecordDevice(path string, mode os.FileMode, rdev uint64) {
+	record(path, func(e *Entry) { e.Device, e.Rdev = mode&(os.ModeDevice|os.ModeCharDevice), rdev })
+}
+
+func record(path string, fn func(*Entry)) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journal == nil {
+		return
+	}
+	e, ok := journal[path]
+	if !ok {
+		e = &Entry{}
+		journal[path] = e
+	}
+	fn(e)
+}
+
+// entriesUnder returns the journal entries below root, keyed by their path
+// relative to it.
+func entriesUnder(root string) map[string]Entry {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	out := map[string]Entry{}
+	for path, e := range journal {
+		if !utils.Within(path, root) {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+		out[rel] = *e
+	}
+	return out
+}
+
+// request is one call to the helper; which fields are used depends on Op.
+type request struct {
+	Op      string           `json:"op"`
+	Path    string           `json:"path,omitempty"`
+	Device  string           `json:"device,omitempty"`
+	FSType  string           `json:"fstype,omitempty"`
+	Name    string           `json:"name,omitempty"`
+	Args    []string         `json:"args,omitempty"`
+	Output  string           `json:"output,omitempty"`
+	Entries map[string]Entry `json:"entries,omitempty"`
+}
+
+type response struct {
+	Device string `json:"device,omitempty"`
+	Stdout []byte `json:"stdout,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Helper is the unprivileged build's connection to its privileged helper.
+// A nil Helper means root was not dropped.
+type Helper struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	dec  *json.Decoder
+	in   io.Closer
+	wait func() error
+}
+
+func newHelper(w io.WriteCloser, r io.Reader, wait func() error) *Helper {
+	return &Helper{enc: json.NewEncoder(w), dec: json.NewDecoder(bufio.NewReader(r)), in: w, wait: wait}
+}
+
+func (h *Helper) call(req request) (response, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var resp response
+	if err := h.enc.Encode(req); err != nil {
+		return resp, fmt.Errorf("privileged helper is gone: %w", err)
+	}
+	if err := h.dec.Decode(&resp); err != nil {
+		return resp, fmt.Errorf("privileged helper is gone: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Apply gives the rootfs at root its recorded owners, modes and device
+// nodes, and root everything else. The directory holding root is made
+// root-only first, so the build can no longer reach into the rootfs.
+func (h *Helper) Apply(root string) error {
+	_, err := h.call(request{Op: "apply", Path: root, Entries: entriesUnder(root)})
+	return err
+}
+
+// Attach attaches the image file at path to a loop device.
+func (h *Helper) Attach(path string) (string, error) {
+	resp, err := h.call(request{Op: "attach", Path: path})
+	return resp.Device, err
+}
+
+// Detach detaches a loop device attached by Attach.
+func (h *Helper) Detach(device string) error {
+	_, err := h.call(request{Op: "detach", Device: device})
+	return err
+}
+
+// Mount mounts a loop device attached by Attach on target.
+func (h *Helper) Mount(device, target, fstype string) error {
+	_, err := h.call(request{Op: "mount", Device: device, Path: target, FSType: fstype})
+	return err
+}
+
+// Unmount unmounts a mount made by Mount.
+func (h *Helper) Unmount(target string) error {
+	_, err := h.call(request{Op: "unmount", Path: target})
+	return err
+}
+
+// Run runs the tool name as root and returns its standard output. Output,
+// if set, is a file the tool creates, which is given to the invoking user.
+func (h *Helper) Run(name string, args []string, output string) ([]byte, error) {
+	resp, err := h.call(request{Op: "run", Name: name, Args: args, Output: output})
+	return resp.Stdout, err
+}
+
+// Close ends the helper, which unmounts and detaches anything left behind
+// and removes the scratch directory, and waits for it to exit.
+func (h *Helper) Close() error {
+	if h == nil {
+		return nil
+	}
+	h.in.Close()
+	return h.wait()
+}
+
+// Serve runs the privileged helper for the scratch directory, taking
+// requests on stdin until it is closed. Interrupts are ignored: the build
+// reacts to them, and the helper must outlive it to clean up.
+func Serve(scratch string) error {
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
+	s, err := newServer(scratch)
+	if err != nil {
+		return err
+	}
+	return s.serve(os.Stdin, os.Stdout)
+}
+
+// server is the helper's state: the scratch directory it is confined to,
+// the user owning it, and the loop devices and mounts it made.
+type server struct {
+	scratch  string
+	uid, gid int
+	devices  map[string]bool
+	mounts   map[string]bool
+}
+
+func newServer(scratch string) (*server, error) {
+	if !filepath.IsAbs(scratch) || !strings.HasPrefix(filepath.Base(scratch), scratchPrefix) {
+		return nil, fmt.Errorf("invalid scratch directory %s", scratch)
+	}
+	info, err := os.Lstat(scratch)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("scratch directory %s is not a directory", scratch)
+	}
+	uid, gid, err := fileOwner(info)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(scratch)
+	if err != nil {
+		return nil, err
+	}
+	return &server{scratch: resolved, uid: uid, gid: gid, devices: map[string]bool{}, mounts: map[string]bool{}}, nil
+}
+
+// serve answers requests from r on w until r is closed, then cleans up.
+func (s *server) serve(r io.Reader, w io.Writer) error {
+	defer s.cleanup()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	enc := json.NewEncoder(w)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("invalid request: %w", err)
+		}
+		if err := enc.Encode(s.handle(req)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) handle(req request) response {
+	var resp response
+	var err error
+	switch req.Op {
+	case "apply":
+		err = s.apply(req.Path, req.Entries)
+	case "attach":
+		resp.Device, err = s.attach(req.Path)
+	case "detach":
+		err = s.detach(req.Device)
+	case "mount":
+		err = s.mount(req.Device, req.Path, req.FSType)
+	case "unmount":
+		err = s.unmount(req.Path)
+	case "run":
+		resp.Stdout, err = s.run(req.Name, req.Args, req.Output)
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// confine resolves path, taking relative paths from the scratch directory,
+// and rejects it unless it lies inside the scratch directory.
+func (s *server) confine(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.scratch, path)
+	}
+	resolved, err := utils.CanonicalPath(path)
+	if err != nil {
+		return "", err
+	}
+	if !utils.Within(resolved, s.scratch) {
+		return "", fmt.Errorf("%s is outside the build's scratch directory", path)
+	}
+	return resolved, nil
+}
+
+func (s *server) attach(path string) (string, error) {
+	path, err := s.confine(path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not an image file", path)
+	}
+	device, err := loopdev.Attach(path, false)
+	if err != nil {
+		return "", err
+	}
+	s.devices[device] = true
+	ledger.Record(ledger.KindLoop, device, path)
+	return device, nil
+}
+
+func (s *server) detach(device string) error {
+	if !s.devices[device] {
+		return fmt.Errorf("%s was not attached by this build", device)
+	}
+	if err := loopdev.Detach(device); err != nil {
+		return err
+	}
+	delete(s.devices, device)
+	ledger.Release(ledger.KindLoop, device)
+	return nil
+}
+
+func (s *server) mount(device, target, fstype string) error {
+	if !s.devices[device] {
+		return fmt.Errorf("%s was not attached by this build", device)
+	}
+	target, err := s.confine(target)
+	if err != nil {
+		return err
+	}
+	if err := loopdev.Mount(device, target, fstype, false); err != nil {
+		return err
+	}
+	s.mounts[target] = true
+	ledger.Record(ledger.KindMount, target, device)
+	return nil
+}
+
+func (s *server) unmount(target string) error {
+	target, err := s.confine(target)
+	if err != nil {
+		return err
+	}
+	if !s.mounts[target] {
+		return fmt.Errorf("%s was not mounted by this build", target)
+	}
+	if err := loopdev.Unmount(target); err != nil {
+		return err
+	}
+	delete(s.mounts, target)
+	ledger.Release(ledger.KindMount, target)
+	return nil
+}
+
+// run runs an allowed tool in the scratch directory. Every argument that
+// is not a flag, and the value of every flag=value, is taken as a path and
+// must stay inside the scratch directory.
+func (s *server) run(name string, args []string, output string) ([]byte, error) {
+	if !tools[name] {
+		return nil, fmt.Errorf("%s may not be run with root privileges", name)
+	}
+	for _, arg := range args {
+		path := arg
+		if strings.HasPrefix(arg, "-") {
+			_, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				continue
+			}
+			path = value
+		}
+		if _, err := s.confine(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = s.scratch
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if err != nil {
+		return stdout, fmt.Errorf("%s failed: %w\nOutput: %s%s", name, err, stdout, stderr.String())
+	}
+	if output != "" {
+		path, err := s.confine(output)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Lchown(path, s.uid, s.gid); err != nil {
+			return nil, fmt.Errorf("failed to hand %s to the invoking user: %w", path, err)
+		}
+	}
+	return stdout, nil
+}
+
+// cleanup unmounts and detaches what the build left behind, then removes
+// the scratch directory.
+func (s *server) cleanup() {
+	for target := range s.mounts {
+		if err := loopdev.Unmount(target); err == nil {
+			ledger.Release(ledger.KindMount, target)
+		}
+	}
+	for device := range s.devices {
+		if err := loopdev.Detach(device); err == nil {
+			ledger.Release(ledger.KindLoop, device)
+		}
+	}
+	if os.Getenv("FLEDGE_KEEP_TEMP") == "" {
+		os.RemoveAll(s.scratch)
+	}
+}
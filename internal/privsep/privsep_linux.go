@@ -0,0 +1,227 @@
+//go:build linux
+
+package privsep
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// Start starts the privileged helper and drops the process to the user who
+// invoked fledge through sudo. Temporary files go to a new scratch
+// directory owned by that user, which TMPDIR is pointed at; the helper
+// removes it when the returned Helper is closed or fledge exits.
+func Start() (*Helper, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("dropping privileges requires running as root")
+	}
+	uid, gid, err := invokingUser()
+	if err != nil {
+		return nil, err
+	}
+	scratch, err := os.MkdirTemp("", scratchPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	if err := os.Chown(scratch, uid, gid); err != nil {
+		os.Remove(scratch)
+		return nil, fmt.Errorf("failed to hand scratch directory to the invoking user: %w", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		os.Remove(scratch)
+		return nil, fmt.Errorf("failed to locate the fledge binary: %w", err)
+	}
+	cmd := exec.Command(exe, HelperArg, scratch)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		os.Remove(scratch)
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		os.Remove(scratch)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		os.Remove(scratch)
+		return nil, fmt.Errorf("failed to start privileged helper: %w", err)
+	}
+	h := newHelper(stdin, stdout, cmd.Wait)
+
+	if err := drop(uid, gid); err != nil {
+		h.Close()
+		return nil, err
+	}
+	os.Setenv("TMPDIR", scratch)
+	journalMu.Lock()
+	journal = map[string]*Entry{}
+	journalMu.Unlock()
+	return h, nil
+}
+
+// invokingUser returns the user and group sudo was run by.
+func invokingUser() (int, int, error) {
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot tell which user to drop to: run fledge through sudo")
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot tell which group to drop to: SUDO_GID is not set")
+	}
+	if uid == 0 {
+		return 0, 0, fmt.Errorf("fledge was invoked by root; there is no user to drop to")
+	}
+	return uid, gid, nil
+}
+
+// drop switches every thread of the process to uid and gid, with the
+// user's supplementary groups, and points HOME and USER at the user.
+func drop(uid, gid int) error {
+	groups := []int{gid}
+	u, lookupErr := user.LookupId(strconv.Itoa(uid))
+	if lookupErr == nil {
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil && g != gid {
+				groups = append(groups, g)
+			}
+		}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setresgid(gid, gid, gid); err != nil {
+		return fmt.Errorf("failed to drop to group %d: %w", gid, err)
+	}
+	if err := syscall.Setresuid(uid, uid, uid); err != nil {
+		return fmt.Errorf("failed to drop to user %d: %w", uid, err)
+	}
+	if lookupErr == nil {
+		os.Setenv("HOME", u.HomeDir)
+		os.Setenv("USER", u.Username)
+		os.Setenv("LOGNAME", u.Username)
+	}
+	return nil
+}
+
+// fileOwner returns the owner of the file described by info.
+func fileOwner(info os.FileInfo) (int, int, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("cannot read the owner of %s", info.Name())
+	}
+	return int(st.Uid), int(st.Gid), nil
+}
+
+// apply gives the rootfs at root its journal entries, keyed by path
+// relative to root, and root ownership everywhere else.
+func (s *server) apply(root string, entries map[string]Entry) error {
+	root, err := s.confine(root)
+	if err != nil {
+		return err
+	}
+	parent := filepath.Dir(root)
+	if parent == s.scratch || !utils.Within(parent, s.scratch) {
+		return fmt.Errorf("rootfs %s must be in a directory of its own", root)
+	}
+	// The tree is about to hold root-owned and setuid files, so the build
+	// must no longer be able to reach into it or swap parts of it
+	if err := os.Lchown(parent, 0, 0); err != nil {
+		return err
+	}
+	if err := os.Chmod(parent, 0700); err != nil {
+		return err
+	}
+
+	type inode struct{ dev, ino uint64 }
+	type node struct {
+		path string
+		info os.FileInfo
+		key  inode
+	}
+	// Hardlinks share one inode, so an entry for any of its names applies
+	// to all of them
+	var nodes []node
+	recorded := map[inode]Entry{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot stat %s", path)
+		}
+		key := inode{uint64(st.Dev), st.Ino}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if e, ok := entries[rel]; ok {
+			recorded[key] = e
+		}
+		nodes = append(nodes, node{path: path, info: info, key: key})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk rootfs: %w", err)
+	}
+
+	done := map[inode]bool{}
+	for _, n := range nodes {
+		if done[n.key] {
+			continue
+		}
+		done[n.key] = true
+		if err := applyEntry(n.path, n.info, recorded[n.key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEntry applies e to path, whose Lstat result is info. Changing the
+// owner clears setuid and setgid bits, so the mode is set afterwards.
+func applyEntry(path string, info os.FileInfo, e Entry) error {
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if e.Mode != nil {
+		mode = *e.Mode
+	}
+	if e.Device != 0 && info.Mode().IsRegular() {
+		kind := uint32(syscall.S_IFBLK)
+		if e.Device&os.ModeCharDevice != 0 {
+			kind = syscall.S_IFCHR
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if err := syscall.Mknod(path, kind|uint32(mode.Perm()), int(e.Rdev)); err != nil {
+			return fmt.Errorf("failed to create device node %s: %w", path, err)
+		}
+	}
+	if err := os.Lchown(path, e.UID, e.GID); err != nil {
+		return fmt.Errorf("failed to chown %s to %d:%d: %w", path, e.UID, e.GID, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to restore mode on %s: %w", path, err)
+	}
+	return nil
+}
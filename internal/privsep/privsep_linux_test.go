@@ -0,0 +1,172 @@
+//go:build linux
+
+package privsep
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// startTestHelper serves a helper for a new scratch directory over pipes.
+func startTestHelper(t *testing.T) (*Helper, string) {
+	t.Helper()
+	scratch := filepath.Join(t.TempDir(), scratchPrefix+"test")
+	if err := os.Mkdir(scratch, 0700); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(scratch)
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.serve(reqR, respW)
+		respW.Close()
+		done <- err
+	}()
+	h := newHelper(reqW, respR, func() error { return <-done })
+	return h, scratch
+}
+
+// TestJournal tests recording ownership, modes and device nodes while root
+// is dropped, and nothing otherwise.
+func TestJournal(t *testing.T) {
+	RecordOwner("/scratch/rootfs/etc", 0, 0)
+	if Journaling() || len(entriesUnder("/scratch/rootfs")) != 0 {
+		t.Fatal("Expected nothing to be recorded before root is dropped")
+	}
+
+	journalMu.Lock()
+	journal = map[string]*Entry{}
+	journalMu.Unlock()
+	defer func() {
+		journalMu.Lock()
+		journal = nil
+		journalMu.Unlock()
+	}()
+
+	RecordOwner("/scratch/rootfs/home/app", 1000, 1000)
+	RecordMode("/scratch/rootfs/usr/bin/su", 04755)
+	RecordOwner("/scratch/rootfs/dev/null", 0, 5)
+	RecordDevice("/scratch/rootfs/dev/null", os.ModeDevice|os.ModeCharDevice|0666, 1<<8|3)
+	RecordOwner("/scratch/rootfs-other/x", 1, 1)
+
+	entries := entriesUnder("/scratch/rootfs")
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries under the rootfs, got %v", entries)
+	}
+	if e := entries["home/app"]; e.UID != 1000 || e.GID != 1000 || e.Mode != nil {
+		t.Errorf("Expected home/app owned by 1000:1000, got %+v", e)
+	}
+	if e := entries["usr/bin/su"]; e.Mode == nil || *e.Mode != 04755 {
+		t.Errorf("Expected usr/bin/su to keep mode 04755, got %+v", e)
+	}
+	if e := entries["dev/null"]; e.GID != 5 || e.Device != os.ModeDevice|os.ModeCharDevice || e.Rdev != 1<<8|3 {
+		t.Errorf("Expected dev/null to be a character device owned by group 5, got %+v", e)
+	}
+}
+
+// TestHelperConfinement tests that the helper only runs allowed tools, only
+// on paths inside its scratch directory, and only detaches and unmounts
+// what it made.
+func TestHelperConfinement(t *testing.T) {
+	h, scratch := startTestHelper(t)
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(scratch, "rootfs"), 0755)
+	os.Symlink(outside, filepath.Join(scratch, "escape"))
+
+	if out, err := h.Run("du", []string{"-sk", filepath.Join(scratch, "rootfs")}, ""); err != nil || !strings.Contains(string(out), "rootfs") {
+		t.Errorf("Expected du inside the scratch directory to run, got %q, %v", out, err)
+	}
+	for _, args := range [][]string{
+		{"-sk", outside},
+		{"-sk", filepath.Join(scratch, "escape")},
+		{"-sk", "../.."},
+		{"-sk", "--files0-from=/etc/passwd"},
+	} {
+		if _, err := h.Run("du", args, ""); err == nil {
+			t.Errorf("Expected du %v to be rejected", args)
+		}
+	}
+	if _, err := h.Run("sh", []string{"-c", "id"}, ""); err == nil {
+		t.Error("Expected a tool outside the allowlist to be rejected")
+	}
+
+	if _, err := h.Attach(filepath.Join(outside, "fs.img")); err == nil {
+		t.Error("Expected attaching an image outside the scratch directory to fail")
+	}
+	if err := h.Detach("/dev/loop0"); err == nil {
+		t.Error("Expected detaching a device the helper did not attach to fail")
+	}
+	if err := h.Mount("/dev/loop0", filepath.Join(scratch, "mnt"), "ext4"); err == nil {
+		t.Error("Expected mounting a device the helper did not attach to fail")
+	}
+	if err := h.Unmount(filepath.Join(scratch, "mnt")); err == nil {
+		t.Error("Expected unmounting a mount the helper did not make to fail")
+	}
+	if err := h.Apply(filepath.Join(scratch, "rootfs")); err == nil {
+		t.Error("Expected applying ownership to a rootfs directly in the scratch directory to fail")
+	}
+
+	if err := h.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Error("Expected the scratch directory to be removed once the helper ends")
+	}
+	if _, err := newServer(outside); err == nil {
+		t.Error("Expected a helper for a directory that is not a scratch directory to be refused")
+	}
+}
+
+// TestHelperApply tests applying recorded owners, modes and device nodes,
+// through hardlinks, and root ownership for everything else.
+func TestHelperApply(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("applying ownership requires root")
+	}
+	h, scratch := startTestHelper(t)
+	defer h.Close()
+	root := filepath.Join(scratch, "unpacked", "rootfs")
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	os.WriteFile(filepath.Join(root, "bin", "su"), []byte("x"), 0755)
+	os.Link(filepath.Join(root, "bin", "su"), filepath.Join(root, "bin", "su-link"))
+	os.WriteFile(filepath.Join(root, "shadow"), nil, 0600)
+	os.WriteFile(filepath.Join(root, "null"), nil, 0600)
+	os.Lchown(filepath.Join(root, "shadow"), 1000, 1000)
+
+	suMode, nullMode := os.FileMode(0755)|os.ModeSetuid, os.FileMode(0666)
+	entries := map[string]Entry{
+		"bin/su-link": {UID: 0, GID: 50, Mode: &suMode},
+		"null":        {Mode: &nullMode, Device: os.ModeDevice | os.ModeCharDevice, Rdev: 1<<8 | 3},
+	}
+	if _, err := h.call(request{Op: "apply", Path: root, Entries: entries}); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	owner := func(name string) (os.FileInfo, *syscall.Stat_t) {
+		info, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info, info.Sys().(*syscall.Stat_t)
+	}
+	if info, st := owner("bin/su"); st.Gid != 50 || info.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("Expected the hardlinked entry to apply to bin/su with setuid kept, got gid %d mode %v", st.Gid, info.Mode())
+	}
+	if _, st := owner("shadow"); st.Uid != 0 || st.Gid != 0 {
+		t.Errorf("Expected an unrecorded file to be given to root, got %d:%d", st.Uid, st.Gid)
+	}
+	if info, st := owner("null"); info.Mode()&os.ModeCharDevice == 0 || st.Rdev != 1<<8|3 {
+		t.Errorf("Expected null to become a character device, got %v", info.Mode())
+	}
+	if info, _ := os.Stat(filepath.Dir(root)); info.Mode().Perm() != 0700 {
+		t.Errorf("Expected the rootfs to be locked away from the build, got %v", info.Mode())
+	}
+}
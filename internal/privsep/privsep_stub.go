@@ -0,0 +1,23 @@
+//go:build !linux
+
+package privsep
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("dropping privileges requires linux")
+
+// Start is not supported on this platform.
+func Start() (*Helper, error) {
+	return nil, errUnsupported
+}
+
+func fileOwner(info os.FileInfo) (int, int, error) {
+	return 0, 0, errUnsupported
+}
+
+func (s *server) apply(root string, entries map[string]Entry) error {
+	return errUnsupported
+}
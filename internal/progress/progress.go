@@ -0,0 +1,87 @@
+// Package progress decides how build progress is shown and renders BuildKit
+// solve status. The mode is chosen once per process, from --progress.
+package progress
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// Mode selects how progress is displayed.
+type Mode string
+
+const (
+	// ModeAuto uses ModeTTY when stderr is a terminal and ModePlain otherwise.
+	ModeAuto Mode = "auto"
+	// ModeTTY redraws an interactive display with progress bars.
+	ModeTTY Mode = "tty"
+	// ModePlain prints one line per event, suitable for CI logs.
+	ModePlain Mode = "plain"
+	// ModeQuiet shows no progress at all.
+	ModeQuiet Mode = "quiet"
+)
+
+// Env names the environment variable providing the default mode.
+const Env = "FLEDGE_PROGRESS"
+
+var (
+	mu   sync.Mutex
+	mode = ModeAuto
+)
+
+// ParseMode validates a --progress value.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case ModeAuto, ModeTTY, ModePlain, ModeQuiet:
+		return m, nil
+	case "":
+		return ModeAuto, nil
+	}
+	return "", fmt.Errorf("invalid progress mode %q (expected auto, tty, plain or quiet)", s)
+}
+
+// SetMode sets the mode for the rest of the process.
+func SetMode(m Mode) {
+	mu.Lock()
+	defer mu.Unlock()
+	mode = m
+}
+
+// Current returns the mode in effect, resolving ModeAuto.
+func Current() Mode {
+	mu.Lock()
+	m := mode
+	mu.Unlock()
+	if m != ModeAuto {
+		return m
+	}
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		return ModeTTY
+	}
+	return ModePlain
+}
+
+// Bars reports whether progress bars for downloads and copies should be drawn.
+func Bars() bool {
+	return Current() == ModeTTY
+}
+
+// width returns the terminal width of stderr, or 80 when unknown.
+func width() int {
+	if w, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && w > 0 {
+		return w
+	}
+	return 80
+}
+
+// height returns the terminal height of stderr, or 25 when unknown.
+func height() int {
+	if _, h, err := term.GetSize(int(os.Stderr.Fd())); err == nil && h > 0 {
+		return h
+	}
+	return 25
+}
@@ -0,0 +1,123 @@
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	bkclient "github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// TestParseMode tests accepted and rejected --progress values.
+func TestParseMode(t *testing.T) {
+	for in, want := range map[string]Mode{"": ModeAuto, "auto": ModeAuto, "TTY": ModeTTY, "plain": ModePlain, " quiet ": ModeQuiet} {
+		got, err := ParseMode(in)
+		if err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseMode("fancy"); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
+
+// TestDisplaySolve_Plain tests plain output for started, logged, cached and failed steps.
+func TestDisplaySolve_Plain(t *testing.T) {
+	SetMode(ModePlain)
+	defer SetMode(ModeAuto)
+
+	start := time.Unix(100, 0)
+	done := start.Add(1500 * time.Millisecond)
+	run := digest.FromString("run")
+	from := digest.FromString("from")
+	fail := digest.FromString("fail")
+
+	ch := make(chan *bkclient.SolveStatus, 8)
+	ch <- &bkclient.SolveStatus{Vertexes: []*bkclient.Vertex{
+		{Digest: from, Name: "[1/3] FROM alpine", Started: &start, Completed: &start, Cached: true},
+		{Digest: run, Name: "[2/3] RUN make", Started: &start},
+	}}
+	ch <- &bkclient.SolveStatus{Logs: []*bkclient.VertexLog{{Vertex: run, Data: []byte("building\npart")}}}
+	ch <- &bkclient.SolveStatus{
+		Vertexes: []*bkclient.Vertex{{Digest: run, Name: "[2/3] RUN make", Started: &start, Completed: &done}},
+		Logs:     []*bkclient.VertexLog{{Vertex: run, Data: []byte("ial")}},
+	}
+	ch <- &bkclient.SolveStatus{Vertexes: []*bkclient.Vertex{{Digest: fail, Name: "[3/3] RUN false", Started: &done, Completed: &done, Error: "exit code 1"}}}
+	close(ch)
+
+	var out bytes.Buffer
+	stats := DisplaySolve(&out, ch)
+
+	want := strings.Join([]string{
+		"#1 [1/3] FROM alpine",
+		"#2 [2/3] RUN make",
+		"#1 CACHED",
+		"#2 building",
+		"#2 partial",
+		"#2 DONE 1.5s",
+		"#3 [3/3] RUN false",
+		"#3 ERROR: exit code 1",
+	}, "\n") + "\n"
+	if out.String() != want {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if stats.Steps != 3 || stats.Cached != 1 {
+		t.Errorf("Expected 3 steps with 1 cached, got %+v", stats)
+	}
+}
+
+// TestDisplaySolve_TTY tests that the interactive display ends with every step and failed logs.
+func TestDisplaySolve_TTY(t *testing.T) {
+	SetMode(ModeTTY)
+	defer SetMode(ModeAuto)
+
+	start := time.Unix(100, 0)
+	done := start.Add(time.Second)
+	run := digest.FromString("run")
+
+	ch := make(chan *bkclient.SolveStatus, 2)
+	ch <- &bkclient.SolveStatus{
+		Vertexes: []*bkclient.Vertex{{Digest: run, Name: "[1/1] RUN make", Started: &start, Completed: &done, Error: "exit code 2"}},
+		Logs:     []*bkclient.VertexLog{{Vertex: run, Data: []byte("make: *** no rule\n")}},
+	}
+	close(ch)
+
+	var out bytes.Buffer
+	DisplaySolve(&out, ch)
+	for _, s := range []string{"[+] Finished", "=> ERROR [1/1] RUN make", "1.0s", "#1 make: *** no rule", "ERROR: exit code 2"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected output to contain %q:\n%s", s, out.String())
+		}
+	}
+}
+
+// TestRender_LiveLog tests that running steps show their latest output.
+func TestRender_LiveLog(t *testing.T) {
+	start := time.Now()
+	run := digest.FromString("run")
+	tr := newSolveTracker()
+	tr.update(&bkclient.SolveStatus{
+		Vertexes: []*bkclient.Vertex{{Digest: run, Name: "[1/1] RUN apt-get install", Started: &start}},
+	})
+	var logs []byte
+	for i := 1; i <= liveLogLines+2; i++ {
+		logs = append(logs, fmt.Sprintf("line %d\n", i)...)
+	}
+	tr.update(&bkclient.SolveStatus{
+		Logs: []*bkclient.VertexLog{{Vertex: run, Data: append(logs, "Unpacking"...)}},
+	})
+
+	var out bytes.Buffer
+	tr.render(&out, 0, false)
+	if strings.Contains(out.String(), "#1 line 3\n") {
+		t.Errorf("Expected only the latest %d lines:\n%s", liveLogLines, out.String())
+	}
+	for _, s := range []string{"#1 line 8", "#1 Unpacking"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected output to contain %q:\n%s", s, out.String())
+		}
+	}
+}
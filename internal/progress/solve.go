@@ -0,0 +1,401 @@
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	bkclient "github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+const (
+	// redrawInterval is how often the tty display is refreshed.
+	redrawInterval = 150 * time.Millisecond
+	// logTail is how many log lines of a failed step the tty display repeats
+	// once the solve is over.
+	logTail = 20
+	// liveLogLines is how many of its latest log lines the tty display shows
+	// under a running step.
+	liveLogLines = 6
+)
+
+// SolveStats summarises a finished solve.
+type SolveStats struct {
+	// Steps counts completed vertices and Cached those served from the cache.
+	Steps  int
+	Cached int
+}
+
+// DisplaySolve renders the BuildKit status stream ch on w in the current
+// mode until ch is closed, and returns the step counts.
+func DisplaySolve(w io.Writer, ch <-chan *bkclient.SolveStatus) SolveStats {
+	t := newSolveTracker()
+	switch Current() {
+	case ModeTTY:
+		t.runTTY(w, ch)
+	case ModePlain:
+		for st := range ch {
+			t.printPlain(w, st)
+		}
+	default:
+		for st := range ch {
+			t.update(st)
+		}
+	}
+	return t.stats()
+}
+
+// solveVertex is the display state of one BuildKit vertex.
+type solveVertex struct {
+	index     int
+	name      string
+	started   *time.Time
+	completed *time.Time
+	cached    bool
+	err       string
+	statuses  []*bkclient.VertexStatus
+	logs      []string
+	partial   []byte
+
+	// Set once plain mode has printed the vertex start and result
+	printedStart bool
+	printedDone  bool
+}
+
+// duration returns how long the vertex ran, or has been running at now.
+func (v *solveVertex) duration(now time.Time) time.Duration {
+	if v.started == nil {
+		return 0
+	}
+	if v.completed != nil {
+		return v.completed.Sub(*v.started)
+	}
+	return now.Sub(*v.started)
+}
+
+// setStatus records s, replacing an earlier update with the same ID.
+func (v *solveVertex) setStatus(s *bkclient.VertexStatus) {
+	for i, old := range v.statuses {
+		if old.ID == s.ID {
+			v.statuses[i] = s
+			return
+		}
+	}
+	v.statuses = append(v.statuses, s)
+}
+
+// appendLog adds data to the vertex log and returns the lines it completed.
+func (v *solveVertex) appendLog(data []byte) []string {
+	v.partial = append(v.partial, data...)
+	var lines []string
+	for {
+		i := bytes.IndexByte(v.partial, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, strings.TrimRight(string(v.partial[:i]), "\r"))
+		v.partial = v.partial[i+1:]
+	}
+	v.logs = append(v.logs, lines...)
+	if len(v.logs) > logTail {
+		v.logs = v.logs[len(v.logs)-logTail:]
+	}
+	return lines
+}
+
+// flushLog returns the unterminated last log line, if any.
+func (v *solveVertex) flushLog() []string {
+	if len(v.partial) == 0 {
+		return nil
+	}
+	return v.appendLog([]byte("\n"))
+}
+
+// liveLog returns the latest log lines of v, including one still being
+// written, so long-running commands show progress as they print.
+func (v *solveVertex) liveLog() []string {
+	lines := v.logs
+	if len(v.partial) > 0 {
+		lines = append(lines[:len(lines):len(lines)], strings.TrimRight(string(v.partial), "\r"))
+	}
+	if len(lines) > liveLogLines {
+		lines = lines[len(lines)-liveLogLines:]
+	}
+	return lines
+}
+
+// solveTracker accumulates the state of a solve from its status stream.
+type solveTracker struct {
+	start    time.Time
+	vertices map[digest.Digest]*solveVertex
+	order    []*solveVertex
+	warnings []string
+}
+
+func newSolveTracker() *solveTracker {
+	return &solveTracker{start: time.Now(), vertices: make(map[digest.Digest]*solveVertex)}
+}
+
+// vertex returns the state for d, numbering new vertices in arrival order.
+func (t *solveTracker) vertex(d digest.Digest) *solveVertex {
+	v, ok := t.vertices[d]
+	if !ok {
+		v = &solveVertex{index: len(t.order) + 1}
+		t.vertices[d] = v
+		t.order = append(t.order, v)
+	}
+	return v
+}
+
+// update applies st and returns the lines its logs completed, per vertex.
+func (t *solveTracker) update(st *bkclient.SolveStatus) map[*solveVertex][]string {
+	for _, sv := range st.Vertexes {
+		if sv == nil {
+			continue
+		}
+		v := t.vertex(sv.Digest)
+		v.name = sv.Name
+		v.started = sv.Started
+		v.completed = sv.Completed
+		v.cached = sv.Cached
+		v.err = sv.Error
+	}
+	for _, s := range st.Statuses {
+		if s != nil {
+			t.vertex(s.Vertex).setStatus(s)
+		}
+	}
+	var lines map[*solveVertex][]string
+	for _, l := range st.Logs {
+		if l == nil {
+			continue
+		}
+		v := t.vertex(l.Vertex)
+		if done := v.appendLog(l.Data); len(done) > 0 {
+			if lines == nil {
+				lines = make(map[*solveVertex][]string)
+			}
+			lines[v] = append(lines[v], done...)
+		}
+	}
+	for _, w := range st.Warnings {
+		if w != nil {
+			t.warnings = append(t.warnings, fmt.Sprintf("#%d %s", t.vertex(w.Vertex).index, bytes.TrimSpace(w.Short)))
+		}
+	}
+	return lines
+}
+
+// stats counts the completed and cached vertices.
+func (t *solveTracker) stats() SolveStats {
+	var s SolveStats
+	for _, v := range t.order {
+		if v.completed != nil {
+			s.Steps++
+			if v.cached {
+				s.Cached++
+			}
+		}
+	}
+	return s
+}
+
+// printPlain applies st and prints what changed, one line per event in the
+// style of `docker build --progress=plain`.
+func (t *solveTracker) printPlain(w io.Writer, st *bkclient.SolveStatus) {
+	printedStatus := make(map[string]bool)
+	for _, v := range t.order {
+		for _, s := range v.statuses {
+			printedStatus[s.ID] = s.Completed != nil
+		}
+	}
+	logs := t.update(st)
+
+	for _, v := range t.order {
+		if (v.started != nil || v.completed != nil) && !v.printedStart {
+			fmt.Fprintf(w, "#%d %s\n", v.index, v.name)
+			v.printedStart = true
+		}
+	}
+	for _, s := range st.Statuses {
+		if s == nil || s.Completed == nil || printedStatus[s.ID] {
+			continue
+		}
+		printedStatus[s.ID] = true
+		fmt.Fprintf(w, "#%d %s done\n", t.vertex(s.Vertex).index, statusText(s))
+	}
+	for _, v := range t.order {
+		for _, line := range logs[v] {
+			fmt.Fprintf(w, "#%d %s\n", v.index, line)
+		}
+	}
+	for _, v := range t.order {
+		if v.completed == nil || v.printedDone {
+			continue
+		}
+		for _, line := range v.flushLog() {
+			fmt.Fprintf(w, "#%d %s\n", v.index, line)
+		}
+		switch {
+		case v.cached:
+			fmt.Fprintf(w, "#%d CACHED\n", v.index)
+		case v.err != "":
+			fmt.Fprintf(w, "#%d ERROR: %s\n", v.index, v.err)
+		default:
+			fmt.Fprintf(w, "#%d DONE %.1fs\n", v.index, v.duration(*v.completed).Seconds())
+		}
+		v.printedDone = true
+	}
+	for _, warning := range t.warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+	t.warnings = nil
+}
+
+// runTTY redraws the display on w until ch is closed, then repeats the log
+// tail of failed steps and any warnings below it.
+func (t *solveTracker) runTTY(w io.Writer, ch <-chan *bkclient.SolveStatus) {
+	ticker := time.NewTicker(redrawInterval)
+	defer ticker.Stop()
+	drawn := 0
+	for {
+		select {
+		case st, ok := <-ch:
+			if !ok {
+				t.render(w, drawn, true)
+				t.printFailures(w)
+				return
+			}
+			t.update(st)
+		case <-ticker.C:
+			drawn = t.render(w, drawn, false)
+		}
+	}
+}
+
+// render draws the display over the prev lines drawn last time and returns
+// the number of lines now on screen. Unless final, only the newest lines
+// that fit the terminal are drawn.
+func (t *solveTracker) render(w io.Writer, prev int, final bool) int {
+	now := time.Now()
+	cols := width()
+
+	var body []string
+	for _, v := range t.order {
+		if v.started == nil && v.completed == nil {
+			continue
+		}
+		body = append(body, vertexLine(v, now, cols))
+		if v.completed != nil {
+			continue
+		}
+		for _, s := range v.statuses {
+			if s.Completed == nil {
+				body = append(body, truncate(" => => "+statusText(s), cols))
+			}
+		}
+		for _, line := range v.liveLog() {
+			body = append(body, truncate(fmt.Sprintf("#%d %s", v.index, line), cols))
+		}
+	}
+	if !final {
+		if limit := height() - 2; limit > 0 && len(body) > limit {
+			body = body[len(body)-limit:]
+		}
+	}
+
+	s := t.stats()
+	state := "Building"
+	if final {
+		state = "Finished"
+	}
+	header := fmt.Sprintf("[+] %s %.1fs (%d/%d)", state, now.Sub(t.start).Seconds(), s.Steps, len(t.order))
+
+	var b strings.Builder
+	if prev > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", prev)
+	}
+	for _, line := range append([]string{header}, body...) {
+		b.WriteString("\x1b[2K")
+		b.WriteString(truncate(line, cols))
+		b.WriteByte('\n')
+	}
+	lines := len(body) + 1
+	for ; lines < prev; lines++ {
+		b.WriteString("\x1b[2K\n")
+	}
+	io.WriteString(w, b.String())
+	return lines
+}
+
+// printFailures repeats the log tail of failed vertices and any warnings.
+func (t *solveTracker) printFailures(w io.Writer) {
+	for _, v := range t.order {
+		if v.err == "" {
+			continue
+		}
+		v.flushLog()
+		fmt.Fprintf(w, "------\n > %s:\n", v.name)
+		for _, line := range v.logs {
+			fmt.Fprintf(w, "#%d %s\n", v.index, line)
+		}
+		fmt.Fprintf(w, "------\nERROR: %s\n", v.err)
+	}
+	for _, warning := range t.warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+}
+
+// vertexLine formats v for the tty display with its duration right-aligned.
+func vertexLine(v *solveVertex, now time.Time, cols int) string {
+	line := " => " + v.name
+	switch {
+	case v.cached:
+		line = " => CACHED " + v.name
+	case v.err != "":
+		line = " => ERROR " + v.name
+	}
+	dur := fmt.Sprintf("%.1fs", v.duration(now).Seconds())
+	room := cols - len(dur) - 1
+	if room < 1 {
+		return truncate(line, cols)
+	}
+	line = truncate(line, room)
+	return line + strings.Repeat(" ", room-utf8.RuneCountInString(line)+1) + dur
+}
+
+// statusText describes a vertex status such as a layer download.
+func statusText(s *bkclient.VertexStatus) string {
+	name := s.Name
+	if name == "" {
+		name = s.ID
+	}
+	switch {
+	case s.Total > 0:
+		return fmt.Sprintf("%s %s / %s", name, utils.FormatBytes(s.Current), utils.FormatBytes(s.Total))
+	case s.Current > 0:
+		return fmt.Sprintf("%s %s", name, utils.FormatBytes(s.Current))
+	}
+	return name
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	if n <= 3 {
+		return string(r[:n])
+	}
+	return string(r[:n-3]) + "..."
+}
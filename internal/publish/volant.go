@@ -0,0 +1,221 @@
+// Package publish registers built plugins with a Volant control plane.
+package publish
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// artifactSections are the manifest.json sections that reference the boot
+// artifact, one per build strategy.
+var artifactSections = []string{"rootfs", "initramfs"}
+
+// Client talks to the plugin registry API of a Volant orchestrator.
+type Client struct {
+	apiURL string
+	token  string
+	http   *http.Client
+}
+
+// Result describes a published plugin.
+type Result struct {
+	Plugin      string `json:"plugin"`
+	ArtifactURL string `json:"artifact_url"`
+	// Updated is set when the plugin already existed and was replaced.
+	Updated bool `json:"updated"`
+}
+
+// NewClient creates a client for the Volant API at apiURL, authenticating
+// with token when it is not empty.
+func NewClient(apiURL, token string) (*Client, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Volant API URL %q: must be an http(s) URL", apiURL)
+	}
+	return &Client{
+		apiURL: strings.TrimRight(apiURL, "/"),
+		token:  token,
+		http:   http.DefaultClient,
+	}, nil
+}
+
+// Publish uploads the artifact at artifactPath, rewrites the artifact URL in
+// its manifest.json to the location Volant stores it at and registers the
+// manifest as a plugin, replacing an existing plugin of the same name.
+func (c *Client) Publish(ctx context.Context, artifactPath, manifestPath string) (*Result, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	manifest := make(map[string]interface{})
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", manifestPath, err)
+	}
+	name, _ := manifest["name"].(string)
+	if name == "" {
+		return nil, fmt.Errorf("manifest %s has no name", manifestPath)
+	}
+	section, err := artifactSection(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", manifestPath, err)
+	}
+
+	// Refuse to register a manifest that describes a different build
+	checksum, _ := section["checksum"].(string)
+	actual, err := fileSHA256(artifactPath)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" && checksum != "sha256:"+actual {
+		return nil, fmt.Errorf("artifact %s does not match manifest checksum %s", artifactPath, checksum)
+	}
+
+	artifactURL, err := c.uploadArtifact(ctx, name, artifactPath, actual)
+	if err != nil {
+		return nil, err
+	}
+	section["url"] = artifactURL
+
+	updated, err := c.registerPlugin(ctx, name, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Plugin: name, ArtifactURL: artifactURL, Updated: updated}, nil
+}
+
+// artifactSection returns the manifest section holding the artifact URL.
+func artifactSection(manifest map[string]interface{}) (map[string]interface{}, error) {
+	for _, key := range artifactSections {
+		if section, ok := manifest[key].(map[string]interface{}); ok {
+			return section, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s section", strings.Join(artifactSections, " or "))
+}
+
+// uploadArtifact streams the artifact to
+// PUT /api/v1/plugins/{name}/artifacts/{file} and returns the URL Volant
+// serves it from.
+func (c *Client) uploadArtifact(ctx context.Context, name, path, sum string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat artifact: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/api/v1/plugins/%s/artifacts/%s", c.apiURL, url.PathEscape(name), url.PathEscape(filepath.Base(path)))
+	req, err := c.newRequest(ctx, http.MethodPut, endpoint, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Checksum-Sha256", sum)
+
+	var uploaded struct {
+		URL string `json:"url"`
+	}
+	if _, err := c.do(req, &uploaded, http.StatusOK, http.StatusCreated); err != nil {
+		return "", fmt.Errorf("failed to upload artifact: %w", err)
+	}
+	if uploaded.URL == "" {
+		return "", fmt.Errorf("failed to upload artifact: Volant returned no artifact URL")
+	}
+	return uploaded.URL, nil
+}
+
+// registerPlugin installs manifest with POST /api/v1/plugins, or replaces it
+// with PUT /api/v1/plugins/{name} when the plugin already exists.
+func (c *Client) registerPlugin(ctx context.Context, name string, manifest map[string]interface{}) (bool, error) {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, c.apiURL+"/api/v1/plugins", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	status, err := c.do(req, nil, http.StatusOK, http.StatusCreated, http.StatusConflict)
+	if err != nil {
+		return false, fmt.Errorf("failed to register plugin: %w", err)
+	}
+	if status != http.StatusConflict {
+		return false, nil
+	}
+
+	req, err = c.newRequest(ctx, http.MethodPut, c.apiURL+"/api/v1/plugins/"+url.PathEscape(name), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := c.do(req, nil, http.StatusOK, http.StatusNoContent); err != nil {
+		return false, fmt.Errorf("failed to update plugin: %w", err)
+	}
+	return true, nil
+}
+
+// newRequest creates an authenticated request.
+func (c *Client) newRequest(ctx context.Context, method, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends req and decodes a JSON response into out when it is not nil. Any
+// status outside accepted is returned as an error.
+func (c *Client) do(req *http.Request, out interface{}, accepted ...int) (int, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range accepted {
+		if resp.StatusCode != status {
+			continue
+		}
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return 0, fmt.Errorf("failed to parse response: %w", err)
+			}
+		}
+		return resp.StatusCode, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return 0, fmt.Errorf("%s %s returned status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// fileSHA256 returns the hex sha256 of path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash artifact: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,138 @@
+package publish
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeVolant records the plugins registered with it.
+type fakeVolant struct {
+	plugins   map[string]map[string]interface{}
+	artifacts map[string][]byte
+}
+
+func (f *fakeVolant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/artifacts/"):
+		data, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(data)
+		if r.Header.Get("X-Checksum-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "checksum mismatch", http.StatusBadRequest)
+			return
+		}
+		f.artifacts[r.URL.Path] = data
+		json.NewEncoder(w).Encode(map[string]string{"url": "https://volant.example" + r.URL.Path})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/plugins":
+		var m map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&m)
+		name := m["name"].(string)
+		if _, exists := f.plugins[name]; exists {
+			http.Error(w, "plugin exists", http.StatusConflict)
+			return
+		}
+		f.plugins[name] = m
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/api/v1/plugins/"):
+		var m map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&m)
+		f.plugins[strings.TrimPrefix(r.URL.Path, "/api/v1/plugins/")] = m
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeBuild writes an artifact and a manifest.json describing it.
+func writeBuild(t *testing.T, dir string, content []byte, checksum string) (string, string) {
+	t.Helper()
+	artifact := filepath.Join(dir, "nginx.img")
+	os.WriteFile(artifact, content, 0644)
+	if checksum == "" {
+		sum := sha256.Sum256(content)
+		checksum = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"name":    "nginx",
+		"version": "1.0.0",
+		"rootfs":  map[string]interface{}{"url": "file://" + artifact, "format": "squashfs", "checksum": checksum},
+	})
+	manifestPath := artifact + ".manifest.json"
+	os.WriteFile(manifestPath, manifest, 0644)
+	return artifact, manifestPath
+}
+
+// TestPublish tests uploading an artifact and registering, then replacing, its plugin.
+func TestPublish(t *testing.T) {
+	volant := &fakeVolant{plugins: map[string]map[string]interface{}{}, artifacts: map[string][]byte{}}
+	srv := httptest.NewServer(volant)
+	defer srv.Close()
+
+	artifact, manifest := writeBuild(t, t.TempDir(), []byte("rootfs"), "")
+	client, err := NewClient(srv.URL+"/", "secret")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	res, err := client.Publish(context.Background(), artifact, manifest)
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	wantURL := "https://volant.example/api/v1/plugins/nginx/artifacts/nginx.img"
+	if res.Plugin != "nginx" || res.ArtifactURL != wantURL || res.Updated {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+	if string(volant.artifacts["/api/v1/plugins/nginx/artifacts/nginx.img"]) != "rootfs" {
+		t.Error("Expected artifact to be uploaded")
+	}
+	rootfs := volant.plugins["nginx"]["rootfs"].(map[string]interface{})
+	if rootfs["url"] != wantURL {
+		t.Errorf("Expected registered manifest to use %s, got %v", wantURL, rootfs["url"])
+	}
+
+	res, err = client.Publish(context.Background(), artifact, manifest)
+	if err != nil {
+		t.Fatalf("second Publish failed: %v", err)
+	}
+	if !res.Updated {
+		t.Error("Expected existing plugin to be updated")
+	}
+}
+
+// TestPublish_Errors tests rejected publishes.
+func TestPublish_Errors(t *testing.T) {
+	volant := &fakeVolant{plugins: map[string]map[string]interface{}{}, artifacts: map[string][]byte{}}
+	srv := httptest.NewServer(volant)
+	defer srv.Close()
+
+	if _, err := NewClient("ftp://volant", ""); err == nil {
+		t.Error("Expected error for non-http API URL")
+	}
+
+	artifact, manifest := writeBuild(t, t.TempDir(), []byte("rootfs"), "sha256:0000")
+	client, _ := NewClient(srv.URL, "secret")
+	if _, err := client.Publish(context.Background(), artifact, manifest); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected checksum mismatch error, got %v", err)
+	}
+
+	artifact, manifest = writeBuild(t, t.TempDir(), []byte("rootfs"), "")
+	client, _ = NewClient(srv.URL, "wrong")
+	if _, err := client.Publish(context.Background(), artifact, manifest); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected unauthorized error, got %v", err)
+	}
+	if len(volant.plugins) != 0 {
+		t.Error("Expected no plugin to be registered")
+	}
+}
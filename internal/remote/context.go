@@ -0,0 +1,129 @@
+package remote
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+
+	"github.com/volantvm/fledge/internal/buildkit/buildctx"
+)
+
+// writeContext writes dir as a gzipped tarball to w, leaving out the paths
+// of exclude and those matched by its .dockerignore and .fledgeignore, but
+// keeping the paths of keep and their parents, which the build reads whatever
+// the ignore files say.
+func writeContext(w io.Writer, dir string, exclude, keep []string) error {
+	patterns, err := buildctx.ExcludePatterns(dir, "")
+	if err != nil {
+		return err
+	}
+	for _, p := range exclude {
+		patterns = append(patterns, filepath.ToSlash(p))
+	}
+	pm, err := patternmatcher.New(patterns)
+	if err != nil {
+		return fmt.Errorf("invalid ignore patterns in %s: %w", dir, err)
+	}
+	kept := make([]string, len(keep))
+	for i, p := range keep {
+		kept[i] = filepath.ToSlash(filepath.Clean(p))
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(pm, rel, kept) {
+			if d.IsDir() && !keepsUnder(rel, kept) {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() {
+				return nil
+			}
+		}
+		return addFile(tw, path, rel, d)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to package %s: %w", dir, err)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// excluded reports whether rel is left out of the context.
+func excluded(pm *patternmatcher.PatternMatcher, rel string, keep []string) bool {
+	for _, k := range keep {
+		if rel == k || strings.HasPrefix(rel, k+"/") {
+			return false
+		}
+	}
+	matched, _ := pm.MatchesOrParentMatches(rel)
+	return matched
+}
+
+// keepsUnder reports whether a kept path is inside the directory rel.
+func keepsUnder(rel string, keep []string) bool {
+	for _, k := range keep {
+		if strings.HasPrefix(k, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// addFile writes the file at path to tw as rel. Symlinks are kept as links;
+// the build service refuses those pointing outside the context.
+func addFile(tw *tar.Writer, path, rel string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	} else if !info.Mode().IsRegular() && !info.IsDir() {
+		// Sockets, devices and pipes cannot be part of a context
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// As in docker build, the context is owned by root on the builder
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,314 @@
+// Package remote builds plugins on a fledge build service (fledge serve): it
+// uploads a local fledge.toml with its directory, streams the build's log
+// back and downloads the artifact, so hosts that cannot build themselves can
+// use a shared Linux builder.
+package remote
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArtifactTTL is how long the service keeps an artifact built for a client,
+// which downloads it as soon as the build ends.
+const ArtifactTTL = time.Hour
+
+// Multipart fields of POST /v1/builds/upload.
+const (
+	fieldConfig   = "config"
+	fieldManifest = "manifest"
+	fieldContext  = "context"
+)
+
+// maxEventSize bounds a line of the build's event stream.
+const maxEventSize = 1 << 20
+
+// Client talks to the HTTP API of a fledge build service.
+type Client struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// NewClient creates a client for the build service at baseURL,
+// authenticating with apiKey when it is not empty. The key needs the build
+// and read scopes.
+func NewClient(baseURL, apiKey string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid build service URL %q: must be an http(s) URL", baseURL)
+	}
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		http:    http.DefaultClient,
+	}, nil
+}
+
+// Request is a build of a local fledge.toml.
+type Request struct {
+	ConfigPath string
+	// ManifestPath is the manifest.toml to build with; empty uses the
+	// service's default manifest.
+	ManifestPath string
+	// Exclude lists paths of the config's directory, relative to it, that
+	// are not uploaded, such as the artifact of a previous build. Paths
+	// matched by its .dockerignore and .fledgeignore are not uploaded
+	// either.
+	Exclude []string
+	// Keep lists paths of the config's directory the build reads, such as
+	// mapping sources, which are uploaded whatever the ignore files say.
+	Keep []string
+	// Priority is the build's place in the service's queue: low, normal or
+	// high; empty is normal.
+	Priority string
+	// OnLog is called with every log record of the build as it is streamed
+	// back.
+	OnLog func(Log)
+}
+
+// Log is a log record of a remote build.
+type Log struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Step    string            `json:"step,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// SlogLevel returns the level of l, or Info for an unknown one.
+func (l Log) SlogLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// Artifact describes the artifact a remote build stored.
+type Artifact struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Strategy string `json:"strategy"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Manifest bool   `json:"manifest"`
+}
+
+// event is a line of the build's event stream.
+type event struct {
+	Log      *Log      `json:"log"`
+	Artifact *Artifact `json:"artifact"`
+	Error    string    `json:"error"`
+	Status   int       `json:"status"`
+}
+
+// Build uploads req and builds it on the service, then writes the artifact
+// to output with its manifest.json and checksum next to it, as a local build
+// would. It returns the stored artifact.
+func (c *Client) Build(ctx context.Context, req Request, output string) (*Artifact, error) {
+	a, err := c.run(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.download(ctx, a, output); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// run uploads req, streams its log to req.OnLog and returns the artifact
+// the build stored.
+func (c *Client) run(ctx context.Context, req Request) (*Artifact, error) {
+	body, contentType := uploadBody(req)
+	defer body.Close()
+
+	query := url.Values{"stream": {"true"}, "ttl": {ArtifactTTL.String()}}
+	if req.Priority != "" {
+		query.Set("priority", req.Priority)
+	}
+	httpReq, err := c.newRequest(ctx, http.MethodPost, c.baseURL+"/v1/builds/upload?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload build: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, fmt.Errorf("build service refused the build: %w", err)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("failed to parse build event: %w", err)
+		}
+		switch {
+		case e.Log != nil:
+			if req.OnLog != nil {
+				req.OnLog(*e.Log)
+			}
+		case e.Error != "":
+			return nil, fmt.Errorf("remote %s (HTTP %d)", e.Error, e.Status)
+		case e.Artifact != nil:
+			return e.Artifact, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("lost the build's event stream: %w", err)
+	}
+	return nil, fmt.Errorf("build service ended the event stream without a result")
+}
+
+// uploadBody returns the multipart body of req, written as it is read, and
+// its content type. Reading fails with the first error packaging it.
+func uploadBody(req Request) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUpload(mw, req))
+	}()
+	return pr, mw.FormDataContentType()
+}
+
+// writeUpload writes the config, manifest and context parts of req.
+func writeUpload(mw *multipart.Writer, req Request) error {
+	if err := copyPart(mw, fieldConfig, req.ConfigPath); err != nil {
+		return err
+	}
+	if req.ManifestPath != "" {
+		if err := copyPart(mw, fieldManifest, req.ManifestPath); err != nil {
+			return err
+		}
+	}
+	w, err := mw.CreateFormFile(fieldContext, "context.tar.gz")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(req.ConfigPath)
+	exclude := append([]string{filepath.Base(req.ConfigPath)}, req.Exclude...)
+	if err := writeContext(w, dir, exclude, req.Keep); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// copyPart writes the file at path as the multipart field.
+func copyPart(mw *multipart.Writer, field, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	w, err := mw.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// download writes artifact a to output, checking its checksum, with its
+// manifest.json to <output>.manifest.json and <output>.sha256.
+func (c *Client) download(ctx context.Context, a *Artifact, output string) error {
+	if dir := filepath.Dir(output); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	sum, err := c.fetch(ctx, "/v1/artifacts/"+a.ID, output)
+	if err != nil {
+		return fmt.Errorf("failed to download artifact: %w", err)
+	}
+	if sum != a.SHA256 {
+		os.Remove(output)
+		return fmt.Errorf("downloaded artifact has SHA256 %s, the build service reported %s", sum, a.SHA256)
+	}
+	if a.Manifest {
+		if _, err := c.fetch(ctx, "/v1/artifacts/"+a.ID+"/manifest", output+".manifest.json"); err != nil {
+			return fmt.Errorf("failed to download manifest: %w", err)
+		}
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(output))
+	if err := os.WriteFile(output+".sha256", []byte(line), 0644); err != nil {
+		return fmt.Errorf("failed to write checksum file: %w", err)
+	}
+	return nil
+}
+
+// fetch downloads path of the service to the file dest, replacing it only
+// once complete, and returns its SHA256.
+func (c *Client) fetch(ctx context.Context, path, dest string) (string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// newRequest creates an authenticated request.
+func (c *Client) newRequest(ctx context.Context, method, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	return req, nil
+}
+
+// checkStatus returns an error with the body of a response that is not 200.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,190 @@
+package remote
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates files under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// contextFiles returns the regular files of a gzipped context tarball.
+func contextFiles(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("context is not gzipped: %v", err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("failed to read context: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			data, _ := io.ReadAll(tr)
+			files[hdr.Name] = string(data)
+		}
+	}
+}
+
+// TestBuild tests a remote build: the upload, the streamed log and the
+// download of the artifact and its manifest.
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"fledge.toml":   "version = \"1\"\nstrategy = \"initramfs\"\n",
+		"manifest.toml": "name = \"app\"\n",
+		".fledgeignore": "bin\n*.img\n",
+		"app.sh":        "echo hi",
+		"bin/app":       "binary",
+		"bin/debug":     "debug",
+		"old.img":       "stale",
+		"plugin.img":    "previous",
+	})
+
+	artifact := []byte("artifact")
+	sum := sha256.Sum256(artifact)
+	var uploaded map[string]string
+	var query string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/builds/upload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		query = r.URL.RawQuery
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uploaded = map[string]string{}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if part.FormName() == fieldContext {
+				for name, content := range contextFiles(t, part) {
+					uploaded["context:"+name] = content
+				}
+				continue
+			}
+			data, _ := io.ReadAll(part)
+			uploaded[part.FormName()] = string(data)
+		}
+		enc := json.NewEncoder(w)
+		enc.Encode(event{Log: &Log{Level: "WARN", Message: "Building", Step: "package"}})
+		enc.Encode(event{Artifact: &Artifact{ID: "0123456789abcdef", Name: "plugin.img", SHA256: hex.EncodeToString(sum[:]), Manifest: true}})
+	})
+	mux.HandleFunc("/v1/artifacts/0123456789abcdef", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(artifact)
+	})
+	mux.HandleFunc("/v1/artifacts/0123456789abcdef/manifest", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"app"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL+"/", "secret")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	var logs []Log
+	output := filepath.Join(t.TempDir(), "dist", "plugin.img")
+	_, err = c.Build(context.Background(), Request{
+		ConfigPath:   filepath.Join(dir, "fledge.toml"),
+		ManifestPath: filepath.Join(dir, "manifest.toml"),
+		Exclude:      []string{"plugin.img"},
+		Keep:         []string{"bin/app"},
+		Priority:     "high",
+		OnLog:        func(l Log) { logs = append(logs, l) },
+	}, output)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	if uploaded[fieldConfig] == "" || uploaded[fieldManifest] != "name = \"app\"\n" {
+		t.Errorf("Expected the config and manifest to be uploaded, got %v", uploaded)
+	}
+	if uploaded["context:app.sh"] != "echo hi" || uploaded["context:bin/app"] != "binary" {
+		t.Errorf("Expected the context and the kept mapping source, got %v", uploaded)
+	}
+	for _, name := range []string{"context:bin/debug", "context:old.img", "context:plugin.img", "context:fledge.toml"} {
+		if _, ok := uploaded[name]; ok {
+			t.Errorf("Expected %s to be left out of the context", strings.TrimPrefix(name, "context:"))
+		}
+	}
+	if !strings.Contains(query, "priority=high") || !strings.Contains(query, "stream=true") {
+		t.Errorf("Unexpected query %q", query)
+	}
+	if len(logs) != 1 || logs[0].Step != "package" || logs[0].SlogLevel().String() != "WARN" {
+		t.Errorf("Unexpected streamed logs: %+v", logs)
+	}
+
+	if data, _ := os.ReadFile(output); string(data) != "artifact" {
+		t.Errorf("Expected the artifact at %s, got %q", output, data)
+	}
+	if data, _ := os.ReadFile(output + ".manifest.json"); string(data) != `{"name":"app"}` {
+		t.Errorf("Expected the manifest next to the artifact, got %q", data)
+	}
+	if data, _ := os.ReadFile(output + ".sha256"); string(data) != hex.EncodeToString(sum[:])+"  plugin.img\n" {
+		t.Errorf("Unexpected checksum file %q", data)
+	}
+}
+
+// TestBuild_Failure tests that a failed remote build and a refused upload
+// return the service's error.
+func TestBuild_Failure(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"fledge.toml": "version = \"1\"\n"})
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"build failed: step exploded": func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			json.NewEncoder(w).Encode(event{Error: "build failed: step exploded", Status: http.StatusInternalServerError})
+		},
+		"tenant web already has 2 builds": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "tenant web already has 2 builds, its quota; retry later", http.StatusTooManyRequests)
+		},
+	} {
+		srv := httptest.NewServer(handler)
+		c, _ := NewClient(srv.URL, "")
+		_, err := c.Build(context.Background(), Request{ConfigPath: filepath.Join(dir, "fledge.toml")}, filepath.Join(t.TempDir(), "out.img"))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected an error mentioning %q, got %v", name, err)
+		}
+		srv.Close()
+	}
+
+	if _, err := NewClient("builder:7070", ""); err == nil {
+		t.Error("Expected a URL without scheme to be rejected")
+	}
+}
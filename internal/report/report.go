@@ -0,0 +1,336 @@
+// Package report collects timings and statistics of a build and writes them
+// to <output>.report.json, so build performance can be tracked over time.
+//
+// All Report methods are safe to call on a nil *Report, which records
+// nothing; builders therefore record unconditionally.
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix is appended to the artifact path to name its report.
+const Suffix = ".report.json"
+
+// toolVersionTimeout bounds each "<tool> --version" probe.
+const toolVersionTimeout = 5 * time.Second
+
+// toolVersionArgs lists tools that do not print their version with --version.
+var toolVersionArgs = map[string][]string{
+	"mksquashfs": {"-version"},
+	"mkfs.ext4":  {"-V"},
+	"mkfs.xfs":   {"-V"},
+	"e2fsck":     {"-V"},
+}
+
+// Report describes a single build.
+type Report struct {
+	mu sync.Mutex
+
+	FledgeVersion   string            `json:"fledge_version"`
+	Strategy        string            `json:"strategy"`
+	Output          string            `json:"output"`
+	SHA256          string            `json:"sha256,omitempty"`
+	StartedAt       time.Time         `json:"started_at"`
+	DurationMS      int64             `json:"duration_ms"`
+	Success         bool              `json:"success"`
+	Error           string            `json:"error,omitempty"`
+	Steps           []Step            `json:"steps"`
+	Downloads       []Download        `json:"downloads"`
+	DownloadedBytes int64             `json:"downloaded_bytes"`
+	Cache           Cache             `json:"cache"`
+	Sizes           map[string]int64  `json:"sizes"`
+	SizeBreakdown   *SizeBreakdown    `json:"size_breakdown,omitempty"`
+	Warnings        []string          `json:"warnings"`
+	Tools           map[string]string `json:"tools"`
+}
+
+// Step is a timed build step.
+type Step struct {
+	Name       string `json:"name"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Download is a remote input fetched by the build.
+type Download struct {
+	// Kind is the input's role, e.g. "source", "layer", "asset", "agent",
+	// "busybox", "toybox", "dash" or "mapping".
+	Kind   string `json:"kind"`
+	Source string `json:"source"`
+	Bytes  int64  `json:"bytes"`
+	// Cached is set when the input came from a local cache instead of the
+	// network.
+	Cached bool `json:"cached"`
+}
+
+// SizeBreakdown attributes the files of the assembled rootfs to the
+// top-level directory they are in and the build source that wrote them.
+type SizeBreakdown struct {
+	Bytes       int64       `json:"bytes"`
+	Files       int         `json:"files"`
+	ByDirectory []SizeShare `json:"by_directory"`
+	BySource    []SizeShare `json:"by_source"`
+}
+
+// SizeShare is the part of the rootfs in one directory or from one source.
+type SizeShare struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+	Files int    `json:"files"`
+}
+
+// Cache summarizes cache effectiveness.
+type Cache struct {
+	DownloadHits   int `json:"download_hits"`
+	DownloadMisses int `json:"download_misses"`
+	BuildKitSteps  int `json:"buildkit_steps"`
+	BuildKitCached int `json:"buildkit_cached"`
+}
+
+// New starts a report for a build of strategy writing output.
+func New(fledgeVersion, strategy, output string) *Report {
+	return &Report{
+		FledgeVersion: fledgeVersion,
+		Strategy:      strategy,
+		Output:        output,
+		StartedAt:     time.Now().UTC(),
+		Steps:         []Step{},
+		Downloads:     []Download{},
+		Sizes:         make(map[string]int64),
+		Warnings:      []string{},
+		Tools:         make(map[string]string),
+	}
+}
+
+// RecordStep records the duration and outcome of a build step.
+func (r *Report) RecordStep(name string, d time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	step := Step{Name: name, DurationMS: d.Milliseconds()}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, step)
+}
+
+// RecordDownload records a fetched input.
+func (r *Report) RecordDownload(d Download) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Downloads = append(r.Downloads, d)
+	if d.Cached {
+		r.Cache.DownloadHits++
+		return
+	}
+	r.Cache.DownloadMisses++
+	r.DownloadedBytes += d.Bytes
+}
+
+// RecordBuildKit adds the number of BuildKit steps solved and how many of
+// them were served from the BuildKit cache.
+func (r *Report) RecordBuildKit(steps, cached int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Cache.BuildKitSteps += steps
+	r.Cache.BuildKitCached += cached
+}
+
+// RecordSize records the size in bytes of an intermediate or final result,
+// such as "rootfs" or "artifact".
+func (r *Report) RecordSize(name string, bytes int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Sizes[name] = bytes
+}
+
+// RecordSizeBreakdown records where the rootfs size comes from.
+func (r *Report) RecordSizeBreakdown(b *SizeBreakdown) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.SizeBreakdown = b
+}
+
+// RecordArtifact records the final artifact path and its size.
+func (r *Report) RecordArtifact(path string) {
+	if r == nil {
+		return
+	}
+	info, err := os.Stat(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Output = path
+	if err == nil {
+		r.Sizes["artifact"] = info.Size()
+	}
+}
+
+// RecordChecksum records the SHA256 of the verified artifact.
+func (r *Report) RecordChecksum(sha256 string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.SHA256 = sha256
+}
+
+// Warn records a warning logged during the build. args are the logger's
+// alternating key/value pairs.
+func (r *Report) Warn(msg string, args []any) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Warnings = append(r.Warnings, FormatWarning(msg, args))
+}
+
+// FormatWarning renders a warning and the logger's alternating key/value
+// pairs as a single line.
+func FormatWarning(msg string, args []any) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	return b.String()
+}
+
+// UseTool notes that the build ran an external tool; its version is looked
+// up when the report is finished.
+func (r *Report) UseTool(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.Tools[name]; !ok {
+		r.Tools[name] = ""
+	}
+}
+
+// Finish records the build outcome and resolves tool versions.
+func (r *Report) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DurationMS = time.Since(r.StartedAt).Milliseconds()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+	for name, v := range r.Tools {
+		if v == "" {
+			r.Tools[name] = toolVersion(name)
+		}
+	}
+}
+
+// Path returns where the report for the current output is written.
+func (r *Report) Path() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Output + Suffix
+}
+
+// Write saves the report next to the artifact.
+func (r *Report) Write() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.SliceStable(r.Downloads, func(i, j int) bool { return r.Downloads[i].Kind < r.Downloads[j].Kind })
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode build report: %w", err)
+	}
+	path := r.Output + Suffix
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write build report: %w", err)
+	}
+	return nil
+}
+
+// toolVersion returns the first line of the tool's version output.
+func toolVersion(name string) string {
+	args, ok := toolVersionArgs[name]
+	if !ok {
+		args = []string{"--version"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), toolVersionTimeout)
+	defer cancel()
+	// Some tools print their version to stderr or exit non-zero after doing so
+	output, _ := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return "unknown"
+}
+
+// DirSize returns the total size of the regular files under dir.
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying r.
+func NewContext(ctx context.Context, r *Report) context.Context {
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the report carried by ctx, or nil.
+func FromContext(ctx context.Context) *Report {
+	r, _ := ctx.Value(contextKey{}).(*Report)
+	return r
+}
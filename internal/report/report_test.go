@@ -0,0 +1,99 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReport_Write tests recording build statistics and writing the report.
+func TestReport_Write(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "plugin.img")
+	if err := os.WriteFile(output, []byte("artifact"), 0644); err != nil {
+		t.Fatalf("Failed to write artifact: %v", err)
+	}
+
+	r := New("v1.2.3", "oci_rootfs", filepath.Join(dir, "planned.img"))
+	r.RecordStep("Download OCI image", 1500*time.Millisecond, nil)
+	r.RecordStep("Create squashfs image", time.Second, errors.New("mksquashfs failed"))
+	r.RecordDownload(Download{Kind: "source", Source: "nginx:latest", Bytes: 100})
+	r.RecordDownload(Download{Kind: "mapping", Source: "https://example.com/a", Bytes: 50, Cached: true})
+	r.RecordBuildKit(4, 3)
+	r.RecordSize("rootfs", 1024)
+	r.RecordArtifact(output)
+	r.Warn("Cached download is corrupt", []any{"url", "https://example.com/a"})
+	r.Finish(errors.New("build failed"))
+
+	if err := r.Write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if r.Path() != output+Suffix {
+		t.Errorf("Expected report next to the artifact, got %s", r.Path())
+	}
+
+	data, err := os.ReadFile(output + Suffix)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var got Report
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to parse report: %v", err)
+	}
+	if got.Success || got.Error != "build failed" || got.FledgeVersion != "v1.2.3" {
+		t.Errorf("Unexpected outcome: success=%v error=%q version=%q", got.Success, got.Error, got.FledgeVersion)
+	}
+	if len(got.Steps) != 2 || got.Steps[0].DurationMS != 1500 || got.Steps[1].Error != "mksquashfs failed" {
+		t.Errorf("Unexpected steps: %+v", got.Steps)
+	}
+	if got.DownloadedBytes != 100 || got.Cache.DownloadHits != 1 || got.Cache.DownloadMisses != 1 {
+		t.Errorf("Unexpected download statistics: %d bytes, %+v", got.DownloadedBytes, got.Cache)
+	}
+	if got.Cache.BuildKitSteps != 4 || got.Cache.BuildKitCached != 3 {
+		t.Errorf("Unexpected BuildKit statistics: %+v", got.Cache)
+	}
+	if got.Sizes["rootfs"] != 1024 || got.Sizes["artifact"] != 8 {
+		t.Errorf("Unexpected sizes: %v", got.Sizes)
+	}
+	if len(got.Warnings) != 1 || got.Warnings[0] != "Cached download is corrupt url=https://example.com/a" {
+		t.Errorf("Unexpected warnings: %v", got.Warnings)
+	}
+}
+
+// TestReport_Nil tests that a nil report records nothing and does not panic.
+func TestReport_Nil(t *testing.T) {
+	var r *Report
+	r.RecordStep("step", time.Second, nil)
+	r.RecordDownload(Download{Kind: "source"})
+	r.RecordSize("rootfs", 1)
+	r.UseTool("mksquashfs")
+	r.Finish(nil)
+	if err := r.Write(); err != nil {
+		t.Errorf("Expected nil report to write nothing, got %v", err)
+	}
+
+	if FromContext(context.Background()) != nil {
+		t.Error("Expected no report in an empty context")
+	}
+	r = New("v1", "initramfs", "out.cpio.gz")
+	if FromContext(NewContext(context.Background(), r)) != r {
+		t.Error("Expected report from context")
+	}
+}
+
+// TestReport_ToolVersions tests resolving versions of the tools a build used.
+func TestReport_ToolVersions(t *testing.T) {
+	r := New("v1", "initramfs", filepath.Join(t.TempDir(), "out"))
+	r.UseTool("fledge-no-such-tool")
+	r.Finish(nil)
+	if r.Tools["fledge-no-such-tool"] != "unknown" {
+		t.Errorf("Expected unknown version for a missing tool, got %q", r.Tools["fledge-no-such-tool"])
+	}
+	if !r.Success {
+		t.Error("Expected successful build")
+	}
+}
@@ -0,0 +1,121 @@
+// Package retry re-runs flaky operations, such as registry pulls, downloads
+// and microVM launches, with jittered exponential backoff.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// Policy controls how often and how patiently an operation is retried.
+type Policy struct {
+	// Attempts is the total number of tries, including the first; values
+	// below 2 disable retries.
+	Attempts int
+	// Delay is the backoff before the second try; it doubles per attempt.
+	Delay time.Duration
+	// MaxDelay caps a single backoff.
+	MaxDelay time.Duration
+}
+
+// Policies groups the policies for each class of flaky operation.
+type Policies struct {
+	// Network covers image pulls and inspections, and file downloads.
+	Network Policy
+	// VM covers launching the microVMs that run Dockerfile steps.
+	VM Policy
+}
+
+// Defaults returns the policies used when a build configures none.
+func Defaults() Policies {
+	return Policies{
+		Network: Policy{Attempts: 3, Delay: 2 * time.Second, MaxDelay: 30 * time.Second},
+		VM:      Policy{Attempts: 2, Delay: time.Second, MaxDelay: 5 * time.Second},
+	}
+}
+
+// permanentError marks a failure that retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Do returns it without retrying, e.g. for a
+// missing image or a 404.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Do runs fn until it succeeds, returns a Permanent error, ctx is done or the
+// attempts are used up. what names the operation in logs and errors.
+func (p Policy) Do(ctx context.Context, what string, fn func(ctx context.Context) error) error {
+	attempts := max(p.Attempts, 1)
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := p.backoff(attempt)
+			logging.Warn("Retrying after failure", "operation", what, "attempt", attempt+1, "attempts", attempts, "delay", delay, "error", err)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		err = fn(ctx)
+		if err == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	if attempts > 1 {
+		return fmt.Errorf("%s failed after %d attempts: %w", what, attempts, err)
+	}
+	return err
+}
+
+// backoff returns the jittered delay before the given attempt (1 for the
+// first retry). The delay is drawn from [d/2, d] so that concurrent builds
+// hitting the same registry do not retry in lockstep.
+func (p Policy) backoff(attempt int) time.Duration {
+	d := p.Delay << (attempt - 1)
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d <= 0) {
+		d = p.MaxDelay
+	}
+	if d <= 1 {
+		return max(d, 0)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p Policies) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the policies carried by ctx, or Defaults.
+func FromContext(ctx context.Context) Policies {
+	if p, ok := ctx.Value(contextKey{}).(Policies); ok {
+		return p
+	}
+	return Defaults()
+}
@@ -0,0 +1,95 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDo_RetriesUntilSuccess tests that transient failures are retried.
+func TestDo_RetriesUntilSuccess(t *testing.T) {
+	calls := 0
+	err := Policy{Attempts: 3, Delay: time.Millisecond}.Do(context.Background(), "op", func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("flaky")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+}
+
+// TestDo_GivesUp tests that the last error is returned once attempts run out.
+func TestDo_GivesUp(t *testing.T) {
+	calls := 0
+	err := Policy{Attempts: 2, Delay: time.Millisecond}.Do(context.Background(), "pull image", func(ctx context.Context) error {
+		calls++
+		return errors.New("connection reset")
+	})
+	if err == nil || !strings.Contains(err.Error(), "pull image failed after 2 attempts: connection reset") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", calls)
+	}
+}
+
+// TestDo_Permanent tests that permanent errors are not retried.
+func TestDo_Permanent(t *testing.T) {
+	calls := 0
+	notFound := errors.New("manifest unknown")
+	err := Policy{Attempts: 5, Delay: time.Millisecond}.Do(context.Background(), "op", func(ctx context.Context) error {
+		calls++
+		return Permanent(notFound)
+	})
+	if err != notFound {
+		t.Errorf("Expected the unwrapped permanent error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+}
+
+// TestDo_Cancelled tests that a cancelled context stops the backoff.
+func TestDo_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Policy{Attempts: 5, Delay: time.Hour}.Do(ctx, "op", func(ctx context.Context) error {
+		calls++
+		cancel()
+		return errors.New("failed")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("Expected one failed call, got %d calls and %v", calls, err)
+	}
+}
+
+// TestBackoff tests that delays double, stay jittered within bounds and are capped.
+func TestBackoff(t *testing.T) {
+	p := Policy{Attempts: 10, Delay: time.Second, MaxDelay: 4 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 8: 4 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if got := p.backoff(attempt); got < want/2 || got > want {
+				t.Errorf("backoff(%d) = %s, want within [%s, %s]", attempt, got, want/2, want)
+			}
+		}
+	}
+}
+
+// TestFromContext tests that policies travel with the context and default otherwise.
+func TestFromContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != Defaults() {
+		t.Errorf("Expected defaults, got %+v", got)
+	}
+	p := Policies{Network: Policy{Attempts: 7}}
+	if got := FromContext(NewContext(context.Background(), p)); got != p {
+		t.Errorf("Expected %+v, got %+v", p, got)
+	}
+}
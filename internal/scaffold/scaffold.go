@@ -0,0 +1,156 @@
+// Package scaffold writes starter plugin directories for common plugin
+// archetypes: a Dockerfile or payload, fledge.toml and manifest.toml that
+// build as they are, for fledge new.
+//
+// Each template is a directory under templates/ whose files end in .tmpl
+// and are rendered with text/template, so that Go sources and go.mod in a
+// template are not part of this module.
+package scaffold
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//go:embed all:templates
+var templates embed.FS
+
+// Template describes a plugin template.
+type Template struct {
+	Name        string
+	Description string
+}
+
+// descriptions describe each directory under templates/.
+var descriptions = map[string]string{
+	"go-service":   "Go HTTP service built by a multi-stage Dockerfile into a squashfs rootfs",
+	"python-app":   "Python application on python:3.12-slim, with requirements.txt",
+	"nginx-static": "Static website served by nginx:alpine from site/",
+	"custom-init":  "initramfs whose own shell script runs as PID 1 and starts the payload",
+}
+
+// Templates returns the available templates, by name.
+func Templates() []Template {
+	list := make([]Template, 0, len(descriptions))
+	for name, desc := range descriptions {
+		list = append(list, Template{Name: name, Description: desc})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Options configure the files a template writes.
+type Options struct {
+	// Name names the plugin in manifest.toml and the sources; empty uses
+	// the directory's name.
+	Name string
+	// Force overwrites files that already exist.
+	Force bool
+}
+
+// nameRe matches the characters a plugin name may not contain.
+var nameRe = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// PluginName turns s, such as a directory name, into a plugin name:
+// lowercase letters, digits and hyphens.
+func PluginName(s string) string {
+	return strings.Trim(nameRe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// Write renders the template name into dir, creating it if needed, and
+// returns the paths written, relative to dir. Nothing is written if a file
+// exists already, unless opts.Force is set.
+func Write(name, dir string, opts Options) ([]string, error) {
+	if _, ok := descriptions[name]; !ok {
+		var names []string
+		for _, t := range Templates() {
+			names = append(names, t.Name)
+		}
+		return nil, fmt.Errorf("unknown template %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	if opts.Name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		opts.Name = filepath.Base(abs)
+	}
+	pluginName := PluginName(opts.Name)
+	if pluginName == "" {
+		return nil, fmt.Errorf("plugin name %q has no letters or digits", opts.Name)
+	}
+
+	files, err := render(name, pluginName)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	if !opts.Force {
+		for _, p := range paths {
+			if _, err := os.Lstat(filepath.Join(dir, p)); err == nil {
+				return nil, fmt.Errorf("%s already exists (use --force to overwrite)", filepath.Join(dir, p))
+			}
+		}
+	}
+
+	for _, p := range paths {
+		target := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", filepath.Dir(target), err)
+		}
+		// Scripts, such as a custom init, must be executable in the
+		// artifact
+		mode := os.FileMode(0644)
+		if bytes.HasPrefix(files[p], []byte("#!")) {
+			mode = 0755
+		}
+		if err := os.WriteFile(target, files[p], mode); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", target, err)
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// render returns the files of template name for the plugin pluginName, by
+// slash-separated path.
+func render(name, pluginName string) (map[string][]byte, error) {
+	root := path.Join("templates", name)
+	files := map[string][]byte{}
+	err := fs.WalkDir(templates, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := templates.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimSuffix(strings.TrimPrefix(p, root+"/"), ".tmpl")
+		tpl, err := template.New(rel).Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("template %s: %w", p, err)
+		}
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, struct{ Name string }{pluginName}); err != nil {
+			return fmt.Errorf("template %s: %w", p, err)
+		}
+		files[rel] = buf.Bytes()
+		return nil
+	})
+	return files, err
+}
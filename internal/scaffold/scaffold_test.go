@@ -0,0 +1,85 @@
+package scaffold
+
+import (
+	"go/format"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestWrite tests that every template writes a plugin whose fledge.toml and
+// manifest.toml load.
+func TestWrite(t *testing.T) {
+	for _, tpl := range Templates() {
+		dir := filepath.Join(t.TempDir(), "My App")
+		paths, err := Write(tpl.Name, dir, Options{})
+		if err != nil {
+			t.Fatalf("Write(%s): %v", tpl.Name, err)
+		}
+		if len(paths) == 0 {
+			t.Fatalf("Expected %s to write files", tpl.Name)
+		}
+		if _, err := config.Load(filepath.Join(dir, "fledge.toml")); err != nil {
+			t.Errorf("%s: fledge.toml does not load: %v", tpl.Name, err)
+		}
+		manifest, err := config.LoadManifestTemplate(filepath.Join(dir, "manifest.toml"))
+		if err != nil {
+			t.Errorf("%s: manifest.toml does not load: %v", tpl.Name, err)
+		} else if manifest.Name != "my-app" {
+			t.Errorf("%s: expected the plugin to be named my-app, got %q", tpl.Name, manifest.Name)
+		}
+		for _, p := range paths {
+			if strings.HasSuffix(p, ".tmpl") {
+				t.Errorf("%s: expected %s without its .tmpl suffix", tpl.Name, p)
+			}
+			if strings.HasSuffix(p, ".go") {
+				src, _ := os.ReadFile(filepath.Join(dir, p))
+				if _, err := format.Source(src); err != nil {
+					t.Errorf("%s: %s is not valid Go: %v", tpl.Name, p, err)
+				}
+			}
+		}
+	}
+
+	// Scripts are executable
+	dir := t.TempDir()
+	if _, err := Write("custom-init", dir, Options{Name: "demo"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "init")); err != nil || info.Mode().Perm()&0111 == 0 {
+		t.Errorf("Expected init to be executable, got %v, %v", info.Mode(), err)
+	}
+}
+
+// TestWriteExisting tests that existing files are only overwritten with
+// Force.
+func TestWriteExisting(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fledge.toml"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Write("nginx-static", dir, Options{}); err == nil {
+		t.Fatal("Expected an existing fledge.toml to be refused")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Dockerfile")); err == nil {
+		t.Error("Expected nothing to be written when a file exists")
+	}
+	if _, err := Write("nginx-static", dir, Options{Force: true}); err != nil {
+		t.Fatalf("Write with Force: %v", err)
+	}
+	if _, err := Write("wordpress", t.TempDir(), Options{}); err == nil {
+		t.Error("Expected an unknown template to be refused")
+	}
+}
+
+// TestPluginName tests deriving plugin names from directory names.
+func TestPluginName(t *testing.T) {
+	for in, want := range map[string]string{"My App": "my-app", "api_v2": "api-v2", "--x--": "x", "日本": ""} {
+		if got := PluginName(in); got != want {
+			t.Errorf("PluginName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
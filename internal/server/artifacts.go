@@ -0,0 +1,445 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/publish"
+)
+
+// artifactMetaFile holds an artifact's metadata inside its store directory.
+const artifactMetaFile = "artifact.json"
+
+// artifactPruneInterval is how often the store removes expired artifacts.
+const artifactPruneInterval = time.Minute
+
+// errArtifactNotFound is returned for unknown artifact IDs.
+var errArtifactNotFound = errors.New("artifact not found")
+
+// Artifact describes a finished build kept by the daemon.
+type Artifact struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Strategy  string    `json:"strategy"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+	// Manifest is set when the build's manifest.json was kept as well.
+	Manifest bool `json:"manifest"`
+	// ExpiresAt is when the daemon removes the artifact; zero keeps it until
+	// it is deleted or evicted by the store's size limit.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// artifactStore keeps finished artifacts under dir/<id>/, together with their
+// manifest.json and metadata, so clients can download them over HTTP.
+// The metadata file is written last, so partially stored artifacts are never
+// listed.
+type artifactStore struct {
+	dir string
+	// ttl is the lifetime of artifacts whose build did not ask for one;
+	// zero keeps them.
+	ttl time.Duration
+	// maxBytes bounds the total size of the store; the oldest artifacts are
+	// evicted beyond it. Zero means no limit.
+	maxBytes int64
+
+	// pruneMu serializes removals, so that concurrent prunes do not evict
+	// more than needed.
+	pruneMu sync.Mutex
+}
+
+// newArtifactStore opens (and creates) the artifact store at dir.
+func newArtifactStore(dir string) (*artifactStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory %s: %w", dir, err)
+	}
+	return &artifactStore{dir: dir}, nil
+}
+
+// add copies the artifact at path, and its ".manifest.json" sidecar if
+// present, into the store. With move set the files are renamed when possible
+// instead of copied. The artifact expires after ttl, or the store's default
+// when ttl is zero, and older artifacts are evicted to make room for it.
+func (s *artifactStore) add(path, strategy string, move bool, ttl time.Duration) (*Artifact, error) {
+	id, err := newArtifactID()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.dir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+
+	a := &Artifact{ID: id, Name: filepath.Base(path), Strategy: strategy, CreatedAt: time.Now().UTC()}
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	if ttl > 0 {
+		a.ExpiresAt = a.CreatedAt.Add(ttl)
+	}
+	size, sum, err := transferFile(path, filepath.Join(dir, a.Name), move)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	a.Size, a.SHA256 = size, sum
+
+	manifestPath := path + ".manifest.json"
+	if _, err := os.Stat(manifestPath); err == nil {
+		if _, _, err := transferFile(manifestPath, filepath.Join(dir, "manifest.json"), move); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		a.Manifest = true
+	}
+
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to encode artifact metadata: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, artifactMetaFile), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to write artifact metadata: %w", err)
+	}
+	s.prune(a.ID)
+	return a, nil
+}
+
+// remove deletes artifact id from the store.
+func (s *artifactStore) remove(id string) error {
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+	return s.removeLocked(id)
+}
+
+func (s *artifactStore) removeLocked(id string) error {
+	if !validArtifactID(id) {
+		return errArtifactNotFound
+	}
+	// The metadata goes first so that the artifact is never listed half
+	// removed; open downloads keep reading the unlinked file.
+	if err := os.Remove(filepath.Join(s.dir, id, artifactMetaFile)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errArtifactNotFound
+		}
+		return fmt.Errorf("failed to remove artifact %s: %w", id, err)
+	}
+	if err := os.RemoveAll(filepath.Join(s.dir, id)); err != nil {
+		return fmt.Errorf("failed to remove artifact %s: %w", id, err)
+	}
+	return nil
+}
+
+// prune removes expired artifacts, then the oldest ones until the store fits
+// in maxBytes. The artifact keep is never evicted for size, so that a single
+// artifact larger than the limit survives until it expires.
+func (s *artifactStore) prune(keep string) {
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+	artifacts, err := s.list()
+	if err != nil {
+		logging.Warn("Failed to prune artifacts", "error", err)
+		return
+	}
+	now := time.Now()
+	var total int64
+	var kept []Artifact
+	for _, a := range artifacts {
+		if !a.ExpiresAt.IsZero() && now.After(a.ExpiresAt) {
+			s.evict(a, "expired")
+			continue
+		}
+		total += a.Size
+		kept = append(kept, a)
+	}
+	if s.maxBytes <= 0 {
+		return
+	}
+	// list returns the newest first
+	for i := len(kept) - 1; i >= 0 && total > s.maxBytes; i-- {
+		if kept[i].ID == keep {
+			continue
+		}
+		s.evict(kept[i], "store size limit")
+		total -= kept[i].Size
+	}
+}
+
+// evict removes artifact a on behalf of the retention policy. pruneMu must
+// be held.
+func (s *artifactStore) evict(a Artifact, reason string) {
+	if err := s.removeLocked(a.ID); err != nil && !errors.Is(err, errArtifactNotFound) {
+		logging.Warn("Failed to remove artifact", "id", a.ID, "error", err)
+		return
+	}
+	logging.Info("Removed artifact", "id", a.ID, "name", a.Name, "reason", reason)
+}
+
+// pruneLoop prunes the store every artifactPruneInterval until done is closed.
+func (s *artifactStore) pruneLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(artifactPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.prune("")
+		case <-done:
+			return
+		}
+	}
+}
+
+// get returns the metadata of artifact id.
+func (s *artifactStore) get(id string) (*Artifact, error) {
+	if !validArtifactID(id) {
+		return nil, errArtifactNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id, artifactMetaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errArtifactNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var a Artifact
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of artifact %s: %w", id, err)
+	}
+	return &a, nil
+}
+
+// list returns all stored artifacts, newest first.
+func (s *artifactStore) list() ([]Artifact, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact directory: %w", err)
+	}
+	artifacts := make([]Artifact, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		a, err := s.get(e.Name())
+		if err != nil {
+			// Incomplete or foreign directories are not artifacts
+			continue
+		}
+		artifacts = append(artifacts, *a)
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].CreatedAt.After(artifacts[j].CreatedAt)
+	})
+	return artifacts, nil
+}
+
+// path returns the file of artifact a, or its manifest.json.
+func (s *artifactStore) path(a *Artifact, manifest bool) string {
+	if manifest {
+		return filepath.Join(s.dir, a.ID, "manifest.json")
+	}
+	return filepath.Join(s.dir, a.ID, a.Name)
+}
+
+// listArtifactsHandler serves GET /v1/artifacts, listing the artifacts of
+// the caller's tenant.
+func listArtifactsHandler(tenants *tenantSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tenant, ok := tenants.forRequest(w, r)
+		if !ok {
+			return
+		}
+		artifacts, err := tenant.store.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(artifactList{artifacts})
+	}
+}
+
+// getArtifactHandler serves GET /v1/artifacts/{id}, which downloads the
+// artifact (honouring Range requests), DELETE /v1/artifacts/{id},
+// GET /v1/artifacts/{id}/manifest, GET /v1/artifacts/{id}/info and
+// POST /v1/artifacts/{id}/publish. Only artifacts of the caller's tenant are
+// found.
+func getArtifactHandler(tenants *tenantSet, publisher *publish.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/v1/artifacts/")
+		id, sub, _ := strings.Cut(rest, "/")
+
+		allowed := r.Method == http.MethodGet || r.Method == http.MethodHead
+		switch {
+		case sub == "publish":
+			allowed = r.Method == http.MethodPost
+		case sub == "" && r.Method == http.MethodDelete:
+			allowed = true
+		}
+		if !allowed {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tenant, ok := tenants.forRequest(w, r)
+		if !ok {
+			return
+		}
+		store := tenant.store
+
+		a, err := store.get(id)
+		if errors.Is(err, errArtifactNotFound) {
+			http.Error(w, "artifact not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch sub {
+		case "":
+			if r.Method == http.MethodDelete {
+				if err := store.remove(a.ID); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			serveArtifactFile(w, r, store.path(a, false), a.Name, "application/octet-stream")
+		case "manifest":
+			if !a.Manifest {
+				http.Error(w, "artifact has no manifest", http.StatusNotFound)
+				return
+			}
+			serveArtifactFile(w, r, store.path(a, true), "manifest.json", "application/json")
+		case "info":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(a)
+		case "publish":
+			publishArtifact(w, r, store, a, publisher)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
+
+// publishArtifact registers artifact a and its manifest with Volant.
+func publishArtifact(w http.ResponseWriter, r *http.Request, store *artifactStore, a *Artifact, publisher *publish.Client) {
+	if publisher == nil {
+		http.Error(w, "publishing is not configured (start fledge serve with --volant-api)", http.StatusNotImplemented)
+		return
+	}
+	if !a.Manifest {
+		http.Error(w, "artifact has no manifest", http.StatusConflict)
+		return
+	}
+	res, err := publisher.Publish(r.Context(), store.path(a, false), store.path(a, true))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("publish failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// serveArtifactFile streams path with Range and conditional request support.
+func serveArtifactFile(w http.ResponseWriter, r *http.Request, path, name, contentType string) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "artifact file missing", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to stat artifact", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// transferFile moves or copies src to dst and returns its size and sha256.
+func transferFile(src, dst string, move bool) (int64, string, error) {
+	if move {
+		if err := os.Rename(src, dst); err == nil {
+			return hashFile(dst)
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, h), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	if move {
+		os.Remove(src)
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the size and sha256 of path.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newArtifactID returns a random 16-character hex ID.
+func newArtifactID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate artifact ID: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// validArtifactID reports whether id has the shape newArtifactID produces, so
+// IDs from URLs can never name paths outside the store.
+func validArtifactID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
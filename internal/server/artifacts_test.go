@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/volantvm/fledge/internal/publish"
+)
+
+// TestArtifactStore tests storing, listing and downloading artifacts.
+func TestArtifactStore(t *testing.T) {
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+
+	buildDir := t.TempDir()
+	output := filepath.Join(buildDir, "nginx.img")
+	if err := os.WriteFile(output, []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Failed to write artifact: %v", err)
+	}
+	if err := os.WriteFile(output+".manifest.json", []byte(`{"name":"nginx"}`), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	a, err := store.add(output, "oci_rootfs", false, 0)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if a.Size != 10 || !a.Manifest || a.SHA256 != "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882" {
+		t.Errorf("Unexpected artifact metadata: %+v", a)
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Errorf("Expected the original output to be kept when copying: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	listArtifactsHandler(newTenantSet("", store))(rec, httptest.NewRequest(http.MethodGet, "/v1/artifacts", nil))
+	var list struct {
+		Artifacts []Artifact `json:"artifacts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode listing: %v", err)
+	}
+	if len(list.Artifacts) != 1 || list.Artifacts[0].ID != a.ID {
+		t.Errorf("Expected listing with %s, got %+v", a.ID, list.Artifacts)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/artifacts/"+a.ID, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec = httptest.NewRecorder()
+	getArtifactHandler(newTenantSet("", store), nil)(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Errorf("Expected 206 with '2345', got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	getArtifactHandler(newTenantSet("", store), nil)(rec, httptest.NewRequest(http.MethodGet, "/v1/artifacts/"+a.ID+"/manifest", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"name":"nginx"}` {
+		t.Errorf("Expected manifest, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	for _, id := range []string{"0000000000000000", "..", "not-an-id"} {
+		rec = httptest.NewRecorder()
+		getArtifactHandler(newTenantSet("", store), nil)(rec, httptest.NewRequest(http.MethodGet, "/v1/artifacts/"+id, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %q, got %d", id, rec.Code)
+		}
+	}
+}
+
+// TestPublishArtifact tests publishing a stored artifact to Volant.
+func TestPublishArtifact(t *testing.T) {
+	var registered map[string]interface{}
+	volant := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			json.NewEncoder(w).Encode(map[string]string{"url": "https://volant.example/nginx.img"})
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&registered)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer volant.Close()
+
+	store, _ := newArtifactStore(t.TempDir())
+	output := filepath.Join(t.TempDir(), "nginx.img")
+	os.WriteFile(output, []byte("0123456789"), 0644)
+	os.WriteFile(output+".manifest.json", []byte(`{"name":"nginx","rootfs":{"url":"file:///tmp/nginx.img"}}`), 0644)
+	a, err := store.add(output, "oci_rootfs", true, 0)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	publishURL := "/v1/artifacts/" + a.ID + "/publish"
+	rec := httptest.NewRecorder()
+	getArtifactHandler(newTenantSet("", store), nil)(rec, httptest.NewRequest(http.MethodPost, publishURL, nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a publisher, got %d", rec.Code)
+	}
+
+	publisher, _ := publish.NewClient(volant.URL, "")
+	rec = httptest.NewRecorder()
+	getArtifactHandler(newTenantSet("", store), publisher)(rec, httptest.NewRequest(http.MethodGet, publishURL, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET publish, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	getArtifactHandler(newTenantSet("", store), publisher)(rec, httptest.NewRequest(http.MethodPost, publishURL, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rootfs, _ := registered["rootfs"].(map[string]interface{})
+	if rootfs["url"] != "https://volant.example/nginx.img" {
+		t.Errorf("Expected registered manifest to point at Volant, got %v", registered)
+	}
+}
+
+// TestArtifactRetention tests expiring artifacts, evicting the oldest beyond
+// the size limit and deleting artifacts over HTTP.
+func TestArtifactRetention(t *testing.T) {
+	store, _ := newArtifactStore(t.TempDir())
+	store.maxBytes = 30
+	add := func(ttl time.Duration) *Artifact {
+		t.Helper()
+		output := filepath.Join(t.TempDir(), "plugin.img")
+		os.WriteFile(output, []byte("0123456789"), 0644)
+		a, err := store.add(output, "initramfs", true, ttl)
+		if err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+		return a
+	}
+
+	expiring := add(time.Hour)
+	if expiring.ExpiresAt.IsZero() {
+		t.Errorf("Expected an expiry for a ttl, got %+v", expiring)
+	}
+	oldest := add(0)
+	add(0)
+	if _, err := store.get(oldest.ID); err != nil {
+		t.Fatalf("Expected %s to be kept within the size limit: %v", oldest.ID, err)
+	}
+	// A fourth artifact exceeds 30 bytes; the oldest goes first
+	newest := add(0)
+	if _, err := store.get(expiring.ID); err != errArtifactNotFound {
+		t.Errorf("Expected the oldest artifact to be evicted, got %v", err)
+	}
+	if _, err := store.get(oldest.ID); err != nil {
+		t.Errorf("Expected %s to be kept: %v", oldest.ID, err)
+	}
+
+	store.maxBytes = 0
+	meta, _ := store.get(oldest.ID)
+	meta.ExpiresAt = time.Now().Add(-time.Minute)
+	data, _ := json.Marshal(meta)
+	os.WriteFile(filepath.Join(store.dir, oldest.ID, artifactMetaFile), data, 0644)
+	store.prune("")
+	if _, err := store.get(oldest.ID); err != errArtifactNotFound {
+		t.Errorf("Expected the expired artifact to be removed, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	getArtifactHandler(newTenantSet("", store), nil)(rec, httptest.NewRequest(http.MethodDelete, "/v1/artifacts/"+newest.ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(store.dir, newest.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the artifact directory to be removed, got %v", err)
+	}
+	rec = httptest.NewRecorder()
+	getArtifactHandler(newTenantSet("", store), nil)(rec, httptest.NewRequest(http.MethodDelete, "/v1/artifacts/"+newest.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted artifact, got %d", rec.Code)
+	}
+}
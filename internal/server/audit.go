@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// Special audit log destinations accepted by openAuditLog besides a path.
+const (
+	AuditSinkStdout = "-"
+	AuditSinkSyslog = "syslog"
+)
+
+// Audit results.
+const (
+	auditOK     = "ok"
+	auditDenied = "denied"
+	auditError  = "error"
+)
+
+// auditRecord is one line of the audit log: who did what, with which
+// config, and how it ended.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// Protocol is http or grpc.
+	Protocol string `json:"protocol"`
+	// Action is the HTTP method and path, or the full gRPC method.
+	Action     string `json:"action"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// KeyFingerprint identifies the API key presented, without revealing it.
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	// KeyName names the API key the caller authenticated with.
+	KeyName string `json:"key_name,omitempty"`
+	// Tenant is the workspace of that key, when not the default one.
+	Tenant string `json:"tenant,omitempty"`
+	// ClientCert is the subject of the verified TLS client certificate.
+	ClientCert   string `json:"client_cert,omitempty"`
+	BuildID      string `json:"build_id,omitempty"`
+	ConfigDigest string `json:"config_digest,omitempty"`
+	ArtifactID   string `json:"artifact_id,omitempty"`
+	// Result is ok, denied (authentication or authorization failed) or
+	// error; Code is the HTTP status or gRPC code behind it.
+	Result     string `json:"result"`
+	Code       string `json:"code"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+
+	mu sync.Mutex
+}
+
+// auditLog appends records as JSON lines to a file, stdout or syslog. Each
+// record is written with a single write, so that records from concurrent
+// requests never interleave in an O_APPEND file.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// openAuditLog opens the audit sink dest: AuditSinkStdout, AuditSinkSyslog
+// or a file path, which is created with mode 0600 and only appended to.
+func openAuditLog(dest string) (*auditLog, error) {
+	switch dest {
+	case AuditSinkStdout:
+		return &auditLog{w: os.Stdout}, nil
+	case AuditSinkSyslog:
+		w, err := openSyslog()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		return &auditLog{w: w, c: w}, nil
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &auditLog{w: f, c: f}, nil
+}
+
+// write appends rec to the log. Failures are logged rather than failing the
+// request that was already served.
+func (l *auditLog) write(rec *auditRecord) {
+	rec.mu.Lock()
+	data, err := json.Marshal(rec)
+	rec.mu.Unlock()
+	if err != nil {
+		logging.Warn("Failed to encode audit record", "error", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		logging.Warn("Failed to write audit record", "action", rec.Action, "error", err)
+	}
+}
+
+// Close closes the audit sink.
+func (l *auditLog) Close() error {
+	if l.c == nil {
+		return nil
+	}
+	return l.c.Close()
+}
+
+type auditKey struct{}
+
+// withAudit attaches rec to ctx so that handlers can add to it.
+func withAudit(ctx context.Context, rec *auditRecord) context.Context {
+	return context.WithValue(ctx, auditKey{}, rec)
+}
+
+// auditFrom returns the record of the request of ctx, or nil when requests
+// are not audited.
+func auditFrom(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditKey{}).(*auditRecord)
+	return rec
+}
+
+// auditNote records build and artifact details of the request of ctx. Empty
+// values leave the record unchanged.
+func auditNote(ctx context.Context, buildID, artifactID string) {
+	rec := auditFrom(ctx)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if buildID != "" {
+		rec.BuildID = buildID
+	}
+	if artifactID != "" {
+		rec.ArtifactID = artifactID
+	}
+}
+
+// auditKeyName records the name and tenant of the API key the caller
+// authenticated with.
+func auditKeyName(ctx context.Context, name, tenant string) {
+	rec := auditFrom(ctx)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	rec.KeyName, rec.Tenant = name, tenant
+	rec.mu.Unlock()
+}
+
+// auditConfig records the digest of the fledge.toml the request of ctx
+// builds.
+func auditConfig(ctx context.Context, data []byte) {
+	rec := auditFrom(ctx)
+	if rec == nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	rec.mu.Lock()
+	rec.ConfigDigest = "sha256:" + hex.EncodeToString(sum[:])
+	rec.mu.Unlock()
+}
+
+// auditConfigFile is auditConfig for a config file on the daemon's host.
+func auditConfigFile(ctx context.Context, path string) {
+	if auditFrom(ctx) == nil {
+		return
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		auditConfig(ctx, data)
+	}
+}
+
+// keyFingerprint returns a short, non-reversible identifier of an API key.
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// clientCertSubject returns the subject of the verified client certificate
+// of a TLS connection, if any.
+func clientCertSubject(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.String()
+}
+
+// newHTTPAudit starts the audit record of an HTTP request.
+func newHTTPAudit(r *http.Request) *auditRecord {
+	return &auditRecord{
+		Time:           time.Now().UTC(),
+		Protocol:       "http",
+		Action:         r.Method + " " + r.URL.Path,
+		RemoteAddr:     r.RemoteAddr,
+		KeyFingerprint: keyFingerprint(presentedKey(r)),
+		ClientCert:     clientCertSubject(r.TLS),
+	}
+}
+
+// statusRecorder remembers the status an HTTP handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// auditHTTP wraps h so that every request is recorded in l.
+func auditHTTP(l *auditLog, h http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := newHTTPAudit(r)
+		ctx := withAudit(r.Context(), rec)
+		sw := &statusRecorder{ResponseWriter: w}
+		h(sw, r.WithContext(ctx))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		auditNote(ctx, w.Header().Get(buildIDHeader), w.Header().Get(artifactIDHeader))
+		if id, ok := strings.CutPrefix(r.URL.Path, "/v1/artifacts/"); ok {
+			id, _, _ = strings.Cut(id, "/")
+			auditNote(ctx, "", id)
+		}
+		rec.finish(strconv.Itoa(status), httpResult(status), "")
+		l.write(rec)
+	}
+}
+
+// httpResult classifies an HTTP status for the audit log.
+func httpResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditDenied
+	case status >= 400:
+		return auditError
+	}
+	return auditOK
+}
+
+// finish records the outcome of the request.
+func (rec *auditRecord) finish(code, result, errMsg string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.Code = code
+	rec.Result = result
+	rec.Error = errMsg
+	rec.DurationMS = time.Since(rec.Time).Milliseconds()
+}
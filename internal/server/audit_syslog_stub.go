@@ -0,0 +1,13 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog is not supported on this platform.
+func openSyslog() (io.WriteCloser, error) {
+	return nil, errors.ErrUnsupported
+}
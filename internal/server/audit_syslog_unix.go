@@ -0,0 +1,13 @@
+//go:build unix
+
+package server
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to the system logger for audit records.
+func openSyslog() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "fledge-audit")
+}
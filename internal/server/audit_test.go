@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestAuditHTTP tests that audited requests are appended to the log with the
+// caller's key fingerprint, config digest, build, artifact and result.
+func TestAuditHTTP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("openAuditLog failed: %v", err)
+	}
+	defer audit.Close()
+
+	store, _ := newArtifactStore(t.TempDir())
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		return os.WriteFile(output, []byte("artifact"), 0644)
+	}
+	handler := auditHTTP(audit, buildHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), nil, 0, build, build))
+
+	cfg := "version = \"1\"\nstrategy = \"initramfs\"\n"
+	body, _ := json.Marshal(buildRequest{Config: cfg})
+	req := httptest.NewRequest(http.MethodPost, "/v1/build", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer secret")
+	handler(httptest.NewRecorder(), req)
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/build", nil))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	var recs []*auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rec := &auditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", scanner.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("Expected 2 audit records, got %d", len(recs))
+	}
+
+	first := recs[0]
+	if first.Action != "POST /v1/build" || first.Result != auditOK || first.Code != "200" {
+		t.Errorf("Unexpected first record: %s %s %s", first.Action, first.Result, first.Code)
+	}
+	if first.KeyFingerprint != keyFingerprint("secret") || strings.Contains(first.KeyFingerprint, "secret") {
+		t.Errorf("Expected the key's fingerprint, got %q", first.KeyFingerprint)
+	}
+	sum := sha256.Sum256([]byte(cfg))
+	if first.ConfigDigest != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the config digest, got %q", first.ConfigDigest)
+	}
+	if first.BuildID == "" || first.ArtifactID == "" {
+		t.Errorf("Expected build and artifact IDs, got %q and %q", first.BuildID, first.ArtifactID)
+	}
+	if recs[1].Result != auditError || recs[1].Code != "405" {
+		t.Errorf("Unexpected second record: %s %s", recs[1].Result, recs[1].Code)
+	}
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// Scopes grant API keys access to groups of endpoints.
+const (
+	// ScopeBuild starts and cancels builds.
+	ScopeBuild = "build"
+	// ScopeRead lists, downloads and watches builds and artifacts.
+	ScopeRead = "read"
+	// ScopeAdmin deletes and publishes artifacts, and implies every other
+	// scope.
+	ScopeAdmin = "admin"
+)
+
+// staticKeyName names the key given with Options.APIKey in the audit log.
+const staticKeyName = "api-key"
+
+// apiKeysFile is the format of Options.APIKeysFile:
+//
+//	[[keys]]
+//	name = "ci"
+//	key_sha256 = "9f86d0…"   # or key = "…"
+//	scopes = ["build", "read"]
+//	tenant = "team-a"         # optional
+//
+//	[tenants.team-a]          # optional quota overrides
+//	max_disk = "50G"
+//	max_builds = 4
+type apiKeysFile struct {
+	Keys []struct {
+		Name      string   `toml:"name"`
+		Key       string   `toml:"key"`
+		KeySHA256 string   `toml:"key_sha256"`
+		Scopes    []string `toml:"scopes"`
+		Tenant    string   `toml:"tenant"`
+	} `toml:"keys"`
+	Tenants map[string]struct {
+		MaxDisk   string `toml:"max_disk"`
+		MaxBuilds int    `toml:"max_builds"`
+	} `toml:"tenants"`
+}
+
+// apiKey is a key the daemon accepts, kept only as its digest.
+type apiKey struct {
+	name   string
+	digest [sha256.Size]byte
+	scopes map[string]bool
+	// tenant names the workspace the key's builds and artifacts live in;
+	// empty is the default workspace.
+	tenant string
+}
+
+// allows reports whether the key grants scope.
+func (k *apiKey) allows(scope string) bool {
+	return k.scopes[ScopeAdmin] || k.scopes[scope]
+}
+
+// authStore holds the API keys of the daemon. Keys from a file are reloaded
+// whenever the file changes, so keys can be added, rotated and revoked
+// without restarting the daemon.
+type authStore struct {
+	static *apiKey
+	path   string
+	oidc   *oidcVerifier
+
+	mu   sync.Mutex
+	keys []*apiKey
+	// quotas are the per-tenant quotas of the file; zero fields keep the
+	// daemon's default.
+	quotas  map[string]TenantQuota
+	modTime time.Time
+	size    int64
+}
+
+// newAuthStore returns the store of the static admin key, the keys in path
+// and the tokens oidc accepts, or nil when none is set and the API is open.
+func newAuthStore(static, path string, oidc *oidcVerifier) (*authStore, error) {
+	if static == "" && path == "" && oidc == nil {
+		return nil, nil
+	}
+	s := &authStore{path: path, oidc: oidc}
+	if static != "" {
+		s.static = &apiKey{name: staticKeyName, digest: sha256.Sum256([]byte(static)), scopes: map[string]bool{ScopeAdmin: true}}
+	}
+	if path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API keys: %w", err)
+		}
+		keys, quotas, err := loadAPIKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		s.keys, s.quotas, s.modTime, s.size = keys, quotas, info.ModTime(), info.Size()
+	}
+	return s, nil
+}
+
+// loadAPIKeys parses and validates an API keys file, returning its keys
+// and tenant quotas.
+func loadAPIKeys(path string) ([]*apiKey, map[string]TenantQuota, error) {
+	var f apiKeysFile
+	if _, err := toml.DecodeFile(path, &f); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse API keys %s: %w", path, err)
+	}
+	keys := make([]*apiKey, 0, len(f.Keys))
+	names := map[string]bool{}
+	for i, entry := range f.Keys {
+		if entry.Name == "" {
+			return nil, nil, fmt.Errorf("API key %d in %s has no name", i+1, path)
+		}
+		if names[entry.Name] {
+			return nil, nil, fmt.Errorf("duplicate API key name %q in %s", entry.Name, path)
+		}
+		names[entry.Name] = true
+
+		if entry.Tenant != "" && !validTenantName(entry.Tenant) {
+			return nil, nil, fmt.Errorf("API key %q has invalid tenant %q (lowercase letters, digits, - and _)", entry.Name, entry.Tenant)
+		}
+		k := &apiKey{name: entry.Name, scopes: map[string]bool{}, tenant: entry.Tenant}
+		switch {
+		case entry.Key != "" && entry.KeySHA256 != "":
+			return nil, nil, fmt.Errorf("API key %q sets both key and key_sha256", entry.Name)
+		case entry.Key != "":
+			k.digest = sha256.Sum256([]byte(entry.Key))
+		case entry.KeySHA256 != "":
+			sum, err := hex.DecodeString(entry.KeySHA256)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, nil, fmt.Errorf("API key %q has an invalid key_sha256", entry.Name)
+			}
+			copy(k.digest[:], sum)
+		default:
+			return nil, nil, fmt.Errorf("API key %q needs key or key_sha256", entry.Name)
+		}
+		if len(entry.Scopes) == 0 {
+			return nil, nil, fmt.Errorf("API key %q has no scopes", entry.Name)
+		}
+		for _, scope := range entry.Scopes {
+			switch scope {
+			case ScopeBuild, ScopeRead, ScopeAdmin:
+				k.scopes[scope] = true
+			default:
+				return nil, nil, fmt.Errorf("API key %q has unknown scope %q (expected %s, %s or %s)", entry.Name, scope, ScopeBuild, ScopeRead, ScopeAdmin)
+			}
+		}
+		keys = append(keys, k)
+	}
+	quotas := make(map[string]TenantQuota, len(f.Tenants))
+	for name, entry := range f.Tenants {
+		if !validTenantName(name) {
+			return nil, nil, fmt.Errorf("invalid tenant %q in %s", name, path)
+		}
+		var q TenantQuota
+		if entry.MaxDisk != "" {
+			n, err := config.ParseByteSize(entry.MaxDisk)
+			if err != nil {
+				return nil, nil, fmt.Errorf("tenant %q has an invalid max_disk: %w", name, err)
+			}
+			q.MaxDiskBytes = n
+		}
+		if entry.MaxBuilds < 0 {
+			return nil, nil, fmt.Errorf("tenant %q has a negative max_builds", name)
+		}
+		q.MaxBuilds = entry.MaxBuilds
+		quotas[name] = q
+	}
+	return keys, quotas, nil
+}
+
+// reload rereads the keys file when it changed. A file that fails to load
+// keeps the previous keys, so a bad edit does not lock everyone out.
+func (s *authStore) reload() {
+	if s.path == "" {
+		return
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return
+	}
+	s.modTime, s.size = info.ModTime(), info.Size()
+	keys, quotas, err := loadAPIKeys(s.path)
+	if err != nil {
+		logging.Warn("Keeping previous API keys", "error", err)
+		return
+	}
+	s.keys, s.quotas = keys, quotas
+	logging.Info("Reloaded API keys", "path", s.path, "keys", len(keys))
+}
+
+// authenticate returns the key matching presented, or the identity of a
+// valid OIDC token, if any.
+func (s *authStore) authenticate(presented string) (*apiKey, bool) {
+	if presented == "" {
+		return nil, false
+	}
+	digest := sha256.Sum256([]byte(presented))
+	if s.static != nil && subtle.ConstantTimeCompare(digest[:], s.static.digest[:]) == 1 {
+		return s.static, true
+	}
+	s.mu.Lock()
+	s.reload()
+	keys := s.keys
+	s.mu.Unlock()
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(digest[:], k.digest[:]) == 1 {
+			return k, true
+		}
+	}
+	if s.oidc != nil && looksLikeJWT(presented) {
+		k, err := s.oidc.verify(presented)
+		if err != nil {
+			logging.Debug("Rejected OIDC token", "error", err)
+			return nil, false
+		}
+		return k, true
+	}
+	return nil, false
+}
+
+// tenantQuota returns the quota the keys file sets for tenant, if any.
+func (s *authStore) tenantQuota(tenant string) (TenantQuota, bool) {
+	if s == nil {
+		return TenantQuota{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	q, ok := s.quotas[tenant]
+	return q, ok
+}
+
+// authorize checks that presented grants scope, returning the key's tenant
+// and 0 when it does, or http.StatusUnauthorized or http.StatusForbidden. A
+// nil store allows everything in the default tenant. The key's name and
+// tenant are noted in the audit record of ctx.
+func (s *authStore) authorize(ctx context.Context, presented, scope string) (string, int) {
+	if s == nil {
+		return defaultTenant, 0
+	}
+	k, ok := s.authenticate(presented)
+	if !ok {
+		return "", http.StatusUnauthorized
+	}
+	auditKeyName(ctx, k.name, k.tenant)
+	if !k.allows(scope) {
+		return "", http.StatusForbidden
+	}
+	return k.tenant, 0
+}
+
+// presentedKey returns the API key of an HTTP request: a Bearer token or the
+// X-API-Key header.
+func presentedKey(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// grpcPresentedKey returns the API key of a gRPC call, from the
+// "authorization" (Bearer) or "x-api-key" metadata.
+func grpcPresentedKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		return strings.TrimPrefix(v[0], "Bearer ")
+	}
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// httpScope returns the scope an HTTP request needs, from the apiRoutes
+// entry it matches. HEAD needs what GET does; unknown routes need admin.
+func httpScope(r *http.Request) string {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	for _, route := range apiRoutes {
+		if route.method == method && matchRoute(route.path, r.URL.Path) {
+			return route.scope
+		}
+	}
+	return ScopeAdmin
+}
+
+// matchRoute reports whether path matches pattern, whose {name} segments
+// match any single segment.
+func matchRoute(pattern, path string) bool {
+	ps := strings.Split(pattern, "/")
+	segs := strings.Split(path, "/")
+	if len(ps) != len(segs) {
+		return false
+	}
+	for i := range ps {
+		if strings.HasPrefix(ps[i], "{") || ps[i] == segs[i] {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// grpcScopes are the scopes of the gRPC methods; unknown methods need admin.
+var grpcScopes = map[string]string{
+	"/fledge.v1.BuildService/StartBuild":          ScopeBuild,
+	"/fledge.v1.BuildService/Build":               ScopeBuild,
+	"/fledge.v1.BuildService/CancelJob":           ScopeBuild,
+	"/fledge.v1.BuildService/GetJob":              ScopeRead,
+	"/fledge.v1.BuildService/ListJobs":            ScopeRead,
+	"/fledge.v1.BuildService/WatchJob":            ScopeRead,
+	"/fledge.v1.ArtifactService/ListArtifacts":    ScopeRead,
+	"/fledge.v1.ArtifactService/GetArtifact":      ScopeRead,
+	"/fledge.v1.ArtifactService/DownloadArtifact": ScopeRead,
+	"/fledge.v1.ArtifactService/PublishArtifact":  ScopeAdmin,
+}
+
+// grpcScope returns the scope a gRPC method needs.
+func grpcScope(method string) string {
+	if scope, ok := grpcScopes[method]; ok {
+		return scope
+	}
+	return ScopeAdmin
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	fledgev1 "github.com/volantvm/fledge/api/fledge/v1"
+)
+
+// TestAuthStore tests scoped keys from a file, the static admin key and
+// reloading rotated keys.
+func TestAuthStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.toml")
+	sum := sha256.Sum256([]byte("reader-secret"))
+	write := func(content string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	write(`
+[[keys]]
+name = "ci"
+key = "ci-secret"
+scopes = ["build"]
+
+[[keys]]
+name = "dashboard"
+key_sha256 = "`+hex.EncodeToString(sum[:])+`"
+scopes = ["read"]
+`, time.Now().Add(-time.Hour))
+
+	auth, err := newAuthStore("root-secret", path, nil)
+	if err != nil {
+		t.Fatalf("newAuthStore failed: %v", err)
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		key, scope string
+		want       int
+	}{
+		{"ci-secret", ScopeBuild, 0},
+		{"ci-secret", ScopeRead, http.StatusForbidden},
+		{"reader-secret", ScopeRead, 0},
+		{"reader-secret", ScopeAdmin, http.StatusForbidden},
+		{"root-secret", ScopeAdmin, 0},
+		{"root-secret", ScopeBuild, 0},
+		{"wrong", ScopeRead, http.StatusUnauthorized},
+		{"", ScopeRead, http.StatusUnauthorized},
+	} {
+		if _, got := auth.authorize(ctx, tc.key, tc.scope); got != tc.want {
+			t.Errorf("authorize(%q, %s) = %d, want %d", tc.key, tc.scope, got, tc.want)
+		}
+	}
+
+	// Rotating the CI key takes effect without a restart
+	write("[[keys]]\nname = \"ci\"\nkey = \"ci-secret-2\"\nscopes = [\"build\", \"read\"]\n", time.Now())
+	if _, got := auth.authorize(ctx, "ci-secret", ScopeBuild); got != http.StatusUnauthorized {
+		t.Errorf("Expected the rotated-out key to be rejected, got %d", got)
+	}
+	if _, got := auth.authorize(ctx, "ci-secret-2", ScopeRead); got != 0 {
+		t.Errorf("Expected the new key to be accepted, got %d", got)
+	}
+
+	// A broken edit keeps the previous keys
+	write("[[keys]]\nname = \"ci\"\nscopes = [\"everything\"]\n", time.Now().Add(time.Minute))
+	if _, got := auth.authorize(ctx, "ci-secret-2", ScopeBuild); got != 0 {
+		t.Errorf("Expected the previous keys to be kept, got %d", got)
+	}
+
+	if _, err := newAuthStore("", filepath.Join(t.TempDir(), "missing.toml"), nil); err == nil {
+		t.Error("Expected an error for a missing keys file")
+	}
+	open, _ := newAuthStore("", "", nil)
+	if _, code := open.authorize(ctx, "", ScopeAdmin); code != 0 {
+		t.Error("Expected an open API without keys")
+	}
+}
+
+// TestScopes tests that every route and gRPC method has a scope.
+func TestScopes(t *testing.T) {
+	for _, route := range apiRoutes {
+		if route.scope == "" {
+			t.Errorf("%s %s has no scope", route.method, route.path)
+		}
+	}
+	for _, sd := range []grpc.ServiceDesc{fledgev1.BuildService_ServiceDesc, fledgev1.ArtifactService_ServiceDesc} {
+		var names []string
+		for _, m := range sd.Methods {
+			names = append(names, m.MethodName)
+		}
+		for _, st := range sd.Streams {
+			names = append(names, st.StreamName)
+		}
+		for _, name := range names {
+			if _, ok := grpcScopes["/"+sd.ServiceName+"/"+name]; !ok {
+				t.Errorf("gRPC method %s/%s has no scope", sd.ServiceName, name)
+			}
+		}
+	}
+
+	for _, tc := range []struct{ method, path, want string }{
+		{http.MethodGet, "/v1/artifacts/0123456789abcdef", ScopeRead},
+		{http.MethodHead, "/v1/artifacts/0123456789abcdef", ScopeRead},
+		{http.MethodDelete, "/v1/artifacts/0123456789abcdef", ScopeAdmin},
+		{http.MethodPost, "/v1/artifacts/0123456789abcdef/publish", ScopeAdmin},
+		{http.MethodPost, "/v1/build", ScopeBuild},
+		{http.MethodGet, "/v1/unknown", ScopeAdmin},
+	} {
+		if got := httpScope(httptest.NewRequest(tc.method, tc.path, nil)); got != tc.want {
+			t.Errorf("httpScope(%s %s) = %s, want %s", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
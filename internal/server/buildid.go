@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// buildIDHeader returns the ID that tags a build's log records.
+const buildIDHeader = "X-Fledge-Build-Id"
+
+// artifactIDHeader returns the ID of the artifact an upload build stored.
+const artifactIDHeader = "X-Fledge-Artifact-Id"
+
+// withBuildID tags ctx with a new build ID for logging and returns the ID in
+// the response headers, so that clients can find the logs of their build.
+func withBuildID(ctx context.Context, w http.ResponseWriter) context.Context {
+	id, err := newArtifactID()
+	if err != nil {
+		return ctx
+	}
+	w.Header().Set(buildIDHeader, id)
+	return logging.NewContext(ctx, logging.KeyBuildID, id)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/volantvm/fledge/internal/buildinfo"
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// capabilities is the response of GET /v1/capabilities: what builds the
+// daemon can run, for clients to check a request before submitting it.
+type capabilities struct {
+	// Version is the fledge version and APIVersion that of the HTTP API.
+	Version    string `json:"version"`
+	APIVersion string `json:"api_version"`
+	// Platform is the daemon's OS and architecture, such as "linux/amd64".
+	Platform string `json:"platform"`
+	// Architectures are the CPU architectures of the artifacts it builds.
+	Architectures []string `json:"architectures"`
+	// Strategies are the build strategies a config can select.
+	Strategies []string `json:"strategies"`
+	// Filesystems are the [filesystem] types, available if their mkfs tool
+	// is installed.
+	Filesystems []buildinfo.Backend `json:"filesystems"`
+	// Hypervisors are the microVM backends of Dockerfile RUN steps,
+	// available if installed.
+	Hypervisors []buildinfo.Backend `json:"hypervisors"`
+	// EmbeddedBuildKit is whether Dockerfile builds are supported without
+	// a buildkitd.
+	EmbeddedBuildKit bool `json:"embedded_buildkit"`
+	// CacheBackends are the caches builds use.
+	CacheBackends []string `json:"cache_backends"`
+	// Publishing is whether POST /v1/artifacts/{id}/publish is enabled.
+	Publishing bool `json:"publishing"`
+	// MaxRequestBytes and MaxUploadBytes bound request bodies.
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	MaxUploadBytes  int64 `json:"max_upload_bytes"`
+}
+
+// capabilitiesHandler serves GET /v1/capabilities. The host's tools are
+// looked up on every request, so that installing one shows without a
+// restart.
+func capabilitiesHandler(opts Options, maxRequest, maxUpload int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		info := buildinfo.Get(opts.Version, "", "")
+		host := buildinfo.ProbeHost()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(capabilities{
+			Version:          opts.Version,
+			APIVersion:       apiVersion,
+			Platform:         info.Platform,
+			Architectures:    host.Architectures,
+			Strategies:       config.Strategies,
+			Filesystems:      host.Filesystems,
+			Hypervisors:      host.Hypervisors,
+			EmbeddedBuildKit: info.Features.EmbeddedBuildKit,
+			CacheBackends:    host.CacheBackends,
+			Publishing:       opts.Publisher != nil,
+			MaxRequestBytes:  maxRequest,
+			MaxUploadBytes:   maxUpload,
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCapabilitiesHandler tests describing what builds the daemon can run.
+func TestCapabilitiesHandler(t *testing.T) {
+	h := capabilitiesHandler(Options{Version: "1.2.3"}, 1<<20, 1<<30)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/v1/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var got capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to decode capabilities: %v", err)
+	}
+	if got.Version != "1.2.3" || got.APIVersion != apiVersion || got.Publishing {
+		t.Errorf("unexpected capabilities: %+v", got)
+	}
+	if len(got.Strategies) == 0 || len(got.Filesystems) != 4 || len(got.Architectures) != 1 {
+		t.Errorf("Expected strategies, filesystems and the host architecture, got %+v", got)
+	}
+	if got.MaxRequestBytes != 1<<20 || got.MaxUploadBytes != 1<<30 {
+		t.Errorf("unexpected request limits: %d, %d", got.MaxRequestBytes, got.MaxUploadBytes)
+	}
+
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/v1/capabilities", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMagic starts a zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// extractContext unpacks a tar, tar.gz or tar.zst build context into dir.
+// Only directories, regular files and symlinks are accepted, owned by the
+// server and with their permission bits only: a client cannot plant device
+// nodes or setuid programs. Entries cannot escape dir, write through a
+// symlink or replace a file already in dir.
+func extractContext(ctx context.Context, r io.Reader, dir string) error {
+	rc, err := decompressContext(r)
+	if err != nil {
+		return fmt.Errorf("failed to extract context: %w", err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract context: %w", err)
+		}
+		if err := extractContextEntry(tr, hdr, dir); err != nil {
+			return fmt.Errorf("failed to extract context entry %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// decompressContext returns the tar stream of a context, detecting gzip and
+// zstd by their magic numbers.
+func decompressContext(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(4); err == nil && bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return io.NopCloser(br), nil
+}
+
+// extractContextEntry creates the file of hdr under dir.
+func extractContextEntry(tr *tar.Reader, hdr *tar.Header, dir string) error {
+	name := filepath.Clean(filepath.FromSlash(hdr.Name))
+	if name == "." {
+		return nil
+	}
+	if !filepath.IsLocal(name) {
+		return errors.New("path escapes the context")
+	}
+	if err := mkdirInside(dir, filepath.Dir(name)); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	perm := hdr.FileInfo().Mode().Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		info, err := os.Lstat(path)
+		if err == nil && !info.IsDir() {
+			return errors.New("not a directory")
+		}
+		if err != nil {
+			if err := os.Mkdir(path, perm|0700); err != nil {
+				return err
+			}
+		}
+		// Owner access keeps the directory writable for its entries
+		return os.Chmod(path, perm|0700)
+	case tar.TypeReg:
+		return createUploadFile(path, tr, perm)
+	case tar.TypeSymlink:
+		// Links are checked once the context is unpacked
+		return os.Symlink(hdr.Linkname, path)
+	default:
+		return fmt.Errorf("unsupported entry type %q: only directories, regular files and symlinks are accepted", hdr.Typeflag)
+	}
+}
+
+// mkdirInside creates the directory rel of dir and its parents, failing
+// when one of them exists as anything but a real directory.
+func mkdirInside(dir, rel string) error {
+	path := dir
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		if elem == "." {
+			continue
+		}
+		path = filepath.Join(path, elem)
+		info, err := os.Lstat(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if err := os.Mkdir(path, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return fmt.Errorf("%s is not a directory", elem)
+		}
+	}
+	return nil
+}
+
+// createUploadFile writes r to the new file path. It fails if path exists,
+// as a symlink too, so an upload cannot overwrite its own files or write
+// through a link it planted.
+func createUploadFile(path string, r io.Reader, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s is uploaded more than once", filepath.Base(path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,547 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	fledgev1 "github.com/volantvm/fledge/api/fledge/v1"
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/publish"
+)
+
+// maxGRPCMessageBytes bounds a gRPC request. An upload build travels in a
+// single message, so larger build contexts must use /v1/builds/upload.
+const maxGRPCMessageBytes = 1 << 30
+
+// downloadChunkSize is the size of the chunks DownloadArtifact streams.
+const downloadChunkSize = 1 << 20
+
+// grpcService implements the BuildService and ArtifactService of
+// api/fledge/v1 on top of the same tenants, limiter and build functions as the
+// HTTP endpoints. Builds run as jobs that outlive the request starting them.
+type grpcService struct {
+	fledgev1.UnimplementedBuildServiceServer
+	fledgev1.UnimplementedArtifactServiceServer
+
+	// ctx is the daemon's context; jobs are cancelled when it is done.
+	ctx         context.Context
+	tenants     *tenantSet
+	limiter     *buildLimiter
+	jobs        *jobRegistry
+	maxDuration time.Duration
+	sandbox     *pathSandbox
+	publisher   *publish.Client
+	buildFn     buildFunc
+	initramfsFn buildFunc
+}
+
+// newGRPCServer returns a gRPC server for svc, checking API keys against
+// auth, limiting each client's calls with rate and serving TLS with tlsCfg
+// when not nil, and recording calls in audit when not nil.
+func newGRPCServer(svc *grpcService, auth *authStore, rate *rateLimiter, tlsCfg *tls.Config, audit *auditLog) *grpc.Server {
+	// check rate limits and authenticates a call and runs it, recording it
+	// in audit
+	check := func(ctx context.Context, method string, run func(ctx context.Context) error) error {
+		var rec *auditRecord
+		if audit != nil {
+			rec = newGRPCAudit(ctx, method)
+			ctx = withAudit(ctx, rec)
+		}
+		var client string
+		if p, ok := peer.FromContext(ctx); ok {
+			client = clientAddr(p.Addr.String())
+		}
+		var err error
+		if ok, wait := rate.allow(client); !ok {
+			err = status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %s", wait.Round(time.Millisecond))
+		} else {
+			tenant, code := auth.authorize(ctx, grpcPresentedKey(ctx), grpcScope(method))
+			switch code {
+			case http.StatusUnauthorized:
+				err = status.Error(codes.Unauthenticated, "unauthorized")
+			case http.StatusForbidden:
+				err = status.Errorf(codes.PermissionDenied, "API key lacks the %s scope", grpcScope(method))
+			default:
+				err = run(withTenant(ctx, tenant))
+			}
+		}
+		if rec != nil {
+			code := status.Code(err)
+			rec.finish(code.String(), grpcResult(code), status.Convert(err).Message())
+			audit.write(rec)
+		}
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxGRPCMessageBytes),
+		// Bounds the handshake of new connections
+		grpc.ConnectionTimeout(15 * time.Second),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			var resp any
+			err := check(ctx, info.FullMethod, func(ctx context.Context) error {
+				var err error
+				resp, err = handler(ctx, req)
+				return err
+			})
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return check(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+				return handler(srv, contextStream{ss, ctx})
+			})
+		}),
+	}
+	if tlsCfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	s := grpc.NewServer(opts...)
+	fledgev1.RegisterBuildServiceServer(s, svc)
+	fledgev1.RegisterArtifactServiceServer(s, svc)
+	return s
+}
+
+// contextStream is a server stream with the context of its interceptor.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context { return s.ctx }
+
+// newGRPCAudit starts the audit record of a gRPC call.
+func newGRPCAudit(ctx context.Context, method string) *auditRecord {
+	rec := &auditRecord{Time: time.Now().UTC(), Protocol: "grpc", Action: method}
+	rec.KeyFingerprint = keyFingerprint(grpcPresentedKey(ctx))
+	if p, ok := peer.FromContext(ctx); ok {
+		rec.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			rec.ClientCert = clientCertSubject(&info.State)
+		}
+	}
+	return rec
+}
+
+// grpcResult classifies a gRPC status code for the audit log.
+func grpcResult(code codes.Code) string {
+	switch code {
+	case codes.OK:
+		return auditOK
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return auditDenied
+	}
+	return auditError
+}
+
+// StartBuild queues a build and returns its job without waiting for it.
+func (s *grpcService) StartBuild(ctx context.Context, req *fledgev1.StartBuildRequest) (*fledgev1.Job, error) {
+	j, err := s.startJob(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return j.proto(), nil
+}
+
+// Build starts a build and streams its events until it finishes. The job
+// keeps running when the client goes away; WatchJob picks it up again.
+func (s *grpcService) Build(req *fledgev1.StartBuildRequest, stream fledgev1.BuildService_BuildServer) error {
+	j, err := s.startJob(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	return j.watch(stream.Context(), stream.Send)
+}
+
+// GetJob returns a job by ID.
+func (s *grpcService) GetJob(ctx context.Context, req *fledgev1.GetJobRequest) (*fledgev1.Job, error) {
+	j, err := s.job(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return j.proto(), nil
+}
+
+// ListJobs returns the jobs of the caller's tenant the daemon remembers.
+func (s *grpcService) ListJobs(ctx context.Context, req *fledgev1.ListJobsRequest) (*fledgev1.ListJobsResponse, error) {
+	return &fledgev1.ListJobsResponse{Jobs: s.jobs.list(tenantFrom(ctx))}, nil
+}
+
+// CancelJob cancels a queued or running job and returns it.
+func (s *grpcService) CancelJob(ctx context.Context, req *fledgev1.CancelJobRequest) (*fledgev1.Job, error) {
+	j, err := s.job(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	j.requestCancel()
+	return j.proto(), nil
+}
+
+// WatchJob streams the log of a job from its start and follows it.
+func (s *grpcService) WatchJob(req *fledgev1.WatchJobRequest, stream fledgev1.BuildService_WatchJobServer) error {
+	j, err := s.job(stream.Context(), req.GetId())
+	if err != nil {
+		return err
+	}
+	return j.watch(stream.Context(), stream.Send)
+}
+
+// job returns job id of the caller's tenant or a NOT_FOUND error.
+func (s *grpcService) job(ctx context.Context, id string) (*job, error) {
+	auditNote(ctx, id, "")
+	j, ok := s.jobs.get(id, tenantFrom(ctx))
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "job %q not found", id)
+	}
+	return j, nil
+}
+
+// startJob prepares the build of req and runs it in the background, in the
+// workspace of the caller's tenant. Errors in the request are returned
+// before a job exists.
+func (s *grpcService) startJob(ctx context.Context, req *fledgev1.StartBuildRequest) (*job, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	release, err := s.tenants.admit(tenant)
+	if err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	priority := req.GetPriority()
+	if priority == fledgev1.BuildPriority_BUILD_PRIORITY_UNSPECIFIED {
+		priority = fledgev1.BuildPriority_BUILD_PRIORITY_NORMAL
+	} else if _, ok := fledgev1.BuildPriority_name[int32(priority)]; !ok {
+		release()
+		return nil, status.Errorf(codes.InvalidArgument, "invalid priority %d", priority)
+	}
+	ticket, ok := s.limiter.admit()
+	if !ok {
+		release()
+		return nil, status.Error(codes.ResourceExhausted, "build queue is full, retry later")
+	}
+	ticket.priority = priority
+	// Until the build goroutine takes them over, the ticket, tenant
+	// reservation and workspace are released on return
+	var workspace string
+	started := false
+	defer func() {
+		if !started {
+			ticket.release()
+			release()
+			if workspace != "" {
+				os.RemoveAll(workspace)
+			}
+		}
+	}()
+
+	var cfg *config.Config
+	var workDir, output string
+	switch src := req.GetSource().(type) {
+	case *fledgev1.StartBuildRequest_ConfigPath:
+		configPath, err := s.sandbox.check("config_path", src.ConfigPath)
+		if err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		if output, err = s.sandbox.check("output_path", req.GetOutputPath()); err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		auditConfigFile(ctx, configPath)
+		cfg, err = config.Load(configPath)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "config error: %v", err)
+		}
+		workDir = dirOf(configPath)
+		if err := s.sandbox.checkConfig(cfg, workDir); err != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "config error: %v", err)
+		}
+		if output == "" {
+			workspace, err = tenant.mkdirTemp("fledge-build-*")
+			if err != nil {
+				return nil, status.Error(codes.Internal, "failed to create workspace")
+			}
+			output = filepath.Join(workspace, filepath.Base(defaultOutput(cfg)))
+		} else {
+			if abs, err := filepath.Abs(output); err == nil {
+				output = abs
+			}
+			if !ticket.claimOutput(output) {
+				return nil, status.Errorf(codes.AlreadyExists, "another build is already writing %s", output)
+			}
+		}
+	case *fledgev1.StartBuildRequest_Upload:
+		if req.GetOutputPath() != "" {
+			return nil, status.Error(codes.InvalidArgument, "output_path is not supported for upload builds")
+		}
+		workspace, err = tenant.mkdirTemp("fledge-upload-*")
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to create workspace")
+		}
+		workDir = filepath.Join(workspace, "src")
+		if err := receiveGRPCUpload(ctx, src.Upload, workDir); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "upload error: %v", err)
+		}
+		auditConfig(ctx, src.Upload.GetConfig())
+		cfg, err = config.Load(filepath.Join(workDir, uploadConfigName))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "config error: %v", err)
+		}
+		if err := confineToWorkspace(cfg, workDir); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "config error: %v", err)
+		}
+		outDir := filepath.Join(workspace, "out")
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return nil, status.Error(codes.Internal, "failed to create output directory")
+		}
+		output = filepath.Join(outDir, filepath.Base(defaultOutput(cfg)))
+	default:
+		return nil, status.Error(codes.InvalidArgument, "config_path or upload required")
+	}
+
+	var fn buildFunc
+	switch cfg.Strategy {
+	case config.StrategyOCIRootfs:
+		fn = s.buildFn
+	case config.StrategyInitramfs:
+		fn = s.initramfsFn
+	default:
+		return nil, status.Error(codes.InvalidArgument, "unsupported strategy")
+	}
+
+	id, err := newArtifactID()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	timeout := buildTimeout(s.maxDuration, cfg)
+	guarded, stop := s.tenants.guard(tenant.buildContext(s.ctx), tenant)
+	buildCtx, cancel := context.WithTimeout(logging.NewContext(guarded, logging.KeyBuildID, id), timeout)
+	// Isolated builds report the stored artifact as their output once done
+	isolated := workspace != ""
+	jobOutput := output
+	if isolated {
+		jobOutput = ""
+	}
+	auditNote(ctx, id, "")
+	j := newJob(id, tenant.name, cfg.Strategy, jobOutput, cancel)
+	j.priority = priority
+	s.jobs.add(j)
+
+	started = true
+	go func() {
+		defer ticket.release()
+		defer release()
+		defer stop()
+		defer cancel()
+		if isolated {
+			defer os.RemoveAll(workspace)
+		}
+		stopLog := logging.OnBuildLog(buildCtx, j.appendLog)
+		defer stopLog()
+
+		if err := ticket.wait(buildCtx); err != nil {
+			j.finish("", fmt.Errorf("build cancelled while queued: %w", err))
+			return
+		}
+		j.start()
+		logging.InfoContext(buildCtx, "Starting build", logging.KeyStrategy, cfg.Strategy, "priority", priorityName(priority))
+		if err := fn(buildCtx, cfg, nil, workDir, output); err != nil {
+			switch {
+			case errors.Is(context.Cause(buildCtx), errDiskQuota):
+				err = fmt.Errorf("%w: %w", errDiskQuota, err)
+			case errors.Is(buildCtx.Err(), context.DeadlineExceeded):
+				err = fmt.Errorf("exceeded timeout of %s: %w", timeout, err)
+			}
+			logging.ErrorContext(buildCtx, "Build failed", "error", err)
+			j.finish("", err)
+			return
+		}
+
+		a, err := tenant.store.add(output, cfg.Strategy, isolated, 0)
+		switch {
+		case err == nil:
+			if isolated {
+				j.setOutput(tenant.store.path(a, false))
+			}
+			j.finish(a.ID, nil)
+		case isolated:
+			j.finish("", fmt.Errorf("failed to store artifact: %w", err))
+		default:
+			logging.WarnContext(buildCtx, "Failed to store artifact", "output", output, "error", err)
+			j.finish("", nil)
+		}
+	}()
+	return j, nil
+}
+
+// receiveGRPCUpload writes the files of an upload build into dir, like
+// receiveUpload does for a multipart body.
+func receiveGRPCUpload(ctx context.Context, u *fledgev1.Upload, dir string) error {
+	if len(u.GetConfig()) == 0 {
+		return errors.New("missing config with fledge.toml")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace: %w", err)
+	}
+	// The config and payload files are created first and exclusively, so
+	// that the context can neither replace them nor plant links under them
+	if err := createUploadFile(filepath.Join(dir, uploadConfigName), bytes.NewReader(u.GetConfig()), 0644); err != nil {
+		return err
+	}
+	for name, data := range u.GetFiles() {
+		base := filepath.Base(name)
+		if base != name || base == "." || base == ".." || base == uploadConfigName {
+			return fmt.Errorf("invalid payload file name %q", name)
+		}
+		if err := createUploadFile(filepath.Join(dir, base), bytes.NewReader(data), 0644); err != nil {
+			return err
+		}
+	}
+	if len(u.GetContext()) > 0 {
+		if err := extractContext(ctx, bytes.NewReader(u.GetContext()), dir); err != nil {
+			return err
+		}
+	}
+	return checkSymlinks(dir)
+}
+
+// ListArtifacts returns the stored artifacts of the caller's tenant.
+func (s *grpcService) ListArtifacts(ctx context.Context, req *fledgev1.ListArtifactsRequest) (*fledgev1.ListArtifactsResponse, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	artifacts, err := tenant.store.list()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &fledgev1.ListArtifactsResponse{Artifacts: make([]*fledgev1.Artifact, len(artifacts))}
+	for i := range artifacts {
+		resp.Artifacts[i] = artifactProto(&artifacts[i])
+	}
+	return resp, nil
+}
+
+// GetArtifact returns the metadata of an artifact.
+func (s *grpcService) GetArtifact(ctx context.Context, req *fledgev1.GetArtifactRequest) (*fledgev1.Artifact, error) {
+	a, _, err := s.artifact(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return artifactProto(a), nil
+}
+
+// DownloadArtifact streams an artifact, or its manifest, from an offset.
+func (s *grpcService) DownloadArtifact(req *fledgev1.DownloadArtifactRequest, stream fledgev1.ArtifactService_DownloadArtifactServer) error {
+	a, store, err := s.artifact(stream.Context(), req.GetId())
+	if err != nil {
+		return err
+	}
+	if req.GetManifest() && !a.Manifest {
+		return status.Error(codes.NotFound, "artifact has no manifest")
+	}
+	f, err := os.Open(store.path(a, req.GetManifest()))
+	if err != nil {
+		return status.Error(codes.Internal, "artifact file missing")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to stat artifact")
+	}
+	if off := req.GetOffset(); off < 0 || off > info.Size() {
+		return status.Errorf(codes.OutOfRange, "offset %d outside of the %d byte file", off, info.Size())
+	}
+	if _, err := f.Seek(req.GetOffset(), io.SeekStart); err != nil {
+		return status.Errorf(codes.Internal, "failed to seek: %v", err)
+	}
+
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&fledgev1.DownloadArtifactResponse{Chunk: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read artifact: %v", err)
+		}
+	}
+}
+
+// PublishArtifact registers an artifact and its manifest with Volant.
+func (s *grpcService) PublishArtifact(ctx context.Context, req *fledgev1.PublishArtifactRequest) (*fledgev1.PublishArtifactResponse, error) {
+	if s.publisher == nil {
+		return nil, status.Error(codes.Unimplemented, "publishing is not configured (start fledge serve with --volant-api)")
+	}
+	a, store, err := s.artifact(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if !a.Manifest {
+		return nil, status.Error(codes.FailedPrecondition, "artifact has no manifest")
+	}
+	res, err := s.publisher.Publish(ctx, store.path(a, false), store.path(a, true))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "publish failed: %v", err)
+	}
+	return &fledgev1.PublishArtifactResponse{Plugin: res.Plugin, ArtifactUrl: res.ArtifactURL, Updated: res.Updated}, nil
+}
+
+// tenant returns the tenant of the call of ctx.
+func (s *grpcService) tenant(ctx context.Context) (*tenant, error) {
+	t, err := s.tenants.forContext(ctx)
+	if err != nil {
+		logging.Error("Failed to open tenant workspace", logging.KeyTenant, tenantFrom(ctx), "error", err)
+		return nil, status.Error(codes.Internal, "failed to open tenant workspace")
+	}
+	return t, nil
+}
+
+// artifact returns artifact id of the caller's tenant, and the store
+// keeping it, or a NOT_FOUND error.
+func (s *grpcService) artifact(ctx context.Context, id string) (*Artifact, *artifactStore, error) {
+	auditNote(ctx, "", id)
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := t.store.get(id)
+	if errors.Is(err, errArtifactNotFound) {
+		return nil, nil, status.Error(codes.NotFound, "artifact not found")
+	}
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	return a, t.store, nil
+}
+
+// artifactProto converts artifact metadata to its API message.
+func artifactProto(a *Artifact) *fledgev1.Artifact {
+	return &fledgev1.Artifact{
+		Id:        a.ID,
+		Name:      a.Name,
+		Strategy:  a.Strategy,
+		Size:      a.Size,
+		Sha256:    a.SHA256,
+		CreatedAt: timestamppb.New(a.CreatedAt),
+		Manifest:  a.Manifest,
+	}
+}
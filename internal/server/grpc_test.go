@@ -0,0 +1,220 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	fledgev1 "github.com/volantvm/fledge/api/fledge/v1"
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// newTestGRPC serves a gRPC service over an in-memory connection and returns
+// a client connection to it.
+func newTestGRPC(t *testing.T, apiKey string, build buildFunc) *grpc.ClientConn {
+	t.Helper()
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	auth, err := newAuthStore(apiKey, "", nil)
+	if err != nil {
+		t.Fatalf("newAuthStore failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv := newGRPCServer(&grpcService{
+		ctx:         ctx,
+		tenants:     newTenantSet("", store),
+		limiter:     newBuildLimiter(1, 0),
+		jobs:        newJobRegistry(),
+		buildFn:     build,
+		initramfsFn: build,
+	}, auth, nil, nil, nil)
+
+	ln := bufconn.Listen(1 << 20)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestGRPCBuild tests an upload build over gRPC: its streamed log and final
+// state, the stored artifact and its download from an offset.
+func TestGRPCBuild(t *testing.T) {
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		logging.InfoContext(logging.NewContext(ctx, logging.KeyStep, "Pack"), "packing", "files", 1)
+		data, err := os.ReadFile(workDir + "/payload.bin")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(output, data, 0644)
+	}
+	conn := newTestGRPC(t, "secret", build)
+	builds := fledgev1.NewBuildServiceClient(conn)
+	artifacts := fledgev1.NewArtifactServiceClient(conn)
+
+	req := &fledgev1.StartBuildRequest{Source: &fledgev1.StartBuildRequest_Upload{Upload: &fledgev1.Upload{
+		Config: []byte("version = \"1\"\nstrategy = \"initramfs\"\n\n[mappings]\n\"payload.bin\" = \"/payload.bin\"\n"),
+		Files:  map[string][]byte{"payload.bin": []byte("0123456789")},
+	}}}
+
+	if _, err := builds.StartBuild(context.Background(), req); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Expected Unauthenticated without an API key, got %v", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	stream, err := builds.Build(ctx, req)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	var logs []*fledgev1.LogEntry
+	var last *fledgev1.Job
+	for {
+		ev, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if l := ev.GetLog(); l != nil {
+			logs = append(logs, l)
+		}
+		if j := ev.GetJob(); j != nil {
+			last = j
+		}
+	}
+	if last == nil || last.State != fledgev1.JobState_JOB_STATE_SUCCEEDED || last.ArtifactId == "" {
+		t.Fatalf("Expected a succeeded job with an artifact, got %v", last)
+	}
+	found := false
+	for _, l := range logs {
+		if l.Message == "packing" && l.Step == "Pack" && l.Attrs["files"] == "1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the build's log in the stream, got %v", logs)
+	}
+
+	got, err := builds.GetJob(ctx, &fledgev1.GetJobRequest{Id: last.Id})
+	if err != nil || got.State != fledgev1.JobState_JOB_STATE_SUCCEEDED {
+		t.Errorf("GetJob returned %v, %v", got, err)
+	}
+
+	a, err := artifacts.GetArtifact(ctx, &fledgev1.GetArtifactRequest{Id: last.ArtifactId})
+	if err != nil || a.Size != 10 {
+		t.Fatalf("GetArtifact returned %v, %v", a, err)
+	}
+	dl, err := artifacts.DownloadArtifact(ctx, &fledgev1.DownloadArtifactRequest{Id: a.Id, Offset: 4})
+	if err != nil {
+		t.Fatalf("DownloadArtifact failed: %v", err)
+	}
+	var data []byte
+	for {
+		chunk, err := dl.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		data = append(data, chunk.Chunk...)
+	}
+	if string(data) != "456789" {
+		t.Errorf("Expected '456789' from offset 4, got %q", data)
+	}
+
+	if _, err := builds.GetJob(ctx, &fledgev1.GetJobRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown job, got %v", err)
+	}
+}
+
+// TestGRPCCancelJob tests cancelling a running job.
+func TestGRPCCancelJob(t *testing.T) {
+	started := make(chan struct{})
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	conn := newTestGRPC(t, "", build)
+	builds := fledgev1.NewBuildServiceClient(conn)
+
+	j, err := builds.StartBuild(context.Background(), &fledgev1.StartBuildRequest{Source: &fledgev1.StartBuildRequest_Upload{Upload: &fledgev1.Upload{
+		Config: []byte("version = \"1\"\nstrategy = \"initramfs\"\n"),
+	}}})
+	if err != nil {
+		t.Fatalf("StartBuild failed: %v", err)
+	}
+	<-started
+	if _, err := builds.CancelJob(context.Background(), &fledgev1.CancelJobRequest{Id: j.Id}); err != nil {
+		t.Fatalf("CancelJob failed: %v", err)
+	}
+
+	stream, err := builds.WatchJob(context.Background(), &fledgev1.WatchJobRequest{Id: j.Id})
+	if err != nil {
+		t.Fatalf("WatchJob failed: %v", err)
+	}
+	var last *fledgev1.Job
+	for {
+		ev, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if ev.GetJob() != nil {
+			last = ev.GetJob()
+		}
+	}
+	if last == nil || last.State != fledgev1.JobState_JOB_STATE_CANCELLED {
+		t.Errorf("Expected a cancelled job, got %v", last)
+	}
+}
+
+// TestReceiveGRPCUpload_PlantedSymlinks tests that a context cannot
+// redirect the config or payload files out of the workspace.
+func TestReceiveGRPCUpload_PlantedSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	for _, name := range []string{uploadConfigName, "payload.bin"} {
+		var planted bytes.Buffer
+		tw := tar.NewWriter(&planted)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, name)})
+		tw.Close()
+
+		err := receiveGRPCUpload(context.Background(), &fledgev1.Upload{
+			Config:  []byte("version = \"1\"\n"),
+			Context: planted.Bytes(),
+			Files:   map[string][]byte{"payload.bin": []byte("payload")},
+		}, filepath.Join(t.TempDir(), "src"))
+		if err == nil {
+			t.Errorf("Expected a context link named %s to be refused", name)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, name)); err == nil {
+			t.Errorf("Expected nothing written outside the workspace, found %s", name)
+		}
+	}
+}
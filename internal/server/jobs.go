@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	fledgev1 "github.com/volantvm/fledge/api/fledge/v1"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// maxJobLogEntries bounds the log kept per job for WatchJob; older entries
+// are dropped first.
+const maxJobLogEntries = 10000
+
+// maxFinishedJobs bounds how many finished jobs the daemon remembers.
+const maxFinishedJobs = 256
+
+// job is a build started over gRPC. Its log and state changes are kept so
+// that any number of clients can watch it, from its start, while it runs.
+type job struct {
+	id string
+	// tenant is the tenant that started the job; only its keys see it.
+	tenant    string
+	strategy  string
+	priority  fledgev1.BuildPriority
+	createdAt time.Time
+	cancel    context.CancelFunc
+
+	mu         sync.Mutex
+	state      fledgev1.JobState
+	startedAt  time.Time
+	finishedAt time.Time
+	err        string
+	artifactID string
+	output     string
+	cancelled  bool
+	log        []*fledgev1.LogEntry
+	// dropped counts log entries removed to stay within maxJobLogEntries.
+	dropped int
+	// changed is closed, and replaced, whenever the job is updated.
+	changed chan struct{}
+}
+
+// newJob returns a queued job of tenant whose build is cancelled with
+// cancel.
+func newJob(id, tenant, strategy, output string, cancel context.CancelFunc) *job {
+	return &job{
+		id:        id,
+		tenant:    tenant,
+		strategy:  strategy,
+		output:    output,
+		createdAt: time.Now().UTC(),
+		cancel:    cancel,
+		state:     fledgev1.JobState_JOB_STATE_QUEUED,
+		changed:   make(chan struct{}),
+	}
+}
+
+// update applies fn to the job and wakes its watchers.
+func (j *job) update(fn func(j *job)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(j)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// start marks the job running.
+func (j *job) start() {
+	j.update(func(j *job) {
+		j.state = fledgev1.JobState_JOB_STATE_RUNNING
+		j.startedAt = time.Now().UTC()
+	})
+}
+
+// finish records the outcome of the job; a job cancelled with
+// requestCancel ends cancelled whatever err is.
+func (j *job) finish(artifactID string, err error) {
+	j.update(func(j *job) {
+		j.finishedAt = time.Now().UTC()
+		switch {
+		case j.cancelled:
+			j.state = fledgev1.JobState_JOB_STATE_CANCELLED
+			j.err = "build cancelled"
+		case err != nil:
+			j.state = fledgev1.JobState_JOB_STATE_FAILED
+			j.err = err.Error()
+		default:
+			j.state = fledgev1.JobState_JOB_STATE_SUCCEEDED
+			j.artifactID = artifactID
+		}
+	})
+}
+
+// requestCancel cancels the job's build unless it already finished.
+func (j *job) requestCancel() {
+	j.mu.Lock()
+	done := jobDone(j.state)
+	if !done {
+		j.cancelled = true
+	}
+	j.mu.Unlock()
+	if !done {
+		j.cancel()
+	}
+}
+
+// setOutput records where the build wrote its artifact.
+func (j *job) setOutput(output string) {
+	j.update(func(j *job) { j.output = output })
+}
+
+// appendLog adds a record of the job's build to its log.
+func (j *job) appendLog(e logging.Entry) {
+	step, attrs := entryAttrs(e)
+	entry := &fledgev1.LogEntry{
+		Time:    timestamppb.New(e.Time),
+		Level:   e.Level.String(),
+		Message: e.Message,
+		Step:    step,
+		Attrs:   attrs,
+	}
+	j.update(func(j *job) {
+		if len(j.log) == maxJobLogEntries {
+			j.log = j.log[1:]
+			j.dropped++
+		}
+		j.log = append(j.log, entry)
+	})
+}
+
+// entryAttrs returns the build step of a log record and its other
+// attributes but the build ID, which every record of a build shares.
+func entryAttrs(e logging.Entry) (string, map[string]string) {
+	var step string
+	attrs := map[string]string{}
+	for _, a := range e.Attrs {
+		switch a.Key {
+		case logging.KeyBuildID:
+		case logging.KeyStep:
+			step = a.Value.String()
+		default:
+			attrs[a.Key] = a.Value.Resolve().String()
+		}
+	}
+	return step, attrs
+}
+
+// since returns the log entries from the n-th on, counting dropped ones,
+// the job's state and a channel closed on its next update.
+func (j *job) since(n int) ([]*fledgev1.LogEntry, int, *fledgev1.Job, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	start := n - j.dropped
+	if start < 0 {
+		start = 0
+	}
+	entries := append([]*fledgev1.LogEntry(nil), j.log[start:]...)
+	return entries, j.dropped + len(j.log), j.protoLocked(), j.changed
+}
+
+// proto returns the job as sent to clients.
+func (j *job) proto() *fledgev1.Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.protoLocked()
+}
+
+func (j *job) protoLocked() *fledgev1.Job {
+	p := &fledgev1.Job{
+		Id:         j.id,
+		State:      j.state,
+		Strategy:   j.strategy,
+		CreatedAt:  timestamppb.New(j.createdAt),
+		Error:      j.err,
+		ArtifactId: j.artifactID,
+		Output:     j.output,
+		Priority:   j.priority,
+	}
+	if !j.startedAt.IsZero() {
+		p.StartedAt = timestamppb.New(j.startedAt)
+	}
+	if !j.finishedAt.IsZero() {
+		p.FinishedAt = timestamppb.New(j.finishedAt)
+	}
+	return p
+}
+
+// jobDone reports whether state is final.
+func jobDone(state fledgev1.JobState) bool {
+	switch state {
+	case fledgev1.JobState_JOB_STATE_SUCCEEDED, fledgev1.JobState_JOB_STATE_FAILED, fledgev1.JobState_JOB_STATE_CANCELLED:
+		return true
+	}
+	return false
+}
+
+// watch sends the log and state changes of j to send until j finishes or
+// ctx is done. The finished job is the last event sent.
+func (j *job) watch(ctx context.Context, send func(*fledgev1.JobEvent) error) error {
+	next := 0
+	var lastState fledgev1.JobState
+	for {
+		entries, n, state, changed := j.since(next)
+		next = n
+		for _, e := range entries {
+			if err := send(&fledgev1.JobEvent{Event: &fledgev1.JobEvent_Log{Log: e}}); err != nil {
+				return err
+			}
+		}
+		if state.State != lastState {
+			lastState = state.State
+			if err := send(&fledgev1.JobEvent{Event: &fledgev1.JobEvent_Job{Job: state}}); err != nil {
+				return err
+			}
+		}
+		if jobDone(state.State) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// jobRegistry holds the jobs of the daemon.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*job)}
+}
+
+// add registers j, forgetting the oldest finished jobs beyond
+// maxFinishedJobs.
+func (r *jobRegistry) add(j *job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[j.id] = j
+
+	var finished []*job
+	for _, other := range r.jobs {
+		other.mu.Lock()
+		if jobDone(other.state) {
+			finished = append(finished, other)
+		}
+		other.mu.Unlock()
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, k int) bool { return finished[i].createdAt.Before(finished[k].createdAt) })
+	for _, old := range finished[:len(finished)-maxFinishedJobs] {
+		delete(r.jobs, old.id)
+	}
+}
+
+// get returns job id of tenant, if the daemon remembers it.
+func (r *jobRegistry) get(id, tenant string) (*job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, ok := r.jobs[id]
+	if !ok || j.tenant != tenant {
+		return nil, false
+	}
+	return j, true
+}
+
+// list returns the jobs of tenant, newest first.
+func (r *jobRegistry) list(tenant string) []*fledgev1.Job {
+	r.mu.Lock()
+	jobs := make([]*job, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		if j.tenant == tenant {
+			jobs = append(jobs, j)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].createdAt.After(jobs[k].createdAt) })
+	out := make([]*fledgev1.Job, len(jobs))
+	for i, j := range jobs {
+		out[i] = j.proto()
+	}
+	return out
+}
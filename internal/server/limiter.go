@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	fledgev1 "github.com/volantvm/fledge/api/fledge/v1"
+)
+
+// Default build limits for fledge serve. A zero MaxConcurrentBuilds also falls
+// back to DefaultMaxConcurrentBuilds.
+const (
+	DefaultMaxConcurrentBuilds = 2
+	DefaultMaxQueuedBuilds     = 16
+)
+
+// queueFullRetryAfter is the Retry-After hint, in seconds, sent with 429.
+const queueFullRetryAfter = "30"
+
+// Build priorities of requests to fledge serve. Queued builds of a higher
+// priority start first, so that a hotfix need not wait behind bulk rebuilds.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// buildLimiter bounds how many builds run at once and how many may wait for a
+// slot. Admission is checked before a request body is read so that a full
+// queue is rejected cheaply; the slot itself is only taken once the build is
+// ready to start. A freed slot goes to the waiting build of the highest
+// priority, the longest waiting one among equals.
+type buildLimiter struct {
+	admitted   chan struct{}
+	maxRunning int
+
+	mu      sync.Mutex
+	running int
+	waiting []*buildTicket
+	// seq orders waiting builds of the same priority.
+	seq     uint64
+	outputs map[string]bool
+}
+
+// newBuildLimiter creates a limiter running at most maxConcurrent builds with
+// up to maxQueued more waiting.
+func newBuildLimiter(maxConcurrent, maxQueued int) *buildLimiter {
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrentBuilds
+	}
+	if maxQueued < 0 {
+		maxQueued = 0
+	}
+	return &buildLimiter{
+		admitted:   make(chan struct{}, maxConcurrent+maxQueued),
+		maxRunning: maxConcurrent,
+		outputs:    make(map[string]bool),
+	}
+}
+
+// buildTicket is an admitted build. It must be released exactly once.
+type buildTicket struct {
+	l *buildLimiter
+	// priority orders the build among waiting ones; set it before wait.
+	priority fledgev1.BuildPriority
+	output   string
+
+	// running, seq and ready are guarded by l.mu; ready is closed when a
+	// waiting build is given a slot.
+	running bool
+	seq     uint64
+	ready   chan struct{}
+}
+
+// admit reserves a place in the queue, reporting false when it is full.
+func (l *buildLimiter) admit() (*buildTicket, bool) {
+	select {
+	case l.admitted <- struct{}{}:
+		return &buildTicket{l: l, priority: fledgev1.BuildPriority_BUILD_PRIORITY_NORMAL}, true
+	default:
+		return nil, false
+	}
+}
+
+// claimOutput marks path as being written by this build, reporting false if
+// another build is already producing the same file.
+func (t *buildTicket) claimOutput(path string) bool {
+	t.l.mu.Lock()
+	defer t.l.mu.Unlock()
+	if t.l.outputs[path] {
+		return false
+	}
+	t.l.outputs[path] = true
+	t.output = path
+	return true
+}
+
+// wait blocks until a build slot is free or ctx is done.
+func (t *buildTicket) wait(ctx context.Context) error {
+	l := t.l
+	l.mu.Lock()
+	if l.running < l.maxRunning && len(l.waiting) == 0 {
+		l.running++
+		t.running = true
+		l.mu.Unlock()
+		return nil
+	}
+	l.seq++
+	t.seq = l.seq
+	t.ready = make(chan struct{})
+	l.waiting = append(l.waiting, t)
+	l.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// A slot given at the same time is freed by release
+		if !t.running {
+			l.waiting = slices.DeleteFunc(l.waiting, func(w *buildTicket) bool { return w == t })
+		}
+		return ctx.Err()
+	}
+}
+
+// grantLocked gives free slots to the waiting builds of the highest
+// priority, first come first served among equals.
+func (l *buildLimiter) grantLocked() {
+	for l.running < l.maxRunning && len(l.waiting) > 0 {
+		next := 0
+		for i, w := range l.waiting {
+			best := l.waiting[next]
+			if w.priority > best.priority || (w.priority == best.priority && w.seq < best.seq) {
+				next = i
+			}
+		}
+		t := l.waiting[next]
+		l.waiting = slices.Delete(l.waiting, next, next+1)
+		l.running++
+		t.running = true
+		close(t.ready)
+	}
+}
+
+// release frees the ticket's queue place, build slot and output claim.
+func (t *buildTicket) release() {
+	l := t.l
+	l.mu.Lock()
+	if t.running {
+		l.running--
+		l.grantLocked()
+	}
+	if t.output != "" {
+		delete(l.outputs, t.output)
+	}
+	l.mu.Unlock()
+	<-l.admitted
+}
+
+// stats returns the number of running and queued builds.
+func (l *buildLimiter) stats() (running, queued int) {
+	l.mu.Lock()
+	running = l.running
+	l.mu.Unlock()
+	return running, len(l.admitted) - running
+}
+
+// parsePriority parses the priority of a build request: low, normal (the
+// default when empty) or high.
+func parsePriority(s string) (fledgev1.BuildPriority, error) {
+	switch s {
+	case PriorityLow:
+		return fledgev1.BuildPriority_BUILD_PRIORITY_LOW, nil
+	case "", PriorityNormal:
+		return fledgev1.BuildPriority_BUILD_PRIORITY_NORMAL, nil
+	case PriorityHigh:
+		return fledgev1.BuildPriority_BUILD_PRIORITY_HIGH, nil
+	}
+	return 0, fmt.Errorf("invalid priority %q (expected %s, %s or %s)", s, PriorityLow, PriorityNormal, PriorityHigh)
+}
+
+// priorityName returns the request name of p.
+func priorityName(p fledgev1.BuildPriority) string {
+	switch p {
+	case fledgev1.BuildPriority_BUILD_PRIORITY_LOW:
+		return PriorityLow
+	case fledgev1.BuildPriority_BUILD_PRIORITY_HIGH:
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// rejectQueueFull answers a build request that could not be admitted.
+func rejectQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", queueFullRetryAfter)
+	http.Error(w, "build queue is full, retry later", http.StatusTooManyRequests)
+}
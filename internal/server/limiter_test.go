@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestBuildLimiter tests concurrency slots, queue admission and output claims.
+func TestBuildLimiter(t *testing.T) {
+	l := newBuildLimiter(1, 1)
+
+	first, ok := l.admit()
+	if !ok {
+		t.Fatal("Expected first build to be admitted")
+	}
+	second, ok := l.admit()
+	if !ok {
+		t.Fatal("Expected second build to be queued")
+	}
+	if _, ok := l.admit(); ok {
+		t.Fatal("Expected third build to be rejected")
+	}
+
+	if err := first.wait(context.Background()); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := second.wait(ctx); err == nil {
+		t.Fatal("Expected queued build to wait for the running one")
+	}
+	if running, queued := l.stats(); running != 1 || queued != 1 {
+		t.Errorf("Expected 1 running and 1 queued, got %d and %d", running, queued)
+	}
+
+	if !first.claimOutput("/out/a.img") {
+		t.Fatal("Expected output claim to succeed")
+	}
+	if second.claimOutput("/out/a.img") {
+		t.Error("Expected a second claim of the same output to fail")
+	}
+
+	first.release()
+	if err := second.wait(context.Background()); err != nil {
+		t.Fatalf("Expected slot after release, got %v", err)
+	}
+	if !second.claimOutput("/out/a.img") {
+		t.Error("Expected output to be free after release")
+	}
+	second.release()
+	if running, queued := l.stats(); running != 0 || queued != 0 {
+		t.Errorf("Expected an idle limiter, got %d running and %d queued", running, queued)
+	}
+}
+
+// TestBuildPriority tests that freed slots go to the highest priority
+// waiting build, and to the longest waiting one among equals.
+func TestBuildPriority(t *testing.T) {
+	l := newBuildLimiter(1, 4)
+	first, _ := l.admit()
+	if err := first.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan string)
+	names := []string{"low", "normal", "high", "normal-2"}
+	for i, name := range names {
+		ticket, _ := l.admit()
+		priority, err := parsePriority(strings.TrimSuffix(name, "-2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ticket.priority = priority
+		go func() {
+			if err := ticket.wait(context.Background()); err == nil {
+				started <- name
+				ticket.release()
+			}
+		}()
+		// Let the build queue before the next one, fixing arrival order
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			l.mu.Lock()
+			n := len(l.waiting)
+			l.mu.Unlock()
+			if n == i+1 {
+				break
+			}
+		}
+	}
+
+	first.release()
+	var order []string
+	for range names {
+		order = append(order, <-started)
+	}
+	if want := []string{"high", "normal", "normal-2", "low"}; !slices.Equal(order, want) {
+		t.Errorf("Builds started in order %v, want %v", order, want)
+	}
+	if _, err := parsePriority("urgent"); err == nil {
+		t.Error("Expected an unknown priority to be rejected")
+	}
+}
+
+// TestRejectQueueFull tests the 429 response for a full queue.
+func TestRejectQueueFull(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rejectQueueFull(rec)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+// TestBuildTimeout tests that a build's own timeout can only lower the server cap.
+func TestBuildTimeout(t *testing.T) {
+	tests := []struct {
+		max  time.Duration
+		cfg  string
+		want time.Duration
+	}{
+		{0, "", DefaultBuildTimeout},
+		{time.Hour, "", time.Hour},
+		{time.Hour, "45m", 45 * time.Minute},
+		{time.Hour, "2h", time.Hour},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{}
+		if tt.cfg != "" {
+			cfg.Build = &config.BuildConfig{Timeout: tt.cfg}
+		}
+		if got := buildTimeout(tt.max, cfg); got != tt.want {
+			t.Errorf("buildTimeout(%s, %q) = %s, want %s", tt.max, tt.cfg, got, tt.want)
+		}
+	}
+}
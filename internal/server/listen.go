@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// unixScheme prefixes Unix socket addresses, e.g. unix:///run/fledge.sock.
+	unixScheme = "unix://"
+	// listenFDsStart is the first file descriptor passed by systemd.
+	listenFDsStart = 3
+)
+
+// Listen returns the listener for addr. A socket passed by systemd socket
+// activation (LISTEN_FDS) takes precedence; otherwise addr is either a TCP
+// host:port or a unix:// socket path.
+func Listen(addr string) (net.Listener, error) {
+	if ln, err := activatedListener(); ln != nil || err != nil {
+		return ln, err
+	}
+
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		if path == "" {
+			return nil, fmt.Errorf("unix socket address %q has no path", addr)
+		}
+		// A socket left behind by an unclean shutdown blocks the bind
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+		}
+		// Builds run as root, so only root and the socket's group may connect
+		if err := os.Chmod(path, 0660); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set permissions on %s: %w", path, err)
+		}
+		return ln, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return ln, nil
+}
+
+// activatedListener returns the socket passed by systemd, or nil when the
+// process was not socket activated. Only a single socket is supported.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n == 0 {
+		return nil, nil
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("socket activation passed %d sockets, expected 1", n)
+	}
+
+	// Child processes (builds) must not see the activation variables
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_3")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket from systemd: %w", err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestListen_UnixSocket tests listening on a unix:// address over a stale socket.
+func TestListen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fledge.sock")
+
+	// Leave a socket file behind, as an unclean shutdown would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := Listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket missing: %v", err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket mode 0660, got %o", info.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.Close()
+
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed on close, got %v", err)
+	}
+
+	if _, err := Listen("unix://"); err == nil {
+		t.Error("Expected error for unix address without a path")
+	}
+}
+
+// TestListen_IgnoresForeignActivation tests that LISTEN_FDS meant for another process is ignored.
+func TestListen_IgnoresForeignActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	if ln.Addr().Network() != "tcp" {
+		t.Errorf("Expected tcp listener, got %s", ln.Addr().Network())
+	}
+}
+
+// TestInstallSystemd tests writing the socket activation units.
+func TestInstallSystemd(t *testing.T) {
+	dir := t.TempDir()
+	paths, err := InstallSystemd(dir, "/usr/local/bin/fledge", "/run/fledge-test.sock")
+	if err != nil {
+		t.Fatalf("InstallSystemd failed: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("Expected 2 units, got %v", paths)
+	}
+
+	socket, _ := os.ReadFile(filepath.Join(dir, "fledge.socket"))
+	if !strings.Contains(string(socket), "ListenStream=/run/fledge-test.sock") {
+		t.Errorf("fledge.socket missing ListenStream:\n%s", socket)
+	}
+	service, _ := os.ReadFile(filepath.Join(dir, "fledge.service"))
+	if !strings.Contains(string(service), "ExecStart=/usr/local/bin/fledge serve --addr unix:///run/fledge-test.sock") {
+		t.Errorf("fledge.service has unexpected ExecStart:\n%s", service)
+	}
+
+	if _, err := InstallSystemd(dir, "/opt/my tools/fledge", "/run/fledge.sock"); err == nil {
+		t.Error("Expected error for executable path with whitespace")
+	}
+}
@@ -0,0 +1,458 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// OIDCOptions lets the daemon accept JWTs from an OpenID Connect provider as
+// Bearer tokens, alongside any API keys.
+type OIDCOptions struct {
+	// Issuer is the iss every token must carry. Its discovery document
+	// locates the signing keys unless JWKSURL is set.
+	Issuer  string
+	JWKSURL string
+	// Audience must appear in the aud claim.
+	Audience string
+	// RequiredClaims are claims a token must carry with the given value; an
+	// array claim must contain it.
+	RequiredClaims map[string]string
+	// ScopesClaim names the claim granting fledge scopes, as a
+	// space-separated string or an array of strings; defaults to "scope".
+	// Only build, read and admin, optionally prefixed "fledge:", count.
+	ScopesClaim string
+	// TenantClaim names the string claim selecting the tenant workspace of
+	// a token. When set, tokens without a valid one are rejected; when
+	// empty, every token uses the default workspace.
+	TenantClaim string
+}
+
+// Enabled reports whether OIDC authentication is configured.
+func (o OIDCOptions) Enabled() bool {
+	return o.Issuer != ""
+}
+
+const (
+	// jwksRefreshInterval is how long fetched signing keys are used before
+	// they are fetched again, so that removed keys stop being accepted.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefresh throttles refetching for tokens signed with an unknown
+	// key, so that bogus tokens cannot hammer the provider.
+	jwksMinRefresh = time.Minute
+	// jwtLeeway tolerates clock skew between the daemon and the provider.
+	jwtLeeway = time.Minute
+)
+
+// oidcVerifier validates JWTs against the keys of an OIDC provider.
+type oidcVerifier struct {
+	opts   OIDCOptions
+	client *http.Client
+
+	mu      sync.Mutex
+	jwksURL string
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// newOIDCVerifier checks opts and fetches the provider's keys. A provider
+// that is unreachable at startup is only logged; keys are fetched again on
+// the first token.
+func newOIDCVerifier(opts OIDCOptions) (*oidcVerifier, error) {
+	if opts.Audience == "" {
+		return nil, fmt.Errorf("OIDC requires an audience")
+	}
+	if err := checkProviderURL(opts.Issuer); err != nil {
+		return nil, fmt.Errorf("invalid OIDC issuer: %w", err)
+	}
+	if opts.JWKSURL != "" {
+		if err := checkProviderURL(opts.JWKSURL); err != nil {
+			return nil, fmt.Errorf("invalid OIDC JWKS URL: %w", err)
+		}
+	}
+	if opts.ScopesClaim == "" {
+		opts.ScopesClaim = "scope"
+	}
+	v := &oidcVerifier{
+		opts:    opts,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		jwksURL: opts.JWKSURL,
+	}
+	v.mu.Lock()
+	err := v.refresh()
+	v.mu.Unlock()
+	if err != nil {
+		logging.Warn("Failed to fetch OIDC signing keys", "issuer", opts.Issuer, "error", err)
+	}
+	return v, nil
+}
+
+// checkProviderURL requires https, except for loopback hosts.
+func checkProviderURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if u.Scheme == "http" {
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must use https", raw)
+}
+
+// getJSON fetches url into v.
+func (v *oidcVerifier) getJSON(url string, out any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// refresh fetches the signing keys, discovering their URL from the issuer
+// first if needed. The caller holds v.mu. On failure the previous keys stay
+// in use.
+func (v *oidcVerifier) refresh() error {
+	v.fetched = time.Now()
+	if v.jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.opts.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("failed to discover OIDC provider: %w", err)
+		}
+		if discovery.Issuer != v.opts.Issuer {
+			return fmt.Errorf("OIDC provider reports issuer %q, expected %q", discovery.Issuer, v.opts.Issuer)
+		}
+		if err := checkProviderURL(discovery.JWKSURI); err != nil {
+			return fmt.Errorf("invalid jwks_uri: %w", err)
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(v.jwksURL, &set); err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			logging.Debug("Skipping OIDC signing key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS at %s has no usable signing keys", v.jwksURL)
+	}
+	v.keys = keys
+	return nil
+}
+
+// key returns the signing key kid, refetching the keys when they are stale
+// or kid is unknown. An empty kid matches the only key of the set.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Since(v.fetched) > jwksRefreshInterval {
+		if err := v.refresh(); err != nil {
+			logging.Warn("Failed to refresh OIDC signing keys", "error", err)
+		}
+	}
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				return k
+			}
+		}
+		return v.keys[kid]
+	}
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+	if time.Since(v.fetched) > jwksMinRefresh {
+		if err := v.refresh(); err != nil {
+			return nil, err
+		}
+		if k := lookup(); k != nil {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jwk is a JSON Web Key of an RSA, EC or Ed25519 public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key, rejecting RSA keys under 2048 bits.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := b64(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid e")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key of %d bits is too small", pub.N.BitLen())
+		}
+		return pub, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := b64(k.X)
+		y, errY := b64(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("EC point is not on %s", k.Crv)
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// jwtHashes maps the supported JWS algorithms to their hash; EdDSA signs
+// the message itself. Symmetric algorithms and "none" are rejected.
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// ecdsaBits is the curve size each ECDSA algorithm signs with.
+var ecdsaBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// verifySignature checks the JWS signature sig of signed with pub.
+func verifySignature(alg string, pub crypto.PublicKey, signed, sig []byte) error {
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	errSig := errors.New("invalid signature")
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+				return errSig
+			}
+			return nil
+		case "PS":
+			if rsa.VerifyPSS(key, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+				return errSig
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize != ecdsaBits[alg] {
+			break
+		}
+		size := (ecdsaBits[alg] + 7) / 8
+		if len(sig) != 2*size {
+			return errSig
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errSig
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(key, signed, sig) {
+			return errSig
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %s does not match the signing key", alg)
+}
+
+// looksLikeJWT reports whether a presented credential is a compact JWS
+// rather than an API key.
+func looksLikeJWT(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+// verify validates token and returns the identity it grants: named after
+// its subject, with the fledge scopes of its scopes claim.
+func (v *oidcVerifier) verify(token string) (*apiKey, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if _, ok := jwtHashes[header.Alg]; !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	pub, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, pub, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != v.opts.Issuer {
+		return nil, fmt.Errorf("token issuer %q is not %q", iss, v.opts.Issuer)
+	}
+	if !claimContains(claims["aud"], v.opts.Audience) {
+		return nil, fmt.Errorf("token audience does not include %q", v.opts.Audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	for name, want := range v.opts.RequiredClaims {
+		if !claimContains(claims[name], want) {
+			return nil, fmt.Errorf("token claim %s is not %q", name, want)
+		}
+	}
+
+	sub, _ := claims["sub"].(string)
+	k := &apiKey{name: "oidc:" + sub, scopes: map[string]bool{}}
+	var granted []string
+	switch c := claims[v.opts.ScopesClaim].(type) {
+	case string:
+		granted = strings.Fields(c)
+	case []any:
+		for _, s := range c {
+			if s, ok := s.(string); ok {
+				granted = append(granted, s)
+			}
+		}
+	}
+	for _, scope := range granted {
+		switch scope = strings.TrimPrefix(scope, "fledge:"); scope {
+		case ScopeBuild, ScopeRead, ScopeAdmin:
+			k.scopes[scope] = true
+		}
+	}
+	if v.opts.TenantClaim != "" {
+		tenant, _ := claims[v.opts.TenantClaim].(string)
+		if !validTenantName(tenant) {
+			return nil, fmt.Errorf("token claim %s is not a valid tenant", v.opts.TenantClaim)
+		}
+		k.tenant = tenant
+	}
+	return k, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT into v.
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimContains reports whether a claim is want, or an array containing it.
+func claimContains(claim any, want string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == want
+	case []any:
+		for _, v := range c {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProvider is an OIDC provider serving discovery and a JWKS of its keys.
+type testProvider struct {
+	srv  *httptest.Server
+	keys map[string]any
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	p := &testProvider{keys: map[string]any{}}
+	b64 := base64.RawURLEncoding.EncodeToString
+	p.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": p.srv.URL, "jwks_uri": p.srv.URL + "/jwks"})
+		case "/jwks":
+			var keys []map[string]string
+			for kid, key := range p.keys {
+				switch key := key.(type) {
+				case *rsa.PrivateKey:
+					keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+						"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())})
+				case *ecdsa.PrivateKey:
+					keys = append(keys, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256",
+						"x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+// sign issues a JWT with claims, signed by the key kid.
+func (p *testProvider) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	alg := "RS256"
+	if _, ok := p.keys[kid].(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	var sig []byte
+	switch key := p.keys[kid].(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+// TestOIDC tests accepting provider-issued tokens: signature, issuer,
+// audience, expiry and required claims, scopes from a claim, and signing
+// key rotation.
+func TestOIDC(t *testing.T) {
+	p := newTestProvider(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.keys["rsa"] = rsaKey
+
+	v, err := newOIDCVerifier(OIDCOptions{
+		Issuer:         p.srv.URL,
+		Audience:       "fledge",
+		RequiredClaims: map[string]string{"groups": "builders"},
+	})
+	if err != nil {
+		t.Fatalf("newOIDCVerifier failed: %v", err)
+	}
+	auth, err := newAuthStore("", "", v)
+	if err != nil {
+		t.Fatalf("newAuthStore failed: %v", err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(mod func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss": p.srv.URL, "aud": []string{"other", "fledge"}, "sub": "alice",
+			"exp": now + 300, "groups": []string{"dev", "builders"}, "scope": "openid fledge:build read",
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	ctx := context.Background()
+	token := p.sign(t, "rsa", claims(nil))
+	if _, code := auth.authorize(ctx, token, ScopeBuild); code != 0 {
+		t.Errorf("Expected a valid token to grant build, got %d", code)
+	}
+	if _, code := auth.authorize(ctx, token, ScopeAdmin); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a scope the token lacks, got %d", code)
+	}
+	if k, _ := auth.authenticate(token); k == nil || k.name != "oidc:alice" {
+		t.Errorf("Expected the token to authenticate as oidc:alice, got %+v", k)
+	}
+
+	for name, mod := range map[string]func(map[string]any){
+		"wrong issuer":   func(c map[string]any) { c["iss"] = "https://evil.example" },
+		"wrong audience": func(c map[string]any) { c["aud"] = "other" },
+		"expired":        func(c map[string]any) { c["exp"] = now - 600 },
+		"no expiry":      func(c map[string]any) { delete(c, "exp") },
+		"not yet valid":  func(c map[string]any) { c["nbf"] = now + 600 },
+		"missing claim":  func(c map[string]any) { c["groups"] = []string{"dev"} },
+	} {
+		if _, code := auth.authorize(ctx, p.sign(t, "rsa", claims(mod)), ScopeRead); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a token with %s, got %d", name, code)
+		}
+	}
+
+	// A tampered payload and an unsigned token must both be rejected
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(claims(func(c map[string]any) { c["scope"] = "admin" }))
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	for _, bad := range []string{tampered, none} {
+		if _, code := auth.authorize(ctx, bad, ScopeRead); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a forged token, got %d", code)
+		}
+	}
+
+	// A token from a key added since the last fetch is accepted once the
+	// keys are refetched
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.keys["ec"] = ecKey
+	v.fetched = time.Now().Add(-2 * jwksMinRefresh)
+	if _, code := auth.authorize(ctx, p.sign(t, "ec", claims(nil)), ScopeRead); code != 0 {
+		t.Errorf("Expected a token from a rotated-in key to be accepted, got %d", code)
+	}
+
+	// With a tenant claim, tokens select their tenant and need a valid one
+	v.opts.TenantClaim = "team"
+	if tenant, code := auth.authorize(ctx, p.sign(t, "rsa", claims(func(c map[string]any) { c["team"] = "web" })), ScopeRead); code != 0 || tenant != "web" {
+		t.Errorf("authorize = %q, %d; want tenant web", tenant, code)
+	}
+	if _, code := auth.authorize(ctx, token, ScopeRead); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a token without a tenant, got %d", code)
+	}
+
+	if _, err := newOIDCVerifier(OIDCOptions{Issuer: p.srv.URL}); err == nil {
+		t.Error("Expected an error without an audience")
+	}
+	if _, err := newOIDCVerifier(OIDCOptions{Issuer: "http://idp.example", Audience: "fledge"}); err == nil {
+		t.Error("Expected an error for a plain-http issuer")
+	}
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/volantvm/fledge/internal/publish"
+)
+
+// apiVersion is the version of the HTTP API under /v1, reported in
+// /v1/openapi.json and the X-Fledge-API-Version header. Its major version
+// follows the path prefix; compatible additions raise the minor version.
+const apiVersion = "1.4.0"
+
+// apiVersionHeader carries apiVersion on every response.
+const apiVersionHeader = "X-Fledge-API-Version"
+
+// artifactList is the response of GET /v1/artifacts.
+type artifactList struct {
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// apiRoute documents one operation of the HTTP API.
+type apiRoute struct {
+	method  string
+	path    string
+	summary string
+	// params are the query parameters, by name and description.
+	params [][2]string
+	// request is the JSON body model, or a content type string for
+	// non-JSON bodies.
+	request any
+	// response is the JSON model of the success response, or a content
+	// type string for non-JSON responses.
+	response any
+	// status is the success status; zero means 200.
+	status int
+	// errors are the documented error statuses besides 401, 403 and 429.
+	errors []int
+	// scope is the API key scope the route requires.
+	scope string
+}
+
+// apiRoutes lists every endpoint of fledge serve. /v1/openapi.json is
+// generated from it, with schemas derived from the Go request and response
+// types, so a handler change and its documentation land in the same place.
+var apiRoutes = []apiRoute{
+	{method: http.MethodGet, path: "/v1/healthz", summary: "Report daemon health and build load", response: "text/plain", scope: ScopeRead},
+	{method: http.MethodGet, path: "/v1/openapi.json", summary: "This OpenAPI document", response: "application/json", scope: ScopeRead},
+	{method: http.MethodGet, path: "/v1/capabilities", summary: "Describe the strategies, filesystems, hypervisors and caches builds can use",
+		response: capabilities{}, scope: ScopeRead},
+	{method: http.MethodPost, path: "/v1/build", summary: "Build a fledge.toml on the server or one sent inline",
+		request: buildRequest{}, response: buildResponse{}, errors: []int{400, 409, 413, 500, 503, 504, 507}, scope: ScopeBuild},
+	{method: http.MethodPost, path: "/v1/builds/upload", summary: "Build from an uploaded config, context and payload files",
+		params: [][2]string{{"ttl", "How long the artifact is kept, e.g. 24h"}, {"priority", "low, normal (default) or high; queued builds of a higher priority start first"},
+			{"stream", "true to answer with the build's log records and then its stored artifact, as newline-delimited JSON"}},
+		request: "multipart/form-data", response: "application/octet-stream", errors: []int{400, 413, 500, 503, 504, 507}, scope: ScopeBuild},
+	{method: http.MethodGet, path: "/v1/usage", summary: "Report the disk usage, builds and quota of the caller's tenant", response: tenantUsage{}, scope: ScopeRead},
+	{method: http.MethodGet, path: "/v1/artifacts", summary: "List stored artifacts, newest first", response: artifactList{}, scope: ScopeRead},
+	{method: http.MethodGet, path: "/v1/artifacts/{id}", summary: "Download an artifact; supports Range requests",
+		response: "application/octet-stream", errors: []int{404}, scope: ScopeRead},
+	{method: http.MethodDelete, path: "/v1/artifacts/{id}", summary: "Remove an artifact from the store",
+		status: http.StatusNoContent, errors: []int{404}, scope: ScopeAdmin},
+	{method: http.MethodGet, path: "/v1/artifacts/{id}/info", summary: "Describe an artifact", response: Artifact{}, errors: []int{404}, scope: ScopeRead},
+	{method: http.MethodGet, path: "/v1/artifacts/{id}/manifest", summary: "Download the manifest.json of an artifact",
+		response: "application/json", errors: []int{404}, scope: ScopeRead},
+	{method: http.MethodPost, path: "/v1/artifacts/{id}/publish", summary: "Register an artifact with the Volant control plane",
+		response: publish.Result{}, errors: []int{404, 409, 501, 502}, scope: ScopeAdmin},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+)
+
+// openAPIHandler serves GET /v1/openapi.json.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	openAPIOnce.Do(func() {
+		openAPIDoc, _ = json.MarshalIndent(openAPISpec(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDoc)
+}
+
+// openAPISpec builds the OpenAPI 3 document of apiRoutes.
+func openAPISpec() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+	for _, route := range apiRoutes {
+		op := map[string]any{
+			"summary":     route.summary,
+			"operationId": operationID(route),
+			// The API key scope the operation requires
+			"x-fledge-scope": route.scope,
+		}
+
+		var params []any
+		if strings.Contains(route.path, "{id}") {
+			params = append(params, map[string]any{
+				"name": "id", "in": "path", "required": true,
+				"schema": map[string]any{"type": "string", "pattern": "^[0-9a-f]{16}$"},
+			})
+		}
+		for _, p := range route.params {
+			params = append(params, map[string]any{
+				"name": p[0], "in": "query", "description": p[1],
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if route.request != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": content(route.request, schemas)}
+		}
+
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		if route.response != nil {
+			success["content"] = content(route.response, schemas)
+		}
+		responses := map[string]any{strconv.Itoa(status): success}
+		for _, code := range append([]int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests}, route.errors...) {
+			responses[strconv.Itoa(code)] = map[string]any{
+				"description": http.StatusText(code),
+				"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+			}
+		}
+		op["responses"] = responses
+
+		if paths[route.path] == nil {
+			paths[route.path] = map[string]any{}
+		}
+		paths[route.path][strings.ToLower(route.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "fledge serve",
+			"version": apiVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"security": []any{map[string]any{"bearer": []any{}}, map[string]any{"apiKey": []any{}}},
+	}
+}
+
+// operationID derives a stable operation name such as getArtifactsIdInfo.
+func operationID(route apiRoute) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(route.method))
+	for _, part := range strings.FieldsFunc(route.path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if part == "v1" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// content returns the content map of a body: a JSON schema reference for a
+// model, or a bare content type.
+func content(body any, schemas map[string]any) map[string]any {
+	if contentType, ok := body.(string); ok {
+		var schema map[string]any
+		switch contentType {
+		case "text/plain":
+			schema = map[string]any{"type": "string"}
+		case "application/json":
+			schema = map[string]any{"type": "object"}
+		case "multipart/form-data":
+			binary := map[string]any{"type": "string", "format": "binary"}
+			schema = map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					uploadFieldConfig:   binary,
+					uploadFieldManifest: binary,
+					uploadFieldContext:  binary,
+					uploadFieldFile:     map[string]any{"type": "array", "items": binary},
+				},
+				"required": []string{uploadFieldConfig},
+			}
+		default:
+			schema = map[string]any{"type": "string", "format": "binary"}
+		}
+		return map[string]any{contentType: map[string]any{"schema": schema}}
+	}
+	return map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(body), schemas)}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the JSON schema of t as encoding/json marshals it. Named
+// structs are added to schemas and referenced.
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		s := map[string]any{"type": "integer"}
+		if t.Size() == 8 {
+			s["format"] = "int64"
+		}
+		return s
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]any{}
+	}
+
+	name := schemaName(t)
+	ref := map[string]any{"$ref": "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+	// Registered before the fields so that recursive types terminate
+	schemas[name] = nil
+	props := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		fieldName, _, _ := strings.Cut(tag, ",")
+		if fieldName == "" {
+			fieldName = f.Name
+		}
+		props[fieldName] = schemaOf(f.Type, schemas)
+	}
+	schemas[name] = map[string]any{"type": "object", "properties": props}
+	return ref
+}
+
+// schemaName names the schema of struct t: its Go name, capitalized, with
+// the package prefixed for types outside this package.
+func schemaName(t reflect.Type) string {
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if pkg := t.PkgPath(); pkg != reflect.TypeOf(apiRoute{}).PkgPath() {
+		p := pkg[strings.LastIndex(pkg, "/")+1:]
+		name = strings.ToUpper(p[:1]) + p[1:] + name
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPISpec tests that /v1/openapi.json documents every route with
+// schemas derived from the request and response types.
+func TestOpenAPISpec(t *testing.T) {
+	rec := httptest.NewRecorder()
+	openAPIHandler(rec, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var spec struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]struct {
+					Type   string `json:"type"`
+					Format string `json:"format"`
+					Ref    string `json:"$ref"`
+				} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Failed to decode spec: %v", err)
+	}
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("Expected OpenAPI 3.0.3, got %q", spec.OpenAPI)
+	}
+	for _, route := range apiRoutes {
+		if _, ok := spec.Paths[route.path][strings.ToLower(route.method)]; !ok {
+			t.Errorf("Missing %s %s", route.method, route.path)
+		}
+	}
+
+	req := spec.Components.Schemas["BuildRequest"]
+	if req.Properties["config_path"].Type != "string" || req.Properties["ttl"].Type != "string" {
+		t.Errorf("Unexpected BuildRequest schema: %+v", req)
+	}
+	artifact := spec.Components.Schemas["Artifact"]
+	if artifact.Properties["created_at"].Format != "date-time" || artifact.Properties["size"].Format != "int64" {
+		t.Errorf("Unexpected Artifact schema: %+v", artifact)
+	}
+	if _, ok := spec.Components.Schemas["PublishResult"]; !ok {
+		t.Errorf("Expected a PublishResult schema, got %v", spec.Components.Schemas)
+	}
+}
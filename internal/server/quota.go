@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+const (
+	// usageMaxAge is how long a measured disk usage is reused when
+	// admitting builds, so that bursts of requests do not each walk the
+	// tenant's directory.
+	usageMaxAge = 10 * time.Second
+	// quotaCheckInterval is how often the disk usage of a tenant with
+	// running builds is measured.
+	quotaCheckInterval = 15 * time.Second
+)
+
+// errDiskQuota cancels the builds of a tenant that exceeds its disk quota.
+var errDiskQuota = errors.New("tenant disk quota exceeded")
+
+// TenantQuota bounds what a tenant may use; zero fields are unlimited.
+type TenantQuota struct {
+	// MaxDiskBytes bounds the tenant's artifacts, download cache, BuildKit
+	// state and build workspaces together.
+	MaxDiskBytes int64
+	// MaxBuilds bounds the tenant's builds running or queued at once.
+	MaxBuilds int
+}
+
+// quotaError is a build a tenant's quota does not allow, answered with
+// status.
+type quotaError struct {
+	status int
+	msg    string
+}
+
+func (e *quotaError) Error() string { return e.msg }
+
+// quotaFor returns the quota of t. The default tenant has none; the daemon's
+// limits bound it.
+func (s *tenantSet) quotaFor(t *tenant) TenantQuota {
+	if t.name == defaultTenant || s.quota == nil {
+		return TenantQuota{}
+	}
+	return s.quota(t.name)
+}
+
+// admit reserves a build of t within its quota, returning the function
+// that releases it, or a *quotaError when the tenant has too many builds or
+// is at its disk quota.
+func (s *tenantSet) admit(t *tenant) (func(), error) {
+	q := s.quotaFor(t)
+	if q.MaxDiskBytes > 0 {
+		if used := t.diskUsage(usageMaxAge); used >= q.MaxDiskBytes {
+			return nil, &quotaError{http.StatusInsufficientStorage, fmt.Sprintf("tenant %s uses %s of its %s disk quota; delete artifacts to free space",
+				t.name, utils.FormatBytes(used), utils.FormatBytes(q.MaxDiskBytes))}
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if q.MaxBuilds > 0 && t.builds >= q.MaxBuilds {
+		return nil, &quotaError{http.StatusTooManyRequests, fmt.Sprintf("tenant %s already has %d builds, its quota; retry later", t.name, t.builds)}
+	}
+	t.builds++
+	return func() {
+		t.mu.Lock()
+		t.builds--
+		// The build changed the tenant's usage
+		t.measuredAt = time.Time{}
+		t.mu.Unlock()
+	}, nil
+}
+
+// guard returns ctx for a build of t, cancelled with errDiskQuota once the
+// tenant's usage exceeds its disk quota, and the function ending the check.
+func (s *tenantSet) guard(ctx context.Context, t *tenant) (context.Context, context.CancelFunc) {
+	limit := s.quotaFor(t).MaxDiskBytes
+	if limit == 0 {
+		return context.WithCancel(ctx)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(quotaCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if used := t.diskUsage(0); used > limit {
+					logging.WarnContext(ctx, "Cancelling build over the tenant disk quota", "used", utils.FormatBytes(used), "quota", utils.FormatBytes(limit))
+					cancel(errDiskQuota)
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// rejectQuota answers a request refused by a tenant quota.
+func rejectQuota(w http.ResponseWriter, err error) {
+	var qe *quotaError
+	if !errors.As(err, &qe) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if qe.status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", queueFullRetryAfter)
+	}
+	http.Error(w, qe.msg, qe.status)
+}
+
+// diskUsage returns the bytes stored under the tenant's directory, measured
+// at most maxAge ago.
+func (t *tenant) diskUsage(maxAge time.Duration) int64 {
+	t.mu.Lock()
+	if maxAge > 0 && time.Since(t.measuredAt) < maxAge {
+		used := t.usage
+		t.mu.Unlock()
+		return used
+	}
+	t.mu.Unlock()
+
+	used := dirSize(t.dir)
+	t.mu.Lock()
+	t.usage, t.measuredAt = used, time.Now()
+	t.mu.Unlock()
+	return used
+}
+
+// dirSize returns the total size of the regular files under dir. Files
+// removed while it walks are skipped.
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// tenantUsage is the response of GET /v1/usage.
+type tenantUsage struct {
+	// Tenant is the caller's tenant; empty for the default one.
+	Tenant string `json:"tenant"`
+	// DiskBytes is the size of the tenant's artifacts, caches and build
+	// workspaces; for the default tenant, that of its artifacts.
+	DiskBytes    int64 `json:"disk_bytes"`
+	MaxDiskBytes int64 `json:"max_disk_bytes,omitempty"`
+	// Builds are the tenant's builds running or queued.
+	Builds    int `json:"builds"`
+	MaxBuilds int `json:"max_builds,omitempty"`
+}
+
+// usageHandler serves GET /v1/usage, the caller's tenant usage and quota.
+func usageHandler(tenants *tenantSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t, ok := tenants.forRequest(w, r)
+		if !ok {
+			return
+		}
+		q := tenants.quotaFor(t)
+		u := tenantUsage{Tenant: t.name, MaxDiskBytes: q.MaxDiskBytes, MaxBuilds: q.MaxBuilds}
+		if t.name == defaultTenant {
+			u.DiskBytes = dirSize(t.store.dir)
+		} else {
+			u.DiskBytes = t.diskUsage(usageMaxAge)
+		}
+		t.mu.Lock()
+		u.Builds = t.builds
+		t.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(u)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTenantQuota tests that builds beyond a tenant's build or disk quota
+// are refused with 429 and 507.
+func TestTenantQuota(t *testing.T) {
+	def, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	tenants := newTenantSet(t.TempDir(), def)
+	tenants.quota = func(name string) TenantQuota {
+		return TenantQuota{MaxDiskBytes: 1000, MaxBuilds: 1}
+	}
+	web, err := tenants.get("web")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+
+	release, err := tenants.admit(web)
+	if err != nil {
+		t.Fatalf("Expected the first build to be admitted: %v", err)
+	}
+	_, err = tenants.admit(web)
+	rec := httptest.NewRecorder()
+	rejectQuota(rec, err)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After beyond max builds, got %d", rec.Code)
+	}
+	release()
+
+	if err := os.WriteFile(filepath.Join(web.cacheDir, "big"), make([]byte, 1500), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tenants.admit(web)
+	rec = httptest.NewRecorder()
+	rejectQuota(rec, err)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 over the disk quota, got %d", rec.Code)
+	}
+
+	// The default tenant has no quota
+	for i := 0; i < 3; i++ {
+		if _, err := tenants.admit(tenants.def); err != nil {
+			t.Errorf("Expected the default tenant to be unlimited: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/usage", nil)
+	rec = httptest.NewRecorder()
+	usageHandler(tenants)(rec, req.WithContext(withTenant(req.Context(), "web")))
+	var u tenantUsage
+	if err := json.NewDecoder(rec.Body).Decode(&u); err != nil {
+		t.Fatalf("Failed to decode usage: %v", err)
+	}
+	if u.Tenant != "web" || u.DiskBytes != 1500 || u.MaxDiskBytes != 1000 || u.MaxBuilds != 1 {
+		t.Errorf("Unexpected usage: %+v", u)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errDiskQuota)
+	rec = httptest.NewRecorder()
+	writeBuildError(rec, ctx, 0, errors.New("write failed"))
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected a build stopped by the quota to get 507, got %d", rec.Code)
+	}
+}
+
+// TestTenantQuotaFile tests quota overrides in the API keys file.
+func TestTenantQuotaFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.toml")
+	content := "[[keys]]\nname = \"web\"\nkey = \"k\"\nscopes = [\"build\"]\ntenant = \"web\"\n\n[tenants.web]\nmax_disk = \"50G\"\nmax_builds = 4\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, quotas, err := loadAPIKeys(path)
+	if err != nil {
+		t.Fatalf("loadAPIKeys failed: %v", err)
+	}
+	if q := quotas["web"]; q.MaxDiskBytes != 50<<30 || q.MaxBuilds != 4 {
+		t.Errorf("Unexpected quota: %+v", q)
+	}
+
+	for _, bad := range []string{"[tenants.web]\nmax_disk = \"lots\"\n", "[tenants.Web]\nmax_builds = 1\n", "[tenants.web]\nmax_builds = -1\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadAPIKeys(path); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
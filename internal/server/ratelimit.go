@@ -0,0 +1,170 @@
+package server
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default request limits for fledge serve. Zero Options values fall back to
+// them; a negative RateLimit or ClientTimeout disables the limit.
+const (
+	// DefaultRateLimit is the sustained requests per second allowed per
+	// client address, and DefaultRateBurst the requests it may make at once.
+	DefaultRateLimit = 10
+	DefaultRateBurst = 40
+	// DefaultMaxRequestBytes bounds JSON request bodies.
+	DefaultMaxRequestBytes = 8 << 20
+	// DefaultMaxUploadBytes bounds upload build requests.
+	DefaultMaxUploadBytes = 4 << 30
+	// DefaultClientTimeout is how long a client may go without sending any
+	// of its request body or accepting any of its response.
+	DefaultClientTimeout = time.Minute
+)
+
+// rateSweepInterval is how often idle clients are forgotten.
+const rateSweepInterval = 5 * time.Minute
+
+// rateLimiter is a token bucket per client address.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows each client rate requests per second with bursts of
+// burst, or returns nil, allowing everything, when rate is negative.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate < 0 {
+		return nil
+	}
+	if rate == 0 {
+		rate = DefaultRateLimit
+	}
+	if burst <= 0 {
+		burst = DefaultRateBurst
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), clients: map[string]*tokenBucket{}, swept: time.Now()}
+}
+
+// allow takes a token for client, or reports how long until one is free.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > rateSweepInterval {
+		// A bucket idle long enough to refill is the same as a new one
+		full := time.Duration(l.burst / l.rate * float64(time.Second))
+		for c, b := range l.clients {
+			if now.Sub(b.last) > full {
+				delete(l.clients, c)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// clientAddr returns the rate limiting key of a remote address: its IP, so
+// that a client cannot gain requests by opening connections. Unix socket
+// clients share one key.
+func clientAddr(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// rejectRateLimited answers 429 with the time until the client may retry.
+func rejectRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded, retry later", http.StatusTooManyRequests)
+}
+
+// guardClient bounds the body of r to maxBytes and, with a positive timeout,
+// fails the request when the client sends none of its body or accepts none
+// of the response for that long. It returns the writer to respond with and a
+// function to call once the handler returns.
+func guardClient(w http.ResponseWriter, r *http.Request, maxBytes int64, timeout time.Duration) (http.ResponseWriter, func()) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	if timeout <= 0 {
+		return w, func() {}
+	}
+	rc := http.NewResponseController(w)
+	if r.ContentLength != 0 && rc.SetReadDeadline(time.Now().Add(timeout)) == nil {
+		r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc, timeout: timeout}
+	}
+	dw := &deadlineWriter{ResponseWriter: w, rc: rc, timeout: timeout}
+	// The write deadline of the last write would otherwise still apply to
+	// flushing the end of the response and to the next request on the
+	// connection
+	return dw, func() { rc.SetWriteDeadline(time.Now().Add(timeout)) }
+}
+
+// deadlineBody extends the connection's read deadline as the body arrives,
+// and lifts it once the body is consumed, so that a long build after it
+// does not look like a client gone away.
+type deadlineBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.rc.SetReadDeadline(time.Time{})
+	} else if n > 0 {
+		b.rc.SetReadDeadline(time.Now().Add(b.timeout))
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	b.rc.SetReadDeadline(time.Time{})
+	return b.ReadCloser.Close()
+}
+
+// deadlineWriter extends the connection's write deadline with each write.
+// Time before the first write, such as a build running, does not count.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (d *deadlineWriter) Write(b []byte) (int, error) {
+	d.rc.SetWriteDeadline(time.Now().Add(d.timeout))
+	return d.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (d *deadlineWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRateLimiter tests bursts, refill and per-client buckets.
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("10.0.0.1"); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, wait := l.allow("10.0.0.1")
+	if ok || wait <= 0 || wait > 10*time.Millisecond {
+		t.Fatalf("Expected the request after the burst to wait up to 10ms, got %v, %v", ok, wait)
+	}
+	if ok, _ := l.allow("10.0.0.2"); !ok {
+		t.Error("Expected another client to have its own bucket")
+	}
+	time.Sleep(wait + 5*time.Millisecond)
+	if ok, _ := l.allow("10.0.0.1"); !ok {
+		t.Error("Expected the bucket to refill")
+	}
+
+	if l := newRateLimiter(-1, 0); l != nil {
+		t.Error("Expected a negative rate to disable limiting")
+	}
+	if got := clientAddr("192.0.2.1:4321"); got != "192.0.2.1" {
+		t.Errorf("Expected the IP as client key, got %q", got)
+	}
+}
+
+// TestGuardClient tests the body size limit and failing clients that stall
+// sending their body, while a slow but steady one succeeds.
+func TestGuardClient(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	results := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, done := guardClient(w, r, 16, timeout)
+		defer done()
+		_, err := io.ReadAll(r.Body)
+		results <- err
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "text/plain", strings.NewReader(strings.Repeat("x", 17)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var tooLarge *http.MaxBytesError
+	if err := <-results; err == nil || !errors.As(err, &tooLarge) {
+		t.Errorf("Expected a MaxBytesError for a 17-byte body, got %v", err)
+	}
+
+	send := func(chunks int, pause time.Duration) error {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 8\r\n\r\n")
+		for i := 0; i < chunks; i++ {
+			time.Sleep(pause)
+			conn.Write([]byte("x"))
+		}
+		select {
+		case err := <-results:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the handler")
+			return nil
+		}
+	}
+	if err := send(8, timeout/4); err != nil {
+		t.Errorf("Expected a slow but steady body to be read, got %v", err)
+	}
+	if err := send(2, 0); err == nil {
+		t.Error("Expected a stalled body to fail")
+	}
+}
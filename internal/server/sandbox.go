@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// pathSandbox confines the host paths that clients name — config_path,
+// work_dir, output_path and the files a config reads — to allowed directory
+// trees. Paths are compared after resolving symlinks, so a link inside an
+// allowed tree cannot reach outside it. A nil sandbox allows every path.
+type pathSandbox struct {
+	roots []string
+}
+
+// newPathSandbox returns the sandbox of roots, or nil when roots is empty.
+// Each root must be an existing directory.
+func newPathSandbox(roots []string) (*pathSandbox, error) {
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	s := &pathSandbox{}
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			return nil, fmt.Errorf("allowed root %s must be an absolute path", root)
+		}
+		resolved, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed root: %w", err)
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("allowed root %s is not a directory", root)
+		}
+		s.roots = append(s.roots, resolved)
+	}
+	return s, nil
+}
+
+// check returns the canonical form of path, or an error naming field when
+// it lies outside every allowed root.
+func (s *pathSandbox) check(field, path string) (string, error) {
+	if s == nil || path == "" {
+		return path, nil
+	}
+	resolved, err := utils.CanonicalPath(path)
+	if err != nil {
+		return "", fmt.Errorf("%s '%s' cannot be resolved: %w", field, path, err)
+	}
+	for _, root := range s.roots {
+		if utils.Within(resolved, root) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s '%s' is outside the allowed roots", field, path)
+}
+
+// checkConfig rejects configs that read or write files outside the allowed
+// roots, resolving their relative paths against workDir, or that run a
+// program of the client's choosing (see checkServedConfig). The paths of cfg are replaced by their canonical
+// form, so that a symlink swapped after the check cannot redirect the build.
+func (s *pathSandbox) checkConfig(cfg *config.Config, workDir string) error {
+	if s == nil {
+		return nil
+	}
+	if err := checkServedConfig(cfg); err != nil {
+		return err
+	}
+	return cfg.ResolveHostPaths(workDir, func(p config.HostPath, path string) (string, error) {
+		return s.check(p.Field, path)
+	})
+}
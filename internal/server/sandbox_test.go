@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestPathSandbox tests confining paths to allowed roots, including through
+// symlinks and for files that do not exist yet.
+func TestPathSandbox(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	allowed := filepath.Join(root, "allowed")
+	os.Mkdir(allowed, 0755)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0600)
+	os.Symlink(outside, filepath.Join(allowed, "escape"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(allowed, "dangling"))
+	os.Mkdir(filepath.Join(outside, "sub"), 0755)
+	os.Symlink(filepath.Join(outside, "sub"), filepath.Join(allowed, "deep"))
+
+	s, err := newPathSandbox([]string{allowed})
+	if err != nil {
+		t.Fatalf("newPathSandbox failed: %v", err)
+	}
+	for _, ok := range []string{
+		allowed,
+		filepath.Join(allowed, "fledge.toml"),
+		filepath.Join(allowed, "new", "dir", "out.img"),
+		filepath.Join(allowed, "..", "allowed", "x"),
+	} {
+		if _, err := s.check("path", ok); err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", ok, err)
+		}
+	}
+	for _, bad := range []string{
+		filepath.Join(outside, "secret"),
+		filepath.Join(allowed, "..", "allowed-not"),
+		filepath.Join(allowed, "escape", "secret"),
+		filepath.Join(allowed, "dangling"),
+		// Lexically inside, but deep/.. is outside once the link resolves
+		filepath.Join(allowed, "deep") + "/../secret",
+	} {
+		if _, err := s.check("path", bad); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+
+	cfg := &config.Config{Mappings: map[string]string{"escape/secret": "/secret"}}
+	if err := s.checkConfig(cfg, allowed); err == nil {
+		t.Error("Expected a config mapping through a symlink out of the roots to be rejected")
+	}
+	cfg = &config.Config{Postprocess: &config.PostprocessConfig{Command: []string{"./scan.sh"}}}
+	if err := s.checkConfig(cfg, allowed); err == nil {
+		t.Error("Expected a config with a [postprocess] command to be rejected")
+	}
+	cfg = &config.Config{GPU: &config.GPUConfig{DriverRunFile: "NVIDIA.run"}}
+	if err := s.checkConfig(cfg, allowed); err == nil || !strings.Contains(err.Error(), "[gpu] driver_run_file") {
+		t.Errorf("Expected a config with a GPU run file to be rejected, got %v", err)
+	}
+	cfg = &config.Config{Source: config.SourceConfig{Artifact: "base.squashfs"}}
+	if err := s.checkConfig(cfg, allowed); err == nil || !strings.Contains(err.Error(), "source.artifact") {
+		t.Errorf("Expected a config with a base artifact to be rejected, got %v", err)
+	}
+	cfg = &config.Config{Source: config.SourceConfig{
+		Userland:       config.UserlandBusybox,
+		BusyboxURL:     config.DefaultBusyboxURL,
+		BusyboxSHA256:  config.DefaultBusyboxSHA256,
+		BusyboxApplets: []string{config.BusyboxAppletsAll},
+	}}
+	if err := s.checkConfig(cfg, allowed); err != nil {
+		t.Errorf("Expected every applet of the default busybox to be accepted, got %v", err)
+	}
+	cfg.Source.BusyboxURL = "https://example.com/busybox"
+	if err := s.checkConfig(cfg, allowed); err == nil || !strings.Contains(err.Error(), "busybox_url") {
+		t.Errorf("Expected every applet of a custom busybox to be rejected, got %v", err)
+	}
+	cfg.Source = config.SourceConfig{Userland: config.UserlandToybox, UserlandURL: "https://example.com/toybox", BusyboxApplets: []string{config.BusyboxAppletsAll}}
+	if err := s.checkConfig(cfg, allowed); err == nil || !strings.Contains(err.Error(), "toybox") {
+		t.Errorf("Expected every applet of toybox to be rejected, got %v", err)
+	}
+	for field, cfg := range map[string]*config.Config{
+		"init.path":             {Init: &config.InitConfig{Path: "escape/secret"}},
+		"source.export_image":   {Source: config.SourceConfig{ExportImage: "escape/image.tar"}},
+		"kernel.modules_dir":    {Kernel: &config.KernelConfig{ModulesDir: "escape/sub"}},
+		"selinux.file_contexts": {SELinux: &config.SELinuxConfig{FileContexts: "escape/secret"}},
+		"assets.source":         {Assets: []config.Asset{{Source: "git+file://escape/repo", Ref: "main", Dest: "/opt"}}},
+	} {
+		if err := s.checkConfig(cfg, allowed); err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected %s through a symlink out of the roots to be rejected, got %v", field, err)
+		}
+	}
+
+	// The checked paths replace those of the config, so swapping a link
+	// after the check cannot redirect the build
+	os.Mkdir(filepath.Join(allowed, "real"), 0755)
+	os.Symlink("real", filepath.Join(allowed, "link"))
+	cfg = &config.Config{Mappings: map[string]string{"link/app": "/app"}, Init: &config.InitConfig{Path: "link/init"}}
+	if err := s.checkConfig(cfg, allowed); err != nil {
+		t.Fatalf("checkConfig failed: %v", err)
+	}
+	real, _ := filepath.EvalSymlinks(filepath.Join(allowed, "real"))
+	if cfg.Mappings[filepath.Join(real, "app")] != "/app" || cfg.Init.Path != filepath.Join(real, "init") {
+		t.Errorf("Expected canonical paths, got mappings %v and init.path %s", cfg.Mappings, cfg.Init.Path)
+	}
+	if s, _ := newPathSandbox(nil); s != nil {
+		t.Error("Expected no sandbox without roots")
+	}
+	if _, err := newPathSandbox([]string{"relative"}); err == nil {
+		t.Error("Expected an error for a relative root")
+	}
+}
+
+// TestBuildHandlerSandbox tests that build requests naming paths outside
+// the allowed roots are rejected before anything is read.
+func TestBuildHandlerSandbox(t *testing.T) {
+	allowed := t.TempDir()
+	outside := t.TempDir()
+	cfgData := []byte("version = \"1\"\nstrategy = \"initramfs\"\n")
+	os.WriteFile(filepath.Join(allowed, "fledge.toml"), cfgData, 0644)
+	os.WriteFile(filepath.Join(outside, "fledge.toml"), cfgData, 0644)
+
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	sandbox, err := newPathSandbox([]string{allowed})
+	if err != nil {
+		t.Fatalf("newPathSandbox failed: %v", err)
+	}
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		return os.WriteFile(output, []byte("artifact"), 0644)
+	}
+	handler := buildHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), sandbox, 0, build, build)
+
+	for _, tc := range []struct {
+		req  buildRequest
+		want int
+	}{
+		{buildRequest{ConfigPath: filepath.Join(allowed, "fledge.toml")}, http.StatusOK},
+		{buildRequest{ConfigPath: filepath.Join(allowed, "fledge.toml"), OutputPath: filepath.Join(allowed, "out.img")}, http.StatusOK},
+		{buildRequest{ConfigPath: filepath.Join(outside, "fledge.toml")}, http.StatusForbidden},
+		{buildRequest{ConfigPath: filepath.Join(allowed, "fledge.toml"), OutputPath: filepath.Join(outside, "out.img")}, http.StatusForbidden},
+		{buildRequest{Config: string(cfgData), WorkDir: outside}, http.StatusForbidden},
+		// Inline configs without a work_dir may not read host files at all
+		{buildRequest{Config: string(cfgData) + "\n[mappings]\n\"/etc/hostname\" = \"/hostname\"\n"}, http.StatusBadRequest},
+		// Nor run commands on the server
+		{buildRequest{Config: string(cfgData) + "\n[postprocess]\ncommand = [\"id\"]\n"}, http.StatusBadRequest},
+		{buildRequest{Config: string(cfgData) + "\n[postprocess]\ncommand = [\"id\"]\n", WorkDir: allowed}, http.StatusBadRequest},
+		{buildRequest{Config: string(cfgData) + "\n[gpu]\ndriver_run_file = \"NVIDIA.run\"\n", WorkDir: allowed}, http.StatusBadRequest},
+	} {
+		body, _ := json.Marshal(tc.req)
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/v1/build", strings.NewReader(string(body))))
+		if rec.Code != tc.want {
+			t.Errorf("Expected %d for %+v, got %d: %s", tc.want, tc.req, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -2,38 +2,207 @@ package server
 
 import (
     "context"
+    "crypto/tls"
     "encoding/json"
+    "errors"
     "fmt"
     "net/http"
     "os"
+    "path/filepath"
+    "strconv"
     "strings"
     "time"
 
+    "google.golang.org/grpc"
+
     "github.com/volantvm/fledge/internal/config"
     "github.com/volantvm/fledge/internal/logging"
+    "github.com/volantvm/fledge/internal/publish"
+    "github.com/volantvm/fledge/internal/utils"
 )
 
 type Options struct {
+    // Addr is a TCP host:port or a unix:// socket path. It is ignored when
+    // systemd passes a socket (LISTEN_FDS).
     Addr        string
+    // APIKey is a key with the admin scope, and APIKeysFile a TOML file of
+    // named keys with scopes that is reloaded when it changes. The API is
+    // open when both are empty.
     APIKey      string
+    APIKeysFile string
     CORSOrigins []string
+    // ArtifactDir stores finished artifacts for download; defaults to the
+    // fledge cache directory.
+    ArtifactDir string
+    // ArtifactTTL is how long stored artifacts are kept when their build
+    // request sets no ttl; zero keeps them until deleted.
+    ArtifactTTL time.Duration
+    // MaxArtifactBytes bounds the artifact store; the oldest artifacts are
+    // removed beyond it. Zero means no limit.
+    MaxArtifactBytes int64
+    // TenantsDir holds the workspaces of API keys that name a tenant: their
+    // artifact store, download cache and build workspaces, under
+    // <TenantsDir>/<tenant>/. Defaults to the fledge cache directory. Both
+    // ArtifactTTL and MaxArtifactBytes apply to each tenant's store.
+    TenantsDir string
+    // TenantQuota bounds the disk usage and builds of every tenant; the
+    // [tenants.<name>] tables of APIKeysFile override it per tenant.
+    TenantQuota TenantQuota
+    // MaxConcurrentBuilds bounds builds running at once and MaxQueuedBuilds
+    // those waiting for a slot; requests beyond both get 429.
+    MaxConcurrentBuilds int
+    MaxQueuedBuilds     int
+    // RateLimit is the sustained requests per second allowed per client
+    // address, with bursts of RateBurst; 429 answers requests beyond it.
+    RateLimit float64
+    RateBurst int
+    // MaxRequestBytes bounds JSON request bodies and MaxUploadBytes upload
+    // builds; larger requests get 413.
+    MaxRequestBytes int64
+    MaxUploadBytes  int64
+    // ClientTimeout fails requests whose client sends none of the body or
+    // accepts none of the response for that long.
+    ClientTimeout time.Duration
+    // AllowedRoots confines the config_path, work_dir and output_path of
+    // build requests, and the files their configs read, to these directory
+    // trees after resolving symlinks. Empty allows any path.
+    AllowedRoots []string
+    // BuildTimeout caps each build, queueing included; a build's own
+    // [build] timeout may only lower it. Zero means DefaultBuildTimeout.
+    BuildTimeout time.Duration
+    // OIDC additionally accepts Bearer JWTs issued by an OpenID Connect
+    // provider, with scopes taken from a claim.
+    OIDC OIDCOptions
+    // TLS serves HTTPS, optionally requiring client certificates.
+    TLS TLSOptions
+    // Publisher registers stored artifacts with a Volant control plane via
+    // POST /v1/artifacts/{id}/publish; publishing is disabled when nil.
+    Publisher *publish.Client
+    // AuditLog records every API request as a JSON line: a file path,
+    // AuditSinkStdout or AuditSinkSyslog. Empty disables auditing.
+    AuditLog string
+    // GRPCAddr additionally serves the gRPC API of api/fledge/v1 on a TCP
+    // host:port or unix:// socket path, with the same API key and TLS
+    // settings. Empty disables it.
+    GRPCAddr string
+    // Version is the fledge version reported by GET /v1/capabilities.
+    Version string
 }
 
+// buildRequest is the body of POST /v1/build. Exactly one of ConfigPath and
+// Config must be set.
 type buildRequest struct {
     ConfigPath string `json:"config_path"`
+    // Config is the content of a fledge.toml, for clients that cannot stage
+    // files on the daemon's host.
+    Config string `json:"config"`
+    // Manifest is the content of a manifest.toml; the default runtime
+    // manifest is used when empty.
+    Manifest string `json:"manifest"`
+    // WorkDir is the absolute directory on the daemon's host that relative
+    // paths of an inline Config resolve against. Empty builds in an empty
+    // workspace.
+    WorkDir    string `json:"work_dir"`
     OutputPath string `json:"output_path"`
+    // TTL is how long the stored artifact is kept, as a Go duration such as
+    // "24h"; empty applies the daemon's --artifact-ttl.
+    TTL string `json:"ttl"`
+    // Priority is low, normal (the default) or high; queued builds of a
+    // higher priority start first.
+    Priority string `json:"priority"`
 }
 
 type buildResponse struct {
-    Output string `json:"output"`
+    Output     string `json:"output"`
+    ArtifactID string `json:"artifact_id,omitempty"`
 }
 
 // Start launches the HTTP server and blocks until the context is done or the server exits.
-func Start(ctx context.Context, opts Options, buildFn func(ctx context.Context, cfg *config.Config, workDir, output string) error, initramfsFn func(ctx context.Context, cfg *config.Config, workDir, output string) error) error {
+func Start(ctx context.Context, opts Options, buildFn func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error, initramfsFn func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error) error {
     mux := http.NewServeMux()
 
-    wrap := func(h http.HandlerFunc) http.HandlerFunc {
-        return func(w http.ResponseWriter, r *http.Request) {
+    artifactDir := opts.ArtifactDir
+    if artifactDir == "" {
+        dir, err := utils.CacheDir("artifacts")
+        if err != nil {
+            return err
+        }
+        artifactDir = dir
+    }
+    store, err := newArtifactStore(artifactDir)
+    if err != nil {
+        return err
+    }
+    store.ttl, store.maxBytes = opts.ArtifactTTL, opts.MaxArtifactBytes
+    store.prune("")
+    go store.pruneLoop(ctx.Done())
+    tenants := newTenantSet(opts.TenantsDir, store)
+    tenants.done = ctx.Done()
+    limiter := newBuildLimiter(opts.MaxConcurrentBuilds, opts.MaxQueuedBuilds)
+    sandbox, err := newPathSandbox(opts.AllowedRoots)
+    if err != nil {
+        return err
+    }
+    if sandbox == nil {
+        logging.Warn("Build requests may name any path on this host; set allowed roots to confine them")
+    }
+
+    var oidc *oidcVerifier
+    if opts.OIDC.Enabled() {
+        oidc, err = newOIDCVerifier(opts.OIDC)
+        if err != nil {
+            return err
+        }
+    }
+    auth, err := newAuthStore(opts.APIKey, opts.APIKeysFile, oidc)
+    if err != nil {
+        return err
+    }
+    tenants.quota = func(name string) TenantQuota {
+        q := opts.TenantQuota
+        if o, ok := auth.tenantQuota(name); ok {
+            if o.MaxDiskBytes > 0 {
+                q.MaxDiskBytes = o.MaxDiskBytes
+            }
+            if o.MaxBuilds > 0 {
+                q.MaxBuilds = o.MaxBuilds
+            }
+        }
+        return q
+    }
+
+    var audit *auditLog
+    if opts.AuditLog != "" {
+        audit, err = openAuditLog(opts.AuditLog)
+        if err != nil {
+            return err
+        }
+        defer audit.Close()
+    }
+
+    rate := newRateLimiter(opts.RateLimit, opts.RateBurst)
+    maxRequest, maxUpload := opts.MaxRequestBytes, opts.MaxUploadBytes
+    if maxRequest <= 0 {
+        maxRequest = DefaultMaxRequestBytes
+    }
+    if maxUpload <= 0 {
+        maxUpload = DefaultMaxUploadBytes
+    }
+    clientTimeout := opts.ClientTimeout
+    if clientTimeout == 0 {
+        clientTimeout = DefaultClientTimeout
+    }
+
+    // wrap applies the checks every endpoint shares, accepting request
+    // bodies of up to maxBody bytes.
+    wrap := func(h http.HandlerFunc, maxBody int64) http.HandlerFunc {
+        return auditHTTP(audit, func(w http.ResponseWriter, r *http.Request) {
+            if ok, wait := rate.allow(clientAddr(r.RemoteAddr)); !ok {
+                rejectRateLimited(w, wait)
+                return
+            }
+            w, done := guardClient(w, r, maxBody, clientTimeout)
+            defer done()
             if !allowOrigin(w, r, opts.CORSOrigins) {
                 http.Error(w, "CORS not allowed", http.StatusForbidden)
                 return
@@ -42,56 +211,277 @@ func Start(ctx context.Context, opts Options, buildFn func(ctx context.Context,
                 w.WriteHeader(http.StatusNoContent)
                 return
             }
-            if opts.APIKey != "" && !authOK(r, opts.APIKey) {
+            w.Header().Set(apiVersionHeader, apiVersion)
+            tenant, code := auth.authorize(r.Context(), presentedKey(r), httpScope(r))
+            switch code {
+            case http.StatusUnauthorized:
                 http.Error(w, "unauthorized", http.StatusUnauthorized)
                 return
+            case http.StatusForbidden:
+                http.Error(w, "API key lacks the "+httpScope(r)+" scope", http.StatusForbidden)
+                return
             }
-            h(w, r)
-        }
+            h(w, r.WithContext(withTenant(r.Context(), tenant)))
+        })
     }
 
     mux.HandleFunc("/v1/healthz", wrap(func(w http.ResponseWriter, r *http.Request) {
+        running, queued := limiter.stats()
+        w.Header().Set("X-Fledge-Builds-Running", strconv.Itoa(running))
+        w.Header().Set("X-Fledge-Builds-Queued", strconv.Itoa(queued))
         w.WriteHeader(http.StatusOK)
         _, _ = w.Write([]byte("ok"))
-    }))
+    }, maxRequest))
+
+    mux.HandleFunc("/v1/openapi.json", wrap(openAPIHandler, maxRequest))
+    mux.HandleFunc("/v1/capabilities", wrap(capabilitiesHandler(opts, maxRequest, maxUpload), maxRequest))
+    mux.HandleFunc("/v1/build", wrap(buildHandler(ctx, tenants, limiter, sandbox, opts.BuildTimeout, buildFn, initramfsFn), maxRequest))
+
+    mux.HandleFunc("/v1/builds/upload", wrap(uploadHandler(ctx, tenants, limiter, opts.BuildTimeout, buildFn, initramfsFn), maxUpload))
+    mux.HandleFunc("/v1/usage", wrap(usageHandler(tenants), maxRequest))
+    mux.HandleFunc("/v1/artifacts", wrap(listArtifactsHandler(tenants), maxRequest))
+    mux.HandleFunc("/v1/artifacts/", wrap(getArtifactHandler(tenants, opts.Publisher), maxRequest))
+
+    srv := &http.Server{
+        Handler:           mux,
+        ReadHeaderTimeout: 15 * time.Second,
+        // Keep-alive connections idle this long are closed
+        IdleTimeout:    2 * time.Minute,
+        MaxHeaderBytes: 64 << 10,
+    }
+
+    var tlsCfg *tls.Config
+    if opts.TLS.Enabled() {
+        tlsCfg, err = tlsConfig(opts.TLS)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Unix socket listeners remove their socket file when closed on shutdown
+    ln, err := Listen(opts.Addr)
+    if err != nil {
+        return err
+    }
+    if tlsCfg != nil {
+        ln = tls.NewListener(ln, tlsCfg)
+    }
+
+    errCh := make(chan error, 2)
+    var grpcSrv *grpc.Server
+    if opts.GRPCAddr != "" {
+        grpcLn, err := Listen(opts.GRPCAddr)
+        if err != nil {
+            ln.Close()
+            return err
+        }
+        grpcSrv = newGRPCServer(&grpcService{
+            ctx:         ctx,
+            tenants:     tenants,
+            limiter:     limiter,
+            jobs:        newJobRegistry(),
+            maxDuration: opts.BuildTimeout,
+            sandbox:     sandbox,
+            publisher:   opts.Publisher,
+            buildFn:     buildFn,
+            initramfsFn: initramfsFn,
+        }, auth, rate, tlsCfg, audit)
+        go func() {
+            logging.Info("Fledge gRPC API listening", "addr", grpcLn.Addr().String(), "network", grpcLn.Addr().Network(), "tls", tlsCfg != nil)
+            if err := grpcSrv.Serve(grpcLn); err != nil {
+                errCh <- err
+            }
+        }()
+    }
+
+    go func() {
+        logging.Info("Fledge daemon listening", "addr", ln.Addr().String(), "network", ln.Addr().Network(), "tls", tlsCfg != nil, "client_auth", tlsCfg != nil && tlsCfg.ClientCAs != nil)
+        if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+            errCh <- err
+        }
+    }()
+
+    select {
+    case <-ctx.Done():
+        ctxShutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        _ = srv.Shutdown(ctxShutdown)
+        if grpcSrv != nil {
+            grpcSrv.Stop()
+        }
+        return nil
+    case err := <-errCh:
+        if grpcSrv != nil {
+            grpcSrv.Stop()
+        }
+        return err
+    }
+}
 
-    mux.HandleFunc("/v1/build", wrap(func(w http.ResponseWriter, r *http.Request) {
+// buildHandler serves POST /v1/build, which builds a fledge.toml on the
+// daemon's host (config_path) or one sent inline (config), optionally with an
+// inline manifest.toml. The artifact is written to output_path, or kept in
+// the store of the caller's tenant only when that is empty. Host paths must lie within sandbox, and
+// inline configs without a work_dir may only read their empty workspace.
+// Builds are cancelled after maxDuration, or the config's shorter [build]
+// timeout.
+func buildHandler(ctx context.Context, tenants *tenantSet, limiter *buildLimiter, sandbox *pathSandbox, maxDuration time.Duration, buildFn, initramfsFn buildFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost {
             http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
             return
         }
+        ticket, ok := limiter.admit()
+        if !ok {
+            rejectQueueFull(w)
+            return
+        }
+        defer ticket.release()
+        tenant, ok := tenants.forRequest(w, r)
+        if !ok {
+            return
+        }
+        release, err := tenants.admit(tenant)
+        if err != nil {
+            rejectQuota(w, err)
+            return
+        }
+        defer release()
+        store := tenant.store
+
         var req buildRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            var tooLarge *http.MaxBytesError
+            if errors.As(err, &tooLarge) {
+                http.Error(w, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+                return
+            }
             http.Error(w, "invalid json", http.StatusBadRequest)
             return
         }
-        if req.ConfigPath == "" {
-            http.Error(w, "config_path required", http.StatusBadRequest)
+        if (req.ConfigPath == "") == (req.Config == "") {
+            http.Error(w, "exactly one of config_path and config required", http.StatusBadRequest)
+            return
+        }
+        if req.WorkDir != "" && (req.Config == "" || !filepath.IsAbs(req.WorkDir)) {
+            http.Error(w, "work_dir must be an absolute path and requires config", http.StatusBadRequest)
+            return
+        }
+        ttl, err := parseTTL(req.TTL)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if ticket.priority, err = parsePriority(req.Priority); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
-        cfg, err := config.Load(req.ConfigPath)
+        // Checked before anything is read, and used canonical from here on
+        // so that a symlink swapped later cannot redirect the build
+        for _, p := range []struct {
+            field string
+            path  *string
+        }{{"config_path", &req.ConfigPath}, {"work_dir", &req.WorkDir}, {"output_path", &req.OutputPath}} {
+            if *p.path, err = sandbox.check(p.field, *p.path); err != nil {
+                http.Error(w, err.Error(), http.StatusForbidden)
+                return
+            }
+        }
+
+        // Builds without an explicit output or work_dir get their own
+        // workspace; their artifact is moved into the store afterwards.
+        var workspace string
+        if req.OutputPath == "" || (req.Config != "" && req.WorkDir == "") {
+            workspace, err = tenant.mkdirTemp("fledge-build-*")
+            if err != nil {
+                http.Error(w, "failed to create workspace", http.StatusInternalServerError)
+                return
+            }
+            defer os.RemoveAll(workspace)
+        }
+
+        var cfg *config.Config
+        var workDir string
+        if req.Config != "" {
+            auditConfig(r.Context(), []byte(req.Config))
+            cfg, err = config.Parse([]byte(req.Config), nil)
+            workDir = req.WorkDir
+            if workDir == "" {
+                workDir = filepath.Join(workspace, "src")
+                if mkErr := os.Mkdir(workDir, 0755); mkErr != nil {
+                    http.Error(w, "failed to create workspace", http.StatusInternalServerError)
+                    return
+                }
+            }
+        } else {
+            auditConfigFile(r.Context(), req.ConfigPath)
+            cfg, err = config.Load(req.ConfigPath)
+            workDir = dirOf(req.ConfigPath)
+        }
+        if err == nil && req.Config != "" {
+            err = checkServedConfig(cfg)
+        }
         if err != nil {
             http.Error(w, fmt.Sprintf("config error: %v", err), http.StatusBadRequest)
             return
         }
-        workDir := dirOf(req.ConfigPath)
+        if req.Config != "" && req.WorkDir == "" {
+            if err := confineToWorkspace(cfg, workDir); err != nil {
+                http.Error(w, fmt.Sprintf("config error: %v", err), http.StatusBadRequest)
+                return
+            }
+        } else if err := sandbox.checkConfig(cfg, workDir); err != nil {
+            http.Error(w, fmt.Sprintf("config error: %v", err), http.StatusForbidden)
+            return
+        }
+        var manifestTpl *config.ManifestTemplate
+        if req.Manifest != "" {
+            manifestTpl, err = config.ParseManifestTemplate([]byte(req.Manifest), workDir)
+            if err != nil {
+                http.Error(w, fmt.Sprintf("manifest error: %v", err), http.StatusBadRequest)
+                return
+            }
+        }
+
         output := req.OutputPath
-        if output == "" {
-            output = defaultOutput(cfg)
+        isolated := output == ""
+        if isolated {
+            output = filepath.Join(workspace, filepath.Base(defaultOutput(cfg)))
+        } else {
+            if abs, err := filepath.Abs(output); err == nil {
+                output = abs
+            }
+            if !ticket.claimOutput(output) {
+                http.Error(w, "another build is already writing "+output, http.StatusConflict)
+                return
+            }
         }
 
-        ctx2, cancel := context.WithTimeout(ctx, 12*time.Hour)
+        timeout := buildTimeout(maxDuration, cfg)
+        guarded, stop := tenants.guard(tenant.buildContext(ctx), tenant)
+        defer stop()
+        ctx2, cancel := context.WithTimeout(withBuildID(guarded, w), timeout)
         defer cancel()
 
+        if err := ticket.wait(ctx2); err != nil {
+            http.Error(w, "build cancelled while queued", http.StatusServiceUnavailable)
+            return
+        }
+        configName := req.ConfigPath
+        if configName == "" {
+            configName = "inline"
+        }
+        logging.InfoContext(ctx2, "Starting build", logging.KeyStrategy, cfg.Strategy, "config", configName, "priority", priorityName(ticket.priority))
+
         switch cfg.Strategy {
         case config.StrategyOCIRootfs:
-            if err := buildFn(ctx2, cfg, workDir, output); err != nil {
-                http.Error(w, fmt.Sprintf("build failed: %v", err), http.StatusInternalServerError)
+            if err := buildFn(ctx2, cfg, manifestTpl, workDir, output); err != nil {
+                writeBuildError(w, ctx2, timeout, err)
                 return
             }
         case config.StrategyInitramfs:
-            if err := initramfsFn(ctx2, cfg, workDir, output); err != nil {
-                http.Error(w, fmt.Sprintf("build failed: %v", err), http.StatusInternalServerError)
+            if err := initramfsFn(ctx2, cfg, manifestTpl, workDir, output); err != nil {
+                writeBuildError(w, ctx2, timeout, err)
                 return
             }
         default:
@@ -99,42 +489,35 @@ func Start(ctx context.Context, opts Options, buildFn func(ctx context.Context,
             return
         }
 
-        json.NewEncoder(w).Encode(buildResponse{Output: output})
-    }))
-
-    srv := &http.Server{
-        Addr:              opts.Addr,
-        Handler:           mux,
-        ReadHeaderTimeout: 15 * time.Second,
-    }
-
-    errCh := make(chan error, 1)
-    go func() {
-        logging.Info("Fledge daemon listening", "addr", opts.Addr)
-        if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-            errCh <- err
+        resp := buildResponse{Output: output}
+        a, err := store.add(output, cfg.Strategy, isolated, ttl)
+        switch {
+        case err == nil:
+            resp.ArtifactID = a.ID
+            auditNote(r.Context(), "", a.ID)
+            if isolated {
+                resp.Output = store.path(a, false)
+            }
+        case isolated:
+            http.Error(w, fmt.Sprintf("failed to store artifact: %v", err), http.StatusInternalServerError)
+            return
+        default:
+            logging.WarnContext(ctx2, "Failed to store artifact", "output", output, "error", err)
         }
-    }()
-
-    select {
-    case <-ctx.Done():
-        ctxShutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-        defer cancel()
-        _ = srv.Shutdown(ctxShutdown)
-        return nil
-    case err := <-errCh:
-        return err
+        json.NewEncoder(w).Encode(resp)
     }
 }
 
-func authOK(r *http.Request, apiKey string) bool {
-    if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
-        return strings.TrimPrefix(h, "Bearer ") == apiKey
+// parseTTL parses the ttl of a build request; empty returns zero.
+func parseTTL(s string) (time.Duration, error) {
+    if s == "" {
+        return 0, nil
     }
-    if h := r.Header.Get("X-API-Key"); h != "" {
-        return h == apiKey
+    ttl, err := time.ParseDuration(s)
+    if err != nil || ttl <= 0 {
+        return 0, fmt.Errorf("invalid ttl %q: must be a positive duration such as 24h", s)
     }
-    return false
+    return ttl, nil
 }
 
 func allowOrigin(w http.ResponseWriter, r *http.Request, origins []string) bool {
@@ -160,7 +543,7 @@ func allowOrigin(w http.ResponseWriter, r *http.Request, origins []string) bool
         w.Header().Set("Access-Control-Allow-Origin", origin)
         w.Header().Set("Vary", "Origin")
         w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
-        w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Methods", "POST, GET, DELETE, OPTIONS")
     }
     return allowed
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// TestBuildHandlerInlineConfig tests a /v1/build request carrying its
+// fledge.toml and manifest.toml in the body.
+func TestBuildHandlerInlineConfig(t *testing.T) {
+	var sawName string
+	var sawWorkDir string
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		if manifestTpl != nil {
+			sawName = manifestTpl.Name
+		}
+		sawWorkDir = workDir
+		return os.WriteFile(output, []byte("artifact"), 0644)
+	}
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	handler := buildHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), nil, 0, build, build)
+
+	body, _ := json.Marshal(buildRequest{
+		Config:   "version = \"1\"\nstrategy = \"initramfs\"\n",
+		Manifest: "name = \"hello\"\nversion = \"1.0.0\"\nruntime = \"hello\"\n",
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/v1/build", strings.NewReader(string(body))))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp buildResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.ArtifactID == "" {
+		t.Errorf("Expected the artifact to be stored, got %+v", resp)
+	}
+	if sawName != "hello" {
+		t.Errorf("Expected the inline manifest to reach the build, got name %q", sawName)
+	}
+	if _, err := os.Stat(sawWorkDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the workspace %s to be removed, got %v", sawWorkDir, err)
+	}
+
+	for _, req := range []buildRequest{
+		{},
+		{ConfigPath: "/srv/fledge.toml", Config: "version = \"1\""},
+		{ConfigPath: "/srv/fledge.toml", WorkDir: "/srv"},
+		{Config: "version = \"1\"\nstrategy = \"initramfs\"\n", WorkDir: "relative"},
+		{Config: "not toml ["},
+	} {
+		body, _ := json.Marshal(req)
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/v1/build", strings.NewReader(string(body))))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %+v, got %d: %s", req, rec.Code, rec.Body.String())
+		}
+	}
+}
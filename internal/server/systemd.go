@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSocketPath is the socket used by the generated systemd units when
+// serve is not given a unix:// address.
+const DefaultSocketPath = "/run/fledge.sock"
+
+// SystemdUnits returns fledge.socket and fledge.service units that start
+// "execPath serve" on demand through socket activation on socketPath.
+// Daemon settings such as FLEDGE_API_KEY are read from /etc/fledge/fledge.env.
+func SystemdUnits(execPath, socketPath string) map[string]string {
+	socket := fmt.Sprintf(`[Unit]
+Description=Fledge build daemon socket
+
+[Socket]
+ListenStream=%s
+SocketMode=0660
+
+[Install]
+WantedBy=sockets.target
+`, socketPath)
+
+	service := fmt.Sprintf(`[Unit]
+Description=Fledge build daemon
+Documentation=https://github.com/volantvm/fledge
+Requires=fledge.socket
+After=network-online.target fledge.socket
+
+[Service]
+Type=simple
+EnvironmentFile=-/etc/fledge/fledge.env
+ExecStart=%s serve --addr %s
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`, execPath, unixScheme+socketPath)
+
+	return map[string]string{
+		"fledge.socket":  socket,
+		"fledge.service": service,
+	}
+}
+
+// InstallSystemd writes the units from SystemdUnits into dir and returns
+// their paths.
+func InstallSystemd(dir, execPath, socketPath string) ([]string, error) {
+	if strings.ContainsAny(execPath, " \t\n") {
+		return nil, fmt.Errorf("executable path %q contains whitespace", execPath)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	var paths []string
+	for _, name := range []string{"fledge.socket", "fledge.service"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(SystemdUnits(execPath, socketPath)[name]), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
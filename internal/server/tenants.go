@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// defaultTenant is the tenant of keys that name none, and of every request
+// when the API is open.
+const defaultTenant = ""
+
+// tenantNamePattern restricts tenant names to safe directory names.
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// validTenantName reports whether name can name a tenant.
+func validTenantName(name string) bool {
+	return tenantNamePattern.MatchString(name)
+}
+
+// tenantKey is the context key of the tenant of a request.
+type tenantKey struct{}
+
+// withTenant returns ctx carrying the tenant the caller authenticated as.
+func withTenant(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, name)
+}
+
+// tenantFrom returns the tenant of ctx, or defaultTenant.
+func tenantFrom(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+// tenant is the isolated workspace of the API keys naming it: its own
+// artifact store, download cache, BuildKit state and build workspaces, under
+// <tenants dir>/<name>/. The default tenant uses the daemon's store, cache
+// and temp directory.
+type tenant struct {
+	name  string
+	dir   string
+	store *artifactStore
+	// cacheDir replaces fledge's cache directory for the tenant's builds.
+	cacheDir string
+	// tempDir holds the tenant's build workspaces.
+	tempDir string
+
+	mu sync.Mutex
+	// builds counts the tenant's builds running or queued.
+	builds int
+	// usage is the size of dir, as measured at measuredAt.
+	usage      int64
+	measuredAt time.Time
+}
+
+// mkdirTemp creates a build workspace of the tenant.
+func (t *tenant) mkdirTemp(pattern string) (string, error) {
+	return os.MkdirTemp(t.tempDir, pattern)
+}
+
+// buildContext returns ctx for a build of the tenant: its downloads and
+// BuildKit state are kept in the tenant's cache and its log records name the
+// tenant.
+func (t *tenant) buildContext(ctx context.Context) context.Context {
+	if t.name == defaultTenant {
+		return ctx
+	}
+	return logging.NewContext(utils.WithCacheDir(ctx, t.cacheDir), logging.KeyTenant, t.name)
+}
+
+// tenantSet opens tenant workspaces as their keys first use them. Every
+// tenant store gets the artifact ttl and size limit of the default one.
+type tenantSet struct {
+	// root holds the tenant workspaces; empty resolves to the tenants
+	// subdirectory of fledge's cache when first needed.
+	root string
+	def  *tenant
+	// done stops the prune loops of the tenant stores; nil starts none.
+	done <-chan struct{}
+	// quota returns the quota of a named tenant; nil sets none.
+	quota func(name string) TenantQuota
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+}
+
+// newTenantSet returns the tenants under root, whose default tenant keeps
+// its artifacts in store.
+func newTenantSet(root string, store *artifactStore) *tenantSet {
+	return &tenantSet{
+		root:    root,
+		def:     &tenant{name: defaultTenant, store: store},
+		tenants: make(map[string]*tenant),
+	}
+}
+
+// get returns tenant name, creating its workspace when first used.
+func (s *tenantSet) get(name string) (*tenant, error) {
+	if name == defaultTenant {
+		return s.def, nil
+	}
+	if !validTenantName(name) {
+		return nil, fmt.Errorf("invalid tenant %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tenants[name]; ok {
+		return t, nil
+	}
+	if s.root == "" {
+		root, err := utils.CacheDir("tenants")
+		if err != nil {
+			return nil, err
+		}
+		s.root = root
+	}
+	dir := filepath.Join(s.root, name)
+	t := &tenant{
+		name:     name,
+		dir:      dir,
+		cacheDir: filepath.Join(dir, "cache"),
+		tempDir:  filepath.Join(dir, "tmp"),
+	}
+	for _, d := range []string{t.cacheDir, t.tempDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create tenant directory %s: %w", d, err)
+		}
+	}
+	store, err := newArtifactStore(filepath.Join(dir, "artifacts"))
+	if err != nil {
+		return nil, err
+	}
+	store.ttl, store.maxBytes = s.def.store.ttl, s.def.store.maxBytes
+	store.prune("")
+	if s.done != nil {
+		go store.pruneLoop(s.done)
+	}
+	t.store = store
+	s.tenants[name] = t
+	logging.Info("Opened tenant workspace", logging.KeyTenant, name, "dir", dir)
+	return t, nil
+}
+
+// forContext returns the tenant of the request of ctx.
+func (s *tenantSet) forContext(ctx context.Context) (*tenant, error) {
+	return s.get(tenantFrom(ctx))
+}
+
+// forRequest returns the tenant of r, or answers 500 when its workspace
+// cannot be opened.
+func (s *tenantSet) forRequest(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	t, err := s.forContext(r.Context())
+	if err != nil {
+		logging.Error("Failed to open tenant workspace", logging.KeyTenant, tenantFrom(r.Context()), "error", err)
+		http.Error(w, "failed to open tenant workspace", http.StatusInternalServerError)
+		return nil, false
+	}
+	return t, true
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// TestTenantKeys tests that keys naming a tenant authorize into it.
+func TestTenantKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.toml")
+	keys := "[[keys]]\nname = \"a\"\nkey = \"a-secret\"\nscopes = [\"admin\"]\ntenant = \"team-a\"\n\n" +
+		"[[keys]]\nname = \"ops\"\nkey = \"ops-secret\"\nscopes = [\"read\"]\n"
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newAuthStore("", path, nil)
+	if err != nil {
+		t.Fatalf("newAuthStore failed: %v", err)
+	}
+	ctx := context.Background()
+	if tenant, code := auth.authorize(ctx, "a-secret", ScopeBuild); code != 0 || tenant != "team-a" {
+		t.Errorf("authorize = %q, %d; want team-a, 0", tenant, code)
+	}
+	if tenant, code := auth.authorize(ctx, "ops-secret", ScopeRead); code != 0 || tenant != defaultTenant {
+		t.Errorf("authorize = %q, %d; want the default tenant", tenant, code)
+	}
+
+	for _, bad := range []string{"Team-A", "../a", "-a"} {
+		if err := os.WriteFile(path, []byte("[[keys]]\nname = \"a\"\nkey = \"k\"\nscopes = [\"read\"]\ntenant = \""+bad+"\"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadAPIKeys(path); err == nil {
+			t.Errorf("Expected tenant %q to be rejected", bad)
+		}
+	}
+}
+
+// TestTenantIsolation tests that tenants only see their own artifacts and
+// jobs.
+func TestTenantIsolation(t *testing.T) {
+	def, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	root := t.TempDir()
+	tenants := newTenantSet(root, def)
+
+	a, err := tenants.get("team-a")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if again, _ := tenants.get("team-a"); again != a {
+		t.Error("Expected the tenant to be opened once")
+	}
+	for _, dir := range []string{"artifacts", "cache", "tmp"} {
+		if _, err := os.Stat(filepath.Join(root, "team-a", dir)); err != nil {
+			t.Errorf("Expected the tenant's %s directory: %v", dir, err)
+		}
+	}
+	if _, err := tenants.get("../etc"); err == nil {
+		t.Error("Expected an invalid tenant to be rejected")
+	}
+
+	output := filepath.Join(t.TempDir(), "app.img")
+	if err := os.WriteFile(output, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	art, err := a.store.add(output, "oci_rootfs", false, 0)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	get := getArtifactHandler(tenants, nil)
+	for tenant, want := range map[string]int{"team-a": http.StatusOK, "team-b": http.StatusNotFound, defaultTenant: http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/artifacts/"+art.ID+"/info", nil)
+		rec := httptest.NewRecorder()
+		get(rec, req.WithContext(withTenant(req.Context(), tenant)))
+		if rec.Code != want {
+			t.Errorf("Tenant %q got %d, want %d", tenant, rec.Code, want)
+		}
+	}
+
+	// Builds of the tenant cache their downloads in its workspace
+	cache, err := utils.CacheDirContext(a.buildContext(context.Background()), "downloads")
+	if err != nil || cache != filepath.Join(root, "team-a", "cache", "downloads") {
+		t.Errorf("CacheDirContext = %q, %v", cache, err)
+	}
+
+	jobs := newJobRegistry()
+	jobs.add(newJob("job-a", "team-a", "oci_rootfs", "", func() {}))
+	if _, ok := jobs.get("job-a", "team-b"); ok {
+		t.Error("Expected another tenant's job to be hidden")
+	}
+	if _, ok := jobs.get("job-a", "team-a"); !ok {
+		t.Error("Expected the tenant's own job")
+	}
+	if n := len(jobs.list(defaultTenant)); n != 0 {
+		t.Errorf("Expected no jobs in the default tenant, got %d", n)
+	}
+}
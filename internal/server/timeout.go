@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/volantvm/fledge/internal/config"
+)
+
+// DefaultBuildTimeout caps how long a served build may take, including time
+// spent queued for a slot. A zero Options.BuildTimeout falls back to it.
+const DefaultBuildTimeout = 12 * time.Hour
+
+// buildTimeout returns the deadline for a build of cfg: the server cap max,
+// lowered to the build's own [build] timeout when that is shorter.
+func buildTimeout(max time.Duration, cfg *config.Config) time.Duration {
+	if max <= 0 {
+		max = DefaultBuildTimeout
+	}
+	if d := cfg.BuildTimeout(); d > 0 && d < max {
+		return d
+	}
+	return max
+}
+
+// writeBuildError reports a failed build, answering 504 when it ran out of
+// time and 507 when its tenant ran out of disk quota, rather than failing on
+// its own.
+func writeBuildError(w http.ResponseWriter, ctx context.Context, timeout time.Duration, err error) {
+	msg, status := buildError(ctx, timeout, err)
+	http.Error(w, msg, status)
+}
+
+// buildError returns the message and HTTP status of a failed build of ctx.
+func buildError(ctx context.Context, timeout time.Duration, err error) (string, int) {
+	if errors.Is(context.Cause(ctx), errDiskQuota) {
+		return fmt.Sprintf("build failed: %v: %v", errDiskQuota, err), http.StatusInsufficientStorage
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Sprintf("build failed: exceeded timeout of %s: %v", timeout, err), http.StatusGatewayTimeout
+	}
+	return fmt.Sprintf("build failed: %v", err), http.StatusInternalServerError
+}
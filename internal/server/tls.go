@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSOptions enables HTTPS for the daemon. With ClientCA set, clients must
+// present a certificate signed by it (mutual TLS).
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	ClientCA string
+}
+
+// Enabled reports whether any TLS option is set.
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != "" || o.ClientCA != ""
+}
+
+// tlsConfig loads the server certificate and client CA described by o.
+func tlsConfig(o TLSOptions) (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, fmt.Errorf("TLS requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if o.ClientCA != "" {
+		data, err := os.ReadFile(o.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in client CA %s", o.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA when
+// parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+"-key.pem")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certPath, keyPath
+}
+
+// tlsPair converts the certificate for use by a TLS client.
+func (c *testCert) tlsPair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// TestTLSConfig_MutualTLS tests that client certificates are required and verified.
+func TestTLSConfig_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "fledge-ca", nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newTestCert(t, "fledge-server", ca).write(t, dir, "server")
+	client := newTestCert(t, "client", ca)
+	stranger := newTestCert(t, "stranger", newTestCert(t, "other-ca", nil))
+
+	cfg, err := tlsConfig(TLSOptions{CertFile: certPath, KeyFile: keyPath, ClientCA: caPath})
+	if err != nil {
+		t.Fatalf("tlsConfig failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(tls.NewListener(ln, cfg))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) error {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := c.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(client.tlsPair()); err != nil {
+		t.Errorf("Expected client with trusted certificate to connect: %v", err)
+	}
+	if err := get(); err == nil {
+		t.Error("Expected client without certificate to be rejected")
+	}
+	if err := get(stranger.tlsPair()); err == nil {
+		t.Error("Expected client with untrusted certificate to be rejected")
+	}
+}
+
+// TestTLSConfig_Errors tests invalid TLS option combinations.
+func TestTLSConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := newTestCert(t, "fledge-server", nil).write(t, dir, "server")
+	notPEM := filepath.Join(dir, "ca.txt")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0644)
+
+	cases := map[string]TLSOptions{
+		"missing key":    {CertFile: certPath},
+		"only client CA": {ClientCA: certPath},
+		"bad client CA":  {CertFile: certPath, KeyFile: keyPath, ClientCA: notPEM},
+		"missing files":  {CertFile: filepath.Join(dir, "nope.pem"), KeyFile: keyPath},
+	}
+	for name, opts := range cases {
+		if _, err := tlsConfig(opts); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	cfg, err := tlsConfig(TLSOptions{CertFile: certPath, KeyFile: keyPath})
+	if err != nil {
+		t.Fatalf("tlsConfig failed: %v", err)
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Error("Expected no client authentication without a client CA")
+	}
+}
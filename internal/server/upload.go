@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/utils"
+)
+
+// uploadConfigName is the name the uploaded config is stored under.
+const uploadConfigName = "fledge.toml"
+
+// Multipart field names accepted by /v1/builds/upload.
+const (
+	uploadFieldConfig   = "config"
+	uploadFieldContext  = "context"
+	uploadFieldFile     = "file"
+	uploadFieldManifest = "manifest"
+)
+
+// uploadEventsType is the content type of a streamed upload build.
+const uploadEventsType = "application/x-ndjson"
+
+// buildFunc builds cfg from workDir into output. A nil manifestTpl selects
+// the default runtime manifest.
+type buildFunc func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error
+
+// uploadHandler serves POST /v1/builds/upload. The multipart body carries
+// fledge.toml ("config"), an optional manifest.toml ("manifest"), an optional
+// tar, tar.gz or tar.zst build context ("context") and any number of payload
+// files ("file"), which are unpacked into a fresh workspace of the caller's
+// tenant. The built artifact is moved into the tenant's store and returned as
+// the response body, with its ID in the X-Fledge-Artifact-Id header; the
+// workspace is removed afterwards. With the "stream" query parameter set, the
+// build's log records and its stored artifact are streamed as uploadEvents
+// instead, and the build is cancelled if the client disconnects. The "ttl"
+// query parameter sets how long the artifact is kept and "priority" its place
+// in the queue. Builds are cancelled after maxDuration, or the config's
+// shorter [build] timeout.
+func uploadHandler(ctx context.Context, tenants *tenantSet, limiter *buildLimiter, maxDuration time.Duration, buildFn, initramfsFn buildFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ttl, err := parseTTL(r.URL.Query().Get("ttl"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		priority, err := parsePriority(r.URL.Query().Get("priority"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stream, err := parseStream(r.URL.Query().Get("stream"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Reject before reading the upload when the queue is full
+		ticket, ok := limiter.admit()
+		if !ok {
+			rejectQueueFull(w)
+			return
+		}
+		defer ticket.release()
+		ticket.priority = priority
+
+		tenant, ok := tenants.forRequest(w, r)
+		if !ok {
+			return
+		}
+		release, err := tenants.admit(tenant)
+		if err != nil {
+			rejectQuota(w, err)
+			return
+		}
+		defer release()
+		store := tenant.store
+		workspace, err := tenant.mkdirTemp("fledge-upload-*")
+		if err != nil {
+			http.Error(w, "failed to create workspace", http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(workspace)
+
+		srcDir := filepath.Join(workspace, "src")
+		manifest, err := receiveUpload(r, srcDir)
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("upload error: %v", err), status)
+			return
+		}
+
+		auditConfigFile(r.Context(), filepath.Join(srcDir, uploadConfigName))
+		cfg, err := config.Load(filepath.Join(srcDir, uploadConfigName))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("config error: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := confineToWorkspace(cfg, srcDir); err != nil {
+			http.Error(w, fmt.Sprintf("config error: %v", err), http.StatusBadRequest)
+			return
+		}
+		var manifestTpl *config.ManifestTemplate
+		if manifest != nil {
+			manifestTpl, err = config.ParseManifestTemplate(manifest, srcDir)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("manifest error: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		outDir := filepath.Join(workspace, "out")
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			http.Error(w, "failed to create output directory", http.StatusInternalServerError)
+			return
+		}
+		output := filepath.Join(outDir, filepath.Base(defaultOutput(cfg)))
+
+		timeout := buildTimeout(maxDuration, cfg)
+		guarded, stop := tenants.guard(tenant.buildContext(ctx), tenant)
+		defer stop()
+		ctx2, cancel := context.WithTimeout(withBuildID(guarded, w), timeout)
+		defer cancel()
+
+		if err := ticket.wait(ctx2); err != nil {
+			http.Error(w, "build cancelled while queued", http.StatusServiceUnavailable)
+			return
+		}
+
+		var fn buildFunc
+		switch cfg.Strategy {
+		case config.StrategyOCIRootfs:
+			fn = buildFn
+		case config.StrategyInitramfs:
+			fn = initramfsFn
+		default:
+			http.Error(w, "unsupported strategy", http.StatusBadRequest)
+			return
+		}
+		if stream {
+			// Nobody downloads the artifact once the client is gone
+			stopCancel := context.AfterFunc(r.Context(), cancel)
+			defer stopCancel()
+			streamUploadBuild(ctx2, w, func() (*Artifact, string, int) {
+				logging.InfoContext(ctx2, "Starting upload build", logging.KeyStrategy, cfg.Strategy, "workspace", workspace, "priority", priorityName(priority))
+				if err := fn(ctx2, cfg, manifestTpl, srcDir, output); err != nil {
+					msg, status := buildError(ctx2, timeout, err)
+					return nil, msg, status
+				}
+				a, err := store.add(output, cfg.Strategy, true, ttl)
+				if err != nil {
+					return nil, fmt.Sprintf("failed to store artifact: %v", err), http.StatusInternalServerError
+				}
+				return a, "", 0
+			})
+			return
+		}
+
+		logging.InfoContext(ctx2, "Starting upload build", logging.KeyStrategy, cfg.Strategy, "workspace", workspace, "priority", priorityName(priority))
+		if err := fn(ctx2, cfg, manifestTpl, srcDir, output); err != nil {
+			writeBuildError(w, ctx2, timeout, err)
+			return
+		}
+
+		a, err := store.add(output, cfg.Strategy, true, ttl)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to store artifact: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(artifactIDHeader, a.ID)
+		serveArtifactFile(w, r, store.path(a, false), a.Name, "application/octet-stream")
+	}
+}
+
+// parseStream parses the "stream" query parameter of an upload build.
+func parseStream(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	stream, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid stream %q: must be true or false", s)
+	}
+	return stream, nil
+}
+
+// uploadEvent is a line of a streamed upload build: a log record of the
+// build, or its outcome, which is the last line.
+type uploadEvent struct {
+	Log *uploadLog `json:"log,omitempty"`
+	// Artifact is the stored artifact of a successful build, to download
+	// from /v1/artifacts/{id}.
+	Artifact *Artifact `json:"artifact,omitempty"`
+	// Error and Status describe a failed build as the HTTP status it would
+	// have been answered with otherwise.
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// uploadLog is a log record of a streamed upload build.
+type uploadLog struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Step    string            `json:"step,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// streamUploadBuild runs build, the build of ctx, answering with its log
+// records as they are logged and then its outcome, one uploadEvent per line.
+// Records are buffered for a slow client; beyond maxJobLogEntries the oldest
+// are dropped.
+func streamUploadBuild(ctx context.Context, w http.ResponseWriter, build func() (*Artifact, string, int)) {
+	var (
+		mu      sync.Mutex
+		pending []uploadLog
+		wake    = make(chan struct{}, 1)
+	)
+	stopLog := logging.OnBuildLog(ctx, func(e logging.Entry) {
+		step, attrs := entryAttrs(e)
+		mu.Lock()
+		if len(pending) == maxJobLogEntries {
+			pending = pending[1:]
+		}
+		pending = append(pending, uploadLog{Time: e.Time, Level: e.Level.String(), Message: e.Message, Step: step, Attrs: attrs})
+		mu.Unlock()
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+
+	w.Header().Set("Content-Type", uploadEventsType)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		mu.Lock()
+		logs := pending
+		pending = nil
+		mu.Unlock()
+		for i := range logs {
+			enc.Encode(uploadEvent{Log: &logs[i]})
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	done := make(chan struct{})
+	var result uploadEvent
+	go func() {
+		defer close(done)
+		result.Artifact, result.Error, result.Status = build()
+	}()
+	for running := true; running; {
+		select {
+		case <-wake:
+		case <-done:
+			running = false
+		}
+		flush()
+	}
+	stopLog()
+	flush()
+	enc.Encode(result)
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// receiveUpload streams the multipart parts of r into dir and returns the
+// uploaded manifest.toml, or nil.
+func receiveUpload(r *http.Request, dir string) ([]byte, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("expected multipart/form-data: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+
+	haveConfig := false
+	var manifest []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read multipart body: %w", err)
+		}
+
+		switch part.FormName() {
+		case uploadFieldConfig:
+			err = createUploadFile(filepath.Join(dir, uploadConfigName), part, 0644)
+			haveConfig = true
+		case uploadFieldContext:
+			// Later parts are written only once its links are known safe
+			if err = extractContext(r.Context(), part, dir); err == nil {
+				err = checkSymlinks(dir)
+			}
+		case uploadFieldManifest:
+			if manifest, err = io.ReadAll(part); err != nil {
+				err = fmt.Errorf("failed to read manifest: %w", err)
+			}
+		case uploadFieldFile:
+			name := filepath.Base(part.FileName())
+			if name == "." || name == string(filepath.Separator) || name == uploadConfigName {
+				err = fmt.Errorf("invalid payload file name %q", part.FileName())
+				break
+			}
+			err = createUploadFile(filepath.Join(dir, name), part, 0644)
+		default:
+			err = fmt.Errorf("unexpected field %q", part.FormName())
+		}
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !haveConfig {
+		return nil, fmt.Errorf("missing %q field with fledge.toml", uploadFieldConfig)
+	}
+	return manifest, checkSymlinks(dir)
+}
+
+// checkSymlinks fails if any symlink under dir resolves outside it. Mapped
+// directories are copied following symlinks, so an uploaded link to a host
+// path would otherwise leak that path into the artifact.
+func checkSymlinks(dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve workspace: %w", err)
+	}
+	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.Type()&os.ModeSymlink == 0 {
+			return err
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			// Dangling links cannot be read through
+			return nil
+		}
+		if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			rel, _ := filepath.Rel(root, path)
+			return fmt.Errorf("symlink %s points outside the uploaded workspace", rel)
+		}
+		return nil
+	})
+}
+
+// checkServedConfig rejects configs that would run a program of the
+// client's choosing on the server: a [postprocess] command, a GPU driver
+// run file, which is executed to unpack it and to build its modules, or a
+// custom busybox or toybox asked for its applets by busybox_applets =
+// ["all"]. Base artifacts are refused too: unpacking one runs unsquashfs or
+// cpio, or mounts a filesystem image, on the client's bytes as root.
+func checkServedConfig(cfg *config.Config) error {
+	if cfg.Postprocess != nil && len(cfg.Postprocess.Command) > 0 {
+		return fmt.Errorf("[postprocess] commands are not accepted by the build service")
+	}
+	if cfg.GPU != nil && (cfg.GPU.DriverRunFile != "" || cfg.GPU.BuildModules) {
+		return fmt.Errorf("[gpu] driver_run_file and build_modules are not accepted by the build service; use driver_image")
+	}
+	src := cfg.Source
+	allApplets := len(src.BusyboxApplets) == 1 && src.BusyboxApplets[0] == config.BusyboxAppletsAll
+	if allApplets && src.Userland == config.UserlandBusybox &&
+		(src.BusyboxURL != config.DefaultBusyboxURL || src.BusyboxSHA256 != config.DefaultBusyboxSHA256) {
+		return fmt.Errorf("busybox_applets = [\"all\"] with a custom busybox_url is not accepted by the build service; list the applets")
+	}
+	if allApplets && src.Userland == config.UserlandToybox {
+		return fmt.Errorf("busybox_applets = [\"all\"] with toybox userland is not accepted by the build service; list the applets")
+	}
+	if src.Artifact != "" {
+		return fmt.Errorf("source.artifact is not accepted by the build service; build from an image or a Dockerfile")
+	}
+	return nil
+}
+
+// confineToWorkspace rejects configs that name host files outside the upload
+// workspace dir, which would let a client read or write arbitrary paths on
+// the server, or that run a program of the client's choosing. Symlinks from the
+// uploaded context are resolved before checking, and the paths of cfg are
+// replaced by their canonical form so the build uses exactly those checked.
+func confineToWorkspace(cfg *config.Config, dir string) error {
+	if err := checkServedConfig(cfg); err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve workspace: %w", err)
+	}
+	return cfg.ResolveHostPaths(root, func(p config.HostPath, path string) (string, error) {
+		if filepath.IsAbs(p.Path) {
+			return "", fmt.Errorf("%s '%s' must be a relative path inside the uploaded workspace", p.Field, p.Path)
+		}
+		resolved, err := utils.CanonicalPath(path)
+		if err != nil {
+			return "", fmt.Errorf("%s '%s' cannot be resolved: %w", p.Field, p.Path, err)
+		}
+		if !utils.Within(resolved, root) {
+			return "", fmt.Errorf("%s '%s' points outside the uploaded workspace", p.Field, p.Path)
+		}
+		return resolved, nil
+	})
+}
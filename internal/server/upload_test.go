@@ -0,0 +1,320 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// newUploadRequest builds a multipart upload request with a config, an
+// optional context tarball and payload files.
+func newUploadRequest(t *testing.T, configContent string, contextTar []byte, files map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	add := func(field, name string, data []byte) {
+		w, err := mw.CreateFormFile(field, name)
+		if err != nil {
+			t.Fatalf("CreateFormFile failed: %v", err)
+		}
+		w.Write(data)
+	}
+	add(uploadFieldConfig, "fledge.toml", []byte(configContent))
+	if contextTar != nil {
+		add(uploadFieldContext, "context.tar", contextTar)
+	}
+	for name, content := range files {
+		add(uploadFieldFile, name, []byte(content))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/builds/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// tarOf returns a tar archive holding the given files.
+func tarOf(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+// TestUploadHandler tests a build from uploaded config, context and payload files.
+func TestUploadHandler(t *testing.T) {
+	var sawContext, sawPayload string
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		data, _ := os.ReadFile(filepath.Join(workDir, "app", "main.sh"))
+		sawContext = string(data)
+		data, _ = os.ReadFile(filepath.Join(workDir, "payload.bin"))
+		sawPayload = string(data)
+		return os.WriteFile(output, []byte("artifact"), 0644)
+	}
+
+	cfg := "version = \"1\"\nstrategy = \"initramfs\"\n\n[mappings]\n\"app/main.sh\" = \"/usr/bin/main.sh\"\n"
+	req := newUploadRequest(t, cfg, tarOf(t, map[string]string{"app/main.sh": "echo hi"}), map[string]string{"payload.bin": "payload"})
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	uploadHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), 0, build, build)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body, _ := io.ReadAll(rec.Body); string(body) != "artifact" {
+		t.Errorf("Expected artifact body, got %q", body)
+	}
+	if sawContext != "echo hi" || sawPayload != "payload" {
+		t.Errorf("Expected context and payload in workspace, got %q and %q", sawContext, sawPayload)
+	}
+	if _, err := store.get(rec.Header().Get("X-Fledge-Artifact-Id")); err != nil {
+		t.Errorf("Expected the artifact to be stored: %v", err)
+	}
+}
+
+// TestUploadHandler_RejectsHostPaths tests that configs cannot reach outside the workspace.
+func TestUploadHandler_RejectsHostPaths(t *testing.T) {
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		t.Error("build should not run")
+		return nil
+	}
+
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	for _, src := range []string{"/etc/passwd", "../../etc/passwd"} {
+		cfg := "version = \"1\"\nstrategy = \"initramfs\"\n\n[mappings]\n\"" + src + "\" = \"/etc/passwd\"\n"
+		rec := httptest.NewRecorder()
+		uploadHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), 0, build, build)(rec, newUploadRequest(t, cfg, nil, nil))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "workspace") {
+			t.Errorf("Expected 400 for mapping source %s, got %d: %s", src, rec.Code, rec.Body.String())
+		}
+	}
+
+	// A local repository is read by git on the server
+	gitCfg := "version = \"1\"\nstrategy = \"initramfs\"\n\n[[assets]]\nsource = \"git+file:///srv/git/secret.git\"\nref = \"main\"\ndest = \"/opt/secret\"\n"
+	rec := httptest.NewRecorder()
+	uploadHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), 0, build, build)(rec, newUploadRequest(t, gitCfg, nil, nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "assets.source '/srv/git/secret.git' must be a relative path") {
+		t.Errorf("Expected 400 for a local git asset outside the workspace, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The exported image tarball is written on the server
+	exportCfg := "version = \"1\"\nstrategy = \"initramfs\"\n\n[source]\ndockerfile = \"Dockerfile\"\nexport_image = \"../../tmp/image.tar\"\n"
+	rec = httptest.NewRecorder()
+	uploadHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), 0, build, build)(rec, newUploadRequest(t, exportCfg, nil, map[string]string{"Dockerfile": "FROM scratch\n"}))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "source.export_image '../../tmp/image.tar' points outside the uploaded workspace") {
+		t.Errorf("Expected 400 for an export_image outside the workspace, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Nor run programs of the client's choosing on the server
+	for want, cfg := range map[string]string{
+		"[postprocess]":         "version = \"1\"\nstrategy = \"initramfs\"\n\n[postprocess]\ncommand = [\"sh\", \"-c\", \"id\"]\n",
+		"[gpu] driver_run_file": "version = \"1\"\nstrategy = \"initramfs\"\n\n[gpu]\ndriver_run_file = \"NVIDIA.run\"\nbuild_modules = true\n",
+		"custom busybox_url":    "version = \"1\"\nstrategy = \"initramfs\"\n\n[source]\nbusybox_url = \"https://example.com/busybox\"\nbusybox_applets = [\"all\"]\n",
+		"toybox userland":       "version = \"1\"\nstrategy = \"initramfs\"\n\n[source]\nuserland = \"toybox\"\nuserland_url = \"https://example.com/toybox\"\nuserland_sha256 = \"" + strings.Repeat("0", 64) + "\"\nbusybox_applets = [\"all\"]\n",
+		// Unpacking an uploaded artifact runs tools on it as root
+		"source.artifact is not accepted": "version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nartifact = \"base.squashfs\"\n\n[filesystem]\ntype = \"squashfs\"\n",
+	} {
+		rec = httptest.NewRecorder()
+		uploadHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), 0, build, build)(rec, newUploadRequest(t, cfg, nil, map[string]string{"NVIDIA.run": "#!/bin/sh\nid\n", "base.squashfs": "hsqs"}))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected 400 for %s, got %d: %s", want, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// TestUploadHandler_Timeout tests that [build] timeout cancels a hung build with 504.
+func TestUploadHandler_Timeout(t *testing.T) {
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	cfg := "version = \"1\"\nstrategy = \"initramfs\"\n\n[build]\ntimeout = \"50ms\"\n"
+	rec := httptest.NewRecorder()
+	uploadHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), 0, build, build)(rec, newUploadRequest(t, cfg, nil, nil))
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "50ms") {
+		t.Errorf("Expected 504 mentioning the timeout, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestUploadHandler_Stream tests that a streamed build answers with its log
+// records and then its stored artifact, built with the uploaded manifest.
+func TestUploadHandler_Stream(t *testing.T) {
+	var sawManifest string
+	build := func(ctx context.Context, cfg *config.Config, manifestTpl *config.ManifestTemplate, workDir, output string) error {
+		if manifestTpl != nil {
+			sawManifest = manifestTpl.Name
+		}
+		logging.InfoContext(logging.NewContext(ctx, logging.KeyStep, "package"), "Packaging artifact")
+		return os.WriteFile(output, []byte("artifact"), 0644)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for field, content := range map[string]string{
+		uploadFieldConfig:   "version = \"1\"\nstrategy = \"initramfs\"\n",
+		uploadFieldManifest: "schema_version = \"v1\"\nname = \"app\"\nversion = \"1.0.0\"\nruntime = \"app\"\n",
+	} {
+		w, _ := mw.CreateFormFile(field, field+".toml")
+		w.Write([]byte(content))
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/v1/builds/upload?stream=true", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	store, err := newArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newArtifactStore failed: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	uploadHandler(context.Background(), newTenantSet("", store), newBuildLimiter(1, 0), 0, build, build)(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != uploadEventsType {
+		t.Fatalf("Expected a 200 event stream, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var events []uploadEvent
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var e uploadEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Failed to decode event: %v", err)
+		}
+		events = append(events, e)
+	}
+	var logged bool
+	for _, e := range events {
+		if e.Log != nil && e.Log.Message == "Packaging artifact" && e.Log.Step == "package" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("Expected the build's log record among %+v", events)
+	}
+	last := events[len(events)-1]
+	if last.Artifact == nil || last.Error != "" {
+		t.Fatalf("Expected the stored artifact last, got %+v", last)
+	}
+	if _, err := store.get(last.Artifact.ID); err != nil {
+		t.Errorf("Expected the artifact to be stored: %v", err)
+	}
+	if sawManifest != "app" {
+		t.Errorf("Expected the uploaded manifest to be built with, got %q", sawManifest)
+	}
+}
+
+// TestReceiveUpload_PlantedSymlinks tests that parts after a context are
+// not written through symlinks it planted, and that names are unique.
+func TestReceiveUpload_PlantedSymlinks(t *testing.T) {
+	victim := filepath.Join(t.TempDir(), "victim")
+	if err := os.WriteFile(victim, []byte("host file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var planted bytes.Buffer
+	tw := tar.NewWriter(&planted)
+	tw.WriteHeader(&tar.Header{Name: "payload.bin", Typeflag: tar.TypeSymlink, Linkname: victim})
+	tw.Close()
+	cfg := []byte("version = \"1\"\n")
+
+	type part struct {
+		field, name string
+		data        []byte
+	}
+	for name, parts := range map[string][]part{
+		"config through a link":  {{uploadFieldContext, "context.tar", planted.Bytes()}, {uploadFieldConfig, uploadConfigName, cfg}},
+		"payload through a link": {{uploadFieldConfig, uploadConfigName, cfg}, {uploadFieldContext, "context.tar", planted.Bytes()}, {uploadFieldFile, "payload.bin", []byte("x")}},
+		"duplicate payload":      {{uploadFieldConfig, uploadConfigName, cfg}, {uploadFieldFile, "a", []byte("1")}, {uploadFieldFile, "a", []byte("2")}},
+		"duplicate config":       {{uploadFieldConfig, uploadConfigName, cfg}, {uploadFieldConfig, uploadConfigName, cfg}},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, p := range parts {
+			w, _ := mw.CreateFormFile(p.field, p.name)
+			w.Write(p.data)
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/v1/builds/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		if _, err := receiveUpload(req, filepath.Join(t.TempDir(), "src")); err == nil {
+			t.Errorf("%s: expected the upload to be refused", name)
+		}
+		if data, _ := os.ReadFile(victim); string(data) != "host file" {
+			t.Fatalf("%s: the file outside the workspace was overwritten: %q", name, data)
+		}
+	}
+}
+
+// TestExtractContext tests that contexts may only hold directories,
+// regular files and symlinks, without ownership or setuid bits.
+func TestExtractContext(t *testing.T) {
+	archive := func(hdrs ...*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			tw.WriteHeader(hdr)
+			tw.Write(make([]byte, hdr.Size))
+		}
+		tw.Close()
+		return buf.Bytes()
+	}
+
+	dir := t.TempDir()
+	err := extractContext(context.Background(), bytes.NewReader(archive(
+		&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555},
+		&tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 04755, Size: 4, Uid: 4242, Gid: 4242},
+		&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "bin/tool"},
+	)), dir)
+	if err != nil {
+		t.Fatalf("extractContext failed: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "bin", "tool"))
+	if err != nil || info.Mode() != 0755 {
+		t.Errorf("Expected bin/tool with mode 0755, got %v (%v)", info, err)
+	}
+	if target, _ := os.Readlink(filepath.Join(dir, "link")); target != "bin/tool" {
+		t.Errorf("Expected link to bin/tool, got %q", target)
+	}
+
+	for name, hdrs := range map[string][]*tar.Header{
+		"char device":  {{Name: "mem", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 8}},
+		"block device": {{Name: "disk", Typeflag: tar.TypeBlock, Mode: 0666, Devmajor: 8}},
+		"hard link":    {{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}},
+		"escape":       {{Name: "../outside", Typeflag: tar.TypeReg, Mode: 0644}},
+		"through link": {
+			{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: t.TempDir()},
+			{Name: "etc/file", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		dir := t.TempDir()
+		if err := extractContext(context.Background(), bytes.NewReader(archive(hdrs...)), dir); err == nil {
+			t.Errorf("%s: expected the context to be refused", name)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package store keeps build artifacts by the SHA256 of their content, so
+// that rebuilding an identical artifact, such as another version of a
+// plugin whose image did not change, hardlinks the output to the stored
+// copy instead of keeping a second one on disk.
+//
+// A store directory holds blobs/sha256/<hex>, hardlinked to every output
+// with that content, and index/<hex>.json, recording when the blob was
+// added and the output paths it was stored from.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Env names the environment variable providing the default store directory.
+const Env = "FLEDGE_STORE"
+
+// mu serialises index updates of the builds of one process.
+var mu sync.Mutex
+
+// Store is an artifact store directory.
+type Store struct {
+	dir string
+}
+
+// Entry describes a stored artifact.
+type Entry struct {
+	Digest string    `json:"digest"`
+	Size   int64     `json:"size"`
+	Added  time.Time `json:"added"`
+	// Paths are the outputs the artifact was stored from. Only those still
+	// hardlinked to it are listed by List.
+	Paths []string `json:"paths"`
+}
+
+// Open returns the store at dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no artifact store directory (use --store or %s)", Env)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve artifact store %s: %w", dir, err)
+	}
+	for _, sub := range []string{filepath.Join("blobs", "sha256"), "index"} {
+		if err := os.MkdirAll(filepath.Join(abs, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create artifact store: %w", err)
+		}
+	}
+	return &Store{dir: abs}, nil
+}
+
+// Dir returns the store's directory.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Put stores the artifact at path. When the store already holds the same
+// content, path is atomically replaced by a hardlink to it and deduplicated
+// is true; otherwise the store links to path. The store must be on the
+// filesystem of path.
+func (s *Store) Put(path string) (entry Entry, deduplicated bool, err error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	sum, size, err := fileDigest(abs)
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("failed to digest %s: %w", path, err)
+	}
+	blob := s.blobPath(sum)
+
+	mu.Lock()
+	defer mu.Unlock()
+	err = os.Link(abs, blob)
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrExist):
+		if deduplicated, err = relink(blob, abs); err != nil {
+			return Entry{}, false, err
+		}
+	case errors.Is(err, syscall.EXDEV):
+		return Entry{}, false, fmt.Errorf("artifact store %s is not on the filesystem of %s, so artifacts cannot be hardlinked", s.dir, path)
+	default:
+		return Entry{}, false, fmt.Errorf("failed to store %s: %w", path, err)
+	}
+
+	entry, err = s.readEntry(sum)
+	if errors.Is(err, os.ErrNotExist) {
+		entry, err = Entry{Digest: "sha256:" + sum, Size: size, Added: time.Now().UTC()}, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if !slices.Contains(entry.Paths, abs) {
+		entry.Paths = append(entry.Paths, abs)
+	}
+	if err := s.writeEntry(sum, entry); err != nil {
+		return Entry{}, false, err
+	}
+	return entry, deduplicated, nil
+}
+
+// relink replaces path with a hardlink to blob, unless it already is one.
+func relink(blob, path string) (bool, error) {
+	blobInfo, err := os.Stat(blob)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(blobInfo, info) {
+		return false, nil
+	}
+	tmp := path + ".store-tmp"
+	os.Remove(tmp)
+	if err := os.Link(blob, tmp); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return false, fmt.Errorf("artifact store is not on the filesystem of %s, so artifacts cannot be hardlinked", path)
+		}
+		return false, fmt.Errorf("failed to link %s to the stored artifact: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("failed to replace %s with the stored artifact: %w", path, err)
+	}
+	return true, nil
+}
+
+// List returns the stored artifacts, oldest first, with the paths still
+// hardlinked to them.
+func (s *Store) List() ([]Entry, error) {
+	blobs, err := os.ReadDir(filepath.Join(s.dir, "blobs", "sha256"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact store: %w", err)
+	}
+	var entries []Entry
+	for _, b := range blobs {
+		sum := b.Name()
+		info, err := os.Stat(s.blobPath(sum))
+		if err != nil {
+			continue
+		}
+		entry, err := s.readEntry(sum)
+		if err != nil {
+			entry = Entry{Digest: "sha256:" + sum, Added: info.ModTime().UTC()}
+		}
+		entry.Size = info.Size()
+		entry.Paths = linkedPaths(info, entry.Paths)
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Added.Before(entries[j].Added)
+	})
+	return entries, nil
+}
+
+// linkedPaths returns the paths that are still hardlinks of the blob info.
+func linkedPaths(info os.FileInfo, paths []string) []string {
+	var linked []string
+	for _, p := range paths {
+		if pi, err := os.Stat(p); err == nil && os.SameFile(info, pi) {
+			linked = append(linked, p)
+		}
+	}
+	return linked
+}
+
+// Prune removes the stored artifacts no output is hardlinked to any more,
+// which only take up space in the store, and that were added before
+// cutoff, unless cutoff is zero. With dryRun nothing is removed. It returns
+// the artifacts pruned.
+func (s *Store) Prune(cutoff time.Time, dryRun bool) ([]Entry, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []Entry
+	for _, e := range entries {
+		if len(e.Paths) > 0 || (!cutoff.IsZero() && !e.Added.Before(cutoff)) {
+			continue
+		}
+		pruned = append(pruned, e)
+		if dryRun {
+			continue
+		}
+		sum := strings.TrimPrefix(e.Digest, "sha256:")
+		if err := os.Remove(s.blobPath(sum)); err != nil && !os.IsNotExist(err) {
+			return pruned, fmt.Errorf("failed to prune %s: %w", e.Digest, err)
+		}
+		os.Remove(s.indexPath(sum))
+	}
+	return pruned, nil
+}
+
+// blobPath returns the path of the blob with the hex SHA256 sum.
+func (s *Store) blobPath(sum string) string {
+	return filepath.Join(s.dir, "blobs", "sha256", sum)
+}
+
+// indexPath returns the path of the index of the blob with the hex SHA256
+// sum.
+func (s *Store) indexPath(sum string) string {
+	return filepath.Join(s.dir, "index", sum+".json")
+}
+
+func (s *Store) readEntry(sum string) (Entry, error) {
+	var entry Entry
+	data, err := os.ReadFile(s.indexPath(sum))
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, fmt.Errorf("invalid artifact store index %s: %w", s.indexPath(sum), err)
+	}
+	return entry, nil
+}
+
+// writeEntry replaces the index of the blob with the hex SHA256 sum
+// atomically.
+func (s *Store) writeEntry(sum string, entry Entry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := s.indexPath(sum)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write artifact store index: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write artifact store index: %w", err)
+	}
+	return nil
+}
+
+// fileDigest returns the hex SHA256 and size of the file at path.
+func fileDigest(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
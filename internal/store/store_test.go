@@ -0,0 +1,96 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPut tests that an identical rebuild is hardlinked to the stored
+// artifact and different content is stored separately.
+func TestPut(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	v1 := filepath.Join(dir, "app-1.0.img")
+	v2 := filepath.Join(dir, "app-1.1.img")
+	v3 := filepath.Join(dir, "app-2.0.img")
+	os.WriteFile(v1, []byte("rootfs"), 0644)
+	os.WriteFile(v2, []byte("rootfs"), 0644)
+	os.WriteFile(v3, []byte("other rootfs"), 0644)
+
+	first, dedup, err := s.Put(v1)
+	if err != nil || dedup {
+		t.Fatalf("Expected the first artifact to be stored, got %v, %v", dedup, err)
+	}
+	second, dedup, err := s.Put(v2)
+	if err != nil || !dedup || second.Digest != first.Digest {
+		t.Fatalf("Expected the identical artifact to be deduplicated, got %+v, %v, %v", second, dedup, err)
+	}
+	i1, _ := os.Stat(v1)
+	i2, _ := os.Stat(v2)
+	if !os.SameFile(i1, i2) {
+		t.Error("Expected identical artifacts to share one file")
+	}
+	if _, dedup, err := s.Put(v2); err != nil || dedup {
+		t.Errorf("Expected storing a linked artifact again to change nothing, got %v, %v", dedup, err)
+	}
+	if _, _, err := s.Put(v3); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 stored artifacts, got %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Digest == first.Digest && (len(e.Paths) != 2 || e.Size != int64(len("rootfs"))) {
+			t.Errorf("Expected both versions linked to the shared artifact, got %+v", e)
+		}
+	}
+}
+
+// TestPrune tests that only artifacts no output links to are pruned.
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	kept := filepath.Join(dir, "kept.img")
+	gone := filepath.Join(dir, "gone.img")
+	os.WriteFile(kept, []byte("kept"), 0644)
+	os.WriteFile(gone, []byte("gone"), 0644)
+	s.Put(kept)
+	s.Put(gone)
+	// A rebuild with different content replaces the output
+	os.Remove(gone)
+	os.WriteFile(gone, []byte("rebuilt"), 0644)
+
+	if pruned, err := s.Prune(time.Now().Add(-time.Hour), false); err != nil || len(pruned) != 0 {
+		t.Errorf("Expected nothing added over an hour ago to be pruned, got %+v, %v", pruned, err)
+	}
+	pruned, err := s.Prune(time.Time{}, true)
+	if err != nil || len(pruned) != 1 {
+		t.Fatalf("Expected a dry run to find 1 unlinked artifact, got %+v, %v", pruned, err)
+	}
+	if entries, _ := s.List(); len(entries) != 2 {
+		t.Errorf("Expected a dry run to remove nothing, got %+v", entries)
+	}
+	if _, err := s.Prune(time.Time{}, false); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	entries, _ := s.List()
+	if len(entries) != 1 || len(entries[0].Paths) != 1 || entries[0].Paths[0] != kept {
+		t.Errorf("Expected only the linked artifact to remain, got %+v", entries)
+	}
+	if data, err := os.ReadFile(kept); err != nil || string(data) != "kept" {
+		t.Errorf("Expected the linked output to be untouched, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,110 @@
+// Package telemetry configures OpenTelemetry tracing for fledge builds.
+//
+// Tracing is off unless an OTLP endpoint is configured through the standard
+// environment variables (OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT). OTEL_EXPORTER_OTLP_PROTOCOL selects
+// "grpc" or "http/protobuf" (the default), OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES describe the resource, and OTEL_TRACES_EXPORTER=none
+// disables export. All other OTEL_EXPORTER_OTLP_* settings (headers, TLS,
+// timeouts) are read by the exporter itself.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies fledge's instrumentation.
+const tracerName = "github.com/volantvm/fledge"
+
+// Enabled reports whether the environment configures an OTLP trace exporter.
+func Enabled() bool {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER")), "none") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup installs a global tracer provider exporting over OTLP when Enabled.
+// The returned function flushes and stops the exporter; it is a no-op when
+// tracing is disabled.
+func Setup(ctx context.Context, version string) (func(context.Context) error, error) {
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var client otlptrace.Client
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	switch protocol {
+	case "grpc":
+		client = otlptracegrpc.NewClient()
+	case "", "http/protobuf":
+		client = otlptracehttp.NewClient()
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, must be 'grpc' or 'http/protobuf'", protocol)
+	}
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	// Environment attributes come last so OTEL_SERVICE_NAME can override ours
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", "fledge"),
+			attribute.String("service.version", version),
+		),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start begins a span named name as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Step runs fn inside a span named name.
+func Step(ctx context.Context, name string, fn func(context.Context) error, attrs ...attribute.KeyValue) error {
+	ctx, span := Start(ctx, name, attrs...)
+	err := fn(ctx)
+	End(span, err)
+	return err
+}
@@ -0,0 +1,62 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestEnabled tests detection of the OTLP environment configuration.
+func TestEnabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	if Enabled() {
+		t.Error("Expected tracing to be disabled without an endpoint")
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+	if !Enabled() {
+		t.Error("Expected tracing to be enabled with an endpoint")
+	}
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	if Enabled() {
+		t.Error("Expected OTEL_TRACES_EXPORTER=none to disable tracing")
+	}
+}
+
+// TestStep tests that steps become nested spans carrying their errors.
+func TestStep(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	ctx, root := Start(context.Background(), "fledge.build")
+	_ = Step(ctx, "Unpack image layers", func(context.Context) error { return nil })
+	err := Step(ctx, "Create squashfs image", func(context.Context) error { return errors.New("mksquashfs failed") })
+	End(root, err)
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+	for _, s := range spans[:2] {
+		if s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("Expected step %q to be a child of the build span", s.Name())
+		}
+	}
+	if spans[1].Status().Code != codes.Error || spans[2].Status().Code != codes.Error {
+		t.Errorf("Expected the failing step and the build to be marked as errors")
+	}
+	if spans[0].Status().Code == codes.Error {
+		t.Errorf("Expected the successful step not to be marked as an error")
+	}
+}
@@ -0,0 +1,338 @@
+// Package tui draws an interactive full-screen monitor of a build: its steps
+// with their durations, the step VMs running Dockerfile RUN steps, and the
+// latest log lines, redrawn as the build goes.
+//
+// The monitor follows the model/view split of Elm-style terminal UIs: events
+// update the model under a lock, and a ticker renders the model into a frame
+// that replaces the previous one.
+package tui
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	// frameInterval is how often the screen is redrawn.
+	frameInterval = 100 * time.Millisecond
+	// maxLogLines bounds the log lines kept for the log pane.
+	maxLogLines = 500
+)
+
+// spinner animates running steps and VMs.
+var spinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// Monitor is a running build monitor.
+type Monitor struct {
+	out  io.Writer
+	fd   int
+	stop chan struct{}
+	done chan struct{}
+
+	mu sync.Mutex
+	m  model
+}
+
+// model is the state the monitor renders.
+type model struct {
+	title string
+	start time.Time
+	steps []step
+	vms   map[string]*vm
+	logs  []string
+	frame int
+}
+
+type step struct {
+	name     string
+	start    time.Time
+	duration time.Duration
+	done     bool
+	err      error
+}
+
+type vm struct {
+	name  string
+	pid   int
+	start time.Time
+	end   time.Time
+	err   error
+}
+
+// Start takes over the terminal of out to monitor the build titled title.
+// out must be a terminal.
+func Start(out *os.File, title string) (*Monitor, error) {
+	fd := int(out.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("--tui needs a terminal")
+	}
+	mon := &Monitor{
+		out:  out,
+		fd:   fd,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		m:    model{title: title, start: time.Now(), vms: map[string]*vm{}},
+	}
+	// Alternate screen, cursor hidden
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	go mon.run()
+	return mon, nil
+}
+
+// run redraws the screen until Stop.
+func (mon *Monitor) run() {
+	defer close(mon.done)
+	ticker := time.NewTicker(frameInterval)
+	defer ticker.Stop()
+	for {
+		mon.draw()
+		select {
+		case <-mon.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// draw renders the model at the terminal's size.
+func (mon *Monitor) draw() {
+	width, height, err := term.GetSize(mon.fd)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	mon.mu.Lock()
+	mon.m.frame++
+	frame := mon.m.view(time.Now(), width, height)
+	mon.mu.Unlock()
+	// Rewritten in place, clearing what each line and the screen below the
+	// frame held before, which does not flicker as clearing it all would
+	fmt.Fprint(mon.out, "\x1b[H"+frame+"\x1b[K\x1b[J")
+}
+
+// Stop restores the terminal and prints the steps and their durations, so
+// that they stay on screen once the build is over.
+func (mon *Monitor) Stop() {
+	close(mon.stop)
+	<-mon.done
+	fmt.Fprint(mon.out, "\x1b[?25h\x1b[?1049l")
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	fmt.Fprint(mon.out, mon.m.summary(time.Now()))
+}
+
+// Step records that a build step started or, with done set, finished.
+func (mon *Monitor) Step(name string, done bool, duration time.Duration, err error) {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	if !done {
+		mon.m.steps = append(mon.m.steps, step{name: name, start: time.Now()})
+		return
+	}
+	for i := len(mon.m.steps) - 1; i >= 0; i-- {
+		if s := &mon.m.steps[i]; s.name == name && !s.done {
+			s.done, s.duration, s.err = true, duration, err
+			return
+		}
+	}
+}
+
+// VM records that a step VM booted or, with exited set, exited.
+func (mon *Monitor) VM(name string, pid int, exited bool, err error) {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	if !exited {
+		mon.m.vms[name] = &vm{name: name, pid: pid, start: time.Now()}
+		return
+	}
+	if v := mon.m.vms[name]; v != nil {
+		v.end, v.err = time.Now(), err
+	}
+}
+
+// Log adds a line to the log pane.
+func (mon *Monitor) Log(line string) {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	for _, l := range strings.Split(strings.TrimRight(line, "\n"), "\n") {
+		mon.m.logs = append(mon.m.logs, l)
+	}
+	if over := len(mon.m.logs) - maxLogLines; over > 0 {
+		mon.m.logs = append(mon.m.logs[:0], mon.m.logs[over:]...)
+	}
+}
+
+// Handler returns a slog handler that writes records of level and above to
+// the log pane.
+func (mon *Monitor) Handler(level slog.Level) slog.Handler {
+	return slog.NewTextHandler(logWriter{mon}, &slog.HandlerOptions{
+		Level: level,
+		// The pane shows the time well enough by position
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+}
+
+// logWriter feeds the lines a slog handler writes to the log pane.
+type logWriter struct {
+	mon *Monitor
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.mon.Log(string(p))
+	return len(p), nil
+}
+
+// view renders the model into a frame of width columns and height rows.
+func (m *model) view(now time.Time, width, height int) string {
+	var lines []string
+	header := " fledge · " + m.title
+	elapsed := "elapsed " + formatDuration(now.Sub(m.start))
+	lines = append(lines, bold(pad(header, width-len(elapsed)-1)+elapsed))
+
+	// The steps get half of the screen at most, most recent last
+	lines = append(lines, rule("Steps", width))
+	stepRows := max(height/2-2, 1)
+	steps := m.steps
+	if len(steps) > stepRows {
+		lines = append(lines, dim(fmt.Sprintf("   … %d earlier steps", len(steps)-stepRows+1)))
+		steps = steps[len(steps)-stepRows+1:]
+	}
+	for _, s := range steps {
+		lines = append(lines, m.stepLine(s, now, width))
+	}
+
+	if len(m.vms) > 0 {
+		lines = append(lines, rule("Step VMs", width))
+		for _, v := range m.sortedVMs() {
+			lines = append(lines, m.vmLine(v, now, width))
+		}
+	}
+
+	lines = append(lines, rule("Log", width))
+	if rows := height - len(lines); rows > 0 {
+		logs := m.logs
+		if len(logs) > rows {
+			logs = logs[len(logs)-rows:]
+		}
+		for _, l := range logs {
+			lines = append(lines, truncate(l, width))
+		}
+	}
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	return strings.Join(lines, "\x1b[K\r\n")
+}
+
+// stepLine renders a step with its status and duration.
+func (m *model) stepLine(s step, now time.Time, width int) string {
+	icon, duration := spinner[m.frame%len(spinner)], now.Sub(s.start)
+	switch {
+	case s.done && s.err != nil:
+		icon, duration = red("✗"), s.duration
+	case s.done:
+		icon, duration = green("✓"), s.duration
+	}
+	d := formatDuration(duration)
+	return " " + icon + " " + pad(truncate(s.name, width-len(d)-5), width-len(d)-4) + d
+}
+
+// vmLine renders a step VM with its state.
+func (m *model) vmLine(v *vm, now time.Time, width int) string {
+	state, icon, end := "running", spinner[m.frame%len(spinner)], now
+	switch {
+	case !v.end.IsZero() && v.err != nil:
+		state, icon, end = "failed: "+v.err.Error(), red("✗"), v.end
+	case !v.end.IsZero():
+		state, icon, end = "exited", green("✓"), v.end
+	}
+	line := fmt.Sprintf("%s  pid %d  %s  %s", v.name, v.pid, formatDuration(end.Sub(v.start)), state)
+	return " " + icon + " " + truncate(line, width-3)
+}
+
+// sortedVMs returns the VMs by boot time, running ones and the five most
+// recently exited.
+func (m *model) sortedVMs() []*vm {
+	var running, exited []*vm
+	for _, v := range m.vms {
+		if v.end.IsZero() {
+			running = append(running, v)
+		} else {
+			exited = append(exited, v)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].start.Before(running[j].start) })
+	sort.Slice(exited, func(i, j int) bool { return exited[i].end.Before(exited[j].end) })
+	if len(exited) > 5 {
+		exited = exited[len(exited)-5:]
+	}
+	return append(exited, running...)
+}
+
+// summary lists the steps and their durations once the monitor is gone.
+func (m *model) summary(now time.Time) string {
+	var b strings.Builder
+	for _, s := range m.steps {
+		status := "done"
+		switch {
+		case s.done && s.err != nil:
+			status = "failed"
+		case !s.done:
+			status = "interrupted"
+		}
+		fmt.Fprintf(&b, "  %-40s %8s  %s\n", s.name, formatDuration(s.duration), status)
+	}
+	fmt.Fprintf(&b, "  %-40s %8s\n", "Total", formatDuration(now.Sub(m.start)))
+	return b.String()
+}
+
+// formatDuration renders d to a tenth of a second under a minute, and to
+// the second above.
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	return d.Round(time.Second).String()
+}
+
+// rule renders a section heading across the width.
+func rule(title string, width int) string {
+	return dim("─ " + title + " " + strings.Repeat("─", max(width-len([]rune(title))-3, 0)))
+}
+
+// pad pads s with spaces to n columns.
+func pad(s string, n int) string {
+	if w := len([]rune(s)); w < n {
+		return s + strings.Repeat(" ", n-w)
+	}
+	return s
+}
+
+// truncate shortens s to n columns.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 {
+		return ""
+	}
+	if len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+func bold(s string) string  { return "\x1b[1m" + s + "\x1b[0m" }
+func dim(s string) string   { return "\x1b[2m" + s + "\x1b[0m" }
+func red(s string) string   { return "\x1b[31m" + s + "\x1b[0m" }
+func green(s string) string { return "\x1b[32m" + s + "\x1b[0m" }
@@ -0,0 +1,92 @@
+package tui
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ansiRe = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// plain strips the escape sequences from a frame.
+func plain(s string) string {
+	return ansiRe.ReplaceAllString(s, "")
+}
+
+// TestMonitorView tests rendering steps, step VMs and logs into a frame.
+func TestMonitorView(t *testing.T) {
+	mon := &Monitor{m: model{title: "demo/fledge.toml", start: time.Now(), vms: map[string]*vm{}}}
+	mon.Step("Download image", false, 0, nil)
+	mon.Step("Download image", true, 2*time.Second, nil)
+	mon.Step("Create squashfs", false, 0, nil)
+	mon.Step("Create squashfs", true, time.Second, errors.New("mksquashfs failed"))
+	mon.Step("Verify image", false, 0, nil)
+	mon.VM("fledge-step-1", 4242, false, nil)
+	mon.VM("fledge-step-1", 4242, true, nil)
+	mon.VM("fledge-step-2", 4343, false, nil)
+	slog.New(mon.Handler(slog.LevelInfo)).Info("Packing image", "size", "12M")
+
+	frame := plain(mon.m.view(time.Now(), 80, 24))
+	lines := strings.Split(frame, "\r\n")
+	if len(lines) > 24 {
+		t.Errorf("Expected at most 24 rows, got %d", len(lines))
+	}
+	for _, want := range []string{
+		"fledge · demo/fledge.toml",
+		"✓ Download image",
+		"2.0s",
+		"✗ Create squashfs",
+		"Verify image",
+		"Step VMs",
+		"fledge-step-1  pid 4242",
+		"exited",
+		"fledge-step-2  pid 4343",
+		"running",
+		`level=INFO msg="Packing image" size=12M`,
+	} {
+		if !strings.Contains(frame, want) {
+			t.Errorf("Expected the frame to contain %q:\n%s", want, frame)
+		}
+	}
+	if strings.Contains(frame, "time=") {
+		t.Errorf("Expected log lines without times:\n%s", frame)
+	}
+
+	summary := mon.m.summary(time.Now())
+	for _, want := range []string{"Download image", "done", "failed", "interrupted", "Total"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("Expected the summary to contain %q:\n%s", want, summary)
+		}
+	}
+}
+
+// TestMonitorViewOverflow tests that the steps and log are cut to fit the
+// screen, keeping the most recent.
+func TestMonitorViewOverflow(t *testing.T) {
+	mon := &Monitor{m: model{title: "demo", start: time.Now(), vms: map[string]*vm{}}}
+	for i := 0; i < 30; i++ {
+		name := "step " + string(rune('A'+i%26)) + strings.Repeat("x", i/26)
+		mon.Step(name, false, 0, nil)
+		mon.Step(name, true, time.Millisecond, nil)
+		mon.Log("line " + name)
+	}
+	frame := plain(mon.m.view(time.Now(), 60, 20))
+	lines := strings.Split(frame, "\r\n")
+	if len(lines) != 20 {
+		t.Errorf("Expected 20 rows, got %d:\n%s", len(lines), frame)
+	}
+	if !strings.Contains(frame, "earlier steps") {
+		t.Errorf("Expected the earlier steps to be folded:\n%s", frame)
+	}
+	if !strings.Contains(frame, "line step Dx") {
+		t.Errorf("Expected the latest log line to show:\n%s", frame)
+	}
+	for _, l := range lines {
+		if n := len([]rune(strings.TrimSuffix(l, "\x1b[K"))); n > 60 {
+			t.Errorf("Expected rows of at most 60 columns, got %d: %q", n, l)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheDirKey is the context key of the cache base set with WithCacheDir.
+type cacheDirKey struct{}
+
+// CacheDir returns (and creates) the named subdirectory of fledge's cache.
+// FLEDGE_CACHE_DIR overrides the location; otherwise the user cache directory
+// is used, falling back to the system temp directory.
+func CacheDir(name string) (string, error) {
+	base := strings.TrimSpace(os.Getenv("FLEDGE_CACHE_DIR"))
+	if base == "" {
+		if userCache, err := os.UserCacheDir(); err == nil && userCache != "" {
+			base = filepath.Join(userCache, "fledge")
+		} else {
+			base = filepath.Join(os.TempDir(), "fledge-cache")
+		}
+	}
+	return makeCacheDir(base, name)
+}
+
+// WithCacheDir returns a context under which CacheDirContext keeps its
+// subdirectories in base instead of fledge's cache, so that builds of one
+// workspace never reuse the downloads of another.
+func WithCacheDir(ctx context.Context, base string) context.Context {
+	return context.WithValue(ctx, cacheDirKey{}, base)
+}
+
+// CacheBase returns the cache base set on ctx with WithCacheDir, or "".
+func CacheBase(ctx context.Context) string {
+	base, _ := ctx.Value(cacheDirKey{}).(string)
+	return base
+}
+
+// CacheDirContext is CacheDir under the cache base of ctx, if one was set
+// with WithCacheDir.
+func CacheDirContext(ctx context.Context, name string) (string, error) {
+	if base := CacheBase(ctx); base != "" {
+		return makeCacheDir(base, name)
+	}
+	return CacheDir(name)
+}
+
+func makeCacheDir(base, name string) (string, error) {
+	dir := filepath.Join(base, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory %s: %w", dir, err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CanonicalPath resolves every symlink in path, which need not exist yet:
+// the missing final element is joined to its resolved parent. A final
+// element that is a dangling symlink is rejected, since writing through it
+// would escape the check. Relative paths are taken from the working
+// directory.
+func CanonicalPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		path = wd + string(filepath.Separator) + path
+	}
+	if len(path) > 1 {
+		path = strings.TrimRight(path, string(filepath.Separator))
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if _, lerr := os.Lstat(path); lerr == nil {
+		return "", fmt.Errorf("%s is a dangling symlink", path)
+	}
+	// Split without filepath.Dir, whose lexical cleaning would resolve
+	// "link/.." differently from the kernel
+	i := strings.LastIndex(path, string(filepath.Separator))
+	dir, name := path[:i], path[i+1:]
+	if name == "." || name == ".." {
+		return "", err
+	}
+	if dir == "" {
+		dir = string(filepath.Separator)
+	}
+	parent, perr := CanonicalPath(dir)
+	if perr != nil {
+		return "", perr
+	}
+	return filepath.Join(parent, name), nil
+}
+
+// Within reports whether the canonical path lies in the canonical directory
+// root.
+func Within(path, root string) bool {
+	if path == root || root == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
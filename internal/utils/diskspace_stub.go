@@ -0,0 +1,10 @@
+//go:build !unix
+
+package utils
+
+import "errors"
+
+// FreeSpace is not supported on this platform.
+func FreeSpace(path string) (int64, uint64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
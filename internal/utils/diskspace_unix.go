@@ -0,0 +1,27 @@
+//go:build unix
+
+package utils
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to unprivileged users on the
+// filesystem holding path, and an ID identifying that filesystem. A path that
+// does not exist yet is measured at its nearest existing parent.
+func FreeSpace(path string) (int64, uint64, error) {
+	dir, err := existingParent(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat filesystem of %s: %w", dir, err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat %s: %w", dir, err)
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), uint64(st.Dev), nil
+}
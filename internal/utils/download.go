@@ -2,20 +2,82 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/retry"
 )
 
+// DefaultDownloadStallTimeout is how long a download may go without receiving
+// data before it is aborted. DownloadStallEnv overrides it.
+const DefaultDownloadStallTimeout = 2 * time.Minute
+
+// DownloadStallEnv names the environment variable overriding
+// DefaultDownloadStallTimeout, as a Go duration such as "5m".
+const DownloadStallEnv = "FLEDGE_DOWNLOAD_STALL_TIMEOUT"
+
+var errDownloadStalled = errors.New("download stalled")
+
+// downloadStallTimeout returns the stall limit for downloads.
+func downloadStallTimeout() time.Duration {
+	v := os.Getenv(DownloadStallEnv)
+	if v == "" {
+		return DefaultDownloadStallTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		logging.Warn("Ignoring invalid download stall timeout", "env", DownloadStallEnv, "value", v)
+		return DefaultDownloadStallTimeout
+	}
+	return d
+}
+
+// stallReader pushes back a stall timer every time data arrives.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+	limit time.Duration
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.limit)
+	}
+	return n, err
+}
+
 // DownloadFile downloads a file from a URL to a destination path with progress indication.
-func DownloadFile(url, destPath string, showProgress bool) error {
+// A download that receives no data for the stall timeout fails instead of
+// hanging the build. Failures other than client errors are retried according
+// to the network retry policy in ctx.
+func DownloadFile(ctx context.Context, url, destPath string, showProgress bool) error {
+	return retry.FromContext(ctx).Network.Do(ctx, "download "+url, func(ctx context.Context) error {
+		return downloadOnce(ctx, url, destPath, showProgress)
+	})
+}
+
+// downloadOnce makes a single attempt at DownloadFile.
+func downloadOnce(ctx context.Context, url, destPath string, showProgress bool) error {
 	logging.Debug("Downloading file", "url", url, "dest", destPath)
 
+	limit := downloadStallTimeout()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timer := time.AfterFunc(limit, func() {
+		cancel(fmt.Errorf("%w: no data received for %s (set %s to wait longer)", errDownloadStalled, limit, DownloadStallEnv))
+	})
+	defer timer.Stop()
+
 	// Create destination directory if it doesn't exist
 	destDir := filepath.Dir(destPath)
 	if err := os.MkdirAll(destDir, 0755); err != nil {
@@ -23,14 +85,24 @@ func DownloadFile(url, destPath string, showProgress bool) error {
 	}
 
 	// Create HTTP request
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to download from %s: %w", url, err)
+		return fmt.Errorf("failed to download from %s: %w", url, stallCause(ctx, err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed with status %d: %s", resp.StatusCode, resp.Status)
+		err := fmt.Errorf("download failed with status %d: %s", resp.StatusCode, resp.Status)
+		// Client errors other than timeouts and rate limits will not go away
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return retry.Permanent(err)
+		}
+		return err
 	}
 
 	// Create destination file
@@ -41,26 +113,36 @@ func DownloadFile(url, destPath string, showProgress bool) error {
 	defer out.Close()
 
 	// Download with progress bar if enabled and size is known
+	body := &stallReader{r: resp.Body, timer: timer, limit: limit}
 	if showProgress && resp.ContentLength > 0 {
 		bar := progressbar.DefaultBytes(
 			resp.ContentLength,
 			fmt.Sprintf("Downloading %s", filepath.Base(destPath)),
 		)
-		_, err = io.Copy(io.MultiWriter(out, bar), resp.Body)
+		_, err = io.Copy(io.MultiWriter(out, bar), body)
 	} else {
-		_, err = io.Copy(out, resp.Body)
+		_, err = io.Copy(out, body)
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to save file: %w", err)
+		return fmt.Errorf("failed to save file: %w", stallCause(ctx, err))
 	}
 
 	logging.Debug("Download complete", "file", destPath)
 	return nil
 }
 
+// stallCause returns the stall error when ctx was cancelled by the stall
+// timer, and err otherwise.
+func stallCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errDownloadStalled) {
+		return cause
+	}
+	return err
+}
+
 // DownloadToTempFile downloads a file to a temporary location and returns the path.
-func DownloadToTempFile(url string, showProgress bool) (string, error) {
+func DownloadToTempFile(ctx context.Context, url string, showProgress bool) (string, error) {
 	tmpFile, err := os.CreateTemp("", "fledge-download-*")
 	if err != nil {
 		return "", fmt.Errorf("failed to create temp file: %w", err)
@@ -68,10 +150,55 @@ func DownloadToTempFile(url string, showProgress bool) (string, error) {
 	tmpPath := tmpFile.Name()
 	tmpFile.Close()
 
-	if err := DownloadFile(url, tmpPath, showProgress); err != nil {
+	if err := DownloadFile(ctx, url, tmpPath, showProgress); err != nil {
 		os.Remove(tmpPath)
 		return "", err
 	}
 
 	return tmpPath, nil
 }
+
+// DownloadCached returns a local copy of url whose content matches checksum
+// ("sha256:<hex>"). Verified downloads are kept in fledge's cache directory,
+// keyed by checksum, so later builds reuse them without network access. The
+// returned bool reports whether the file was already cached.
+func DownloadCached(ctx context.Context, url, checksum string, showProgress bool) (string, bool, error) {
+	hexSum := strings.ToLower(strings.TrimPrefix(checksum, "sha256:"))
+	if hexSum == "" {
+		return "", false, fmt.Errorf("a sha256 checksum is required to cache %s", url)
+	}
+
+	dir, err := CacheDirContext(ctx, "downloads")
+	if err != nil {
+		return "", false, err
+	}
+	cached := filepath.Join(dir, hexSum)
+
+	if _, err := os.Stat(cached); err == nil {
+		if err := VerifyChecksum(cached, checksum); err == nil {
+			logging.Debug("Using cached download", "url", url, "path", cached)
+			return cached, true, nil
+		}
+		logging.Warn("Cached download is corrupt, downloading again", "url", url, "path", cached)
+		os.Remove(cached)
+	}
+
+	tmp, err := os.CreateTemp(dir, hexSum+".partial-*")
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	if err := DownloadFile(ctx, url, tmpPath, showProgress); err != nil {
+		return "", false, err
+	}
+	if err := VerifyChecksum(tmpPath, checksum); err != nil {
+		return "", false, fmt.Errorf("download of %s failed verification: %w", url, err)
+	}
+	if err := os.Rename(tmpPath, cached); err != nil {
+		return "", false, fmt.Errorf("failed to store download in cache: %w", err)
+	}
+	return cached, false, nil
+}
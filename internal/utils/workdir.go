@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/volantvm/fledge/internal/logging"
+)
+
+// WorkDirEnv names the environment variable selecting the scratch directory.
+const WorkDirEnv = "FLEDGE_WORKDIR"
+
+// UseTempDir makes dir the scratch directory for the rest of the process by
+// pointing TMPDIR at it, so fledge's own temporary files as well as those of
+// skopeo, mksquashfs, BuildKit and microVM workers land there. It returns the
+// absolute path.
+func UseTempDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve temp directory %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return "", fmt.Errorf("failed to create temp directory %s: %w", abs, err)
+	}
+	if err := os.Setenv("TMPDIR", abs); err != nil {
+		return "", fmt.Errorf("failed to set TMPDIR: %w", err)
+	}
+	logging.Info("Using temp directory", "path", abs)
+	return abs, nil
+}
@@ -0,0 +1,16 @@
+//go:build fledge_vendor
+
+package vendored
+
+import _ "embed"
+
+var (
+	//go:embed assets/busybox
+	busybox []byte
+	//go:embed assets/kestrel
+	agent []byte
+	// agentVersion is the release tag the kestrel binary was downloaded
+	// from.
+	//go:embed assets/kestrel.version
+	agentVersion string
+)
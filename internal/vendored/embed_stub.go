@@ -0,0 +1,9 @@
+//go:build !fledge_vendor
+
+package vendored
+
+var (
+	busybox      []byte
+	agent        []byte
+	agentVersion string
+)
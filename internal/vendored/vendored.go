@@ -0,0 +1,77 @@
+// Package vendored holds the static busybox and kestrel binaries embedded
+// into fledge when it is built with the fledge_vendor tag, so that initramfs
+// builds with the default busybox and the embedded kestrel's version need no
+// downloads:
+//
+//	make vendor-assets KESTREL_VERSION=v0.7.1 KESTREL_SHA256=<hex>
+//	go build -tags fledge_vendor ./cmd/fledge
+//
+// make vendor-assets downloads the pinned binaries into assets/ and checks
+// their SHA256. Without the tag, nothing is embedded and Busybox and Agent
+// report themselves unavailable.
+package vendored
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BusyboxVersion is the version of the busybox binary make vendor-assets
+// downloads: that of config.DefaultBusyboxURL.
+const BusyboxVersion = "1.35.0"
+
+// Binary is an embedded binary.
+type Binary struct {
+	// Name is the binary's name, such as "busybox".
+	Name string
+	// Version is the binary's version, or its release tag.
+	Version string
+	data    []byte
+}
+
+// Busybox is the embedded busybox, the binary of config.DefaultBusyboxURL.
+var Busybox = &Binary{Name: "busybox", Version: BusyboxVersion, data: busybox}
+
+// Agent is the embedded kestrel agent, a release of volantvm/volant.
+var Agent = &Binary{Name: "kestrel", Version: strings.TrimSpace(agentVersion), data: agent}
+
+// Available reports whether b was embedded.
+func (b *Binary) Available() bool {
+	return b != nil && len(b.data) > 0
+}
+
+// SHA256 returns the hex SHA256 of b.
+func (b *Binary) SHA256() string {
+	sum := sha256.Sum256(b.data)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteFile writes b to path as an executable, creating its directory if
+// needed.
+func (b *Binary) WriteFile(path string) error {
+	if !b.Available() {
+		return fmt.Errorf("%s is not vendored into this fledge (build it with -tags fledge_vendor)", b.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, b.data, 0755); err != nil {
+		return fmt.Errorf("failed to write vendored %s: %w", b.Name, err)
+	}
+	return os.Chmod(path, 0755)
+}
+
+// Versions returns the version of each embedded binary, by name.
+func Versions() map[string]string {
+	versions := map[string]string{}
+	for _, b := range []*Binary{Busybox, Agent} {
+		if b.Available() {
+			versions[b.Name] = b.Version
+		}
+	}
+	return versions
+}
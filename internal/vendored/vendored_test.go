@@ -0,0 +1,37 @@
+package vendored
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBinaryWriteFile tests writing an embedded binary as an executable.
+func TestBinaryWriteFile(t *testing.T) {
+	b := &Binary{Name: "busybox", Version: BusyboxVersion, data: []byte("\x7fELF")}
+	if !b.Available() {
+		t.Fatal("Expected a binary with data to be available")
+	}
+	path := filepath.Join(t.TempDir(), "bin", "busybox")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 || info.Size() != 4 {
+		t.Errorf("Expected a 4 byte executable, got %v, %d bytes", info.Mode(), info.Size())
+	}
+	if got := b.SHA256(); len(got) != 64 {
+		t.Errorf("Expected a hex SHA256, got %q", got)
+	}
+
+	empty := &Binary{Name: "kestrel"}
+	if empty.Available() {
+		t.Error("Expected a binary without data to be unavailable")
+	}
+	if err := empty.WriteFile(filepath.Join(t.TempDir(), "kestrel")); err == nil {
+		t.Error("Expected writing an unavailable binary to fail")
+	}
+}
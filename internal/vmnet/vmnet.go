@@ -0,0 +1,138 @@
+// Package vmnet carries the network settings of the microVMs that run
+// Dockerfile steps from a build's configuration to the executor.
+package vmnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Mode selects how a step VM configures its network interface.
+type Mode string
+
+const (
+	// ModeStatic leases an address from volant's pool and passes it to the
+	// guest on the kernel command line.
+	ModeStatic Mode = "static"
+	// ModeDHCP leaves addressing to a DHCP server on the worker bridge.
+	ModeDHCP Mode = "dhcp"
+	// ModeUser connects the guest to passt's user-mode network stack, so no
+	// tap device, bridge or address pool is needed on the host.
+	ModeUser Mode = "user"
+)
+
+// Provider selects what allocates step VM addresses and host interfaces.
+type Provider string
+
+const (
+	// ProviderVolant leases addresses from volant's database and attaches
+	// tap devices to its bridge.
+	ProviderVolant Provider = "volant"
+	// ProviderPool hands out addresses from Options.Pool and attaches tap
+	// devices to Options.Bridge, without needing volant.
+	ProviderPool Provider = "pool"
+	// ProviderNone gives step VMs no network interface.
+	ProviderNone Provider = "none"
+)
+
+// Options configures step VM networking.
+type Options struct {
+	Mode     Mode
+	Provider Provider
+
+	// Pool is the "first-last" IPv4 range ProviderPool leases from, with
+	// Gateway and Netmask handed to guests and Bridge receiving their taps.
+	Pool    string
+	Gateway string
+	Netmask string
+	Bridge  string
+
+	// Proxy is exported to step commands and passed as build args.
+	Proxy Proxy
+
+	// PackageCache runs a caching proxy for package downloads on the
+	// worker and points step VMs' HTTP_PROXY at it.
+	PackageCache PackageCache
+}
+
+// PackageCache configures the worker's package download cache.
+type PackageCache struct {
+	Enabled bool
+	// Dir holds the cached packages; empty uses fledge's cache directory.
+	Dir string
+	// MaxBytes bounds the cache size; zero means unbounded.
+	MaxBytes int64
+}
+
+// Proxy holds the HTTP(S) proxy settings for build steps.
+type Proxy struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy string
+}
+
+// ProxyFromEnv returns the proxy settings of the fledge process, preferring
+// the upper-case variables.
+func ProxyFromEnv() Proxy {
+	get := func(name string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return os.Getenv(strings.ToLower(name))
+	}
+	return Proxy{HTTP: get("HTTP_PROXY"), HTTPS: get("HTTPS_PROXY"), NoProxy: get("NO_PROXY")}
+}
+
+// Env returns the set proxy variables as KEY=value pairs, in both the upper-
+// and lower-case spellings tools look for.
+func (p Proxy) Env() []string {
+	var env []string
+	for _, kv := range [][2]string{{"HTTP_PROXY", p.HTTP}, {"HTTPS_PROXY", p.HTTPS}, {"NO_PROXY", p.NoProxy}} {
+		if kv[1] == "" {
+			continue
+		}
+		env = append(env, kv[0]+"="+kv[1], strings.ToLower(kv[0])+"="+kv[1])
+	}
+	return env
+}
+
+// Defaults returns the options used when a build configures none.
+func Defaults() Options {
+	return Options{Mode: ModeStatic, Provider: ProviderVolant}
+}
+
+// ParsePool parses a "first-last" IPv4 range.
+func ParsePool(pool string) (first, last net.IP, err error) {
+	a, b, ok := strings.Cut(pool, "-")
+	if !ok {
+		return nil, nil, fmt.Errorf("pool %q is not a first-last range", pool)
+	}
+	first = net.ParseIP(strings.TrimSpace(a)).To4()
+	last = net.ParseIP(strings.TrimSpace(b)).To4()
+	if first == nil || last == nil {
+		return nil, nil, fmt.Errorf("pool %q must be a range of IPv4 addresses", pool)
+	}
+	if bytes.Compare(first, last) > 0 {
+		return nil, nil, fmt.Errorf("pool %q ends before it starts", pool)
+	}
+	return first, last, nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying o.
+func NewContext(ctx context.Context, o Options) context.Context {
+	return context.WithValue(ctx, contextKey{}, o)
+}
+
+// FromContext returns the options carried by ctx, or Defaults.
+func FromContext(ctx context.Context) Options {
+	if o, ok := ctx.Value(contextKey{}).(Options); ok {
+		return o
+	}
+	return Defaults()
+}
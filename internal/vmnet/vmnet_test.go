@@ -0,0 +1,49 @@
+package vmnet
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestParsePool tests accepted and rejected address ranges.
+func TestParsePool(t *testing.T) {
+	first, last, err := ParsePool("10.0.3.10 - 10.0.3.50")
+	if err != nil {
+		t.Fatalf("ParsePool() error = %v", err)
+	}
+	if first.String() != "10.0.3.10" || last.String() != "10.0.3.50" {
+		t.Errorf("ParsePool() = %s, %s", first, last)
+	}
+	for _, bad := range []string{"10.0.3.10", "10.0.3.50-10.0.3.10", "fd00::1-fd00::9", "a-b"} {
+		if _, _, err := ParsePool(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestFromContext tests that options travel through a context.
+func TestFromContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != Defaults() {
+		t.Errorf("Expected defaults, got %+v", got)
+	}
+	o := Options{Mode: ModeDHCP, Provider: ProviderPool}
+	if got := FromContext(NewContext(context.Background(), o)); got != o {
+		t.Errorf("Expected %+v, got %+v", o, got)
+	}
+}
+
+// TestProxyEnv tests that set proxy variables are exported in both spellings.
+func TestProxyEnv(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("http_proxy", "http://proxy:3128")
+	t.Setenv("HTTPS_PROXY", "http://secure:3128")
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+
+	got := ProxyFromEnv().Env()
+	want := []string{"HTTP_PROXY=http://proxy:3128", "http_proxy=http://proxy:3128", "HTTPS_PROXY=http://secure:3128", "https_proxy=http://secure:3128"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Env() = %v, want %v", got, want)
+	}
+}
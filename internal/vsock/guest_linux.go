@@ -0,0 +1,207 @@
+//go:build linux
+
+package vsock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// outputDrain bounds how long a finished command's background children
+	// may hold its output open before the exit code is sent anyway.
+	outputDrain = 5 * time.Second
+	// closeWait bounds how long the agent waits for the host to hang up
+	// after the exit code, so it is not lost to an early poweroff.
+	closeWait = 5 * time.Second
+)
+
+// RunGuest is the entry point of fledge-agent. "run -- CMD [ARG...]" runs a
+// build step: its output and exit code are streamed to the host over vsock
+// while exec sessions are served alongside it. Without a vsock device the
+// command runs on the agent's own stdio so the init script's output files
+// still capture it. The command's exit status is returned.
+func RunGuest(args []string) int {
+	if len(args) > 0 && args[0] == "run" {
+		args = args[1:]
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+	} else {
+		args = nil
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: fledge-agent run -- COMMAND [ARG...]")
+		return 2
+	}
+
+	conn, err := dialHost(RunPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fledge-agent: vsock unavailable, falling back to output files: %v\n", err)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return runCommand(cmd)
+	}
+	defer conn.Close()
+
+	go serveExec()
+	return serve(conn, exec.Command(args[0], args[1:]...))
+}
+
+// serve runs cmd attached to a host session on conn and reports its exit
+// code.
+func serve(conn io.ReadWriter, cmd *exec.Cmd) int {
+	w := &frameWriter{mu: &sync.Mutex{}, w: conn}
+	cmd.Stdout = &frameWriter{mu: w.mu, w: conn, kind: frameStdout}
+	cmd.Stderr = &frameWriter{mu: w.mu, w: conn, kind: frameStderr}
+	cmd.WaitDelay = outputDrain
+
+	// An os.Pipe rather than an io.Reader keeps Wait from blocking on
+	// stdin the command never read.
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(cmd.Stderr, "fledge-agent: stdin pipe: %v\n", err)
+		_ = w.send(frameExit, exitPayload(126))
+		return 126
+	}
+	cmd.Stdin = stdinR
+	hungUp := make(chan struct{})
+	go func() {
+		defer close(hungUp)
+		defer stdinW.Close()
+		for {
+			kind, payload, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			switch kind {
+			case frameStdin:
+				_, _ = stdinW.Write(payload)
+			case frameStdinClose:
+				stdinW.Close()
+			}
+		}
+	}()
+
+	code := runCommand(cmd)
+	stdinR.Close()
+	if err := w.send(frameExit, exitPayload(code)); err == nil {
+		select {
+		case <-hungUp:
+		case <-time.After(closeWait):
+		}
+	}
+	return code
+}
+
+// runCommand runs cmd and returns its exit status the way a shell would:
+// 128+N for a signal, 127 when it cannot be found and 126 when it cannot be
+// started.
+func runCommand(cmd *exec.Cmd) int {
+	err := cmd.Run()
+	if cmd.ProcessState != nil {
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return cmd.ProcessState.ExitCode()
+	}
+	fmt.Fprintf(cmd.Stderr, "fledge-agent: %v\n", err)
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return 127
+	}
+	return 126
+}
+
+// serveExec accepts exec sessions from the host until the VM powers off.
+func serveExec() {
+	ln, err := listenGuest(ExecPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fledge-agent: exec sessions unavailable: %v\n", err)
+		return
+	}
+	for {
+		nfd, _, err := unix.Accept4(ln, unix.SOCK_CLOEXEC)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) || errors.Is(err, unix.ECONNABORTED) {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "fledge-agent: accept exec session: %v\n", err)
+			return
+		}
+		conn, err := fileConn(nfd)
+		if err != nil {
+			continue
+		}
+		go handleExec(conn)
+	}
+}
+
+func handleExec(conn *os.File) {
+	defer conn.Close()
+	kind, payload, err := readFrame(conn)
+	if err != nil || kind != frameExec {
+		return
+	}
+	var req ExecRequest
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Args) == 0 {
+		w := &frameWriter{mu: &sync.Mutex{}, w: conn, kind: frameStderr}
+		fmt.Fprintln(w, "fledge-agent: invalid exec request")
+		_ = w.send(frameExit, exitPayload(126))
+		return
+	}
+	cmd := exec.Command(req.Args[0], req.Args[1:]...)
+	if len(req.Env) > 0 {
+		cmd.Env = req.Env
+	}
+	cmd.Dir = req.Cwd
+	serve(conn, cmd)
+}
+
+// dialHost connects to port on the host.
+func dialHost(port uint32) (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_HOST, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("connect to host port %d: %w", port, err)
+	}
+	return fileConn(fd)
+}
+
+// listenGuest returns a listening socket for port.
+func listenGuest(port uint32) (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("bind port %d: %w", port, err)
+	}
+	if err := unix.Listen(fd, 8); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("listen on port %d: %w", port, err)
+	}
+	return fd, nil
+}
+
+// fileConn wraps a connected socket so it is served by the runtime poller.
+func fileConn(fd int) (*os.File, error) {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "vsock"), nil
+}
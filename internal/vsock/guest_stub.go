@@ -0,0 +1,14 @@
+//go:build !linux
+
+package vsock
+
+import (
+	"fmt"
+	"os"
+)
+
+// RunGuest is only supported inside Linux build VMs.
+func RunGuest(args []string) int {
+	fmt.Fprintln(os.Stderr, "fledge-agent: only supported inside Linux build VMs")
+	return 1
+}
@@ -0,0 +1,142 @@
+package vsock
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds the CONNECT exchange with the VMM when the
+// caller's context has no deadline.
+const handshakeTimeout = 10 * time.Second
+
+// Listen accepts guest connections to port through the VMM's vsock socket.
+func Listen(socket string, port uint32) (net.Listener, error) {
+	ln, err := net.Listen("unix", fmt.Sprintf("%s_%d", socket, port))
+	if err != nil {
+		return nil, fmt.Errorf("vsock: listen on port %d: %w", port, err)
+	}
+	return ln, nil
+}
+
+// Dial connects to guest port through the VMM's vsock socket.
+func Dial(ctx context.Context, socket string, port uint32) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("vsock: dial %s: %w", socket, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vsock: connect to guest port %d: %w", port, err)
+	}
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vsock: connect to guest port %d: %w", port, err)
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("vsock: connect to guest port %d: unexpected reply %q", port, strings.TrimSpace(line))
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn keeps bytes read past the handshake line.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// Attach forwards stdin to the guest and the guest's output to stdout and
+// stderr until it reports the command's exit code, which is returned.
+// Cancelling ctx closes conn.
+func Attach(ctx context.Context, conn io.ReadWriteCloser, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	w := &frameWriter{mu: &sync.Mutex{}, w: conn}
+	go sendStdin(w, stdin)
+
+	for {
+		kind, payload, err := readFrame(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+				return -1, ErrNoExitCode
+			}
+			return -1, fmt.Errorf("vsock: read frame: %w", err)
+		}
+		switch kind {
+		case frameStdout:
+			if stdout != nil {
+				_, _ = stdout.Write(payload)
+			}
+		case frameStderr:
+			if stderr != nil {
+				_, _ = stderr.Write(payload)
+			}
+		case frameExit:
+			if len(payload) != 4 {
+				return -1, fmt.Errorf("vsock: malformed exit frame")
+			}
+			return int(int32(binary.BigEndian.Uint32(payload))), nil
+		}
+	}
+}
+
+// Exec runs req in the VM behind socket and returns its exit code.
+func Exec(ctx context.Context, socket string, req ExecRequest, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	conn, err := Dial(ctx, socket, ExecPort)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	data, err := json.Marshal(req)
+	if err != nil {
+		return -1, fmt.Errorf("vsock: encode exec request: %w", err)
+	}
+	if err := writeFrame(conn, frameExec, data); err != nil {
+		return -1, fmt.Errorf("vsock: send exec request: %w", err)
+	}
+	return Attach(ctx, conn, stdin, stdout, stderr)
+}
+
+// sendStdin copies stdin to the guest and then signals its end. Errors mean
+// the session is over and are left for the reader to report.
+func sendStdin(w *frameWriter, stdin io.Reader) {
+	if stdin != nil {
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if werr := w.send(frameStdin, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	_ = w.send(frameStdinClose, nil)
+}
@@ -0,0 +1,118 @@
+// Package vsock implements the control channel between the microVM executor
+// and the fledge-agent running inside a build VM. The guest streams a step's
+// output and exit code to the host as it runs, and the host can open further
+// sessions to execute commands in a running VM.
+//
+// Cloud Hypervisor exposes guest vsock through a Unix socket on the host:
+// guest connections to port P arrive on "<socket>_P", and host connections
+// to the socket itself are routed to a guest port by a "CONNECT P" handshake.
+package vsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// GuestCID is the context ID given to build VMs. Each VM has its own
+	// host socket, so they can all share it.
+	GuestCID = 3
+	// RunPort is the host port the agent connects to when a step starts.
+	RunPort = 10240
+	// ExecPort is the guest port the agent accepts exec sessions on.
+	ExecPort = 10241
+)
+
+// Frame types. Output and the exit code flow from guest to host; exec
+// requests and stdin flow from host to guest.
+const (
+	frameStdout byte = iota + 1
+	frameStderr
+	frameExit
+	frameStdin
+	frameStdinClose
+	frameExec
+)
+
+// maxFrame bounds a frame payload so a corrupt stream cannot make either
+// side allocate without limit.
+const maxFrame = 1 << 20
+
+// ErrNoExitCode is returned when the control channel closes before the
+// guest reported an exit code.
+var ErrNoExitCode = errors.New("guest closed the control channel without an exit code")
+
+// ExecRequest describes a command to run in a VM over an exec session.
+type ExecRequest struct {
+	Args []string `json:"args"`
+	Env  []string `json:"env,omitempty"`
+	Cwd  string   `json:"cwd,omitempty"`
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	var hdr [5]byte
+	hdr[0] = kind
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("vsock: frame of %d bytes exceeds limit", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+// frameWriter sends everything written to it as frames of one kind. Writers
+// sharing a connection share mu so frames are never interleaved.
+type frameWriter struct {
+	mu   *sync.Mutex
+	w    io.Writer
+	kind byte
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		if err := writeFrame(f.w, f.kind, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (f *frameWriter) send(kind byte, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return writeFrame(f.w, kind, payload)
+}
+
+func exitPayload(code int) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(int32(code)))
+	return b[:]
+}
@@ -0,0 +1,138 @@
+package vsock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestFrameWriter tests that large writes are split into bounded frames.
+func TestFrameWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &frameWriter{mu: &sync.Mutex{}, w: &buf, kind: frameStdout}
+	data := bytes.Repeat([]byte("x"), maxFrame+10)
+	if n, err := w.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+
+	var got []byte
+	for frames := 0; ; frames++ {
+		kind, payload, err := readFrame(&buf)
+		if errors.Is(err, io.EOF) {
+			if frames != 2 {
+				t.Errorf("Expected 2 frames, got %d", frames)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("readFrame() error = %v", err)
+		}
+		if kind != frameStdout {
+			t.Errorf("Expected stdout frame, got %d", kind)
+		}
+		got = append(got, payload...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Reassembled payload differs from the write")
+	}
+}
+
+// TestAttach tests streaming a guest session's output, stdin and exit code.
+func TestAttach(t *testing.T) {
+	host, guest := net.Pipe()
+	go func() {
+		defer guest.Close()
+		w := &frameWriter{mu: &sync.Mutex{}, w: guest}
+		var stdin []byte
+		for {
+			kind, payload, err := readFrame(guest)
+			if err != nil {
+				return
+			}
+			if kind == frameStdin {
+				stdin = append(stdin, payload...)
+			}
+			if kind == frameStdinClose {
+				break
+			}
+		}
+		_ = w.send(frameStdout, []byte("echo: "+string(stdin)))
+		_ = w.send(frameStderr, []byte("warning"))
+		_ = w.send(frameExit, exitPayload(3))
+	}()
+
+	var stdout, stderr bytes.Buffer
+	code, err := Attach(context.Background(), host, strings.NewReader("hello"), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	if code != 3 {
+		t.Errorf("Expected exit code 3, got %d", code)
+	}
+	if stdout.String() != "echo: hello" || stderr.String() != "warning" {
+		t.Errorf("Unexpected output: stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+// TestAttach_NoExitCode tests a session that ends before reporting an exit code.
+func TestAttach_NoExitCode(t *testing.T) {
+	host, guest := net.Pipe()
+	go func() {
+		_, _, _ = readFrame(guest)
+		guest.Close()
+	}()
+	if _, err := Attach(context.Background(), host, nil, nil, nil); !errors.Is(err, ErrNoExitCode) {
+		t.Errorf("Expected ErrNoExitCode, got %v", err)
+	}
+}
+
+// TestExec tests the CONNECT handshake and exec request sent to the guest.
+func TestExec(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "vm.vsock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		line, _ := br.ReadString('\n')
+		if line != fmt.Sprintf("CONNECT %d\n", ExecPort) {
+			return
+		}
+		fmt.Fprintf(conn, "OK 1073741824\n")
+		_, payload, err := readFrame(br)
+		if err != nil {
+			return
+		}
+		var req ExecRequest
+		_ = json.Unmarshal(payload, &req)
+		w := &frameWriter{mu: &sync.Mutex{}, w: conn}
+		_ = w.send(frameStdout, []byte(strings.Join(req.Args, " ")+" in "+req.Cwd))
+		_ = w.send(frameExit, exitPayload(0))
+	}()
+
+	var stdout bytes.Buffer
+	code, err := Exec(context.Background(), socket, ExecRequest{Args: []string{"ls", "-l"}, Cwd: "/src"}, nil, &stdout, nil)
+	if err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+	if code != 0 || stdout.String() != "ls -l in /src" {
+		t.Errorf("Exec() = %d, stdout %q", code, stdout.String())
+	}
+}
@@ -0,0 +1,392 @@
+// Package fledge builds Volant plugin artifacts from Go programs, such as a
+// Volant operator, with the same builders the fledge command runs.
+//
+// A build reads a fledge.toml, loaded with LoadConfig or ParseConfig, and
+// writes the artifact and its manifest, checksum files and optional SBOM
+// and report:
+//
+//	cfg, err := fledge.LoadConfig("plugins/nginx/fledge.toml")
+//	if err != nil {
+//		return err
+//	}
+//	res, err := fledge.Build(ctx, cfg, fledge.Options{
+//		WorkDir: "plugins/nginx",
+//		Output:  "dist/nginx.img",
+//		Progress: func(ev fledge.Event) {
+//			log.Println(ev.Kind, ev.Step, ev.Err)
+//		},
+//	})
+//
+// Builds need root privileges for loop devices and mounts, as the fledge
+// command does. Logging is off unless enabled with SetLogHandler.
+package fledge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/volantvm/fledge/internal/builder"
+	"github.com/volantvm/fledge/internal/config"
+	"github.com/volantvm/fledge/internal/lock"
+	"github.com/volantvm/fledge/internal/logging"
+	"github.com/volantvm/fledge/internal/report"
+)
+
+// Config is a parsed fledge.toml.
+type Config = config.Config
+
+// ManifestTemplate is a parsed manifest.toml, the runtime defaults merged
+// into the generated manifest.json.
+type ManifestTemplate = config.ManifestTemplate
+
+// SizeBreakdown attributes the rootfs size to directories and sources.
+type SizeBreakdown = report.SizeBreakdown
+
+// Build strategies.
+const (
+	StrategyOCIRootfs = config.StrategyOCIRootfs
+	StrategyInitramfs = config.StrategyInitramfs
+)
+
+// Checksum algorithms Options.Checksums can name.
+const (
+	ChecksumSHA256 = builder.ChecksumSHA256
+	ChecksumSHA512 = builder.ChecksumSHA512
+)
+
+// Version is the fledge release recorded in build reports and input
+// digests.
+var Version = "dev"
+
+// LoadConfig loads and validates the fledge.toml at path, applying
+// overrides in the key=value form of fledge build --set.
+func LoadConfig(path string, overrides ...string) (*Config, error) {
+	return config.LoadWithOverrides(path, overrides)
+}
+
+// ParseConfig is like LoadConfig but parses the fledge.toml in data, for
+// programs that generate or store configurations themselves.
+func ParseConfig(data []byte, overrides ...string) (*Config, error) {
+	return config.Parse(data, overrides)
+}
+
+// LoadManifestTemplate loads and validates the manifest.toml at path.
+func LoadManifestTemplate(path string) (*ManifestTemplate, error) {
+	return config.LoadManifestTemplate(path)
+}
+
+// DefaultManifestTemplate returns the runtime defaults used when a build
+// has no manifest.toml.
+func DefaultManifestTemplate() *ManifestTemplate {
+	return config.DefaultManifestTemplate()
+}
+
+// SetLogHandler sends fledge's log records to h; nil, the default, discards
+// them. Records of a build carry its build_id and step attributes.
+func SetLogHandler(h slog.Handler) {
+	logging.SetHandler(h)
+}
+
+// PostProcessor processes finished artifacts, such as scanning them for
+// viruses or watermarking them, before their checksum files are written.
+type PostProcessor = builder.PostProcessor
+
+// PostProcessInput is the artifact and manifest a PostProcessor is given.
+type PostProcessInput = builder.PostProcessInput
+
+// PostProcessResult is a replacement artifact and the metadata a
+// PostProcessor records in the manifest.
+type PostProcessResult = builder.PostProcessResult
+
+// PostProcessFunc adapts a function to a PostProcessor.
+type PostProcessFunc = builder.PostProcessFunc
+
+// RegisterPostProcessor registers p to process the artifact of every build
+// as name, in name order and before a fledge.toml [postprocess] command; a
+// nil p unregisters it.
+func RegisterPostProcessor(name string, p PostProcessor) {
+	builder.RegisterPostProcessor(name, p)
+}
+
+// Options configure a build.
+type Options struct {
+	// WorkDir is the directory relative paths in the config resolve
+	// against, normally the one holding fledge.toml. Empty means the
+	// current directory.
+	WorkDir string
+	// Output is the artifact path. The oci_rootfs strategy may change its
+	// extension to match the filesystem type; Result.Output has the path
+	// written.
+	Output string
+	// Manifest holds the runtime defaults; nil uses
+	// DefaultManifestTemplate.
+	Manifest *ManifestTemplate
+	// LockFile is the fledge.lock recording the digests remote inputs
+	// resolved to; empty records nothing.
+	LockFile string
+	// Locked fails the build when a remote input resolves differently than
+	// LockFile records.
+	Locked bool
+	// SkipUnchanged skips the build when Output was already built from the
+	// same inputs, like fledge build without --force.
+	SkipUnchanged bool
+	// SkipVerify skips the consistency check of the finished artifact.
+	SkipVerify bool
+	// CopyDeps copies shared libraries that mapped executables need from
+	// the host instead of only warning that they are missing.
+	CopyDeps bool
+	// SizeReport attributes the rootfs size to directories and sources in
+	// Result.SizeBreakdown.
+	SizeReport bool
+	// Checksums lists the algorithms <output>.<algorithm> checksum files
+	// are written for; empty writes <output>.sha256.
+	Checksums []string
+	// SBOM writes an SPDX document of the artifact and its resolved inputs
+	// to <output>.spdx.json.
+	SBOM bool
+	// Report writes <output>.report.json.
+	Report bool
+	// Progress, if set, is called with the events of the build, one at a
+	// time.
+	Progress func(Event)
+}
+
+// EventKind says what an Event reports.
+type EventKind string
+
+const (
+	// EventStepStarted reports that a build step started.
+	EventStepStarted EventKind = "step_started"
+	// EventStepFinished reports that a build step finished, failed when
+	// Event.Err is set.
+	EventStepFinished EventKind = "step_finished"
+	// EventWarning reports a warning logged by the build.
+	EventWarning EventKind = "warning"
+)
+
+// Event is a progress update of a build.
+type Event struct {
+	Kind EventKind
+	// Step names the build step, e.g. "Unpack image layers".
+	Step string
+	// Duration is how long a finished step took.
+	Duration time.Duration
+	// Err is why a step failed.
+	Err error
+	// Message is the text of a warning, with its attributes.
+	Message string
+}
+
+// Result describes a finished build.
+type Result struct {
+	// Output is the artifact path.
+	Output string
+	// Strategy is the build strategy, StrategyOCIRootfs or
+	// StrategyInitramfs.
+	Strategy string
+	// SHA256 is the artifact's checksum; it is empty for skipped builds.
+	SHA256 string
+	// Manifest is the path of the generated manifest.json.
+	Manifest string
+	// Files lists the other files written next to the artifact: checksum
+	// files and, when requested, the SBOM and report.
+	Files []string
+	// Skipped is set when SkipUnchanged found the artifact up to date.
+	Skipped bool
+	// InputsDigest identifies everything the build read; empty when it
+	// could not be determined.
+	InputsDigest string
+	// Duration is how long the build took.
+	Duration time.Duration
+	// Steps lists the build steps in the order they ran.
+	Steps []Step
+	// Warnings are the warnings logged by the build.
+	Warnings []string
+	// SizeBreakdown is set with Options.SizeReport.
+	SizeBreakdown *SizeBreakdown
+}
+
+// Step is a build step of a Result.
+type Step struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Build builds the artifact of cfg, which LoadConfig or ParseConfig
+// returned. It may be called concurrently for different outputs.
+func Build(ctx context.Context, cfg *Config, opts Options) (*Result, error) {
+	if cfg == nil {
+		return nil, errors.New("a configuration is required")
+	}
+	if err := config.Validate(cfg); err != nil {
+		return nil, fmt.Errorf("validation failed: %w", err)
+	}
+	if opts.Output == "" {
+		return nil, errors.New("an output path is required")
+	}
+	switch cfg.Strategy {
+	case StrategyOCIRootfs, StrategyInitramfs:
+	default:
+		return nil, fmt.Errorf("unknown build strategy: %s", cfg.Strategy)
+	}
+	workDir, err := filepath.Abs(opts.WorkDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve work directory: %w", err)
+	}
+	if opts.Manifest == nil {
+		opts.Manifest = DefaultManifestTemplate()
+	}
+	if len(opts.Checksums) == 0 {
+		opts.Checksums = []string{ChecksumSHA256}
+	}
+	var tracker *lock.Tracker
+	if opts.LockFile != "" {
+		if tracker, err = lock.Open(opts.LockFile, opts.Locked); err != nil {
+			return nil, err
+		}
+	} else if opts.Locked {
+		return nil, errors.New("a locked build requires a lock file")
+	}
+
+	ctx = logging.NewContext(ctx, logging.KeyBuildID, newBuildID())
+	res := &Result{Output: opts.Output, Strategy: cfg.Strategy, Manifest: opts.Output + ".manifest.json"}
+	if res.InputsDigest, err = builder.InputsDigest(ctx, cfg, opts.Manifest, workDir, opts.Output, Version); err != nil {
+		logging.InfoContext(ctx, "Cannot tell whether build inputs changed", "reason", err)
+		res.InputsDigest = ""
+	} else if opts.SkipUnchanged && builder.UpToDate(cfg, workDir, opts.Output, res.InputsDigest) && filesExist(distFiles(opts.Output, opts)) {
+		res.Skipped = true
+		res.Files = distFiles(opts.Output, opts)
+		return res, nil
+	}
+	if err := os.Remove(opts.Output + builder.InputsSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove build inputs record: %w", err)
+	}
+
+	rep := report.New(Version, cfg.Strategy, opts.Output)
+	stopWarnings := logging.OnBuildWarn(ctx, func(msg string, args []any) {
+		rep.Warn(msg, args)
+		if opts.Progress != nil {
+			opts.Progress(Event{Kind: EventWarning, Message: report.FormatWarning(msg, args)})
+		}
+	})
+	err = run(ctx, cfg, workDir, opts, tracker, rep, res)
+	stopWarnings()
+	rep.Finish(err)
+	res.Duration = time.Duration(rep.DurationMS) * time.Millisecond
+	for _, s := range rep.Steps {
+		res.Steps = append(res.Steps, Step{Name: s.Name, Duration: time.Duration(s.DurationMS) * time.Millisecond})
+	}
+	res.Warnings = rep.Warnings
+	if opts.Report {
+		if werr := rep.Write(); werr != nil {
+			logging.WarnContext(ctx, "Failed to write build report", "error", werr)
+		} else {
+			res.Files = append(res.Files, rep.Path())
+		}
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if res.InputsDigest != "" {
+		if err := builder.RecordInputs(res.Output, res.InputsDigest); err != nil {
+			logging.WarnContext(ctx, "Failed to record build inputs", "error", err)
+		}
+	}
+	if err := tracker.Save(); err != nil {
+		logging.WarnContext(ctx, "Failed to update lock file", "path", opts.LockFile, "error", err)
+	}
+	return res, nil
+}
+
+// run builds the artifact of cfg with the builder of its strategy and fills
+// in the artifact fields of res.
+func run(ctx context.Context, cfg *Config, workDir string, opts Options, tracker *lock.Tracker, rep *report.Report, res *Result) error {
+	onStep := func(ev builder.StepEvent) {
+		if opts.Progress == nil {
+			return
+		}
+		if !ev.Done {
+			opts.Progress(Event{Kind: EventStepStarted, Step: ev.Name})
+			return
+		}
+		opts.Progress(Event{Kind: EventStepFinished, Step: ev.Name, Duration: ev.Duration, Err: ev.Err})
+	}
+
+	var (
+		output   string
+		checksum string
+		sizes    *report.SizeBreakdown
+		err      error
+	)
+	if cfg.Strategy == StrategyOCIRootfs {
+		b := builder.NewOCIRootfsBuilder(cfg, opts.Manifest, workDir, opts.Output)
+		b.Lock = tracker
+		b.Report = rep
+		b.TrackSizes = opts.SizeReport
+		b.CopyDeps = opts.CopyDeps
+		b.SkipVerify = opts.SkipVerify
+		b.Checksums = opts.Checksums
+		b.SBOM = opts.SBOM
+		b.OnStep = onStep
+		err = b.BuildContext(ctx)
+		output, checksum, sizes = b.OutputPath, b.Checksum(), b.SizeBreakdown
+	} else {
+		b := builder.NewInitramfsBuilder(cfg, opts.Manifest, workDir, opts.Output)
+		b.Lock = tracker
+		b.Report = rep
+		b.TrackSizes = opts.SizeReport
+		b.CopyDeps = opts.CopyDeps
+		b.SkipVerify = opts.SkipVerify
+		b.Checksums = opts.Checksums
+		b.SBOM = opts.SBOM
+		b.OnStep = onStep
+		err = b.BuildContext(ctx)
+		output, checksum, sizes = b.OutputPath, b.Checksum(), b.SizeBreakdown
+	}
+	if err != nil {
+		return err
+	}
+	res.Output = output
+	res.Manifest = output + ".manifest.json"
+	res.SHA256 = checksum
+	res.SizeBreakdown = sizes
+	res.Files = append(distFiles(output, opts), res.Files...)
+	return nil
+}
+
+// distFiles returns the checksum files and SBOM a build of output writes.
+func distFiles(output string, opts Options) []string {
+	var files []string
+	for _, algorithm := range opts.Checksums {
+		files = append(files, output+"."+algorithm)
+	}
+	if opts.SBOM {
+		files = append(files, output+builder.SBOMSuffix)
+	}
+	return files
+}
+
+// filesExist reports whether all paths exist.
+func filesExist(paths []string) bool {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// newBuildID returns a random ID tagging the log records of one build.
+func newBuildID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,89 @@
+package fledge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/volantvm/fledge/internal/builder"
+)
+
+// TestBuildSkipUnchanged tests that an artifact built from the same inputs
+// is not rebuilt, without needing root.
+func TestBuildSkipUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Dockerfile", "FROM scratch\nCOPY app /app\n")
+	write("app", "v1")
+
+	cfg, err := ParseConfig([]byte("version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\ndockerfile = \"Dockerfile\"\n"))
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	output := filepath.Join(dir, "app.squashfs")
+	digest, err := builder.InputsDigest(context.Background(), cfg, DefaultManifestTemplate(), dir, output, Version)
+	if err != nil {
+		t.Fatalf("InputsDigest failed: %v", err)
+	}
+	write("app.squashfs", "artifact")
+	write("app.squashfs.manifest.json", "{}")
+	write("app.squashfs.sha256", "sum  app.squashfs\n")
+	if err := builder.RecordInputs(output, digest); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	res, err := Build(context.Background(), cfg, Options{
+		WorkDir:       dir,
+		Output:        output,
+		SkipUnchanged: true,
+		Progress:      func(ev Event) { events = append(events, ev) },
+	})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if !res.Skipped || res.InputsDigest != digest {
+		t.Errorf("Build() = %+v, want a skipped build with inputs %s", res, digest)
+	}
+	if want := []string{output + ".sha256"}; !slices.Equal(res.Files, want) {
+		t.Errorf("Files = %v, want %v", res.Files, want)
+	}
+	if len(events) != 0 {
+		t.Errorf("Skipped build reported events: %v", events)
+	}
+}
+
+// TestBuildInvalidOptions tests that builds without a config, an output or
+// a lock file to check against are rejected before anything runs.
+func TestBuildInvalidOptions(t *testing.T) {
+	cfg, err := ParseConfig([]byte("version = \"1\"\nstrategy = \"oci_rootfs\"\n\n[source]\nimage = \"alpine:3.19\"\n"))
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	tests := []struct {
+		name    string
+		cfg     *Config
+		opts    Options
+		wantErr string
+	}{
+		{"no config", nil, Options{Output: "out.img"}, "configuration is required"},
+		{"no output", cfg, Options{}, "output path is required"},
+		{"locked without lock file", cfg, Options{Output: "out.img", Locked: true}, "requires a lock file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Build(context.Background(), tt.cfg, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Build() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}